@@ -0,0 +1,450 @@
+// Package client is a Go client for the vfdserver REST and WebSocket API.
+//
+// It covers the endpoints automation needs: live drive data (/api/devices and /ws),
+// control (/api/control), curtailment (/api/curtail), hand/auto (/api/hand), connecting and
+// disconnecting drives (/api/vfdconnect), the control event log (/api/control-events) and
+// server status (/api/status). The types mirror the server's JSON, so a field renamed on
+// the server shows up here as a compile error instead of a silent zero value.
+//
+//    c := client.New("http://10.33.10.53", "fan-optimizer", "1.4.0")
+//    drives, err := c.Devices(ctx)
+//    err = c.Control(ctx, client.ControlRequest{Drives: []string{"10.33.30.11"}, Action: client.ActionSetSpeed, Speed: 45})
+package client
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Control actions accepted by /api/control
+const (
+    ActionStart       = "Start"
+    ActionStop        = "Stop"
+    ActionFanhold     = "Fanhold"
+    ActionFreespin    = "Freespin"
+    ActionSetSpeed    = "SetSpeed"
+    ActionReverse     = "Reverse"
+    ActionJog         = "Jog"
+    ActionApplyPreset = "ApplyPreset"
+    ActionSetCfm      = "SetCfm"
+)
+
+// DriveStatus is one drive from /api/devices or the WebSocket: its config and live data.
+// Status is "Running", "Stopped", "Tripped", "Unavailable", "Disabled", "Remote" (another
+// shard polls it) or "Waiting" before the first poll.
+type DriveStatus struct {
+    ID            string  `json:"id"`
+    IP            string  `json:"ip"`
+    Group         string  `json:"group"`
+    FanNumber     int     `json:"fanNumber"`
+    FanDesc       string  `json:"fanDesc"`
+    DriveType     string  `json:"DriveType,omitempty"` // /api/devices only
+    RpmToHz       float64 `json:"rpmToHz"`
+    CfmRpm        float64 `json:"cfmRpm"`
+    SetSpeed      float64 `json:"setSpeed"`    // Hz
+    ActualSpeed   float64 `json:"actualSpeed"` // Hz
+    ActualPercent float64 `json:"actualPercent"`
+    RpmSpeed      int     `json:"rpmSpeed"`
+    ActualCfm     int     `json:"actualCfm"`
+    Current       float64 `json:"current"` // A
+    Power         *float64 `json:"power,omitempty"` // kW, drives with an OutputPower register
+    Clockwise     int     `json:"clockwise"`
+    Direction     string  `json:"direction,omitempty"` // "forward" or "reverse"
+    DirectionMismatch bool `json:"directionMismatch,omitempty"`
+    FaultCode     *int    `json:"faultCode,omitempty"`
+    FaultText     string  `json:"faultText,omitempty"`
+    Status        string  `json:"status"`
+    LastUpdated   int64   `json:"lastUpdated"` // Unix seconds
+    Shard         string  `json:"shard,omitempty"`
+    Tagout        *Tagout `json:"tagout,omitempty"`
+    Hand          *Hand   `json:"hand,omitempty"`
+    Extra         map[string]float64 `json:"extra,omitempty"`
+}
+
+// Tagout is a maintenance tag on a drive
+type Tagout struct {
+    User   string    `json:"user"`
+    Reason string    `json:"reason"`
+    SetAt  time.Time `json:"setAt"`
+}
+
+// Hand is who put a drive in hand, and why
+type Hand struct {
+    User   string    `json:"user"`
+    Reason string    `json:"reason,omitempty"`
+    Since  time.Time `json:"since"`
+}
+
+// ControlRequest is the body of POST /api/control. Drives are IDs or IPs.
+type ControlRequest struct {
+    Drives         []string `json:"drives"`
+    Action         string   `json:"action"`
+    Speed          float64  `json:"speed,omitempty"` // Hz, for SetSpeed and Reverse
+    Acknowledge    bool     `json:"acknowledge,omitempty"`
+    Synchronized   bool     `json:"synchronized,omitempty"`
+    QueueIfOffline bool     `json:"queueIfOffline,omitempty"`
+    QueueTTLSec    int      `json:"queueTTLSec,omitempty"`
+    Preset         string   `json:"preset,omitempty"` // ApplyPreset
+    Hand           bool     `json:"hand,omitempty"`
+    User           string   `json:"user,omitempty"` // required with Hand
+    Cfm            float64  `json:"cfm,omitempty"` // SetCfm: airflow per fan in Drives, or per group in Groups
+    Groups         []string `json:"groups,omitempty"` // SetCfm
+}
+
+// ControlEvent is one entry of the control event log
+type ControlEvent struct {
+    Timestamp time.Time        `json:"timestamp"`
+    Action    string           `json:"action"`
+    Speed     float64          `json:"speed"`
+    Drives    []DriveEventInfo `json:"drives"`
+    Detail    string           `json:"detail,omitempty"`
+}
+
+// DriveEventInfo is a drive's outcome in a control event
+type DriveEventInfo struct {
+    ID           string `json:"id,omitempty"`
+    IP           string `json:"ip"`
+    Success      bool   `json:"success"`
+    Error        string `json:"error,omitempty"`
+    Superseded   bool   `json:"superseded,omitempty"`
+    Queued       bool   `json:"queued,omitempty"`
+    Warning      string `json:"warning,omitempty"`
+    VerifyFailed bool   `json:"verifyFailed,omitempty"`
+}
+
+// CurtailmentState is the curtailment in effect: what each curtailed drive was doing
+type CurtailmentState struct {
+    ID        string                `json:"id"`
+    User      string                `json:"user,omitempty"` // who started it
+    Timestamp time.Time             `json:"timestamp"`
+    Groups    []string              `json:"groups"`
+    Drives    []CurtailedDriveState `json:"drives"`
+    ResumeAt  *time.Time            `json:"resumeAt,omitempty"` // resumed automatically at this time
+    Target    *CurtailTarget        `json:"target,omitempty"`   // running drives slowed down instead of stopped
+    Rotation  *CurtailRotation      `json:"rotation,omitempty"` // rolling: Drives are the groups whose turn it is
+    Shed      *CurtailShed          `json:"shed,omitempty"`     // power-target curtailment
+}
+
+// CurtailedDriveState is a curtailed drive's speed and status before it was curtailed
+type CurtailedDriveState struct {
+    IP        string  `json:"ip"`
+    Group     string  `json:"group"`
+    SetSpeed  float64 `json:"setSpeed"`
+    Status    string  `json:"status"`
+    ReducedHz float64 `json:"reducedHz,omitempty"` // partial curtailment: the speed it was lowered to
+    PowerKW   float64 `json:"powerKW,omitempty"`   // power when curtailed
+}
+
+// CurtailTarget is a partial curtailment's speed, in Hz or percent of each drive's speed,
+// or the power to shed in kW
+type CurtailTarget struct {
+    Hz      float64 `json:"hz,omitempty"`
+    Percent float64 `json:"percent,omitempty"`
+    KW      float64 `json:"kw,omitempty"`
+}
+
+// CurtailShed is a power-target curtailment's requested, planned and measured reduction in kW
+type CurtailShed struct {
+    TargetKW    float64  `json:"targetKW"`
+    EstimatedKW float64  `json:"estimatedKW"`
+    MeasuredKW  *float64 `json:"measuredKW,omitempty"`
+}
+
+// CurtailRotation is a rolling curtailment: Count of Groups at a time, handed on every EveryMin
+type CurtailRotation struct {
+    Groups   []string  `json:"groups"`
+    Count    int       `json:"count"`
+    EveryMin int       `json:"everyMin"`
+    Index    int       `json:"index"`
+    NextAt   time.Time `json:"nextAt"`
+}
+
+// CurtailResult is the response to a curtail or resume
+type CurtailResult struct {
+    ID             string       `json:"id"` // the curtailment session
+    Success        bool         `json:"success"`
+    Message        string       `json:"message"`
+    DriveCount     int          `json:"driveCount"`
+    Groups         []string     `json:"groups"`
+    CriticalDrives []string     `json:"criticalDrives,omitempty"`     // NeverCurtail drives, left running
+    ReservedDrives []string     `json:"reservedDrives,omitempty"`     // kept running for airflow reservations
+    HandDrives     []string     `json:"handDrives,omitempty"`         // left alone because they are in hand
+    OtherSessions  []string     `json:"otherSessionDrives,omitempty"` // left to the other curtailments holding them
+    Shed           *CurtailShed `json:"shed,omitempty"`               // power-target curtailment
+}
+
+// Status is the server's readiness from /api/status
+type Status struct {
+    Loading                bool      `json:"loading"`
+    Ready                  bool      `json:"ready"`
+    InitialConnectionsDone bool      `json:"initialConnectionsDone"`
+    TotalVFDs              int       `json:"totalVFDs"`
+    ConnectedVFDs          int       `json:"connectedVFDs"`
+    HealthyVFDs            int       `json:"healthyVFDs"`
+    LastUpdateTime         time.Time `json:"lastUpdateTime"`
+    ExcludedVFDs           []string  `json:"excludedVFDs,omitempty"`
+}
+
+// Error is a non-2xx response. Body is the server's message or JSON error document.
+type Error struct {
+    StatusCode int
+    Body       string
+}
+
+func (e *Error) Error() string {
+    return fmt.Sprintf("vfdserver: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Client talks to one vfdserver. Name and Version identify it on the WebSocket
+// (/api/ws-clients); a Token (one of the server's APITokens) is sent as a bearer token;
+// the zero HTTPClient uses a 30s timeout.
+type Client struct {
+    BaseURL    string
+    Name       string
+    Version    string
+    Token      string
+    HTTPClient *http.Client
+}
+
+// header returns the headers sent with every request
+func (c *Client) header() http.Header {
+    h := http.Header{}
+    if c.Token != "" {
+        h.Set("Authorization", "Bearer "+c.Token)
+    }
+    return h
+}
+
+// New returns a client for the server at baseURL, e.g. "http://10.33.10.53"
+func New(baseURL, name, version string) *Client {
+    return &Client{
+        BaseURL:    strings.TrimRight(baseURL, "/"),
+        Name:       name,
+        Version:    version,
+        HTTPClient: &http.Client{Timeout: 30 * time.Second},
+    }
+}
+
+// do sends a request with an optional JSON body and decodes a JSON response into out, if given
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+    var rd io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        rd = bytes.NewReader(data)
+    }
+    req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, rd)
+    if err != nil {
+        return err
+    }
+    req.Header = c.header()
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    hc := c.HTTPClient
+    if hc == nil {
+        hc = &http.Client{Timeout: 30 * time.Second}
+    }
+    resp, err := hc.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    data, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return &Error{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+    }
+    if out == nil || len(data) == 0 {
+        return nil
+    }
+    if err := json.Unmarshal(data, out); err != nil {
+        return fmt.Errorf("vfdserver: decoding %s %s: %w", method, path, err)
+    }
+    return nil
+}
+
+// Devices returns every drive with its config and live data
+func (c *Client) Devices(ctx context.Context) ([]DriveStatus, error) {
+    var drives []DriveStatus
+    err := c.do(ctx, http.MethodGet, "/api/devices", nil, &drives)
+    return drives, err
+}
+
+// Device returns one drive by ID or IP
+func (c *Client) Device(ctx context.Context, ref string) (DriveStatus, error) {
+    drives, err := c.Devices(ctx)
+    if err != nil {
+        return DriveStatus{}, err
+    }
+    for _, d := range drives {
+        if d.ID == ref || d.IP == ref {
+            return d, nil
+        }
+    }
+    return DriveStatus{}, &Error{StatusCode: http.StatusNotFound, Body: "Unknown drive: " + ref}
+}
+
+// Control sends a control action. Refusals (speed limits, airflow reservations, shadow
+// mode) come back as an *Error; per-drive outcomes are in the control event log.
+func (c *Client) Control(ctx context.Context, req ControlRequest) error {
+    return c.do(ctx, http.MethodPost, "/api/control", req, nil)
+}
+
+// ControlEvents returns the control event log; a non-empty drive (ID or IP) keeps the
+// events that touched it
+func (c *Client) ControlEvents(ctx context.Context, drive string) ([]ControlEvent, error) {
+    path := "/api/control-events"
+    if drive != "" {
+        path += "?drive=" + url.QueryEscape(drive)
+    }
+    var events []ControlEvent
+    err := c.do(ctx, http.MethodGet, path, nil, &events)
+    return events, err
+}
+
+// Curtail saves the state of the drives in groups (all drives if none) and stops them
+func (c *Client) Curtail(ctx context.Context, groups ...string) (CurtailResult, error) {
+    if groups == nil {
+        groups = []string{}
+    }
+    var res CurtailResult
+    err := c.do(ctx, http.MethodPost, "/api/curtail", map[string]interface{}{"action": "curtail", "groups": groups}, &res)
+    return res, err
+}
+
+// ShedPower curtails groups (all drives if none) by slowing the running drives down just
+// enough to shed about kw
+func (c *Client) ShedPower(ctx context.Context, kw float64, groups ...string) (CurtailResult, error) {
+    if groups == nil {
+        groups = []string{}
+    }
+    var res CurtailResult
+    err := c.do(ctx, http.MethodPost, "/api/curtail", map[string]interface{}{"action": "curtail", "groups": groups, "shedKW": kw}, &res)
+    return res, err
+}
+
+// Resume restores the curtailed drives to their saved state. It needs a single curtailment
+// in effect; with several, use ResumeSession.
+func (c *Client) Resume(ctx context.Context) (CurtailResult, error) {
+    return c.ResumeSession(ctx, "")
+}
+
+// ResumeSession restores the drives of curtailment session id to their saved state. An
+// empty id means the only curtailment in effect.
+func (c *Client) ResumeSession(ctx context.Context, id string) (CurtailResult, error) {
+    var res CurtailResult
+    err := c.do(ctx, http.MethodPost, "/api/curtail", map[string]string{"action": "resume", "id": id}, &res)
+    return res, err
+}
+
+// Curtailment returns the most recent curtailment in effect, nil if there is none
+func (c *Client) Curtailment(ctx context.Context) (*CurtailmentState, error) {
+    var state CurtailmentState
+    err := c.do(ctx, http.MethodGet, "/api/curtail", nil, &state)
+    if e, ok := err.(*Error); ok && e.StatusCode == http.StatusNotFound {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &state, nil
+}
+
+// Curtailments returns every curtailment session in effect, oldest first
+func (c *Client) Curtailments(ctx context.Context) ([]CurtailmentState, error) {
+    var sessions []CurtailmentState
+    err := c.do(ctx, http.MethodGet, "/api/curtail/sessions", nil, &sessions)
+    return sessions, err
+}
+
+// SetHand puts a drive (ID or IP) in hand, so curtailment, schedules and automation leave it alone
+func (c *Client) SetHand(ctx context.Context, drive, user, reason string) error {
+    return c.do(ctx, http.MethodPost, "/api/hand/"+url.PathEscape(drive), map[string]string{"user": user, "reason": reason}, nil)
+}
+
+// SetAuto returns a drive (ID or IP) from hand to auto
+func (c *Client) SetAuto(ctx context.Context, drive, user string) error {
+    return c.do(ctx, http.MethodDelete, "/api/hand/"+url.PathEscape(drive), map[string]string{"user": user}, nil)
+}
+
+// SetConnected enables (connect) or disables (disconnect) polling of drives (IDs or IPs).
+// A disabled drive's connection is closed and it shows as "Disabled".
+func (c *Client) SetConnected(ctx context.Context, connected bool, drives ...string) error {
+    action := "disconnect"
+    if connected {
+        action = "connect"
+    }
+    return c.do(ctx, http.MethodPost, "/api/vfdconnect", map[string]interface{}{"ips": drives, "action": action}, nil)
+}
+
+// Status returns the server's readiness
+func (c *Client) Status(ctx context.Context) (Status, error) {
+    var st Status
+    err := c.do(ctx, http.MethodGet, "/api/status", nil, &st)
+    return st, err
+}
+
+// Watch streams live drive data from the WebSocket, calling fn with every update (about
+// once a second) until ctx is done, fn returns an error or the connection fails. It
+// returns ctx.Err() when cancelled; reconnecting is up to the caller.
+func (c *Client) Watch(ctx context.Context, fn func([]DriveStatus) error) error {
+    u, err := url.Parse(c.BaseURL)
+    if err != nil {
+        return err
+    }
+    switch u.Scheme {
+    case "https":
+        u.Scheme = "wss"
+    default:
+        u.Scheme = "ws"
+    }
+    u.Path = strings.TrimRight(u.Path, "/") + "/ws"
+    u.RawQuery = url.Values{"client": {c.Name}, "version": {c.Version}}.Encode()
+
+    conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), c.header())
+    if err != nil {
+        if resp != nil {
+            data, _ := io.ReadAll(resp.Body)
+            resp.Body.Close()
+            return &Error{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+        }
+        return err
+    }
+    defer conn.Close()
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        select {
+        case <-ctx.Done():
+            conn.Close()
+        case <-done:
+        }
+    }()
+
+    for {
+        var drives []DriveStatus
+        if err := conn.ReadJSON(&drives); err != nil {
+            if ctx.Err() != nil {
+                return ctx.Err()
+            }
+            return err
+        }
+        if err := fn(drives); err != nil {
+            return err
+        }
+    }
+}
@@ -16,19 +16,48 @@ package main
 import (
     "encoding/json"
     "fmt"
+    "io"
     "log"
+    "net"
     "net/http"
+    "net/smtp"
+    "net/url"
     "os"
     "context"
     "time"
     "sync"
+    "runtime"
     "sync/atomic"
     "math"
+    "math/rand"
+    crand "crypto/rand"
     "github.com/grid-x/modbus"
     "github.com/gorilla/websocket"
     "github.com/prometheus/client_golang/prometheus"
     "github.com/prometheus/client_golang/prometheus/promhttp"
+    "github.com/segmentio/kafka-go"
+    "github.com/nats-io/nats.go"
+    "github.com/nats-io/nats.go/jetstream"
     "strings"
+    "bytes"
+    "encoding/binary"
+    "regexp"
+    "sort"
+    "strconv"
+    "reflect"
+    "os/signal"
+    "syscall"
+    "errors"
+    "text/template"
+    "os/exec"
+    "path"
+    "path/filepath"
+    "crypto/sha256"
+    "crypto/subtle"
+    "flag"
+    "text/tabwriter"
+    apiclient "vfdserver/api/client"
+    "encoding/hex"
 )
 
 // =====================
@@ -47,9 +76,198 @@ type AppConfig struct {
     NoFanHold  bool          `json:"NoFanHold"`
     GroupLabel string        `json:"GroupLabel"`
     VFDs       []DriveConfig `json:"VFDs"`
+
+    // SetSpeed requests to the same drive within this window are coalesced and only
+    // the latest is written. Opt-in: 0 (default) or negative writes every request at once.
+    SetSpeedCoalesceMs int `json:"SetSpeedCoalesceMs,omitempty"`
+
+    // SetSpeed changes faster than this are stepped by the server (Hz per second, 0 = none)
+    MaxRampHzPerSec float64 `json:"MaxRampHzPerSec,omitempty"`
+
+    // Setpoint writes closer than this to the drive's current setpoint are skipped, sparing
+    // drives that keep the setpoint in EEPROM (Hz, 0 = none, at most 1)
+    SetpointDeadbandHz float64 `json:"SetpointDeadbandHz,omitempty"`
+
+    // Jog runs a stopped drive at JogHz (default 10) for JogSeconds (default 10, max 120)
+    JogHz      float64 `json:"JogHz,omitempty"`
+    JogSeconds int     `json:"JogSeconds,omitempty"`
+
+    // Default speed profile for /api/soak (default 20/40/60/80/100% for 10 minutes each)
+    SoakSteps []SoakStep `json:"SoakSteps,omitempty"`
+
+    // Flag drives for maintenance after this many run hours / starts since their last service (0 = none)
+    MaintenanceRunHours float64 `json:"MaintenanceRunHours,omitempty"`
+    MaintenanceStarts   int64   `json:"MaintenanceStarts,omitempty"`
+
+    // Open a second Modbus session per drive for commands, so a slow or hung poll never
+    // delays a stop. Drives that refuse a second session fall back to the shared one.
+    DedicatedWriteConnection bool `json:"DedicatedWriteConnection,omitempty"`
+
+    // Read back setpoint and control writes and rewrite those that didn't take
+    WriteVerify *WriteVerifyConfig `json:"WriteVerify,omitempty"`
+
+    // SetSpeed outside a drive's MinHz..HardMaxHz is clamped to the range (with a warning)
+    // instead of rejected
+    ClampSpeedLimits bool `json:"ClampSpeedLimits,omitempty"`
+
+    // Site-wide defaults for drives without their own write limits (0 = no limit)
+    WriteCooldownMs   int `json:"WriteCooldownMs,omitempty"`
+    WriteBudgetPerMin int `json:"WriteBudgetPerMin,omitempty"`
+
+    // Optional second listener (e.g. dashboard VLAN) serving only the read-only endpoints
+    ReadOnlyBindIP   string `json:"ReadOnlyBindIP,omitempty"`
+    ReadOnlyBindPort string `json:"ReadOnlyBindPort,omitempty"`
+    // Per-endpoint source allow-lists: path -> list of IPs/CIDRs. "*" applies to paths without their own entry.
+    AllowLists map[string][]string `json:"AllowLists,omitempty"`
+    // Named bearer tokens for API clients (e.g. `vfdserver ctl` on a jump host); the allow-lists still apply
+    APITokens []APIToken `json:"APITokens,omitempty"`
+
+    // /api/estop: an armed stop must be confirmed within EStopConfirmSec (default 30).
+    // A request carrying EStopToken stops in one call (wired panels, alarm integrations).
+    EStopConfirmSec int    `json:"EStopConfirmSec,omitempty"`
+    EStopToken      string `json:"EStopToken,omitempty"`
+
+    Kafka *KafkaConfig `json:"Kafka,omitempty"` // optional event/telemetry streaming
+    KNX   *KNXConfig   `json:"KNX,omitempty"`   // optional KNXnet/IP fan object mapping
+    NATS  *NATSConfig  `json:"NATS,omitempty"`  // optional status publishing / control subscription
+
+    Shadow *ShadowConfig `json:"Shadow,omitempty"` // run as a read-only shadow of a production instance
+
+    Sharding *ShardingConfig `json:"Sharding,omitempty"` // split polling across several instances behind one front-end
+
+    ConfigSync *ConfigSyncConfig `json:"ConfigSync,omitempty"` // pull config.json from Git or a config service
+
+    // Start ordering between groups: group -> groups that must be running before it starts
+    // (e.g. {"Supply": ["Exhaust"]}). Stops run in reverse. Applies when a request spans them.
+    GroupDependencies    map[string][]string `json:"GroupDependencies,omitempty"`
+    GroupStageTimeoutSec int                 `json:"GroupStageTimeoutSec,omitempty"` // per-stage verification timeout, default 30
+
+    // Delay between starting drives of the same group, to spread their inrush current.
+    // GroupStartStaggerMs overrides it per group (0 there = no stagger). 0 = start together.
+    StartStaggerMs      int            `json:"StartStaggerMs,omitempty"`
+    GroupStartStaggerMs map[string]int `json:"GroupStartStaggerMs,omitempty"`
+
+    // Enables /api/chaos latency/drop injection on drive connections. Staging only.
+    UnsafeChaos bool `json:"UnsafeChaos,omitempty"`
+
+    // /ws clients must identify themselves (?client=<name>&version=<v>) unless this is set
+    AllowAnonymousWebSocket bool `json:"AllowAnonymousWebSocket,omitempty"`
+
+    // Identify each drive on first connect and match it against the profiles' Identify:
+    // fills in a missing DriveType and flags a configured one the drive contradicts
+    DetectDriveType bool `json:"DetectDriveType,omitempty"`
+
+    // Per-site feature flag settings (flag name -> on/off) over the built-in defaults;
+    // /api/admin/flags overrides take precedence. Applied on reload.
+    FeatureFlags map[string]bool `json:"FeatureFlags,omitempty"`
+
+    // Start (and reload) without the drives that fail config validation instead of refusing
+    StartDegraded bool `json:"StartDegraded,omitempty"`
+
+    // Recurring control actions; more can be added at runtime through /api/schedules
+    Schedules []Schedule `json:"Schedules,omitempty"`
+
+    Guardrails *GuardrailConfig `json:"Guardrails,omitempty"` // self-monitoring limits for shedding work
+
+    Sensors []SensorConfig `json:"Sensors,omitempty"` // non-drive Modbus devices polled with the drives
+
+    ExternalSources []ExternalSourceConfig `json:"ExternalSources,omitempty"` // REST endpoints polled for named signals
+
+    DCIM *DCIMConfig `json:"DCIM,omitempty"` // scale group airflow with per-room IT power from the DCIM API
+
+    // Lead-lag rotation: groups that rest some fans in turn to even out run hours
+    Rotation []RotationConfig `json:"Rotation,omitempty"`
+
+    QuietHours []QuietHoursConfig `json:"QuietHours,omitempty"` // per-group speed caps during noise-sensitive windows
+
+    Notifications *NotificationConfig `json:"Notifications,omitempty"` // channels and routing for trip/offline/failure notices
+
+    AutoReset *AutoResetConfig `json:"AutoReset,omitempty"` // reset tripped drives automatically, with an hourly limit and lockout
+
+    SetpointWatchdog *SetpointWatchdogConfig `json:"SetpointWatchdog,omitempty"` // flag or re-assert setpoints changed outside the server
+
+    // Target-CFM control (SetCfm): trim once actual airflow is off by more than
+    // CfmTrimPercent (default 2) and speeds have been steady for CfmSettleSec (default 5)
+    CfmTrimPercent float64 `json:"CfmTrimPercent,omitempty"`
+    CfmSettleSec   int     `json:"CfmSettleSec,omitempty"`
+
+    // Current governor for drives with MaxCurrentA: each step lowers the setpoint by
+    // CurrentStepHz (default 2) after current has stayed over the limit for
+    // CurrentConfirmSec (default 5)
+    CurrentStepHz     float64 `json:"CurrentStepHz,omitempty"`
+    CurrentConfirmSec int     `json:"CurrentConfirmSec,omitempty"`
+
+    // How often profiles' EnergyCounter registers are read (default 60)
+    EnergyPollSec int `json:"EnergyPollSec,omitempty"`
+
+    Purge *PurgeConfig `json:"Purge,omitempty"` // smoke-control airflow profile, started from the API or a fire-panel input
+
+    Baselines *BaselineConfig `json:"Baselines,omitempty"` // learn each drive's normal current (and vibration) by speed and alert on deviations
+
+    History *HistoryConfig `json:"History,omitempty"` // in-memory setpoint/speed/current samples for /api/history
+
+    Mirror *MirrorConfig `json:"Mirror,omitempty"` // cached, rate-limited /api/mirror for third-party pollers, optionally on its own listener
+
+    Policies []AuthPolicy `json:"Policies,omitempty"` // who may do what to which groups, when, on /api/control and /api/curtail
+
+    DemandResponse *DemandResponseConfig `json:"DemandResponse,omitempty"` // deadline-driven curtailment tiers for /api/dr
+}
+
+// ShadowConfig turns the instance into a read-only validation shadow: no register writes,
+// no control/curtail API, no integrations or persisted stats, a slower poll, and every
+// poll compared against the primary's /api/devices. Tolerances default to 0.5.
+type ShadowConfig struct {
+    PrimaryURL        string  `json:"PrimaryURL"`     // e.g. "http://10.33.10.53:8080"
+    PollIntervalMs    int     `json:"PollIntervalMs"` // default 5000
+    FreqToleranceHz   float64 `json:"FreqToleranceHz"`
+    CurrentToleranceA float64 `json:"CurrentToleranceA"`
+    PowerToleranceKW  float64 `json:"PowerToleranceKW"`
+    ConfirmCount      int     `json:"ConfirmCount"` // consecutive mismatches before a field is divergent; default 3
+}
+
+// NATSConfig enables status publishing and control subscriptions over NATS.
+// Subjects live under SubjectPrefix (default "vfd.<SiteName>"):
+//   <prefix>.status.<ip>  per-drive status, published when it changes (IP dots become "_")
+//   <prefix>.events       control events (JetStream-persisted when EventsStream is set)
+//   <prefix>.control      subscribed; same JSON body as /api/control, replies with the event
+//   <prefix>.devices      subscribed; request-reply returning the full /api/devices snapshot
+type NATSConfig struct {
+    URL           string `json:"URL"`
+    SubjectPrefix string `json:"SubjectPrefix"`
+    CredsFile     string `json:"CredsFile"`
+    EventsStream  string `json:"EventsStream"`
+}
+
+// KNXConfig maps each fan to a standard group-address set on a KNXnet/IP tunnelling gateway.
+// Unless overridden in Fans, addresses are MainGroup/<function>/<FanNumber> with functions:
+// 0 switch, 1 switch status, 2 speed %, 3 speed status %, 4 fault status.
+type KNXConfig struct {
+    Gateway   string                     `json:"Gateway"`   // "ip:port", port defaults to 3671
+    MainGroup int                        `json:"MainGroup"` // 0-31
+    Fans      map[string]KNXFanAddresses `json:"Fans"`      // optional per-drive-IP overrides
+}
+
+// KNXFanAddresses is one fan's group-address set ("main/middle/sub" notation)
+type KNXFanAddresses struct {
+    Switch       string `json:"Switch"`       // DPT 1.001, written by the bus: start/stop
+    SwitchStatus string `json:"SwitchStatus"` // DPT 1.001, published: running
+    Speed        string `json:"Speed"`        // DPT 5.001, written by the bus: speed %
+    SpeedStatus  string `json:"SpeedStatus"`  // DPT 5.001, published: actual speed %
+    FaultStatus  string `json:"FaultStatus"`  // DPT 1.005, published: tripped
+}
+
+// KafkaConfig enables streaming of control events and per-poll telemetry to Kafka
+type KafkaConfig struct {
+    Brokers           []string `json:"Brokers"`
+    EventsTopic       string   `json:"EventsTopic"`       // empty disables event streaming
+    TelemetryTopic    string   `json:"TelemetryTopic"`    // empty disables telemetry streaming
+    Format            string   `json:"Format"`            // "json" (default) or "avro"
+    EventsSchemaID    int      `json:"EventsSchemaID"`    // Avro only: schema registry ID, 0 = no wire-format header
+    TelemetrySchemaID int      `json:"TelemetrySchemaID"` // Avro only: schema registry ID, 0 = no wire-format header
 }
 
 type DriveConfig struct {
+    ID           string  `json:"ID,omitempty"` // stable key for history and metrics; generated when empty
     IP           string  `json:"IP"`
     Port         int     `json:"Port"`
     Unit         int     `json:"Unit"`
@@ -61,6 +279,42 @@ type DriveConfig struct {
     CfmRpm       float64 `json:"CfmRpm"`
     DriveType    string  `json:"DriveType"`
     LastPull     int64   `json:"-"`
+
+    WriteCooldownMs   int `json:"WriteCooldownMs,omitempty"`   // min interval between writes; 0 = site default, negative = none
+    WriteBudgetPerMin int `json:"WriteBudgetPerMin,omitempty"` // max writes per minute; 0 = site default, negative = unlimited
+
+    MaxRampHzPerSec float64 `json:"MaxRampHzPerSec,omitempty"` // SetSpeed ramp limit; 0 = site default, negative = none
+    SetpointDeadbandHz float64 `json:"SetpointDeadbandHz,omitempty"` // 0 = site default, negative = none
+    JogHz           float64 `json:"JogHz,omitempty"`           // 0 = site default
+
+    MaintenanceRunHours float64 `json:"MaintenanceRunHours,omitempty"` // 0 = site default, negative = none
+    MaintenanceStarts   int64   `json:"MaintenanceStarts,omitempty"`   // 0 = site default, negative = none
+
+    SharedConnection bool `json:"SharedConnection,omitempty"` // never open a DedicatedWriteConnection (drive allows one session)
+
+    NeverCurtail bool `json:"NeverCurtail,omitempty"` // critical, e.g. serving a hot row: curtailments and demand response skip it
+
+    // Speed limit tiers for SetSpeed: above SoftMaxHz requires "acknowledge"; HardMaxHz is never exceeded. 0 = none
+    SoftMaxHz float64 `json:"SoftMaxHz,omitempty"`
+    HardMaxHz float64 `json:"HardMaxHz,omitempty"`
+    MinHz     float64 `json:"MinHz,omitempty"` // lowest SetSpeed; 0 = the profile's MinHz
+
+    // Current governor: above MaxCurrentA the setpoint is trimmed down in steps. 0 = none
+    MaxCurrentA float64 `json:"MaxCurrentA,omitempty"`
+
+    VibrationSignal string `json:"VibrationSignal,omitempty"` // "<sensor>.vibration" on this fan, learned by Baselines
+
+    Damper *DamperConfig `json:"Damper,omitempty"` // opened before starts, closed after stops
+
+    // Used to estimate energy for drives without an OutputPower register
+    LineVoltage float64 `json:"LineVoltage,omitempty"` // default 480
+    PowerFactor float64 `json:"PowerFactor,omitempty"` // default 0.85
+
+    MotorHP float64 `json:"MotorHP,omitempty"` // nameplate power; lets lint check CfmRpm against a plausible CFM/HP
+
+    // Profile fields that differ on this unit from its DriveType, e.g. {"Setpoint": [8193]}.
+    // Each named field replaces the profile's value whole (maps and lists are not merged).
+    ProfileOverrides json.RawMessage `json:"ProfileOverrides,omitempty"`
 }
 
 type VFDConfig map[string][]DriveConfig
@@ -73,6 +327,17 @@ type VFDConnection struct {
     port    int
     unit    byte
     healthy atomic.Bool
+    writer  atomic.Pointer[VFDConnection] // dedicated session for commands; nil = commands share this one
+    stop    bool                          // a stop is being written: exempt from the write limiter. Guarded by mu.
+}
+
+// commandConn returns the session commands should use: the dedicated write session while
+// it is healthy, else the shared one
+func (c *VFDConnection) commandConn() *VFDConnection {
+    if w := c.writer.Load(); w != nil && w.healthy.Load() {
+        return w
+    }
+    return c
 }
 
 type ControlEvent struct {
@@ -80,28 +345,120 @@ type ControlEvent struct {
     Action    string    `json:"action"`
     Speed     float64   `json:"speed"`
     Drives    []DriveEventInfo `json:"drives"`
+    Detail    string    `json:"detail,omitempty"` // what a non-drive action changed, e.g. the profile name for ProfileUpdate
 }
 
 type DriveEventInfo struct {
-    IP      string `json:"ip"`
-    Success bool   `json:"success"`
-    Error   string `json:"error,omitempty"`
+    ID         string `json:"id,omitempty"` // drive ID; absent on events from before drive IDs
+    IP         string `json:"ip"`
+    Success    bool   `json:"success"`
+    Error      string `json:"error,omitempty"`
+    Superseded bool   `json:"superseded,omitempty"` // SetSpeed dropped in favour of a newer request within the coalescing window
+    Queued     bool   `json:"queued,omitempty"`     // drive was Unavailable; command queued until it reconnects
+    Warning    string `json:"warning,omitempty"`    // e.g. acknowledged soft speed limit override
+    VerifyFailed bool `json:"verifyFailed,omitempty"` // a write was acknowledged but did not read back (WriteVerify)
 }
 
 type CurtailmentState struct {
+    ID        string                 `json:"id"`
+    User      string                 `json:"user,omitempty"`
     Timestamp time.Time              `json:"timestamp"`
     Groups    []string               `json:"groups"`
     Drives    []CurtailedDriveState  `json:"drives"`
+    ResumeAt  *time.Time             `json:"resumeAt,omitempty"` // resumed automatically at this time
+    Target    *CurtailTarget         `json:"target,omitempty"`   // reduce running drives instead of stopping them
+    Rotation  *CurtailRotation       `json:"rotation,omitempty"` // rolling: Drives are the groups whose turn it is
+    Shed      *CurtailShed           `json:"shed,omitempty"`     // power-target curtailment
+    Past      []CurtailedDriveState  `json:"past,omitempty"`     // rolling: drives restored at the end of their turn, for the history
 }
 
 type CurtailedDriveState struct {
-    IP       string  `json:"ip"`
-    Group    string  `json:"group"`
-    SetSpeed float64 `json:"setSpeed"`
-    Status   string  `json:"status"`
+    IP        string     `json:"ip"`
+    Group     string     `json:"group"`
+    SetSpeed  float64    `json:"setSpeed"`
+    Status    string     `json:"status"`
+    ReducedHz float64    `json:"reducedHz,omitempty"` // partial curtailment: the speed it was lowered to
+    PowerKW   float64    `json:"powerKW,omitempty"`   // power when curtailed
+    Since     time.Time  `json:"since"`
+    Until     *time.Time `json:"until,omitempty"`     // rolling: restored at the end of its turn
+}
+
+// CurtailTarget is a partial curtailment: running drives drop to Hz, or to Percent of
+// their speed, never below their MinHz and never up. With KW, the speeds are planned
+// across the drives to shed that much power (planShed).
+type CurtailTarget struct {
+    Hz      float64 `json:"hz,omitempty"`
+    Percent float64 `json:"percent,omitempty"`
+    KW      float64 `json:"kw,omitempty"`
+}
+
+// CurtailShed reports a power-target curtailment: the kW asked for, the reduction the
+// planned speeds should give, and (on GET) the reduction the drives now show
+type CurtailShed struct {
+    TargetKW    float64  `json:"targetKW"`
+    EstimatedKW float64  `json:"estimatedKW"`
+    MeasuredKW  *float64 `json:"measuredKW,omitempty"`
+}
+
+// reducedSpeed is the speed a partial curtailment lowers a drive running at hz to
+func (t CurtailTarget) reducedSpeed(d *DriveConfig, hz float64) float64 {
+    if t.KW > 0 {
+        return hz // planned for all drives together by planShed
+    }
+    target := t.Hz
+    if t.Percent > 0 {
+        target = math.Round(hz*t.Percent) / 100
+    }
+    lo, _ := speedRange(d)
+    return math.Min(math.Max(target, lo), hz)
+}
+
+// CurtailRotation is a rolling curtailment: Count of Groups are curtailed at a time, and
+// every EveryMin minutes the next Count take their place, so load is shed without any one
+// group going without airflow for the whole event
+type CurtailRotation struct {
+    Groups   []string  `json:"groups"` // in rotation order
+    Count    int       `json:"count"`
+    EveryMin int       `json:"everyMin"`
+    Index    int       `json:"index"` // position in Groups of the first curtailed group
+    NextAt   time.Time `json:"nextAt"`
+}
+
+// validate checks a rolling curtailment request: at least one group must be left running
+// at any time
+func (r CurtailRotation) validate() error {
+    if len(r.Groups) < 2 {
+        return fmt.Errorf("a rolling curtailment needs at least two groups")
+    }
+    if r.Count >= len(r.Groups) {
+        return fmt.Errorf("rotateCount must be less than the number of groups")
+    }
+    seen := make(map[string]bool)
+    for _, g := range r.Groups {
+        if seen[g] || len(getDrivesForGroups([]string{g})) == 0 {
+            return fmt.Errorf("group %q is repeated or has no drives", g)
+        }
+        seen[g] = true
+    }
+    return nil
 }
 
-const curtailmentStateFile = "/etc/vfd/curtailment_state.json"
+// active returns the groups curtailed when the turn starts at index
+func (r CurtailRotation) active(index int) []string {
+    groups := make([]string, 0, r.Count)
+    for i := 0; i < r.Count; i++ {
+        groups = append(groups, r.Groups[(index+i)%len(r.Groups)])
+    }
+    return groups
+}
+
+// Curtailments are kept by session ID in curtailmentsFile. curtailmentStateFile held the
+// single curtailment before sessions; it is read as one session until the next save.
+const (
+    curtailmentsFile     = "/etc/vfd/curtailments.json"
+    curtailmentStateFile = "/etc/vfd/curtailment_state.json"
+    legacyCurtailmentID  = "curtailment"
+)
 
 var upgrader = websocket.Upgrader{
     CheckOrigin: func(r *http.Request) bool {
@@ -129,6 +486,177 @@ type DriveTypeProfile struct {
     SignedOutputFreq bool          `json:"SignedOutputFreq"`
     MinHz           int            `json:"MinHz"`
     EnabledStatus   int            `json:"EnabledStatus"`
+    OutputPower     int            `json:"OutputPower"`      // optional; 0 = not read
+    OutPowerCalc    string         `json:"OutPowerCalc"`     // raw -> kW
+    SetpointReadCalc string        `json:"SetpointReadCalc"` // raw setpoint -> Hz when it differs from OutFreqCalc
+    DoubleWord      []string       `json:"DoubleWord"`       // fields stored as 32-bit values across two consecutive registers
+    WordOrder       string         `json:"WordOrder"`        // 32-bit word order: "big" (high word first, default) or "little"
+    FieldWordOrder  map[string]string `json:"FieldWordOrder"` // per-field WordOrder overrides
+    FieldRegisterType map[string]string `json:"FieldRegisterType"` // per-field RegisterType overrides for reads ("holding"/"input")
+    AddressBase     int            `json:"AddressBase"`      // number addresses count from: 0 = protocol address (default), 1 = 1-based manual, 40001/30001 = Modicon
+    FieldAddressBase map[string]int `json:"FieldAddressBase"` // per-field AddressBase overrides
+    StartSequence   []ControlStep  `json:"StartSequence"`    // ordered writes instead of StartValue
+    StopSequence    []ControlStep  `json:"StopSequence"`     // ordered writes instead of StopValue
+    UnTripSequence  []ControlStep  `json:"UnTripSequence"`   // ordered writes instead of UnTripValue
+    ReverseValue    int            `json:"ReverseValue"`     // control word that runs the drive backwards; 0 = no reverse
+    ReverseSequence []ControlStep  `json:"ReverseSequence"`  // ordered writes instead of ReverseValue
+    InvertedStatusBits []string    `json:"InvertedStatusBits"` // StatusBits names that are active when the bit is 0
+    SignedSetpoint  bool           `json:"SignedSetpoint"`   // setpoint is a signed reference (e.g. Danfoss ±16384)
+    ProbeRegister   int            `json:"ProbeRegister"`    // holding register used for connect/health probes (default 0)
+    EnterRegister   int            `json:"EnterRegister"`    // e.g. Yaskawa ENTER command (0x0910 RAM-only); 0 = none
+    EnterValue      int            `json:"EnterValue"`
+    EnterAfter      []string       `json:"EnterAfter"`       // write kinds ("Setpoint", "Control") that must be followed by ENTER
+    FaultCode       int            `json:"FaultCode"`        // register holding the active fault code; non-zero = Tripped. 0 = none
+    FaultCodeMask   int            `json:"FaultCodeMask"`    // bits of FaultCode that carry the code (e.g. 255 when the high byte is a warning); 0 = all
+    FaultCodes      map[string]string `json:"FaultCodes"`    // fault code (decimal) -> text reported as faultText
+    Constants       map[string]float64 `json:"Constants"`    // named values for the *Calc expressions (e.g. "maxHz": 60)
+    ExtraRegisters  []ExtraRegister `json:"ExtraRegisters"` // additional telemetry polled with the standard fields
+    EnergyCounter   int            `json:"EnergyCounter"`    // cumulative energy register, read every EnergyPollSec; 0 = energy is integrated from power
+    EnergyCalc      string         `json:"EnergyCalc"`       // raw -> kWh
+    EnergyRollover  float64        `json:"EnergyRollover"`   // raw value the counter wraps at; 0 = 65536, or 2^32 with DoubleWord
+    Identify        *DriveIdentity `json:"Identify"`        // how DetectDriveType recognizes this drive type
+
+    // Coil-based control (FC05) and status (FC01/FC02), for drives without a control word
+    StartCoil      *int           `json:"StartCoil"`      // set ON to run; set OFF to stop unless StopCoil is given
+    StopCoil       *int           `json:"StopCoil"`       // set ON to stop (momentary stop input)
+    UnTripCoil     *int           `json:"UnTripCoil"`     // pulsed ON then OFF to reset a trip
+    ReverseCoil    *int           `json:"ReverseCoil"`    // set ON with StartCoil to run backwards; OFF for forward
+    StatusCoils    map[string]int `json:"StatusCoils"`    // "Enabled"/"Tripped"/"Inhibited" -> coil; replaces the Status register
+    CoilStatusType string         `json:"CoilStatusType"` // "coil" (FC01, default) or "discrete" (FC02 discrete inputs)
+
+    NoReadBack []string `json:"NoReadBack"` // write kinds ("Setpoint", "Control") whose registers don't read back what was written
+}
+
+// needsEnter reports whether writes of the given kind must be committed with an ENTER command
+func (p DriveTypeProfile) needsEnter(kind string) bool {
+    if p.EnterRegister == 0 {
+        return false
+    }
+    for _, k := range p.EnterAfter {
+        if k == kind {
+            return true
+        }
+    }
+    return false
+}
+
+// statusInvertMask returns the bits to flip so every StatusBits entry reads active-high
+func (p DriveTypeProfile) statusInvertMask() int {
+    return p.invertMaskFor(p.StatusBits)
+}
+
+// invertMaskFor computes the inversion mask against a given name -> bit map (StatusBits,
+// or the bit layout built from StatusCoils)
+func (p DriveTypeProfile) invertMaskFor(bits map[string]int) int {
+    mask := 0
+    for _, name := range p.InvertedStatusBits {
+        if bit, ok := bits[name]; ok {
+            mask |= 1 << bit
+        }
+    }
+    return mask
+}
+
+// ExtraRegister is an additional telemetry register (DC bus voltage, heatsink temperature,
+// torque, ...) reported under "extra" in live data and as vfd_extra in Prometheus. Its raw
+// value is also available to the profile's *Calc expressions under Name. DoubleWord,
+// FieldWordOrder, FieldRegisterType and FieldAddressBase apply to it by Name.
+type ExtraRegister struct {
+    Name     string `json:"Name"`
+    Register int    `json:"Register"`
+    Type     string `json:"Type"`   // "holding" or "input"; default is the profile's RegisterType
+    Signed   bool   `json:"Signed"`
+    Calc     string `json:"Calc"`   // scaling expression; empty = raw value unchanged
+    Unit     string `json:"Unit"`   // e.g. "V", "C", "%"
+}
+
+// DriveIdentity matches what a drive reports about itself. Strings are case-insensitive
+// substrings of the Modbus device identification objects (FC 0x2B / MEI 0x0E); Register is
+// a holding register with a model code, one of Values. Every criterion given must match.
+type DriveIdentity struct {
+    VendorName  string `json:"VendorName"`
+    ProductCode string `json:"ProductCode"`
+    ModelName   string `json:"ModelName"`   // object 0x05, or ProductName (0x04) if the drive has no ModelName
+    Register    *int   `json:"Register"`    // profile address; AddressBase applies under the field name "Identify"
+    Values      []int  `json:"Values"`
+}
+
+// faultText decodes a fault code with the profile's FaultCodes table ("" for no fault)
+func (p DriveTypeProfile) faultText(code int) string {
+    if code == 0 {
+        return ""
+    }
+    if text, ok := p.FaultCodes[strconv.Itoa(code)]; ok {
+        return text
+    }
+    return fmt.Sprintf("Fault %d", code)
+}
+
+// extraUnit returns the Unit of the named extra register
+func (p DriveTypeProfile) extraUnit(name string) string {
+    for _, er := range p.ExtraRegisters {
+        if er.Name == name {
+            return er.Unit
+        }
+    }
+    return ""
+}
+
+// ControlStep is one write in a start/stop/untrip sequence. In JSON a bare number is
+// shorthand for writing that value to the Control register.
+type ControlStep struct {
+    Register      *int `json:"Register"`      // defaults to the profile's Control register
+    Value         int  `json:"Value"`
+    DelayMs       int  `json:"DelayMs"`       // pause before this step (default 100ms between steps)
+    WaitBit       *int `json:"WaitBit"`       // after writing, wait until this Status register bit is set
+    WaitTimeoutMs int  `json:"WaitTimeoutMs"` // default 2000
+}
+
+func (c *ControlStep) UnmarshalJSON(b []byte) error {
+    var v int
+    if err := json.Unmarshal(b, &v); err == nil {
+        *c = ControlStep{Value: v}
+        return nil
+    }
+    type plain ControlStep
+    return json.Unmarshal(b, (*plain)(c))
+}
+
+// lowWordFirst reports whether the named 32-bit field stores its low word in the first register
+func (p DriveTypeProfile) lowWordFirst(field string) bool {
+    order := p.WordOrder
+    if o, ok := p.FieldWordOrder[field]; ok {
+        order = o
+    }
+    return strings.EqualFold(order, "little")
+}
+
+// inputRegister reports whether the named field is read with FC04 (input) rather than FC03
+// (holding); def is the profile-wide choice used when the field has no override
+func (p DriveTypeProfile) inputRegister(field string, def bool) bool {
+    if t, ok := p.FieldRegisterType[field]; ok {
+        return t == "input"
+    }
+    return def
+}
+
+// wireAddr converts a profile address for the named field to the 0-based protocol address
+func (p DriveTypeProfile) wireAddr(field string, addr int) int {
+    base := p.AddressBase
+    if b, ok := p.FieldAddressBase[field]; ok {
+        base = b
+    }
+    return addr - base
+}
+
+// isDoubleWord reports whether the named register field is declared 32-bit
+func (p DriveTypeProfile) isDoubleWord(field string) bool {
+    for _, f := range p.DoubleWord {
+        if f == field {
+            return true
+        }
+    }
+    return false
 }
 
 // =====================
@@ -144,13 +672,17 @@ type SystemStatus struct {
     HealthyVFDs          int           `json:"healthyVFDs"`          // Number of healthy/responsive VFDs
     LastUpdateTime       time.Time     `json:"lastUpdateTime"`       // When we last updated VFD data
     DataCollectionAge    time.Duration `json:"dataCollectionAge"`    // How long ago we last collected data
+    ConfigIssues         []ConfigIssue `json:"configIssues,omitempty"`   // Validation problems in the running config
+    ExcludedVFDs         []string      `json:"excludedVFDs,omitempty"`   // Drives left out by StartDegraded
+    Health               ServerHealth  `json:"health"`                   // Latest self-monitoring sample
 }
 
 // =====================
 // Global Variables
 // =====================
 var appConfig AppConfig
-var ipToDrive map[string]*DriveConfig // static IP -> config lookup, built once at startup
+var ipToDrive map[string]*DriveConfig // IP -> config lookup, rebuilt on reload
+var configMu sync.RWMutex // guards appConfig.VFDs, ipToDrive and groupLevels, which a SIGHUP reload replaces
 var vfdData      []map[string]interface{}
 var vfdDataMutex sync.RWMutex
 var vfdConnections map[string]*VFDConnection
@@ -159,6 +691,7 @@ var systemStatus SystemStatus
 var statusMutex sync.RWMutex
 var controlEvents []ControlEvent
 var driveTypeProfiles map[string]DriveTypeProfile
+var profilesMu sync.RWMutex // guards driveTypeProfiles and freqCalcCache, which /api/profiles can change at runtime
 var disabledDrives = make(map[string]bool)
 var disabledDrivesMu sync.RWMutex
 var driveManagers = make(map[string]bool) // IPs with a running manageVFDConnection goroutine
@@ -189,6 +722,10 @@ func loadControlEvents(filePath string) {
     if len(loaded) > controlEventsRetention {
         loaded = loaded[len(loaded)-controlEventsRetention:]
     }
+    // Events from before drive IDs name drives by IP; they take the ID of the drive now there
+    for i := range loaded {
+        fillEventDriveIDs(&loaded[i])
+    }
 
     eventsMutex.Lock()
     controlEvents = loaded
@@ -217,6 +754,7 @@ func saveControlEvents(filePath string) {
 
 // recordControlEvent appends an event, trims to retention, and persists to disk
 func recordControlEvent(event ControlEvent) {
+    fillEventDriveIDs(&event)
     eventsMutex.Lock()
     controlEvents = append(controlEvents, event)
     if len(controlEvents) > controlEventsRetention {
@@ -224,6 +762,7 @@ func recordControlEvent(event ControlEvent) {
     }
     eventsMutex.Unlock()
     saveControlEvents(controlEventsFilePath)
+    onControlEvent(event)
 }
 
 // =====================
@@ -253,9 +792,25 @@ func safeInt(v interface{}) int {
     return 0
 }
 
+// driveConfig returns a drive's configuration. A reload swaps in new entries instead of
+// editing them, so the pointer stays consistent after the lock is released.
+func driveConfig(ip string) (*DriveConfig, bool) {
+    configMu.RLock()
+    defer configMu.RUnlock()
+    d, ok := ipToDrive[ip]
+    return d, ok
+}
+
+// configuredDrives returns the current drive list. Treat it as read-only.
+func configuredDrives() []DriveConfig {
+    configMu.RLock()
+    defer configMu.RUnlock()
+    return appConfig.VFDs
+}
+
 // Helper to find drive type for a given IP
 func findDriveType(ip string) (string, bool) {
-    if d, ok := ipToDrive[ip]; ok {
+    if d, ok := driveConfig(ip); ok {
         return d.DriveType, true
     }
     return "", false
@@ -290,7 +845,10 @@ func statusToString(status int, statusBits map[string]int, enabledStatus int) st
     
     // Bit-based status (legacy behavior for other drives)
     driveEnabled := (status & (1 << statusBits["Enabled"])) != 0
-    driveTripped := (status & (1 << statusBits["Tripped"])) != 0
+    driveTripped := false
+    if bit, ok := statusBits["Tripped"]; ok {
+        driveTripped = (status & (1 << bit)) != 0
+    }
     driveInhibited := false
     if bit, ok := statusBits["Inhibited"]; ok {
         driveInhibited = (status & (1 << bit)) != 0
@@ -329,17 +887,199 @@ func readRegister(ctx context.Context, client modbus.Client, reg int, input bool
     return float64(int(res[0])<<8 | int(res[1])), nil
 }
 
+// decodeRegister32 combines two registers into one value. Words are high-first unless
+// lowWordFirst; bytes within each word are always big-endian per Modbus.
+func decodeRegister32(res []byte, signed bool, lowWordFirst bool) float64 {
+    hi, lo := binary.BigEndian.Uint16(res[0:2]), binary.BigEndian.Uint16(res[2:4])
+    if lowWordFirst {
+        hi, lo = lo, hi
+    }
+    v := uint32(hi)<<16 | uint32(lo)
+    if signed {
+        return float64(int32(v))
+    }
+    return float64(v)
+}
+
+// encodeRegister32 is the inverse of decodeRegister32 for 32-bit writes
+func encodeRegister32(v uint32, lowWordFirst bool) []byte {
+    hi, lo := uint16(v>>16), uint16(v)
+    if lowWordFirst {
+        hi, lo = lo, hi
+    }
+    b := make([]byte, 4)
+    binary.BigEndian.PutUint16(b[0:2], hi)
+    binary.BigEndian.PutUint16(b[2:4], lo)
+    return b
+}
+
+// readRegister32 reads a 32-bit value spanning reg and reg+1.
+func readRegister32(ctx context.Context, client modbus.Client, reg int, input bool, signed bool, lowWordFirst bool) (float64, error) {
+    var res []byte
+    var err error
+    if input {
+        res, err = client.ReadInputRegisters(ctx, uint16(reg), 2)
+    } else {
+        res, err = client.ReadHoldingRegisters(ctx, uint16(reg), 2)
+    }
+    if err != nil {
+        return 0, fmt.Errorf("read error for reg %d: %w", reg, err)
+    }
+    if len(res) < 4 {
+        return 0, fmt.Errorf("insufficient data for reg %d: got %d bytes", reg, len(res))
+    }
+    return decodeRegister32(res, signed, lowWordFirst), nil
+}
+
+// readStatusCoils reads the profile's status coils and packs them into a status word, returning
+// the word and a matching StatusBits map (bit i = i-th coil in name order) for statusToString.
+func readStatusCoils(ctx context.Context, client modbus.Client, profile DriveTypeProfile) (int, map[string]int, error) {
+    names := make([]string, 0, len(profile.StatusCoils))
+    for name := range profile.StatusCoils {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    status := 0
+    bits := make(map[string]int, len(names))
+    for i, name := range names {
+        addr := uint16(profile.wireAddr("StatusCoils", profile.StatusCoils[name]))
+        var res []byte
+        var err error
+        if profile.CoilStatusType == "discrete" {
+            res, err = client.ReadDiscreteInputs(ctx, addr, 1)
+        } else {
+            res, err = client.ReadCoils(ctx, addr, 1)
+        }
+        if err != nil {
+            return 0, nil, fmt.Errorf("read error for coil %d: %w", addr, err)
+        }
+        if len(res) < 1 {
+            return 0, nil, fmt.Errorf("insufficient data for coil %d", addr)
+        }
+        bits[name] = i
+        if res[0]&0x01 != 0 {
+            status |= 1 << i
+        }
+    }
+    return status, bits, nil
+}
+
+// readProfileRegister reads a profile field, applying the field's register type and address
+// base and using a 32-bit read when the profile declares it
+func readProfileRegister(ctx context.Context, client modbus.Client, profile DriveTypeProfile, field string, reg int, input bool, signed bool) (float64, error) {
+    reg = profile.wireAddr(field, reg)
+    input = profile.inputRegister(field, input)
+    if profile.isDoubleWord(field) {
+        return readRegister32(ctx, client, reg, input, signed, profile.lowWordFirst(field))
+    }
+    return readRegister(ctx, client, reg, input, signed)
+}
+
 // =====================
 // Drive Profile & Connection Management
 // =====================
+const driveProfilesFilePath = "/etc/vfd/drive_profiles.json"
+
 func loadDriveTypeProfiles(path string) error {
-    file, err := os.Open(path)
+    profiles, err := readDriveTypeProfiles(path)
     if err != nil {
         return err
     }
+    driveTypeProfiles = profiles
+    return nil
+}
+
+func readDriveTypeProfiles(path string) (map[string]DriveTypeProfile, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
     defer file.Close()
-    decoder := json.NewDecoder(file)
-    return decoder.Decode(&driveTypeProfiles)
+    profiles := make(map[string]DriveTypeProfile)
+    if err := json.NewDecoder(file).Decode(&profiles); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return profiles, nil
+}
+
+// profileFor returns a drive type's profile. Profiles are replaced, never modified in
+// place, so the returned value stays consistent after the lock is released.
+func profileFor(driveType string) (DriveTypeProfile, bool) {
+    profilesMu.RLock()
+    defer profilesMu.RUnlock()
+    p, ok := driveTypeProfiles[driveType]
+    return p, ok
+}
+
+// driveProfile returns the profile a drive is run with: its DriveType's profile with the
+// drive's ProfileOverrides applied. Overrides are checked when the config is loaded, so
+// ok=false means an unknown DriveType.
+func driveProfile(d *DriveConfig) (DriveTypeProfile, bool) {
+    p, ok := profileFor(d.DriveType)
+    if !ok || len(d.ProfileOverrides) == 0 {
+        return p, ok
+    }
+    p, err := applyProfileOverrides(p, d.ProfileOverrides)
+    if err != nil {
+        log.Printf("VFD %s: ProfileOverrides: %v", d.IP, err)
+        return p, false
+    }
+    return p, true
+}
+
+// applyProfileOverrides returns p with the fields named in overrides replaced. Field names
+// must match the drive_profiles.json keys exactly.
+func applyProfileOverrides(p DriveTypeProfile, overrides json.RawMessage) (DriveTypeProfile, error) {
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(overrides, &fields); err != nil {
+        return p, err
+    }
+    // Zero the named fields first so maps are replaced rather than merged into p's (shared) maps
+    v := reflect.ValueOf(&p).Elem()
+    for name := range fields {
+        f, ok := v.Type().FieldByName(name)
+        if !ok || strings.Split(f.Tag.Get("json"), ",")[0] != name {
+            return p, fmt.Errorf("unknown profile field %q", name)
+        }
+        v.FieldByIndex(f.Index).Set(reflect.Zero(f.Type))
+    }
+    decoder := json.NewDecoder(bytes.NewReader(overrides))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&p); err != nil {
+        return p, err
+    }
+    return p, nil
+}
+
+// overrideProfiles resolves and validates the ProfileOverrides of every drive that has them,
+// returning the effective profiles by IP. Drives with an unknown DriveType are left to lint.
+func overrideProfiles(drives []DriveConfig, profiles map[string]DriveTypeProfile) (map[string]DriveTypeProfile, error) {
+    out := make(map[string]DriveTypeProfile)
+    for _, d := range drives {
+        base, ok := profiles[d.DriveType]
+        if !ok || len(d.ProfileOverrides) == 0 {
+            continue
+        }
+        p, err := applyProfileOverrides(base, d.ProfileOverrides)
+        if err != nil {
+            return nil, fmt.Errorf("drive %s ProfileOverrides: %w", d.IP, err)
+        }
+        if problems := validateProfile(p); len(problems) > 0 {
+            return nil, fmt.Errorf("drive %s ProfileOverrides: %s", d.IP, strings.Join(problems, "; "))
+        }
+        out[d.IP] = p
+    }
+    return out, nil
+}
+
+// cacheOverrideCalcs compiles expressions that only appear in ProfileOverrides, so they are not
+// re-parsed on every poll. Caller holds profilesMu (or runs before the server starts).
+func cacheOverrideCalcs(overridden map[string]DriveTypeProfile) {
+    for ip, p := range overridden {
+        for _, problem := range cacheProfileCalcs(p) {
+            log.Printf("[PROFILE] %s (ProfileOverrides) %s", ip, problem)
+        }
+    }
 }
 
 func isDriveDisabled(ip string) bool {
@@ -402,11 +1142,17 @@ func manageVFDConnection(vfd *DriveConfig) {
     wasUnavailable := false
 
     for {
-        // 1. If disabled, exit; ensureDriveManager restarts us on re-enable.
-        // Re-check under driveManagersMu so a concurrent re-enable can't be missed.
-        if isDriveDisabled(ip) {
+        // 0. If a reload removed the drive or changed how to reach it, hand over and exit
+        if driveRetired(vfd) {
+            retireDriveManager(vfd)
+            return
+        }
+
+        // 1. If disabled or polled by another shard, exit; ensureDriveManager restarts us on
+        // re-enable or takeover. Re-check under driveManagersMu so a concurrent re-enable can't be missed.
+        if isDriveDisabled(ip) || !ownsDrive(ip) {
             driveManagersMu.Lock()
-            if isDriveDisabled(ip) {
+            if isDriveDisabled(ip) || !ownsDrive(ip) {
                 delete(driveManagers, ip)
                 driveManagersMu.Unlock()
                 return
@@ -419,7 +1165,7 @@ func manageVFDConnection(vfd *DriveConfig) {
         var lastErr error
         for i := 0; i < 3; i++ {
             var err error
-            conn, err = connectVFD(ip, port, unit)
+            conn, err = connectVFD(ip, port, unit, probeRegister(ip))
             if err == nil {
                 break
             }
@@ -434,7 +1180,17 @@ func manageVFDConnection(vfd *DriveConfig) {
         // 3. After 3 failures, back off before retrying
         if conn == nil {
             wasUnavailable = true
-            time.Sleep(5 * time.Minute)
+            for i := 0; i < 60 && !driveRetired(vfd) && ownsDrive(ip); i++ {
+                time.Sleep(5 * time.Second)
+            }
+            continue
+        }
+
+        if appConfig.DetectDriveType && detectDriveType(conn, vfd) {
+            // DriveType was filled in: close so the next pass reconnects under the detected profile
+            conn.mu.Lock()
+            conn.handler.Close()
+            conn.mu.Unlock()
             continue
         }
 
@@ -443,7 +1199,7 @@ func manageVFDConnection(vfd *DriveConfig) {
         vfdConnectionsMu.Unlock()
 
         // CFW500: Ensure P0222=12 (Ethernet mode) for SoftPLC speed control via P1012
-        if vfd.DriveType == "CFW500" {
+        if vfd.DriveType == "CFW500" && !shadowMode() {
             conn.mu.Lock()
             res, err := conn.client.ReadHoldingRegisters(context.Background(), 222, 1)
             if err == nil && len(res) >= 2 {
@@ -464,11 +1220,16 @@ func manageVFDConnection(vfd *DriveConfig) {
             log.Printf("VFD %s is now AVAILABLE (reconnected)", ip)
             wasUnavailable = false
         }
+        if wantWriteConnection(vfd) {
+            openWriteConnection(conn)
+        }
+        go runQueuedCommand(ip)
 
         // 4. Health check loop
         for {
-            if isDriveDisabled(ip) {
-                // If disabled while connected, close and break to outer loop
+            if isDriveDisabled(ip) || driveRetired(vfd) || !ownsDrive(ip) {
+                // If disabled, reconfigured or handed back while connected, close and break to outer loop
+                closeWriteConnection(conn)
                 conn.mu.Lock()
                 conn.handler.Close()
                 conn.mu.Unlock()
@@ -477,21 +1238,121 @@ func manageVFDConnection(vfd *DriveConfig) {
             }
             time.Sleep(5 * time.Second)
             conn.mu.Lock()
-            _, err := conn.client.ReadHoldingRegisters(context.Background(), 0, 1)
+            _, err := conn.client.ReadHoldingRegisters(context.Background(), probeRegister(ip), 1)
             conn.mu.Unlock()
             if err != nil {
                 log.Printf("Lost connection to %s: %v", ip, err)
+                closeWriteConnection(conn)
                 conn.healthy.Store(false)
                 conn.mu.Lock()
                 conn.handler.Close() // release the dead socket before reconnecting
                 conn.mu.Unlock()
                 break // Go back to outer loop to retry connection
             }
+            if w := conn.writer.Load(); w != nil {
+                w.mu.Lock()
+                _, err := w.client.ReadHoldingRegisters(context.Background(), probeRegister(ip), 1)
+                w.mu.Unlock()
+                if err != nil {
+                    // Commands fall back to the poll session until the next reconnect
+                    log.Printf("[WRITE CONN] VFD %s: write session lost (%v); commands share the poll connection", ip, err)
+                    closeWriteConnection(conn)
+                }
+            }
+        }
+    }
+}
+
+// wantWriteConnection reports whether a drive gets a dedicated write session
+func wantWriteConnection(d *DriveConfig) bool {
+    return appConfig.DedicatedWriteConnection && !d.SharedConnection && !shadowMode()
+}
+
+// openWriteConnection opens a drive's dedicated write session next to its poll session.
+// Drives that allow only one Modbus session refuse it; they keep sharing, and the next
+// reconnect tries again.
+func openWriteConnection(conn *VFDConnection) {
+    w, err := connectVFD(conn.ip, conn.port, conn.unit, probeRegister(conn.ip))
+    if err != nil {
+        log.Printf("[WRITE CONN] VFD %s: second session refused (%v); commands share the poll connection", conn.ip, err)
+        return
+    }
+    conn.writer.Store(w)
+    log.Printf("[WRITE CONN] VFD %s: dedicated write session open", conn.ip)
+}
+
+// closeWriteConnection closes a drive's write session, if it has one
+func closeWriteConnection(conn *VFDConnection) {
+    w := conn.writer.Swap(nil)
+    if w == nil {
+        return
+    }
+    w.healthy.Store(false)
+    w.mu.Lock()
+    w.handler.Close()
+    w.mu.Unlock()
+}
+
+// writeConnectionStates reports, per connected drive, whether commands use a "dedicated"
+// write session or the "shared" poll session
+func writeConnectionStates() map[string]string {
+    vfdConnectionsMu.RLock()
+    defer vfdConnectionsMu.RUnlock()
+    states := make(map[string]string, len(vfdConnections))
+    for ip, conn := range vfdConnections {
+        if !conn.healthy.Load() {
+            continue
         }
+        states[ip] = "shared"
+        if conn.commandConn() != conn {
+            states[ip] = "dedicated"
+        }
+    }
+    return states
+}
+
+// driveRetired reports whether a reload removed the drive or changed its connection settings
+func driveRetired(vfd *DriveConfig) bool {
+    d, ok := driveConfig(vfd.IP)
+    return !ok || driveConnectionChanged(*vfd, *d)
+}
+
+// driveConnectionChanged reports whether two configs for an IP need separate Modbus sessions
+func driveConnectionChanged(a, b DriveConfig) bool {
+    return a.Port != b.Port || a.Unit != b.Unit || a.DriveType != b.DriveType
+}
+
+// retireDriveManager drops a retired manager's connection and, if the drive is still
+// configured, starts a manager with its new settings
+func retireDriveManager(vfd *DriveConfig) {
+    vfdConnectionsMu.Lock()
+    delete(vfdConnections, vfd.IP)
+    vfdConnectionsMu.Unlock()
+    driveManagersMu.Lock()
+    delete(driveManagers, vfd.IP)
+    driveManagersMu.Unlock()
+    if d, ok := driveConfig(vfd.IP); ok && !isDriveDisabled(vfd.IP) {
+        log.Printf("VFD %s: connection settings changed, reconnecting", vfd.IP)
+        ensureDriveManager(d)
+        return
     }
+    log.Printf("VFD %s: removed from configuration, connection closed", vfd.IP)
 }
 
-func connectVFD(ip string, port int, unit byte) (*VFDConnection, error) {
+// probeRegister returns the holding register used to verify a drive is responding.
+// Drives that reject reads of register 0 (e.g. Danfoss) set ProbeRegister in their profile.
+func probeRegister(ip string) uint16 {
+    d, ok := driveConfig(ip)
+    if !ok {
+        return 0
+    }
+    if profile, ok := driveProfile(d); ok {
+        return uint16(profile.wireAddr("ProbeRegister", profile.ProbeRegister))
+    }
+    return 0
+}
+
+func connectVFD(ip string, port int, unit byte, probeReg uint16) (*VFDConnection, error) {
     handler := modbus.NewTCPClientHandler(fmt.Sprintf("%s:%d", ip, port))
     handler.Timeout = 2 * time.Second
     handler.SlaveID = unit
@@ -499,10 +1360,13 @@ func connectVFD(ip string, port int, unit byte) (*VFDConnection, error) {
     if err != nil {
         return nil, err
     }
-    client := modbus.NewClient(handler)
+    var client modbus.Client = modbus.NewClient(handler)
+    if appConfig.UnsafeChaos {
+        client = chaosClient{Client: client, ip: ip}
+    }
 
     // Try to read a known register to verify the drive is present
-    _, err = client.ReadHoldingRegisters(context.Background(), 0, 1) // e.g., status register
+    _, err = client.ReadHoldingRegisters(context.Background(), probeReg, 1) // e.g., status register
     if err != nil {
         handler.Close()
         return nil, fmt.Errorf("Connection by MODBUS probe failed: %w", err)
@@ -520,31 +1384,270 @@ func connectVFD(ip string, port int, unit byte) (*VFDConnection, error) {
 }
 
 // =====================
-// Polling & Data Collection
+// Drive Type Detection
+// =====================
+// With DetectDriveType set, a drive is identified right after its first successful connect:
+// device identification objects plus any ID registers the profiles declare, matched against
+// every profile's Identify. A drive configured without a DriveType gets the one matching
+// profile (in memory only; the log says what to put in config.json). A configured type the
+// drive contradicts is flagged (log, DriveTypeMismatch event, vfd_drive_type_mismatch) but
+// never changed. Drives that answer neither FC 0x2B nor an ID register are left alone.
+
+// DriveDetection is the outcome of identifying one drive
+type DriveDetection struct {
+    Identity   map[string]string `json:"identity,omitempty"`  // device identification objects by name
+    Registers  map[int]int       `json:"registers,omitempty"` // ID register wire address -> value
+    Matches    []string          `json:"matches"`             // profiles whose Identify matches
+    Configured string            `json:"configured"`          // DriveType in use after detection
+    AutoFilled bool              `json:"autoFilled,omitempty"`
+    Mismatch   bool              `json:"mismatch,omitempty"`
+    Time       time.Time         `json:"time"`
+}
+
+var (
+    detectionsMu sync.RWMutex
+    detections   = make(map[string]DriveDetection)
+
+    vfdDriveTypeMismatch = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "drive_type_mismatch",
+            Help:      "1 when a drive identifies as a different type than its configured DriveType",
+        },
+        []string{"ip", "configured", "detected"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(vfdDriveTypeMismatch)
+}
+
+// deviceIDObjects names the device identification objects used for matching
+var deviceIDObjects = map[byte]string{0x00: "VendorName", 0x01: "ProductCode", 0x02: "Revision", 0x04: "ProductName", 0x05: "ModelName"}
+
+func driveDetection(ip string) (DriveDetection, bool) {
+    detectionsMu.RLock()
+    defer detectionsMu.RUnlock()
+    det, ok := detections[ip]
+    return det, ok
+}
+
+// readDeviceIdentity reads the regular device identification objects, falling back to the
+// basic set; nil if the drive does not implement FC 0x2B
+func readDeviceIdentity(ctx context.Context, client modbus.Client) map[string]string {
+    objects, err := client.ReadDeviceIdentification(ctx, modbus.ReadDeviceIDCodeRegular)
+    if err != nil {
+        objects, err = client.ReadDeviceIdentification(ctx, modbus.ReadDeviceIDCodeBasic)
+    }
+    if err != nil {
+        return nil
+    }
+    identity := make(map[string]string)
+    for id, value := range objects {
+        if name, ok := deviceIDObjects[id]; ok {
+            identity[name] = strings.TrimSpace(string(value))
+        }
+    }
+    return identity
+}
+
+// readIdentityRegisters reads every ID register declared by a profile, once per address.
+// Registers the drive rejects are skipped.
+func readIdentityRegisters(ctx context.Context, client modbus.Client, profiles map[string]DriveTypeProfile) map[int]int {
+    regs := make(map[int]int)
+    tried := make(map[int]bool)
+    for _, p := range profiles {
+        if p.Identify == nil || p.Identify.Register == nil {
+            continue
+        }
+        addr := p.wireAddr("Identify", *p.Identify.Register)
+        if tried[addr] {
+            continue
+        }
+        tried[addr] = true
+        if v, err := readRegister(ctx, client, addr, false, false); err == nil {
+            regs[addr] = int(v)
+        }
+    }
+    return regs
+}
+
+// identifies reports whether p's Identify matches a drive's identity and ID registers
+func (p DriveTypeProfile) identifies(identity map[string]string, regs map[int]int) bool {
+    id := p.Identify
+    if id == nil {
+        return false
+    }
+    criteria := 0
+    has := func(want string, got ...string) bool {
+        criteria++
+        for _, g := range got {
+            if g != "" && strings.Contains(strings.ToLower(g), strings.ToLower(want)) {
+                return true
+            }
+        }
+        return false
+    }
+    if id.VendorName != "" && !has(id.VendorName, identity["VendorName"]) {
+        return false
+    }
+    if id.ProductCode != "" && !has(id.ProductCode, identity["ProductCode"]) {
+        return false
+    }
+    if id.ModelName != "" && !has(id.ModelName, identity["ModelName"], identity["ProductName"]) {
+        return false
+    }
+    if id.Register != nil {
+        criteria++
+        v, ok := regs[p.wireAddr("Identify", *id.Register)]
+        if !ok || !containsInt(id.Values, v) {
+            return false
+        }
+    }
+    return criteria > 0
+}
+
+func containsInt(values []int, v int) bool {
+    for _, x := range values {
+        if x == v {
+            return true
+        }
+    }
+    return false
+}
+
+// matchDriveProfiles returns the names of the profiles that identify a drive, sorted
+func matchDriveProfiles(identity map[string]string, regs map[int]int, profiles map[string]DriveTypeProfile) []string {
+    matches := []string{}
+    for name, p := range profiles {
+        if p.identifies(identity, regs) {
+            matches = append(matches, name)
+        }
+    }
+    sort.Strings(matches)
+    return matches
+}
+
+// judgeDetection decides what a detection means for a drive configured as driveType
+func judgeDetection(driveType string, matches []string) (fill string, mismatch bool) {
+    if len(matches) == 0 {
+        return "", false
+    }
+    for _, m := range matches {
+        if m == driveType {
+            return "", false
+        }
+    }
+    if driveType == "" {
+        if len(matches) == 1 {
+            return matches[0], false
+        }
+        return "", false
+    }
+    return "", true
+}
+
+// setDetectedDriveType fills in a drive's DriveType, copy-on-write like a reload
+func setDetectedDriveType(ip, driveType string) {
+    configMu.Lock()
+    defer configMu.Unlock()
+    vfds := append([]DriveConfig(nil), appConfig.VFDs...)
+    byIP := make(map[string]*DriveConfig, len(vfds))
+    for i := range vfds {
+        if vfds[i].IP == ip {
+            vfds[i].DriveType = driveType
+        }
+        byIP[vfds[i].IP] = &vfds[i]
+    }
+    appConfig.VFDs = vfds
+    ipToDrive = byIP
+}
+
+// detectDriveType identifies a freshly connected drive once. It returns true when it filled
+// in the DriveType, so the caller reconnects under the detected profile.
+func detectDriveType(conn *VFDConnection, d *DriveConfig) bool {
+    if det, ok := driveDetection(d.IP); ok && det.Configured == d.DriveType {
+        return false
+    }
+    profilesMu.RLock()
+    profiles := make(map[string]DriveTypeProfile, len(driveTypeProfiles))
+    for name, p := range driveTypeProfiles {
+        profiles[name] = p
+    }
+    profilesMu.RUnlock()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    conn.mu.Lock()
+    identity := readDeviceIdentity(ctx, conn.client)
+    regs := readIdentityRegisters(ctx, conn.client, profiles)
+    conn.mu.Unlock()
+
+    det := DriveDetection{Identity: identity, Registers: regs, Matches: matchDriveProfiles(identity, regs, profiles), Configured: d.DriveType, Time: time.Now()}
+    fill, mismatch := judgeDetection(d.DriveType, det.Matches)
+    det.Mismatch = mismatch
+    if fill != "" {
+        det.Configured = fill
+        det.AutoFilled = true
+    }
+    detectionsMu.Lock()
+    detections[d.IP] = det
+    detectionsMu.Unlock()
+
+    vfdDriveTypeMismatch.DeletePartialMatch(prometheus.Labels{"ip": d.IP})
+    switch {
+    case mismatch:
+        detected := strings.Join(det.Matches, "|")
+        log.Printf("[DETECT] VFD %s: configured as %s but identifies as %s (%v)", d.IP, d.DriveType, detected, identity)
+        vfdDriveTypeMismatch.With(prometheus.Labels{"ip": d.IP, "configured": d.DriveType, "detected": detected}).Set(1)
+        recordControlEvent(ControlEvent{
+            Timestamp: time.Now(),
+            Action:    "DriveTypeMismatch",
+            Drives:    []DriveEventInfo{{IP: d.IP, Success: false, Error: fmt.Sprintf("configured as %s, drive identifies as %s", d.DriveType, detected)}},
+        })
+    case fill != "":
+        log.Printf("[DETECT] VFD %s: no DriveType configured, detected %s; set \"DriveType\": %q in config.json to make it permanent", d.IP, fill, fill)
+        setDetectedDriveType(d.IP, fill)
+        return true
+    case d.DriveType == "":
+        log.Printf("[DETECT] VFD %s: no DriveType configured and detection is inconclusive (matches %v, identity %v)", d.IP, det.Matches, identity)
+    }
+    return false
+}
+
+// =====================
+// Polling & Data Collection
 // =====================
 func initializeVfdData() {
     vfdDataMutex.Lock()
     defer vfdDataMutex.Unlock()
 
-    vfdData = make([]map[string]interface{}, 0, len(appConfig.VFDs))
-    for _, d := range appConfig.VFDs {
-        vfdData = append(vfdData, map[string]interface{}{
-            "group":         d.Group,
-            "fanNumber":     d.FanNumber,
-            "fanDesc":       d.FanDesc,
-            "ip":            d.IP,
-            "rpmToHz":       d.RpmToHz,
-            "cfmRpm":        d.CfmRpm,
-            "setSpeed":      0.0,
-            "actualSpeed":   0.0,
-            "actualPercent": 0.0,
-            "rpmSpeed":      0,
-            "actualCfm":     0,
-            "current":       0.0,
-            "clockwise":     1,
-            "status":        "Waiting",
-            "lastUpdated":   time.Now().Unix(),
-        })
+    drives := configuredDrives()
+    vfdData = make([]map[string]interface{}, 0, len(drives))
+    for _, d := range drives {
+        vfdData = append(vfdData, newVfdEntry(d, time.Now()))
+    }
+}
+
+// newVfdEntry is a drive's live data before its first poll
+func newVfdEntry(d DriveConfig, now time.Time) map[string]interface{} {
+    return map[string]interface{}{
+        "id":            d.ID,
+        "group":         d.Group,
+        "fanNumber":     d.FanNumber,
+        "fanDesc":       d.FanDesc,
+        "ip":            d.IP,
+        "rpmToHz":       d.RpmToHz,
+        "cfmRpm":        d.CfmRpm,
+        "setSpeed":      0.0,
+        "actualSpeed":   0.0,
+        "actualPercent": 0.0,
+        "rpmSpeed":      0,
+        "actualCfm":     0,
+        "current":       0.0,
+        "clockwise":     1,
+        "status":        "Waiting",
+        "lastUpdated":   now.Unix(),
     }
 }
 
@@ -558,9 +1661,160 @@ func markDriveOffline(entry map[string]interface{}, status string) {
     entry["current"] = 0.0
     entry["setSpeed"] = 0.0
     entry["clockwise"] = 1
+    if _, ok := entry["power"]; ok {
+        entry["power"] = 0.0
+    }
+    delete(entry, "extra")
+    delete(entry, "faultCode")
+    delete(entry, "faultText")
     entry["lastUpdated"] = time.Now().Unix()
 }
 
+// =====================
+// Current Governor
+// =====================
+// A drive with MaxCurrentA is kept under it by lowering its setpoint. After each poll,
+// checkCurrents looks at running drives: once current has stayed above the limit for
+// CurrentConfirmSec, the setpoint is lowered by CurrentStepHz (not below the drive's
+// minimum), and again after every further CurrentConfirmSec over the limit. The first step
+// opens a CurrentLimit alert; it resolves when current is back under the limit. The lowered
+// setpoint stays until someone sets another speed, so a hot afternoon doesn't end in an
+// overload trip and the fan doesn't hunt back up into it. Each step ends the drive's
+// airflow target, if it has one.
+
+// currentOverload tracks a drive running above its current limit
+type currentOverload struct {
+    Since   time.Time // over the limit since, or since the last step
+    Steps   int
+    AtFloor bool // at the minimum speed; nothing left to lower
+}
+
+var (
+    currentMu        sync.Mutex
+    currentOverloads = make(map[string]*currentOverload) // by drive IP
+)
+
+func currentGovernorSettings() (step float64, confirm time.Duration) {
+    step, confirm = appConfig.CurrentStepHz, time.Duration(appConfig.CurrentConfirmSec)*time.Second
+    if step <= 0 {
+        step = 2
+    }
+    if confirm <= 0 {
+        confirm = 5 * time.Second
+    }
+    return step, confirm
+}
+
+// currentAction is what a poll decided to do about one drive
+type currentAction struct {
+    kind    string // "step", "floor" or "clear"
+    d       DriveConfig
+    current float64
+    fromHz  float64
+    toHz    float64
+    first   bool // the first step of this overload, which opens the alert
+}
+
+// checkCurrents compares a poll snapshot with the drives' current limits and returns the
+// actions due. Caller holds currentMu.
+func checkCurrents(snapshot []map[string]interface{}, now time.Time) []currentAction {
+    stepHz, confirm := currentGovernorSettings()
+    var actions []currentAction
+    seen := make(map[string]bool)
+    for _, entry := range snapshot {
+        ip, _ := entry["ip"].(string)
+        d, ok := driveConfig(ip)
+        if !ok || d.MaxCurrentA <= 0 || entry["status"] != "Running" || entry["tagout"] != nil || !ownsDrive(ip) {
+            continue
+        }
+        seen[ip] = true
+        current := safeFloat(entry["current"])
+        o := currentOverloads[ip]
+        if current <= d.MaxCurrentA {
+            if o != nil {
+                if o.Steps > 0 || o.AtFloor {
+                    actions = append(actions, currentAction{kind: "clear", d: *d, current: current})
+                }
+                delete(currentOverloads, ip)
+            }
+            continue
+        }
+        if o == nil {
+            currentOverloads[ip] = &currentOverload{Since: now}
+            continue
+        }
+        if o.AtFloor || now.Sub(o.Since) < confirm {
+            continue
+        }
+        from := safeFloat(entry["setSpeed"])
+        floor, _ := speedRange(d)
+        to := math.Round(math.Max(floor, from-stepHz)*10) / 10
+        o.Since = now
+        if to >= from {
+            o.AtFloor = true
+            actions = append(actions, currentAction{kind: "floor", d: *d, current: current, fromHz: from})
+            continue
+        }
+        o.Steps++
+        actions = append(actions, currentAction{kind: "step", d: *d, current: current, fromHz: from, toHz: to, first: o.Steps == 1})
+    }
+    // Drives that stopped or dropped out are no longer overloaded
+    for ip, o := range currentOverloads {
+        if !seen[ip] {
+            if o.Steps > 0 || o.AtFloor {
+                if d, ok := driveConfig(ip); ok {
+                    actions = append(actions, currentAction{kind: "clear", d: *d})
+                }
+            }
+            delete(currentOverloads, ip)
+        }
+    }
+    return actions
+}
+
+// governCurrents runs the current governor for a poll (from onPollComplete)
+func governCurrents(snapshot []map[string]interface{}) {
+    if shadowMode() {
+        return
+    }
+    currentMu.Lock()
+    actions := checkCurrents(snapshot, time.Now())
+    currentMu.Unlock()
+
+    for _, a := range actions {
+        d := a.d
+        info := DriveEventInfo{ID: d.ID, IP: d.IP, Success: true}
+        detail := fmt.Sprintf("%.1f A over the %.1f A limit", a.current, d.MaxCurrentA)
+        switch a.kind {
+        case "step":
+            detail += fmt.Sprintf("; setpoint %.1f -> %.1f Hz", a.fromHz, a.toHz)
+            log.Printf("[CURRENT] %s: %s", d.IP, detail)
+            endCfmTargets([]string{d.IP}, "CurrentLimit")
+            if err := writeSpeedStep(d.IP, a.toHz); err != nil {
+                info.Success, info.Error = false, err.Error()
+            }
+            recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "CurrentLimit", Speed: a.toHz, Drives: []DriveEventInfo{info}, Detail: detail})
+        case "floor":
+            detail += fmt.Sprintf("; already at the %.1f Hz minimum, not lowered further", a.fromHz)
+            log.Printf("[CURRENT] %s: %s", d.IP, detail)
+            info.Warning = detail
+            recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "CurrentLimit", Speed: a.fromHz, Drives: []DriveEventInfo{info}, Detail: detail})
+        case "clear":
+            log.Printf("[CURRENT] %s: current back under the %.1f A limit", d.IP, d.MaxCurrentA)
+            resolveAlert("CurrentLimit", d.ID)
+            continue
+        }
+        if a.first || a.kind == "floor" {
+            severity := "warning"
+            if a.kind == "floor" {
+                severity = "critical"
+            }
+            notify(Notification{Severity: severity, Kind: "CurrentLimit", Group: d.Group, DriveID: d.ID, IP: d.IP,
+                Message: fmt.Sprintf("Drive %s is drawing too much current: %s", d.IP, detail)})
+        }
+    }
+}
+
 func pollAllDrives() {
     // Serialize full poll cycles: the 1s ticker and handler-triggered polls
     // must not interleave, or a slow cycle could publish stale data last.
@@ -587,9 +1841,35 @@ func pollAllDrives() {
             newMap[k] = v
         }
         newData[i] = newMap
+        id, _ := newMap["id"].(string)
+        if t, ok := driveTagout(id); ok {
+            newMap["tagout"] = t
+        } else {
+            delete(newMap, "tagout")
+        }
+        if h, ok := driveHand(id); ok {
+            newMap["hand"] = h
+        } else {
+            delete(newMap, "hand")
+        }
     }
 
-    for _, d := range appConfig.VFDs {
+    for _, d := range configuredDrives() {
+        if owner := driveOwner(d.IP); owner != "" {
+            if owner != appConfig.Sharding.Self {
+                mu.Lock()
+                if idx, ok := ipIndex[d.IP]; ok {
+                    applyShardEntry(newData[idx], d.IP, owner)
+                }
+                mu.Unlock()
+                continue
+            }
+            mu.Lock()
+            if idx, ok := ipIndex[d.IP]; ok {
+                newData[idx]["shard"] = owner
+            }
+            mu.Unlock()
+        }
         if isDriveDisabled(d.IP) {
             mu.Lock()
             if idx, ok := ipIndex[d.IP]; ok {
@@ -632,10 +1912,50 @@ func pollAllDrives() {
             mu.Unlock()
         }(d)
     }
+    vfdDataMutex.RLock()
+    currentSensors := sensorData
+    vfdDataMutex.RUnlock()
+    newSensors := pollSensors(currentSensors, sem)
     wg.Wait()
     vfdDataMutex.Lock()
     vfdData = newData
+    sensorData = newSensors
     vfdDataMutex.Unlock()
+    onPollComplete(newData)
+}
+
+// onPollComplete fans a freshly published snapshot out to the optional integrations
+func onPollComplete(snapshot []map[string]interface{}) {
+    if !isFrontEnd() {
+        // The front-end runs the rest on the merged fleet
+        autoResetTrips(snapshot)
+        watchSetpoints(snapshot)
+        governCurrents(snapshot)
+        trimCfmTargets(snapshot)
+        return
+    }
+    updateDriveStats(snapshot, time.Now())
+    updateBaselines(snapshot)
+    recordHistory(snapshot, time.Now())
+    publishTelemetryKafka(snapshot)
+    publishStatusKNX(snapshot)
+    publishStatusNATS(snapshot)
+    notifyStatusChanges(snapshot)
+    resolveDriveAlerts(snapshot)
+    autoResetTrips(snapshot)
+    watchSetpoints(snapshot)
+    governCurrents(snapshot)
+    trimCfmTargets(snapshot)
+    watchPurge(snapshot)
+    driveSensorOutputs(snapshot)
+    compareWithPrimary(snapshot)
+}
+
+// onControlEvent fans a recorded control event out to the optional integrations
+func onControlEvent(event ControlEvent) {
+    publishControlEventKafka(event)
+    publishControlEventNATS(event)
+    notifyControlEvent(event)
 }
 
 func pollDrive(ctx context.Context, d DriveConfig) (map[string]interface{}, error) {
@@ -647,7 +1967,7 @@ func pollDrive(ctx context.Context, d DriveConfig) (map[string]interface{}, erro
     }
 
     // Look up drive profile
-    profile, ok := driveTypeProfiles[d.DriveType]
+    profile, ok := driveProfile(&d)
     if !ok {
         return nil, fmt.Errorf("unknown drive type profile: %s", d.DriveType)
     }
@@ -660,7 +1980,15 @@ func pollDrive(ctx context.Context, d DriveConfig) (map[string]interface{}, erro
     var err error
 
     // Read each required register individually
-    statusRaw, err := readRegister(ctx, conn.client, profile.Status, useInputRegisters, false)
+    var statusRaw float64
+    statusBits := profile.StatusBits
+    if len(profile.StatusCoils) > 0 {
+        var coilStatus int
+        coilStatus, statusBits, err = readStatusCoils(ctx, conn.client, profile)
+        statusRaw = float64(coilStatus)
+    } else {
+        statusRaw, err = readProfileRegister(ctx, conn.client, profile, "Status", profile.Status, useInputRegisters, false)
+    }
     if err != nil {
         conn.healthy.Store(false)
         return nil, err
@@ -669,37 +1997,68 @@ func pollDrive(ctx context.Context, d DriveConfig) (map[string]interface{}, erro
     // Read enabled status for GS44020 drives
     var enabledStatusRaw float64
     if profile.EnabledStatus > 0 {
-        enabledStatusRaw, err = readRegister(ctx, conn.client, profile.EnabledStatus, useInputRegisters, false)
+        enabledStatusRaw, err = readProfileRegister(ctx, conn.client, profile, "EnabledStatus", profile.EnabledStatus, useInputRegisters, false)
         if err != nil {
             conn.healthy.Store(false)
             return nil, err
         }
     }
 
-    setSpeedRaw, err := readRegister(ctx, conn.client, profile.Setpoint[0], useInputRegisters, false)
+    setSpeedRaw, err := readProfileRegister(ctx, conn.client, profile, "Setpoint", profile.Setpoint[0], useInputRegisters, profile.SignedSetpoint)
     if err != nil {
         conn.healthy.Store(false)
         return nil, err
     }
+    // Direction is reported via the output frequency sign; the setpoint is shown as a magnitude
+    setSpeedRaw = math.Abs(setSpeedRaw)
 
     // Read output frequency as signed (always HOLDING) or unsigned based on profile setting
     var outputFreqRaw float64
     if profile.SignedOutputFreq {
-        outputFreqRaw, err = readRegister(ctx, conn.client, profile.OutputFrequency, false, true)
+        outputFreqRaw, err = readProfileRegister(ctx, conn.client, profile, "OutputFrequency", profile.OutputFrequency, false, true)
     } else {
-        outputFreqRaw, err = readRegister(ctx, conn.client, profile.OutputFrequency, useInputRegisters, false)
+        outputFreqRaw, err = readProfileRegister(ctx, conn.client, profile, "OutputFrequency", profile.OutputFrequency, useInputRegisters, false)
     }
     if err != nil {
         conn.healthy.Store(false)
         return nil, err
     }
 
-    outputCurrentRaw, err := readRegister(ctx, conn.client, profile.OutputCurrent, useInputRegisters, false)
+    outputCurrentRaw, err := readProfileRegister(ctx, conn.client, profile, "OutputCurrent", profile.OutputCurrent, useInputRegisters, false)
     if err != nil {
         conn.healthy.Store(false)
         return nil, err
     }
 
+    // Output power is optional (e.g. ABB ACS580 01.14)
+    var outputPowerRaw float64
+    if profile.OutputPower > 0 {
+        outputPowerRaw, err = readProfileRegister(ctx, conn.client, profile, "OutputPower", profile.OutputPower, useInputRegisters, true)
+        if err != nil {
+            conn.healthy.Store(false)
+            return nil, err
+        }
+    }
+
+    // Drives that report faults as a code rather than a status bit (e.g. Delta 2100H)
+    var faultCode int
+    if profile.FaultCode > 0 {
+        raw, err := readProfileRegister(ctx, conn.client, profile, "FaultCode", profile.FaultCode, useInputRegisters, false)
+        if err != nil {
+            conn.healthy.Store(false)
+            return nil, err
+        }
+        faultCode = int(raw)
+        if profile.FaultCodeMask > 0 {
+            faultCode &= profile.FaultCodeMask
+        }
+    }
+
+    // Extra telemetry is read after the required registers, so a dead connection has already
+    // failed above; a failure here drops only that value (e.g. a wrong address on one model)
+    extraRaw := readExtraRegisters(ctx, conn.client, profile, useInputRegisters, d.IP)
+    energyRaw, energyRead := readEnergyCounter(ctx, conn.client, profile, useInputRegisters, d.IP, time.Now())
+
     // Detect rotation direction based on output frequency sign
     clockwise := 1
     if outputFreqRaw < 0 {
@@ -708,487 +2067,8485 @@ func pollDrive(ctx context.Context, d DriveConfig) (map[string]interface{}, erro
         outputFreqRaw = outputFreqRaw * -1
     }
     
-    status := int(statusRaw)
+    status := int(statusRaw) ^ profile.invertMaskFor(statusBits)
     enabledStatus := int(enabledStatusRaw)
-    setSpeed := applyFreqCalc(setSpeedRaw, profile.OutFreqCalc)
-    actualSpeed := applyFreqCalc(outputFreqRaw, profile.OutFreqCalc)
-    current := applyFreqCalc(outputCurrentRaw, profile.OutCurrentCalc)
+    setpointCalc := profile.OutFreqCalc
+    if profile.SetpointReadCalc != "" {
+        setpointCalc = profile.SetpointReadCalc
+    }
+    fields := make(map[string]float64, len(extraRaw)+len(calcFieldVars))
+    for name, raw := range extraRaw {
+        fields[name] = raw
+    }
+    fields["status"] = statusRaw
+    fields["setpoint"] = setSpeedRaw
+    fields["outputFrequency"] = outputFreqRaw
+    fields["outputCurrent"] = outputCurrentRaw
+    fields["outputPower"] = outputPowerRaw
+    fields["faultCode"] = float64(faultCode)
+    vars := profile.calcVars(fields)
+    rawValues := make(map[string]float64, len(fields)+1)
+    for k, v := range fields {
+        rawValues[k] = v
+    }
+    if profile.EnabledStatus > 0 {
+        rawValues["enabledStatus"] = enabledStatusRaw
+    }
+    if energyRead {
+        rawValues["energyCounter"] = energyRaw
+    }
+    recordRawReading(d.IP, rawValues, time.Now())
+    setSpeed := applyCalc(setpointCalc, setSpeedRaw, vars)
+    actualSpeed := applyCalc(profile.OutFreqCalc, outputFreqRaw, vars)
+    current := applyCalc(profile.OutCurrentCalc, outputCurrentRaw, vars)
     rpm := int(actualSpeed * d.RpmToHz)
     cfm := int(math.Round(float64(rpm) * d.CfmRpm))
 
     // Mark connection as healthy after successful poll
     conn.healthy.Store(true)
 
-    return map[string]interface{}{
+    data := map[string]interface{}{
         "setSpeed":      math.Round(setSpeed*10) / 10,
         "actualSpeed":   math.Round(actualSpeed*10) / 10,
         "actualPercent": math.Round((actualSpeed/0.6)*10) / 10,
         "rpmSpeed":      rpm,
         "actualCfm":     cfm,
         "current":       math.Round(current*10) / 10,
-        "status":        statusToString(status, profile.StatusBits, enabledStatus),
+        "status":        statusToString(status, statusBits, enabledStatus),
         "clockwise":     clockwise,
-    }, nil
+        "direction":     driveDirection(d.IP),
+    }
+    if directionMismatch(profile, data["direction"].(string), clockwise, actualSpeed) {
+        data["directionMismatch"] = true
+    }
+    if faultCode != 0 {
+        data["status"] = "Tripped"
+    }
+    if profile.FaultCode > 0 {
+        data["faultCode"] = faultCode
+        data["faultText"] = profile.faultText(faultCode)
+    }
+    if profile.OutputPower > 0 {
+        data["power"] = math.Round(applyCalc(profile.OutPowerCalc, outputPowerRaw, vars)*100) / 100
+    }
+    if len(profile.ExtraRegisters) > 0 {
+        data["extra"] = scaleExtraRegisters(profile, extraRaw, vars)
+    }
+    if energyRead {
+        data["energyMeter"] = math.Round(applyCalc(profile.EnergyCalc, energyRaw, vars)*1000) / 1000
+    }
+    return data, nil
 }
 
-// Freq calc expressions ("* 10", "/ 60 * 8192", ...) are parsed once at startup
-// instead of on every register read. Operand order is preserved exactly.
-type freqCalcOp int
-
-const (
-    calcDefault   freqCalcOp = iota // no expression: raw / 10 (legacy behavior)
-    calcDivMul                      // "/ X * Y": raw / a * b
-    calcMulDiv                      // "* X / Y": raw * a / b
-    calcMul                         // "* X":     raw * a
-    calcDiv                         // "/ X":     raw / a
-    calcRaw                         // unparsable: return raw unchanged
+// energyReads holds when each drive's energy counter was last read, by IP. Counters change
+// slowly, so they are read every EnergyPollSec rather than every poll.
+var (
+    energyReadsMu sync.Mutex
+    energyReads   = make(map[string]time.Time)
 )
 
-type freqCalc struct {
-    op   freqCalcOp
-    a, b float64
+func energyPollInterval() time.Duration {
+    if appConfig.EnergyPollSec > 0 {
+        return time.Duration(appConfig.EnergyPollSec) * time.Second
+    }
+    return time.Minute
 }
 
-func parseFreqCalc(expr string) freqCalc {
-    if expr == "" {
-        return freqCalc{op: calcDefault}
-    }
-    expr = strings.TrimSpace(expr)
-    var a, b float64
-    if n, _ := fmt.Sscanf(expr, "/ %f * %f", &a, &b); n == 2 {
-        return freqCalc{op: calcDivMul, a: a, b: b}
+// readEnergyCounter reads the profile's EnergyCounter when it is due. A failure is logged
+// once and retried on the next poll.
+func readEnergyCounter(ctx context.Context, client modbus.Client, profile DriveTypeProfile, useInputRegisters bool, ip string, now time.Time) (float64, bool) {
+    if profile.EnergyCounter <= 0 {
+        return 0, false
     }
-    if n, _ := fmt.Sscanf(expr, "* %f / %f", &a, &b); n == 2 {
-        return freqCalc{op: calcMulDiv, a: a, b: b}
+    energyReadsMu.Lock()
+    due := now.Sub(energyReads[ip]) >= energyPollInterval()
+    energyReadsMu.Unlock()
+    if !due {
+        return 0, false
     }
-    if n, _ := fmt.Sscanf(expr, "* %f", &a); n == 1 {
-        return freqCalc{op: calcMul, a: a}
+    v, err := readProfileRegister(ctx, client, profile, "EnergyCounter", profile.EnergyCounter, useInputRegisters, false)
+    key := ip + "/EnergyCounter"
+    if err != nil {
+        if _, logged := extraReadFailing.LoadOrStore(key, true); !logged {
+            log.Printf("[ENERGY] IP: %s, EnergyCounter (reg %d): %v", ip, profile.EnergyCounter, err)
+        }
+        return 0, false
     }
-    if n, _ := fmt.Sscanf(expr, "/ %f", &a); n == 1 {
-        return freqCalc{op: calcDiv, a: a}
+    extraReadFailing.Delete(key)
+    energyReadsMu.Lock()
+    energyReads[ip] = now
+    energyReadsMu.Unlock()
+    return v, true
+}
+
+// energyRolloverKWh is where a profile's energy counter wraps, in kWh
+func energyRolloverKWh(p DriveTypeProfile) float64 {
+    roll := p.EnergyRollover
+    if roll <= 0 {
+        roll = 65536
+        if p.isDoubleWord("EnergyCounter") {
+            roll = 4294967296
+        }
     }
-    return freqCalc{op: calcRaw}
+    return applyCalc(p.EnergyCalc, roll, p.Constants) - applyCalc(p.EnergyCalc, 0, p.Constants)
 }
 
-func (c freqCalc) apply(raw float64) float64 {
-    switch c.op {
-    case calcDefault:
-        return raw / 10.0
-    case calcDivMul:
-        return raw / c.a * c.b
-    case calcMulDiv:
-        return raw * c.a / c.b
-    case calcMul:
-        return raw * c.a
-    case calcDiv:
-        return raw / c.a
-    default:
-        return raw
+// meterEnergyDelta is the energy between two counter readings (kWh). A counter that went
+// down from the top half of its range to the bottom half wrapped; any other decrease is a
+// reset (e.g. a replaced drive), counted from zero. The first reading only sets the baseline.
+func meterEnergyDelta(last *float64, reading, rollover float64) float64 {
+    if last == nil {
+        return 0
+    }
+    delta := reading - *last
+    if delta >= 0 {
+        return delta
     }
+    if rollover > 0 && *last >= rollover/2 && reading < rollover/2 {
+        return reading + rollover - *last
+    }
+    return reading
 }
 
-// freqCalcCache is built once at startup from all profile expressions
-// and is read-only afterwards, so no locking is needed.
-var freqCalcCache = make(map[string]freqCalc)
+// extraReadFailing tracks "ip/name" extra registers whose read error has been logged,
+// so a bad address is reported once rather than every poll
+var extraReadFailing sync.Map
 
-func buildFreqCalcCache() {
-    for _, p := range driveTypeProfiles {
-        for _, expr := range []string{p.OutFreqCalc, p.SetFreqCalc, p.OutCurrentCalc} {
-            if _, ok := freqCalcCache[expr]; !ok {
-                freqCalcCache[expr] = parseFreqCalc(expr)
+// readExtraRegisters reads the profile's ExtraRegisters, returning raw values by name
+func readExtraRegisters(ctx context.Context, client modbus.Client, profile DriveTypeProfile, useInputRegisters bool, ip string) map[string]float64 {
+    raw := make(map[string]float64, len(profile.ExtraRegisters))
+    for _, er := range profile.ExtraRegisters {
+        input := useInputRegisters
+        if er.Type != "" {
+            input = er.Type == "input"
+        }
+        v, err := readProfileRegister(ctx, client, profile, er.Name, er.Register, input, er.Signed)
+        key := ip + "/" + er.Name
+        if err != nil {
+            if _, logged := extraReadFailing.LoadOrStore(key, true); !logged {
+                log.Printf("[EXTRA] IP: %s, %s (reg %d): %v", ip, er.Name, er.Register, err)
             }
+            continue
         }
+        extraReadFailing.Delete(key)
+        raw[er.Name] = v
     }
+    return raw
 }
 
-// Helper to apply OutFreqCalc expression to the raw frequency value
-func applyFreqCalc(raw float64, expr string) float64 {
-    if c, ok := freqCalcCache[expr]; ok {
-        return c.apply(raw)
+// scaleExtraRegisters applies each extra register's Calc to its raw value
+func scaleExtraRegisters(profile DriveTypeProfile, raw map[string]float64, vars map[string]float64) map[string]float64 {
+    extra := make(map[string]float64, len(raw))
+    for _, er := range profile.ExtraRegisters {
+        v, ok := raw[er.Name]
+        if !ok {
+            continue
+        }
+        if er.Calc != "" {
+            v = applyCalc(er.Calc, v, vars)
+        }
+        extra[er.Name] = math.Round(v*100) / 100
     }
-    return parseFreqCalc(expr).apply(raw)
+    return extra
 }
 
-// =====================
-// Modbus Command Functions
-// =====================
-// getConnAndProfile resolves a drive's healthy connection and type profile,
-// the shared preamble of every control function.
-func getConnAndProfile(ip string) (*VFDConnection, DriveTypeProfile, error) {
-    vfdConnectionsMu.RLock()
-    conn, ok := vfdConnections[ip]
-    vfdConnectionsMu.RUnlock()
-    if !ok || !conn.healthy.Load() {
-        return nil, DriveTypeProfile{}, fmt.Errorf("No available connection for  %s", ip)
-    }
-    driveType, ok := findDriveType(ip)
-    if !ok {
-        return nil, DriveTypeProfile{}, fmt.Errorf("No drive profile for %s", ip)
+// Scaling expressions ("* 10", "(raw - 16384) / 16384 * maxHz", ...) are compiled once at
+// startup instead of on every register read. They support + - * /, parentheses, numbers,
+// the functions abs/min/max/round, and variables: raw (the value being scaled), the raw
+// values of the other polled registers (calcFieldVars) and the profile's Constants.
+// A leading * or / is shorthand for "raw * ..." / "raw / ...", which is how the original
+// profiles are written; an empty expression is raw / 10 (legacy behavior).
+type freqCalc struct {
+    root calcNode // nil = empty expression
+    err  error    // compile error: the expression returns raw unchanged
+}
+
+// Raw register values available to every expression evaluated during a poll
+var calcFieldVars = []string{"status", "setpoint", "outputFrequency", "outputCurrent", "outputPower", "faultCode"}
+
+type calcNode interface {
+    eval(raw float64, vars map[string]float64) (float64, error)
+}
+
+type calcNum float64
+
+type calcVar string
+
+type calcNeg struct{ x calcNode }
+
+type calcBinary struct {
+    op   byte
+    l, r calcNode
+}
+
+type calcCall struct {
+    fn   string
+    args []calcNode
+}
+
+// calcFuncs maps function names to their minimum and maximum argument counts (-1 = any)
+var calcFuncs = map[string][2]int{
+    "abs":   {1, 1},
+    "round": {1, 1},
+    "min":   {2, -1},
+    "max":   {2, -1},
+}
+
+func (n calcNum) eval(raw float64, vars map[string]float64) (float64, error) {
+    return float64(n), nil
+}
+
+func (n calcVar) eval(raw float64, vars map[string]float64) (float64, error) {
+    if n == "raw" {
+        return raw, nil
     }
-    profile, ok := driveTypeProfiles[driveType]
-    if !ok {
-        return nil, DriveTypeProfile{}, fmt.Errorf("No drive profile for %s", ip)
+    if v, ok := vars[string(n)]; ok {
+        return v, nil
     }
-    return conn, profile, nil
+    return 0, fmt.Errorf("unknown variable %q", string(n))
 }
 
-func fanStop(ip string) error {
-    conn, profile, err := getConnAndProfile(ip)
-    if err != nil {
-        return err
-    }
-    conn.mu.Lock()
-    defer conn.mu.Unlock()
-    _, err = conn.client.WriteSingleRegister(context.Background(), uint16(profile.Control), uint16(profile.StopValue))
-    return err
+func (n calcNeg) eval(raw float64, vars map[string]float64) (float64, error) {
+    v, err := n.x.eval(raw, vars)
+    return -v, err
 }
 
-func fanUnTrip(ip string) error {
-    conn, profile, err := getConnAndProfile(ip)
+func (n calcBinary) eval(raw float64, vars map[string]float64) (float64, error) {
+    l, err := n.l.eval(raw, vars)
     if err != nil {
-        return err
+        return 0, err
     }
-    conn.mu.Lock()
-    defer conn.mu.Unlock()
-    _, err = conn.client.WriteSingleRegister(context.Background(), uint16(profile.UnTripRegister), uint16(profile.UnTripValue))
-    return err
-}
-
-func fanStart(ip string) error {
-    conn, profile, err := getConnAndProfile(ip)
+    r, err := n.r.eval(raw, vars)
     if err != nil {
-        return err
+        return 0, err
+    }
+    switch n.op {
+    case '+':
+        return l + r, nil
+    case '-':
+        return l - r, nil
+    case '*':
+        return l * r, nil
+    default:
+        if r == 0 {
+            return 0, fmt.Errorf("division by zero")
+        }
+        return l / r, nil
     }
-    conn.mu.Lock()
-    defer conn.mu.Unlock()
-    _, err = conn.client.WriteSingleRegister(context.Background(), uint16(profile.Control), uint16(profile.StartValue))
-    return err
 }
 
-func setFanSpeed(ip string, setspeed float64) error {
-    conn, profile, err := getConnAndProfile(ip)
-    if err != nil {
-        return err
-    }
-    conn.mu.Lock()
-    defer conn.mu.Unlock()
-    actualSpeedSet := applyFreqCalc(setspeed, profile.SetFreqCalc)
-    // Write speed reference BEFORE start command
-    if len(profile.Setpoint) > 0 {
-        _, err := conn.client.WriteSingleRegister(context.Background(), uint16(profile.Setpoint[0]), uint16(int(actualSpeedSet)))
+func (n calcCall) eval(raw float64, vars map[string]float64) (float64, error) {
+    args := make([]float64, len(n.args))
+    for i, a := range n.args {
+        v, err := a.eval(raw, vars)
         if err != nil {
-            return err
+            return 0, err
         }
+        args[i] = v
     }
-    if len(profile.Setpoint) > 1 {
-        _, err := conn.client.WriteSingleRegister(context.Background(), uint16(profile.Setpoint[1]), uint16(int(actualSpeedSet*float64(profile.SpeedPresetMultiplier))))
-        if err != nil {
-            return err
+    switch n.fn {
+    case "abs":
+        return math.Abs(args[0]), nil
+    case "round":
+        return math.Round(args[0]), nil
+    case "min":
+        m := args[0]
+        for _, v := range args[1:] {
+            m = math.Min(m, v)
         }
+        return m, nil
+    default: // max
+        m := args[0]
+        for _, v := range args[1:] {
+            m = math.Max(m, v)
+        }
+        return m, nil
     }
-    _, err = conn.client.WriteSingleRegister(context.Background(), uint16(profile.Control), uint16(profile.StartValue))
-    if err != nil {
-        return err
-    }
-    return nil
 }
 
-func fanHold(ip string) error {
-    conn, profile, err := getConnAndProfile(ip)
-    if err != nil {
-        return err
-    }
-    conn.mu.Lock()
-    defer conn.mu.Unlock()
-    _, err = conn.client.WriteSingleRegister(context.Background(), uint16(profile.Control), uint16(profile.StartValue))
-    if err != nil {
-        return err
-    }
-    if len(profile.Setpoint) > 0 {
-        _, err = conn.client.WriteSingleRegister(context.Background(), uint16(profile.Setpoint[0]), 0)
-        if err != nil {
-            return err
-        }
-    }
-    if len(profile.Setpoint) > 1 {
-        _, err = conn.client.WriteSingleRegister(context.Background(), uint16(profile.Setpoint[1]), 0)
-        if err != nil {
-            return err
+// calcVariables collects the variable names an expression refers to
+func calcVariables(n calcNode, out map[string]bool) {
+    switch n := n.(type) {
+    case calcVar:
+        out[string(n)] = true
+    case calcNeg:
+        calcVariables(n.x, out)
+    case calcBinary:
+        calcVariables(n.l, out)
+        calcVariables(n.r, out)
+    case calcCall:
+        for _, a := range n.args {
+            calcVariables(a, out)
         }
     }
-    return nil
 }
 
-// =====================
-// Curtailment Functions
-// =====================
+// calcParser is a recursive-descent parser: expr = term {(+|-) term}, term = unary {(*|/) unary},
+// unary = [-|+] unary | primary, primary = number | name | name(args) | (expr)
+type calcParser struct {
+    src string
+    pos int
+}
 
-// loadCurtailmentState loads the curtailment state from file
-func loadCurtailmentState() (*CurtailmentState, error) {
-    data, err := os.ReadFile(curtailmentStateFile)
-    if err != nil {
-        return nil, err
+func (p *calcParser) peek() byte {
+    for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+        p.pos++
     }
-    var state CurtailmentState
-    err = json.Unmarshal(data, &state)
-    if err != nil {
-        return nil, err
+    if p.pos >= len(p.src) {
+        return 0
     }
-    return &state, nil
+    return p.src[p.pos]
 }
 
-// saveCurtailmentState saves the curtailment state to file
-func saveCurtailmentState(state *CurtailmentState) error {
-    data, err := json.MarshalIndent(state, "", "  ")
+func (p *calcParser) parse() (calcNode, error) {
+    n, err := p.expr()
     if err != nil {
-        return err
+        return nil, err
     }
-    return os.WriteFile(curtailmentStateFile, data, 0644)
+    if c := p.peek(); c != 0 {
+        return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos+1)
+    }
+    return n, nil
 }
 
-// clearCurtailmentState removes the curtailment state file
-func clearCurtailmentState() error {
-    err := os.Remove(curtailmentStateFile)
-    if err != nil && !os.IsNotExist(err) {
-        return err
+func (p *calcParser) expr() (calcNode, error) {
+    l, err := p.term()
+    for err == nil {
+        op := p.peek()
+        if op != '+' && op != '-' {
+            return l, nil
+        }
+        p.pos++
+        var r calcNode
+        r, err = p.term()
+        l = calcBinary{op: op, l: l, r: r}
     }
-    return nil
+    return nil, err
 }
 
-// getDrivesForGroups returns all drives matching the specified groups
-// If groups is empty, returns all drives
-func getDrivesForGroups(groups []string) []DriveConfig {
-    var drives []DriveConfig
-    if len(groups) == 0 {
-        // Return all drives
-        drives = appConfig.VFDs
-    } else {
-        // Return only drives in specified groups
-        for _, drive := range appConfig.VFDs {
-            for _, group := range groups {
-                if drive.Group == group {
-                    drives = append(drives, drive)
-                    break
-                }
-            }
+func (p *calcParser) term() (calcNode, error) {
+    l, err := p.unary()
+    for err == nil {
+        op := p.peek()
+        if op != '*' && op != '/' {
+            return l, nil
         }
+        p.pos++
+        var r calcNode
+        r, err = p.unary()
+        l = calcBinary{op: op, l: l, r: r}
     }
-    return drives
+    return nil, err
 }
 
-// curtailDrives saves current state and stops selected drives
-func curtailDrives(groups []string) error {
-    drives := getDrivesForGroups(groups)
-    if len(drives) == 0 {
-        return fmt.Errorf("no drives found for the specified groups")
+func (p *calcParser) unary() (calcNode, error) {
+    switch p.peek() {
+    case '-':
+        p.pos++
+        x, err := p.unary()
+        return calcNeg{x}, err
+    case '+':
+        p.pos++
+        return p.unary()
     }
+    return p.primary()
+}
 
-    state := CurtailmentState{
-        Timestamp: time.Now(),
-        Groups:    groups,
-        Drives:    make([]CurtailedDriveState, 0),
-    }
+func isCalcNameChar(c byte, first bool) bool {
+    return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
 
-    // Get current state from vfdData
-    vfdDataMutex.RLock()
-    liveByIP := make(map[string]map[string]interface{}, len(vfdData))
-    for _, entry := range vfdData {
-        if ip, ok := entry["ip"].(string); ok {
-            liveByIP[ip] = entry
+func (p *calcParser) primary() (calcNode, error) {
+    c := p.peek()
+    switch {
+    case c == 0:
+        return nil, fmt.Errorf("unexpected end of expression")
+    case c == '(':
+        p.pos++
+        n, err := p.expr()
+        if err != nil {
+            return nil, err
         }
-    }
-    for _, drive := range drives {
-        entry, ok := liveByIP[drive.IP]
-        if !ok {
-            continue
+        if p.peek() != ')' {
+            return nil, fmt.Errorf("missing ')' at position %d", p.pos+1)
         }
-        curtailedDrive := CurtailedDriveState{
-            IP:    drive.IP,
-            Group: drive.Group,
+        p.pos++
+        return n, nil
+    case c == '.' || c >= '0' && c <= '9':
+        start := p.pos
+        for p.pos < len(p.src) && (p.src[p.pos] == '.' || p.src[p.pos] >= '0' && p.src[p.pos] <= '9') {
+            p.pos++
         }
-        if setSpeed, ok := entry["setSpeed"].(float64); ok {
-            curtailedDrive.SetSpeed = setSpeed
+        if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+            p.pos++
+            if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+                p.pos++
+            }
+            for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+                p.pos++
+            }
         }
-        if status, ok := entry["status"].(string); ok {
-            curtailedDrive.Status = status
+        v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+        if err != nil {
+            return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
         }
-        state.Drives = append(state.Drives, curtailedDrive)
-    }
-    vfdDataMutex.RUnlock()
-
-    // Save state to file
-    err := saveCurtailmentState(&state)
-    if err != nil {
-        return fmt.Errorf("failed to save curtailment state: %w", err)
-    }
-
-    log.Printf("[CURTAIL] Saving state for %d drives in groups: %v", len(state.Drives), groups)
-
-    // Stop all affected drives
-    var wg sync.WaitGroup
-    for _, drive := range state.Drives {
-        wg.Add(1)
-        go func(ip string) {
-            defer wg.Done()
-            err := fanStop(ip)
+        return calcNum(v), nil
+    case isCalcNameChar(c, true):
+        start := p.pos
+        for p.pos < len(p.src) && isCalcNameChar(p.src[p.pos], false) {
+            p.pos++
+        }
+        name := p.src[start:p.pos]
+        if p.peek() != '(' {
+            return calcVar(name), nil
+        }
+        arity, ok := calcFuncs[name]
+        if !ok {
+            return nil, fmt.Errorf("unknown function %q", name)
+        }
+        p.pos++
+        var args []calcNode
+        for p.peek() != ')' {
+            if len(args) > 0 {
+                if p.peek() != ',' {
+                    return nil, fmt.Errorf("expected ',' or ')' at position %d", p.pos+1)
+                }
+                p.pos++
+            }
+            a, err := p.expr()
             if err != nil {
-                log.Printf("[CURTAIL] Warning: Failed to stop drive %s: %v", ip, err)
+                return nil, err
             }
-        }(drive.IP)
-    }
-    wg.Wait()
-
-    log.Printf("[CURTAIL] Curtailment complete, %d drives stopped, state saved", len(state.Drives))
-    return nil
-}
-
-// resumeDrives restores drives to their previous state
-func resumeDrives() error {
-    state, err := loadCurtailmentState()
-    if err != nil {
-        if os.IsNotExist(err) {
-            return fmt.Errorf("no curtailment state found to resume")
+            args = append(args, a)
         }
-        return fmt.Errorf("failed to load curtailment state: %w", err)
+        p.pos++
+        if len(args) < arity[0] || arity[1] >= 0 && len(args) > arity[1] {
+            return nil, fmt.Errorf("wrong number of arguments to %s: %d", name, len(args))
+        }
+        return calcCall{fn: name, args: args}, nil
     }
+    return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos+1)
+}
 
-    log.Printf("[RESUME] Loading curtailment state from %s", state.Timestamp.Format(time.RFC3339))
-    log.Printf("[RESUME] Restoring %d drives to previous state", len(state.Drives))
-
-    // Restore each drive
-    var wg sync.WaitGroup
-    for _, drive := range state.Drives {
-        wg.Add(1)
-        go func(d CurtailedDriveState) {
-            defer wg.Done()
-            if d.Status == "Running" || d.Status == "Enabled" {
-                // Restore speed and start the drive
-                err := setFanSpeed(d.IP, d.SetSpeed)
-                if err != nil {
-                    log.Printf("[RESUME] Warning: Failed to restore drive %s: %v", d.IP, err)
-                    return
-                }
-                log.Printf("[RESUME] Restored drive %s to %.1f Hz", d.IP, d.SetSpeed)
-            } else {
-                log.Printf("[RESUME] Drive %s was stopped, leaving stopped", d.IP)
-            }
-        }(drive)
+func parseFreqCalc(expr string) freqCalc {
+    expr = strings.TrimSpace(expr)
+    if expr == "" {
+        return freqCalc{}
     }
-    wg.Wait()
-
-    // Clear the curtailment state file
-    err = clearCurtailmentState()
-    if err != nil {
-        log.Printf("[RESUME] Warning: Failed to clear curtailment state file: %v", err)
+    if expr[0] == '*' || expr[0] == '/' {
+        expr = "raw " + expr
     }
-
-    log.Printf("[RESUME] Resume complete, state cleared")
-    return nil
+    root, err := (&calcParser{src: expr}).parse()
+    return freqCalc{root: root, err: err}
 }
 
-// =====================
-// HTTP/WebSocket Handlers
-// =====================
-func handleLivePage(w http.ResponseWriter, r *http.Request) {
-        http.ServeFile(w, r, "/etc/vfd/index.html")
+func (c freqCalc) apply(raw float64) float64 {
+    return c.eval(raw, nil)
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-    log.Printf("WebSocket connection attempt from %s", r.RemoteAddr)
-    conn, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        log.Println("WebSocket upgrade error:", err)
-        return
+// eval returns raw unchanged when the expression failed to compile or cannot be
+// evaluated (unknown variable, division by zero)
+func (c freqCalc) eval(raw float64, vars map[string]float64) float64 {
+    if c.err != nil {
+        return raw
     }
-    defer conn.Close()
-    log.Printf("WebSocket connection established from %s", r.RemoteAddr)
-
-    // Send initial data immediately
-    vfdDataMutex.RLock()
-    initialData := make([]map[string]interface{}, len(vfdData))
-    copy(initialData, vfdData)
-    vfdDataMutex.RUnlock()
-
-    log.Printf("Sending initial data to WebSocket client, data length: %d", len(initialData))
-    if err := conn.WriteJSON(initialData); err != nil {
-        log.Println("WebSocket initial write error:", err)
-        return
+    if c.root == nil {
+        return raw / 10.0
     }
-    log.Println("Initial data sent successfully")
-
-    // Then send updated data every second
-    ticker := time.NewTicker(1 * time.Second)
-    defer ticker.Stop()
+    v, err := c.root.eval(raw, vars)
+    if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+        return raw
+    }
+    return v
+}
 
-    for range ticker.C {
-        vfdDataMutex.RLock()
-        data := make([]map[string]interface{}, len(vfdData))
-        copy(data, vfdData)
-        vfdDataMutex.RUnlock()
+// freqCalcCache holds the compiled form of every profile expression. It is built at
+// startup, extended when /api/profiles stores a profile and rebuilt on reload (under profilesMu).
+var freqCalcCache = make(map[string]freqCalc)
 
-        if err := conn.WriteJSON(data); err != nil {
-            log.Println("WebSocket write error:", err)
-            return
+// buildFreqCalcCache compiles every profile expression, logging any that fail to
+// compile or refer to variables the profile does not provide
+func buildFreqCalcCache() {
+    for name, p := range driveTypeProfiles {
+        for _, problem := range cacheProfileCalcs(p) {
+            log.Printf("[PROFILE] %s %s", name, problem)
         }
     }
 }
 
-func handleControlEvents(w http.ResponseWriter, r *http.Request) {
-    eventsMutex.RLock()
-    events := make([]map[string]interface{}, len(controlEvents))
-    for i, event := range controlEvents {
-        events[i] = map[string]interface{}{
-            "timestamp": event.Timestamp.Format(time.RFC3339),
-            "action":    event.Action,
-            "speed":     event.Speed,
-            "drives":    event.Drives,
+// profileExprs returns a profile's scaling expressions keyed by field
+func (p DriveTypeProfile) profileExprs() map[string]string {
+    exprs := map[string]string{"OutFreqCalc": p.OutFreqCalc, "SetFreqCalc": p.SetFreqCalc, "OutCurrentCalc": p.OutCurrentCalc, "OutPowerCalc": p.OutPowerCalc, "SetpointReadCalc": p.SetpointReadCalc, "EnergyCalc": p.EnergyCalc}
+    for _, er := range p.ExtraRegisters {
+        if er.Calc != "" {
+            exprs["ExtraRegisters."+er.Name] = er.Calc
         }
     }
-    eventsMutex.RUnlock()
-    json.NewEncoder(w).Encode(events)
+    return exprs
 }
 
-func handleControl(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-                http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-                return
+// cacheProfileCalcs compiles a profile's expressions into freqCalcCache and returns their problems.
+// Caller holds profilesMu (or runs before the server starts).
+func cacheProfileCalcs(p DriveTypeProfile) []string {
+    var problems []string
+    for field, expr := range p.profileExprs() {
+        c, ok := freqCalcCache[expr]
+        if !ok {
+            c = parseFreqCalc(expr)
+            freqCalcCache[expr] = c
+        }
+        for _, problem := range p.calcProblems(field, c) {
+            problems = append(problems, fmt.Sprintf("%s %q: %s", field, expr, problem))
         }
+    }
+    sort.Strings(problems)
+    return problems
+}
 
-        var controlData struct {
-                Drives []string `json:"drives"`
-                Action string   `json:"action"`
-                Speed  float64  `json:"speed"`  
+// calcProblems reports why a compiled expression would fall back to returning raw
+func (p DriveTypeProfile) calcProblems(field string, c freqCalc) []string {
+    if c.err != nil {
+        return []string{c.err.Error()}
+    }
+    if c.root == nil {
+        return nil
+    }
+    used := make(map[string]bool)
+    calcVariables(c.root, used)
+    var problems []string
+    for v := range used {
+        _, isConst := p.Constants[v]
+        isField := false
+        for _, f := range calcFieldVars {
+            isField = isField || f == v
         }
-        err := json.NewDecoder(r.Body).Decode(&controlData)
-        if err != nil {
-                http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
-                return
+        for _, er := range p.ExtraRegisters {
+            isField = isField || er.Name == v
         }
-
-        // Validate action
-        if controlData.Action != "Freespin" && controlData.Action != "Fanhold" && controlData.Action != "SetSpeed" && controlData.Action != "Start" && controlData.Action != "Stop" {
-                http.Error(w, "Invalid action", http.StatusBadRequest)
-                return
+        // SetFreqCalc runs on the command path, where only raw and Constants exist
+        if v == "raw" || isConst || isField && field != "SetFreqCalc" {
+            continue
         }
+        problems = append(problems, fmt.Sprintf("unknown variable %q", v))
+    }
+    sort.Strings(problems)
+    return problems
+}
 
-        log.Printf("[INCOMING REQUEST] Control action: Action=%s, Speed=%.2f, Drives=%v\n", controlData.Action, controlData.Speed, controlData.Drives)
+// calcVars returns the variables for expressions evaluated during a poll: the profile's
+// Constants plus the raw register values (standard and extra) read this cycle
+func (p DriveTypeProfile) calcVars(fields map[string]float64) map[string]float64 {
+    vars := make(map[string]float64, len(p.Constants)+len(fields))
+    for k, v := range p.Constants {
+        vars[k] = v
+    }
+    for k, v := range fields {
+        vars[k] = v
+    }
+    return vars
+}
 
-    event := ControlEvent{
-        Timestamp: time.Now(),
-        Action:    controlData.Action,
-        Speed:     controlData.Speed,
-        Drives:    make([]DriveEventInfo, 0),
+// applyCalc scales raw with a profile expression and variable set
+func applyCalc(expr string, raw float64, vars map[string]float64) float64 {
+    profilesMu.RLock()
+    c, ok := freqCalcCache[expr]
+    profilesMu.RUnlock()
+    if ok {
+        return c.eval(raw, vars)
     }
+    return parseFreqCalc(expr).eval(raw, vars)
+}
 
-    var wg sync.WaitGroup
-    var mu sync.Mutex
-    
-    for _, ip := range controlData.Drives {
-        wg.Add(1)
-        go func(ip string) {
-            defer wg.Done()
-            driveInfo := DriveEventInfo{IP: ip, Success: true}
-            var err error
+// Helper to apply OutFreqCalc expression to the raw frequency value
+func applyFreqCalc(raw float64, expr string) float64 {
+    return applyCalc(expr, raw, nil)
+}
+
+// =====================
+// Sensors
+// =====================
+// Sensors are non-drive Modbus devices, e.g. temperature/humidity or vibration transmitters
+// and digital I/O modules. They are read in the same poll cycle as the drives and published
+// in sensorData (guarded by vfdDataMutex), /api/sensors, the WebSocket (clients that ask
+// with ?sensors=1) and Prometheus. Control code reads them as named signals through
+// sensorValue. I/O module outputs (beacons, damper commands) either follow a condition
+// (driveSensorOutputs, each poll) or are set through POST /api/sensors/<name>/<output>.
+
+// SensorConfig is one sensor in config.json Sensors. A register address of 0 is not read.
+type SensorConfig struct {
+    Name         string `json:"Name"` // unique; signals are "<Name>.temperature", "<Name>.humidity", "<Name>.vibration", "<Name>.<input>" and "<Name>.<output>"
+    IP           string `json:"IP"`
+    Port         int    `json:"Port"` // default 502
+    Unit         int    `json:"Unit"`
+    Group        string `json:"Group,omitempty"`
+    RegisterType string `json:"RegisterType,omitempty"` // "holding" (default) or "input"
+    Temperature  int    `json:"Temperature,omitempty"`  // signed 16-bit
+    TempCalc     string `json:"TempCalc,omitempty"`     // to °C; default "/ 10" as for drives
+    Humidity     int    `json:"Humidity,omitempty"`
+    HumidityCalc string `json:"HumidityCalc,omitempty"` // to %RH; default "/ 10"
+    Vibration     int    `json:"Vibration,omitempty"`
+    VibrationCalc string `json:"VibrationCalc,omitempty"` // to mm/s RMS; default "/ 10"
+    Inputs        map[string]int `json:"Inputs,omitempty"` // discrete inputs (FC02) by name, e.g. {"purge": 0}; read as 1 or 0
+    Outputs       map[string]SensorOutput `json:"Outputs,omitempty"` // coils (FC05) by name, read back as 1 or 0
+}
+
+// SensorOutput is a coil on an I/O module
+type SensorOutput struct {
+    Coil   int    `json:"Coil"`
+    Follow string `json:"Follow,omitempty"` // "Purge", "EmergencyStop", "Alert", "Alert:<kind>", "Running:<group>" or a signal; empty = set through the API only
+}
+
+// sensorEntryFields are the live entry keys an input or output can't be named
+var sensorEntryFields = []string{"name", "ip", "group", "kind", "status", "lastUpdated", "temperature", "humidity", "vibration"}
+
+// sensorStaleAfter is how old a reading may be before sensorValue stops returning it
+const sensorStaleAfter = 10 * time.Second
+
+var (
+    sensorData []map[string]interface{} // live readings, guarded by vfdDataMutex
+
+    sensorConnsMu sync.Mutex
+    sensorConns   = make(map[string]*VFDConnection) // sensor name -> session
+    sensorRetry   = make(map[string]time.Time)      // sensor name -> earliest reconnect
+
+    vfdSensorTemperature = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "sensor_temperature_celsius",
+            Help:      "Sensor temperature",
+        },
+        []string{"name", "group"},
+    )
+    vfdSensorHumidity = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "sensor_humidity_percent",
+            Help:      "Sensor relative humidity",
+        },
+        []string{"name", "group"},
+    )
+    vfdSensorVibration = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "sensor_vibration_mm_per_second",
+            Help:      "Sensor vibration velocity (RMS)",
+        },
+        []string{"name", "group"},
+    )
+    vfdSensorInput = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "sensor_input",
+            Help:      "Sensor digital input state (1 = on)",
+        },
+        []string{"name", "group", "input"},
+    )
+    vfdSensorOutput = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "sensor_output",
+            Help:      "Sensor digital output state as read back (1 = on)",
+        },
+        []string{"name", "group", "output"},
+    )
+    vfdSensorUp = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "sensor_up",
+            Help:      "1 when the sensor answered the last poll",
+        },
+        []string{"name", "group"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(vfdSensorTemperature, vfdSensorHumidity, vfdSensorVibration, vfdSensorInput, vfdSensorOutput, vfdSensorUp)
+}
+
+// validateSensors checks config.json Sensors; any problem is fatal at startup
+func validateSensors(sensors []SensorConfig) error {
+    seen := make(map[string]bool, len(sensors))
+    for _, s := range sensors {
+        switch {
+        case s.Name == "" || strings.ContainsAny(s.Name, ". /"):
+            return fmt.Errorf("sensor %q: Name must be non-empty, without dots, spaces or slashes", s.Name)
+        case seen[s.Name]:
+            return fmt.Errorf("sensor %q: duplicate Name", s.Name)
+        case s.IP == "":
+            return fmt.Errorf("sensor %q: no IP", s.Name)
+        case s.Temperature <= 0 && s.Humidity <= 0 && s.Vibration <= 0 && len(s.Inputs) == 0 && len(s.Outputs) == 0:
+            return fmt.Errorf("sensor %q: needs a Temperature, Humidity or Vibration register, Inputs or Outputs", s.Name)
+        case s.RegisterType != "" && s.RegisterType != "holding" && s.RegisterType != "input":
+            return fmt.Errorf("sensor %q: RegisterType must be \"holding\" or \"input\"", s.Name)
+        }
+        for _, expr := range []string{s.TempCalc, s.HumidityCalc, s.VibrationCalc} {
+            if err := parseFreqCalc(expr).err; err != nil {
+                return fmt.Errorf("sensor %q: calc %q: %v", s.Name, expr, err)
+            }
+        }
+        for name, addr := range s.Inputs {
+            if name == "" || strings.ContainsAny(name, ". /") || containsString(sensorEntryFields, name) || addr < 0 {
+                return fmt.Errorf("sensor %q: input %q: names must be non-empty, without dots, spaces or slashes, and not one of %s; addresses not negative", s.Name, name, strings.Join(sensorEntryFields, ", "))
+            }
+        }
+        for name, out := range s.Outputs {
+            if _, dup := s.Inputs[name]; dup || name == "" || strings.ContainsAny(name, ". /") || containsString(sensorEntryFields, name) || out.Coil < 0 {
+                return fmt.Errorf("sensor %q: output %q: names must be non-empty, without dots, spaces or slashes, not an input and not one of %s; coils not negative", s.Name, name, strings.Join(sensorEntryFields, ", "))
+            }
+        }
+        seen[s.Name] = true
+    }
+    return nil
+}
+
+// newSensorEntry is a sensor's live entry before its first successful read
+func newSensorEntry(s SensorConfig, now time.Time) map[string]interface{} {
+    return map[string]interface{}{
+        "name":        s.Name,
+        "ip":          s.IP,
+        "group":       s.Group,
+        "kind":        "sensor",
+        "status":      "Waiting",
+        "lastUpdated": now.Unix(),
+    }
+}
+
+func initializeSensorData() {
+    now := time.Now()
+    data := make([]map[string]interface{}, 0, len(appConfig.Sensors))
+    for _, s := range appConfig.Sensors {
+        data = append(data, newSensorEntry(s, now))
+    }
+    vfdDataMutex.Lock()
+    sensorData = data
+    vfdDataMutex.Unlock()
+}
+
+// sensorConn returns the sensor's session, connecting if it has none. Failed connects are
+// retried at most every 30 s so an absent sensor does not slow the poll cycle.
+func sensorConn(s SensorConfig) (*VFDConnection, error) {
+    sensorConnsMu.Lock()
+    old := sensorConns[s.Name]
+    if old != nil && old.healthy.Load() {
+        sensorConnsMu.Unlock()
+        return old, nil
+    }
+    if time.Now().Before(sensorRetry[s.Name]) {
+        sensorConnsMu.Unlock()
+        return nil, fmt.Errorf("sensor %s unavailable", s.Name)
+    }
+    delete(sensorConns, s.Name)
+    sensorRetry[s.Name] = time.Now().Add(30 * time.Second) // cleared if this attempt succeeds
+    sensorConnsMu.Unlock()
+
+    if old != nil {
+        old.mu.Lock()
+        old.handler.Close()
+        old.mu.Unlock()
+    }
+    port := s.Port
+    if port == 0 {
+        port = 502
+    }
+    handler := modbus.NewTCPClientHandler(fmt.Sprintf("%s:%d", s.IP, port))
+    handler.Timeout = 1 * time.Second
+    handler.SlaveID = byte(s.Unit)
+    if err := handler.Connect(context.Background()); err != nil {
+        return nil, err
+    }
+    conn := &VFDConnection{handler: handler, client: modbus.NewClient(handler), ip: s.IP, port: port, unit: byte(s.Unit)}
+    conn.healthy.Store(true)
+    sensorConnsMu.Lock()
+    sensorConns[s.Name] = conn
+    delete(sensorRetry, s.Name)
+    sensorConnsMu.Unlock()
+    log.Printf("[SENSOR] %s (%s) connected", s.Name, s.IP)
+    return conn, nil
+}
+
+// pollSensor reads a sensor's registers; a failed read marks its session for reconnect
+func pollSensor(ctx context.Context, s SensorConfig) (map[string]interface{}, error) {
+    conn, err := sensorConn(s)
+    if err != nil {
+        return nil, err
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    input := s.RegisterType == "input"
+    data := map[string]interface{}{"status": "Online"}
+    if s.Temperature > 0 {
+        raw, err := readRegister(ctx, conn.client, s.Temperature, input, true)
+        if err != nil {
+            conn.healthy.Store(false)
+            return nil, err
+        }
+        data["temperature"] = math.Round(applyCalc(s.TempCalc, raw, nil)*10) / 10
+    }
+    if s.Humidity > 0 {
+        raw, err := readRegister(ctx, conn.client, s.Humidity, input, false)
+        if err != nil {
+            conn.healthy.Store(false)
+            return nil, err
+        }
+        data["humidity"] = math.Round(applyCalc(s.HumidityCalc, raw, nil)*10) / 10
+    }
+    if s.Vibration > 0 {
+        raw, err := readRegister(ctx, conn.client, s.Vibration, input, false)
+        if err != nil {
+            conn.healthy.Store(false)
+            return nil, err
+        }
+        data["vibration"] = math.Round(applyCalc(s.VibrationCalc, raw, nil)*100) / 100
+    }
+    for name, addr := range s.Inputs {
+        res, err := conn.client.ReadDiscreteInputs(ctx, uint16(addr), 1)
+        if err == nil && len(res) < 1 {
+            err = fmt.Errorf("insufficient data for input %d", addr)
+        }
+        if err != nil {
+            conn.healthy.Store(false)
+            return nil, err
+        }
+        data[name] = float64(res[0] & 0x01)
+    }
+    for name, out := range s.Outputs {
+        res, err := conn.client.ReadCoils(ctx, uint16(out.Coil), 1)
+        if err == nil && len(res) < 1 {
+            err = fmt.Errorf("insufficient data for coil %d", out.Coil)
+        }
+        if err != nil {
+            conn.healthy.Store(false)
+            return nil, err
+        }
+        data[name] = float64(res[0] & 0x01)
+    }
+    return data, nil
+}
+
+// pollSensors reads every sensor, at most sem's capacity at once, and returns the new
+// entries in config order. A sensor that fails keeps no stale values.
+func pollSensors(current []map[string]interface{}, sem chan struct{}) []map[string]interface{} {
+    sensors := appConfig.Sensors
+    out := make([]map[string]interface{}, len(sensors))
+    var wg sync.WaitGroup
+    for i, s := range sensors {
+        entry := newSensorEntry(s, time.Now())
+        if i < len(current) && current[i]["name"] == s.Name {
+            entry["lastUpdated"] = current[i]["lastUpdated"]
+        }
+        out[i] = entry
+        wg.Add(1)
+        go func(s SensorConfig, entry map[string]interface{}) {
+            defer wg.Done()
+            sem <- struct{}{}
+            defer func() { <-sem }()
+            ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+            defer cancel()
+            data, err := pollSensor(ctx, s)
+            if err != nil {
+                entry["status"] = "Unavailable"
+                return
+            }
+            for k, v := range data {
+                entry[k] = v
+            }
+            entry["lastUpdated"] = time.Now().Unix()
+        }(s, entry)
+    }
+    wg.Wait()
+    return out
+}
+
+// sensorValue returns a named signal ("<sensor>.temperature", ".humidity", ".vibration" or
+// ".<input>", or "<source>.<value>" from ExternalSources) for control loops and interlocks. Offline
+// sensors and stale readings yield ok=false, so callers must decide how to fail safe.
+func sensorValue(signal string) (float64, bool) {
+    name, field, ok := strings.Cut(signal, ".")
+    if !ok {
+        return 0, false
+    }
+    if v, ok, found := externalValue(name, field); found {
+        return v, ok
+    }
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+    for _, entry := range sensorData {
+        if entry["name"] != name {
+            continue
+        }
+        ts, _ := entry["lastUpdated"].(int64)
+        if entry["status"] != "Online" || time.Since(time.Unix(ts, 0)) > sensorStaleAfter {
+            return 0, false
+        }
+        v, ok := entry[field].(float64)
+        return v, ok
+    }
+    return 0, false
+}
+
+// outputFollowValue is the state an output's Follow asks for. ok=false (a signal with no
+// current value) leaves the output as it is.
+func outputFollowValue(follow string, snapshot []map[string]interface{}) (on, ok bool) {
+    kind, arg, _ := strings.Cut(follow, ":")
+    switch kind {
+    case "Purge":
+        purgeMu.Lock()
+        defer purgeMu.Unlock()
+        return purgeState != nil, true
+    case "EmergencyStop":
+        return estopError() != nil, true
+    case "Alert":
+        alertsMu.Lock()
+        defer alertsMu.Unlock()
+        for _, a := range activeAlerts {
+            if (arg == "" && a.Severity == "critical") || (arg != "" && a.Kind == arg) {
+                return true, true
+            }
+        }
+        return false, true
+    case "Running":
+        for _, entry := range snapshot {
+            ip, _ := entry["ip"].(string)
+            if d, ok := driveConfig(ip); ok && d.Group == arg && entry["status"] == "Running" {
+                return true, true
+            }
+        }
+        return false, true
+    }
+    v, ok := sensorValue(follow)
+    return v != 0, ok
+}
+
+// validateOutputFollow checks an output's Follow against the config
+func validateOutputFollow(follow string, vfds []DriveConfig) error {
+    kind, arg, hasArg := strings.Cut(follow, ":")
+    switch {
+    case follow == "" || follow == "Purge" || follow == "EmergencyStop" || follow == "Alert":
+        return nil
+    case kind == "Alert" && hasArg:
+        if !alertKinds[arg] {
+            return fmt.Errorf("Follow %q: unknown alert kind", follow)
+        }
+        return nil
+    case kind == "Running" && hasArg:
+        for _, d := range vfds {
+            if d.Group == arg {
+                return nil
+            }
+        }
+        return fmt.Errorf("Follow %q: group has no drives", follow)
+    case strings.Contains(follow, "."):
+        return nil // a signal
+    }
+    return fmt.Errorf("Follow %q: must be \"Purge\", \"EmergencyStop\", \"Alert\", \"Alert:<kind>\", \"Running:<group>\" or a signal \"<name>.<value>\"", follow)
+}
+
+// setSensorOutput writes an output coil through the sensor's session and updates its
+// live entry, so the next poll doesn't write it again before reading it back
+func setSensorOutput(s SensorConfig, name string, on bool) error {
+    out, ok := s.Outputs[name]
+    if !ok {
+        return fmt.Errorf("sensor %s has no output %q", s.Name, name)
+    }
+    conn, err := sensorConn(s)
+    if err != nil {
+        return err
+    }
+    conn.mu.Lock()
+    err = writeCoil(conn, out.Coil, on)
+    conn.mu.Unlock()
+    if err != nil {
+        conn.healthy.Store(false)
+        return err
+    }
+    vfdDataMutex.Lock()
+    for _, entry := range sensorData {
+        if entry["name"] == s.Name {
+            entry[name] = boolToFloat(on)
+        }
+    }
+    vfdDataMutex.Unlock()
+    return nil
+}
+
+// driveSensorOutputs sets each output with a Follow that reads back differently from
+// what its Follow asks for. Offline modules are skipped until they answer again.
+func driveSensorOutputs(snapshot []map[string]interface{}) {
+    if shadowMode() {
+        return
+    }
+    for _, s := range appConfig.Sensors {
+        for name, out := range s.Outputs {
+            if out.Follow == "" {
+                continue
+            }
+            want, ok := outputFollowValue(out.Follow, snapshot)
+            if !ok {
+                continue
+            }
+            current, online := sensorValue(s.Name + "." + name)
+            if !online || (current != 0) == want {
+                continue
+            }
+            if err := setSensorOutput(s, name, want); err != nil {
+                log.Printf("[IO] %s.%s (%s): failed to set %s: %v", s.Name, name, out.Follow, onOff(want), err)
+                continue
+            }
+            log.Printf("[IO] %s.%s set %s (%s)", s.Name, name, onOff(want), out.Follow)
+        }
+    }
+}
+
+func onOff(on bool) string {
+    if on {
+        return "on"
+    }
+    return "off"
+}
+
+// handleSensorRoutes serves /api/sensors/<name>/<output>: POST {"on": true, "user": "..."}
+// sets an output that has no Follow
+func handleSensorRoutes(w http.ResponseWriter, r *http.Request) {
+    name, output, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sensors/"), "/"), "/")
+    var sensor *SensorConfig
+    for i := range appConfig.Sensors {
+        if appConfig.Sensors[i].Name == name {
+            sensor = &appConfig.Sensors[i]
+        }
+    }
+    out, ok := SensorOutput{}, false
+    if sensor != nil {
+        out, ok = sensor.Outputs[output]
+    }
+    if !ok {
+        http.Error(w, "Unknown sensor output: "+name+"/"+output, http.StatusNotFound)
+        return
+    }
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    if out.Follow != "" {
+        http.Error(w, "Output follows "+out.Follow+" and can't be set by hand", http.StatusConflict)
+        return
+    }
+    var req struct {
+        On   bool   `json:"on"`
+        User string `json:"user"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if strings.TrimSpace(req.User) == "" {
+        http.Error(w, "user is required", http.StatusBadRequest)
+        return
+    }
+    event := ControlEvent{Timestamp: time.Now(), Action: "SetOutput", Drives: []DriveEventInfo{}, Detail: fmt.Sprintf("%s.%s %s by %s", name, output, onOff(req.On), req.User)}
+    if err := setSensorOutput(*sensor, output, req.On); err != nil {
+        http.Error(w, "Failed to set output: "+err.Error(), http.StatusBadGateway)
+        return
+    }
+    log.Printf("[IO] %s", event.Detail)
+    recordControlEvent(event)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(event)
+}
+
+// collectSensorMetrics exports the latest sensor readings; series of missing values are dropped
+func collectSensorMetrics() {
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+    for i, entry := range sensorData {
+        name, _ := entry["name"].(string)
+        group, _ := entry["group"].(string)
+        labels := prometheus.Labels{"name": name, "group": group}
+        vfdSensorUp.With(labels).Set(boolToFloat(entry["status"] == "Online"))
+        if i < len(appConfig.Sensors) {
+            for input := range appConfig.Sensors[i].Inputs {
+                inputLabels := prometheus.Labels{"name": name, "group": group, "input": input}
+                if v, ok := entry[input].(float64); ok {
+                    vfdSensorInput.With(inputLabels).Set(v)
+                } else {
+                    vfdSensorInput.Delete(inputLabels)
+                }
+            }
+            for output := range appConfig.Sensors[i].Outputs {
+                outputLabels := prometheus.Labels{"name": name, "group": group, "output": output}
+                if v, ok := entry[output].(float64); ok {
+                    vfdSensorOutput.With(outputLabels).Set(v)
+                } else {
+                    vfdSensorOutput.Delete(outputLabels)
+                }
+            }
+        }
+        for field, vec := range map[string]*prometheus.GaugeVec{"temperature": vfdSensorTemperature, "humidity": vfdSensorHumidity, "vibration": vfdSensorVibration} {
+            if v, ok := entry[field].(float64); ok {
+                vec.With(labels).Set(v)
+            } else {
+                vec.Delete(labels)
+            }
+        }
+    }
+}
+
+// sensorSnapshot copies the live sensor entries for handlers
+func sensorSnapshot() []map[string]interface{} {
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+    out := make([]map[string]interface{}, len(sensorData))
+    copy(out, sensorData)
+    return out
+}
+
+func handleSensors(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(sensorSnapshot())
+}
+
+// =====================
+// External Data Sources
+// =====================
+// Some control inputs (chilled-water plant load, IT load from DCIM) are only available
+// over REST. Each ExternalSources entry is fetched with GET every IntervalSec, and the
+// numbers its Values paths select become signals "<Name>.<value>", read like sensor
+// signals through sensorValue. They are shown by /api/external-sources and exported as
+// vfd_external_value. A value that fails to fetch or parse goes stale after MaxAgeSec.
+
+const (
+    defaultExternalIntervalSec = 30
+    minExternalIntervalSec     = 5
+    defaultExternalTimeoutSec  = 10
+)
+
+// ExternalSourceConfig is one REST endpoint in config.json ExternalSources. Auth is Basic
+// (Username/Password) or any header, e.g. {"Authorization": "Bearer ..."}.
+type ExternalSourceConfig struct {
+    Name        string            `json:"Name"` // unique across sensors and sources; signals are "<Name>.<value>"
+    URL         string            `json:"URL"`
+    Values      map[string]string `json:"Values"` // value name -> JSONPath into the response, e.g. "$.plant.loadTons"
+    IntervalSec int               `json:"IntervalSec,omitempty"` // default 30, min 5
+    TimeoutSec  int               `json:"TimeoutSec,omitempty"`  // default 10, less than IntervalSec
+    MaxAgeSec   int               `json:"MaxAgeSec,omitempty"`   // values older than this are stale; default 3 intervals
+    Headers     map[string]string `json:"Headers,omitempty"`
+    Username    string            `json:"Username,omitempty"`
+    Password    string            `json:"Password,omitempty"`
+}
+
+func (c ExternalSourceConfig) interval() time.Duration {
+    if c.IntervalSec <= 0 {
+        return defaultExternalIntervalSec * time.Second
+    }
+    return time.Duration(c.IntervalSec) * time.Second
+}
+
+func (c ExternalSourceConfig) timeout() time.Duration {
+    if c.TimeoutSec <= 0 {
+        return min(defaultExternalTimeoutSec*time.Second, c.interval()/2)
+    }
+    return time.Duration(c.TimeoutSec) * time.Second
+}
+
+func (c ExternalSourceConfig) maxAge() time.Duration {
+    if c.MaxAgeSec <= 0 {
+        return 3 * c.interval()
+    }
+    return time.Duration(c.MaxAgeSec) * time.Second
+}
+
+// ExternalSourceStatus is a source's last poll, for /api/external-sources
+type ExternalSourceStatus struct {
+    Name        string             `json:"name"`
+    URL         string             `json:"url"` // without credentials
+    Status      string             `json:"status"` // "Waiting", "Online" or "Unavailable"
+    Error       string             `json:"error,omitempty"`
+    LastPoll    *time.Time         `json:"lastPoll,omitempty"`
+    LastSuccess *time.Time         `json:"lastSuccess,omitempty"`
+    Values      map[string]float64 `json:"values"`
+    Stale       bool               `json:"stale"`
+    maxAge      time.Duration
+}
+
+func (st *ExternalSourceStatus) stale(now time.Time) bool {
+    return st.LastSuccess == nil || now.Sub(*st.LastSuccess) > st.maxAge
+}
+
+var (
+    externalMu     sync.RWMutex
+    externalStatus = make(map[string]*ExternalSourceStatus) // by source name
+
+    vfdExternalValue = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "external_value",
+            Help:      "Value read from an external REST source",
+        },
+        []string{"source", "value"},
+    )
+    vfdExternalUp = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "external_up",
+            Help:      "1 when the external source answered the last poll",
+        },
+        []string{"source"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(vfdExternalValue, vfdExternalUp)
+}
+
+// jsonPathStep is one field name or array index of a JSONPath
+type jsonPathStep struct {
+    key   string
+    index int // used when key is ""
+}
+
+// parseJSONPath accepts the JSONPath subset of field and index steps: "$.a.b[0]['c d']".
+// The leading "$" is optional.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+    rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+    var steps []jsonPathStep
+    for rest != "" {
+        switch {
+        case rest[0] == '.':
+            end := strings.IndexAny(rest[1:], ".[")
+            if end < 0 {
+                end = len(rest) - 1
+            }
+            if end == 0 {
+                return nil, fmt.Errorf("empty field name in %q", path)
+            }
+            steps = append(steps, jsonPathStep{key: rest[1 : end+1]})
+            rest = rest[end+1:]
+        case strings.HasPrefix(rest, "['"):
+            end := strings.Index(rest, "']")
+            if end < 3 {
+                return nil, fmt.Errorf("bad quoted field in %q", path)
+            }
+            steps = append(steps, jsonPathStep{key: rest[2:end]})
+            rest = rest[end+2:]
+        case rest[0] == '[':
+            end := strings.IndexByte(rest, ']')
+            if end < 0 {
+                return nil, fmt.Errorf("unclosed index in %q", path)
+            }
+            n, err := strconv.Atoi(rest[1:end])
+            if err != nil || n < 0 {
+                return nil, fmt.Errorf("bad index %q in %q", rest[1:end], path)
+            }
+            steps = append(steps, jsonPathStep{index: n})
+            rest = rest[end+1:]
+        default:
+            return nil, fmt.Errorf("unexpected %q in %q", rest, path)
+        }
+    }
+    if len(steps) == 0 {
+        return nil, fmt.Errorf("path %q selects nothing", path)
+    }
+    return steps, nil
+}
+
+// jsonPathNumber follows a parsed path through a decoded JSON document. Numbers, numeric
+// strings and booleans (as 1/0) are accepted.
+func jsonPathNumber(doc interface{}, steps []jsonPathStep) (float64, error) {
+    for _, st := range steps {
+        switch v := doc.(type) {
+        case map[string]interface{}:
+            next, ok := v[st.key]
+            if st.key == "" || !ok {
+                return 0, fmt.Errorf("no field %q", st.key)
+            }
+            doc = next
+        case []interface{}:
+            if st.key != "" || st.index >= len(v) {
+                return 0, fmt.Errorf("no element [%d] of %d", st.index, len(v))
+            }
+            doc = v[st.index]
+        default:
+            return 0, fmt.Errorf("cannot descend into %T", doc)
+        }
+    }
+    switch v := doc.(type) {
+    case float64:
+        return v, nil
+    case bool:
+        return boolToFloat(v), nil
+    case string:
+        return strconv.ParseFloat(strings.TrimSpace(v), 64)
+    }
+    return 0, fmt.Errorf("value is %T, not a number", doc)
+}
+
+// validateExternalSources checks config.json ExternalSources; any problem is fatal at startup
+func validateExternalSources(sources []ExternalSourceConfig, sensors []SensorConfig) error {
+    seen := make(map[string]bool)
+    for _, s := range sensors {
+        seen[s.Name] = true
+    }
+    for _, c := range sources {
+        u, err := url.Parse(c.URL)
+        switch {
+        case c.Name == "" || strings.ContainsAny(c.Name, ". /"):
+            return fmt.Errorf("external source %q: Name must be non-empty, without dots, spaces or slashes", c.Name)
+        case seen[c.Name]:
+            return fmt.Errorf("external source %q: Name is already used by a sensor or source", c.Name)
+        case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+            return fmt.Errorf("external source %q: URL must be http(s)", c.Name)
+        case len(c.Values) == 0:
+            return fmt.Errorf("external source %q: no Values", c.Name)
+        case c.IntervalSec != 0 && c.IntervalSec < minExternalIntervalSec:
+            return fmt.Errorf("external source %q: IntervalSec must be at least %d", c.Name, minExternalIntervalSec)
+        case c.timeout() >= c.interval():
+            return fmt.Errorf("external source %q: TimeoutSec must be less than IntervalSec", c.Name)
+        }
+        for name, path := range c.Values {
+            if name == "" || strings.ContainsAny(name, ". /") {
+                return fmt.Errorf("external source %q: value name %q must be non-empty, without dots, spaces or slashes", c.Name, name)
+            }
+            if _, err := parseJSONPath(path); err != nil {
+                return fmt.Errorf("external source %q: value %q: %v", c.Name, name, err)
+            }
+        }
+        seen[c.Name] = true
+    }
+    return nil
+}
+
+// pollExternalSource fetches a source and extracts its values. A value whose path doesn't
+// resolve is an error for the whole poll, since a changed API is worth noticing.
+func pollExternalSource(ctx context.Context, c ExternalSourceConfig) (map[string]float64, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Accept", "application/json")
+    for k, v := range c.Headers {
+        req.Header.Set(k, v)
+    }
+    if c.Username != "" {
+        req.SetBasicAuth(c.Username, c.Password)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        detail, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+        return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+    }
+    var doc interface{}
+    if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&doc); err != nil {
+        return nil, fmt.Errorf("invalid JSON: %v", err)
+    }
+    values := make(map[string]float64, len(c.Values))
+    for name, path := range c.Values {
+        steps, _ := parseJSONPath(path) // checked at startup
+        v, err := jsonPathNumber(doc, steps)
+        if err != nil {
+            return nil, fmt.Errorf("%s (%s): %v", name, path, err)
+        }
+        values[name] = v
+    }
+    return values, nil
+}
+
+// runExternalSources polls every source on its own interval for the life of the process
+func runExternalSources(sources []ExternalSourceConfig) {
+    for _, c := range sources {
+        u, _ := url.Parse(c.URL)
+        u.User = nil
+        externalMu.Lock()
+        externalStatus[c.Name] = &ExternalSourceStatus{Name: c.Name, URL: u.Redacted(), Status: "Waiting", Values: map[string]float64{}, maxAge: c.maxAge()}
+        externalMu.Unlock()
+        go func(c ExternalSourceConfig) {
+            ticker := time.NewTicker(c.interval())
+            defer ticker.Stop()
+            for {
+                ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+                values, err := pollExternalSource(ctx, c)
+                cancel()
+                recordExternalPoll(c.Name, values, err, time.Now())
+                <-ticker.C
+            }
+        }(c)
+    }
+}
+
+// recordExternalPoll stores a poll's outcome. A failed poll keeps the last values, which
+// externalValue stops returning once they are older than MaxAgeSec.
+func recordExternalPoll(name string, values map[string]float64, err error, now time.Time) {
+    externalMu.Lock()
+    defer externalMu.Unlock()
+    st := externalStatus[name]
+    if st == nil {
+        return
+    }
+    st.LastPoll = &now
+    if err != nil {
+        if st.Status != "Unavailable" {
+            log.Printf("[EXTERNAL] %s: %v", name, err)
+        }
+        st.Status, st.Error = "Unavailable", err.Error()
+        vfdExternalUp.WithLabelValues(name).Set(0)
+        return
+    }
+    if st.Status == "Unavailable" {
+        log.Printf("[EXTERNAL] %s: recovered", name)
+    }
+    st.Status, st.Error, st.LastSuccess, st.Values = "Online", "", &now, values
+    vfdExternalUp.WithLabelValues(name).Set(1)
+    for k, v := range values {
+        vfdExternalValue.WithLabelValues(name, k).Set(v)
+    }
+}
+
+// externalValue looks up "<source>.<value>". found is false when no source has that name,
+// so sensorValue can look among the sensors instead.
+func externalValue(source, value string) (v float64, ok, found bool) {
+    externalMu.RLock()
+    defer externalMu.RUnlock()
+    st := externalStatus[source]
+    if st == nil {
+        return 0, false, false
+    }
+    if st.stale(time.Now()) {
+        return 0, false, true
+    }
+    v, ok = st.Values[value]
+    return v, ok, true
+}
+
+// handleExternalSources serves GET /api/external-sources: each source's status and values
+func handleExternalSources(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    externalMu.RLock()
+    list := make([]ExternalSourceStatus, 0, len(externalStatus))
+    for _, st := range externalStatus {
+        entry := *st
+        entry.Values = make(map[string]float64, len(st.Values))
+        for k, v := range st.Values {
+            entry.Values[k] = v
+        }
+        entry.Stale = st.stale(time.Now())
+        list = append(list, entry)
+    }
+    externalMu.RUnlock()
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    json.NewEncoder(w).Encode(list)
+}
+
+// =====================
+// DCIM Load-Following
+// =====================
+// With DCIM set, each room's IT power (kW) is read from the DCIM API and its group's
+// airflow follows it: CfmPerKw × kW, kept between MinCfm and MaxCfm. The API is polled as
+// the external source "dcim" (signals "dcim.<room>"), and every IntervalSec runDCIM sets
+// the group's running drives to the one speed that gives the target airflow. Drives are
+// never started or stopped; speed limits, quiet hours and airflow reservations apply as to
+// any SetSpeed. A room whose reading is missing or stale keeps its current speeds. Rooms
+// can be paused through /api/dcim, e.g. while balancing by hand.
+const dcimSourceName = "dcim"
+
+type DCIMConfig struct {
+    URL         string            `json:"URL"`
+    Headers     map[string]string `json:"Headers,omitempty"`
+    Username    string            `json:"Username,omitempty"`
+    Password    string            `json:"Password,omitempty"`
+    IntervalSec int               `json:"IntervalSec,omitempty"` // poll and control interval, default 60
+    Rooms       []DCIMRoom        `json:"Rooms"`
+}
+
+type DCIMRoom struct {
+    Name            string  `json:"Name"`  // signal "dcim.<Name>"
+    Path            string  `json:"Path"`  // JSONPath to the room's IT power in kW
+    Group           string  `json:"Group"` // the group cooling the room
+    CfmPerKw        float64 `json:"CfmPerKw"`
+    MinCfm          float64 `json:"MinCfm,omitempty"` // floor, e.g. for minimum ventilation
+    MaxCfm          float64 `json:"MaxCfm,omitempty"` // ceiling; 0 = none
+    DeadbandPercent float64 `json:"DeadbandPercent,omitempty"` // changes smaller than this are not written, default 5
+}
+
+// DCIMRoomStatus is a room's last control pass, for /api/dcim
+type DCIMRoomStatus struct {
+    Room        string     `json:"room"`
+    Group       string     `json:"group"`
+    Enabled     bool       `json:"enabled"`
+    ItKw        *float64   `json:"itKw,omitempty"`
+    TargetCfm   float64    `json:"targetCfm,omitempty"`
+    PlannedCfm  float64    `json:"plannedCfm"` // group airflow from current setpoints
+    Hz          float64    `json:"hz,omitempty"`
+    Note        string     `json:"note,omitempty"`
+    LastApplied *time.Time `json:"lastApplied,omitempty"`
+}
+
+var (
+    dcimMu     sync.Mutex
+    dcimPaused = make(map[string]bool)            // by room name
+    dcimStatus = make(map[string]*DCIMRoomStatus) // by room name
+)
+
+// externalSources is ExternalSources plus the DCIM API, when configured
+func externalSources(cfg AppConfig) []ExternalSourceConfig {
+    sources := cfg.ExternalSources
+    if c := cfg.DCIM; c != nil {
+        values := make(map[string]string, len(c.Rooms))
+        for _, room := range c.Rooms {
+            values[room.Name] = room.Path
+        }
+        sources = append(append([]ExternalSourceConfig{}, sources...), ExternalSourceConfig{
+            Name: dcimSourceName, URL: c.URL, Values: values, IntervalSec: c.IntervalSec,
+            Headers: c.Headers, Username: c.Username, Password: c.Password,
+        })
+    }
+    return sources
+}
+
+func validateDCIM(c *DCIMConfig, drives []DriveConfig) error {
+    if c == nil {
+        return nil
+    }
+    if len(c.Rooms) == 0 {
+        return fmt.Errorf("DCIM: no Rooms")
+    }
+    groups := make(map[string]int)
+    for _, d := range drives {
+        if d.RpmToHz > 0 && d.CfmRpm > 0 {
+            groups[d.Group]++
+        } else if _, ok := groups[d.Group]; !ok {
+            groups[d.Group] = 0
+        }
+    }
+    seen, controlled := make(map[string]bool), make(map[string]bool)
+    for _, room := range c.Rooms {
+        n, ok := groups[room.Group]
+        switch {
+        case seen[room.Name]:
+            return fmt.Errorf("DCIM room %q: duplicate Name", room.Name)
+        case controlled[room.Group]:
+            return fmt.Errorf("DCIM room %q: group %s is already controlled by another room", room.Name, room.Group)
+        case !ok:
+            return fmt.Errorf("DCIM room %q: group %q has no drives", room.Name, room.Group)
+        case n == 0:
+            return fmt.Errorf("DCIM room %q: no drive in group %s has RpmHz and CfmRpm to convert airflow to speed", room.Name, room.Group)
+        case room.CfmPerKw <= 0:
+            return fmt.Errorf("DCIM room %q: CfmPerKw must be positive", room.Name)
+        case room.MinCfm < 0 || (room.MaxCfm > 0 && room.MaxCfm < room.MinCfm):
+            return fmt.Errorf("DCIM room %q: MinCfm must be between 0 and MaxCfm", room.Name)
+        }
+        seen[room.Name], controlled[room.Group] = true, true
+    }
+    return nil
+}
+
+// dcimTargetCfm is a room's airflow for an IT load, within its floor and ceiling
+func dcimTargetCfm(room DCIMRoom, kw float64) float64 {
+    target := math.Max(kw*room.CfmPerKw, room.MinCfm)
+    if room.MaxCfm > 0 {
+        target = math.Min(target, room.MaxCfm)
+    }
+    return target
+}
+
+// airflowLimits is the speed range shared by drives run at one speed: the highest
+// minimum, and the lowest soft or hard limit or the group's quiet-hours cap
+func airflowLimits(group string, drives []DriveConfig, now time.Time) (floor, limit float64) {
+    limit = math.Inf(1)
+    for i := range drives {
+        d := drives[i]
+        if lo, _ := speedRange(&d); lo > floor {
+            floor = lo
+        }
+        for _, max := range []float64{d.SoftMaxHz, d.HardMaxHz} {
+            if max > 0 {
+                limit = math.Min(limit, max)
+            }
+        }
+    }
+    if c, ok := quietHoursCap(group, now); ok && c.MaxHz < limit {
+        limit = c.MaxHz
+    }
+    return floor, limit
+}
+
+// airflowSpeed is the one speed that gives the target airflow from the drives, kept
+// within airflowLimits. It returns a note when the target can't be met.
+func airflowSpeed(group string, drives []DriveConfig, target float64, now time.Time) (float64, string) {
+    var cfmPerHz float64
+    for _, d := range drives {
+        cfmPerHz += driveCfmAt(d, 1)
+    }
+    if cfmPerHz <= 0 {
+        return 0, "running drives have no CfmRpm"
+    }
+    hz := target / cfmPerHz
+    note := ""
+    floor, limit := airflowLimits(group, drives, now)
+    if hz > limit {
+        hz, note = limit, fmt.Sprintf("limited to %.1f Hz", limit)
+    }
+    if hz < floor {
+        hz, note = floor, fmt.Sprintf("raised to the %.1f Hz minimum", floor)
+    }
+    return math.Round(hz*10) / 10, note
+}
+
+// runDCIM applies the DCIM targets every IntervalSec
+func runDCIM() {
+    c := appConfig.DCIM
+    if c == nil {
+        return
+    }
+    dcimMu.Lock()
+    for _, room := range c.Rooms {
+        dcimStatus[room.Name] = &DCIMRoomStatus{Room: room.Name, Group: room.Group, Enabled: true, Note: "waiting for DCIM"}
+    }
+    dcimMu.Unlock()
+    interval := ExternalSourceConfig{IntervalSec: c.IntervalSec}.interval()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        for _, room := range c.Rooms {
+            applyDCIMRoom(room, time.Now())
+        }
+    }
+}
+
+// applyDCIMRoom runs one control pass for a room
+func applyDCIMRoom(room DCIMRoom, now time.Time) {
+    dcimMu.Lock()
+    st := dcimStatus[room.Name]
+    paused := dcimPaused[room.Name]
+    dcimMu.Unlock()
+    if st == nil {
+        return
+    }
+
+    live := liveDrives()
+    var running []DriveConfig
+    var ips []string
+    var planned float64
+    for _, d := range getDrivesForGroups([]string{room.Group}) {
+        entry := live[d.IP]
+        planned += driveAirflow(d, entry)
+        if entry["status"] == "Running" && !isDriveDisabled(d.IP) && d.RpmToHz > 0 && d.CfmRpm > 0 {
+            running = append(running, d)
+            ips = append(ips, d.IP)
+        }
+    }
+    update := func(f func(*DCIMRoomStatus)) {
+        dcimMu.Lock()
+        st.Enabled, st.PlannedCfm = !paused, math.Round(planned)
+        f(st)
+        dcimMu.Unlock()
+    }
+
+    kw, ok := sensorValue(dcimSourceName + "." + room.Name)
+    if !ok {
+        update(func(st *DCIMRoomStatus) { st.ItKw, st.Note = nil, "no current DCIM reading; holding speeds" })
+        return
+    }
+    target := dcimTargetCfm(room, kw)
+    hz, note := airflowSpeed(room.Group, running, target, now)
+    if len(running) == 0 {
+        note = "no drives running"
+    }
+    update(func(st *DCIMRoomStatus) { st.ItKw, st.TargetCfm, st.Hz, st.Note = &kw, math.Round(target), hz, note })
+    if paused || len(running) == 0 || hz <= 0 {
+        return
+    }
+    ips, held := arbitrate(sourceAutomation, ips)
+    if len(held) > 0 {
+        note = joinWarnings(note, fmt.Sprintf("%d drives held by a higher-priority source", len(held)))
+        update(func(st *DCIMRoomStatus) { st.Note = note })
+    }
+    if len(ips) == 0 {
+        return
+    }
+    deadband := room.DeadbandPercent
+    if deadband <= 0 {
+        deadband = 5
+    }
+    atSpeed := true
+    for _, ip := range ips {
+        if math.Abs(safeFloat(live[ip]["setSpeed"])-hz) > 0.1 {
+            atSpeed = false
+        }
+    }
+    if atSpeed || math.Abs(planned-target) <= target*deadband/100 {
+        return
+    }
+    if conflicts := airflowConflicts("SetSpeed", hz, ips); len(conflicts) > 0 {
+        update(func(st *DCIMRoomStatus) { st.Note = joinWarnings(note, "held by an airflow reservation") })
+        return
+    }
+
+    detail := fmt.Sprintf("room %s: %.1f kW, target %.0f CFM, %.1f Hz", room.Name, kw, target, hz)
+    if note != "" {
+        detail += " (" + note + ")"
+    }
+    log.Printf("[DCIM] %s", detail)
+    event := executeControl("SetSpeed", hz, ips, false)
+    event.Action = "DCIMSetSpeed"
+    event.Detail = joinWarnings(detail, event.Detail)
+    recordControlEvent(event)
+    update(func(st *DCIMRoomStatus) { st.LastApplied = &now })
+}
+
+// handleDCIM serves GET /api/dcim (each room's load, target and speed) and
+// POST /api/dcim/<room> {"enabled": false} to pause a room's control, or true to resume it.
+func handleDCIM(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/dcim"), "/")
+    if r.Method == http.MethodGet && name == "" {
+        list := []DCIMRoomStatus{}
+        dcimMu.Lock()
+        for _, st := range dcimStatus {
+            list = append(list, *st)
+        }
+        dcimMu.Unlock()
+        sort.Slice(list, func(i, j int) bool { return list[i].Room < list[j].Room })
+        json.NewEncoder(w).Encode(map[string]interface{}{"enabled": appConfig.DCIM != nil, "rooms": list})
+        return
+    }
+    if r.Method != http.MethodPost || name == "" {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    var req struct {
+        Enabled *bool `json:"enabled"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+        http.Error(w, "Body must be {\"enabled\": true|false}", http.StatusBadRequest)
+        return
+    }
+    dcimMu.Lock()
+    st := dcimStatus[name]
+    var group string
+    if st != nil {
+        group = st.Group
+    }
+    dcimMu.Unlock()
+    if st == nil {
+        http.Error(w, "Unknown DCIM room: "+name, http.StatusNotFound)
+        return
+    }
+    var ips []string
+    for _, d := range getDrivesForGroups([]string{group}) {
+        ips = append(ips, d.IP)
+    }
+    if !authorize(w, r, "DCIM", ips) {
+        return
+    }
+    dcimMu.Lock()
+    dcimPaused[name] = !*req.Enabled
+    if st := dcimStatus[name]; st != nil {
+        st.Enabled = *req.Enabled
+    }
+    dcimMu.Unlock()
+    detail := "room " + name + " paused"
+    if *req.Enabled {
+        detail = "room " + name + " resumed"
+    }
+    log.Printf("[DCIM] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "DCIMControl", Drives: []DriveEventInfo{}, Detail: detail})
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// =====================
+// Target-CFM Control
+// =====================
+// {"action": "SetCfm", "cfm": N} on /api/control sets airflow instead of speed: N CFM per
+// fan for the listed drives, or N CFM in total from each listed group's running drives.
+// The speed comes from RpmHz and CfmRpm (airflowSpeed, within the speed limits and quiet
+// hours). The target then stays in force: after each poll, once a target's drives have
+// held their actual speed for CfmSettleSec, trimCfmTargets compares their actual airflow
+// with it and, beyond CfmTrimPercent, scales their setpoints by target/actual (at most 10%
+// per trim). Any other speed command for one of its drives ends a target, as does a
+// drive dropping out of the config. Drives polled by another shard, in hand or curtailed
+// are set but not trimmed.
+
+// CfmTarget is an airflow target in force, for /api/cfm-targets
+type CfmTarget struct {
+    Key       string     `json:"key"`             // drive IP, or "group:<name>"
+    Group     string     `json:"group,omitempty"` // set for a group total
+    Drives    []string   `json:"drives"`          // IPs
+    Cfm       float64    `json:"cfm"`
+    ActualCfm float64    `json:"actualCfm"`
+    SetAt     time.Time  `json:"setAt"`
+    Trims     int        `json:"trims"`
+    LastTrim  *time.Time `json:"lastTrim,omitempty"`
+    Note      string     `json:"note,omitempty"`
+}
+
+// steadySpeed tracks how long a drive's actual speed has held
+type steadySpeed struct {
+    Hz    float64
+    Since time.Time
+}
+
+var (
+    cfmMu      sync.Mutex
+    cfmTargets = make(map[string]*CfmTarget)   // by key
+    cfmSteady  = make(map[string]steadySpeed) // by drive IP
+)
+
+const cfmMaxTrimRatio = 0.10
+
+func cfmTrimSettings() (percent float64, settle time.Duration) {
+    percent, settle = appConfig.CfmTrimPercent, time.Duration(appConfig.CfmSettleSec)*time.Second
+    if percent <= 0 {
+        percent = 2
+    }
+    if settle <= 0 {
+        settle = 5 * time.Second
+    }
+    return percent, settle
+}
+
+// cfmPlanStep is one SetSpeed of a SetCfm request
+type cfmPlanStep struct {
+    Hz   float64
+    IPs  []string
+    Note string
+}
+
+// planCfm works out the speeds for a SetCfm request and the targets to keep. Per-fan
+// targets need RpmHz and CfmRpm on every drive; a group target needs running drives with them.
+func planCfm(cfm float64, ips, groups []string, live map[string]map[string]interface{}, now time.Time) ([]cfmPlanStep, []*CfmTarget, error) {
+    if cfm <= 0 {
+        return nil, nil, fmt.Errorf("cfm must be positive")
+    }
+    if (len(ips) == 0) == (len(groups) == 0) {
+        return nil, nil, fmt.Errorf("SetCfm takes either drives (CFM per fan) or groups (CFM per group)")
+    }
+    var steps []cfmPlanStep
+    var targets []*CfmTarget
+    for _, ip := range ips {
+        d, ok := driveConfig(ip)
+        if !ok {
+            return nil, nil, fmt.Errorf("unknown drive %s", ip)
+        }
+        if d.RpmToHz <= 0 || d.CfmRpm <= 0 {
+            return nil, nil, fmt.Errorf("drive %s has no RpmHz and CfmRpm to convert airflow to speed", ip)
+        }
+        hz, note := airflowSpeed(d.Group, []DriveConfig{*d}, cfm, now)
+        steps = append(steps, cfmPlanStep{Hz: hz, IPs: []string{ip}, Note: note})
+        targets = append(targets, &CfmTarget{Key: ip, Drives: []string{ip}, Cfm: cfm, SetAt: now})
+    }
+    for _, group := range groups {
+        var running []DriveConfig
+        var groupIPs []string
+        for _, d := range getDrivesForGroups([]string{group}) {
+            if live[d.IP]["status"] == "Running" && !isDriveDisabled(d.IP) && d.RpmToHz > 0 && d.CfmRpm > 0 {
+                running = append(running, d)
+                groupIPs = append(groupIPs, d.IP)
+            }
+        }
+        if len(running) == 0 {
+            return nil, nil, fmt.Errorf("group %s has no running drives with RpmHz and CfmRpm", group)
+        }
+        hz, note := airflowSpeed(group, running, cfm, now)
+        steps = append(steps, cfmPlanStep{Hz: hz, IPs: groupIPs, Note: note})
+        targets = append(targets, &CfmTarget{Key: "group:" + group, Group: group, Drives: groupIPs, Cfm: cfm, SetAt: now})
+    }
+    return steps, targets, nil
+}
+
+// applyCfmRequest handles {"action": "SetCfm"} on /api/control. Like ApplyPreset it runs
+// one SetSpeed per distinct speed and records them as one SetCfm event.
+func applyCfmRequest(w http.ResponseWriter, cfm float64, refs, groups []string) {
+    steps, targets, err := planCfm(cfm, resolveDriveRefs(refs), groups, liveDrives(), time.Now())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    var conflicts []string
+    for _, step := range steps {
+        conflicts = append(conflicts, airflowConflicts("SetSpeed", step.Hz, step.IPs)...)
+    }
+    if len(conflicts) > 0 {
+        log.Printf("[CFM] SetCfm %.0f rejected: %v", cfm, conflicts)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusConflict)
+        json.NewEncoder(w).Encode(map[string]interface{}{"error": "Action would break an airflow reservation; release it with DELETE /api/airflow-reservations/<group> first", "groups": conflicts})
+        return
+    }
+
+    detail := fmt.Sprintf("target %.0f CFM per fan", cfm)
+    if len(groups) > 0 {
+        detail = fmt.Sprintf("target %.0f CFM per group (%s)", cfm, strings.Join(groups, ", "))
+    }
+    log.Printf("[CFM] %s", detail)
+    event := ControlEvent{Timestamp: time.Now(), Action: "SetCfm", Drives: make([]DriveEventInfo, 0), Detail: detail}
+    failed := make(map[string]bool)
+    for _, step := range steps {
+        result := executeControl("SetSpeed", step.Hz, step.IPs, false)
+        for _, info := range result.Drives {
+            info.Warning = joinWarnings(fmt.Sprintf("%.1f Hz", step.Hz), step.Note, info.Warning)
+            if !info.Success {
+                failed[info.IP] = true
+            }
+            event.Drives = append(event.Drives, info)
+        }
+        if result.Detail != "" {
+            event.Detail += "; " + result.Detail
+        }
+    }
+    recordControlEvent(event)
+
+    cfmMu.Lock()
+    for _, t := range targets {
+        var kept []string
+        for _, ip := range t.Drives {
+            if !failed[ip] {
+                kept = append(kept, ip)
+            }
+        }
+        if len(kept) > 0 {
+            t.Drives = kept
+            cfmTargets[t.Key] = t
+        }
+    }
+    cfmMu.Unlock()
+    w.Write([]byte("Control action processed successfully (" + event.Detail + ")"))
+    go pollAllDrives()
+}
+
+// endCfmTargets ends the airflow targets that include any of the drives, when another
+// control action takes them over
+func endCfmTargets(ips []string, action string) {
+    cfmMu.Lock()
+    defer cfmMu.Unlock()
+    for key, t := range cfmTargets {
+        for _, ip := range t.Drives {
+            if containsString(ips, ip) {
+                log.Printf("[CFM] %s target %.0f CFM ended by %s", key, t.Cfm, action)
+                delete(cfmTargets, key)
+                break
+            }
+        }
+    }
+}
+
+// cfmTrim is a setpoint change trimCfmTargets decided on
+type cfmTrim struct {
+    Key    string
+    IP     string
+    FromHz float64
+    ToHz   float64
+    Detail string
+}
+
+// checkCfmTargets compares a poll snapshot with the airflow targets and returns the
+// trims due. Caller holds cfmMu.
+func checkCfmTargets(snapshot []map[string]interface{}, now time.Time) []cfmTrim {
+    percent, settle := cfmTrimSettings()
+    entries := make(map[string]map[string]interface{}, len(snapshot))
+    for _, entry := range snapshot {
+        ip, _ := entry["ip"].(string)
+        entries[ip] = entry
+        actual := safeFloat(entry["actualSpeed"])
+        if st, ok := cfmSteady[ip]; !ok || math.Abs(st.Hz-actual) > 0.2 {
+            cfmSteady[ip] = steadySpeed{Hz: actual, Since: now}
+        }
+    }
+    var curtailed map[string]bool
+    if len(cfmTargets) > 0 {
+        curtailed = curtailedDrives()
+    }
+    var trims []cfmTrim
+    for key, t := range cfmTargets {
+        var actualCfm float64
+        var drives []DriveConfig
+        var held string
+        steady := true
+        for _, ip := range t.Drives {
+            d, ok := driveConfig(ip)
+            entry := entries[ip]
+            if !ok || entry == nil {
+                log.Printf("[CFM] %s target ended: drive %s is no longer configured", key, ip)
+                delete(cfmTargets, key)
+                steady = false
+                break
+            }
+            if entry["status"] != "Running" || !ownsDrive(ip) || entry["tagout"] != nil {
+                continue
+            }
+            // The trim is automation: a drive in hand or curtailed is left alone
+            if reason := sourceHold(sourceAutomation, ip, curtailed); reason != "" {
+                held = ip + " held: " + reason
+                continue
+            }
+            actualCfm += float64(safeInt(entry["actualCfm"]))
+            drives = append(drives, *d)
+            if now.Sub(cfmSteady[ip].Since) < settle {
+                steady = false
+            }
+        }
+        if _, ok := cfmTargets[key]; !ok {
+            continue
+        }
+        t.ActualCfm = math.Round(actualCfm)
+        switch {
+        case len(drives) == 0 && held != "":
+            t.Note = held
+            continue
+        case len(drives) == 0:
+            t.Note = "no running drives"
+            continue
+        case !steady:
+            t.Note = "settling"
+            continue
+        case actualCfm <= 0 || math.Abs(actualCfm-t.Cfm) <= t.Cfm*percent/100:
+            t.Note = ""
+            continue
+        }
+        ratio := math.Max(1-cfmMaxTrimRatio, math.Min(1+cfmMaxTrimRatio, t.Cfm/actualCfm))
+        group := t.Group
+        if group == "" {
+            group = drives[0].Group
+        }
+        floor, limit := airflowLimits(group, drives, now)
+        t.Note = ""
+        for _, d := range drives {
+            from := safeFloat(entries[d.IP]["setSpeed"])
+            to := math.Round(math.Max(floor, math.Min(limit, from*ratio))*10) / 10
+            if to == from {
+                t.Note = fmt.Sprintf("%s at its %.1f..%.1f Hz limits", d.IP, floor, limit)
+                continue
+            }
+            trims = append(trims, cfmTrim{Key: key, IP: d.IP, FromHz: from, ToHz: to,
+                Detail: fmt.Sprintf("%s: target %.0f CFM, actual %.0f CFM", key, t.Cfm, actualCfm)})
+        }
+        if len(trims) > 0 && trims[len(trims)-1].Key == key {
+            t.Trims++
+            at := now
+            t.LastTrim = &at
+            for _, d := range drives {
+                delete(cfmSteady, d.IP) // wait for the new speed to settle
+            }
+        }
+    }
+    return trims
+}
+
+// trimCfmTargets runs the airflow trim for a poll (from onPollComplete)
+func trimCfmTargets(snapshot []map[string]interface{}) {
+    if shadowMode() {
+        return
+    }
+    cfmMu.Lock()
+    trims := checkCfmTargets(snapshot, time.Now())
+    cfmMu.Unlock()
+    events := make(map[string]*ControlEvent)
+    var keys []string
+    for _, tr := range trims {
+        e := events[tr.Key]
+        if e == nil {
+            e = &ControlEvent{Timestamp: time.Now(), Action: "CfmTrim", Drives: []DriveEventInfo{}, Detail: tr.Detail}
+            events[tr.Key] = e
+            keys = append(keys, tr.Key)
+        }
+        info := DriveEventInfo{ID: driveIDFor(tr.IP), IP: tr.IP, Success: true, Warning: fmt.Sprintf("%.1f -> %.1f Hz", tr.FromHz, tr.ToHz)}
+        if err := writeSpeedStep(tr.IP, tr.ToHz); err != nil {
+            info.Success, info.Error = false, err.Error()
+        }
+        e.Drives = append(e.Drives, info)
+    }
+    for _, key := range keys {
+        log.Printf("[CFM] Trim %s", events[key].Detail)
+        recordControlEvent(*events[key])
+    }
+}
+
+// handleCfmTargets serves GET /api/cfm-targets: the airflow targets in force
+func handleCfmTargets(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    list := []CfmTarget{}
+    cfmMu.Lock()
+    for _, t := range cfmTargets {
+        copied := *t
+        copied.Drives = append([]string(nil), t.Drives...)
+        list = append(list, copied)
+    }
+    cfmMu.Unlock()
+    sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+    json.NewEncoder(w).Encode(list)
+}
+
+// =====================
+// Modbus Command Functions
+// =====================
+// getConnAndProfile resolves a drive's healthy connection and type profile,
+// the shared preamble of every control function.
+func getConnAndProfile(ip string) (*VFDConnection, DriveTypeProfile, error) {
+    if err := tagoutError(ip); err != nil {
+        return nil, DriveTypeProfile{}, err
+    }
+    if err := purgeError(ip); err != nil {
+        return nil, DriveTypeProfile{}, err
+    }
+    return commandConnAndProfile(ip)
+}
+
+// commandConnAndProfile is getConnAndProfile without the tagout and purge checks, for the
+// emergency stop and purge itself
+func commandConnAndProfile(ip string) (*VFDConnection, DriveTypeProfile, error) {
+    if !ownsDrive(ip) {
+        return nil, DriveTypeProfile{}, fmt.Errorf("drive %s is polled by shard %s", ip, driveOwner(ip))
+    }
+    vfdConnectionsMu.RLock()
+    conn, ok := vfdConnections[ip]
+    vfdConnectionsMu.RUnlock()
+    if !ok || !conn.healthy.Load() {
+        return nil, DriveTypeProfile{}, fmt.Errorf("No available connection for  %s", ip)
+    }
+    conn = conn.commandConn()
+    d, ok := driveConfig(ip)
+    if !ok {
+        return nil, DriveTypeProfile{}, fmt.Errorf("No drive profile for %s", ip)
+    }
+    profile, ok := driveProfile(d)
+    if !ok {
+        return nil, DriveTypeProfile{}, fmt.Errorf("No drive profile for %s", ip)
+    }
+    return conn, profile, nil
+}
+
+// writeLimiter enforces a drive's minimum write interval and per-minute write budget.
+// State is keyed by IP so it survives reconnects.
+type writeLimiter struct {
+    mu       sync.Mutex
+    cooldown time.Duration
+    budget   int           // max writes per rolling minute, 0 = unlimited
+    maxWait  time.Duration // longest a write may queue for the cooldown before being rejected
+    next     time.Time     // earliest time the next write may go out
+    recent   []time.Time   // write times within the last minute
+    stopping int           // stops waiting to be written; writes queued for the cooldown give way
+    stopped  chan struct{} // closed when a stop starts waiting, to wake queued writes
+}
+
+var writeLimiters = make(map[string]*writeLimiter)
+var writeLimitersMu sync.Mutex
+
+// reserve claims the next write slot at or after now, returning how long to wait for it
+func (l *writeLimiter) reserve(now time.Time) (time.Duration, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    at := now
+    if l.next.After(at) {
+        at = l.next
+    }
+    if wait := at.Sub(now); wait > l.maxWait {
+        return 0, fmt.Errorf("write rejected: drive is in write cooldown (%s between writes), %s of writes already queued", l.cooldown, wait.Round(time.Millisecond))
+    }
+
+    if l.budget > 0 {
+        cutoff := at.Add(-time.Minute)
+        kept := l.recent[:0]
+        for _, t := range l.recent {
+            if t.After(cutoff) {
+                kept = append(kept, t)
+            }
+        }
+        l.recent = kept
+        if len(l.recent) >= l.budget {
+            retry := l.recent[0].Add(time.Minute).Sub(now).Round(time.Second)
+            return 0, fmt.Errorf("write rejected: write budget of %d writes/min exhausted, retry in %s", l.budget, retry)
+        }
+        l.recent = append(l.recent, at)
+    }
+    l.next = at.Add(l.cooldown)
+    return at.Sub(now), nil
+}
+
+// beginStop wakes the writes queued for the cooldown, which then give up, and makes new
+// ones give up until endStop: a queued write holds conn.mu, so the stop would wait behind it
+func (l *writeLimiter) beginStop() {
+    l.mu.Lock()
+    l.stopping++
+    if l.stopped != nil {
+        close(l.stopped)
+    }
+    l.stopped = make(chan struct{})
+    l.mu.Unlock()
+}
+
+func (l *writeLimiter) endStop() {
+    l.mu.Lock()
+    l.stopping--
+    l.mu.Unlock()
+}
+
+// stopWait returns the channel a queued write waits on, or nil if a stop is pending
+func (l *writeLimiter) stopWait() <-chan struct{} {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.stopping > 0 {
+        return nil
+    }
+    if l.stopped == nil {
+        l.stopped = make(chan struct{})
+    }
+    return l.stopped
+}
+
+// holdForStop clears the way for a stop to ip before it takes conn.mu; call the returned
+// function once the stop is written
+func holdForStop(ip string) func() {
+    l := limiterFor(ip)
+    if l == nil {
+        return func() {}
+    }
+    l.beginStop()
+    return l.endStop
+}
+
+// clear drops the pending cooldown and the budget's recent writes
+func (l *writeLimiter) clear() {
+    l.mu.Lock()
+    l.next, l.recent = time.Time{}, nil
+    l.mu.Unlock()
+}
+
+// limiterFor returns the write limiter for a drive, or nil when it has no limits configured
+func limiterFor(ip string) *writeLimiter {
+    d, ok := driveConfig(ip)
+    if !ok {
+        return nil
+    }
+    cooldown := d.WriteCooldownMs
+    if cooldown == 0 {
+        cooldown = appConfig.WriteCooldownMs
+    }
+    budget := d.WriteBudgetPerMin
+    if budget == 0 {
+        budget = appConfig.WriteBudgetPerMin
+    }
+    if cooldown <= 0 && budget <= 0 {
+        return nil
+    }
+    writeLimitersMu.Lock()
+    defer writeLimitersMu.Unlock()
+    l, ok := writeLimiters[ip]
+    if !ok {
+        l = &writeLimiter{
+            cooldown: time.Duration(max(cooldown, 0)) * time.Millisecond,
+            budget:   max(budget, 0),
+            maxWait:  5 * time.Second,
+        }
+        writeLimiters[ip] = l
+    }
+    return l
+}
+
+// writeRegister performs a command-path register write, honouring the drive's
+// write cooldown and budget. Caller holds conn.mu.
+func writeRegister(conn *VFDConnection, reg uint16, value uint16) error {
+    if err := beforeWrite(conn, reg); err != nil {
+        return err
+    }
+    _, err := conn.client.WriteSingleRegister(context.Background(), reg, value)
+    return err
+}
+
+// writeRegister32 writes a 32-bit value to reg and reg+1 in one request (counts as one write)
+func writeRegister32(conn *VFDConnection, reg uint16, value uint32, lowWordFirst bool) error {
+    if err := beforeWrite(conn, reg); err != nil {
+        return err
+    }
+    _, err := conn.client.WriteMultipleRegisters(context.Background(), reg, 2, encodeRegister32(value, lowWordFirst))
+    return err
+}
+
+// writeCoil sets a single coil ON or OFF (FC05)
+func writeCoil(conn *VFDConnection, addr int, on bool) error {
+    if err := beforeWrite(conn, uint16(addr)); err != nil {
+        return err
+    }
+    value := uint16(0x0000)
+    if on {
+        value = 0xFF00
+    }
+    _, err := conn.client.WriteSingleCoil(context.Background(), uint16(addr), value)
+    return err
+}
+
+// errWriteNotVerified marks a write the drive acknowledged but that didn't read back
+var errWriteNotVerified = errors.New("write not verified")
+
+// WriteVerifyConfig enables read-back of setpoint and control register writes. Some
+// gateways acknowledge writes that never reach the drive; a write that doesn't read back
+// is rewritten up to Retries times, then fails with errWriteNotVerified. Coils and
+// ENTER/reset commands are not verified.
+type WriteVerifyConfig struct {
+    Retries int `json:"Retries,omitempty"` // rewrites after a failed read-back, default 2, negative = none
+    DelayMs int `json:"DelayMs,omitempty"` // wait before each read-back, default 50
+}
+
+var vfdWriteVerify = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Namespace: "vfd",
+        Name:      "write_verify_total",
+        Help:      "Verified writes by result: ok, retried (took after a rewrite) or failed",
+    },
+    []string{"ip", "result"},
+)
+
+func init() {
+    prometheus.MustRegister(vfdWriteVerify)
+}
+
+// writeVerifyLimits returns the rewrite count and read-back delay, and whether writes of
+// this kind are verified for the profile
+func writeVerifyLimits(profile DriveTypeProfile, kind string) (int, time.Duration, bool) {
+    c := appConfig.WriteVerify
+    if c == nil || shadowMode() || containsString(profile.NoReadBack, kind) {
+        return 0, 0, false
+    }
+    retries, delay := c.Retries, time.Duration(c.DelayMs)*time.Millisecond
+    if retries == 0 {
+        retries = 2
+    }
+    if delay <= 0 {
+        delay = 50 * time.Millisecond
+    }
+    return max(retries, 0), delay, true
+}
+
+// verifiedWrite runs write and, when verifying, reads the value back until it matches,
+// rewriting up to retries times. Caller holds conn.mu.
+func verifiedWrite(conn *VFDConnection, retries int, delay time.Duration, what string, want uint32, write func() error, readBack func(context.Context) (uint32, error)) error {
+    if err := write(); err != nil {
+        return err
+    }
+    var got uint32
+    var err error
+    for attempt := 0; ; attempt++ {
+        time.Sleep(delay)
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        got, err = readBack(ctx)
+        cancel()
+        if err == nil && got == want {
+            result := "ok"
+            if attempt > 0 {
+                result = "retried"
+                log.Printf("[VERIFY] %s %s took after %d rewrite(s)", conn.ip, what, attempt)
+            }
+            vfdWriteVerify.WithLabelValues(conn.ip, result).Inc()
+            return nil
+        }
+        if attempt >= retries {
+            break
+        }
+        if err := write(); err != nil {
+            return err
+        }
+    }
+    vfdWriteVerify.WithLabelValues(conn.ip, "failed").Inc()
+    if err != nil {
+        err = fmt.Errorf("%w: %s, read-back failed: %v", errWriteNotVerified, what, err)
+    } else {
+        err = fmt.Errorf("%w: %s reads back %d after %d attempt(s)", errWriteNotVerified, what, got, retries+1)
+    }
+    log.Printf("[VERIFY] %s: %v", conn.ip, err)
+    return err
+}
+
+// writeRegisterVerified writes a register of the given kind, verifying it if configured
+func writeRegisterVerified(conn *VFDConnection, profile DriveTypeProfile, kind string, reg uint16, value uint16) error {
+    retries, delay, verify := writeVerifyLimits(profile, kind)
+    if !verify {
+        return writeRegister(conn, reg, value)
+    }
+    return verifiedWrite(conn, retries, delay, fmt.Sprintf("%s write %d to reg %d", kind, value, reg), uint32(value),
+        func() error { return writeRegister(conn, reg, value) },
+        func(ctx context.Context) (uint32, error) {
+            res, err := conn.client.ReadHoldingRegisters(ctx, reg, 1)
+            if err != nil || len(res) < 2 {
+                return 0, fmt.Errorf("read reg %d: %v", reg, err)
+            }
+            return uint32(binary.BigEndian.Uint16(res)), nil
+        })
+}
+
+// writeRegister32Verified is writeRegisterVerified for 32-bit values
+func writeRegister32Verified(conn *VFDConnection, profile DriveTypeProfile, kind string, reg uint16, value uint32, lowWordFirst bool) error {
+    retries, delay, verify := writeVerifyLimits(profile, kind)
+    if !verify {
+        return writeRegister32(conn, reg, value, lowWordFirst)
+    }
+    return verifiedWrite(conn, retries, delay, fmt.Sprintf("%s write %d to reg %d", kind, value, reg), value,
+        func() error { return writeRegister32(conn, reg, value, lowWordFirst) },
+        func(ctx context.Context) (uint32, error) {
+            res, err := conn.client.ReadHoldingRegisters(ctx, reg, 2)
+            if err != nil || len(res) < 4 {
+                return 0, fmt.Errorf("read reg %d: %v", reg, err)
+            }
+            return uint32(decodeRegister32(res, false, lowWordFirst)), nil
+        })
+}
+
+// beforeWrite applies shadow mode and the drive's write cooldown/budget to a pending write.
+// Stop and Freespin writes are never held back or rejected by the limiter, and a write
+// queued for the cooldown gives up when one arrives (see holdForStop).
+func beforeWrite(conn *VFDConnection, reg uint16) error {
+    if shadowMode() {
+        return fmt.Errorf("shadow mode: writes are disabled")
+    }
+    if conn.stop {
+        return nil
+    }
+    if l := limiterFor(conn.ip); l != nil {
+        wait, err := l.reserve(time.Now())
+        if err == nil && wait > 0 {
+            stopped := l.stopWait()
+            if stopped == nil {
+                err = errWriteStopped
+            } else {
+                timer := time.NewTimer(wait)
+                select {
+                case <-timer.C:
+                case <-stopped:
+                    timer.Stop()
+                    err = errWriteStopped
+                }
+            }
+        }
+        if err != nil {
+            log.Printf("[WRITE LIMIT] IP: %s, reg %d: %v", conn.ip, reg, err)
+            return err
+        }
+    }
+    return nil
+}
+
+var errWriteStopped = errors.New("write cancelled: a stop was sent to the drive")
+
+// writeSetpoint writes a raw setpoint value, as 32-bit when the profile declares Setpoint DoubleWord
+func writeSetpoint(conn *VFDConnection, profile DriveTypeProfile, reg int, value float64) error {
+    reg = profile.wireAddr("Setpoint", reg)
+    if profile.isDoubleWord("Setpoint") {
+        return writeRegister32Verified(conn, profile, "Setpoint", uint16(reg), uint32(int32(value)), profile.lowWordFirst("Setpoint"))
+    }
+    return writeRegisterVerified(conn, profile, "Setpoint", uint16(reg), uint16(int(value)))
+}
+
+// writeEnter commits preceding writes of the given kind on drives that hold
+// parameter writes pending until an ENTER command (Yaskawa). Caller holds conn.mu.
+func writeEnter(conn *VFDConnection, profile DriveTypeProfile, kind string) error {
+    if !profile.needsEnter(kind) {
+        return nil
+    }
+    return writeRegister(conn, uint16(profile.wireAddr("EnterRegister", profile.EnterRegister)), uint16(profile.EnterValue))
+}
+
+// writeControlSequence performs each step in order, giving state-machine drives
+// (ABB Drives profile, PROFIdrive STW1, DriveCom) time to advance between words and
+// optionally waiting for the status word to confirm a state before the next step.
+func writeControlSequence(conn *VFDConnection, profile DriveTypeProfile, steps []ControlStep) error {
+    for i, step := range steps {
+        delay := time.Duration(step.DelayMs) * time.Millisecond
+        if delay == 0 && i > 0 {
+            delay = 100 * time.Millisecond
+        }
+        time.Sleep(delay)
+        reg := profile.Control
+        write := writeRegisterVerified
+        if step.Register != nil {
+            // Other registers may be self-clearing commands, so only the control word is verified
+            reg = *step.Register
+            write = func(conn *VFDConnection, _ DriveTypeProfile, _ string, reg uint16, value uint16) error {
+                return writeRegister(conn, reg, value)
+            }
+        }
+        if err := write(conn, profile, "Control", uint16(profile.wireAddr("Control", reg)), uint16(step.Value)); err != nil {
+            return err
+        }
+        if step.WaitBit != nil {
+            if err := waitStatusBit(conn, profile, *step.WaitBit, step.WaitTimeoutMs); err != nil {
+                return fmt.Errorf("sequence step %d (value %d): %w", i+1, step.Value, err)
+            }
+        }
+    }
+    return writeEnter(conn, profile, "Control")
+}
+
+// waitStatusBit polls the Status register until bit is set. Caller holds conn.mu.
+func waitStatusBit(conn *VFDConnection, profile DriveTypeProfile, bit int, timeoutMs int) error {
+    if timeoutMs <= 0 {
+        timeoutMs = 2000
+    }
+    deadline := time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+    for {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        raw, err := readProfileRegister(ctx, conn.client, profile, "Status", profile.Status, profile.RegisterType == "input", false)
+        cancel()
+        if err == nil && int(raw)&(1<<bit) != 0 {
+            return nil
+        }
+        if time.Now().After(deadline) {
+            if err != nil {
+                return fmt.Errorf("timed out waiting for status bit %d: %w", bit, err)
+            }
+            return fmt.Errorf("timed out waiting for status bit %d (status 0x%04X)", bit, int(raw))
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+}
+
+// writeStart issues the profile's start command, which runs forward; caller holds conn.mu
+func writeStart(conn *VFDConnection, profile DriveTypeProfile) error {
+    if err := writeRunCommand(conn, profile); err != nil {
+        return err
+    }
+    setCommandedDirection(conn.ip, "forward")
+    return nil
+}
+
+func writeRunCommand(conn *VFDConnection, profile DriveTypeProfile) error {
+    if err := estopError(); err != nil {
+        return err
+    }
+    if err := damperError(conn.ip); err != nil {
+        return err
+    }
+    if profile.StartCoil != nil {
+        if profile.ReverseCoil != nil {
+            if err := writeCoil(conn, profile.wireAddr("ReverseCoil", *profile.ReverseCoil), false); err != nil {
+                return err
+            }
+        }
+        if profile.StopCoil != nil {
+            // Release a latched stop input before asking for run
+            if err := writeCoil(conn, profile.wireAddr("StopCoil", *profile.StopCoil), false); err != nil {
+                return err
+            }
+        }
+        return writeCoil(conn, profile.wireAddr("StartCoil", *profile.StartCoil), true)
+    }
+    if len(profile.StartSequence) > 0 {
+        return writeControlSequence(conn, profile, profile.StartSequence)
+    }
+    if err := writeRegisterVerified(conn, profile, "Control", uint16(profile.wireAddr("Control", profile.Control)), uint16(profile.StartValue)); err != nil {
+        return err
+    }
+    return writeEnter(conn, profile, "Control")
+}
+
+// canReverse reports whether the profile has a reverse run command
+func (p DriveTypeProfile) canReverse() bool {
+    return p.ReverseValue != 0 || len(p.ReverseSequence) > 0 || (p.ReverseCoil != nil && p.StartCoil != nil)
+}
+
+// writeReverse issues the profile's reverse run command; caller holds conn.mu
+func writeReverse(conn *VFDConnection, profile DriveTypeProfile) error {
+    if err := estopError(); err != nil {
+        return err
+    }
+    if err := damperError(conn.ip); err != nil {
+        return err
+    }
+    if profile.ReverseCoil != nil && profile.StartCoil != nil {
+        if profile.StopCoil != nil {
+            if err := writeCoil(conn, profile.wireAddr("StopCoil", *profile.StopCoil), false); err != nil {
+                return err
+            }
+        }
+        if err := writeCoil(conn, profile.wireAddr("ReverseCoil", *profile.ReverseCoil), true); err != nil {
+            return err
+        }
+        return writeCoil(conn, profile.wireAddr("StartCoil", *profile.StartCoil), true)
+    }
+    if len(profile.ReverseSequence) > 0 {
+        return writeControlSequence(conn, profile, profile.ReverseSequence)
+    }
+    if err := writeRegisterVerified(conn, profile, "Control", uint16(profile.wireAddr("Control", profile.Control)), uint16(profile.ReverseValue)); err != nil {
+        return err
+    }
+    return writeEnter(conn, profile, "Control")
+}
+
+// fanReverse runs a drive backwards (smoke purge, de-icing), first setting its speed when
+// speed is above 0; otherwise it reverses at its current setpoint
+func fanReverse(ip string, speed float64, ack bool) error {
+    cancelRamp(ip, "Reverse")
+    d, _ := driveConfig(ip)
+    if speed > 0 {
+        speed, _ = clampSpeed(d, speed)
+        if _, err := checkSpeedWrite(d, speed, ack); err != nil {
+            return err
+        }
+    }
+    conn, profile, err := getConnAndProfile(ip)
+    if err != nil {
+        return err
+    }
+    if !profile.canReverse() {
+        return fmt.Errorf("drive type %s has no reverse command (ReverseValue, ReverseSequence or ReverseCoil)", d.DriveType)
+    }
+    if err := openDamper(ip); err != nil {
+        return err
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    if speed > 0 {
+        if err := writeSpeedReference(conn, profile, speed); err != nil {
+            return err
+        }
+    }
+    if err := writeReverse(conn, profile); err != nil {
+        return err
+    }
+    setCommandedDirection(ip, "reverse")
+    return nil
+}
+
+// Direction last commanded per drive IP; absent = forward
+var (
+    directionMu        sync.Mutex
+    commandedDirection = make(map[string]string)
+)
+
+func setCommandedDirection(ip, dir string) {
+    directionMu.Lock()
+    defer directionMu.Unlock()
+    if dir == "forward" {
+        delete(commandedDirection, ip)
+        return
+    }
+    commandedDirection[ip] = dir
+}
+
+func driveDirection(ip string) string {
+    directionMu.Lock()
+    defer directionMu.Unlock()
+    if dir, ok := commandedDirection[ip]; ok {
+        return dir
+    }
+    return "forward"
+}
+
+// directionMismatch reports a running drive turning against its commanded direction, as
+// seen in the sign of its output frequency (clockwise = forward). Only drives with
+// SignedOutputFreq report a sign.
+func directionMismatch(profile DriveTypeProfile, direction string, clockwise int, actualHz float64) bool {
+    if !profile.SignedOutputFreq || actualHz < 0.5 {
+        return false
+    }
+    return (direction == "reverse") == (clockwise == 1)
+}
+
+func fanStop(ip string) error {
+    cancelRamp(ip, "Stop")
+    conn, profile, err := getConnAndProfile(ip)
+    if err != nil {
+        return err
+    }
+    defer holdForStop(ip)()
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    return writeStop(conn, profile)
+}
+
+// writeStop sends a profile's stop command and schedules the damper close. Caller holds
+// conn.mu.
+func writeStop(conn *VFDConnection, profile DriveTypeProfile) error {
+    conn.stop = true
+    err := writeStopCommand(conn, profile)
+    conn.stop = false
+    if err != nil {
+        return err
+    }
+    closeDamperLater(conn.ip)
+    return nil
+}
+
+func writeStopCommand(conn *VFDConnection, profile DriveTypeProfile) error {
+    if profile.StopCoil != nil {
+        if profile.StartCoil != nil {
+            if err := writeCoil(conn, profile.wireAddr("StartCoil", *profile.StartCoil), false); err != nil {
+                return err
+            }
+        }
+        return writeCoil(conn, profile.wireAddr("StopCoil", *profile.StopCoil), true)
+    }
+    if profile.StartCoil != nil {
+        return writeCoil(conn, profile.wireAddr("StartCoil", *profile.StartCoil), false)
+    }
+    if len(profile.StopSequence) > 0 {
+        return writeControlSequence(conn, profile, profile.StopSequence)
+    }
+    if err := writeRegisterVerified(conn, profile, "Control", uint16(profile.wireAddr("Control", profile.Control)), uint16(profile.StopValue)); err != nil {
+        return err
+    }
+    return writeEnter(conn, profile, "Control")
+}
+
+func fanUnTrip(ip string) error {
+    conn, profile, err := getConnAndProfile(ip)
+    if err != nil {
+        return err
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    if profile.UnTripCoil != nil {
+        if err := writeCoil(conn, profile.wireAddr("UnTripCoil", *profile.UnTripCoil), true); err != nil {
+            return err
+        }
+        time.Sleep(100 * time.Millisecond)
+        return writeCoil(conn, profile.wireAddr("UnTripCoil", *profile.UnTripCoil), false)
+    }
+    if len(profile.UnTripSequence) > 0 {
+        return writeControlSequence(conn, profile, profile.UnTripSequence)
+    }
+    return writeRegister(conn, uint16(profile.wireAddr("UnTripRegister", profile.UnTripRegister)), uint16(profile.UnTripValue))
+}
+
+func fanStart(ip string) error {
+    conn, profile, err := getConnAndProfile(ip)
+    if err != nil {
+        return err
+    }
+    if err := openDamper(ip); err != nil {
+        return err
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    return writeStart(conn, profile)
+}
+
+// speedRange returns the lowest and highest speed a drive may be set to, 0 = unbounded:
+// its MinHz (else its profile's) and HardMaxHz
+func speedRange(d *DriveConfig) (float64, float64) {
+    lo := d.MinHz
+    if lo == 0 {
+        if p, ok := driveProfile(d); ok {
+            lo = float64(p.MinHz)
+        }
+    }
+    return lo, d.HardMaxHz
+}
+
+// speedOutOfRange reports whether a speed is outside the drive's absolute range
+func speedOutOfRange(d *DriveConfig, speed float64) bool {
+    if d == nil {
+        return false
+    }
+    lo, hi := speedRange(d)
+    return speed < lo || (hi > 0 && speed > hi)
+}
+
+// clampSpeed brings a speed into the drive's range when ClampSpeedLimits is set, returning
+// a warning if it changed. Without it the speed is returned as is, to be rejected.
+func clampSpeed(d *DriveConfig, speed float64) (float64, string) {
+    if d == nil || !appConfig.ClampSpeedLimits || !speedOutOfRange(d, speed) {
+        return speed, ""
+    }
+    lo, hi := speedRange(d)
+    clamped := math.Max(speed, lo)
+    if hi > 0 {
+        clamped = math.Min(clamped, hi)
+    }
+    return clamped, fmt.Sprintf("speed %.1f Hz clamped to %.1f Hz", speed, clamped)
+}
+
+// joinWarnings combines per-drive warnings, skipping empty ones
+func joinWarnings(warnings ...string) string {
+    var kept []string
+    for _, w := range warnings {
+        if w != "" {
+            kept = append(kept, w)
+        }
+    }
+    return strings.Join(kept, "; ")
+}
+
+// checkSpeedLimits applies a drive's speed limit tiers. A speed above the soft limit is
+// refused unless acknowledged, and then returns a warning; the minimum and the hard limit
+// are absolute.
+func checkSpeedLimits(d *DriveConfig, speed float64, ack bool) (string, error) {
+    if d == nil {
+        return "", nil
+    }
+    if lo, _ := speedRange(d); speed < lo {
+        return "", fmt.Errorf("speed %.1f Hz is below minimum %.1f Hz", speed, lo)
+    }
+    if d.HardMaxHz > 0 && speed > d.HardMaxHz {
+        return "", fmt.Errorf("speed %.1f Hz exceeds hard limit %.1f Hz", speed, d.HardMaxHz)
+    }
+    if d.SoftMaxHz > 0 && speed > d.SoftMaxHz {
+        if !ack {
+            return "", fmt.Errorf("speed %.1f Hz exceeds soft limit %.1f Hz; acknowledge required", speed, d.SoftMaxHz)
+        }
+        return fmt.Sprintf("soft limit %.1f Hz exceeded (acknowledged)", d.SoftMaxHz), nil
+    }
+    return "", nil
+}
+
+// setFanSpeed writes the setpoint and starts the drive. ack permits exceeding the
+// drive's soft speed limit; the hard limit always applies.
+func setFanSpeed(ip string, setspeed float64, ack bool) error {
+    d, _ := driveConfig(ip)
+    setspeed, _ = clampSpeed(d, setspeed)
+    if _, err := checkSpeedWrite(d, setspeed, ack); err != nil {
+        return err
+    }
+    conn, profile, err := getConnAndProfile(ip)
+    if err != nil {
+        return err
+    }
+    if err := openDamper(ip); err != nil {
+        return err
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    // Write speed reference BEFORE start command
+    if err := writeSpeedReference(conn, profile, setspeed); err != nil {
+        return err
+    }
+    if err := writeStart(conn, profile); err != nil {
+        return err
+    }
+    return nil
+}
+
+func fanHold(ip string) error {
+    cancelRamp(ip, "Fanhold")
+    conn, profile, err := getConnAndProfile(ip)
+    if err != nil {
+        return err
+    }
+    if err := openDamper(ip); err != nil {
+        return err
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    if err := writeStart(conn, profile); err != nil {
+        return err
+    }
+    if len(profile.Setpoint) > 0 {
+        err = writeSetpoint(conn, profile, profile.Setpoint[0], 0)
+        if err != nil {
+            return err
+        }
+    }
+    if len(profile.Setpoint) > 1 {
+        err = writeSetpoint(conn, profile, profile.Setpoint[1], 0)
+        if err != nil {
+            return err
+        }
+    }
+    if err := writeEnter(conn, profile, "Setpoint"); err != nil {
+        return err
+    }
+    setCommandedSpeed(ip, 0)
+    return nil
+}
+
+// =====================
+// Speed Ramping
+// =====================
+// With MaxRampHzPerSec set, SetSpeed moves the setpoint in steps from where the drive is
+// instead of writing the target at once, so operators can't slam a fan from 20 to 60 Hz.
+// A newer SetSpeed takes over a ramp from its current step; Stop and Fanhold end it. Each
+// ramp is journalled so a restart mid-ramp is recorded as an InterruptedSetSpeed.
+
+const (
+    rampStepHz          = 1.0                    // preferred step size
+    rampMinStepInterval = 500 * time.Millisecond // fastest step rate, to spare the write budget
+)
+
+var errRampSuperseded = errors.New("ramp superseded by a newer SetSpeed")
+
+// speedRamp is a ramp in progress; setpoint is the last step written
+type speedRamp struct {
+    setpoint float64
+    stop     string // why the ramp was ended early, "" while it runs
+}
+
+var (
+    rampsMu sync.Mutex
+    ramps   = make(map[string]*speedRamp)
+)
+
+// rampRate returns a drive's ramp limit in Hz/s, 0 when it has none
+func rampRate(d *DriveConfig) float64 {
+    rate := appConfig.MaxRampHzPerSec
+    if d != nil && d.MaxRampHzPerSec != 0 {
+        rate = d.MaxRampHzPerSec
+    }
+    return math.Max(rate, 0)
+}
+
+// rampSteps splits a speed change into setpoints at most rate Hz/s apart, ending at to
+func rampSteps(from, to, rate float64) ([]float64, time.Duration) {
+    interval := time.Duration(rampStepHz / rate * float64(time.Second))
+    if interval < rampMinStepInterval {
+        interval = rampMinStepInterval
+    }
+    step := rate * interval.Seconds()
+    n := int(math.Ceil(math.Abs(to-from)/step - 1e-9))
+    steps := make([]float64, 0, n)
+    for i := 1; i < n; i++ {
+        steps = append(steps, math.Round((from+math.Copysign(step*float64(i), to-from))*100)/100)
+    }
+    return append(steps, to), interval
+}
+
+// beginRamp registers a ramp for ip and returns the speed to start from: the step a ramp
+// already running had reached (that ramp is superseded), else the drive's current setpoint
+// if it is running, else 0
+func beginRamp(ip string) (*speedRamp, float64) {
+    rampsMu.Lock()
+    defer rampsMu.Unlock()
+    from := 0.0
+    if prev, ok := ramps[ip]; ok {
+        prev.stop = "superseded"
+        from = prev.setpoint
+    } else {
+        vfdDataMutex.RLock()
+        for _, entry := range vfdData {
+            if entry["ip"] == ip && entry["status"] == "Running" {
+                from, _ = entry["setSpeed"].(float64)
+            }
+        }
+        vfdDataMutex.RUnlock()
+    }
+    r := &speedRamp{setpoint: from}
+    ramps[ip] = r
+    return r, from
+}
+
+func endRamp(ip string, r *speedRamp) {
+    rampsMu.Lock()
+    if ramps[ip] == r {
+        delete(ramps, ip)
+    }
+    rampsMu.Unlock()
+}
+
+// cancelRamp ends a drive's ramp in progress, if any, before another command
+func cancelRamp(ip, reason string) {
+    rampsMu.Lock()
+    if r, ok := ramps[ip]; ok {
+        r.stop = reason
+        delete(ramps, ip)
+    }
+    rampsMu.Unlock()
+}
+
+// rampFanSpeed brings a drive to speed in steps no faster than its ramp limit. The first
+// step starts the drive and the last goes through setFanSpeed, so the target is checked
+// against the speed limits as usual. Steps in between lie between the current speed and
+// an accepted target, so they only need the hard limit.
+func rampFanSpeed(ip string, speed float64, ack bool, rate float64) error {
+    d, _ := driveConfig(ip)
+    if _, err := checkSpeedWrite(d, speed, ack); err != nil {
+        return err
+    }
+    r, from := beginRamp(ip)
+    defer endRamp(ip, r)
+    if d != nil {
+        if lo, _ := speedRange(d); from < lo {
+            from = lo // a stopped drive ramps up from its minimum speed
+        }
+    }
+    steps, interval := rampSteps(from, speed, rate)
+    if len(steps) > 1 {
+        log.Printf("[RAMP] IP: %s, %.1f -> %.1f Hz in %d steps of %s", ip, from, speed, len(steps), interval)
+        op := beginOperation("ramp", "SetSpeed", speed, ack, [][]string{{ip}})
+        defer finishOperation(op)
+    }
+    for i, hz := range steps {
+        if i > 0 {
+            time.Sleep(interval)
+        }
+        rampsMu.Lock()
+        stop := r.stop
+        rampsMu.Unlock()
+        switch {
+        case stop == "superseded":
+            return errRampSuperseded
+        case stop != "":
+            return fmt.Errorf("ramp to %.1f Hz ended at %.1f Hz by %s", speed, r.setpoint, stop)
+        }
+        var err error
+        switch i {
+        case len(steps) - 1:
+            err = setFanSpeed(ip, hz, ack)
+        case 0:
+            err = setFanSpeed(ip, hz, true)
+        default:
+            err = writeSpeedStep(ip, hz)
+        }
+        if err != nil {
+            return fmt.Errorf("ramp to %.1f Hz failed at %.1f Hz: %w", speed, hz, err)
+        }
+        rampsMu.Lock()
+        r.setpoint = hz
+        rampsMu.Unlock()
+    }
+    return nil
+}
+
+// writeSpeedStep writes an intermediate ramp setpoint to a running drive
+func writeSpeedStep(ip string, hz float64) error {
+    d, _ := driveConfig(ip)
+    if _, err := checkSpeedLimits(d, hz, true); err != nil {
+        return err
+    }
+    conn, profile, err := getConnAndProfile(ip)
+    if err != nil {
+        return err
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    return writeSpeedReference(conn, profile, hz)
+}
+
+// writeSpeedReference writes a speed to the setpoint registers without a run command;
+// caller holds conn.mu. Within the drive's setpoint deadband the write is skipped.
+func writeSpeedReference(conn *VFDConnection, profile DriveTypeProfile, hz float64) error {
+    if withinSetpointDeadband(conn.ip, hz) {
+        vfdSetpointSkipped.WithLabelValues(conn.ip).Inc()
+        setCommandedSpeed(conn.ip, hz)
+        return nil
+    }
+    raw := applyCalc(profile.SetFreqCalc, hz, profile.Constants)
+    if len(profile.Setpoint) > 0 {
+        if err := writeSetpoint(conn, profile, profile.Setpoint[0], raw); err != nil {
+            return err
+        }
+    }
+    if len(profile.Setpoint) > 1 {
+        if err := writeSetpoint(conn, profile, profile.Setpoint[1], raw*float64(profile.SpeedPresetMultiplier)); err != nil {
+            return err
+        }
+    }
+    if err := writeEnter(conn, profile, "Setpoint"); err != nil {
+        return err
+    }
+    setCommandedSpeed(conn.ip, hz)
+    return nil
+}
+
+// maxSetpointDeadbandHz bounds SetpointDeadbandHz, so a typo can't leave speeds unwritten
+const maxSetpointDeadbandHz = 1.0
+
+var vfdSetpointSkipped = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Namespace: "vfd",
+        Name:      "setpoint_writes_skipped_total",
+        Help:      "Setpoint writes skipped as within SetpointDeadbandHz of the drive's setpoint",
+    },
+    []string{"ip"},
+)
+
+func init() {
+    prometheus.MustRegister(vfdSetpointSkipped)
+}
+
+func setpointDeadband(d *DriveConfig) float64 {
+    band := appConfig.SetpointDeadbandHz
+    if d != nil && d.SetpointDeadbandHz != 0 {
+        band = d.SetpointDeadbandHz
+    }
+    return math.Max(band, 0)
+}
+
+// withinSetpointDeadband reports whether hz is within the drive's deadband of both its
+// polled setpoint and the last one the server wrote. The second check keeps a write that
+// the poll hasn't caught up with yet from hiding a change back.
+func withinSetpointDeadband(ip string, hz float64) bool {
+    d, _ := driveConfig(ip)
+    band := setpointDeadband(d)
+    if band <= 0 {
+        return false
+    }
+    setpointMu.Lock()
+    cmd, commanded := commandedSpeeds[ip]
+    setpointMu.Unlock()
+    if commanded && math.Abs(cmd.Hz-hz) >= band {
+        return false
+    }
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+    for _, entry := range vfdData {
+        if entry["ip"] != ip {
+            continue
+        }
+        current, ok := entry["setSpeed"].(float64)
+        if !ok || entry["status"] == "Unavailable" || entry["status"] == "NotReady" {
+            return false
+        }
+        return math.Abs(math.Abs(current)-hz) < band
+    }
+    return false
+}
+
+// =====================
+// Dampers
+// =====================
+// A fan with a Damper opens it before any run command and closes it after a stop. Starts
+// (fanStart, setFanSpeed, fanReverse, fanHold, purge) call openDamper before taking the
+// drive's lock: it switches the damper output on and waits for EndSwitch to read open, or
+// for OpenSec without one. A damper that doesn't open in time fails the start and raises a
+// DamperFault alert. writeRunCommand and writeReverse refuse to run a fan whose damper
+// isn't known to be open, so no other path can start it against a closed damper.
+// writeStop schedules the close CloseDelaySec later (run-down time); a start in between
+// cancels it.
+const (
+    defaultDamperTimeoutSec = 60 // EndSwitch wait
+    defaultDamperTravelSec  = 15 // fixed wait without an EndSwitch
+)
+
+// DamperConfig is a fan's damper, driven by an I/O module output or a coil on the drive
+type DamperConfig struct {
+    Output        string `json:"Output,omitempty"`        // "<sensor>.<output>", an I/O module output without a Follow
+    DriveCoil     *int   `json:"DriveCoil,omitempty"`     // or a coil on the drive itself, e.g. a relay output under serial control
+    EndSwitch     string `json:"EndSwitch,omitempty"`     // signal that reads non-zero while the damper is open
+    OpenSec       int    `json:"OpenSec,omitempty"`       // EndSwitch timeout (default 60), or the travel time without one (default 15)
+    CloseDelaySec int    `json:"CloseDelaySec,omitempty"` // after a stop, before closing
+}
+
+var (
+    damperMu   sync.Mutex
+    damperGen  = make(map[string]int)  // by drive IP; bumped by opens and stops to cancel pending closes
+    damperOpen = make(map[string]bool) // by drive IP; opened by openDamper since the last stop
+
+    damperPollInterval = 250 * time.Millisecond
+)
+
+// validateDampers checks the drives' Damper blocks; any problem is fatal at startup
+func validateDampers(cfg AppConfig) error {
+    for _, d := range cfg.VFDs {
+        c := d.Damper
+        if c == nil {
+            continue
+        }
+        if (c.Output == "") == (c.DriveCoil == nil) {
+            return fmt.Errorf("drive %s: Damper needs one of Output and DriveCoil", d.IP)
+        }
+        if c.OpenSec < 0 || c.CloseDelaySec < 0 || (c.DriveCoil != nil && *c.DriveCoil < 0) {
+            return fmt.Errorf("drive %s: Damper times and coil must not be negative", d.IP)
+        }
+        if c.EndSwitch != "" && !strings.Contains(c.EndSwitch, ".") {
+            return fmt.Errorf("drive %s: Damper EndSwitch must be a signal \"<name>.<value>\"", d.IP)
+        }
+        if c.Output == "" {
+            continue
+        }
+        out, ok := damperOutput(cfg.Sensors, c.Output)
+        if !ok {
+            return fmt.Errorf("drive %s: Damper Output %q is not a sensor output", d.IP, c.Output)
+        }
+        if out.Follow != "" {
+            return fmt.Errorf("drive %s: Damper Output %q already follows %s", d.IP, c.Output, out.Follow)
+        }
+    }
+    return nil
+}
+
+// damperOutput finds a "<sensor>.<output>" output
+func damperOutput(sensors []SensorConfig, ref string) (SensorOutput, bool) {
+    name, output, _ := strings.Cut(ref, ".")
+    for _, s := range sensors {
+        if s.Name == name {
+            out, ok := s.Outputs[output]
+            return out, ok
+        }
+    }
+    return SensorOutput{}, false
+}
+
+// setDamper switches a fan's damper output
+func setDamper(d *DriveConfig, open bool) error {
+    c := d.Damper
+    if c.DriveCoil != nil {
+        conn, _, err := commandConnAndProfile(d.IP)
+        if err != nil {
+            return err
+        }
+        conn.mu.Lock()
+        defer conn.mu.Unlock()
+        return writeCoil(conn, *c.DriveCoil, open)
+    }
+    name, output, _ := strings.Cut(c.Output, ".")
+    for _, s := range appConfig.Sensors {
+        if s.Name == name {
+            return setSensorOutput(s, output, open)
+        }
+    }
+    return fmt.Errorf("no sensor %s", name)
+}
+
+// waitForSignal waits up to timeout for a signal to read on (non-zero) or off
+func waitForSignal(signal string, on bool, timeout time.Duration) bool {
+    deadline := time.Now().Add(timeout)
+    for {
+        if v, ok := sensorValue(signal); ok && (v != 0) == on {
+            return true
+        }
+        if time.Now().After(deadline) {
+            return false
+        }
+        time.Sleep(damperPollInterval)
+    }
+}
+
+func damperTimeout(c *DamperConfig) time.Duration {
+    sec := c.OpenSec
+    if sec == 0 && c.EndSwitch != "" {
+        sec = defaultDamperTimeoutSec
+    } else if sec == 0 {
+        sec = defaultDamperTravelSec
+    }
+    return time.Duration(sec) * time.Second
+}
+
+func damperFault(d *DriveConfig, message string) {
+    log.Printf("[DAMPER] IP: %s: %s", d.IP, message)
+    notify(Notification{Severity: "critical", Kind: "DamperFault", Group: d.Group, DriveID: d.ID, IP: d.IP, Message: fmt.Sprintf("Fan %s (%s): %s", d.ID, d.IP, message)})
+}
+
+// openDamper opens a fan's damper and waits until it is open; call it before a run
+// command, without holding the drive's lock
+func openDamper(ip string) error {
+    d, ok := driveConfig(ip)
+    if !ok || d.Damper == nil {
+        return nil
+    }
+    c := d.Damper
+    damperMu.Lock()
+    damperGen[ip]++
+    open := damperOpen[ip]
+    damperMu.Unlock()
+    if !open && c.Output != "" {
+        v, ok := sensorValue(c.Output)
+        open = ok && v != 0
+    }
+    if open && c.EndSwitch == "" {
+        return nil
+    }
+    if !open {
+        if err := setDamper(d, true); err != nil {
+            damperFault(d, "damper output failed: "+err.Error())
+            return fmt.Errorf("damper did not open: %w", err)
+        }
+    }
+    timeout := damperTimeout(c)
+    switch {
+    case c.EndSwitch != "":
+        if !waitForSignal(c.EndSwitch, true, timeout) {
+            damperFault(d, fmt.Sprintf("damper did not open within %s (%s)", timeout, c.EndSwitch))
+            return fmt.Errorf("damper did not open within %s (%s)", timeout, c.EndSwitch)
+        }
+    case !open:
+        time.Sleep(timeout)
+    }
+    damperMu.Lock()
+    damperOpen[ip] = true
+    damperMu.Unlock()
+    resolveAlert("DamperFault", d.ID)
+    return nil
+}
+
+// damperError refuses a run command to a fan whose damper isn't known to be open
+func damperError(ip string) error {
+    d, ok := driveConfig(ip)
+    if !ok || d.Damper == nil {
+        return nil
+    }
+    damperMu.Lock()
+    open := damperOpen[ip]
+    damperMu.Unlock()
+    if c := d.Damper; c.EndSwitch != "" {
+        v, ok := sensorValue(c.EndSwitch)
+        open = open && ok && v != 0
+    }
+    if !open {
+        return fmt.Errorf("drive %s: damper is not open", ip)
+    }
+    return nil
+}
+
+// closeDamperLater closes a fan's damper CloseDelaySec after a stop, unless it is started
+// again first
+func closeDamperLater(ip string) {
+    d, ok := driveConfig(ip)
+    if !ok || d.Damper == nil {
+        return
+    }
+    damperMu.Lock()
+    damperGen[ip]++
+    gen := damperGen[ip]
+    damperOpen[ip] = false
+    damperMu.Unlock()
+    go func() {
+        time.Sleep(time.Duration(d.Damper.CloseDelaySec) * time.Second)
+        damperMu.Lock()
+        superseded := damperGen[ip] != gen
+        damperMu.Unlock()
+        if superseded {
+            return
+        }
+        if err := setDamper(d, false); err != nil {
+            damperFault(d, "damper did not close: "+err.Error())
+            return
+        }
+        if c := d.Damper; c.EndSwitch != "" && !waitForSignal(c.EndSwitch, false, damperTimeout(c)) {
+            damperFault(d, fmt.Sprintf("damper did not close within %s (%s)", damperTimeout(c), c.EndSwitch))
+        }
+    }()
+}
+
+// =====================
+// Jog
+// =====================
+// Jog runs a stopped drive at a low speed (JogHz) for JogSeconds and then stops it, so a
+// tech checking rotation after a belt change can't leave the fan running. Any other command
+// to the drive takes over and cancels the automatic stop. The pending stop is journalled as
+// a "jog" operation, so a restart mid-jog still stops the drive (RecoveredStop).
+const (
+    defaultJogHz      = 10.0
+    defaultJogSeconds = 10
+    maxJogSeconds     = 120
+)
+
+// jogRun is a jog waiting for its automatic stop
+type jogRun struct {
+    timer *time.Timer
+    op    *Operation
+}
+
+var (
+    jogsMu sync.Mutex
+    jogs   = make(map[string]*jogRun) // by drive IP
+)
+
+// jogSettings returns a drive's jog speed and duration
+func jogSettings(d *DriveConfig) (float64, time.Duration) {
+    hz := appConfig.JogHz
+    if d != nil && d.JogHz > 0 {
+        hz = d.JogHz
+    }
+    if hz <= 0 {
+        hz = defaultJogHz
+    }
+    secs := appConfig.JogSeconds
+    if secs <= 0 {
+        secs = defaultJogSeconds
+    }
+    return hz, time.Duration(min(secs, maxJogSeconds)) * time.Second
+}
+
+// fanJog starts a stopped drive at its jog speed and schedules the stop
+func fanJog(ip string) (time.Duration, error) {
+    if driveRunning(ip) {
+        return 0, fmt.Errorf("drive is running; Jog only starts stopped drives")
+    }
+    d, _ := driveConfig(ip)
+    hz, dur := jogSettings(d)
+    if err := setFanSpeed(ip, hz, false); err != nil {
+        return 0, err
+    }
+    run := &jogRun{op: beginOperation("jog", "Stop", 0, false, [][]string{{ip}})}
+    jogsMu.Lock()
+    if old := jogs[ip]; old != nil {
+        old.timer.Stop()
+        finishOperation(old.op)
+    }
+    jogs[ip] = run
+    run.timer = time.AfterFunc(dur, func() { endJog(ip, run) })
+    jogsMu.Unlock()
+    log.Printf("[JOG] %s: running at %.1f Hz for %s", ip, hz, dur)
+    return dur, nil
+}
+
+// endJog stops a drive whose jog time is up, unless another command took over
+func endJog(ip string, run *jogRun) {
+    jogsMu.Lock()
+    if jogs[ip] != run {
+        jogsMu.Unlock()
+        return
+    }
+    delete(jogs, ip)
+    jogsMu.Unlock()
+
+    info := DriveEventInfo{ID: driveIDFor(ip), IP: ip, Success: true}
+    if err := fanStop(ip); err != nil {
+        info.Success, info.Error = false, err.Error()
+        log.Printf("[JOG] %s: automatic stop failed: %v", ip, err)
+    } else {
+        log.Printf("[JOG] %s: stopped after jog", ip)
+    }
+    finishOperation(run.op)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "JogStop", Drives: []DriveEventInfo{info}})
+    go pollAllDrives()
+}
+
+// cancelJog drops a drive's pending jog stop because another command has taken over
+func cancelJog(ip string) {
+    jogsMu.Lock()
+    run := jogs[ip]
+    delete(jogs, ip)
+    jogsMu.Unlock()
+    if run != nil {
+        run.timer.Stop()
+        finishOperation(run.op)
+        log.Printf("[JOG] %s: automatic stop cancelled by a newer command", ip)
+    }
+}
+
+// =====================
+// Soak Test
+// =====================
+// A soak test commissions a newly installed fan. It runs the stopped drive through a
+// speed profile (by default 20/40/60/80/100% of 60 Hz for 10 minutes each), samples
+// current and, with a vibration sensor, vibration at each step after it settles, and
+// checks them against the step's expected bands. The first failing step stops the test.
+// The drive is stopped at the end either way, and a pass/fail certificate is stored in
+// soak_certificates.json for later retrieval. Any other command to the drive aborts the
+// test. The pending stop is journalled as a "soak" operation, so a restart mid-test still
+// stops the drive; no certificate is issued for it.
+const (
+    soakCertificatesFilePath = "/etc/vfd/soak_certificates.json"
+    maxSoakCertificates      = 500
+    maxSoakStepMinutes       = 120
+    defaultSoakSettleSec     = 30
+    defaultSoakVibrationMax  = 4.5 // mm/s RMS
+    soakSampleInterval       = 5 * time.Second
+)
+
+// SoakStep is one speed of a soak profile with its expected bands. A band left at 0 is
+// not checked.
+type SoakStep struct {
+    Percent      float64 `json:"percent"` // of 60 Hz, as actualPercent
+    Minutes      float64 `json:"minutes"`
+    CurrentMin   float64 `json:"currentMin,omitempty"`   // A, checked against the step's average
+    CurrentMax   float64 `json:"currentMax,omitempty"`   // A, checked against the step's peak
+    VibrationMax float64 `json:"vibrationMax,omitempty"` // mm/s; default 4.5 when a vibration signal is given
+}
+
+var defaultSoakSteps = []SoakStep{{Percent: 20, Minutes: 10}, {Percent: 40, Minutes: 10}, {Percent: 60, Minutes: 10}, {Percent: 80, Minutes: 10}, {Percent: 100, Minutes: 10}}
+
+// SoakReading summarizes the samples of one signal during a step
+type SoakReading struct {
+    Min     float64 `json:"min"`
+    Avg     float64 `json:"avg"`
+    Max     float64 `json:"max"`
+    Samples int     `json:"samples"`
+}
+
+func (r *SoakReading) add(v float64) {
+    if r.Samples == 0 || v < r.Min {
+        r.Min = v
+    }
+    if r.Samples == 0 || v > r.Max {
+        r.Max = v
+    }
+    r.Avg = (r.Avg*float64(r.Samples) + v) / float64(r.Samples+1)
+    r.Samples++
+}
+
+// SoakStepResult is a step as run, in the certificate
+type SoakStepResult struct {
+    SoakStep
+    Hz        float64      `json:"hz"`
+    Result    string       `json:"result"` // "pass", "fail" or "not run"
+    Reason    string       `json:"reason,omitempty"`
+    Current   *SoakReading `json:"current,omitempty"`
+    Vibration *SoakReading `json:"vibration,omitempty"`
+}
+
+// SoakCertificate is the commissioning record of one soak test
+type SoakCertificate struct {
+    ID              string           `json:"id"`
+    DriveID         string           `json:"driveId"`
+    IP              string           `json:"ip"`
+    Group           string           `json:"group"`
+    FanDesc         string           `json:"fanDesc,omitempty"`
+    DriveType       string           `json:"driveType"`
+    User            string           `json:"user"`
+    VibrationSignal string           `json:"vibrationSignal,omitempty"`
+    SettleSec       int              `json:"settleSec"`
+    StartedAt       time.Time        `json:"startedAt"`
+    FinishedAt      *time.Time       `json:"finishedAt,omitempty"`
+    Result          string           `json:"result"` // "running", "pass", "fail" or "aborted"
+    Reason          string           `json:"reason,omitempty"`
+    Steps           []SoakStepResult `json:"steps"`
+}
+
+// soakRun is a soak test in progress
+type soakRun struct {
+    cert   SoakCertificate // guarded by soakMu
+    ack    bool
+    cancel chan struct{}
+    op     *Operation
+}
+
+var (
+    soakMu           sync.Mutex
+    soakRuns         = make(map[string]*soakRun) // by drive IP
+    soakCertificates []SoakCertificate           // oldest first
+)
+
+func validateSoakSteps(steps []SoakStep) error {
+    for i, st := range steps {
+        switch {
+        case st.Percent <= 0 || st.Percent > 200:
+            return fmt.Errorf("step %d: percent must be between 0 and 200", i+1)
+        case st.Minutes <= 0 || st.Minutes > maxSoakStepMinutes:
+            return fmt.Errorf("step %d: minutes must be between 0 and %d", i+1, maxSoakStepMinutes)
+        case st.CurrentMin < 0 || st.CurrentMax < 0 || st.VibrationMax < 0:
+            return fmt.Errorf("step %d: bands cannot be negative", i+1)
+        case st.CurrentMax > 0 && st.CurrentMin > st.CurrentMax:
+            return fmt.Errorf("step %d: currentMin is above currentMax", i+1)
+        }
+    }
+    return nil
+}
+
+// soakStepHz converts a step's percent to the drive's speed, refusing speeds the drive
+// may not run at now
+func soakStepHz(d *DriveConfig, st SoakStep, ack bool) (float64, error) {
+    hz, _ := clampSpeed(d, math.Round(st.Percent*0.6*10)/10)
+    if _, err := checkSpeedWrite(d, hz, ack); err != nil {
+        return 0, err
+    }
+    return hz, nil
+}
+
+// judgeSoakStep compares a finished step's readings with its bands
+func judgeSoakStep(r *SoakStepResult, vibrationSignal string) {
+    r.Result = "pass"
+    switch {
+    case r.Current == nil || r.Current.Samples == 0:
+        r.Result, r.Reason = "fail", "no current readings"
+    case r.CurrentMax > 0 && r.Current.Max > r.CurrentMax:
+        r.Result, r.Reason = "fail", fmt.Sprintf("peak current %.1f A above %.1f A", r.Current.Max, r.CurrentMax)
+    case r.CurrentMin > 0 && r.Current.Avg < r.CurrentMin:
+        r.Result, r.Reason = "fail", fmt.Sprintf("average current %.1f A below %.1f A", r.Current.Avg, r.CurrentMin)
+    case vibrationSignal == "":
+    case r.Vibration == nil || r.Vibration.Samples == 0:
+        r.Result, r.Reason = "fail", "no vibration readings from "+vibrationSignal
+    case r.Vibration.Max > r.VibrationMax:
+        r.Result, r.Reason = "fail", fmt.Sprintf("peak vibration %.2f mm/s above %.2f mm/s", r.Vibration.Max, r.VibrationMax)
+    }
+}
+
+// soakSampleProblem reports why a live entry ends the step early, if it does
+func soakSampleProblem(entry map[string]interface{}, hz float64, settled bool) string {
+    if entry == nil {
+        return "drive not found"
+    }
+    switch status, _ := entry["status"].(string); {
+    case status == "Tripped":
+        return fmt.Sprintf("drive tripped (fault %v)", entry["faultText"])
+    case status == "Unavailable" || status == "NotReady":
+        return "drive " + status
+    case settled && status != "Running":
+        return "drive is not running (" + status + ")"
+    }
+    if sp, ok := entry["setSpeed"].(float64); ok && settled && math.Abs(sp-hz) > 0.5 {
+        return fmt.Sprintf("setpoint changed to %.1f Hz outside the test", sp)
+    }
+    return ""
+}
+
+// startSoak checks and starts a soak test on a stopped drive
+func startSoak(ip, user, vibrationSignal string, steps []SoakStep, settleSec int, ack bool) (SoakCertificate, error) {
+    d, ok := driveConfig(ip)
+    if !ok {
+        return SoakCertificate{}, fmt.Errorf("unknown drive %s", ip)
+    }
+    if len(steps) == 0 {
+        steps = appConfig.SoakSteps
+    }
+    if len(steps) == 0 {
+        steps = defaultSoakSteps
+    }
+    if err := validateSoakSteps(steps); err != nil {
+        return SoakCertificate{}, err
+    }
+    if settleSec <= 0 {
+        settleSec = defaultSoakSettleSec
+    }
+    results := make([]SoakStepResult, len(steps))
+    for i, st := range steps {
+        hz, err := soakStepHz(d, st, ack)
+        if err != nil {
+            return SoakCertificate{}, fmt.Errorf("step %d (%.0f%%): %v", i+1, st.Percent, err)
+        }
+        if vibrationSignal != "" && st.VibrationMax == 0 {
+            st.VibrationMax = defaultSoakVibrationMax
+        }
+        if float64(settleSec) >= st.Minutes*60 {
+            return SoakCertificate{}, fmt.Errorf("step %d: the %ds settle time leaves nothing to sample", i+1, settleSec)
+        }
+        results[i] = SoakStepResult{SoakStep: st, Hz: hz, Result: "not run"}
+    }
+    if entry := liveDrives()[ip]; entry == nil || entry["status"] != "Stopped" {
+        status, _ := entry["status"].(string)
+        return SoakCertificate{}, fmt.Errorf("drive must be stopped to start a soak test (status %s)", status)
+    }
+
+    now := time.Now()
+    run := &soakRun{
+        cert: SoakCertificate{
+            ID: fmt.Sprintf("%s-%s", d.ID, now.Format("20060102-150405")), DriveID: d.ID, IP: ip, Group: d.Group,
+            FanDesc: d.FanDesc, DriveType: d.DriveType, User: user, VibrationSignal: vibrationSignal,
+            SettleSec: settleSec, StartedAt: now, Result: "running", Steps: results,
+        },
+        ack:    ack,
+        cancel: make(chan struct{}),
+    }
+    soakMu.Lock()
+    if soakRuns[ip] != nil {
+        soakMu.Unlock()
+        return SoakCertificate{}, fmt.Errorf("a soak test is already running on %s", ip)
+    }
+    soakRuns[ip] = run
+    soakMu.Unlock()
+
+    run.op = beginOperation("soak", "Stop", 0, false, [][]string{{ip}})
+    log.Printf("[SOAK] %s: started %s (%d steps) for %s", ip, run.cert.ID, len(results), user)
+    go runSoak(run)
+    return run.cert, nil
+}
+
+// runSoak runs the steps, stops the drive and stores the certificate
+func runSoak(run *soakRun) {
+    ip := run.cert.IP
+    result, reason := "pass", ""
+    for i := range run.cert.Steps {
+        advanceOperation(run.op, 0) // keeps the pending stop within the recovery window
+        step, aborted := runSoakStep(run, i)
+        soakMu.Lock()
+        run.cert.Steps[i] = step
+        soakMu.Unlock()
+        if aborted != "" {
+            result, reason = "aborted", aborted
+            break
+        }
+        if step.Result == "fail" {
+            result, reason = "fail", fmt.Sprintf("step %d (%.0f%%): %s", i+1, step.Percent, step.Reason)
+            break
+        }
+    }
+
+    info := DriveEventInfo{ID: run.cert.DriveID, IP: ip, Success: result == "pass"}
+    if !info.Success {
+        info.Error = "soak test " + result + ": " + reason
+    }
+    if result != "aborted" {
+        // An abort means another command has taken over the drive
+        if err := fanStop(ip); err != nil {
+            info.Success, info.Error = false, joinWarnings(info.Error, "stop failed: "+err.Error())
+            log.Printf("[SOAK] %s: stop failed: %v", ip, err)
+        }
+    }
+    finishOperation(run.op)
+
+    soakMu.Lock()
+    finished := time.Now()
+    run.cert.Result, run.cert.Reason, run.cert.FinishedAt = result, reason, &finished
+    cert := run.cert
+    delete(soakRuns, ip)
+    soakCertificates = append(soakCertificates, cert)
+    if len(soakCertificates) > maxSoakCertificates {
+        soakCertificates = soakCertificates[len(soakCertificates)-maxSoakCertificates:]
+    }
+    soakMu.Unlock()
+    if err := saveSoakCertificates(soakCertificatesFilePath); err != nil {
+        log.Printf("[SOAK] Failed to save certificates: %v", err)
+    }
+    log.Printf("[SOAK] %s: %s %s %s", ip, cert.ID, result, reason)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "SoakTest", Drives: []DriveEventInfo{info}, Detail: "certificate " + cert.ID + ": " + result})
+    go pollAllDrives()
+}
+
+// runSoakStep runs one step and returns it judged, or why the test was aborted
+func runSoakStep(run *soakRun, i int) (SoakStepResult, string) {
+    soakMu.Lock()
+    step := run.cert.Steps[i]
+    signal, settle := run.cert.VibrationSignal, time.Duration(run.cert.SettleSec)*time.Second
+    soakMu.Unlock()
+    ip := run.cert.IP
+
+    if err := setFanSpeed(ip, step.Hz, run.ack); err != nil {
+        step.Result, step.Reason = "fail", "set speed: "+err.Error()
+        return step, ""
+    }
+    log.Printf("[SOAK] %s: step %d at %.1f Hz for %.0f min", ip, i+1, step.Hz, step.Minutes)
+    step.Current = &SoakReading{}
+    if signal != "" {
+        step.Vibration = &SoakReading{}
+    }
+    start := time.Now()
+    end := start.Add(time.Duration(step.Minutes * float64(time.Minute)))
+    ticker := time.NewTicker(soakSampleInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-run.cancel:
+            return step, "another command was sent to the drive"
+        case now := <-ticker.C:
+            settled := now.Sub(start) >= settle
+            entry := liveDrives()[ip]
+            if problem := soakSampleProblem(entry, step.Hz, settled); problem != "" {
+                step.Result, step.Reason = "fail", problem
+                return step, ""
+            }
+            if settled {
+                step.Current.add(safeFloat(entry["current"]))
+                if v, ok := sensorValue(signal); ok && signal != "" {
+                    step.Vibration.add(v)
+                }
+            }
+            if !now.Before(end) {
+                judgeSoakStep(&step, signal)
+                return step, ""
+            }
+        }
+    }
+}
+
+// cancelSoak aborts a drive's soak test because another command has taken over
+func cancelSoak(ip string) {
+    soakMu.Lock()
+    defer soakMu.Unlock()
+    if run := soakRuns[ip]; run != nil {
+        select {
+        case <-run.cancel:
+        default:
+            close(run.cancel)
+            log.Printf("[SOAK] %s: aborted by a newer command", ip)
+        }
+    }
+}
+
+func loadSoakCertificates(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    var loaded []SoakCertificate
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("[SOAK] %s: %v", filePath, err)
+        return
+    }
+    soakMu.Lock()
+    soakCertificates = loaded
+    soakMu.Unlock()
+}
+
+func saveSoakCertificates(filePath string) error {
+    soakMu.Lock()
+    data, err := json.MarshalIndent(soakCertificates, "", "    ")
+    soakMu.Unlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// handleSoak serves GET /api/soak (tests running and certificates, newest first, filtered
+// by ?drive=), GET /api/soak/<certificate id>, POST /api/soak/<id or ip> to start a test
+// and DELETE /api/soak/<id or ip> to abort one.
+func handleSoak(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    ref := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/soak"), "/")
+    if r.Method == http.MethodGet {
+        soakMu.Lock()
+        defer soakMu.Unlock()
+        if ref != "" {
+            for _, c := range soakCertificates {
+                if c.ID == ref {
+                    json.NewEncoder(w).Encode(c)
+                    return
+                }
+            }
+            for _, run := range soakRuns {
+                if run.cert.ID == ref {
+                    json.NewEncoder(w).Encode(run.cert)
+                    return
+                }
+            }
+            http.Error(w, "Unknown certificate: "+ref, http.StatusNotFound)
+            return
+        }
+        filter := r.URL.Query().Get("drive")
+        if filter != "" {
+            filter = driveRefIP(filter, configuredDrives())
+        }
+        running, certs := []SoakCertificate{}, []SoakCertificate{}
+        for _, run := range soakRuns {
+            if filter == "" || run.cert.IP == filter {
+                running = append(running, run.cert)
+            }
+        }
+        for i := len(soakCertificates) - 1; i >= 0; i-- {
+            if filter == "" || soakCertificates[i].IP == filter {
+                certs = append(certs, soakCertificates[i])
+            }
+        }
+        sort.Slice(running, func(i, j int) bool { return running[i].IP < running[j].IP })
+        json.NewEncoder(w).Encode(map[string]interface{}{"running": running, "certificates": certs})
+        return
+    }
+    if ref == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    ip := driveRefIP(ref, configuredDrives())
+    if _, ok := driveConfig(ip); !ok {
+        http.Error(w, "Unknown drive: "+ref, http.StatusNotFound)
+        return
+    }
+    if !authorize(w, r, "Soak", []string{ip}) {
+        return
+    }
+    if r.Method == http.MethodDelete {
+        soakMu.Lock()
+        running := soakRuns[ip] != nil
+        soakMu.Unlock()
+        if !running {
+            http.Error(w, "No soak test running on "+ref, http.StatusNotFound)
+            return
+        }
+        cancelSoak(ip)
+        // The test stops the drive itself only when it ends on its own
+        if err := fanStop(ip); err != nil {
+            http.Error(w, "Soak test aborted, but the stop failed: "+err.Error(), http.StatusBadGateway)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+
+    var req struct {
+        User            string     `json:"user"`
+        Steps           []SoakStep `json:"steps"`
+        SettleSec       int        `json:"settleSec"`
+        VibrationSignal string     `json:"vibrationSignal"` // "<sensor>.vibration"
+        Acknowledge     bool       `json:"acknowledge"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if req.User == "" {
+        http.Error(w, "user is required", http.StatusBadRequest)
+        return
+    }
+    if req.VibrationSignal != "" && !strings.HasSuffix(req.VibrationSignal, ".vibration") {
+        http.Error(w, "vibrationSignal must be \"<sensor>.vibration\"", http.StatusBadRequest)
+        return
+    }
+    if _, ok := sensorValue(req.VibrationSignal); req.VibrationSignal != "" && !ok {
+        http.Error(w, "No current reading for "+req.VibrationSignal, http.StatusConflict)
+        return
+    }
+    cert, err := startSoak(ip, req.User, req.VibrationSignal, req.Steps, req.SettleSec, req.Acknowledge)
+    if err != nil {
+        http.Error(w, "Soak test not started: "+err.Error(), http.StatusConflict)
+        return
+    }
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(cert)
+}
+
+// =====================
+// Synchronized SetSpeed
+// =====================
+// "synchronized": true on a SetSpeed changes every drive's speed at the same instant. Each
+// drive's session is locked and everything that can be written ahead is written (setpoints
+// on drives that apply them only on ENTER); then all drives are released together for the
+// write that takes effect. The spread of those writes' completion times is the skew.
+
+const syncStageTimeout = 5 * time.Second
+
+// syncWrite is one drive's part of a synchronized write
+type syncWrite struct {
+    info DriveEventInfo
+    done time.Time // when the effective write completed
+}
+
+// executeSynchronized starts any stopped drives, then applies the speed to all of them
+// together. It returns the event and the achieved skew.
+func executeSynchronized(speed float64, ips []string, ack bool) (ControlEvent, time.Duration) {
+    endCfmTargets(ips, "SetSpeed")
+    event := ControlEvent{Timestamp: time.Now(), Action: "SetSpeed", Speed: speed, Drives: make([]DriveEventInfo, 0)}
+    var stopped []string
+    for _, ip := range ips {
+        if !driveRunning(ip) {
+            stopped = append(stopped, ip)
+        }
+    }
+    failed := make(map[string]bool)
+    if len(stopped) > 0 {
+        for _, info := range executeControl("Start", 0, stopped, ack).Drives {
+            if !info.Success {
+                failed[info.IP] = true
+                event.Drives = append(event.Drives, info)
+            }
+        }
+    }
+
+    results := make([]*syncWrite, 0, len(ips))
+    var ready, finished sync.WaitGroup
+    release := make(chan struct{})
+    for _, ip := range ips {
+        if failed[ip] {
+            continue
+        }
+        w := &syncWrite{info: DriveEventInfo{IP: ip, Success: true}}
+        results = append(results, w)
+        ready.Add(1)
+        finished.Add(1)
+        go func() {
+            defer finished.Done()
+            err := stageSyncWrite(w, speed, ack, ready.Done, release)
+            if err != nil {
+                w.info.Success = false
+                w.info.Error = err.Error()
+                w.info.VerifyFailed = errors.Is(err, errWriteNotVerified)
+                log.Printf("[SYNC] IP: %s, SetSpeed %.2f: %v", w.info.IP, speed, err)
+            }
+        }()
+    }
+
+    staged := make(chan struct{})
+    go func() {
+        ready.Wait()
+        close(staged)
+    }()
+    select {
+    case <-staged:
+    case <-time.After(syncStageTimeout):
+        log.Printf("[SYNC] Not every drive staged within %s; releasing the ones that did", syncStageTimeout)
+    }
+    close(release)
+    finished.Wait()
+
+    var first, last time.Time
+    for _, w := range results {
+        event.Drives = append(event.Drives, w.info)
+        if !w.info.Success {
+            continue
+        }
+        if first.IsZero() || w.done.Before(first) {
+            first = w.done
+        }
+        if w.done.After(last) {
+            last = w.done
+        }
+    }
+    skew := last.Sub(first)
+    event.Detail = fmt.Sprintf("synchronized, skew %s", skew.Round(time.Microsecond))
+    log.Printf("[SYNC] SetSpeed %.2f on %d drives, skew %s", speed, len(results), skew.Round(time.Microsecond))
+    return event, skew
+}
+
+// stageSyncWrite holds a drive's session, writes what can go ahead, reports ready and
+// performs the effective write on release. A drive that misses the staging timeout still
+// writes, just late, and reports it.
+func stageSyncWrite(w *syncWrite, speed float64, ack bool, readyDone func(), release <-chan struct{}) error {
+    staged := false
+    defer func() {
+        if !staged {
+            readyDone()
+        }
+    }()
+    d, _ := driveConfig(w.info.IP)
+    speed, clamped := clampSpeed(d, speed)
+    warning, err := checkSpeedWrite(d, speed, ack)
+    if err != nil {
+        return err
+    }
+    w.info.Warning = joinWarnings(warning, clamped)
+    conn, profile, err := getConnAndProfile(w.info.IP)
+    if err != nil {
+        return err
+    }
+    if len(profile.Setpoint) == 0 {
+        return fmt.Errorf("profile has no Setpoint register")
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    raw := applyCalc(profile.SetFreqCalc, speed, profile.Constants)
+    writeSetpoints := func() error {
+        if err := writeSetpoint(conn, profile, profile.Setpoint[0], raw); err != nil {
+            return err
+        }
+        if len(profile.Setpoint) > 1 {
+            return writeSetpoint(conn, profile, profile.Setpoint[1], raw*float64(profile.SpeedPresetMultiplier))
+        }
+        return nil
+    }
+    enter := profile.needsEnter("Setpoint")
+    if enter {
+        // The setpoint takes effect on ENTER, so it can be written ahead
+        if err := writeSetpoints(); err != nil {
+            return err
+        }
+    }
+    staged = true
+    readyDone()
+    <-release
+    if enter {
+        err = writeEnter(conn, profile, "Setpoint")
+    } else {
+        err = writeSetpoints()
+    }
+    w.done = time.Now()
+    if err == nil {
+        setCommandedSpeed(w.info.IP, speed)
+    }
+    return err
+}
+
+// =====================
+// Trip Auto-Reset
+// =====================
+// With AutoReset set, a tripped drive is reset without waiting for someone to notice: after
+// DelaySec it gets fanUnTrip, plus fanStart if it was running when it tripped. A drive is
+// reset at most MaxPerHour times in any hour; the next trip locks it out, which is logged,
+// recorded as an AutoResetLockout event and sent as a critical TripLockout notification.
+// A locked-out drive stays down until someone resets it by hand (seeing it Running again
+// clears the lockout) or clears the lockout through POST /api/auto-reset/<drive>.
+// Lockouts and recent attempts persist in auto_reset.json so a restart doesn't reset them.
+const autoResetFilePath = "/etc/vfd/auto_reset.json"
+
+type AutoResetConfig struct {
+    MaxPerHour        int      `json:"MaxPerHour"`                  // default 3
+    DelaySec          int      `json:"DelaySec"`                    // wait before each reset, default 30
+    Groups            []string `json:"Groups,omitempty"`            // empty: every group
+    ExcludeFaultCodes []int    `json:"ExcludeFaultCodes,omitempty"` // faults that always need a person, e.g. earth fault
+}
+
+// AutoResetState is one drive's auto-reset history, by drive ID
+type AutoResetState struct {
+    Attempts   []time.Time `json:"attempts,omitempty"` // resets in the last hour
+    LockedAt   *time.Time  `json:"lockedAt,omitempty"`
+    Pending    bool        `json:"pending,omitempty"` // a reset is waiting out DelaySec
+    wasRunning bool        // last healthy status seen was Running
+}
+
+var (
+    autoResetMu    sync.Mutex
+    autoResetState = make(map[string]*AutoResetState)
+)
+
+func autoResetLimits(c *AutoResetConfig) (int, time.Duration) {
+    max, delay := c.MaxPerHour, c.DelaySec
+    if max <= 0 {
+        max = 3
+    }
+    if delay <= 0 {
+        delay = 30
+    }
+    return max, time.Duration(delay) * time.Second
+}
+
+// autoResetAppliesTo reports whether the policy covers a drive's group and fault
+func autoResetAppliesTo(c *AutoResetConfig, group string, faultCode int) bool {
+    if len(c.Groups) > 0 && !containsString(c.Groups, group) {
+        return false
+    }
+    return !containsInt(c.ExcludeFaultCodes, faultCode)
+}
+
+// pruneAttempts drops attempts older than an hour
+func (s *AutoResetState) pruneAttempts(now time.Time) {
+    kept := s.Attempts[:0]
+    for _, t := range s.Attempts {
+        if now.Sub(t) < time.Hour {
+            kept = append(kept, t)
+        }
+    }
+    s.Attempts = kept
+}
+
+// autoResetTrips is called after each poll: it schedules resets for tripped drives and
+// locks out those that have used up their hourly budget
+func autoResetTrips(snapshot []map[string]interface{}) {
+    c := appConfig.AutoReset
+    if c == nil || shadowMode() {
+        return
+    }
+    max, delay := autoResetLimits(c)
+    now := time.Now()
+    var locked []Notification
+    changed := false
+
+    autoResetMu.Lock()
+    for _, entry := range snapshot {
+        id, _ := entry["id"].(string)
+        ip, _ := entry["ip"].(string)
+        status, _ := entry["status"].(string)
+        group := fmt.Sprintf("%v", entry["group"])
+        s := autoResetState[id]
+        if s == nil {
+            s = &AutoResetState{}
+            autoResetState[id] = s
+        }
+        switch status {
+        case "Running", "Stopped":
+            s.wasRunning = status == "Running"
+            if status == "Running" && s.LockedAt != nil {
+                log.Printf("[AUTO-RESET] %s is running again; lockout cleared", ip)
+                s.LockedAt, s.Attempts, changed = nil, nil, true
+                resolveAlert("TripLockout", id)
+            }
+            continue
+        case "Tripped":
+        default:
+            continue
+        }
+        faultCode := safeInt(entry["faultCode"])
+        if s.Pending || s.LockedAt != nil || entry["tagout"] != nil || !ownsDrive(ip) || !autoResetAppliesTo(c, group, faultCode) {
+            continue
+        }
+        s.pruneAttempts(now)
+        if len(s.Attempts) >= max {
+            at := now
+            s.LockedAt, changed = &at, true
+            locked = append(locked, Notification{Severity: "critical", Kind: "TripLockout", Group: group, DriveID: id, IP: ip,
+                Message: fmt.Sprintf("Fan %v in group %s (%s) tripped again after %d automatic resets in the last hour; locked out until reset by hand", entry["fanNumber"], group, ip, len(s.Attempts))})
+            continue
+        }
+        s.Pending = true
+        go attemptAutoReset(id, ip, s.wasRunning, faultCode, delay, max)
+    }
+    autoResetMu.Unlock()
+
+    for _, n := range locked {
+        log.Printf("[AUTO-RESET] %s", n.Message)
+        recordControlEvent(ControlEvent{Timestamp: now, Action: "AutoResetLockout", Drives: []DriveEventInfo{{ID: n.DriveID, IP: n.IP, Success: true}}, Detail: n.Message})
+        notify(n)
+    }
+    if changed {
+        if err := saveAutoReset(autoResetFilePath); err != nil {
+            log.Printf("[AUTO-RESET] Failed to save %s: %v", autoResetFilePath, err)
+        }
+    }
+}
+
+// attemptAutoReset waits out the delay and resets the drive if it is still tripped
+func attemptAutoReset(id, ip string, start bool, faultCode int, delay time.Duration, max int) {
+    time.Sleep(delay)
+    status := ""
+    vfdDataMutex.RLock()
+    for _, entry := range vfdData {
+        if entry["ip"] == ip {
+            status, _ = entry["status"].(string)
+        }
+    }
+    vfdDataMutex.RUnlock()
+
+    autoResetMu.Lock()
+    s := autoResetState[id]
+    if status != "Tripped" || isDriveDisabled(ip) {
+        s.Pending = false
+        autoResetMu.Unlock()
+        return
+    }
+    s.Attempts = append(s.Attempts, time.Now())
+    attempt := len(s.Attempts)
+    autoResetMu.Unlock()
+
+    err := fanUnTrip(ip)
+    action := "UnTrip"
+    if err == nil && start {
+        action = "UnTrip+Start"
+        time.Sleep(time.Second) // let the drive leave the fault state before the run command
+        err = fanStart(ip)
+    }
+    info := DriveEventInfo{ID: id, IP: ip, Success: err == nil}
+    detail := fmt.Sprintf("%s after fault %d, attempt %d of %d this hour", action, faultCode, attempt, max)
+    if err != nil {
+        info.Error = err.Error()
+        log.Printf("[AUTO-RESET] %s: %s failed: %v", ip, detail, err)
+    } else {
+        log.Printf("[AUTO-RESET] %s: %s", ip, detail)
+    }
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "AutoReset", Drives: []DriveEventInfo{info}, Detail: detail})
+
+    autoResetMu.Lock()
+    s.Pending = false
+    autoResetMu.Unlock()
+    if err := saveAutoReset(autoResetFilePath); err != nil {
+        log.Printf("[AUTO-RESET] Failed to save %s: %v", autoResetFilePath, err)
+    }
+    go pollAllDrives()
+}
+
+func loadAutoReset(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    loaded := make(map[string]*AutoResetState)
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("[AUTO-RESET] %s: %v", filePath, err)
+        return
+    }
+    for _, s := range loaded {
+        s.Pending = false
+    }
+    autoResetMu.Lock()
+    autoResetState = loaded
+    autoResetMu.Unlock()
+}
+
+func saveAutoReset(filePath string) error {
+    autoResetMu.Lock()
+    data, err := json.MarshalIndent(autoResetState, "", "    ")
+    autoResetMu.Unlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// handleAutoReset serves GET /api/auto-reset (per-drive attempts and lockouts) and
+// POST /api/auto-reset/<id or ip> {"action": "clear"} to lift a lockout
+func handleAutoReset(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    ref := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/auto-reset"), "/")
+    if r.Method == http.MethodGet && ref == "" {
+        type driveState struct {
+            ID       string     `json:"id"`
+            IP       string     `json:"ip"`
+            Attempts int        `json:"attemptsLastHour"`
+            LockedAt *time.Time `json:"lockedAt,omitempty"`
+            Pending  bool       `json:"pending"`
+        }
+        list := []driveState{}
+        now := time.Now()
+        autoResetMu.Lock()
+        for _, d := range configuredDrives() {
+            s := autoResetState[d.ID]
+            if s == nil {
+                continue
+            }
+            s.pruneAttempts(now)
+            if len(s.Attempts) > 0 || s.LockedAt != nil || s.Pending {
+                list = append(list, driveState{ID: d.ID, IP: d.IP, Attempts: len(s.Attempts), LockedAt: s.LockedAt, Pending: s.Pending})
+            }
+        }
+        autoResetMu.Unlock()
+        json.NewEncoder(w).Encode(map[string]interface{}{"policy": appConfig.AutoReset, "drives": list})
+        return
+    }
+    if r.Method != http.MethodPost || ref == "" {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    var req struct {
+        Action string `json:"action"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Action != "clear" {
+        http.Error(w, `Request body must be {"action": "clear"}`, http.StatusBadRequest)
+        return
+    }
+    d, ok := driveConfig(driveRefIP(ref, configuredDrives()))
+    if !ok {
+        http.Error(w, "Unknown drive: "+ref, http.StatusNotFound)
+        return
+    }
+    autoResetMu.Lock()
+    s := autoResetState[d.ID]
+    wasLocked := s != nil && s.LockedAt != nil
+    if s != nil {
+        s.LockedAt, s.Attempts = nil, nil
+    }
+    autoResetMu.Unlock()
+    if err := saveAutoReset(autoResetFilePath); err != nil {
+        http.Error(w, "Failed to save auto-reset state: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    resolveAlert("TripLockout", d.ID)
+    detail := fmt.Sprintf("%s: auto-reset lockout cleared (was locked: %v)", d.IP, wasLocked)
+    log.Printf("[AUTO-RESET] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "AutoResetClear", Drives: []DriveEventInfo{{ID: d.ID, IP: d.IP, Success: true}}, Detail: detail})
+    json.NewEncoder(w).Encode(map[string]interface{}{"id": d.ID, "ip": d.IP, "cleared": wasLocked})
+}
+
+// =====================
+// Maintenance Tagout
+// =====================
+// A tagout is the server's side of lockout/tagout: a drive being worked on is tagged with
+// who tagged it and why. Unlike a disabled drive it stays polled and visible (the "tagout"
+// field of its data), but every control write is refused with the tag as the reason.
+// Manual commands, schedules, curtailment, rotation, quiet hours, DCIM, jog and soak tests
+// all reach the drive through getConnAndProfile, which checks the tag; auto-reset and the
+// setpoint watchdog skip tagged drives. Tags persist in tagouts.json until removed with
+// DELETE /api/tagouts/<drive>.
+
+// Tagout records who tagged a drive out for maintenance, and why
+type Tagout struct {
+    User   string    `json:"user"`
+    Reason string    `json:"reason"`
+    SetAt  time.Time `json:"setAt"`
+}
+
+const tagoutsFilePath = "/etc/vfd/tagouts.json"
+
+var (
+    tagoutsMu sync.RWMutex
+    tagouts   = make(map[string]Tagout) // by drive ID
+)
+
+// driveTagout returns the tag on a drive, by drive ID
+func driveTagout(id string) (Tagout, bool) {
+    tagoutsMu.RLock()
+    defer tagoutsMu.RUnlock()
+    t, ok := tagouts[id]
+    return t, ok
+}
+
+// tagoutError is the reason a control write to a tagged drive is refused, nil if it isn't
+func tagoutError(ip string) error {
+    d, ok := driveConfig(ip)
+    if !ok {
+        return nil
+    }
+    t, tagged := driveTagout(d.ID)
+    if !tagged {
+        return nil
+    }
+    return fmt.Errorf("drive %s is tagged out for maintenance by %s since %s: %s", ip, t.User, t.SetAt.Format("2006-01-02 15:04"), t.Reason)
+}
+
+func loadTagouts(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    loaded := make(map[string]Tagout)
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("[TAGOUT] %s: %v", filePath, err)
+        return
+    }
+    tagoutsMu.Lock()
+    tagouts = loaded
+    tagoutsMu.Unlock()
+}
+
+func saveTagouts(filePath string) error {
+    tagoutsMu.RLock()
+    data, err := json.MarshalIndent(tagouts, "", "    ")
+    tagoutsMu.RUnlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// handleTagouts serves GET /api/tagouts (every tagged drive), POST /api/tagouts/<id or ip>
+// {"user": "...", "reason": "..."} to tag a drive out and DELETE /api/tagouts/<id or ip>
+// {"user": "..."} to release it
+func handleTagouts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    ref := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tagouts"), "/")
+    if r.Method == http.MethodGet && ref == "" {
+        type tagged struct {
+            ID     string `json:"id"`
+            IP     string `json:"ip"`
+            Group  string `json:"group"`
+            Tagout
+        }
+        list := []tagged{}
+        for _, d := range configuredDrives() {
+            if t, ok := driveTagout(d.ID); ok {
+                list = append(list, tagged{ID: d.ID, IP: d.IP, Group: d.Group, Tagout: t})
+            }
+        }
+        json.NewEncoder(w).Encode(list)
+        return
+    }
+    if ref == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    d, ok := driveConfig(driveRefIP(ref, configuredDrives()))
+    if !ok {
+        http.Error(w, "Unknown drive: "+ref, http.StatusNotFound)
+        return
+    }
+    if !authorize(w, r, "Tagout", []string{d.IP}) {
+        return
+    }
+    var req struct {
+        User   string `json:"user"`
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    req.User, req.Reason = strings.TrimSpace(req.User), strings.TrimSpace(req.Reason)
+    if req.User == "" || (r.Method == http.MethodPost && req.Reason == "") {
+        http.Error(w, "user and reason are required", http.StatusBadRequest)
+        return
+    }
+
+    now := time.Now()
+    tagoutsMu.Lock()
+    old, wasTagged := tagouts[d.ID]
+    if r.Method == http.MethodDelete {
+        delete(tagouts, d.ID)
+    } else {
+        tagouts[d.ID] = Tagout{User: req.User, Reason: req.Reason, SetAt: now}
+    }
+    tagoutsMu.Unlock()
+    if r.Method == http.MethodDelete && !wasTagged {
+        http.Error(w, "Drive is not tagged out: "+ref, http.StatusNotFound)
+        return
+    }
+    if err := saveTagouts(tagoutsFilePath); err != nil {
+        http.Error(w, "Failed to save tagouts: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    action, detail := "Tagout", fmt.Sprintf("%s tagged out by %s: %s", d.IP, req.User, req.Reason)
+    if r.Method == http.MethodDelete {
+        action, detail = "TagoutRelease", fmt.Sprintf("%s released by %s (tagged out by %s: %s)", d.IP, req.User, old.User, old.Reason)
+    }
+    log.Printf("[TAGOUT] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: now, Action: action, Drives: []DriveEventInfo{{ID: d.ID, IP: d.IP, Success: true}}, Detail: detail})
+    go pollAllDrives()
+    if r.Method == http.MethodDelete {
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    t, _ := driveTagout(d.ID)
+    json.NewEncoder(w).Encode(map[string]interface{}{"id": d.ID, "ip": d.IP, "tagout": t})
+}
+
+// =====================
+// Hand/Auto
+// =====================
+// Several sources write setpoints, and a higher-priority one wins: operator commands (the
+// control API, KNX, NATS, presets) over curtailment, over schedules, over automation (DCIM
+// load-following and rotation). Putting a drive in hand (POST /api/hand/<drive>, or
+// "hand": true on /api/control) pins it to what the operator set: curtailment, schedules and
+// automation leave it alone until it is switched back to auto (DELETE /api/hand/<drive>).
+// Likewise a curtailed drive is left alone by schedules and automation until resumed.
+// Held drives are reported on the source's event rather than written. Quiet hours caps and
+// auto-reset are limits and recovery, not setpoint sources, and still apply. Hand state
+// persists in hand.json and shows as the "hand" field of the drive's data.
+
+// Setpoint sources, by priority (lower wins)
+const (
+    sourceOperator = iota
+    sourceCurtailment
+    sourceSchedule
+    sourceAutomation
+)
+
+// HandMode records who put a drive in hand, and why
+type HandMode struct {
+    User   string    `json:"user"`
+    Reason string    `json:"reason,omitempty"`
+    Since  time.Time `json:"since"`
+}
+
+const handFilePath = "/etc/vfd/hand.json"
+
+var (
+    handMu    sync.RWMutex
+    handModes = make(map[string]HandMode) // by drive ID
+)
+
+// driveHand returns a drive's hand mode, by drive ID; false means the drive is in auto
+func driveHand(id string) (HandMode, bool) {
+    handMu.RLock()
+    defer handMu.RUnlock()
+    h, ok := handModes[id]
+    return h, ok
+}
+
+// curtailedDrives returns the drives the curtailments in effect hold, nil if none is
+func curtailedDrives() map[string]bool {
+    sessions, err := loadCurtailments()
+    if err != nil || len(sessions) == 0 {
+        return nil
+    }
+    out := make(map[string]bool)
+    for ip := range curtailedBy(sessions) {
+        out[ip] = true
+    }
+    return out
+}
+
+// sourceHold is why a higher-priority source holds a drive against source, "" if source may write it
+func sourceHold(source int, ip string, curtailed map[string]bool) string {
+    if h, ok := driveHand(driveIDFor(ip)); ok && source > sourceOperator {
+        return fmt.Sprintf("in hand (%s since %s)", h.User, h.Since.Format("2006-01-02 15:04"))
+    }
+    if curtailed[ip] && source > sourceCurtailment {
+        return "curtailed"
+    }
+    return ""
+}
+
+// arbitrate splits ips into the drives source may write and, as failed event entries,
+// those a higher-priority source holds
+func arbitrate(source int, ips []string) ([]string, []DriveEventInfo) {
+    var curtailed map[string]bool
+    if source > sourceCurtailment {
+        curtailed = curtailedDrives()
+    }
+    var allowed []string
+    var held []DriveEventInfo
+    for _, ip := range ips {
+        if reason := sourceHold(source, ip, curtailed); reason != "" {
+            held = append(held, DriveEventInfo{ID: driveIDFor(ip), IP: ip, Error: "held: " + reason})
+            continue
+        }
+        allowed = append(allowed, ip)
+    }
+    return allowed, held
+}
+
+// setHand puts a drive in hand, or back in auto with hand false; it reports whether the drive was in hand
+func setHand(id string, hand bool, h HandMode) (HandMode, bool) {
+    handMu.Lock()
+    defer handMu.Unlock()
+    old, was := handModes[id]
+    if hand {
+        handModes[id] = h
+    } else {
+        delete(handModes, id)
+    }
+    return old, was
+}
+
+func loadHand(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    loaded := make(map[string]HandMode)
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("[HAND] %s: %v", filePath, err)
+        return
+    }
+    handMu.Lock()
+    handModes = loaded
+    handMu.Unlock()
+}
+
+func saveHand(filePath string) error {
+    handMu.RLock()
+    data, err := json.MarshalIndent(handModes, "", "    ")
+    handMu.RUnlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// putInHand switches drives to hand for user, saves and records the event
+func putInHand(ips []string, user, reason string) error {
+    now := time.Now()
+    event := ControlEvent{Timestamp: now, Action: "Hand", Drives: []DriveEventInfo{}}
+    for _, ip := range ips {
+        id := driveIDFor(ip)
+        setHand(id, true, HandMode{User: user, Reason: reason, Since: now})
+        event.Drives = append(event.Drives, DriveEventInfo{ID: id, IP: ip, Success: true})
+    }
+    if err := saveHand(handFilePath); err != nil {
+        return err
+    }
+    event.Detail = fmt.Sprintf("%s put in hand by %s", strings.Join(ips, ","), user)
+    if reason != "" {
+        event.Detail += ": " + reason
+    }
+    log.Printf("[HAND] %s", event.Detail)
+    recordControlEvent(event)
+    go pollAllDrives()
+    return nil
+}
+
+// handleHand serves GET /api/hand (every drive in hand), POST /api/hand/<id or ip>
+// {"user": "...", "reason": "..."} to put a drive in hand and DELETE /api/hand/<id or ip>
+// {"user": "..."} to return it to auto
+func handleHand(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    ref := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/hand"), "/")
+    if r.Method == http.MethodGet && ref == "" {
+        type inHand struct {
+            ID    string `json:"id"`
+            IP    string `json:"ip"`
+            Group string `json:"group"`
+            HandMode
+        }
+        list := []inHand{}
+        for _, d := range configuredDrives() {
+            if h, ok := driveHand(d.ID); ok {
+                list = append(list, inHand{ID: d.ID, IP: d.IP, Group: d.Group, HandMode: h})
+            }
+        }
+        json.NewEncoder(w).Encode(list)
+        return
+    }
+    if ref == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    d, ok := driveConfig(driveRefIP(ref, configuredDrives()))
+    if !ok {
+        http.Error(w, "Unknown drive: "+ref, http.StatusNotFound)
+        return
+    }
+    action := "Hand"
+    if r.Method == http.MethodDelete {
+        action = "Auto"
+    }
+    if !authorize(w, r, action, []string{d.IP}) {
+        return
+    }
+    var req struct {
+        User   string `json:"user"`
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    req.User, req.Reason = strings.TrimSpace(req.User), strings.TrimSpace(req.Reason)
+    if req.User == "" {
+        http.Error(w, "user is required", http.StatusBadRequest)
+        return
+    }
+
+    if r.Method == http.MethodPost {
+        if err := putInHand([]string{d.IP}, req.User, req.Reason); err != nil {
+            http.Error(w, "Failed to save hand state: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        h, _ := driveHand(d.ID)
+        json.NewEncoder(w).Encode(map[string]interface{}{"id": d.ID, "ip": d.IP, "hand": h})
+        return
+    }
+    old, was := setHand(d.ID, false, HandMode{})
+    if !was {
+        http.Error(w, "Drive is not in hand: "+ref, http.StatusNotFound)
+        return
+    }
+    if err := saveHand(handFilePath); err != nil {
+        http.Error(w, "Failed to save hand state: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    detail := fmt.Sprintf("%s returned to auto by %s (in hand by %s since %s)", d.IP, req.User, old.User, old.Since.Format("2006-01-02 15:04"))
+    log.Printf("[HAND] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "Auto", Drives: []DriveEventInfo{{ID: d.ID, IP: d.IP, Success: true}}, Detail: detail})
+    go pollAllDrives()
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// =====================
+// Setpoint Watchdog
+// =====================
+// Every successful setpoint write records the commanded speed (setCommandedSpeed). With
+// SetpointWatchdog set, each poll compares it with the setSpeed running drives report.
+// A difference beyond ToleranceHz that lasts ConfirmSec means someone changed the setpoint
+// at the keypad or from another Modbus master. In "reassert" mode the commanded speed is
+// written again (SetpointReassert event), up to MaxReassertsPerHour. Otherwise, or once
+// that limit is reached, the drive is flagged: a SetpointDrift event, a warning
+// notification that opens an alert, and vfd_setpoint_drift. The flag clears when the
+// setpoints agree again or the server writes a new one. Drives not written since startup
+// have no commanded speed and are not watched.
+
+type SetpointWatchdogConfig struct {
+    Mode                string   `json:"Mode,omitempty"`                // "flag" (default) or "reassert"
+    ToleranceHz         float64  `json:"ToleranceHz,omitempty"`         // default 0.5
+    ConfirmSec          int      `json:"ConfirmSec,omitempty"`          // default 30
+    MaxReassertsPerHour int      `json:"MaxReassertsPerHour,omitempty"` // default 3; then the drive is only flagged
+    Groups              []string `json:"Groups,omitempty"`              // empty: every group
+}
+
+// commandedSetpoint is the last speed the server wrote to a drive
+type commandedSetpoint struct {
+    Hz float64
+    At time.Time
+}
+
+// SetpointDrift is a drive whose reported setpoint differs from the commanded one
+type SetpointDrift struct {
+    ID          string    `json:"id"`
+    IP          string    `json:"ip"`
+    Group       string    `json:"group"`
+    CommandedHz float64   `json:"commandedHz"`
+    ReportedHz  float64   `json:"reportedHz"`
+    Since       time.Time `json:"since"`
+    Flagged     bool      `json:"flagged"`
+}
+
+var (
+    setpointMu        sync.Mutex
+    commandedSpeeds   = make(map[string]commandedSetpoint) // by drive IP
+    setpointDrifts    = make(map[string]*SetpointDrift)    // by drive IP
+    setpointReasserts = make(map[string][]time.Time)       // by drive IP, the last hour
+
+    vfdSetpointDrift = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "setpoint_drift",
+            Help:      "1 while the drive's setpoint differs from the one the server wrote",
+        },
+        []string{"ip", "group", "drive_id"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(vfdSetpointDrift)
+}
+
+func setCommandedSpeed(ip string, hz float64) {
+    setpointMu.Lock()
+    commandedSpeeds[ip] = commandedSetpoint{Hz: hz, At: time.Now()}
+    setpointMu.Unlock()
+}
+
+func setpointWatchdogLimits(c *SetpointWatchdogConfig) (tolerance float64, confirm time.Duration, maxReasserts int) {
+    tolerance, confirm, maxReasserts = c.ToleranceHz, time.Duration(c.ConfirmSec)*time.Second, c.MaxReassertsPerHour
+    if tolerance <= 0 {
+        tolerance = 0.5
+    }
+    if confirm <= 0 {
+        confirm = 30 * time.Second
+    }
+    if maxReasserts <= 0 {
+        maxReasserts = 3
+    }
+    return tolerance, confirm, maxReasserts
+}
+
+// setpointAction is what a poll decided to do about one drive
+type setpointAction struct {
+    kind  string // "reassert", "flag" or "clear"
+    drift SetpointDrift
+    note  string
+}
+
+// checkSetpoints compares a poll snapshot with the commanded speeds and returns the
+// actions due. Caller holds setpointMu.
+func checkSetpoints(c *SetpointWatchdogConfig, snapshot []map[string]interface{}, now time.Time) []setpointAction {
+    tolerance, confirm, maxReasserts := setpointWatchdogLimits(c)
+    var actions []setpointAction
+    seen := make(map[string]bool)
+    for _, entry := range snapshot {
+        ip, _ := entry["ip"].(string)
+        id, _ := entry["id"].(string)
+        group := fmt.Sprintf("%v", entry["group"])
+        reported, hasSpeed := entry["setSpeed"].(float64)
+        cmd, commanded := commandedSpeeds[ip]
+        if entry["status"] != "Running" || !hasSpeed || !commanded || entry["tagout"] != nil || (len(c.Groups) > 0 && !containsString(c.Groups, group)) {
+            continue
+        }
+        seen[ip] = true
+        drift := setpointDrifts[ip]
+        // Reversed drives may report a signed setpoint
+        if math.Abs(math.Abs(reported)-cmd.Hz) <= tolerance {
+            if drift != nil {
+                if drift.Flagged {
+                    actions = append(actions, setpointAction{kind: "clear", drift: *drift})
+                }
+                delete(setpointDrifts, ip)
+            }
+            continue
+        }
+        if drift == nil || drift.CommandedHz != cmd.Hz {
+            if drift != nil && drift.Flagged {
+                actions = append(actions, setpointAction{kind: "clear", drift: *drift})
+            }
+            drift = &SetpointDrift{ID: id, IP: ip, Group: group, CommandedHz: cmd.Hz, Since: now}
+            setpointDrifts[ip] = drift
+        }
+        drift.ReportedHz = reported
+        if drift.Flagged || now.Sub(drift.Since) < confirm {
+            continue
+        }
+        var recent []time.Time
+        for _, t := range setpointReasserts[ip] {
+            if now.Sub(t) < time.Hour {
+                recent = append(recent, t)
+            }
+        }
+        setpointReasserts[ip] = recent
+        if c.Mode == "reassert" && len(recent) < maxReasserts {
+            setpointReasserts[ip] = append(recent, now)
+            drift.Since = now // give the write time to show up in a poll
+            actions = append(actions, setpointAction{kind: "reassert", drift: *drift})
+            continue
+        }
+        drift.Flagged = true
+        action := setpointAction{kind: "flag", drift: *drift}
+        if c.Mode == "reassert" {
+            action.note = fmt.Sprintf("; re-asserted %d times in the last hour, giving up", len(recent))
+        }
+        actions = append(actions, action)
+    }
+    // Drives that stopped or dropped out are no longer drifting
+    for ip, drift := range setpointDrifts {
+        if !seen[ip] {
+            if drift.Flagged {
+                actions = append(actions, setpointAction{kind: "clear", drift: *drift})
+            }
+            delete(setpointDrifts, ip)
+        }
+    }
+    return actions
+}
+
+// watchSetpoints runs the watchdog for a poll (from onPollComplete)
+func watchSetpoints(snapshot []map[string]interface{}) {
+    c := appConfig.SetpointWatchdog
+    if c == nil || shadowMode() {
+        return
+    }
+    setpointMu.Lock()
+    actions := checkSetpoints(c, snapshot, time.Now())
+    setpointMu.Unlock()
+
+    for _, a := range actions {
+        d := a.drift
+        labels := prometheus.Labels{"ip": d.IP, "group": d.Group, "drive_id": d.ID}
+        info := DriveEventInfo{ID: d.ID, IP: d.IP, Success: true}
+        detail := fmt.Sprintf("commanded %.1f Hz, drive reports %.1f Hz", d.CommandedHz, d.ReportedHz)
+        switch a.kind {
+        case "reassert":
+            log.Printf("[SETPOINT] %s: %s; re-asserting", d.IP, detail)
+            if err := writeSpeedStep(d.IP, d.CommandedHz); err != nil {
+                info.Success, info.Error = false, err.Error()
+            }
+            recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "SetpointReassert", Speed: d.CommandedHz, Drives: []DriveEventInfo{info}, Detail: detail})
+        case "flag":
+            log.Printf("[SETPOINT] %s: %s%s", d.IP, detail, a.note)
+            vfdSetpointDrift.With(labels).Set(1)
+            info.Warning = detail + a.note
+            recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "SetpointDrift", Speed: d.CommandedHz, Drives: []DriveEventInfo{info}, Detail: detail + a.note})
+            notify(Notification{Severity: "warning", Kind: "SetpointDrift", Group: d.Group, DriveID: d.ID, IP: d.IP,
+                Message: fmt.Sprintf("Setpoint of %s was changed outside the server: %s%s", d.IP, detail, a.note)})
+        case "clear":
+            log.Printf("[SETPOINT] %s: setpoint drift cleared", d.IP)
+            vfdSetpointDrift.Delete(labels)
+            resolveAlert("SetpointDrift", d.ID)
+        }
+    }
+}
+
+// handleSetpointWatchdog serves GET /api/setpoint-watchdog: each watched drive's
+// commanded speed and any drift
+func handleSetpointWatchdog(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    type watched struct {
+        ID          string         `json:"id"`
+        IP          string         `json:"ip"`
+        Group       string         `json:"group"`
+        CommandedHz float64        `json:"commandedHz"`
+        CommandedAt time.Time      `json:"commandedAt"`
+        Drift       *SetpointDrift `json:"drift,omitempty"`
+    }
+    list := []watched{}
+    setpointMu.Lock()
+    for _, d := range configuredDrives() {
+        cmd, ok := commandedSpeeds[d.IP]
+        if !ok {
+            continue
+        }
+        entry := watched{ID: d.ID, IP: d.IP, Group: d.Group, CommandedHz: cmd.Hz, CommandedAt: cmd.At}
+        if drift := setpointDrifts[d.IP]; drift != nil {
+            copied := *drift
+            entry.Drift = &copied
+        }
+        list = append(list, entry)
+    }
+    setpointMu.Unlock()
+    json.NewEncoder(w).Encode(map[string]interface{}{"enabled": appConfig.SetpointWatchdog != nil, "drives": list})
+}
+
+// =====================
+// Airflow Reservations
+// =====================
+// An external optimizer (e.g. the greenhouse heat-reuse controller) can reserve a minimum
+// exhaust airflow per group. While a reservation is active, control actions that would take
+// the group's planned airflow below it are refused, on every path that goes through
+// executeControl, and curtailment leaves enough drives running to cover it. Planned airflow
+// is each running drive's setpoint converted with RpmHz and CfmRpm, so it doesn't depend on
+// the drives having reached speed. Reservations expire after their TTL so a silent optimizer
+// can't pin the fans; the optimizer is expected to refresh them. GET /api/airflow-reservations
+// reports each group's planned airflow and headroom for the optimizer to plan against.
+const (
+    airflowReservationsFilePath = "/etc/vfd/airflow_reservations.json"
+    defaultReservationTTL       = 15 * time.Minute
+    maxReservationTTL           = 24 * time.Hour
+)
+
+type AirflowReservation struct {
+    Group     string    `json:"group"`
+    MinCfm    float64   `json:"minCfm"`
+    Source    string    `json:"source,omitempty"` // who holds it, e.g. "greenhouse"
+    Reason    string    `json:"reason,omitempty"`
+    SetAt     time.Time `json:"setAt"`
+    ExpiresAt time.Time `json:"expiresAt"`
+}
+
+var (
+    reservationsMu      sync.Mutex
+    airflowReservations = make(map[string]AirflowReservation) // by group
+)
+
+// activeReservations returns the unexpired reservations by group
+func activeReservations(now time.Time) map[string]AirflowReservation {
+    reservationsMu.Lock()
+    defer reservationsMu.Unlock()
+    out := make(map[string]AirflowReservation, len(airflowReservations))
+    for g, r := range airflowReservations {
+        if now.Before(r.ExpiresAt) {
+            out[g] = r
+        }
+    }
+    return out
+}
+
+// driveCfmAt converts a drive's speed to airflow
+func driveCfmAt(d DriveConfig, hz float64) float64 {
+    return hz * d.RpmToHz * d.CfmRpm
+}
+
+// liveDrives indexes vfdData by IP
+func liveDrives() map[string]map[string]interface{} {
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+    live := make(map[string]map[string]interface{}, len(vfdData))
+    for _, entry := range vfdData {
+        if ip, ok := entry["ip"].(string); ok {
+            live[ip] = entry
+        }
+    }
+    return live
+}
+
+// driveAirflow is a drive's planned airflow: its setpoint if running, otherwise 0
+func driveAirflow(d DriveConfig, entry map[string]interface{}) float64 {
+    if entry == nil || entry["status"] != "Running" {
+        return 0
+    }
+    return driveCfmAt(d, safeFloat(entry["setSpeed"]))
+}
+
+// plannedGroupAirflow sums planned airflow per group, before and after an action on ips.
+// Drives the action would skip (Unavailable, NotReady) keep their airflow.
+func plannedGroupAirflow(drives []DriveConfig, live map[string]map[string]interface{}, action string, speed float64, ips []string) (before, after map[string]float64) {
+    before, after = make(map[string]float64), make(map[string]float64)
+    targets := make(map[string]bool, len(ips))
+    for _, ip := range ips {
+        targets[ip] = true
+    }
+    for i := range drives {
+        d := drives[i]
+        entry := live[d.IP]
+        cur := driveAirflow(d, entry)
+        next := cur
+        status, _ := entry["status"].(string)
+        if targets[d.IP] && status != "Unavailable" && status != "NotReady" {
+            switch action {
+            case "Stop", "Freespin", "Reverse":
+                next = 0
+            case "SetSpeed":
+                hz, _ := clampSpeed(&d, speed)
+                next = driveCfmAt(d, hz)
+            case "Start":
+                next = driveCfmAt(d, safeFloat(entry["setSpeed"]))
+            }
+        }
+        before[d.Group] += cur
+        after[d.Group] += next
+    }
+    return before, after
+}
+
+// reservationConflicts explains each reservation an action would break. An action that
+// leaves a group's airflow where it was or raises it is never refused, so a group already
+// short of its reservation can still be brought up.
+func reservationConflicts(reservations map[string]AirflowReservation, before, after map[string]float64) []string {
+    var out []string
+    for group, r := range reservations {
+        if after[group] < r.MinCfm && after[group] < before[group] {
+            out = append(out, fmt.Sprintf("group %s would drop to %.0f CFM, below the %.0f CFM reserved by %s", group, after[group], r.MinCfm, reservationHolder(r)))
+        }
+    }
+    sort.Strings(out)
+    return out
+}
+
+func reservationHolder(r AirflowReservation) string {
+    if r.Source == "" {
+        return "an external optimizer"
+    }
+    return r.Source
+}
+
+// airflowConflicts checks a control action against the active reservations
+func airflowConflicts(action string, speed float64, ips []string) []string {
+    reservations := activeReservations(time.Now())
+    if len(reservations) == 0 || (action != "Stop" && action != "Freespin" && action != "SetSpeed" && action != "Reverse") {
+        return nil
+    }
+    before, after := plannedGroupAirflow(configuredDrives(), liveDrives(), action, speed, ips)
+    return reservationConflicts(reservations, before, after)
+}
+
+// reservedDrives picks the running drives curtailment must leave alone: per reserved group,
+// the highest-airflow drives until the reservation is covered
+func reservedDrives(drives []DriveConfig, live map[string]map[string]interface{}, reservations map[string]AirflowReservation) map[string]bool {
+    keep := make(map[string]bool)
+    byGroup := make(map[string][]DriveConfig)
+    for _, d := range drives {
+        if _, ok := reservations[d.Group]; ok && driveAirflow(d, live[d.IP]) > 0 {
+            byGroup[d.Group] = append(byGroup[d.Group], d)
+        }
+    }
+    for group, list := range byGroup {
+        sort.SliceStable(list, func(i, j int) bool {
+            return driveAirflow(list[i], live[list[i].IP]) > driveAirflow(list[j], live[list[j].IP])
+        })
+        var sum float64
+        for _, d := range list {
+            if sum >= reservations[group].MinCfm {
+                break
+            }
+            keep[d.IP] = true
+            sum += driveAirflow(d, live[d.IP])
+        }
+    }
+    return keep
+}
+
+func loadAirflowReservations(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    loaded := make(map[string]AirflowReservation)
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("[AIRFLOW] %s: %v", filePath, err)
+        return
+    }
+    reservationsMu.Lock()
+    airflowReservations = loaded
+    reservationsMu.Unlock()
+}
+
+func saveAirflowReservations(filePath string) error {
+    reservationsMu.Lock()
+    data, err := json.MarshalIndent(airflowReservations, "", "    ")
+    reservationsMu.Unlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// handleAirflowReservations serves GET /api/airflow-reservations (each group's planned
+// and reserved airflow), POST /api/airflow-reservations/<group> {"minCfm", "ttlMinutes",
+// "source", "reason"} to set or refresh a reservation, and DELETE to release it
+func handleAirflowReservations(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    group := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/airflow-reservations"), "/")
+    if r.Method == http.MethodGet && group == "" {
+        type groupAirflow struct {
+            Group       string              `json:"group"`
+            PlannedCfm  float64             `json:"plannedCfm"`
+            ActualCfm   float64             `json:"actualCfm"`
+            Reservation *AirflowReservation `json:"reservation,omitempty"`
+            HeadroomCfm *float64            `json:"headroomCfm,omitempty"` // planned minus reserved
+        }
+        drives := configuredDrives()
+        live := liveDrives()
+        planned, _ := plannedGroupAirflow(drives, live, "", 0, nil)
+        reservations := activeReservations(time.Now())
+        byGroup := make(map[string]*groupAirflow)
+        var list []*groupAirflow
+        for _, d := range drives {
+            g := byGroup[d.Group]
+            if g == nil {
+                g = &groupAirflow{Group: d.Group, PlannedCfm: math.Round(planned[d.Group])}
+                if res, ok := reservations[d.Group]; ok {
+                    headroom := math.Round(planned[d.Group] - res.MinCfm)
+                    g.Reservation, g.HeadroomCfm = &res, &headroom
+                }
+                byGroup[d.Group] = g
+                list = append(list, g)
+            }
+            g.ActualCfm += safeFloat(live[d.IP]["actualCfm"])
+        }
+        sort.Slice(list, func(i, j int) bool { return list[i].Group < list[j].Group })
+        json.NewEncoder(w).Encode(list)
+        return
+    }
+    if group == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    if len(getDrivesForGroups([]string{group})) == 0 {
+        http.Error(w, "Unknown group: "+group, http.StatusNotFound)
+        return
+    }
+
+    now := time.Now()
+    var detail string
+    var res AirflowReservation
+    if r.Method == http.MethodDelete {
+        reservationsMu.Lock()
+        old, ok := airflowReservations[group]
+        delete(airflowReservations, group)
+        reservationsMu.Unlock()
+        if !ok {
+            http.Error(w, "No reservation for group "+group, http.StatusNotFound)
+            return
+        }
+        detail = fmt.Sprintf("Group %s: %.0f CFM reservation by %s released", group, old.MinCfm, reservationHolder(old))
+    } else {
+        var req struct {
+            MinCfm     float64 `json:"minCfm"`
+            TTLMinutes int     `json:"ttlMinutes"` // default 15, max 1440
+            Source     string  `json:"source"`
+            Reason     string  `json:"reason"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        ttl := time.Duration(req.TTLMinutes) * time.Minute
+        if ttl <= 0 {
+            ttl = defaultReservationTTL
+        }
+        if req.MinCfm <= 0 || ttl > maxReservationTTL {
+            http.Error(w, "minCfm must be positive and ttlMinutes at most 1440", http.StatusBadRequest)
+            return
+        }
+        res = AirflowReservation{Group: group, MinCfm: req.MinCfm, Source: req.Source, Reason: req.Reason, SetAt: now, ExpiresAt: now.Add(ttl)}
+        reservationsMu.Lock()
+        old, refreshed := airflowReservations[group]
+        airflowReservations[group] = res
+        reservationsMu.Unlock()
+        if refreshed && old.MinCfm == res.MinCfm && now.Before(old.ExpiresAt) {
+            // Optimizers refresh on a timer; only changes are worth an event
+            detail = ""
+        } else {
+            detail = fmt.Sprintf("Group %s: %.0f CFM reserved by %s until %s", group, res.MinCfm, reservationHolder(res), res.ExpiresAt.Format(time.RFC3339))
+            if res.Reason != "" {
+                detail += ": " + res.Reason
+            }
+        }
+    }
+    if err := saveAirflowReservations(airflowReservationsFilePath); err != nil {
+        http.Error(w, "Failed to save reservations: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if detail != "" {
+        log.Printf("[AIRFLOW] %s", detail)
+        recordControlEvent(ControlEvent{Timestamp: now, Action: "AirflowReservation", Drives: []DriveEventInfo{}, Detail: detail})
+    }
+    if r.Method == http.MethodDelete {
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    json.NewEncoder(w).Encode(res)
+}
+
+// =====================
+// Quiet Hours
+// =====================
+// QuietHours caps fan speed per group during configured windows, for noise ordinances.
+// The cap applies wherever a speed is written (checkSpeedWrite): manual control, schedules,
+// rotation, ramps, synchronized SetSpeed, NATS and KNX. Drives already above the cap when a
+// window opens are brought down to it by runQuietHours, which restores their speed when the
+// window closes if nobody has changed it meanwhile. The cap takes precedence over airflow
+// reservations. Running faster needs an override through POST /api/quiet-hours/override,
+// which names who and why, lasts a fixed time, and is recorded and notified.
+const (
+    defaultQuietOverride = time.Hour
+    maxQuietOverride     = 12 * time.Hour
+)
+
+var errQuietHours = errors.New("quiet hours")
+
+type QuietHoursConfig struct {
+    Name   string   `json:"Name,omitempty"`
+    Groups []string `json:"Groups,omitempty"` // empty: every group
+    Start  string   `json:"Start"`            // "22:00", server local time
+    End    string   `json:"End"`              // "07:00"; earlier than Start runs past midnight
+    Days   []string `json:"Days,omitempty"`   // "Mon".."Sun" the window starts on; empty: every day
+    MaxHz  float64  `json:"MaxHz"`
+}
+
+// QuietOverride lifts the quiet-hours cap for a group until Until
+type QuietOverride struct {
+    Group  string    `json:"group"`
+    User   string    `json:"user"`
+    Reason string    `json:"reason"`
+    At     time.Time `json:"at"`
+    Until  time.Time `json:"until"`
+}
+
+// quietCap is the cap in force for a group
+type quietCap struct {
+    MaxHz float64   `json:"maxHz"`
+    Rule  string    `json:"rule"`
+    Until time.Time `json:"until"`
+}
+
+var (
+    quietMu        sync.Mutex
+    quietOverrides = make(map[string]QuietOverride) // by group
+    quietCapped    = make(map[string]float64)       // drive IP -> setpoint before runQuietHours capped it
+)
+
+// parseClock parses "HH:MM" into minutes after midnight
+func parseClock(s string) (int, error) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, fmt.Errorf("%q is not HH:MM", s)
+    }
+    return t.Hour()*60 + t.Minute(), nil
+}
+
+func validateQuietHours(list []QuietHoursConfig, drives []DriveConfig) error {
+    groups := make(map[string]bool)
+    for _, d := range drives {
+        groups[d.Group] = true
+    }
+    for i, q := range list {
+        name := q.Name
+        if name == "" {
+            name = fmt.Sprintf("#%d", i+1)
+        }
+        start, err := parseClock(q.Start)
+        if err != nil {
+            return fmt.Errorf("QuietHours %s: Start %v", name, err)
+        }
+        end, err := parseClock(q.End)
+        if err != nil {
+            return fmt.Errorf("QuietHours %s: End %v", name, err)
+        }
+        if start == end {
+            return fmt.Errorf("QuietHours %s: Start and End are the same", name)
+        }
+        if q.MaxHz <= 0 {
+            return fmt.Errorf("QuietHours %s: MaxHz must be positive", name)
+        }
+        for _, g := range q.Groups {
+            if !groups[g] {
+                return fmt.Errorf("QuietHours %s: group %q has no drives", name, g)
+            }
+        }
+        for _, day := range q.Days {
+            if _, ok := weekdayNames[day]; !ok {
+                return fmt.Errorf("QuietHours %s: unknown day %q (use Mon..Sun)", name, day)
+            }
+        }
+    }
+    return nil
+}
+
+var weekdayNames = map[string]time.Weekday{"Sun": time.Sunday, "Mon": time.Monday, "Tue": time.Tuesday, "Wed": time.Wednesday, "Thu": time.Thursday, "Fri": time.Friday, "Sat": time.Saturday}
+
+// window returns the window containing now, if any
+func (q QuietHoursConfig) window(now time.Time) (from, until time.Time, ok bool) {
+    start, err1 := parseClock(q.Start)
+    end, err2 := parseClock(q.End)
+    if err1 != nil || err2 != nil {
+        return
+    }
+    midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+    // A window that runs past midnight may have started yesterday
+    for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+        from = day.Add(time.Duration(start) * time.Minute)
+        until = day.Add(time.Duration(end) * time.Minute)
+        if end < start {
+            until = until.AddDate(0, 0, 1)
+        }
+        if !now.Before(from) && now.Before(until) && q.onDay(from.Weekday()) {
+            return from, until, true
+        }
+    }
+    return time.Time{}, time.Time{}, false
+}
+
+func (q QuietHoursConfig) onDay(day time.Weekday) bool {
+    if len(q.Days) == 0 {
+        return true
+    }
+    for _, name := range q.Days {
+        if weekdayNames[name] == day {
+            return true
+        }
+    }
+    return false
+}
+
+// quietHoursCapAt returns the lowest cap of the windows covering a group at now,
+// ignoring overrides
+func quietHoursCapAt(list []QuietHoursConfig, group string, now time.Time) (quietCap, bool) {
+    var best quietCap
+    found := false
+    for i, q := range list {
+        if len(q.Groups) > 0 && !containsString(q.Groups, group) {
+            continue
+        }
+        if _, until, ok := q.window(now); ok && (!found || q.MaxHz < best.MaxHz) {
+            name := q.Name
+            if name == "" {
+                name = fmt.Sprintf("#%d", i+1)
+            }
+            best, found = quietCap{MaxHz: q.MaxHz, Rule: name, Until: until}, true
+        }
+    }
+    return best, found
+}
+
+// quietHoursCap returns the cap in force for a group, honouring overrides
+func quietHoursCap(group string, now time.Time) (quietCap, bool) {
+    quietMu.Lock()
+    o, overridden := quietOverrides[group]
+    quietMu.Unlock()
+    if overridden && now.Before(o.Until) {
+        return quietCap{}, false
+    }
+    configMu.RLock()
+    list := appConfig.QuietHours
+    configMu.RUnlock()
+    return quietHoursCapAt(list, group, now)
+}
+
+// checkSpeedWrite is checkSpeedLimits plus the quiet-hours cap, which depends on the time
+// of day; it guards actual writes, while config validation uses checkSpeedLimits alone
+func checkSpeedWrite(d *DriveConfig, speed float64, ack bool) (string, error) {
+    warning, err := checkSpeedLimits(d, speed, ack)
+    if err != nil || d == nil {
+        return warning, err
+    }
+    if c, ok := quietHoursCap(d.Group, time.Now()); ok && speed > c.MaxHz {
+        return "", fmt.Errorf("%w: speed %.1f Hz exceeds the %.1f Hz cap for group %s (%s) until %s; an override is needed", errQuietHours, speed, c.MaxHz, d.Group, c.Rule, c.Until.Format("15:04"))
+    }
+    return warning, nil
+}
+
+// runQuietHours brings running drives down to the cap when a window opens and restores
+// them when it closes
+func runQuietHours() {
+    ticker := time.NewTicker(30 * time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        enforceQuietHours(time.Now())
+    }
+}
+
+func enforceQuietHours(now time.Time) {
+    configMu.RLock()
+    list := appConfig.QuietHours
+    configMu.RUnlock()
+    live := liveDrives()
+    for _, d := range configuredDrives() {
+        entry := live[d.IP]
+        running := entry != nil && entry["status"] == "Running" && driveDirection(d.IP) != "reverse" // leave smoke purge alone
+        setSpeed := safeFloat(entry["setSpeed"])
+        c, capped := quietHoursCap(d.Group, now)
+        _, inWindow := quietHoursCapAt(list, d.Group, now) // regardless of overrides
+        quietMu.Lock()
+        prev, wasCapped := quietCapped[d.IP]
+        if wasCapped && !inWindow {
+            delete(quietCapped, d.IP)
+        }
+        quietMu.Unlock()
+        switch {
+        case running && capped && setSpeed > c.MaxHz+0.05:
+            if err := setFanSpeed(d.IP, c.MaxHz, true); err != nil {
+                log.Printf("[QUIET] %s: capping %.1f Hz to %.1f Hz failed: %v", d.IP, setSpeed, c.MaxHz, err)
+                continue
+            }
+            if !wasCapped {
+                prev = setSpeed
+            }
+            quietMu.Lock()
+            quietCapped[d.IP] = prev
+            quietMu.Unlock()
+            detail := fmt.Sprintf("%s capped from %.1f Hz to %.1f Hz for quiet hours (%s) until %s", d.IP, setSpeed, c.MaxHz, c.Rule, c.Until.Format("15:04"))
+            log.Printf("[QUIET] %s", detail)
+            recordControlEvent(ControlEvent{Timestamp: now, Action: "QuietHoursCap", Speed: c.MaxHz, Drives: []DriveEventInfo{{ID: d.ID, IP: d.IP, Success: true}}, Detail: detail})
+        case running && wasCapped && !inWindow:
+            // Restore only if the cap is still what's set; anything else was someone's choice
+            if math.Abs(setSpeed-quietCappedTo(list, d, now)) > 0.05 {
+                continue
+            }
+            if err := setFanSpeed(d.IP, prev, true); err != nil {
+                log.Printf("[QUIET] %s: restoring %.1f Hz failed: %v", d.IP, prev, err)
+                continue
+            }
+            detail := fmt.Sprintf("%s restored to %.1f Hz after quiet hours", d.IP, prev)
+            log.Printf("[QUIET] %s", detail)
+            recordControlEvent(ControlEvent{Timestamp: now, Action: "QuietHoursRestore", Speed: prev, Drives: []DriveEventInfo{{ID: d.ID, IP: d.IP, Success: true}}, Detail: detail})
+        }
+    }
+}
+
+// quietCappedTo is the cap a drive was last held at: the window that just closed, found by
+// looking back one tick
+func quietCappedTo(list []QuietHoursConfig, d DriveConfig, now time.Time) float64 {
+    c, _ := quietHoursCapAt(list, d.Group, now.Add(-time.Minute))
+    return c.MaxHz
+}
+
+// handleQuietHours serves GET /api/quiet-hours (windows, caps in force and overrides),
+// POST /api/quiet-hours/override {"groups", "minutes", "user", "reason"} and
+// DELETE /api/quiet-hours/override/<group> to end an override early
+func handleQuietHours(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/quiet-hours"), "/")
+    now := time.Now()
+    if r.Method == http.MethodGet && rest == "" {
+        caps := make(map[string]quietCap)
+        seen := make(map[string]bool)
+        for _, d := range configuredDrives() {
+            if seen[d.Group] {
+                continue
+            }
+            seen[d.Group] = true
+            if c, ok := quietHoursCap(d.Group, now); ok {
+                caps[d.Group] = c
+            }
+        }
+        overrides := []QuietOverride{}
+        quietMu.Lock()
+        for _, o := range quietOverrides {
+            if now.Before(o.Until) {
+                overrides = append(overrides, o)
+            }
+        }
+        quietMu.Unlock()
+        sort.Slice(overrides, func(i, j int) bool { return overrides[i].Group < overrides[j].Group })
+        configMu.RLock()
+        windows := appConfig.QuietHours
+        configMu.RUnlock()
+        json.NewEncoder(w).Encode(map[string]interface{}{"windows": windows, "caps": caps, "overrides": overrides})
+        return
+    }
+    group, isOverride := strings.CutPrefix(rest, "override")
+    group = strings.Trim(group, "/")
+    if !isOverride || !((r.Method == http.MethodPost && group == "") || (r.Method == http.MethodDelete && group != "")) {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+
+    if r.Method == http.MethodDelete {
+        quietMu.Lock()
+        o, ok := quietOverrides[group]
+        delete(quietOverrides, group)
+        quietMu.Unlock()
+        if !ok || !now.Before(o.Until) {
+            http.Error(w, "No quiet-hours override for group "+group, http.StatusNotFound)
+            return
+        }
+        detail := fmt.Sprintf("Quiet-hours override for group %s by %s ended early", group, o.User)
+        log.Printf("[QUIET] %s", detail)
+        recordControlEvent(ControlEvent{Timestamp: now, Action: "QuietHoursOverrideEnd", Drives: []DriveEventInfo{}, Detail: detail})
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+
+    var req struct {
+        Groups  []string `json:"groups"`
+        Minutes int      `json:"minutes"` // default 60, max 720
+        User    string   `json:"user"`
+        Reason  string   `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    d := time.Duration(req.Minutes) * time.Minute
+    if d <= 0 {
+        d = defaultQuietOverride
+    }
+    switch {
+    case len(req.Groups) == 0:
+        http.Error(w, "groups is required", http.StatusBadRequest)
+        return
+    case strings.TrimSpace(req.User) == "" || strings.TrimSpace(req.Reason) == "":
+        http.Error(w, "user and reason are required", http.StatusBadRequest)
+        return
+    case d > maxQuietOverride:
+        http.Error(w, "minutes must be at most 720", http.StatusBadRequest)
+        return
+    }
+    for _, g := range req.Groups {
+        if len(getDrivesForGroups([]string{g})) == 0 {
+            http.Error(w, "Unknown group: "+g, http.StatusNotFound)
+            return
+        }
+    }
+    list := make([]QuietOverride, 0, len(req.Groups))
+    quietMu.Lock()
+    for _, g := range req.Groups {
+        o := QuietOverride{Group: g, User: req.User, Reason: req.Reason, At: now, Until: now.Add(d)}
+        quietOverrides[g] = o
+        list = append(list, o)
+    }
+    quietMu.Unlock()
+
+    detail := fmt.Sprintf("Quiet hours overridden for groups %s by %s until %s: %s", strings.Join(req.Groups, ", "), req.User, now.Add(d).Format(time.RFC3339), req.Reason)
+    log.Printf("[QUIET] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: now, Action: "QuietHoursOverride", Drives: []DriveEventInfo{}, Detail: detail})
+    notify(Notification{Severity: "warning", Kind: "QuietHoursOverride", Message: detail})
+    json.NewEncoder(w).Encode(list)
+}
+
+// =====================
+// Curtailment Functions
+// =====================
+
+// curtailFileMu serializes read-modify-write of the curtailments file, so sessions
+// saved at the same time don't drop each other
+var curtailFileMu sync.Mutex
+
+// loadCurtailments reads the curtailments in effect by session ID; none is an empty map.
+// A state file from before sessions is read as the session "curtailment".
+func loadCurtailments() (map[string]*CurtailmentState, error) {
+    sessions := make(map[string]*CurtailmentState)
+    data, err := os.ReadFile(curtailmentsFile)
+    if os.IsNotExist(err) {
+        data, err = os.ReadFile(curtailmentStateFile)
+        if os.IsNotExist(err) {
+            return sessions, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        var state CurtailmentState
+        if err := json.Unmarshal(data, &state); err != nil {
+            return nil, err
+        }
+        if state.ID == "" {
+            state.ID = legacyCurtailmentID
+        }
+        sessions[state.ID] = &state
+        return sessions, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &sessions); err != nil {
+        return nil, err
+    }
+    return sessions, nil
+}
+
+// writeCurtailments saves the sessions, removing the file when there are none, and the
+// pre-session state file once its curtailment is kept here
+func writeCurtailments(sessions map[string]*CurtailmentState) error {
+    if len(sessions) == 0 {
+        err := os.Remove(curtailmentsFile)
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    } else {
+        data, err := json.MarshalIndent(sessions, "", "  ")
+        if err != nil {
+            return err
+        }
+        if err := os.WriteFile(curtailmentsFile, data, 0644); err != nil {
+            return err
+        }
+    }
+    if err := os.Remove(curtailmentStateFile); err != nil && !os.IsNotExist(err) {
+        log.Printf("[CURTAIL] Warning: failed to remove %s: %v", curtailmentStateFile, err)
+    }
+    return nil
+}
+
+// loadCurtailmentState loads one session; a missing one is an os.ErrNotExist
+func loadCurtailmentState(id string) (*CurtailmentState, error) {
+    sessions, err := loadCurtailments()
+    if err != nil {
+        return nil, err
+    }
+    state, ok := sessions[id]
+    if !ok {
+        return nil, os.ErrNotExist
+    }
+    return state, nil
+}
+
+// saveCurtailmentState saves a session, adding it or replacing the saved one
+func saveCurtailmentState(state *CurtailmentState) error {
+    curtailFileMu.Lock()
+    defer curtailFileMu.Unlock()
+    sessions, err := loadCurtailments()
+    if err != nil {
+        return err
+    }
+    sessions[state.ID] = state
+    return writeCurtailments(sessions)
+}
+
+// clearCurtailmentState removes a session
+func clearCurtailmentState(id string) error {
+    curtailFileMu.Lock()
+    defer curtailFileMu.Unlock()
+    sessions, err := loadCurtailments()
+    if err != nil {
+        return err
+    }
+    delete(sessions, id)
+    return writeCurtailments(sessions)
+}
+
+// sortedCurtailments lists the sessions oldest first
+func sortedCurtailments(sessions map[string]*CurtailmentState) []*CurtailmentState {
+    list := make([]*CurtailmentState, 0, len(sessions))
+    for _, s := range sessions {
+        list = append(list, s)
+    }
+    sort.Slice(list, func(i, j int) bool {
+        if !list[i].Timestamp.Equal(list[j].Timestamp) {
+            return list[i].Timestamp.Before(list[j].Timestamp)
+        }
+        return list[i].ID < list[j].ID
+    })
+    return list
+}
+
+// curtailedBy maps each curtailed drive's IP to the session holding it
+func curtailedBy(sessions map[string]*CurtailmentState) map[string]string {
+    out := make(map[string]string)
+    for id, s := range sessions {
+        for _, d := range s.Drives {
+            out[d.IP] = id
+        }
+    }
+    return out
+}
+
+// resumeTarget picks the session a resume without an ID means: the only one in effect
+func resumeTarget(sessions map[string]*CurtailmentState, id string) (string, error) {
+    if id != "" {
+        if _, ok := sessions[id]; !ok {
+            return "", fmt.Errorf("no curtailment %q in effect", id)
+        }
+        return id, nil
+    }
+    switch len(sessions) {
+    case 0:
+        return "", fmt.Errorf("no curtailment state found to resume")
+    case 1:
+        for id := range sessions {
+            return id, nil
+        }
+    }
+    var ids []string
+    for _, s := range sortedCurtailments(sessions) {
+        ids = append(ids, s.ID)
+    }
+    return "", fmt.Errorf("%d curtailments are in effect (%s); give the id of the one to resume", len(ids), strings.Join(ids, ", "))
+}
+
+// validCurtailmentID checks a session ID given in a curtail request
+func validCurtailmentID(id string) error {
+    if len(id) > 64 || strings.ContainsAny(id, "/ \t\n") {
+        return fmt.Errorf("a curtailment id is at most 64 characters, without spaces or slashes")
+    }
+    if id == "history" || id == "sessions" {
+        return fmt.Errorf("a curtailment can't be called %s", id)
+    }
+    return nil
+}
+
+// getDrivesForGroups returns all drives matching the specified groups
+// If groups is empty, returns all drives
+func getDrivesForGroups(groups []string) []DriveConfig {
+    var drives []DriveConfig
+    if len(groups) == 0 {
+        // Return all drives
+        drives = configuredDrives()
+    } else {
+        // Return only drives in specified groups
+        for _, drive := range configuredDrives() {
+            for _, group := range groups {
+                if drive.Group == group {
+                    drives = append(drives, drive)
+                    break
+                }
+            }
+        }
+    }
+    return drives
+}
+
+// curtailSkips are the drives a curtailment left alone, by reason
+type curtailSkips struct {
+    Critical  []string // NeverCurtail
+    Reserved  []string // kept running for airflow reservations
+    Hand      []string // in hand
+    Elsewhere []string // held by another curtailment session
+}
+
+// events are the control event entries for the skipped drives
+func (s curtailSkips) events() []DriveEventInfo {
+    var infos []DriveEventInfo
+    for _, ip := range s.Critical {
+        infos = append(infos, DriveEventInfo{IP: ip, Success: true, Warning: "critical; never curtailed"})
+    }
+    for _, ip := range s.Reserved {
+        infos = append(infos, DriveEventInfo{IP: ip, Success: true, Warning: "kept running for airflow reservation"})
+    }
+    for _, ip := range s.Hand {
+        infos = append(infos, DriveEventInfo{IP: ip, Success: true, Warning: "in hand; left as the operator set it"})
+    }
+    for _, ip := range s.Elsewhere {
+        infos = append(infos, DriveEventInfo{IP: ip, Success: true, Warning: "held by another curtailment"})
+    }
+    return infos
+}
+
+// errCurtailmentExists is returned when a curtail request reuses the ID of a session in effect
+var errCurtailmentExists = errors.New("a curtailment with this id is already in effect")
+
+// curtailDrives starts the curtailment session id: it saves the current state and stops
+// selected drives, except those kept running for airflow reservations, those in hand and
+// those another session holds, which it returns. With a target, running drives are slowed
+// down instead (stopped ones are held stopped). A non-nil resumeAt schedules the resume.
+// With a rotation, only its first groups are curtailed. Returns the saved state.
+func curtailDrives(id, user string, groups []string, target *CurtailTarget, resumeAt *time.Time, rotation *CurtailRotation) (*CurtailmentState, curtailSkips, error) {
+    drives := getDrivesForGroups(groups)
+    if len(drives) == 0 {
+        return nil, curtailSkips{}, fmt.Errorf("no drives found for the specified groups")
+    }
+    if rotation != nil {
+        rotation.NextAt = time.Now().Add(time.Duration(rotation.EveryMin) * time.Minute)
+        drives = getDrivesForGroups(rotation.active(rotation.Index))
+    }
+
+    state := CurtailmentState{
+        ID:        id,
+        User:      user,
+        Timestamp: time.Now(),
+        Groups:    groups,
+        ResumeAt:  resumeAt,
+        Target:    target,
+        Rotation:  rotation,
+    }
+    // The ID check, the capture (which leaves out drives other sessions hold) and the insert
+    // share one critical section, so concurrent requests can't take the same ID or drive
+    curtailFileMu.Lock()
+    sessions, err := loadCurtailments()
+    if err != nil {
+        curtailFileMu.Unlock()
+        return nil, curtailSkips{}, fmt.Errorf("failed to load curtailment state: %w", err)
+    }
+    if _, ok := sessions[id]; ok {
+        curtailFileMu.Unlock()
+        return nil, curtailSkips{}, errCurtailmentExists
+    }
+    var skipped curtailSkips
+    state.Drives, skipped = captureCurtailment(id, drives, target)
+    if target != nil && target.KW > 0 {
+        state.Shed = &CurtailShed{TargetKW: target.KW, EstimatedKW: planShed(state.Drives, target.KW)}
+        log.Printf("[CURTAIL] Planned %.1f of %.1f kW shed", state.Shed.EstimatedKW, target.KW)
+    }
+    sessions[id] = &state
+    err = writeCurtailments(sessions)
+    curtailFileMu.Unlock()
+    if err != nil {
+        return nil, curtailSkips{}, fmt.Errorf("failed to save curtailment state: %w", err)
+    }
+
+    log.Printf("[CURTAIL] Saving state for %d drives in groups %v as %s", len(state.Drives), groups, id)
+    if len(skipped.Critical) > 0 {
+        log.Printf("[CURTAIL] Leaving critical drives %v alone", skipped.Critical)
+    }
+    if len(skipped.Reserved) > 0 {
+        log.Printf("[CURTAIL] Leaving %v running for airflow reservations", skipped.Reserved)
+    }
+    if len(skipped.Hand) > 0 {
+        log.Printf("[CURTAIL] Leaving %v as the operator set them (in hand)", skipped.Hand)
+    }
+    if len(skipped.Elsewhere) > 0 {
+        log.Printf("[CURTAIL] Leaving %v to the other curtailments holding them", skipped.Elsewhere)
+    }
+
+    applyCurtailment(state.Drives, target)
+
+    if target != nil {
+        log.Printf("[CURTAIL] Curtailment complete, %d drives slowed down, state saved", len(state.Drives))
+        return &state, skipped, nil
+    }
+    log.Printf("[CURTAIL] Curtailment complete, %d drives stopped, state saved", len(state.Drives))
+    return &state, skipped, nil
+}
+
+// captureCurtailment records the current state of drives about to be curtailed by session
+// id, leaving out (and returning) critical drives, those kept running for airflow
+// reservations, those in hand and those another session holds
+func captureCurtailment(id string, drives []DriveConfig, target *CurtailTarget) ([]CurtailedDriveState, curtailSkips) {
+    keep := reservedDrives(configuredDrives(), liveDrives(), activeReservations(time.Now()))
+    var holders map[string]string
+    if sessions, err := loadCurtailments(); err == nil {
+        holders = curtailedBy(sessions)
+    }
+    var skipped curtailSkips
+    captured := make([]CurtailedDriveState, 0)
+
+    // Get current state from vfdData
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+    liveByIP := make(map[string]map[string]interface{}, len(vfdData))
+    for _, entry := range vfdData {
+        if ip, ok := entry["ip"].(string); ok {
+            liveByIP[ip] = entry
+        }
+    }
+    for _, drive := range drives {
+        if drive.NeverCurtail {
+            skipped.Critical = append(skipped.Critical, drive.IP)
+            continue
+        }
+        entry, ok := liveByIP[drive.IP]
+        if !ok {
+            continue
+        }
+        if holder, ok := holders[drive.IP]; ok && holder != id {
+            skipped.Elsewhere = append(skipped.Elsewhere, drive.IP)
+            continue
+        }
+        if keep[drive.IP] {
+            skipped.Reserved = append(skipped.Reserved, drive.IP)
+            continue
+        }
+        if sourceHold(sourceCurtailment, drive.IP, nil) != "" {
+            skipped.Hand = append(skipped.Hand, drive.IP)
+            continue
+        }
+        curtailedDrive := CurtailedDriveState{
+            IP:    drive.IP,
+            Group: drive.Group,
+            Since: time.Now(),
+        }
+        if setSpeed, ok := entry["setSpeed"].(float64); ok {
+            curtailedDrive.SetSpeed = setSpeed
+        }
+        if status, ok := entry["status"].(string); ok {
+            curtailedDrive.Status = status
+        }
+        if curtailedDrive.Status == "Running" {
+            d := drive
+            curtailedDrive.PowerKW = math.Round(drivePowerKW(entry, &d)*100) / 100
+        }
+        if target != nil && curtailedDrive.Status == "Running" {
+            d := drive
+            curtailedDrive.ReducedHz = target.reducedSpeed(&d, curtailedDrive.SetSpeed)
+        }
+        captured = append(captured, curtailedDrive)
+    }
+    return captured, skipped
+}
+
+// applyCurtailment stops the captured drives, or slows the running ones down to their
+// ReducedHz
+func applyCurtailment(drives []CurtailedDriveState, target *CurtailTarget) {
+    var wg sync.WaitGroup
+    for _, drive := range drives {
+        if target != nil && (drive.ReducedHz == 0 || drive.ReducedHz >= drive.SetSpeed) {
+            continue
+        }
+        wg.Add(1)
+        go func(drive CurtailedDriveState) {
+            defer wg.Done()
+            if target != nil {
+                cancelRamp(drive.IP, "Curtail")
+                if err := writeSpeedStep(drive.IP, drive.ReducedHz); err != nil {
+                    log.Printf("[CURTAIL] Warning: Failed to slow drive %s to %.1f Hz: %v", drive.IP, drive.ReducedHz, err)
+                }
+                return
+            }
+            err := fanStop(drive.IP)
+            if err != nil {
+                log.Printf("[CURTAIL] Warning: Failed to stop drive %s: %v", drive.IP, err)
+            }
+        }(drive)
+    }
+    wg.Wait()
+}
+
+// resumeDrives restores the drives of curtailment session id to their previous state and
+// files the session in the history as ended by endedBy
+func resumeDrives(id, endedBy string) error {
+    state, err := loadCurtailmentState(id)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return fmt.Errorf("no curtailment state found to resume")
+        }
+        return fmt.Errorf("failed to load curtailment state: %w", err)
+    }
+
+    log.Printf("[RESUME] Loading curtailment %s from %s", id, state.Timestamp.Format(time.RFC3339))
+    log.Printf("[RESUME] Restoring %d drives to previous state", len(state.Drives))
+    restoreCurtailed(state.Drives, state.Target)
+    fileCurtailment(state, endedBy, time.Now())
+
+    err = clearCurtailmentState(id)
+    if err != nil {
+        log.Printf("[RESUME] Warning: Failed to clear curtailment %s: %v", id, err)
+    }
+
+    log.Printf("[RESUME] Resume complete, state cleared")
+    return nil
+}
+
+// planShed sets ReducedHz on the running drives to shed about kW between them, slowing
+// each to the same fraction of its speed but never below its MinHz. Fan power goes with
+// the cube of speed, so a drive drawing P kW at f Hz sheds P·(1 − (f'/f)³) at f'. Returns
+// the estimated shed, which falls short of kW when every drive is at its MinHz.
+func planShed(drives []CurtailedDriveState, kw float64) float64 {
+    floors := make(map[string]float64, len(drives))
+    for _, d := range configuredDrives() {
+        dc := d
+        floors[d.IP], _ = speedRange(&dc)
+    }
+    speedAt := func(d CurtailedDriveState, ratio float64) float64 {
+        return math.Min(math.Max(math.Floor(d.SetSpeed*ratio*10)/10, floors[d.IP]), d.SetSpeed)
+    }
+    shedAt := func(ratio float64) float64 {
+        shed := 0.0
+        for _, d := range drives {
+            if d.Status == "Running" && d.SetSpeed > 0 {
+                shed += d.PowerKW * (1 - math.Pow(speedAt(d, ratio)/d.SetSpeed, 3))
+            }
+        }
+        return shed
+    }
+    // Shed falls as the ratio rises: find the highest ratio that still sheds kW
+    lo, hi := 0.0, 1.0
+    for i := 0; i < 40; i++ {
+        mid := (lo + hi) / 2
+        if shedAt(mid) >= kw {
+            lo = mid
+        } else {
+            hi = mid
+        }
+    }
+    for i, d := range drives {
+        if d.Status == "Running" && d.SetSpeed > 0 {
+            drives[i].ReducedHz = speedAt(d, lo)
+        }
+    }
+    return math.Round(shedAt(lo)*100) / 100
+}
+
+// measuredShed is how far the curtailed drives' power has fallen since they were curtailed
+func measuredShed(state *CurtailmentState) float64 {
+    live := liveDrives()
+    shed := 0.0
+    for _, c := range state.Drives {
+        entry, ok := live[c.IP]
+        if !ok || c.PowerKW == 0 {
+            continue
+        }
+        d, _ := driveConfig(c.IP)
+        shed += c.PowerKW - drivePowerKW(entry, d)
+    }
+    return math.Round(shed*100) / 100
+}
+
+// restoreCurtailed puts curtailed drives back as they were
+func restoreCurtailed(drives []CurtailedDriveState, target *CurtailTarget) {
+    // Curtailed drives are stopped, so restarts are staggered
+    var restart []string
+    for _, d := range drives {
+        if d.Status == "Running" || d.Status == "Enabled" {
+            restart = append(restart, d.IP)
+        }
+    }
+    offsets, _, _ := staggerSchedule(restart, func(string) bool { return false })
+    if target != nil {
+        offsets = nil // still running, nothing to stagger
+    }
+    var wg sync.WaitGroup
+    for _, drive := range drives {
+        wg.Add(1)
+        go func(d CurtailedDriveState) {
+            defer wg.Done()
+            if sourceHold(sourceCurtailment, d.IP, nil) != "" {
+                log.Printf("[RESUME] Drive %s was put in hand while curtailed, leaving as the operator set it", d.IP)
+                return
+            }
+            if d.Status == "Running" || d.Status == "Enabled" {
+                time.Sleep(offsets[d.IP])
+                // Restore speed and start the drive
+                // Restoring a speed that was already in effect counts as acknowledged
+                err := setFanSpeed(d.IP, d.SetSpeed, true)
+                if err != nil {
+                    log.Printf("[RESUME] Warning: Failed to restore drive %s: %v", d.IP, err)
+                    return
+                }
+                log.Printf("[RESUME] Restored drive %s to %.1f Hz", d.IP, d.SetSpeed)
+            } else {
+                log.Printf("[RESUME] Drive %s was stopped, leaving stopped", d.IP)
+            }
+        }(drive)
+    }
+    wg.Wait()
+}
+
+// curtailResumeMu keeps a scheduled resume and a requested one from running together
+var curtailResumeMu sync.Mutex
+
+// resumeEvent is the control event for resuming a curtailment
+func resumeEvent(state *CurtailmentState, action, detail string) ControlEvent {
+    event := ControlEvent{
+        Timestamp: time.Now(),
+        Action:    action,
+        Speed:     0,
+        Drives:    make([]DriveEventInfo, 0),
+        Detail:    detail,
+    }
+    for _, drive := range state.Drives {
+        info := DriveEventInfo{
+            IP:      drive.IP,
+            Success: true,
+        }
+        if sourceHold(sourceCurtailment, drive.IP, nil) != "" {
+            info.Warning = "in hand; left as the operator set it"
+        }
+        event.Drives = append(event.Drives, info)
+    }
+    return event
+}
+
+// runCurtailmentTimers resumes a curtailment whose window has ended and moves a rolling
+// curtailment on to its next groups. The checks read the saved state, so a window that
+// ended or a turn that came while the server was down is handled on startup.
+func runCurtailmentTimers() {
+    ticker := time.NewTicker(15 * time.Second)
+    defer ticker.Stop()
+    for {
+        checkCurtailmentResume(time.Now())
+        checkCurtailmentRotation(time.Now())
+        <-ticker.C
+    }
+}
+
+func checkCurtailmentResume(now time.Time) {
+    curtailResumeMu.Lock()
+    defer curtailResumeMu.Unlock()
+    sessions, err := loadCurtailments()
+    if err != nil {
+        return
+    }
+    for _, state := range sortedCurtailments(sessions) {
+        if state.ResumeAt == nil || now.Before(*state.ResumeAt) {
+            continue
+        }
+        log.Printf("[RESUME] Curtailment %s window ended at %s, resuming", state.ID, state.ResumeAt.Format(time.RFC3339))
+        if err := resumeDrives(state.ID, "ScheduledResume"); err != nil {
+            log.Printf("[RESUME] Error: %v", err)
+            continue
+        }
+        recordControlEvent(resumeEvent(state, "ScheduledResume", state.ID+": curtailment window ended at "+state.ResumeAt.Format(time.RFC3339)))
+    }
+}
+
+// checkCurtailmentRotation hands a rolling curtailment on to the next groups once their
+// turn comes. Groups that stay curtailed keep their saved state. The next groups are
+// curtailed before the previous ones are restored, so the load doesn't rise while they swap.
+func checkCurtailmentRotation(now time.Time) {
+    curtailResumeMu.Lock()
+    defer curtailResumeMu.Unlock()
+    sessions, err := loadCurtailments()
+    if err != nil {
+        return
+    }
+    for _, state := range sortedCurtailments(sessions) {
+        if state.Rotation == nil || now.Before(state.Rotation.NextAt) {
+            continue
+        }
+        if state.ResumeAt != nil && !now.Before(*state.ResumeAt) {
+            continue // over: checkCurtailmentResume restores every group
+        }
+        rotateCurtailment(state, now)
+    }
+}
+
+// rotateCurtailment moves a rolling session on to its next groups
+func rotateCurtailment(state *CurtailmentState, now time.Time) {
+    rot := state.Rotation
+    previous := rot.active(rot.Index)
+    rot.Index = (rot.Index + rot.Count) % len(rot.Groups)
+    next := rot.active(rot.Index)
+    rot.NextAt = now.Add(time.Duration(rot.EveryMin) * time.Minute)
+
+    staying, leaving := splitCurtailed(state.Drives, next)
+    var entering []DriveConfig
+    for _, d := range getDrivesForGroups(next) {
+        if !containsString(previous, d.Group) {
+            entering = append(entering, d)
+        }
+    }
+    captured, skipped := captureCurtailment(state.ID, entering, state.Target)
+    state.Drives = append(staying, captured...)
+    for _, d := range leaving {
+        until := now
+        d.Until = &until
+        state.Past = append(state.Past, d)
+    }
+    if err := saveCurtailmentState(state); err != nil {
+        log.Printf("[CURTAIL] Rotation: failed to save curtailment state: %v", err)
+        return
+    }
+    log.Printf("[CURTAIL] Rotating curtailment %s from %v to %v", state.ID, previous, next)
+    applyCurtailment(captured, state.Target)
+    restoreCurtailed(leaving, state.Target)
+
+    event := ControlEvent{
+        Timestamp: now,
+        Action:    "CurtailRotate",
+        Drives:    make([]DriveEventInfo, 0),
+        Detail:    fmt.Sprintf("%s: curtailed %s, restored %s; next turn at %s", state.ID, strings.Join(next, ","), strings.Join(previous, ","), rot.NextAt.Format(time.RFC3339)),
+    }
+    for _, d := range captured {
+        event.Drives = append(event.Drives, DriveEventInfo{IP: d.IP, Success: true})
+    }
+    for _, d := range leaving {
+        info := DriveEventInfo{IP: d.IP, Success: true}
+        if sourceHold(sourceCurtailment, d.IP, nil) != "" {
+            info.Warning = "in hand; left as the operator set it"
+        }
+        event.Drives = append(event.Drives, info)
+    }
+    event.Drives = append(event.Drives, skipped.events()...)
+    recordControlEvent(event)
+}
+
+// splitCurtailed separates curtailed drives in groups, which stay curtailed, from the rest
+func splitCurtailed(drives []CurtailedDriveState, groups []string) (staying, leaving []CurtailedDriveState) {
+    for _, d := range drives {
+        if containsString(groups, d.Group) {
+            staying = append(staying, d)
+        } else {
+            leaving = append(leaving, d)
+        }
+    }
+    return staying, leaving
+}
+
+// =====================
+// Curtailment History
+// =====================
+// Each curtailment session is filed when it is resumed, by hand, on schedule or at the end
+// of a demand-response event: who started it, its groups and target, how long it lasted,
+// and each drive's speed before and during it. The shed is an estimate from the power each
+// drive drew when curtailed: all of it for a stopped drive, and P·(1 − (f'/f)³) for one
+// slowed from f to f'. Times each drive's own time curtailed (turns, for a rolling
+// curtailment), that gives the energy saved. GET /api/curtail/history lists the records,
+// newest first, with the sessions still in effect.
+const (
+    curtailHistoryFilePath = "/etc/vfd/curtailment_history.json"
+    maxCurtailHistory      = 500
+)
+
+// CurtailHistoryDrive is one drive's part in a curtailment
+type CurtailHistoryDrive struct {
+    IP             string     `json:"ip"`
+    ID             string     `json:"id,omitempty"`
+    Group          string     `json:"group"`
+    Status         string     `json:"status"`   // before the curtailment
+    BeforeHz       float64    `json:"beforeHz"` // setpoint before
+    AfterHz        float64    `json:"afterHz"`  // during; 0 = stopped
+    PowerKW        float64    `json:"powerKW"`  // drawn when curtailed
+    ShedKW         float64    `json:"shedKW"`   // estimated
+    Since          time.Time  `json:"since"`
+    Until          time.Time  `json:"until"`
+    EnergySavedKWh float64    `json:"energySavedKWh"`
+}
+
+// CurtailRecord is a curtailment session's entry in the history
+type CurtailRecord struct {
+    ID             string                `json:"id"`
+    User           string                `json:"user,omitempty"`
+    Groups         []string              `json:"groups"`
+    Target         *CurtailTarget        `json:"target,omitempty"`
+    Rolling        bool                  `json:"rolling,omitempty"`
+    StartedAt      time.Time             `json:"startedAt"`
+    EndedAt        *time.Time            `json:"endedAt,omitempty"` // nil while in effect
+    EndedBy        string                `json:"endedBy,omitempty"` // Resume, ScheduledResume or DREnd
+    DurationSec    float64               `json:"durationSec"`
+    ShedKW         float64               `json:"shedKW"` // estimated, of the drives curtailed at the end
+    EnergySavedKWh float64               `json:"energySavedKWh"`
+    Drives         []CurtailHistoryDrive `json:"drives"`
+}
+
+var (
+    curtailHistoryMu sync.Mutex
+    curtailHistory   []CurtailRecord // oldest first
+)
+
+// curtailRecord builds the history entry for a session, as of end
+func curtailRecord(state *CurtailmentState, end time.Time) CurtailRecord {
+    rec := CurtailRecord{
+        ID:          state.ID,
+        User:        state.User,
+        Groups:      state.Groups,
+        Target:      state.Target,
+        Rolling:     state.Rotation != nil,
+        StartedAt:   state.Timestamp,
+        DurationSec: math.Round(end.Sub(state.Timestamp).Seconds()),
+        Drives:      []CurtailHistoryDrive{},
+    }
+    if rec.Groups == nil {
+        rec.Groups = []string{}
+    }
+    add := func(d CurtailedDriveState, current bool) {
+        h := CurtailHistoryDrive{IP: d.IP, ID: driveIDFor(d.IP), Group: d.Group, Status: d.Status, BeforeHz: d.SetSpeed, AfterHz: d.ReducedHz, PowerKW: d.PowerKW, Since: d.Since, Until: end}
+        if h.Since.IsZero() {
+            h.Since = state.Timestamp // saved before drives had their own time
+        }
+        if d.Until != nil {
+            h.Until = *d.Until
+        }
+        if d.Status == "Running" {
+            h.ShedKW = d.PowerKW
+            if d.ReducedHz > 0 && d.SetSpeed > 0 {
+                h.ShedKW = d.PowerKW * (1 - math.Pow(math.Min(d.ReducedHz/d.SetSpeed, 1), 3))
+            }
+        }
+        h.ShedKW = math.Round(h.ShedKW*100) / 100
+        h.EnergySavedKWh = math.Round(h.ShedKW*h.Until.Sub(h.Since).Hours()*100) / 100
+        rec.EnergySavedKWh += h.EnergySavedKWh
+        if current {
+            rec.ShedKW += h.ShedKW
+        }
+        rec.Drives = append(rec.Drives, h)
+    }
+    for _, d := range state.Past {
+        add(d, false)
+    }
+    for _, d := range state.Drives {
+        add(d, true)
+    }
+    rec.ShedKW = math.Round(rec.ShedKW*100) / 100
+    rec.EnergySavedKWh = math.Round(rec.EnergySavedKWh*100) / 100
+    return rec
+}
+
+// fileCurtailment adds a resumed session to the history
+func fileCurtailment(state *CurtailmentState, endedBy string, end time.Time) {
+    rec := curtailRecord(state, end)
+    rec.EndedAt, rec.EndedBy = &end, endedBy
+    curtailHistoryMu.Lock()
+    defer curtailHistoryMu.Unlock()
+    curtailHistory = append(curtailHistory, rec)
+    if len(curtailHistory) > maxCurtailHistory {
+        curtailHistory = curtailHistory[len(curtailHistory)-maxCurtailHistory:]
+    }
+    if err := saveCurtailHistoryLocked(curtailHistoryFilePath); err != nil {
+        log.Printf("[CURTAIL] Failed to save %s: %v", curtailHistoryFilePath, err)
+    }
+}
+
+// saveCurtailHistoryLocked replaces the history file through a temporary file. The caller
+// holds curtailHistoryMu, so sessions ending together can't write an older list over a newer one.
+func saveCurtailHistoryLocked(filePath string) error {
+    data, err := json.MarshalIndent(curtailHistory, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+func loadCurtailHistory(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    var saved []CurtailRecord
+    if err := json.Unmarshal(data, &saved); err != nil {
+        log.Printf("[CURTAIL] %s: %v", filePath, err)
+        return
+    }
+    curtailHistoryMu.Lock()
+    curtailHistory = saved
+    curtailHistoryMu.Unlock()
+}
+
+// curtailHistoryView lists the records that overlap since..until (zero = open) and
+// touch group ("" = any), newest first
+func curtailHistoryView(records []CurtailRecord, since, until time.Time, group string) []CurtailRecord {
+    out := []CurtailRecord{}
+    for i := len(records) - 1; i >= 0; i-- {
+        rec := records[i]
+        if !until.IsZero() && rec.StartedAt.After(until) {
+            continue
+        }
+        if !since.IsZero() && rec.EndedAt != nil && rec.EndedAt.Before(since) {
+            continue
+        }
+        if group != "" && len(rec.Groups) > 0 && !containsString(rec.Groups, group) {
+            continue
+        }
+        out = append(out, rec)
+    }
+    return out
+}
+
+// handleCurtailHistory serves GET /api/curtail/history[?since=&until=&group=]: the sessions
+// in effect, then the filed ones, newest first, with totals
+func handleCurtailHistory(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    var since, until time.Time
+    for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+        if v := r.URL.Query().Get(name); v != "" {
+            parsed, err := time.Parse(time.RFC3339, v)
+            if err != nil {
+                http.Error(w, name+" must be an RFC 3339 time", http.StatusBadRequest)
+                return
+            }
+            *t = parsed
+        }
+    }
+    now := time.Now()
+    records := []CurtailRecord{}
+    if sessions, err := loadCurtailments(); err == nil {
+        for _, state := range sortedCurtailments(sessions) {
+            records = append(records, curtailRecord(state, now))
+        }
+    }
+    curtailHistoryMu.Lock()
+    filed := append([]CurtailRecord(nil), curtailHistory...)
+    curtailHistoryMu.Unlock()
+    records = append(filed, records...)
+    view := curtailHistoryView(records, since, until, r.URL.Query().Get("group"))
+    var energy, seconds float64
+    for _, rec := range view {
+        energy += rec.EnergySavedKWh
+        seconds += rec.DurationSec
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "records":        view,
+        "count":          len(view),
+        "durationSec":    seconds,
+        "energySavedKWh": math.Round(energy*100) / 100,
+    })
+}
+
+// =====================
+// Demand Response
+// =====================
+// A demand-response event must bring the load down by a set amount before a deadline.
+// POST /api/dr {"action": "start", ...} takes the reduction (kW, or percent of the power
+// measured at the start) and the deadline (default DeadlineMin, 10 minutes, from now), and
+// curtails the first of DemandResponse.Tiers at once. runDemandResponse then measures the
+// power every 5 s. While the reduction falls short, the next tier is curtailed once the
+// last one has had SettleSec to take effect, or straight away when less than MarginSec
+// remain. Tier writes skip the drives' write cooldowns and budgets. Tiers add to the
+// event's curtailment session, named by its ID: drives already in it keep their saved
+// state and are only taken further down, and drives other sessions hold are left to them. Power comes from MeterSignal (a site meter read through a sensor, in kW), or else
+// is the sum of the drives' reported power. {"action": "end"}, or the event's endAt,
+// resumes the curtailment. Each event leaves a compliance report with its timeline.
+const (
+    drFilePath        = "/etc/vfd/demand_response.json"
+    defaultDRDeadline = 10  // minutes
+    defaultDRSettle   = 60  // seconds
+    defaultDRMargin   = 120 // seconds
+    drCheckInterval   = 5 * time.Second
+    maxDRReports      = 50
+    maxDRSamples      = 2000
+)
+
+type DemandResponseConfig struct {
+    DeadlineMin int      `json:"DeadlineMin,omitempty"` // default 10
+    SettleSec   int      `json:"SettleSec,omitempty"`   // time a tier gets to show its effect, default 60
+    MarginSec   int      `json:"MarginSec,omitempty"`   // with less than this left, escalate without waiting, default 120
+    MeterSignal string   `json:"MeterSignal,omitempty"` // "<sensor>.<field>", site power in kW; default: the drives' power
+    Tiers       []DRTier `json:"Tiers"`
+}
+
+// DRTier is one curtailment step. With TargetHz or Percent its running drives are slowed
+// down instead of stopped.
+type DRTier struct {
+    Name     string   `json:"Name"`
+    Groups   []string `json:"Groups"`
+    TargetHz float64  `json:"TargetHz,omitempty"`
+    Percent  float64  `json:"Percent,omitempty"`
+}
+
+// DREvent is a demand-response event and, once ended, its compliance report
+type DREvent struct {
+    ID          string         `json:"id"`
+    User        string         `json:"user,omitempty"`
+    ReceivedAt  time.Time      `json:"receivedAt"`
+    Deadline    time.Time      `json:"deadline"`
+    EndAt       *time.Time     `json:"endAt,omitempty"`
+    PowerSource string         `json:"powerSource"` // "meter" or "drives"
+    BaselineKW  float64        `json:"baselineKW"`
+    RequiredKW  float64        `json:"requiredKW"` // reduction to reach
+    Result      string         `json:"result"`     // pending, compliant, missed, or cancelled if ended early without meeting it
+    MetAt       *time.Time     `json:"metAt,omitempty"`
+    ShedSec     *float64       `json:"shedSec,omitempty"` // from receipt to the reduction being met
+    EndedAt     *time.Time     `json:"endedAt,omitempty"`
+    EndReason   string         `json:"endReason,omitempty"`
+    Tiers       []DRTierRecord `json:"tiers"`
+    Samples     []DRSample     `json:"samples,omitempty"`
+}
+
+// DRTierRecord is when a tier was curtailed, and why
+type DRTierRecord struct {
+    Tier      int       `json:"tier"`
+    Name      string    `json:"name"`
+    Groups    []string  `json:"groups"`
+    AppliedAt time.Time `json:"appliedAt"`
+    PowerKW   float64   `json:"powerKW"` // just before
+    Drives    int       `json:"drives"`
+    Reason    string    `json:"reason"`
+}
+
+type DRSample struct {
+    At          time.Time `json:"at"`
+    PowerKW     float64   `json:"powerKW"`
+    ReductionKW float64   `json:"reductionKW"`
+}
+
+var (
+    drMu      sync.Mutex
+    drActive  *DREvent
+    drReports []DREvent // newest last
+    drStepMu  sync.Mutex // serializes start, escalation and end
+
+    errDRActive = errors.New("a demand-response event is in progress")
+)
+
+func validateDemandResponse(c *DemandResponseConfig, drives []DriveConfig) error {
+    if c == nil {
+        return nil
+    }
+    if len(c.Tiers) == 0 {
+        return fmt.Errorf("DemandResponse: no Tiers")
+    }
+    if c.DeadlineMin < 0 || c.SettleSec < 0 || c.MarginSec < 0 {
+        return fmt.Errorf("DemandResponse: DeadlineMin, SettleSec and MarginSec must not be negative")
+    }
+    if c.MeterSignal != "" && !strings.Contains(c.MeterSignal, ".") {
+        return fmt.Errorf("DemandResponse: MeterSignal must be \"<sensor>.<field>\"")
+    }
+    groups := make(map[string]bool)
+    for _, d := range drives {
+        groups[d.Group] = true
+    }
+    for i, t := range c.Tiers {
+        name := t.Name
+        if name == "" {
+            name = fmt.Sprintf("#%d", i+1)
+        }
+        if len(t.Groups) == 0 {
+            return fmt.Errorf("DemandResponse tier %s: no Groups", name)
+        }
+        for _, g := range t.Groups {
+            if !groups[g] {
+                return fmt.Errorf("DemandResponse tier %s: group %q has no drives", name, g)
+            }
+        }
+        if t.TargetHz < 0 || t.Percent < 0 || t.Percent >= 100 || (t.TargetHz > 0 && t.Percent > 0) {
+            return fmt.Errorf("DemandResponse tier %s: give TargetHz or Percent (below 100), not both", name)
+        }
+    }
+    return nil
+}
+
+func drLimits(c *DemandResponseConfig) (deadline, settle, margin time.Duration) {
+    d, s, m := defaultDRDeadline, defaultDRSettle, defaultDRMargin
+    if c.DeadlineMin > 0 {
+        d = c.DeadlineMin
+    }
+    if c.SettleSec > 0 {
+        s = c.SettleSec
+    }
+    if c.MarginSec > 0 {
+        m = c.MarginSec
+    }
+    return time.Duration(d) * time.Minute, time.Duration(s) * time.Second, time.Duration(m) * time.Second
+}
+
+func (t DRTier) target() *CurtailTarget {
+    if t.TargetHz == 0 && t.Percent == 0 {
+        return nil
+    }
+    return &CurtailTarget{Hz: t.TargetHz, Percent: t.Percent}
+}
+
+// sitePower is the load demand response measures, in kW
+func sitePower(c *DemandResponseConfig) (kw float64, source string, ok bool) {
+    if c.MeterSignal != "" {
+        kw, ok = sensorValue(c.MeterSignal)
+        return kw, "meter", ok
+    }
+    for _, entry := range liveDrives() {
+        if p, has := entry["power"]; has {
+            kw += safeFloat(p)
+            ok = true
+        }
+    }
+    return math.Round(kw*100) / 100, "drives", ok
+}
+
+// extendCurtailment adds groups to curtailment session id, or starts it. Drives not yet
+// curtailed are captured and curtailed at target; slowed drives are stopped (target nil)
+// or slowed further, keeping the state they had before the curtailment. Drives another
+// session holds are left to it.
+func extendCurtailment(id string, groups []string, target *CurtailTarget) (int, error) {
+    curtailResumeMu.Lock()
+    defer curtailResumeMu.Unlock()
+    state, err := loadCurtailmentState(id)
+    if os.IsNotExist(err) {
+        state, err = &CurtailmentState{ID: id, Timestamp: time.Now(), Groups: []string{}, Drives: []CurtailedDriveState{}}, nil
+    }
+    if err != nil {
+        return 0, err
+    }
+    if state.Rotation != nil {
+        return 0, fmt.Errorf("a rolling curtailment is in effect")
+    }
+    curtailed := make(map[string]int, len(state.Drives))
+    for i, d := range state.Drives {
+        curtailed[d.IP] = i
+    }
+    var fresh []DriveConfig
+    var further []CurtailedDriveState
+    for _, d := range getDrivesForGroups(groups) {
+        i, ok := curtailed[d.IP]
+        if !ok {
+            fresh = append(fresh, d)
+            continue
+        }
+        c := &state.Drives[i]
+        if c.ReducedHz == 0 {
+            continue // stopped already
+        }
+        if target == nil {
+            c.ReducedHz = 0
+            further = append(further, *c)
+        } else if hz := target.reducedSpeed(&d, c.SetSpeed); hz < c.ReducedHz {
+            c.ReducedHz = hz
+            further = append(further, *c)
+        }
+    }
+    captured, _ := captureCurtailment(id, fresh, target)
+    state.Drives = append(state.Drives, captured...)
+    for _, g := range groups {
+        if !containsString(state.Groups, g) {
+            state.Groups = append(state.Groups, g)
+        }
+    }
+    // Partial and full curtailment are mixed, so resume staggers restarts
+    state.Target = nil
+    if err := saveCurtailmentState(state); err != nil {
+        return 0, fmt.Errorf("failed to save curtailment state: %w", err)
+    }
+    changed := append(captured, further...)
+    for _, d := range changed {
+        if l := limiterFor(d.IP); l != nil {
+            l.clear()
+        }
+    }
+    var slow, stop []CurtailedDriveState
+    for _, d := range changed {
+        switch {
+        case d.ReducedHz > 0:
+            slow = append(slow, d)
+        case target == nil || containsString(curtailedIPs(further), d.IP):
+            stop = append(stop, d)
+        }
+    }
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() { defer wg.Done(); applyCurtailment(slow, &CurtailTarget{}) }()
+    go func() { defer wg.Done(); applyCurtailment(stop, nil) }()
+    wg.Wait()
+    return len(changed), nil
+}
+
+func curtailedIPs(drives []CurtailedDriveState) []string {
+    ips := make([]string, len(drives))
+    for i, d := range drives {
+        ips[i] = d.IP
+    }
+    return ips
+}
+
+// applyDRTier curtails the event's next tier
+func applyDRTier(ev *DREvent, c *DemandResponseConfig, powerKW float64, reason string) {
+    drMu.Lock()
+    i := len(ev.Tiers)
+    drMu.Unlock()
+    tier := c.Tiers[i]
+    name := tier.Name
+    if name == "" {
+        name = fmt.Sprintf("tier %d", i+1)
+    }
+    log.Printf("[DR] %s: curtailing %s (%v): %s", ev.ID, name, tier.Groups, reason)
+    n, err := extendCurtailment(ev.ID, tier.Groups, tier.target())
+    rec := DRTierRecord{Tier: i + 1, Name: name, Groups: tier.Groups, AppliedAt: time.Now(), PowerKW: powerKW, Drives: n, Reason: reason}
+    event := ControlEvent{Timestamp: rec.AppliedAt, Action: "DRTier", Drives: []DriveEventInfo{}, Detail: fmt.Sprintf("%s: %s (%s), %d drives: %s", ev.ID, name, strings.Join(tier.Groups, ","), n, reason)}
+    if err != nil {
+        log.Printf("[DR] %s: %s failed: %v", ev.ID, name, err)
+        rec.Reason += "; failed: " + err.Error()
+        event.Detail += "; failed: " + err.Error()
+    }
+    drMu.Lock()
+    ev.Tiers = append(ev.Tiers, rec)
+    drMu.Unlock()
+    recordControlEvent(event)
+}
+
+// startDemandResponse begins an event and curtails its first tier
+func startDemandResponse(c *DemandResponseConfig, id, user string, reductionKW, reductionPercent float64, deadline, endAt *time.Time, now time.Time) (*DREvent, error) {
+    drStepMu.Lock()
+    defer drStepMu.Unlock()
+    drMu.Lock()
+    active := drActive != nil
+    drMu.Unlock()
+    if active {
+        return nil, errDRActive
+    }
+    if _, err := loadCurtailmentState(id); err == nil {
+        return nil, fmt.Errorf("a curtailment %q is already in effect", id)
+    }
+    kw, source, ok := sitePower(c)
+    if !ok {
+        return nil, fmt.Errorf("no power reading: set DemandResponse.MeterSignal or the drives' OutputPower")
+    }
+    window, _, _ := drLimits(c)
+    ev := &DREvent{ID: id, User: user, ReceivedAt: now, Deadline: now.Add(window), EndAt: endAt, PowerSource: source, BaselineKW: kw, RequiredKW: reductionKW, Result: "pending", Tiers: []DRTierRecord{}}
+    if deadline != nil {
+        ev.Deadline = *deadline
+    }
+    if reductionPercent > 0 {
+        ev.RequiredKW = math.Round(kw*reductionPercent) / 100
+    }
+    ev.Samples = []DRSample{{At: now, PowerKW: kw}}
+    drMu.Lock()
+    drActive = ev
+    drMu.Unlock()
+    recordControlEvent(ControlEvent{Timestamp: now, Action: "DRStart", Drives: []DriveEventInfo{}, Detail: fmt.Sprintf("%s: shed %.1f of %.1f kW by %s", id, ev.RequiredKW, kw, ev.Deadline.Format(time.RFC3339))})
+    applyDRTier(ev, c, kw, "event start")
+    saveDemandResponse()
+    return ev, nil
+}
+
+// runDemandResponse measures an event's progress and escalates it. The event is saved, so
+// one in progress carries on after a restart.
+func runDemandResponse() {
+    ticker := time.NewTicker(drCheckInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        if c := appConfig.DemandResponse; c != nil {
+            checkDemandResponse(c, time.Now())
+        }
+    }
+}
+
+func checkDemandResponse(c *DemandResponseConfig, now time.Time) {
+    drStepMu.Lock()
+    defer drStepMu.Unlock()
+    drMu.Lock()
+    ev := drActive
+    drMu.Unlock()
+    if ev == nil {
+        return
+    }
+    if ev.EndAt != nil && !now.Before(*ev.EndAt) {
+        endDemandResponseLocked("event window ended", now)
+        return
+    }
+    _, settle, margin := drLimits(c)
+    kw, _, ok := sitePower(c)
+    drMu.Lock()
+    reduction := math.Round((ev.BaselineKW-kw)*100) / 100
+    met := ok && reduction >= ev.RequiredKW
+    if ok && len(ev.Samples) < maxDRSamples {
+        ev.Samples = append(ev.Samples, DRSample{At: now, PowerKW: kw, ReductionKW: reduction})
+    }
+    var note *Notification
+    switch {
+    case met && ev.MetAt == nil:
+        at, shed := now, now.Sub(ev.ReceivedAt).Seconds()
+        ev.MetAt, ev.ShedSec = &at, &shed
+        if ev.Result == "pending" {
+            ev.Result = "compliant"
+        }
+        note = &Notification{Severity: "info", Kind: "DemandResponse", Message: fmt.Sprintf("Demand response %s: %.1f kW shed after %.0fs (required %.1f kW)", ev.ID, reduction, shed, ev.RequiredKW)}
+    case !met && ev.Result == "pending" && now.After(ev.Deadline):
+        ev.Result = "missed"
+        note = &Notification{Severity: "critical", Kind: "DemandResponse", Message: fmt.Sprintf("Demand response %s missed its deadline: %.1f of %.1f kW shed", ev.ID, reduction, ev.RequiredKW)}
+    }
+    var reason string
+    if !met && len(ev.Tiers) < len(c.Tiers) {
+        last := ev.Tiers[len(ev.Tiers)-1].AppliedAt
+        shortfall := fmt.Sprintf("%.1f of %.1f kW shed", reduction, ev.RequiredKW)
+        if !ok {
+            shortfall = "no power reading"
+        }
+        switch {
+        case ev.Deadline.Sub(now) <= margin:
+            reason = fmt.Sprintf("%s, %s to the deadline", shortfall, ev.Deadline.Sub(now).Round(time.Second))
+        case now.Sub(last) >= settle:
+            reason = fmt.Sprintf("%s %s after the last tier", shortfall, now.Sub(last).Round(time.Second))
+        }
+    }
+    drMu.Unlock()
+    if note != nil {
+        log.Printf("[DR] %s", note.Message)
+        recordControlEvent(ControlEvent{Timestamp: now, Action: "DR" + strings.ToUpper(ev.Result[:1]) + ev.Result[1:], Drives: []DriveEventInfo{}, Detail: note.Message})
+        notify(*note)
+    }
+    if reason != "" {
+        applyDRTier(ev, c, kw, reason)
+    }
+    saveDemandResponse()
+}
+
+// endDemandResponse ends the event in progress, resumes its curtailment and files its report
+func endDemandResponse(reason string, now time.Time) (*DREvent, error) {
+    drStepMu.Lock()
+    defer drStepMu.Unlock()
+    return endDemandResponseLocked(reason, now)
+}
+
+func endDemandResponseLocked(reason string, now time.Time) (*DREvent, error) {
+    drMu.Lock()
+    ev := drActive
+    drMu.Unlock()
+    if ev == nil {
+        return nil, fmt.Errorf("no demand-response event in progress")
+    }
+    curtailResumeMu.Lock()
+    err := resumeDrives(ev.ID, "DREnd")
+    curtailResumeMu.Unlock()
+    if err != nil {
+        log.Printf("[DR] %s: resume: %v", ev.ID, err)
+    }
+    drMu.Lock()
+    ev.EndedAt, ev.EndReason = &now, reason
+    if ev.Result == "pending" {
+        ev.Result = "missed"
+        if now.Before(ev.Deadline) {
+            ev.Result = "cancelled" // ended before its deadline without meeting it
+        }
+    }
+    drActive = nil
+    drReports = append(drReports, *ev)
+    if len(drReports) > maxDRReports {
+        drReports = drReports[len(drReports)-maxDRReports:]
+    }
+    report := *ev
+    drMu.Unlock()
+    saveDemandResponse()
+    log.Printf("[DR] %s ended (%s): %s", ev.ID, reason, ev.Result)
+    recordControlEvent(ControlEvent{Timestamp: now, Action: "DREnd", Drives: []DriveEventInfo{}, Detail: fmt.Sprintf("%s: %s; result %s", ev.ID, reason, ev.Result)})
+    return &report, nil
+}
+
+func saveDemandResponse() {
+    drMu.Lock()
+    data, err := json.MarshalIndent(map[string]interface{}{"active": drActive, "reports": drReports}, "", "  ")
+    drMu.Unlock()
+    if err == nil {
+        err = os.WriteFile(drFilePath, data, 0644)
+    }
+    if err != nil {
+        log.Printf("[DR] Failed to save %s: %v", drFilePath, err)
+    }
+}
+
+func loadDemandResponse(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    var saved struct {
+        Active  *DREvent  `json:"active"`
+        Reports []DREvent `json:"reports"`
+    }
+    if err := json.Unmarshal(data, &saved); err != nil {
+        log.Printf("[DR] %s: %v", filePath, err)
+        return
+    }
+    drMu.Lock()
+    drActive, drReports = saved.Active, saved.Reports
+    drMu.Unlock()
+}
+
+// drInProgress reports whether a demand-response event is running
+func drInProgress() bool {
+    drMu.Lock()
+    defer drMu.Unlock()
+    return drActive != nil
+}
+
+// drSession is the curtailment session of the event in progress, "" if none
+func drSession() string {
+    drMu.Lock()
+    defer drMu.Unlock()
+    if drActive == nil {
+        return ""
+    }
+    return drActive.ID
+}
+
+// handleDemandResponse serves GET/POST /api/dr, GET /api/dr/reports and
+// GET /api/dr/reports/<id>
+func handleDemandResponse(w http.ResponseWriter, r *http.Request) {
+    c := appConfig.DemandResponse
+    if c == nil {
+        http.Error(w, "Demand response is not configured", http.StatusNotFound)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/dr"), "/")
+    if rest != "" {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+            return
+        }
+        id, listing := strings.CutPrefix(rest, "reports")
+        id = strings.TrimPrefix(id, "/")
+        if !listing {
+            http.Error(w, "Not found", http.StatusNotFound)
+            return
+        }
+        drMu.Lock()
+        defer drMu.Unlock()
+        if id == "" {
+            summaries := make([]DREvent, 0, len(drReports))
+            for i := len(drReports) - 1; i >= 0; i-- {
+                s := drReports[i]
+                s.Samples = nil
+                summaries = append(summaries, s)
+            }
+            json.NewEncoder(w).Encode(summaries)
+            return
+        }
+        for _, ev := range drReports {
+            if ev.ID == id {
+                json.NewEncoder(w).Encode(ev)
+                return
+            }
+        }
+        http.Error(w, "Unknown event: "+id, http.StatusNotFound)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        drMu.Lock()
+        defer drMu.Unlock()
+        if drActive == nil {
+            http.Error(w, "No demand-response event in progress", http.StatusNotFound)
+            return
+        }
+        json.NewEncoder(w).Encode(drActive)
+        return
+    case http.MethodPost:
+    default:
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    var req struct {
+        Action           string     `json:"action"` // "start" or "end"
+        ID               string     `json:"id"`
+        User             string     `json:"user"`
+        ReductionKW      float64    `json:"reductionKW"`
+        ReductionPercent float64    `json:"reductionPercent"`
+        Deadline         *time.Time `json:"deadline"`
+        EndAt            *time.Time `json:"endAt"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    var ips []string
+    for _, t := range c.Tiers {
+        for _, d := range getDrivesForGroups(t.Groups) {
+            if !containsString(ips, d.IP) {
+                ips = append(ips, d.IP)
+            }
+        }
+    }
+    now := time.Now()
+    switch req.Action {
+    case "start":
+        switch {
+        case (req.ReductionKW > 0) == (req.ReductionPercent > 0) || req.ReductionKW < 0 || req.ReductionPercent < 0 || req.ReductionPercent > 100:
+            http.Error(w, "Give reductionKW or reductionPercent (up to 100)", http.StatusBadRequest)
+            return
+        case req.Deadline != nil && !req.Deadline.After(now):
+            http.Error(w, "The deadline must be in the future", http.StatusBadRequest)
+            return
+        case req.EndAt != nil && !req.EndAt.After(now):
+            http.Error(w, "endAt must be in the future", http.StatusBadRequest)
+            return
+        }
+        if req.ID == "" {
+            req.ID = "dr-" + now.UTC().Format("20060102-150405")
+        }
+        // The event's ID names its curtailment session and report
+        if err := validCurtailmentID(req.ID); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if !authorize(w, r, "Curtail", ips) {
+            return
+        }
+        ev, err := startDemandResponse(c, req.ID, strings.TrimSpace(req.User), req.ReductionKW, req.ReductionPercent, req.Deadline, req.EndAt, now)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusConflict)
+            return
+        }
+        drMu.Lock()
+        defer drMu.Unlock()
+        json.NewEncoder(w).Encode(ev)
+    case "end":
+        if !authorize(w, r, "Resume", ips) {
+            return
+        }
+        reason := "ended by request"
+        if u := strings.TrimSpace(req.User); u != "" {
+            reason = "ended by " + u
+        }
+        report, err := endDemandResponse(reason, now)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusConflict)
+            return
+        }
+        json.NewEncoder(w).Encode(report)
+    default:
+        http.Error(w, "Invalid action, must be 'start' or 'end'", http.StatusBadRequest)
+    }
+}
+
+// =====================
+// Emergency Stop
+// =====================
+// POST /api/estop stops every configured drive at once, for the fire-watch procedure.
+// Nothing filters the list: disabled, tagged-out and in-hand drives and reserved groups
+// are all sent a stop, without staging, and the drives' write limits are cleared so the
+// stop is never throttled. Jogs, soaks, ramps and CFM targets on them end.
+// So that a stray request can't stop the site, it takes two calls: the first, with a user
+// and reason, arms a stop and returns a confirmation token; POSTing {"confirm": token}
+// within EStopConfirmSec (default 30) runs it. With EStopToken configured, a request
+// carrying that token stops in one call, for wired panels and alarm integrations.
+// The stop is recorded as an EmergencyStop control event and sent as a critical
+// notification that opens an alert. It also latches: while latched no drive can be started
+// (writeRunCommand and writeReverse refuse), so schedules, rotation, auto-reset and curtailment resume
+// can't restart fans. DELETE /api/estop with a user clears the latch; the drives stay
+// stopped until someone starts them. The latch survives restarts (estop.json) and is
+// forwarded to the shards that poll the drives.
+const estopFilePath = "/etc/vfd/estop.json"
+
+// EStopLatch is a latched emergency stop
+type EStopLatch struct {
+    User   string    `json:"user"`
+    Reason string    `json:"reason,omitempty"`
+    At     time.Time `json:"at"`
+}
+
+// estopArm is a first call waiting for its confirmation
+type estopArm struct {
+    user, reason string
+    expires      time.Time
+}
+
+var (
+    estopMu    sync.Mutex
+    estopLatch *EStopLatch
+    estopArms  = make(map[string]estopArm) // by confirmation token
+
+    errEStopLatched = errors.New("emergency stop latched")
+)
+
+func estopConfirmWindow() time.Duration {
+    if appConfig.EStopConfirmSec > 0 {
+        return time.Duration(appConfig.EStopConfirmSec) * time.Second
+    }
+    return 30 * time.Second
+}
+
+// estopError refuses a start while an emergency stop is latched
+func estopError() error {
+    estopMu.Lock()
+    defer estopMu.Unlock()
+    if estopLatch == nil {
+        return nil
+    }
+    return fmt.Errorf("%w by %s at %s; clear it with DELETE /api/estop", errEStopLatched, estopLatch.User, estopLatch.At.Format(time.RFC3339))
+}
+
+// armEStop records a first call and returns its confirmation token
+func armEStop(user, reason string, now time.Time) (string, time.Time) {
+    var b [16]byte
+    crand.Read(b[:])
+    token := hex.EncodeToString(b[:])
+    expires := now.Add(estopConfirmWindow())
+    estopMu.Lock()
+    for t, a := range estopArms {
+        if now.After(a.expires) {
+            delete(estopArms, t)
+        }
+    }
+    estopArms[token] = estopArm{user: user, reason: reason, expires: expires}
+    estopMu.Unlock()
+    return token, expires
+}
+
+// confirmEStop takes an armed stop by its token. A token is good for one use.
+func confirmEStop(token string, now time.Time) (estopArm, bool) {
+    estopMu.Lock()
+    defer estopMu.Unlock()
+    a, ok := estopArms[token]
+    delete(estopArms, token)
+    return a, ok && !now.After(a.expires)
+}
+
+func setEStopLatch(latch *EStopLatch) {
+    estopMu.Lock()
+    estopLatch = latch
+    estopMu.Unlock()
+    if shadowMode() {
+        return
+    }
+    if latch == nil {
+        if err := os.Remove(estopFilePath); err != nil && !os.IsNotExist(err) {
+            log.Printf("[ESTOP] Failed to remove %s: %v", estopFilePath, err)
+        }
+        return
+    }
+    data, _ := json.MarshalIndent(latch, "", "  ")
+    if err := os.WriteFile(estopFilePath, data, 0644); err != nil {
+        log.Printf("[ESTOP] Failed to write %s: %v", estopFilePath, err)
+    }
+}
+
+func loadEStop(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    var latch EStopLatch
+    if err := json.Unmarshal(data, &latch); err != nil {
+        log.Printf("[ESTOP] Failed to decode %s: %v", filePath, err)
+        return
+    }
+    estopMu.Lock()
+    estopLatch = &latch
+    estopMu.Unlock()
+    log.Printf("[ESTOP] Emergency stop latched by %s at %s; drives cannot be started until it is cleared", latch.User, latch.At.Format(time.RFC3339))
+}
+
+// stopAllDrives sends a stop to each drive at once, ignoring tagouts and write limits.
+// Drives other shards poll are stopped through them.
+func stopAllDrives(ips []string) []DriveEventInfo {
+    endCfmTargets(ips, "EmergencyStop")
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    infos := make([]DriveEventInfo, 0, len(ips))
+    local, remote := splitByShard(ips)
+    for shard, shardIPs := range remote {
+        wg.Add(1)
+        go func(shard string, shardIPs []string) {
+            defer wg.Done()
+            res := forwardShardControl(shard, "EmergencyStop", 0, shardIPs, false)
+            mu.Lock()
+            infos = append(infos, res...)
+            mu.Unlock()
+        }(shard, shardIPs)
+    }
+    for _, ip := range local {
+        wg.Add(1)
+        go func(ip string) {
+            defer wg.Done()
+            info := DriveEventInfo{ID: driveIDFor(ip), IP: ip, Success: true}
+            cancelJog(ip)
+            cancelSoak(ip)
+            cancelRamp(ip, "EmergencyStop")
+            if l := limiterFor(ip); l != nil {
+                l.clear()
+            }
+            conn, profile, err := commandConnAndProfile(ip)
+            if err == nil {
+                done := holdForStop(ip)
+                conn.mu.Lock()
+                err = writeStop(conn, profile)
+                conn.mu.Unlock()
+                done()
+            }
+            if err != nil {
+                info.Success, info.Error = false, err.Error()
+                log.Printf("[ESTOP] IP: %s, stop failed: %v", ip, err)
+            }
+            mu.Lock()
+            infos = append(infos, info)
+            mu.Unlock()
+        }(ip)
+    }
+    wg.Wait()
+    sort.Slice(infos, func(i, j int) bool { return infos[i].IP < infos[j].IP })
+    return infos
+}
+
+// emergencyStop latches and stops every configured drive, and records and notifies it
+func emergencyStop(user, reason string) ControlEvent {
+    now := time.Now()
+    setEStopLatch(&EStopLatch{User: user, Reason: reason, At: now})
+    var ips []string
+    for _, d := range configuredDrives() {
+        ips = append(ips, d.IP)
+    }
+    detail := "by " + user
+    if reason != "" {
+        detail += ": " + reason
+    }
+    log.Printf("[ESTOP] Emergency stop %s; stopping %d drives", detail, len(ips))
+    event := ControlEvent{Timestamp: now, Action: "EmergencyStop", Drives: stopAllDrives(ips), Detail: detail}
+    recordControlEvent(event)
+    failed := 0
+    for _, d := range event.Drives {
+        if !d.Success {
+            failed++
+        }
+    }
+    msg := fmt.Sprintf("EMERGENCY STOP %s: %d drives stopped", detail, len(event.Drives)-failed)
+    if failed > 0 {
+        msg += fmt.Sprintf(", %d FAILED to stop", failed)
+    }
+    notify(Notification{Severity: "critical", Kind: "EmergencyStop", Message: msg})
+    return event
+}
+
+// clearEStop releases the latch. Shards are told too, since they start drives on their own
+// (auto-reset).
+func clearEStop(user string) (*EStopLatch, bool) {
+    estopMu.Lock()
+    latch := estopLatch
+    estopMu.Unlock()
+    if latch == nil {
+        return nil, false
+    }
+    setEStopLatch(nil)
+    if c := appConfig.Sharding; c != nil && isFrontEnd() {
+        for _, s := range c.Shards {
+            if s.Name != c.Self {
+                forwardShardControl(s.Name, "EmergencyStopClear", 0, nil, false)
+            }
+        }
+    }
+    log.Printf("[ESTOP] Emergency stop (by %s at %s) cleared by %s", latch.User, latch.At.Format(time.RFC3339), user)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "EmergencyStopClear", Drives: []DriveEventInfo{}, Detail: "by " + user})
+    resolveAlert("EmergencyStop", "")
+    return latch, true
+}
+
+// handleEStop serves /api/estop: GET shows the latch, POST arms, confirms or (with
+// EStopToken) runs an emergency stop, DELETE clears the latch
+func handleEStop(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    var req struct {
+        User    string `json:"user"`
+        Reason  string `json:"reason"`
+        Confirm string `json:"confirm"` // token from the first call
+        Token   string `json:"token"`   // EStopToken: stop in one call
+    }
+    if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+            http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        req.User = strings.TrimSpace(req.User)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    switch r.Method {
+    case http.MethodGet:
+        estopMu.Lock()
+        latch := estopLatch
+        estopMu.Unlock()
+        json.NewEncoder(w).Encode(map[string]interface{}{"latched": latch != nil, "latch": latch})
+    case http.MethodPost:
+        switch {
+        case req.Confirm != "":
+            arm, ok := confirmEStop(req.Confirm, time.Now())
+            if !ok {
+                http.Error(w, "Unknown or expired confirmation token; arm the stop again", http.StatusConflict)
+                return
+            }
+            json.NewEncoder(w).Encode(emergencyStop(arm.user, arm.reason))
+        case req.Token != "":
+            if appConfig.EStopToken == "" || subtle.ConstantTimeCompare([]byte(req.Token), []byte(appConfig.EStopToken)) != 1 {
+                log.Printf("[ESTOP] Wrong EStopToken from %s", r.RemoteAddr)
+                http.Error(w, "Wrong token", http.StatusUnauthorized)
+                return
+            }
+            user := req.User
+            if user == "" {
+                user = "EStopToken"
+            }
+            json.NewEncoder(w).Encode(emergencyStop(user, req.Reason))
+        case req.User == "":
+            http.Error(w, "user is required", http.StatusBadRequest)
+        default:
+            token, expires := armEStop(req.User, req.Reason, time.Now())
+            log.Printf("[ESTOP] Armed by %s from %s; waiting for confirmation", req.User, r.RemoteAddr)
+            w.WriteHeader(http.StatusAccepted)
+            json.NewEncoder(w).Encode(map[string]interface{}{
+                "confirm":   token,
+                "expiresAt": expires.Format(time.RFC3339),
+                "drives":    len(configuredDrives()),
+                "message":   "POST {\"confirm\": \"<token>\"} to /api/estop to stop every drive",
+            })
+        }
+    case http.MethodDelete:
+        if req.User == "" {
+            http.Error(w, "user is required", http.StatusBadRequest)
+            return
+        }
+        latch, ok := clearEStop(req.User)
+        if !ok {
+            http.Error(w, "No emergency stop is latched", http.StatusNotFound)
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"cleared": latch})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// =====================
+// Purge Mode
+// =====================
+// Purge mode runs the smoke-control airflow profile in Purge.Groups, e.g. exhaust fans at
+// full speed and supply fans stopped or reversed. It starts from POST /api/purge or when
+// Purge.InputSignal (typically a fire-panel contact wired to a sensor's Inputs) turns on.
+// Each group's drives go to their PurgeAction at once, ignoring quiet hours, hand and
+// curtailment; tagged-out drives are left alone. While purge is active nothing else can
+// command those drives: getConnAndProfile refuses them, which holds off schedules,
+// rotation, presets, curtailment and operators alike. Only the emergency stop still
+// reaches them. A drive that isn't in its purge state (it was offline, or someone stopped
+// it at the keypad) is set again on the next poll, at most every 30 s.
+// Purge ends only with DELETE /api/purge and a user, and not while the input is still on.
+// The drives then go back to the run states and speeds they had before. An active purge
+// persists in purge.json, so a restart resumes it.
+const purgeFilePath = "/etc/vfd/purge.json"
+
+const purgeReassertInterval = 30 * time.Second
+
+type PurgeConfig struct {
+    Groups      map[string]PurgeAction `json:"Groups"`                // what each group's fans do
+    InputSignal string                 `json:"InputSignal,omitempty"` // e.g. "firepanel.purge"; non-zero starts purge
+}
+
+// PurgeAction is what a group's fans do in purge
+type PurgeAction struct {
+    Action string  `json:"Action,omitempty"` // "Run" (default), "Reverse" or "Stop"
+    Hz     float64 `json:"Hz,omitempty"`     // Run/Reverse speed; 0 = the drive's HardMaxHz, else 60
+}
+
+// PurgeDrive is a drive's state before purge, restored when it ends
+type PurgeDrive struct {
+    IP      string  `json:"ip"`
+    Running bool    `json:"running"`
+    Reverse bool    `json:"reverse,omitempty"`
+    SetHz   float64 `json:"setHz"`
+}
+
+// PurgeState is an active purge
+type PurgeState struct {
+    Since  time.Time             `json:"since"`
+    Source string                `json:"source"` // "api" or the input signal
+    User   string                `json:"user,omitempty"`
+    Reason string                `json:"reason,omitempty"`
+    Before map[string]PurgeDrive `json:"before"` // by drive ID
+}
+
+var (
+    purgeMu        sync.Mutex
+    purgeState     *PurgeState
+    purgeApplied   = make(map[string]time.Time) // by drive IP: last purge write
+    purgeInputLost bool                         // the input signal is offline or stale (logged once)
+)
+
+// validatePurge checks config.json Purge; any problem is fatal at startup
+func validatePurge(c *PurgeConfig, cfg AppConfig) error {
+    if c == nil {
+        return nil
+    }
+    if cfg.Sharding != nil {
+        return fmt.Errorf("Purge: not available with Sharding")
+    }
+    if len(c.Groups) == 0 {
+        return fmt.Errorf("Purge: no Groups")
+    }
+    groups := make(map[string]bool)
+    for _, d := range cfg.VFDs {
+        groups[d.Group] = true
+    }
+    for group, a := range c.Groups {
+        switch {
+        case !groups[group]:
+            return fmt.Errorf("Purge: group %q has no drives", group)
+        case a.Action != "" && a.Action != "Run" && a.Action != "Reverse" && a.Action != "Stop":
+            return fmt.Errorf("Purge: group %q: Action must be \"Run\", \"Reverse\" or \"Stop\"", group)
+        case a.Hz < 0:
+            return fmt.Errorf("Purge: group %q: Hz is negative", group)
+        }
+    }
+    if c.InputSignal != "" && !strings.Contains(c.InputSignal, ".") {
+        return fmt.Errorf("Purge: InputSignal must be \"<sensor>.<input>\"")
+    }
+    return nil
+}
+
+// purgeTarget is a drive's purge action and speed, kept within its speed range
+func purgeTarget(d *DriveConfig, a PurgeAction) (string, float64) {
+    action := a.Action
+    if action == "" {
+        action = "Run"
+    }
+    lo, hi := speedRange(d)
+    hz := a.Hz
+    if hz == 0 {
+        hz = hi
+    }
+    if hz == 0 {
+        hz = 60
+    }
+    if hi > 0 {
+        hz = math.Min(hz, hi)
+    }
+    return action, math.Max(hz, lo)
+}
+
+// purgeAction returns the purge action for a drive's group, if purge covers it
+func purgeAction(d *DriveConfig) (PurgeAction, bool) {
+    c := appConfig.Purge
+    if c == nil || d == nil {
+        return PurgeAction{}, false
+    }
+    a, ok := c.Groups[d.Group]
+    return a, ok
+}
+
+// purgeError refuses commands to a drive held by an active purge
+func purgeError(ip string) error {
+    d, ok := driveConfig(ip)
+    if _, covered := purgeAction(d); !ok || !covered {
+        return nil
+    }
+    purgeMu.Lock()
+    defer purgeMu.Unlock()
+    if purgeState == nil {
+        return nil
+    }
+    return fmt.Errorf("drive %s is held by purge mode since %s; clear it with DELETE /api/purge", ip, purgeState.Since.Format(time.RFC3339))
+}
+
+// applyPurge puts one drive in its purge state, bypassing purgeError and quiet hours
+// but not tagouts
+func applyPurge(d *DriveConfig, a PurgeAction) error {
+    if err := tagoutError(d.IP); err != nil {
+        return err
+    }
+    cancelJog(d.IP)
+    cancelSoak(d.IP)
+    cancelRamp(d.IP, "Purge")
+    action, hz := purgeTarget(d, a)
+    conn, profile, err := commandConnAndProfile(d.IP)
+    if err != nil {
+        return err
+    }
+    if action == "Reverse" && !profile.canReverse() {
+        return fmt.Errorf("drive type %s has no reverse command", d.DriveType)
+    }
+    if action != "Stop" {
+        if err := openDamper(d.IP); err != nil {
+            return err
+        }
+    }
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    switch action {
+    case "Stop":
+        return writeStop(conn, profile)
+    case "Reverse":
+        if err := writeSpeedReference(conn, profile, hz); err != nil {
+            return err
+        }
+        if err := writeReverse(conn, profile); err != nil {
+            return err
+        }
+        setCommandedDirection(d.IP, "reverse")
+        return nil
+    }
+    if err := writeSpeedReference(conn, profile, hz); err != nil {
+        return err
+    }
+    return writeStart(conn, profile)
+}
+
+// applyPurgeTo applies purge to the given drives at once and returns their outcomes
+func applyPurgeTo(drives []DriveConfig, now time.Time) []DriveEventInfo {
+    ips := make([]string, 0, len(drives))
+    for _, d := range drives {
+        ips = append(ips, d.IP)
+    }
+    endCfmTargets(ips, "Purge")
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    infos := make([]DriveEventInfo, 0, len(drives))
+    for i := range drives {
+        d := &drives[i]
+        a, _ := purgeAction(d)
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            info := DriveEventInfo{ID: d.ID, IP: d.IP, Success: true}
+            if err := applyPurge(d, a); err != nil {
+                info.Success, info.Error = false, err.Error()
+                log.Printf("[PURGE] IP: %s: %v", d.IP, err)
+            }
+            mu.Lock()
+            infos = append(infos, info)
+            mu.Unlock()
+        }()
+    }
+    wg.Wait()
+    purgeMu.Lock()
+    for _, ip := range ips {
+        purgeApplied[ip] = now
+    }
+    purgeMu.Unlock()
+    sort.Slice(infos, func(i, j int) bool { return infos[i].IP < infos[j].IP })
+    return infos
+}
+
+// purgeDrives lists the configured drives purge covers
+func purgeDrives() []DriveConfig {
+    var out []DriveConfig
+    for _, d := range configuredDrives() {
+        if _, ok := purgeAction(&d); ok {
+            out = append(out, d)
+        }
+    }
+    return out
+}
+
+func savePurgeState(state *PurgeState) {
+    if shadowMode() {
+        return
+    }
+    if state == nil {
+        if err := os.Remove(purgeFilePath); err != nil && !os.IsNotExist(err) {
+            log.Printf("[PURGE] Failed to remove %s: %v", purgeFilePath, err)
+        }
+        return
+    }
+    data, _ := json.MarshalIndent(state, "", "  ")
+    if err := os.WriteFile(purgeFilePath, data, 0644); err != nil {
+        log.Printf("[PURGE] Failed to write %s: %v", purgeFilePath, err)
+    }
+}
+
+func loadPurge(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    var state PurgeState
+    if err := json.Unmarshal(data, &state); err != nil {
+        log.Printf("[PURGE] Failed to decode %s: %v", filePath, err)
+        return
+    }
+    purgeMu.Lock()
+    purgeState = &state
+    purgeMu.Unlock()
+    log.Printf("[PURGE] Purge mode active since %s (%s); resuming", state.Since.Format(time.RFC3339), state.Source)
+}
+
+// startPurge records the drives' current states, then runs the purge profile. ok=false
+// means purge was already active.
+func startPurge(source, user, reason string, now time.Time) (ControlEvent, bool) {
+    drives := purgeDrives()
+    live := liveDrives()
+    state := &PurgeState{Since: now, Source: source, User: user, Reason: reason, Before: make(map[string]PurgeDrive)}
+    for _, d := range drives {
+        entry := live[d.IP]
+        state.Before[d.ID] = PurgeDrive{IP: d.IP, Running: entry["status"] == "Running", Reverse: driveDirection(d.IP) == "reverse", SetHz: math.Abs(safeFloat(entry["setSpeed"]))}
+    }
+    purgeMu.Lock()
+    if purgeState != nil {
+        purgeMu.Unlock()
+        return ControlEvent{}, false
+    }
+    purgeState = state
+    purgeMu.Unlock()
+    savePurgeState(state)
+
+    detail := "from " + source
+    if user != "" {
+        detail += " by " + user
+    }
+    if reason != "" {
+        detail += ": " + reason
+    }
+    log.Printf("[PURGE] Purge mode started %s; %d drives", detail, len(drives))
+    event := ControlEvent{Timestamp: now, Action: "PurgeStart", Drives: applyPurgeTo(drives, now), Detail: detail}
+    recordControlEvent(event)
+    notify(Notification{Severity: "critical", Kind: "Purge", Message: "Purge mode started " + detail})
+    return event, true
+}
+
+var (
+    errPurgeInactive = errors.New("purge mode is not active")
+    errPurgeInputOn  = errors.New("the purge input is still on")
+)
+
+// endPurge clears purge and returns the drives to their states from before it
+func endPurge(user string, now time.Time) (ControlEvent, error) {
+    if c := appConfig.Purge; c != nil && c.InputSignal != "" {
+        if v, ok := sensorValue(c.InputSignal); ok && v != 0 {
+            return ControlEvent{}, fmt.Errorf("%w (%s)", errPurgeInputOn, c.InputSignal)
+        }
+    }
+    purgeMu.Lock()
+    state := purgeState
+    purgeState = nil
+    purgeApplied = make(map[string]time.Time)
+    purgeMu.Unlock()
+    if state == nil {
+        return ControlEvent{}, errPurgeInactive
+    }
+    savePurgeState(nil)
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    event := ControlEvent{Timestamp: now, Action: "PurgeClear", Drives: []DriveEventInfo{}, Detail: "by " + user}
+    for id, before := range state.Before {
+        wg.Add(1)
+        go func(id string, before PurgeDrive) {
+            defer wg.Done()
+            info := DriveEventInfo{ID: id, IP: before.IP, Success: true}
+            var err error
+            switch {
+            case before.Running && before.SetHz > 0 && before.Reverse:
+                err = fanReverse(before.IP, before.SetHz, true)
+            case before.Running && before.SetHz > 0:
+                err = setFanSpeed(before.IP, before.SetHz, true)
+            default:
+                err = fanStop(before.IP)
+            }
+            if err != nil {
+                info.Success, info.Error = false, err.Error()
+                log.Printf("[PURGE] IP: %s, restore failed: %v", before.IP, err)
+            }
+            mu.Lock()
+            event.Drives = append(event.Drives, info)
+            mu.Unlock()
+        }(id, before)
+    }
+    wg.Wait()
+    sort.Slice(event.Drives, func(i, j int) bool { return event.Drives[i].IP < event.Drives[j].IP })
+    log.Printf("[PURGE] Purge mode (since %s) cleared by %s; drives restored", state.Since.Format(time.RFC3339), user)
+    recordControlEvent(event)
+    resolveAlert("Purge", "")
+    return event, nil
+}
+
+// purgeDrifted reports whether a polled drive is out of its purge state
+func purgeDrifted(entry map[string]interface{}, action string, hz float64) bool {
+    running := entry["status"] == "Running"
+    switch action {
+    case "Stop":
+        return running
+    case "Reverse":
+        return !running || entry["direction"] != "reverse" || math.Abs(math.Abs(safeFloat(entry["setSpeed"]))-hz) > 0.5
+    }
+    return !running || entry["direction"] == "reverse" || math.Abs(safeFloat(entry["setSpeed"])-hz) > 0.5
+}
+
+// watchPurge starts purge when the input turns on and, while purge is active, sets again
+// the drives that have left their purge state
+func watchPurge(snapshot []map[string]interface{}) {
+    c := appConfig.Purge
+    if c == nil || shadowMode() {
+        return
+    }
+    now := time.Now()
+    if c.InputSignal != "" {
+        v, ok := sensorValue(c.InputSignal)
+        purgeMu.Lock()
+        lost := !ok && !purgeInputLost
+        recovered := ok && purgeInputLost
+        purgeInputLost = !ok
+        active := purgeState != nil
+        purgeMu.Unlock()
+        switch {
+        case lost:
+            log.Printf("[PURGE] Input %s has no current reading; purge can only be started from the API", c.InputSignal)
+            notify(Notification{Severity: "warning", Kind: "Purge", Message: "Purge input " + c.InputSignal + " is offline"})
+        case recovered:
+            log.Printf("[PURGE] Input %s is reading again", c.InputSignal)
+        }
+        if ok && v != 0 && !active {
+            startPurge(c.InputSignal, "", "input on", now)
+            return
+        }
+    }
+
+    purgeMu.Lock()
+    active := purgeState != nil
+    purgeMu.Unlock()
+    if !active {
+        return
+    }
+    var due []DriveConfig
+    for _, entry := range snapshot {
+        ip, _ := entry["ip"].(string)
+        d, ok := driveConfig(ip)
+        a, covered := purgeAction(d)
+        if !ok || !covered || entry["tagout"] != nil {
+            continue
+        }
+        if status := entry["status"]; status == "Unavailable" || status == "NotReady" || status == "Disabled" {
+            continue
+        }
+        action, hz := purgeTarget(d, a)
+        purgeMu.Lock()
+        recent := now.Sub(purgeApplied[ip]) < purgeReassertInterval
+        purgeMu.Unlock()
+        if !recent && purgeDrifted(entry, action, hz) {
+            due = append(due, *d)
+        }
+    }
+    if len(due) == 0 {
+        return
+    }
+    event := ControlEvent{Timestamp: now, Action: "PurgeReassert", Drives: applyPurgeTo(due, now), Detail: "drive out of its purge state"}
+    recordControlEvent(event)
+}
+
+// handlePurge serves /api/purge: GET shows purge mode, POST starts it, DELETE clears it
+func handlePurge(w http.ResponseWriter, r *http.Request) {
+    c := appConfig.Purge
+    if r.Method == http.MethodGet {
+        resp := map[string]interface{}{"configured": c != nil, "active": false}
+        if c != nil {
+            resp["groups"] = c.Groups
+            if c.InputSignal != "" {
+                input := map[string]interface{}{"signal": c.InputSignal, "online": false}
+                if v, ok := sensorValue(c.InputSignal); ok {
+                    input["online"], input["on"] = true, v != 0
+                }
+                resp["input"] = input
+            }
+        }
+        purgeMu.Lock()
+        if purgeState != nil {
+            resp["active"], resp["state"] = true, purgeState
+        }
+        purgeMu.Unlock()
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(resp)
+        return
+    }
+    if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    if c == nil {
+        http.Error(w, "Purge is not configured", http.StatusNotFound)
+        return
+    }
+    var ips []string
+    for _, d := range purgeDrives() {
+        ips = append(ips, d.IP)
+    }
+    if !authorize(w, r, "Purge", ips) {
+        return
+    }
+    var req struct {
+        User   string `json:"user"`
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    req.User = strings.TrimSpace(req.User)
+    if req.User == "" {
+        http.Error(w, "user is required", http.StatusBadRequest)
+        return
+    }
+    var event ControlEvent
+    if r.Method == http.MethodPost {
+        var ok bool
+        if event, ok = startPurge("api", req.User, req.Reason, time.Now()); !ok {
+            http.Error(w, "Purge mode is already active", http.StatusConflict)
+            return
+        }
+    } else {
+        var err error
+        if event, err = endPurge(req.User, time.Now()); err != nil {
+            status := http.StatusConflict
+            if errors.Is(err, errPurgeInactive) {
+                status = http.StatusNotFound
+            }
+            http.Error(w, "Purge not cleared: "+err.Error(), status)
+            return
+        }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(event)
+}
+
+// =====================
+// Read-Only Mirror
+// =====================
+// GET /api/mirror is for vendors' collectors that poll our data every few seconds. It
+// serves one cached document, rebuilt at most every CacheSec however many clients poll,
+// with an ETag and Cache-Control so caches and conditional requests (304) take most of the
+// load. Each client (source IP) gets RatePerMin requests a minute, with bursts up to a
+// tenth of that; more get 429 with Retry-After. With Mirror.BindPort set, the mirror also
+// has its own listener, which serves nothing else, so third-party pollers never reach the
+// operational API. The document carries drive status and readings, without IPs or
+// settings.
+const (
+    defaultMirrorCacheSec   = 5
+    defaultMirrorRatePerMin = 60
+)
+
+type MirrorConfig struct {
+    BindIP     string `json:"BindIP,omitempty"`
+    BindPort   string `json:"BindPort,omitempty"`   // own listener serving only /api/mirror; empty = the main listener only
+    CacheSec   int    `json:"CacheSec,omitempty"`   // default 5
+    RatePerMin int    `json:"RatePerMin,omitempty"` // per client, default 60
+}
+
+// mirrorFields are the live drive fields the mirror publishes
+var mirrorFields = []string{"id", "group", "fanNumber", "fanDesc", "status", "setSpeed", "actualSpeed", "actualPercent", "rpmSpeed", "actualCfm", "current", "power", "direction", "faultCode", "faultText", "lastUpdated"}
+
+// mirrorSensorFields are the live sensor fields it publishes, besides inputs and outputs
+var mirrorSensorFields = []string{"name", "group", "status", "temperature", "humidity", "vibration", "lastUpdated"}
+
+var (
+    mirrorMu      sync.Mutex
+    mirrorBody    []byte
+    mirrorETag    string
+    mirrorBuilt   time.Time
+    mirrorClients = make(map[string]*mirrorBucket) // by client IP
+
+    vfdMirrorRequests = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "vfd",
+            Name:      "mirror_requests_total",
+            Help:      "Mirror requests by result: served, not_modified or limited",
+        },
+        []string{"result"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(vfdMirrorRequests)
+}
+
+// mirrorBucket is a client's token bucket
+type mirrorBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+func mirrorLimits(c *MirrorConfig) (cache time.Duration, perMin int) {
+    sec, rate := defaultMirrorCacheSec, defaultMirrorRatePerMin
+    if c != nil && c.CacheSec > 0 {
+        sec = c.CacheSec
+    }
+    if c != nil && c.RatePerMin > 0 {
+        rate = c.RatePerMin
+    }
+    return time.Duration(sec) * time.Second, rate
+}
+
+// mirrorAllow takes a token from the client's bucket; when empty it returns how long
+// until the next one
+func mirrorAllow(client string, perMin int, now time.Time) (bool, time.Duration) {
+    burst := math.Max(float64(perMin)/10, 1)
+    rate := float64(perMin) / 60 // per second
+    mirrorMu.Lock()
+    defer mirrorMu.Unlock()
+    b := mirrorClients[client]
+    if b == nil {
+        b = &mirrorBucket{tokens: burst, last: now}
+        mirrorClients[client] = b
+    }
+    b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+    b.last = now
+    if b.tokens < 1 {
+        return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+    }
+    b.tokens--
+    // Forget clients that have been idle long enough to be full again
+    if len(mirrorClients) > 1000 {
+        for k, other := range mirrorClients {
+            if now.Sub(other.last).Seconds()*rate >= burst {
+                delete(mirrorClients, k)
+            }
+        }
+    }
+    return true, 0
+}
+
+// buildMirror renders the mirror document from the live data
+func buildMirror(now time.Time) []byte {
+    pick := func(entry map[string]interface{}, fields []string) map[string]interface{} {
+        out := make(map[string]interface{}, len(fields))
+        for _, f := range fields {
+            if v, ok := entry[f]; ok {
+                out[f] = v
+            }
+        }
+        return out
+    }
+    vfdDataMutex.RLock()
+    drives := make([]map[string]interface{}, 0, len(vfdData))
+    for _, entry := range vfdData {
+        drives = append(drives, pick(entry, mirrorFields))
+    }
+    sensors := make([]map[string]interface{}, 0, len(sensorData))
+    for i, entry := range sensorData {
+        s := pick(entry, mirrorSensorFields)
+        if i < len(appConfig.Sensors) {
+            for name := range appConfig.Sensors[i].Inputs {
+                s[name] = entry[name]
+            }
+            for name := range appConfig.Sensors[i].Outputs {
+                s[name] = entry[name]
+            }
+        }
+        sensors = append(sensors, s)
+    }
+    vfdDataMutex.RUnlock()
+    body, _ := json.Marshal(map[string]interface{}{
+        "site":        appConfig.SiteName,
+        "generatedAt": now.UTC(),
+        "drives":      drives,
+        "sensors":     sensors,
+    })
+    return body
+}
+
+// mirrorDocument returns the cached document, rebuilding it once it is CacheSec old
+func mirrorDocument(now time.Time, cache time.Duration) ([]byte, string, time.Time) {
+    mirrorMu.Lock()
+    defer mirrorMu.Unlock()
+    if mirrorBody == nil || now.Sub(mirrorBuilt) >= cache {
+        mirrorBody = buildMirror(now)
+        sum := sha256.Sum256(mirrorBody)
+        mirrorETag = `"` + hex.EncodeToString(sum[:8]) + `"`
+        mirrorBuilt = now
+    }
+    return mirrorBody, mirrorETag, mirrorBuilt
+}
+
+func handleMirror(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    cache, perMin := mirrorLimits(appConfig.Mirror)
+    now := time.Now()
+    client, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        client = r.RemoteAddr
+    }
+    if ok, wait := mirrorAllow(client, perMin, now); !ok {
+        vfdMirrorRequests.WithLabelValues("limited").Inc()
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+        http.Error(w, "Too many requests", http.StatusTooManyRequests)
+        return
+    }
+    body, etag, built := mirrorDocument(now, cache)
+    age := now.Sub(built)
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(math.Max((cache-age).Seconds(), 0))))
+    w.Header().Set("Last-Modified", built.UTC().Format(http.TimeFormat))
+    if r.Header.Get("If-None-Match") == etag {
+        vfdMirrorRequests.WithLabelValues("not_modified").Inc()
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    vfdMirrorRequests.WithLabelValues("served").Inc()
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(body)
+}
+
+// =====================
+// HTTP/WebSocket Handlers
+// =====================
+func handleLivePage(w http.ResponseWriter, r *http.Request) {
+        http.ServeFile(w, r, "/etc/vfd/index.html")
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+    name, version, err := wsClientIdentity(r, appConfig.AllowAnonymousWebSocket)
+    var user string
+    var verified bool
+    if err == nil {
+        user, verified, err = wsUser(r)
+    }
+    if err != nil {
+        log.Printf("WebSocket connection from %s rejected: %v", r.RemoteAddr, err)
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    log.Printf("WebSocket connection attempt from %s (client %s %s)", r.RemoteAddr, name, version)
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        log.Println("WebSocket upgrade error:", err)
+        return
+    }
+    defer conn.Close()
+    client := registerWSClient(name, version, r.RemoteAddr)
+    defer unregisterWSClient(client)
+    withBanners, _ := strconv.ParseBool(r.URL.Query().Get("banners"))
+    joinPresence(client, user, verified, withBanners)
+    log.Printf("WebSocket connection established from %s (client %s %s)", r.RemoteAddr, name, version)
+
+    // ?sensors=1 switches the message from the drive array to {"drives": [...], "sensors": [...]}
+    withSensors, _ := strconv.ParseBool(r.URL.Query().Get("sensors"))
+
+    // Send initial data immediately
+    initialData := wsPayload(withSensors)
+
+    log.Printf("Sending initial data to WebSocket client")
+    if err := client.send(conn, initialData); err != nil {
+        log.Println("WebSocket initial write error:", err)
+        return
+    }
+    log.Println("Initial data sent successfully")
+
+    // Then send updated data every second
+    ticker := time.NewTicker(1 * time.Second)
+    defer ticker.Stop()
+
+    for {
+        var msg interface{}
+        select {
+        case <-ticker.C:
+            msg = wsPayload(withSensors)
+        case b := <-client.banners:
+            msg = b
+        }
+        if err := client.send(conn, msg); err != nil {
+            log.Println("WebSocket write error:", err)
+            return
+        }
+    }
+}
+
+// wsPayload snapshots the live data for one WebSocket update
+func wsPayload(withSensors bool) interface{} {
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+    drives := make([]map[string]interface{}, len(vfdData))
+    copy(drives, vfdData)
+    if !withSensors {
+        return drives
+    }
+    sensors := make([]map[string]interface{}, len(sensorData))
+    copy(sensors, sensorData)
+    return map[string]interface{}{"drives": drives, "sensors": sensors}
+}
+
+// handleControlEvents serves GET /api/control-events; ?drive=<id or IP> keeps the events
+// that touched that drive (by ID, so they follow it across IP changes)
+func handleControlEvents(w http.ResponseWriter, r *http.Request) {
+    var id string
+    if ref := r.URL.Query().Get("drive"); ref != "" {
+        id = ref
+        if d, ok := driveConfig(driveRefIP(ref, configuredDrives())); ok {
+            id = d.ID
+        }
+    }
+    eventsMutex.RLock()
+    events := make([]map[string]interface{}, 0, len(controlEvents))
+    for _, event := range controlEvents {
+        if id != "" && !eventTouchesDrive(event, id) {
+            continue
+        }
+        e := map[string]interface{}{
+            "timestamp": event.Timestamp.Format(time.RFC3339),
+            "action":    event.Action,
+            "speed":     event.Speed,
+            "drives":    event.Drives,
+        }
+        if event.Detail != "" {
+            e["detail"] = event.Detail
+        }
+        events = append(events, e)
+    }
+    eventsMutex.RUnlock()
+    json.NewEncoder(w).Encode(events)
+}
+
+func handleControl(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+                return
+        }
+
+        if shadowMode() {
+                http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+                return
+        }
+
+        var controlData struct {
+                Drives []string `json:"drives"`
+                Action string   `json:"action"`
+                Speed  float64  `json:"speed"`  
+                QueueIfOffline bool `json:"queueIfOffline"` // queue for Unavailable drives instead of failing
+                QueueTTLSec    int  `json:"queueTTLSec"`    // default 1h, max 24h
+                Acknowledge    bool `json:"acknowledge"`    // confirm exceeding drives' soft speed limits
+                Synchronized   bool `json:"synchronized"`   // SetSpeed: change every drive's speed at the same instant
+                Preset         string `json:"preset"`       // ApplyPreset: the preset's name
+                Hand           bool   `json:"hand"`         // put the drives in hand, so automation leaves them alone
+                User           string `json:"user"`         // who, required with hand
+                Cfm            float64  `json:"cfm"`        // SetCfm: airflow per fan, or per group with groups
+                Groups         []string `json:"groups"`     // SetCfm: groups whose running drives share the airflow
+        }
+        err := json.NewDecoder(r.Body).Decode(&controlData)
+        if err != nil {
+                http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        controlData.User = strings.TrimSpace(controlData.User)
+        if controlData.Hand && controlData.User == "" {
+                http.Error(w, "user is required with hand", http.StatusBadRequest)
+                return
+        }
+
+        if !authorize(w, r, controlData.Action, controlTargets(controlData.Action, controlData.Preset, controlData.Drives, controlData.Groups)) {
+                return
+        }
+
+        if controlData.Action == "ApplyPreset" {
+                applyPresetRequest(w, controlData.Preset, controlData.Acknowledge)
+                return
+        }
+        if controlData.Action == "SetCfm" {
+                applyCfmRequest(w, controlData.Cfm, controlData.Drives, controlData.Groups)
+                return
+        }
+
+        // Validate action
+        if !isValidControlAction(controlData.Action) {
+                http.Error(w, "Invalid action", http.StatusBadRequest)
+                return
+        }
+
+        log.Printf("[INCOMING REQUEST] Control action: Action=%s, Speed=%.2f, Drives=%v\n", controlData.Action, controlData.Speed, controlData.Drives)
+    ips, refused := checkControl(controlData.Action, controlData.Speed, controlData.Drives, controlData.Acknowledge)
+    if refused != nil {
+        refused.write(w)
+        return
+    }
+    controlData.Drives = ips
+
+    if controlData.Synchronized {
+        if controlData.Action != "SetSpeed" {
+            http.Error(w, "synchronized applies only to SetSpeed", http.StatusBadRequest)
+            return
+        }
+        for _, ip := range controlData.Drives {
+            if d, _ := driveConfig(ip); d != nil && rampRate(d) > 0 {
+                http.Error(w, "synchronized SetSpeed is not available for drives with MaxRampHzPerSec ("+ip+")", http.StatusBadRequest)
+                return
+            }
+        }
+    }
+
+    drives := controlData.Drives
+    var queued []DriveEventInfo
+    if controlData.QueueIfOffline {
+        ttl := time.Duration(controlData.QueueTTLSec) * time.Second
+        if ttl <= 0 {
+            ttl = time.Hour
+        }
+        if ttl > commandQueueMaxTTL {
+            http.Error(w, "queueTTLSec must be at most 86400", http.StatusBadRequest)
+            return
+        }
+        drives, queued = queueOfflineDrives(controlData.Action, controlData.Speed, controlData.Acknowledge, drives, ttl, time.Now())
+    }
+
+    event := runControl(operatorName(r, controlData.User), controlData.Action, controlData.Speed, drives, controlData.Acknowledge, controlData.Synchronized)
+    event.Drives = append(event.Drives, queued...)
+
+    // Log the event with retention and persist
+    recordControlEvent(event)
+
+    if controlData.Hand {
+        var pinned []string
+        for _, d := range event.Drives {
+            if d.Success && !d.Queued {
+                pinned = append(pinned, d.IP)
+            }
+        }
+        if len(pinned) > 0 {
+            if err := putInHand(pinned, controlData.User, controlData.Action); err != nil {
+                log.Printf("[HAND] Failed to save %s: %v", handFilePath, err)
+            }
+        }
+    }
+
+    if controlData.Synchronized {
+        w.Write([]byte("Control action processed successfully (" + event.Detail + ")"))
+    } else {
+        w.Write([]byte("Control action processed successfully"))
+    }
+    go pollAllDrives()
+}
+
+// controlRefusal is why a control request was rejected as a whole, before any drive was
+// written. Detail ("drives" or "groups") goes with the message as a JSON error document.
+type controlRefusal struct {
+    status int
+    msg    string
+    detail map[string]interface{}
+}
+
+func (c *controlRefusal) write(w http.ResponseWriter) {
+    if c.detail == nil {
+        http.Error(w, c.msg, c.status)
+        return
+    }
+    body := map[string]interface{}{"error": c.msg}
+    for k, v := range c.detail {
+        body[k] = v
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(c.status)
+    json.NewEncoder(w).Encode(body)
+}
+
+// checkControl validates a control action from any source (/api/control, NATS) before
+// anything is written. Drive references (IDs or IPs) must name configured drives, speeds
+// must be within each drive's limits and quiet-hours cap, and no airflow reservation may
+// be broken. It returns the drives' IPs, or why the request is refused.
+func checkControl(action string, speed float64, refs []string, ack bool) ([]string, *controlRefusal) {
+    ips := resolveDriveRefs(refs)
+    for i, ip := range ips {
+        if _, ok := driveConfig(ip); !ok {
+            return nil, &controlRefusal{status: http.StatusNotFound, msg: "Unknown drive: " + refs[i]}
+        }
+    }
+
+    // Speed limits are checked up front so a request is either accepted or rejected as a whole.
+    // Start, and Reverse without a speed, run at the drive's current setpoint.
+    if action == "SetSpeed" || action == "Start" || action == "Reverse" {
+        live := liveDrives()
+        var hard, soft, quiet []map[string]interface{}
+        for _, ip := range ips {
+            d, _ := driveConfig(ip)
+            hz, _ := clampSpeed(d, speed)
+            if action == "Start" || (action == "Reverse" && speed <= 0) {
+                if live[ip]["status"] == "Running" {
+                    continue
+                }
+                hz = safeFloat(live[ip]["setSpeed"])
+            }
+            _, err := checkSpeedWrite(d, hz, ack)
+            if err == nil || (action != "SetSpeed" && !errors.Is(err, errQuietHours)) {
+                continue
+            }
+            entry := map[string]interface{}{"ip": ip, "error": err.Error()}
+            switch {
+            case errors.Is(err, errQuietHours):
+                quiet = append(quiet, entry)
+            case speedOutOfRange(d, hz):
+                hard = append(hard, entry)
+            default:
+                soft = append(soft, entry)
+            }
+        }
+        if len(hard) > 0 || len(soft) > 0 || len(quiet) > 0 {
+            status, msg, drives := http.StatusConflict, "Speed exceeds soft limit on some drives; resend with \"acknowledge\": true to override", soft
+            if len(quiet) > 0 {
+                msg, drives = "Speed exceeds the quiet-hours cap on some drives; request an override with POST /api/quiet-hours/override", quiet
+            }
+            if len(hard) > 0 {
+                status, msg, drives = http.StatusBadRequest, "Speed is outside the allowed range on some drives", hard
+            }
+            log.Printf("[LIMIT] %s %.2f rejected: %s %v", action, speed, msg, drives)
+            return nil, &controlRefusal{status: status, msg: msg, detail: map[string]interface{}{"drives": drives}}
+        }
+    }
+
+    if conflicts := airflowConflicts(action, speed, ips); len(conflicts) > 0 {
+        log.Printf("[AIRFLOW] %s %v rejected: %v", action, ips, conflicts)
+        return nil, &controlRefusal{status: http.StatusConflict, msg: "Action would break an airflow reservation; release it with DELETE /api/airflow-reservations/<group> first", detail: map[string]interface{}{"groups": conflicts}}
+    }
+    return ips, nil
+}
+
+// runControl executes a checked control action, with a banner for the other operators when
+// it covers more than one drive, and returns the event, not yet recorded
+func runControl(operator, action string, speed float64, ips []string, ack, synchronized bool) ControlEvent {
+    finished := func(string) {}
+    if len(ips) > 1 {
+        finished = announce(operator, action, ips)
+    }
+    var event ControlEvent
+    if synchronized {
+        event, _ = executeSynchronized(speed, ips, ack)
+    } else {
+        event = executeControl(action, speed, ips, ack)
+    }
+    finished(eventOutcome(event))
+    return event
+}
+
+// applyPresetRequest handles {"action": "ApplyPreset"} on /api/control. Like SetSpeed,
+// the preset is rejected as a whole if any drive's speed needs an acknowledgment or an
+// override it doesn't have.
+func applyPresetRequest(w http.ResponseWriter, name string, ack bool) {
+    p, ok := presetByName(name)
+    if !ok {
+        http.Error(w, "Unknown preset: "+name, http.StatusNotFound)
+        return
+    }
+    var refused []map[string]interface{}
+    for ip, hz := range presetTargets(p, configuredDrives()) {
+        if hz == 0 {
+            continue
+        }
+        d, _ := driveConfig(ip)
+        speed, _ := clampSpeed(d, hz)
+        if _, err := checkSpeedWrite(d, speed, ack); err != nil {
+            refused = append(refused, map[string]interface{}{"ip": ip, "error": err.Error()})
+        }
+    }
+    if len(refused) > 0 {
+        sort.Slice(refused, func(i, j int) bool { return refused[i]["ip"].(string) < refused[j]["ip"].(string) })
+        log.Printf("[PRESET] %s rejected: %v", name, refused)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusConflict)
+        json.NewEncoder(w).Encode(map[string]interface{}{"error": "Preset speeds exceed a soft limit or quiet-hours cap on some drives", "drives": refused})
+        return
+    }
+    log.Printf("[PRESET] Applying %s", name)
+    event := applyPreset(p, ack)
+    recordControlEvent(event)
+    w.Write([]byte("Control action processed successfully (" + event.Detail + ")"))
+    go pollAllDrives()
+}
+
+// Per-drive SetSpeed generation counters used for write coalescing
+var setSpeedGen = make(map[string]uint64)
+var setSpeedGenMu sync.Mutex
+
+// setSpeedCoalesceWindow is how long a SetSpeed waits for a newer one; 0 when coalescing
+// is off, as it is unless configured, so a lone SetSpeed is never delayed
+func setSpeedCoalesceWindow() time.Duration {
+    if appConfig.SetSpeedCoalesceMs <= 0 {
+        return 0
+    }
+    return time.Duration(appConfig.SetSpeedCoalesceMs) * time.Millisecond
+}
+
+// coalesceSetSpeed holds a SetSpeed request for the coalescing window and reports
+// whether a newer request for the same drive arrived meanwhile (superseding this one).
+// Rapid slider movements then cost one set of register writes instead of one per step.
+func coalesceSetSpeed(ip string) bool {
+    window := setSpeedCoalesceWindow()
+    if window <= 0 {
+        return false
+    }
+    setSpeedGenMu.Lock()
+    setSpeedGen[ip]++
+    mine := setSpeedGen[ip]
+    setSpeedGenMu.Unlock()
+
+    time.Sleep(window)
+
+    setSpeedGenMu.Lock()
+    defer setSpeedGenMu.Unlock()
+    return setSpeedGen[ip] != mine
+}
+
+// isValidControlAction reports whether action is one of the /api/control actions
+func isValidControlAction(action string) bool {
+    switch action {
+    case "Freespin", "Fanhold", "SetSpeed", "Start", "Stop", "Reverse", "Jog":
+        return true
+    }
+    return false
+}
+
+// executeControl applies a control action to each drive concurrently and returns
+// the resulting event (not yet recorded). Shared by the HTTP API and bus integrations.
+func executeControl(action string, speed float64, ips []string, ack bool) ControlEvent {
+    endCfmTargets(ips, action)
+    if conflicts := airflowConflicts(action, speed, ips); len(conflicts) > 0 {
+        return reservationBlockedEvent(action, speed, ips, conflicts)
+    }
+    stages := controlStages(action, ips)
+    if len(stages) <= 1 {
+        return executeControlStage(action, speed, ips, ack)
+    }
+    return executeStaged(action, speed, stages, ack)
+}
+
+// reservationBlockedEvent fails every drive of an action refused for airflow reservations
+func reservationBlockedEvent(action string, speed float64, ips []string, conflicts []string) ControlEvent {
+    msg := "airflow reservation: " + strings.Join(conflicts, "; ")
+    log.Printf("[AIRFLOW] %s %v refused: %s", action, ips, msg)
+    event := ControlEvent{Timestamp: time.Now(), Action: action, Speed: speed, Drives: make([]DriveEventInfo, 0, len(ips)), Detail: msg}
+    for _, ip := range ips {
+        event.Drives = append(event.Drives, DriveEventInfo{ID: driveIDFor(ip), IP: ip, Error: msg})
+    }
+    return event
+}
+
+// executeControlStage runs an action on all given drives, staggering starts if configured
+func executeControlStage(action string, speed float64, ips []string, ack bool) ControlEvent {
+    if action == "Start" || action == "SetSpeed" || action == "Reverse" {
+        offsets, times, slots := staggerSchedule(ips, driveRunning)
+        if len(slots) > 1 {
+            return executeStaggered(action, speed, offsets, times, slots, ack)
+        }
+    }
+    return executeConcurrently(action, speed, ips, ack)
+}
+
+// executeConcurrently runs an action on all given drives at once
+func executeConcurrently(action string, speed float64, ips []string, ack bool) ControlEvent {
+    event := ControlEvent{
+        Timestamp: time.Now(),
+        Action:    action,
+        Speed:     speed,
+        Drives:    make([]DriveEventInfo, 0),
+    }
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+
+    // Drives another shard polls are commanded through it
+    ips, remote := splitByShard(ips)
+    for shard, shardIPs := range remote {
+        wg.Add(1)
+        go func(shard string, shardIPs []string) {
+            defer wg.Done()
+            infos := forwardShardControl(shard, action, speed, shardIPs, ack)
+            mu.Lock()
+            event.Drives = append(event.Drives, infos...)
+            mu.Unlock()
+        }(shard, shardIPs)
+    }
+
+    for _, ip := range ips {
+        wg.Add(1)
+        go func(ip string) {
+            defer wg.Done()
+            driveInfo := DriveEventInfo{IP: ip, Success: true}
+            var err error
 
             // Check drive status in vfdData
             vfdDataMutex.RLock()
@@ -1199,458 +10556,11161 @@ func handleControl(w http.ResponseWriter, r *http.Request) {
                     break
                 }
             }
-            vfdDataMutex.RUnlock()
+            vfdDataMutex.RUnlock()
+
+            if terr := tagoutError(ip); terr != nil {
+                driveInfo.Success = false
+                driveInfo.Error = terr.Error()
+                log.Printf("[CONTROL BLOCKED] IP: %s, Action: %s, %v", ip, action, terr)
+            } else if driveStatus == "Unavailable" || driveStatus == "NotReady" {
+                driveInfo.Success = false
+                driveInfo.Error = fmt.Sprintf("%s", driveStatus)
+                log.Printf("[CONTROL BLOCKED] IP: %s, Action: %s, State: %s", ip, action, driveStatus)
+            } else {
+                if action != "Jog" {
+                    cancelJog(ip)
+                }
+                cancelSoak(ip)
+                switch action {
+                case "Jog":
+                    if driveStatus == "Tripped" {
+                        err = fmt.Errorf("drive is tripped; reset it before jogging")
+                        break
+                    }
+                    var dur time.Duration
+                    if dur, err = fanJog(ip); err == nil {
+                        driveInfo.Warning = fmt.Sprintf("stops automatically after %s", dur)
+                    }
+                case "Start":
+                    if driveStatus == "Tripped" {
+                        err = fanUnTrip(ip)
+                        if err == nil {
+                            err = fanStart(ip)
+                        }
+                    } else {
+                        err = fanStart(ip)
+                    }
+                case "Stop":
+                    err = fanStop(ip)
+                case "Fanhold":
+                    err = fanHold(ip)
+                case "Freespin":
+                    err = fanStop(ip)
+                case "Reverse":
+                    if driveStatus == "Tripped" {
+                        err = fanUnTrip(ip)
+                    }
+                    if err == nil {
+                        err = fanReverse(ip, speed, ack)
+                    }
+                case "SetSpeed":
+                    if coalesceSetSpeed(ip) {
+                        driveInfo.Superseded = true
+                        log.Printf("[COALESCED] IP: %s, SetSpeed %.2f superseded by a newer request", ip, speed)
+                        break
+                    }
+                    d, _ := driveConfig(ip)
+                    speed, clamped := clampSpeed(d, speed)
+                    if rate := rampRate(d); rate > 0 {
+                        // The ramp's first step starts the drive, so it doesn't run up to its old setpoint
+                        if driveStatus == "Tripped" {
+                            err = fanUnTrip(ip)
+                        }
+                        if err == nil {
+                            err = rampFanSpeed(ip, speed, ack, rate)
+                        }
+                        if errors.Is(err, errRampSuperseded) {
+                            driveInfo.Superseded = true
+                            log.Printf("[RAMP] IP: %s, ramp to %.2f superseded by a newer request", ip, speed)
+                            err = nil
+                            break
+                        }
+                    } else {
+                        if driveStatus == "Tripped" {
+                            err = fanUnTrip(ip)
+                            if err == nil {
+                                err = fanStart(ip)
+                            }
+                        } else {
+                            err = fanStart(ip)
+                        }
+                        if err == nil {
+                            err = setFanSpeed(ip, speed, ack)
+                        }
+                    }
+                    if err == nil {
+                        driveInfo.Warning, _ = checkSpeedLimits(d, speed, ack)
+                        driveInfo.Warning = joinWarnings(driveInfo.Warning, clamped)
+                    }
+                }
+                if err != nil {
+                    driveInfo.Success = false
+                    driveInfo.Error = err.Error()
+                    driveInfo.VerifyFailed = errors.Is(err, errWriteNotVerified)
+                    log.Printf("[MODBUS ERROR] IP: %s, Action: %s, Error: %s", ip, action, err.Error())
+                }
+            }
+            mu.Lock()
+            event.Drives = append(event.Drives, driveInfo)
+            mu.Unlock()
+        }(ip)
+    }
+    wg.Wait()
+    return event
+}
+
+// handleCurtail serves GET/POST /api/curtail, GET /api/curtail/sessions and
+// GET /api/curtail/<id>
+func handleCurtail(w http.ResponseWriter, r *http.Request) {
+    // GET returns the most recent curtailment in effect, as before sessions; /sessions
+    // lists them all and /<id> returns one
+    if r.Method == http.MethodGet {
+        sessions, err := loadCurtailments()
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        for _, state := range sessions {
+            if state.Shed != nil {
+                measured := measuredShed(state)
+                state.Shed.MeasuredKW = &measured
+            }
+        }
+        list := sortedCurtailments(sessions)
+        switch id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/curtail"), "/"); id {
+        case "sessions":
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(list)
+        case "":
+            if len(list) == 0 {
+                http.Error(w, "No curtailment in effect", http.StatusNotFound)
+                return
+            }
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(list[len(list)-1])
+        default:
+            state, ok := sessions[id]
+            if !ok {
+                http.Error(w, "No curtailment "+id+" in effect", http.StatusNotFound)
+                return
+            }
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(state)
+        }
+        return
+    }
+    if r.Method != http.MethodPost || r.URL.Path != "/api/curtail" {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+
+    var curtailData struct {
+        Action   string     `json:"action"` // "curtail" or "resume"
+        ID       string     `json:"id,omitempty"` // curtail: the session's ID, default curtail-<time>; resume: the session, needed when several are in effect
+        Groups   []string   `json:"groups"` // Empty means all drives
+        Minutes  int        `json:"minutes,omitempty"`  // curtail: resume automatically after this long
+        ResumeAt *time.Time `json:"resumeAt,omitempty"` // curtail: or at this time
+        TargetHz float64    `json:"targetHz,omitempty"` // curtail: slow running drives to this speed instead of stopping them
+        Percent  float64    `json:"percent,omitempty"`  // curtail: or to this percentage of their speed
+        ShedKW   float64    `json:"shedKW,omitempty"`   // curtail: or slow them down to shed about this much power
+        RotateMinutes int   `json:"rotateMinutes,omitempty"` // curtail: rolling, handing on to the next groups this often
+        RotateCount   int   `json:"rotateCount,omitempty"`   // rolling: groups curtailed at a time, default 1
+    }
+    err := json.NewDecoder(r.Body).Decode(&curtailData)
+    if err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // Validate action
+    if curtailData.Action != "curtail" && curtailData.Action != "resume" {
+        http.Error(w, "Invalid action, must be 'curtail' or 'resume'", http.StatusBadRequest)
+        return
+    }
+
+    resumeAt := curtailData.ResumeAt
+    if curtailData.Minutes != 0 {
+        at := time.Now().Add(time.Duration(curtailData.Minutes) * time.Minute)
+        resumeAt = &at
+    }
+    switch {
+    case curtailData.Action == "resume" && resumeAt != nil:
+        http.Error(w, "minutes and resumeAt only apply to curtail", http.StatusBadRequest)
+        return
+    case curtailData.Minutes != 0 && curtailData.ResumeAt != nil:
+        http.Error(w, "Give minutes or resumeAt, not both", http.StatusBadRequest)
+        return
+    case resumeAt != nil && !resumeAt.After(time.Now()):
+        http.Error(w, "The resume time must be in the future", http.StatusBadRequest)
+        return
+    case (curtailData.TargetHz != 0 && curtailData.Percent != 0) || (curtailData.ShedKW != 0 && curtailData.TargetHz+curtailData.Percent != 0):
+        http.Error(w, "Give one of targetHz, percent and shedKW", http.StatusBadRequest)
+        return
+    case curtailData.TargetHz < 0 || curtailData.Percent < 0 || curtailData.Percent >= 100 || curtailData.ShedKW < 0:
+        http.Error(w, "targetHz and shedKW must be positive and percent between 0 and 100", http.StatusBadRequest)
+        return
+    case curtailData.Action == "resume" && (curtailData.TargetHz != 0 || curtailData.Percent != 0 || curtailData.ShedKW != 0):
+        http.Error(w, "targetHz, percent and shedKW only apply to curtail", http.StatusBadRequest)
+        return
+    case curtailData.ShedKW != 0 && curtailData.RotateMinutes != 0:
+        http.Error(w, "shedKW can't be used with a rolling curtailment", http.StatusBadRequest)
+        return
+    case curtailData.Action == "resume" && (curtailData.RotateMinutes != 0 || curtailData.RotateCount != 0):
+        http.Error(w, "rotateMinutes and rotateCount only apply to curtail", http.StatusBadRequest)
+        return
+    case curtailData.RotateMinutes < 0 || curtailData.RotateCount < 0 || (curtailData.RotateCount > 0 && curtailData.RotateMinutes == 0):
+        http.Error(w, "rotateMinutes must be positive, and rotateCount needs rotateMinutes", http.StatusBadRequest)
+        return
+    }
+    if err := validCurtailmentID(curtailData.ID); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    var target *CurtailTarget
+    if curtailData.TargetHz != 0 || curtailData.Percent != 0 || curtailData.ShedKW != 0 {
+        target = &CurtailTarget{Hz: curtailData.TargetHz, Percent: curtailData.Percent, KW: curtailData.ShedKW}
+    }
+    var rotation *CurtailRotation
+    if curtailData.RotateMinutes > 0 {
+        rotation = &CurtailRotation{Groups: curtailData.Groups, Count: curtailData.RotateCount, EveryMin: curtailData.RotateMinutes}
+        if rotation.Count == 0 {
+            rotation.Count = 1
+        }
+        if err := rotation.validate(); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    sessions, err := loadCurtailments()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    action, ips := "Curtail", []string{}
+    id := curtailData.ID
+    if curtailData.Action == "resume" {
+        action = "Resume"
+        if id, err = resumeTarget(sessions, id); err != nil {
+            status := http.StatusNotFound
+            if len(sessions) > 1 {
+                status = http.StatusConflict
+            }
+            http.Error(w, err.Error(), status)
+            return
+        }
+        if id == drSession() {
+            http.Error(w, "curtailment "+id+" belongs to the demand-response event in progress; end it with POST /api/dr {\"action\": \"end\"}", http.StatusConflict)
+            return
+        }
+        ips = curtailedIPs(sessions[id].Drives)
+    } else {
+        if id == "" {
+            id = "curtail-" + time.Now().UTC().Format("20060102-150405")
+            for n := 2; sessions[id] != nil; n++ {
+                id = fmt.Sprintf("curtail-%s-%d", time.Now().UTC().Format("20060102-150405"), n)
+            }
+        }
+        if _, ok := sessions[id]; ok {
+            http.Error(w, fmt.Sprintf("%v: %s", errCurtailmentExists, id), http.StatusConflict)
+            return
+        }
+        for _, d := range getDrivesForGroups(curtailData.Groups) {
+            ips = append(ips, d.IP)
+        }
+    }
+    if !authorize(w, r, action, ips) {
+        return
+    }
+
+    log.Printf("[CURTAIL] Received %s request for %s, groups: %v", curtailData.Action, id, curtailData.Groups)
+
+    var response map[string]interface{}
+    finished := announce(operatorName(r, ""), action, ips)
+    defer func() {
+        if response == nil {
+            finished("failed")
+        } else {
+            finished(response["message"].(string))
+        }
+    }()
+
+    if curtailData.Action == "curtail" {
+        state, skipped, err := curtailDrives(id, operatorName(r, ""), curtailData.Groups, target, resumeAt, rotation)
+        if errors.Is(err, errCurtailmentExists) {
+            http.Error(w, fmt.Sprintf("%v: %s", err, id), http.StatusConflict)
+            return
+        }
+        if err != nil {
+            log.Printf("[CURTAIL] Error: %v", err)
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        drives := getDrivesForGroups(curtailData.Groups)
+        if rotation != nil {
+            drives = getDrivesForGroups(rotation.active(rotation.Index))
+        }
+        applied := len(drives) - len(skipped.Critical) - len(skipped.Reserved) - len(skipped.Hand) - len(skipped.Elsewhere)
+        response = map[string]interface{}{
+            "success":    true,
+            "id":         id,
+            "message":    fmt.Sprintf("Curtailment %s applied to %d drives", id, applied),
+            "driveCount": applied,
+            "groups":     curtailData.Groups,
+            "timestamp":  time.Now().Format(time.RFC3339),
+        }
+        if resumeAt != nil {
+            response["resumeAt"] = resumeAt.Format(time.RFC3339)
+            log.Printf("[CURTAIL] Resuming automatically at %s", resumeAt.Format(time.RFC3339))
+        }
+        if target != nil {
+            response["target"] = target
+        }
+        if rotation != nil {
+            response["rotation"] = rotation
+        }
+        if state.Shed != nil {
+            response["shed"] = state.Shed
+        }
+        if len(skipped.Critical) > 0 {
+            response["criticalDrives"] = skipped.Critical
+        }
+        if len(skipped.Reserved) > 0 {
+            response["reservedDrives"] = skipped.Reserved
+        }
+        if len(skipped.Hand) > 0 {
+            response["handDrives"] = skipped.Hand
+        }
+        if len(skipped.Elsewhere) > 0 {
+            response["otherSessionDrives"] = skipped.Elsewhere
+        }
+
+        // Log control event
+        event := ControlEvent{
+            Timestamp: time.Now(),
+            Action:    "Curtail",
+            Speed:     0,
+            Drives:    make([]DriveEventInfo, 0),
+        }
+        for _, drive := range drives {
+            info := DriveEventInfo{
+                IP:      drive.IP,
+                Success: true,
+            }
+            if containsString(skipped.Critical, drive.IP) {
+                info.Warning = "critical; never curtailed"
+            }
+            if containsString(skipped.Reserved, drive.IP) {
+                info.Warning = "kept running for airflow reservation"
+            }
+            if containsString(skipped.Hand, drive.IP) {
+                info.Warning = "in hand; left as the operator set it"
+            }
+            if containsString(skipped.Elsewhere, drive.IP) {
+                info.Warning = "held by another curtailment"
+            }
+            event.Drives = append(event.Drives, info)
+        }
+        details := []string{"session " + id}
+        switch {
+        case state.Shed != nil:
+            details = append(details, fmt.Sprintf("running drives slowed to shed %.1f kW (estimated %.1f kW)", state.Shed.TargetKW, state.Shed.EstimatedKW))
+        case target != nil && target.Percent > 0:
+            details = append(details, fmt.Sprintf("running drives slowed to %g%% of their speed", target.Percent))
+        case target != nil:
+            event.Speed = target.Hz
+            details = append(details, fmt.Sprintf("running drives slowed to %.1f Hz", target.Hz))
+        }
+        if rotation != nil {
+            details = append(details, fmt.Sprintf("rotating every %d min, %d of %s at a time, starting with %s", rotation.EveryMin, rotation.Count, strings.Join(rotation.Groups, ","), strings.Join(rotation.active(rotation.Index), ",")))
+        }
+        if resumeAt != nil {
+            details = append(details, "resumes at "+resumeAt.Format(time.RFC3339))
+        }
+        event.Detail = strings.Join(details, "; ")
+        recordControlEvent(event)
+
+    } else { // resume
+        curtailResumeMu.Lock()
+        defer curtailResumeMu.Unlock()
+        // Load state BEFORE resuming (resume clears the file)
+        state, err := loadCurtailmentState(id)
+        if os.IsNotExist(err) {
+            http.Error(w, "No curtailment "+id+" in effect", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            log.Printf("[RESUME] Error loading state: %v", err)
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        driveCount := len(state.Drives)
+        groups := state.Groups
+
+        // Now resume the drives
+        err = resumeDrives(id, "Resume")
+        if err != nil {
+            log.Printf("[RESUME] Error: %v", err)
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        response = map[string]interface{}{
+            "success":    true,
+            "id":         id,
+            "message":    fmt.Sprintf("Resumed %d drives from curtailment %s", driveCount, id),
+            "driveCount": driveCount,
+            "groups":     groups,
+            "timestamp":  time.Now().Format(time.RFC3339),
+        }
+
+        // Log control event
+        recordControlEvent(resumeEvent(state, "Resume", "session "+id))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+    go pollAllDrives()
+}
+
+func handleAppConfig(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "siteName":   appConfig.SiteName,
+        "groupLabel": appConfig.GroupLabel,
+        "bindIP": appConfig.BindIP,
+        "bindPort": appConfig.BindPort,
+        "noFanHold": appConfig.NoFanHold,
+        "featureFlags": enabledFeatureFlags(),
+        "version": Version,
+    })
+}
+
+// HTTP handler to toggle a drive's enabled/disabled state by IP
+func handleVFDConnect(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    var req struct {
+        IP     string   `json:"ip"`
+        IPs    []string `json:"ips"`
+        Action string   `json:"action"` // "connect", "disconnect", or empty for toggle
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    // Determine list of IPs to operate on (bulk or single)
+    targets := make([]string, 0)
+    if len(req.IPs) > 0 {
+        targets = append(targets, req.IPs...)
+    } else if req.IP != "" {
+        targets = append(targets, req.IP)
+    } else {
+        http.Error(w, "Missing 'ip' or 'ips' in request", http.StatusBadRequest)
+        return
+    }
+    targets = resolveDriveRefs(targets)
+    if !authorize(w, r, "VFDConnect", targets) {
+        return
+    }
+
+    // Normalize action for logging and behavior
+    normalized := strings.ToLower(strings.TrimSpace(req.Action))
+    var logAction string
+    switch normalized {
+    case "connect":
+        logAction = "ConnectVFD"
+    case "disconnect":
+        logAction = "DisconnectVFD"
+    default:
+        logAction = "ToggleVFD"
+    }
+
+    // Execute
+    drives := make([]DriveEventInfo, 0, len(targets))
+    for _, ip := range targets {
+        // Apply requested state or toggle
+        var disable bool
+        switch normalized {
+        case "connect":
+            disable = false
+        case "disconnect":
+            disable = true
+        default: // toggle
+            disable = !isDriveDisabled(ip)
+        }
+        setDriveDisabled(ip, disable)
+        if !disable {
+            // Restart the connection manager for this drive (no-op if still running)
+            if d, ok := driveConfig(ip); ok {
+                ensureDriveManager(d)
+            }
+        }
+        drives = append(drives, DriveEventInfo{IP: ip, Success: true})
+    }
+
+    // Persist disabled drives and schedule poll once
+    saveDisabledDrives()
+    go pollAllDrives()
+
+    // Log a single aggregated event
+    recordControlEvent(ControlEvent{
+        Timestamp: time.Now(),
+        Action:    logAction,
+        Drives:    drives,
+    })
+
+    // Response
+    if len(targets) == 1 {
+        if logAction == "ConnectVFD" { w.Write([]byte("Drive enabled")) } else if logAction == "DisconnectVFD" { w.Write([]byte("Drive disabled")) } else { w.Write([]byte("Drive toggled")) }
+    } else {
+        w.Write([]byte(fmt.Sprintf("Bulk %s applied to %d drives", logAction, len(targets))))
+    }
+}
+
+// =====================
+// Access Control
+// =====================
+
+// allowNets is built once at startup from appConfig.AllowLists and is read-only afterwards.
+var allowNets map[string][]*net.IPNet
+
+// APIToken is a named bearer token. It names the requester for the policies and the log;
+// it does not get a request past the allow-lists, which are checked first, so a leaked
+// token is no use from outside them. A wrong token is refused.
+type APIToken struct {
+    Name  string `json:"Name"`
+    Token string `json:"Token"`
+}
+
+// apiTokens is set once at startup from appConfig.APITokens and is read-only afterwards.
+var apiTokens []APIToken
+
+// checkAPITokens rejects tokens without a name, short tokens and duplicates
+func checkAPITokens(tokens []APIToken) error {
+    names := make(map[string]bool)
+    values := make(map[string]bool)
+    for _, t := range tokens {
+        if strings.TrimSpace(t.Name) == "" {
+            return fmt.Errorf("APITokens: token without a Name")
+        }
+        if len(t.Token) < 16 {
+            return fmt.Errorf("APITokens %s: Token must be at least 16 characters", t.Name)
+        }
+        if t.Name == anonymousRequester {
+            return fmt.Errorf("APITokens: %q is reserved for requests without a token", t.Name)
+        }
+        if t.Name == natsRequester || t.Name == knxRequester {
+            return fmt.Errorf("APITokens: %q is reserved for bus control requests", t.Name)
+        }
+        if names[t.Name] || values[t.Token] {
+            return fmt.Errorf("APITokens %s: duplicate Name or Token", t.Name)
+        }
+        names[t.Name], values[t.Token] = true, true
+    }
+    return nil
+}
+
+// bearerToken returns the name of the token an Authorization header carries. ok is false
+// without a bearer token; name is empty when the token matches none.
+func bearerToken(tokens []APIToken, header string) (name string, ok bool) {
+    const prefix = "Bearer "
+    if len(tokens) == 0 || !strings.HasPrefix(header, prefix) {
+        return "", false
+    }
+    got := []byte(strings.TrimSpace(header[len(prefix):]))
+    for _, t := range tokens {
+        if subtle.ConstantTimeCompare(got, []byte(t.Token)) == 1 {
+            return t.Name, true
+        }
+    }
+    return "", true
+}
+
+// parseAllowLists converts the configured IP/CIDR strings into networks.
+// Bare IPs are treated as single-host networks.
+func parseAllowLists(lists map[string][]string) (map[string][]*net.IPNet, error) {
+    nets := make(map[string][]*net.IPNet, len(lists))
+    for path, entries := range lists {
+        for _, entry := range entries {
+            entry = strings.TrimSpace(entry)
+            if !strings.Contains(entry, "/") {
+                ip := net.ParseIP(entry)
+                if ip == nil {
+                    return nil, fmt.Errorf("allow-list %s: invalid IP %q", path, entry)
+                }
+                bits := 32
+                if ip.To4() == nil {
+                    bits = 128
+                }
+                entry = fmt.Sprintf("%s/%d", ip.String(), bits)
+            }
+            _, ipNet, err := net.ParseCIDR(entry)
+            if err != nil {
+                return nil, fmt.Errorf("allow-list %s: invalid CIDR %q: %w", path, entry, err)
+            }
+            nets[path] = append(nets[path], ipNet)
+        }
+    }
+    return nets, nil
+}
+
+// sourceAllowed reports whether remoteAddr may access path. Paths without an
+// entry fall back to the "*" entry; with neither, access is unrestricted.
+func sourceAllowed(nets map[string][]*net.IPNet, path, remoteAddr string) bool {
+    allowed, ok := nets[path]
+    if !ok {
+        allowed, ok = nets["*"]
+    }
+    if !ok {
+        return true
+    }
+    host, _, err := net.SplitHostPort(remoteAddr)
+    if err != nil {
+        host = remoteAddr
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return false
+    }
+    for _, n := range allowed {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// withAllowList wraps a handler with the source allow-list for its route pattern
+func withAllowList(pattern string, h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !sourceAllowed(allowNets, pattern, r.RemoteAddr) {
+            log.Printf("[ACCESS DENIED] %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+            http.Error(w, "Forbidden", http.StatusForbidden)
+            return
+        }
+        if name, ok := bearerToken(apiTokens, r.Header.Get("Authorization")); ok {
+            if name == "" {
+                log.Printf("[ACCESS DENIED] %s %s from %s: invalid API token", r.Method, r.URL.Path, r.RemoteAddr)
+                http.Error(w, "Invalid API token", http.StatusUnauthorized)
+                return
+            }
+            if r.Method != http.MethodGet {
+                log.Printf("[API TOKEN] %s: %s %s from %s", name, r.Method, r.URL.Path, r.RemoteAddr)
+            }
+            h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requesterKey{}, name)))
+            return
+        }
+        h.ServeHTTP(w, r)
+    })
+}
+
+// handleFunc registers a handler on mux behind the allow-list for its pattern
+func handleFunc(mux *http.ServeMux, pattern string, h http.HandlerFunc) {
+    mux.Handle(pattern, withAllowList(pattern, h))
+}
+
+// =====================
+// Authorization Policies
+// =====================
+// Policies restrict what a requester may do to drives (/api/control, /api/curtail, ...) beyond
+// the allow-lists, e.g. "contractor tokens may only SetSpeed drives in group TEST between
+// 09:00 and 17:00, at most 3 drives at a time". The requester is the name of the request's
+// API token, or "anonymous" for allow-listed requests without one. A request is checked
+// against the policies whose Who matches its requester: any matching deny policy refuses
+// it, and if allow policies apply, one of them must match. Requesters no allow policy names
+// are otherwise unrestricted, so adding a policy for contractors leaves operators as they
+// were. The emergency stop is never subject to policies. POST /api/admin/policies/test
+// evaluates a hypothetical request, against the configured policies or a candidate set,
+// without running anything.
+//
+// These routes are checked, against their target drives: /api/control, /api/curtail,
+// /api/dr, /api/schedules (create, and enabling a schedule, against the schedule's action
+// and targets), /api/soak, /api/hand ("Hand"/"Auto"), /api/rotation ("Rotate"), /api/purge
+// (start and clear, against the purge groups' drives), /api/tagouts (tag and release) and
+// POST /api/dcim/<room> (the room's group). Admin changes are checked as their own actions:
+// /api/vfdconnect ("VFDConnect", its drives), /api/drive-swap ("DriveSwap", the old
+// drive), /api/profiles writes ("Profiles", the drives using the profile) and
+// /api/config-sync/approve ("ConfigSync", no drives), so a deny policy can keep a token
+// away from them. SetCfm targets are set through /api/control; /api/cfm-targets only lists
+// them. Bus control has no token, so NATS and KNX requests are checked as the fixed
+// requesters "nats" and "knx": a policy naming them (or "*") restricts the bus like any
+// token.
+const (
+    anonymousRequester = "anonymous"
+    natsRequester      = "nats"
+    knxRequester       = "knx"
+)
+
+type AuthPolicy struct {
+    Name      string   `json:"Name"`
+    Effect    string   `json:"Effect,omitempty"`    // "allow" (default) or "deny"
+    Who       []string `json:"Who"`                 // token names or patterns ("contractor-*"), "anonymous", "nats", "knx", or "*" for everyone
+    Actions   []string `json:"Actions,omitempty"`   // control actions or policyActions; empty: every action
+    Groups    []string `json:"Groups,omitempty"`    // allow: every target drive must be in one; deny: any target drive in one; empty: any drive
+    Start     string   `json:"Start,omitempty"`     // "09:00", server local time; empty: any time
+    End       string   `json:"End,omitempty"`       // "17:00"; earlier than Start runs past midnight
+    Days      []string `json:"Days,omitempty"`      // "Mon".."Sun"; empty: every day
+    MaxDrives int      `json:"MaxDrives,omitempty"` // allow: most drives in one request; 0: no limit
+}
+
+// PolicyRequest is what a policy decision is made on
+type PolicyRequest struct {
+    Who    string    `json:"who"`
+    Action string    `json:"action"`
+    Drives []string  `json:"drives"` // target drive IPs
+    Groups []string  `json:"groups"` // their groups
+    At     time.Time `json:"at"`
+}
+
+// PolicyCheck is one applicable policy's verdict on a request
+type PolicyCheck struct {
+    Policy  string `json:"policy"`
+    Effect  string `json:"effect"`
+    Matched bool   `json:"matched"`
+    Reason  string `json:"reason,omitempty"` // why it didn't match
+}
+
+type PolicyDecision struct {
+    Allowed bool          `json:"allowed"`
+    Policy  string        `json:"policy,omitempty"` // the deciding policy
+    Reason  string        `json:"reason"`
+    Checks  []PolicyCheck `json:"checks"`
+}
+
+var vfdPolicyDenials = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Namespace: "vfd",
+        Name:      "policy_denials_total",
+        Help:      "Requests refused by an authorization policy, by requester",
+    },
+    []string{"who"},
+)
+
+func init() {
+    prometheus.MustRegister(vfdPolicyDenials)
+}
+
+// policyActions are the actions policies can name besides the control actions: presets,
+// airflow, curtailment, soak tests, hand/auto, manual rotation, purge, tagouts and DCIM
+// rooms, then the admin actions
+var policyActions = []string{"ApplyPreset", "SetCfm", "Curtail", "Resume", "Soak", "Hand", "Auto", "Rotate", "Purge", "Tagout", "DCIM",
+    "VFDConnect", "DriveSwap", "Profiles", "ConfigSync"}
+
+func validatePolicies(list []AuthPolicy, drives []DriveConfig) error {
+    groups := make(map[string]bool)
+    for _, d := range drives {
+        groups[d.Group] = true
+    }
+    names := make(map[string]bool)
+    for _, p := range list {
+        if strings.TrimSpace(p.Name) == "" || names[p.Name] {
+            return fmt.Errorf("Policies: every policy needs a unique Name (%q)", p.Name)
+        }
+        names[p.Name] = true
+        if p.Effect != "" && p.Effect != "allow" && p.Effect != "deny" {
+            return fmt.Errorf("Policies %s: Effect must be \"allow\" or \"deny\", not %q", p.Name, p.Effect)
+        }
+        if len(p.Who) == 0 {
+            return fmt.Errorf("Policies %s: Who is required", p.Name)
+        }
+        for _, who := range p.Who {
+            if _, err := path.Match(who, ""); err != nil || who == "" {
+                return fmt.Errorf("Policies %s: invalid Who %q", p.Name, who)
+            }
+        }
+        for _, a := range p.Actions {
+            if !isValidControlAction(a) && !containsString(policyActions, a) {
+                return fmt.Errorf("Policies %s: unknown action %q", p.Name, a)
+            }
+        }
+        for _, g := range p.Groups {
+            if !groups[g] {
+                return fmt.Errorf("Policies %s: group %q has no drives", p.Name, g)
+            }
+        }
+        if (p.Start == "") != (p.End == "") {
+            return fmt.Errorf("Policies %s: give both Start and End, or neither", p.Name)
+        }
+        if p.Start != "" {
+            start, err := parseClock(p.Start)
+            if err != nil {
+                return fmt.Errorf("Policies %s: Start %v", p.Name, err)
+            }
+            end, err := parseClock(p.End)
+            if err != nil {
+                return fmt.Errorf("Policies %s: End %v", p.Name, err)
+            }
+            if start == end {
+                return fmt.Errorf("Policies %s: Start and End are the same", p.Name)
+            }
+        }
+        for _, day := range p.Days {
+            if _, ok := weekdayNames[day]; !ok {
+                return fmt.Errorf("Policies %s: unknown day %q (use Mon..Sun)", p.Name, day)
+            }
+        }
+        if p.MaxDrives < 0 || (p.MaxDrives > 0 && p.Effect == "deny") {
+            return fmt.Errorf("Policies %s: MaxDrives must be positive, and only applies to allow policies", p.Name)
+        }
+    }
+    return nil
+}
+
+func (p AuthPolicy) appliesTo(who string) bool {
+    for _, pattern := range p.Who {
+        if ok, _ := path.Match(pattern, who); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// inWindow reports whether at falls in the policy's time window, which is checked like a
+// quiet-hours window
+func (p AuthPolicy) inWindow(at time.Time) bool {
+    q := QuietHoursConfig{Start: p.Start, End: p.End, Days: p.Days}
+    if p.Start == "" {
+        return q.onDay(at.Weekday())
+    }
+    _, _, ok := q.window(at)
+    return ok
+}
+
+// mismatch returns why the policy doesn't match the request, or "" if it does
+func (p AuthPolicy) mismatch(req PolicyRequest) string {
+    if len(p.Actions) > 0 && !containsString(p.Actions, req.Action) {
+        return fmt.Sprintf("action %s is not one of %v", req.Action, p.Actions)
+    }
+    if !p.inWindow(req.At) {
+        window := p.Start + "-" + p.End
+        if p.Start == "" {
+            window = "any time"
+        }
+        if len(p.Days) > 0 {
+            window += " on " + strings.Join(p.Days, ",")
+        }
+        return fmt.Sprintf("%s is outside %s", req.At.Format("Mon 15:04"), window)
+    }
+    if len(p.Groups) > 0 {
+        var outside []string
+        for _, g := range req.Groups {
+            if !containsString(p.Groups, g) {
+                outside = append(outside, g)
+            }
+        }
+        if p.Effect == "deny" && len(outside) == len(req.Groups) {
+            return fmt.Sprintf("no target drive is in %v", p.Groups)
+        }
+        if p.Effect != "deny" && len(outside) > 0 {
+            return fmt.Sprintf("group %s is not one of %v", strings.Join(outside, ","), p.Groups)
+        }
+    }
+    if p.MaxDrives > 0 && len(req.Drives) > p.MaxDrives {
+        return fmt.Sprintf("%d drives is more than %d", len(req.Drives), p.MaxDrives)
+    }
+    return ""
+}
+
+// evaluatePolicies decides a request: a matching deny policy refuses it, otherwise the
+// first matching allow policy permits it. Without applicable allow policies it is allowed.
+func evaluatePolicies(list []AuthPolicy, req PolicyRequest) PolicyDecision {
+    dec := PolicyDecision{Checks: []PolicyCheck{}}
+    var allowedBy string
+    restricted := false // an allow policy applies, so one must match
+    for _, p := range list {
+        if !p.appliesTo(req.Who) {
+            continue
+        }
+        effect := p.Effect
+        if effect == "" {
+            effect = "allow"
+        }
+        restricted = restricted || effect == "allow"
+        reason := p.mismatch(req)
+        dec.Checks = append(dec.Checks, PolicyCheck{Policy: p.Name, Effect: effect, Matched: reason == "", Reason: reason})
+        if reason != "" {
+            continue
+        }
+        if effect == "deny" {
+            dec.Policy, dec.Reason = p.Name, fmt.Sprintf("denied by policy %s", p.Name)
+            return dec
+        }
+        if allowedBy == "" {
+            allowedBy = p.Name
+        }
+    }
+    switch {
+    case !restricted:
+        dec.Allowed, dec.Reason = true, "no allow policy applies to "+req.Who
+    case allowedBy != "":
+        dec.Allowed, dec.Policy, dec.Reason = true, allowedBy, "allowed by policy "+allowedBy
+    default:
+        var why []string
+        for _, c := range dec.Checks {
+            why = append(why, c.Policy+": "+c.Reason)
+        }
+        dec.Reason = "no policy allows it (" + strings.Join(why, "; ") + ")"
+    }
+    return dec
+}
+
+type requesterKey struct{}
+
+// requester returns the name of the request's API token, or "anonymous"
+func requester(r *http.Request) string {
+    if name, ok := r.Context().Value(requesterKey{}).(string); ok {
+        return name
+    }
+    return anonymousRequester
+}
+
+// policyRequest describes an action on the given drive IPs
+func policyRequest(who, action string, ips []string, at time.Time) PolicyRequest {
+    req := PolicyRequest{Who: who, Action: action, Drives: ips, Groups: []string{}, At: at}
+    for _, ip := range ips {
+        if d, ok := driveConfig(ip); ok && !containsString(req.Groups, d.Group) {
+            req.Groups = append(req.Groups, d.Group)
+        }
+    }
+    return req
+}
+
+// checkPolicies decides an action by who on the given drives, logging and counting a
+// refusal; from says where the request came from
+func checkPolicies(who, action string, ips []string, from string) PolicyDecision {
+    if len(appConfig.Policies) == 0 {
+        return PolicyDecision{Allowed: true, Reason: "no policies configured"}
+    }
+    req := policyRequest(who, action, ips, time.Now())
+    dec := evaluatePolicies(appConfig.Policies, req)
+    if !dec.Allowed {
+        log.Printf("[ACCESS DENIED] %s %s on %v from %s: %s", who, action, ips, from, dec.Reason)
+        vfdPolicyDenials.WithLabelValues(who).Inc()
+    }
+    return dec
+}
+
+// authorize checks an action on the given drives against the policies, and answers 403
+// if they refuse it
+func authorize(w http.ResponseWriter, r *http.Request, action string, ips []string) bool {
+    who := requester(r)
+    dec := checkPolicies(who, action, ips, r.RemoteAddr)
+    if dec.Allowed {
+        return true
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusForbidden)
+    json.NewEncoder(w).Encode(map[string]interface{}{"error": "Refused by authorization policy", "who": who, "reason": dec.Reason, "policy": dec.Policy})
+    return false
+}
+
+// controlTargets returns the drive IPs a /api/control request acts on
+func controlTargets(action, preset string, drives, groups []string) []string {
+    var ips []string
+    add := func(ip string) {
+        if !containsString(ips, ip) {
+            ips = append(ips, ip)
+        }
+    }
+    switch {
+    case action == "ApplyPreset":
+        p, _ := presetByName(preset)
+        for _, d := range configuredDrives() {
+            if _, ok := p.Groups[d.Group]; ok {
+                add(d.IP)
+            }
+        }
+        for ref := range p.Drives {
+            add(driveRefIP(ref, configuredDrives()))
+        }
+    case action == "SetCfm" && len(groups) > 0:
+        for _, d := range getDrivesForGroups(groups) {
+            add(d.IP)
+        }
+    default:
+        for _, ip := range resolveDriveRefs(drives) {
+            add(ip)
+        }
+    }
+    return ips
+}
+
+// handlePolicies serves GET /api/admin/policies, and POST /api/admin/policies/test, which
+// evaluates {"who", "action", "drives", "groups", "at"} against the configured policies or
+// against "policies" when given, so a change can be tried before it is deployed
+func handlePolicies(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/policies"), "/") {
+    case "":
+        if r.Method != http.MethodGet {
+            http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+            return
+        }
+        policies := appConfig.Policies
+        if policies == nil {
+            policies = []AuthPolicy{}
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"enforced": len(policies) > 0, "policies": policies})
+    case "test":
+        if r.Method != http.MethodPost {
+            http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+            return
+        }
+        var req struct {
+            Who      string        `json:"who"`
+            Action   string        `json:"action"`
+            Drives   []string      `json:"drives"`
+            Groups   []string      `json:"groups"`
+            At       *time.Time    `json:"at"`
+            Policies *[]AuthPolicy `json:"policies"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        if !isValidControlAction(req.Action) && !containsString(policyActions, req.Action) {
+            http.Error(w, "Unknown action: "+req.Action, http.StatusBadRequest)
+            return
+        }
+        policies := appConfig.Policies
+        if req.Policies != nil {
+            if err := validatePolicies(*req.Policies, configuredDrives()); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            policies = *req.Policies
+        }
+        if req.Who == "" {
+            req.Who = requester(r)
+        }
+        at := time.Now()
+        if req.At != nil {
+            at = req.At.In(time.Local)
+        }
+        ips := controlTargets(req.Action, "", req.Drives, nil)
+        for _, d := range getDrivesForGroups(req.Groups) {
+            if len(req.Groups) > 0 && !containsString(ips, d.IP) {
+                ips = append(ips, d.IP)
+            }
+        }
+        for _, ip := range ips {
+            if _, ok := driveConfig(ip); !ok {
+                http.Error(w, "Unknown drive: "+ip, http.StatusNotFound)
+                return
+            }
+        }
+        preq := policyRequest(req.Who, req.Action, ips, at)
+        json.NewEncoder(w).Encode(map[string]interface{}{"request": preq, "decision": evaluatePolicies(policies, preq)})
+    default:
+        http.Error(w, "Not found", http.StatusNotFound)
+    }
+}
+
+// =====================
+// System Status API
+// =====================
+func handleSystemStatus(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    
+    statusMutex.RLock()
+    vfdConnectionsMu.RLock()
+    vfdDataMutex.RLock()
+    
+    // Calculate current system status
+    drives := configuredDrives()
+    totalVFDs := len(drives)
+    connectedVFDs := 0
+    healthyVFDs := 0
+    
+    for _, vfd := range drives {
+        if conn, exists := vfdConnections[vfd.IP]; exists {
+            if conn.healthy.Load() {
+                connectedVFDs++
+                healthyVFDs++
+            }
+        }
+    }
+    
+    // Update system status
+    status := systemStatus
+    status.TotalVFDs = totalVFDs
+    status.ConnectedVFDs = connectedVFDs
+    status.HealthyVFDs = healthyVFDs
+    
+	// Consider system ready if initial connections are done and we have some VFD data
+	status.Ready = status.InitialConnectionsDone && len(vfdData) > 0
+	status.Loading = !status.Ready
+	
+	// Calculate data collection age properly
+	if !status.LastUpdateTime.IsZero() {
+		status.DataCollectionAge = time.Since(status.LastUpdateTime)
+	} else {
+		status.DataCollectionAge = 0
+	}
+	
+	vfdDataMutex.RUnlock()
+	vfdConnectionsMu.RUnlock()
+	statusMutex.RUnlock()
+	status.Health = currentHealth()
+	
+	json.NewEncoder(w).Encode(status)
+}
+
+// =====================
+// Devices API
+// =====================
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    // ?raw=1 adds each drive's raw register values and scaling expressions, for debugging scaling
+    withRaw, _ := strconv.ParseBool(r.URL.Query().Get("raw"))
+    withRaw = withRaw && featureEnabled("devices-raw-view")
+    writeConns := writeConnectionStates()
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+    // vfdData is []map[string]interface{} with live data
+    // appConfig.VFDs is []DriveConfig with static config
+    // Merge config and live data by IP
+    drives := make([]map[string]interface{}, 0, len(vfdData))
+    for _, live := range vfdData {
+        drive := make(map[string]interface{})
+        ip, _ := live["ip"].(string)
+        config, ok := driveConfig(ip)
+        if ok {
+            drive["DriveType"] = config.DriveType
+        }
+        // Add live data
+        for k, v := range live {
+            drive[k] = v
+        }
+        id, _ := live["id"].(string)
+        if st, ok := driveStatsSnapshot(id); ok {
+            drive["stats"] = map[string]interface{}{
+                "totalStarts":             st.Starts,
+                "totalTrips":              st.Trips,
+                "totalUnavailableMinutes": math.Round(st.UnavailableSeconds/60*10) / 10,
+                "totalKWh":                math.Round(st.EnergyKWh*100) / 100,
+                "energySource":            st.EnergySource,
+                "totalRunHours":           math.Round(st.RunSeconds/3600*10) / 10,
+                "since":                   st.Since.Format(time.RFC3339),
+            }
+        }
+        if config != nil {
+            st, _ := driveStatsSnapshot(id)
+            drive["maintenance"] = driveMaintenance(*config, st)
+        }
+        if det, ok := driveDetection(ip); ok {
+            drive["detection"] = det
+        }
+        if state, ok := writeConns[ip]; ok {
+            drive["writeConnection"] = state
+        }
+        if withRaw && ok {
+            drive["raw"] = rawDebugView(config)
+        }
+        drives = append(drives, drive)
+    }
+    json.NewEncoder(w).Encode(drives)
+}
+
+// =====================
+// Register Map
+// =====================
+// /api/devices/<ip>/registermap lists every register and coil the server reads or writes
+// for a drive, with function codes, wire addresses and scaling, next to the raw values from
+// its last successful poll, so commissioning can check them against the drive manual.
+
+// RawReading is a drive's register values from its last successful poll, as fed to the
+// scaling expressions (Setpoint and OutputFrequency as magnitudes)
+type RawReading struct {
+    Time   time.Time
+    Values map[string]float64 // calcFieldVars, "enabledStatus" and extra register names -> raw value
+}
+
+var (
+    rawReadingsMu sync.RWMutex
+    rawReadings   = make(map[string]RawReading)
+)
+
+func recordRawReading(ip string, values map[string]float64, now time.Time) {
+    rawReadingsMu.Lock()
+    defer rawReadingsMu.Unlock()
+    rawReadings[ip] = RawReading{Time: now, Values: values}
+}
+
+func rawReading(ip string) (RawReading, bool) {
+    rawReadingsMu.RLock()
+    defer rawReadingsMu.RUnlock()
+    r, ok := rawReadings[ip]
+    return r, ok
+}
+
+// RegisterMapEntry is one register or coil access. A register both read and written
+// (Setpoint) has an entry per direction.
+type RegisterMapEntry struct {
+    Field        string   `json:"field"`
+    Access       string   `json:"access"`       // "read" or "write"
+    FunctionCode int      `json:"functionCode"` // Modbus FC: 1/2 coils, 3/4 registers, 5 coil write, 6/16 register write
+    Address      int      `json:"address"`      // as written in the profile
+    WireAddress  int      `json:"wireAddress"`  // protocol address after AddressBase
+    Words        int      `json:"words,omitempty"`
+    WordOrder    string   `json:"wordOrder,omitempty"` // 32-bit fields only
+    Signed       bool     `json:"signed,omitempty"`
+    Scaling      string   `json:"scaling,omitempty"` // expression; reads scale raw -> value, writes Hz -> raw
+    Unit         string   `json:"unit,omitempty"`
+    Values       map[string]int `json:"values,omitempty"` // written values (StartValue, ...) or status bits
+    Raw          *float64 `json:"raw,omitempty"`   // last polled raw value
+    Value        *float64 `json:"value,omitempty"` // Raw after scaling
+}
+
+// registerMap describes a profile's register accesses in poll order followed by writes.
+// raw holds the last poll's values (nil before the first poll).
+func registerMap(p DriveTypeProfile, raw map[string]float64) []RegisterMapEntry {
+    var entries []RegisterMapEntry
+    useInput := p.RegisterType == "input"
+    vars := p.calcVars(raw)
+    register := func(field, rawKey, access string, addr, fc int, signed bool, scaling string) RegisterMapEntry {
+        e := RegisterMapEntry{Field: field, Access: access, FunctionCode: fc, Address: addr, WireAddress: p.wireAddr(field, addr), Words: 1, Signed: signed, Scaling: scaling}
+        if p.isDoubleWord(field) {
+            e.Words = 2
+            e.WordOrder = "big"
+            if p.lowWordFirst(field) {
+                e.WordOrder = "little"
+            }
+            if fc == 6 {
+                e.FunctionCode = 16
+            }
+        }
+        if v, ok := raw[rawKey]; ok && rawKey != "" {
+            e.Raw = &v
+            if access == "read" && scaling != "" {
+                scaled := applyCalc(scaling, v, vars)
+                e.Value = &scaled
+            }
+        }
+        return e
+    }
+    readFC := func(field string, def bool) int {
+        if p.inputRegister(field, def) {
+            return 4
+        }
+        return 3
+    }
+    coil := func(field string, addr, fc int, access string) RegisterMapEntry {
+        return RegisterMapEntry{Field: field, Access: access, FunctionCode: fc, Address: addr, WireAddress: p.wireAddr(field, addr)}
+    }
+
+    if len(p.StatusCoils) > 0 {
+        fc := 1
+        if p.CoilStatusType == "discrete" {
+            fc = 2
+        }
+        names := make([]string, 0, len(p.StatusCoils))
+        for name := range p.StatusCoils {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            entries = append(entries, coil("StatusCoils."+name, p.StatusCoils[name], fc, "read"))
+        }
+    } else {
+        e := register("Status", "status", "read", p.Status, readFC("Status", useInput), false, "")
+        e.Values = p.StatusBits
+        entries = append(entries, e)
+    }
+    if p.EnabledStatus > 0 {
+        entries = append(entries, register("EnabledStatus", "enabledStatus", "read", p.EnabledStatus, readFC("EnabledStatus", useInput), false, ""))
+    }
+    setpointCalc := p.OutFreqCalc
+    if p.SetpointReadCalc != "" {
+        setpointCalc = p.SetpointReadCalc
+    }
+    if len(p.Setpoint) > 0 {
+        entries = append(entries, register("Setpoint", "setpoint", "read", p.Setpoint[0], readFC("Setpoint", useInput), p.SignedSetpoint, setpointCalc))
+    }
+    outInput := useInput && !p.SignedOutputFreq
+    entries = append(entries, register("OutputFrequency", "outputFrequency", "read", p.OutputFrequency, readFC("OutputFrequency", outInput), p.SignedOutputFreq, p.OutFreqCalc))
+    entries = append(entries, register("OutputCurrent", "outputCurrent", "read", p.OutputCurrent, readFC("OutputCurrent", useInput), false, p.OutCurrentCalc))
+    if p.OutputPower > 0 {
+        entries = append(entries, register("OutputPower", "outputPower", "read", p.OutputPower, readFC("OutputPower", useInput), true, p.OutPowerCalc))
+    }
+    if p.FaultCode > 0 {
+        entries = append(entries, register("FaultCode", "faultCode", "read", p.FaultCode, readFC("FaultCode", useInput), false, ""))
+    }
+    if p.EnergyCounter > 0 {
+        entries = append(entries, register("EnergyCounter", "energyCounter", "read", p.EnergyCounter, readFC("EnergyCounter", useInput), false, p.EnergyCalc))
+    }
+    for _, er := range p.ExtraRegisters {
+        input := useInput
+        if er.Type != "" {
+            input = er.Type == "input"
+        }
+        e := register(er.Name, er.Name, "read", er.Register, readFC(er.Name, input), er.Signed, er.Calc)
+        e.Unit = er.Unit
+        entries = append(entries, e)
+    }
+    entries = append(entries, register("ProbeRegister", "", "read", p.ProbeRegister, 3, false, ""))
+    if p.Identify != nil && p.Identify.Register != nil {
+        entries = append(entries, register("Identify", "", "read", *p.Identify.Register, 3, false, ""))
+    }
+
+    if len(p.Setpoint) > 0 {
+        entries = append(entries, register("Setpoint", "", "write", p.Setpoint[0], 6, p.SignedSetpoint, p.SetFreqCalc))
+    }
+    if len(p.Setpoint) > 1 {
+        e := register("Setpoint", "", "write", p.Setpoint[1], 6, p.SignedSetpoint, p.SetFreqCalc)
+        e.Field = "SetpointPreset"
+        e.Values = map[string]int{"SpeedPresetMultiplier": p.SpeedPresetMultiplier}
+        entries = append(entries, e)
+    }
+    if p.StartCoil != nil {
+        entries = append(entries, coil("StartCoil", *p.StartCoil, 5, "write"))
+        if p.StopCoil != nil {
+            entries = append(entries, coil("StopCoil", *p.StopCoil, 5, "write"))
+        }
+    } else {
+        e := register("Control", "", "write", p.Control, 6, false, "")
+        e.Values = map[string]int{"StartValue": p.StartValue, "StopValue": p.StopValue}
+        if p.ReverseValue != 0 {
+            e.Values["ReverseValue"] = p.ReverseValue
+        }
+        if p.UnTripRegister == 0 && p.UnTripCoil == nil {
+            e.Values["UnTripValue"] = p.UnTripValue
+        }
+        entries = append(entries, e)
+    }
+    if p.UnTripCoil != nil {
+        entries = append(entries, coil("UnTripCoil", *p.UnTripCoil, 5, "write"))
+    } else if p.UnTripRegister > 0 {
+        e := register("UnTripRegister", "", "write", p.UnTripRegister, 6, false, "")
+        e.Values = map[string]int{"UnTripValue": p.UnTripValue}
+        entries = append(entries, e)
+    }
+    if p.EnterRegister > 0 {
+        e := register("EnterRegister", "", "write", p.EnterRegister, 6, false, "")
+        e.Values = map[string]int{"EnterValue": p.EnterValue}
+        entries = append(entries, e)
+    }
+    return entries
+}
+
+// rawDebugView is a drive's last polled raw values next to the expressions that scale them
+func rawDebugView(d *DriveConfig) map[string]interface{} {
+    view := map[string]interface{}{}
+    if reading, ok := rawReading(d.IP); ok {
+        view["lastRead"] = reading.Time.Format(time.RFC3339)
+        view["values"] = reading.Values
+    }
+    if p, ok := driveProfile(d); ok {
+        setpointCalc := p.OutFreqCalc
+        if p.SetpointReadCalc != "" {
+            setpointCalc = p.SetpointReadCalc
+        }
+        // An empty expression scales by / 10 (legacy default); show what actually runs
+        orDefault := func(expr string) string {
+            if strings.TrimSpace(expr) == "" {
+                return "/ 10"
+            }
+            return expr
+        }
+        scaling := map[string]string{
+            "setpoint":        orDefault(setpointCalc),
+            "outputFrequency": orDefault(p.OutFreqCalc),
+            "outputCurrent":   orDefault(p.OutCurrentCalc),
+            "setpointWrite":   orDefault(p.SetFreqCalc),
+        }
+        if p.OutputPower > 0 {
+            scaling["outputPower"] = orDefault(p.OutPowerCalc)
+        }
+        for _, er := range p.ExtraRegisters {
+            if er.Calc != "" {
+                scaling[er.Name] = er.Calc
+            }
+        }
+        view["scaling"] = scaling
+    }
+    return view
+}
+
+// handleDeviceRoutes serves the per-drive routes under /api/devices/<id or ip>/
+func handleDeviceRoutes(w http.ResponseWriter, r *http.Request) {
+    ref, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/"), "/")
+    ip := driveRefIP(ref, configuredDrives())
+    if sub == "baseline" {
+        handleDriveBaseline(w, r, ref, ip)
+        return
+    }
+    if sub != "registermap" {
+        http.NotFound(w, r)
+        return
+    }
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    d, ok := driveConfig(ip)
+    if !ok {
+        http.Error(w, "Unknown drive: "+ref, http.StatusNotFound)
+        return
+    }
+    profile, ok := driveProfile(d)
+    if !ok {
+        http.Error(w, "Unknown drive type profile: "+d.DriveType, http.StatusNotFound)
+        return
+    }
+    resp := map[string]interface{}{
+        "id":           d.ID,
+        "ip":           ip,
+        "driveType":    d.DriveType,
+        "registerType": profile.RegisterType,
+        "addressBase":  profile.AddressBase,
+    }
+    if len(d.ProfileOverrides) > 0 {
+        resp["profileOverrides"] = d.ProfileOverrides
+    }
+    var raw map[string]float64
+    if reading, ok := rawReading(ip); ok {
+        raw = reading.Values
+        resp["lastRead"] = reading.Time.Format(time.RFC3339)
+    }
+    resp["registers"] = registerMap(profile, raw)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(resp)
+}
+
+// handleDriveBaseline serves /api/devices/<drive>/baseline: GET shows the learned
+// baseline and latest scores, DELETE starts learning over
+func handleDriveBaseline(w http.ResponseWriter, r *http.Request, ref, ip string) {
+    d, ok := driveConfig(ip)
+    if !ok {
+        http.Error(w, "Unknown drive: "+ref, http.StatusNotFound)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(baselineView(d, time.Now()))
+    case http.MethodDelete:
+        if !resetBaseline(d) {
+            http.Error(w, "No baseline learned for "+ref, http.StatusNotFound)
+            return
+        }
+        log.Printf("[BASELINE] %s: baseline reset from %s; learning again", d.IP, r.RemoteAddr)
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// readOnly refuses everything but GET, for shared handlers on the read-only listener
+func readOnly(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// =====================
+// Drive Statistics
+// =====================
+
+// DriveStats are cumulative per-drive totals since install, persisted across restarts
+type DriveStats struct {
+    Starts             int64     `json:"starts"`
+    Trips              int64     `json:"trips"`
+    UnavailableSeconds float64   `json:"unavailableSeconds"`
+    EnergyKWh          float64   `json:"energyKWh"`
+    RunSeconds         float64   `json:"runSeconds"`
+    TrippedSeconds     float64   `json:"trippedSeconds"` // time spent Tripped before being cleared (repair time)
+    Recoveries         int64     `json:"recoveries"`     // trips that were cleared back to a healthy state
+    Since              time.Time `json:"since"`          // when tracking began for this drive
+    EnergySource       string    `json:"energySource,omitempty"` // "meter" (EnergyCounter), "power" (OutputPower) or "estimate" (current)
+    MeterKWh           *float64  `json:"meterKWh,omitempty"`     // last EnergyCounter reading, the baseline for the next
+
+    // Totals at the last maintenance reset; counters since service are the difference
+    ServicedAt         time.Time `json:"servicedAt,omitempty"`
+    ServicedRunSeconds float64   `json:"servicedRunSeconds,omitempty"`
+    ServicedStarts     int64     `json:"servicedStarts,omitempty"`
+}
+
+const driveStatsFilePath = "/etc/vfd/drive_stats.json"
+
+var driveStats = make(map[string]*DriveStats)
+var driveStatsMu sync.RWMutex
+
+// Previous cycle, used to detect transitions; only touched from onPollComplete (serialized by pollMu)
+var statsLastStatus = make(map[string]string)
+var statsLastTime time.Time
+
+// Statuses that come from an actual drive read, as opposed to startup/offline placeholders
+func isPolledStatus(status string) bool {
+    switch status {
+    case "Running", "Stopped", "Tripped", "NotReady", "Inhibited":
+        return true
+    }
+    return false
+}
+
+// drivePowerKW returns the drive-reported power, or an estimate from current when the
+// profile has no OutputPower register: P = √3 · V · I · PF
+func drivePowerKW(entry map[string]interface{}, d *DriveConfig) float64 {
+    if p, ok := entry["power"].(float64); ok {
+        return p
+    }
+    voltage, pf := 480.0, 0.85
+    if d != nil && d.LineVoltage > 0 {
+        voltage = d.LineVoltage
+    }
+    if d != nil && d.PowerFactor > 0 {
+        pf = d.PowerFactor
+    }
+    return math.Sqrt(3) * voltage * safeFloat(entry["current"]) * pf / 1000
+}
+
+// accumulateDriveStats applies one poll interval of observations to a drive's totals
+func accumulateDriveStats(st *DriveStats, prevStatus, status string, powerKW float64, elapsed time.Duration) {
+    if status == "Running" && (prevStatus == "Stopped" || prevStatus == "Tripped" || prevStatus == "NotReady") {
+        st.Starts++
+    }
+    if status == "Tripped" && prevStatus != "Tripped" && isPolledStatus(prevStatus) {
+        st.Trips++
+    }
+    if prevStatus == "Tripped" && status != "Tripped" && isPolledStatus(status) {
+        st.Recoveries++
+    }
+    switch status {
+    case "Unavailable":
+        st.UnavailableSeconds += elapsed.Seconds()
+    case "Running":
+        st.EnergyKWh += powerKW * elapsed.Hours()
+        st.RunSeconds += elapsed.Seconds()
+    case "Tripped":
+        st.TrippedSeconds += elapsed.Seconds()
+    }
+}
+
+func updateDriveStats(snapshot []map[string]interface{}, now time.Time) {
+    elapsed := now.Sub(statsLastTime)
+    if statsLastTime.IsZero() || elapsed > 10*time.Second {
+        // First cycle or the server was stalled/down: don't attribute the gap to any state
+        elapsed = 0
+    }
+    statsLastTime = now
+
+    var due []*Notification
+    driveStatsMu.Lock()
+    for _, entry := range snapshot {
+        ip, _ := entry["ip"].(string)
+        id, _ := entry["id"].(string)
+        status, _ := entry["status"].(string)
+        st, ok := driveStats[id]
+        if !ok {
+            st = &DriveStats{Since: now}
+            driveStats[id] = st
+        }
+        d, _ := driveConfig(ip)
+        // A drive's own energy counter replaces integrating power, and also covers time
+        // the server was down
+        powerKW := drivePowerKW(entry, d)
+        var profile DriveTypeProfile
+        if d != nil {
+            profile, _ = driveProfile(d)
+        }
+        metered := profile.EnergyCounter > 0 && st.MeterKWh != nil
+        meter, read := entry["energyMeter"].(float64)
+        if metered || read {
+            powerKW = 0
+        }
+        accumulateDriveStats(st, statsLastStatus[ip], status, powerKW, elapsed)
+        statsLastStatus[ip] = status
+        switch {
+        case read:
+            st.EnergyKWh += meterEnergyDelta(st.MeterKWh, meter, energyRolloverKWh(profile))
+            st.MeterKWh = &meter
+            st.EnergySource = "meter"
+        case metered:
+            // between counter reads
+        case isPolledStatus(status):
+            st.MeterKWh = nil
+            st.EnergySource = "estimate"
+            if _, ok := entry["power"].(float64); ok {
+                st.EnergySource = "power"
+            }
+        }
+        if n := checkMaintenanceLocked(d, st); n != nil {
+            due = append(due, n)
+        }
+    }
+    driveStatsMu.Unlock()
+    for _, n := range due {
+        log.Printf("[MAINTENANCE] %s", n.Message)
+        notify(*n)
+    }
+}
+
+// driveStatsSnapshot returns a copy of one drive's totals, by drive ID
+func driveStatsSnapshot(id string) (DriveStats, bool) {
+    driveStatsMu.RLock()
+    defer driveStatsMu.RUnlock()
+    st, ok := driveStats[id]
+    if !ok {
+        return DriveStats{}, false
+    }
+    return *st, true
+}
+
+func loadDriveStats(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    loaded := make(map[string]*DriveStats)
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("Failed to decode drive stats from %s: %v", filePath, err)
+        return
+    }
+    if moved := migrateIPKeyedStats(loaded, configuredDrives()); moved > 0 {
+        log.Printf("[DRIVE ID] Drive stats: %d drives moved from IP to drive ID keys", moved)
+    }
+    driveStatsMu.Lock()
+    driveStats = loaded
+    driveStatsMu.Unlock()
+}
+
+func saveDriveStats(filePath string) {
+    driveStatsMu.RLock()
+    data, err := json.MarshalIndent(driveStats, "", "  ")
+    driveStatsMu.RUnlock()
+    if err != nil {
+        log.Printf("Failed to encode drive stats: %v", err)
+        return
+    }
+    // Write-then-rename so a crash mid-write never loses the long-horizon totals
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        log.Printf("Failed to write %s: %v", tmp, err)
+        return
+    }
+    if err := os.Rename(tmp, filePath); err != nil {
+        log.Printf("Failed to replace %s: %v", filePath, err)
+    }
+}
+
+// persistDriveStats saves the totals, and the learned baselines, once a minute
+func persistDriveStats() {
+    ticker := time.NewTicker(1 * time.Minute)
+    defer ticker.Stop()
+    for range ticker.C {
+        if degraded.Load() {
+            continue // saved when the guardrails recover
+        }
+        saveDriveStats(driveStatsFilePath)
+        if appConfig.Baselines != nil {
+            saveBaselines(baselinesFilePath)
+        }
+    }
+}
+
+// ReliabilityBucket aggregates drive statistics for one drive model or group
+type ReliabilityBucket struct {
+    Key                   string   `json:"key"`
+    Drives                int      `json:"drives"`
+    RunHours              float64  `json:"runHours"`
+    Trips                 int64    `json:"trips"`
+    TripsPer1000RunHours  *float64 `json:"tripsPer1000RunHours"` // null without run hours
+    MTBFHours             *float64 `json:"mtbfHours"`            // run hours per trip; null without trips
+    MTTRMinutes           *float64 `json:"mttrMinutes"`          // mean time tripped until cleared; null without recoveries
+    UnavailableMinutes    float64  `json:"unavailableMinutes"`
+
+    trippedSeconds float64
+    recoveries     int64
+}
+
+func (b *ReliabilityBucket) add(st DriveStats) {
+    b.Drives++
+    b.RunHours += st.RunSeconds / 3600
+    b.Trips += st.Trips
+    b.UnavailableMinutes += st.UnavailableSeconds / 60
+    b.trippedSeconds += st.TrippedSeconds
+    b.recoveries += st.Recoveries
+}
+
+func (b *ReliabilityBucket) finish() {
+    round := func(v float64) *float64 {
+        v = math.Round(v*100) / 100
+        return &v
+    }
+    if b.RunHours > 0 {
+        b.TripsPer1000RunHours = round(float64(b.Trips) / b.RunHours * 1000)
+    }
+    if b.Trips > 0 {
+        b.MTBFHours = round(b.RunHours / float64(b.Trips))
+    }
+    if b.recoveries > 0 {
+        b.MTTRMinutes = round(b.trippedSeconds / float64(b.recoveries) / 60)
+    }
+    b.RunHours = math.Round(b.RunHours*100) / 100
+    b.UnavailableMinutes = math.Round(b.UnavailableMinutes*10) / 10
+}
+
+// buildReliabilityReport groups per-drive totals by drive model and by group
+func buildReliabilityReport(stats map[string]DriveStats, drives []DriveConfig) map[string]interface{} {
+    fleet := &ReliabilityBucket{Key: "fleet"}
+    byModel := make(map[string]*ReliabilityBucket)
+    byGroup := make(map[string]*ReliabilityBucket)
+    bucket := func(m map[string]*ReliabilityBucket, key string) *ReliabilityBucket {
+        b, ok := m[key]
+        if !ok {
+            b = &ReliabilityBucket{Key: key}
+            m[key] = b
+        }
+        return b
+    }
+    var since time.Time
+    for _, d := range drives {
+        st, ok := stats[d.ID]
+        if !ok {
+            continue
+        }
+        if since.IsZero() || st.Since.Before(since) {
+            since = st.Since
+        }
+        fleet.add(st)
+        bucket(byModel, d.DriveType).add(st)
+        bucket(byGroup, d.Group).add(st)
+    }
+    flatten := func(m map[string]*ReliabilityBucket) []*ReliabilityBucket {
+        out := make([]*ReliabilityBucket, 0, len(m))
+        for _, b := range m {
+            b.finish()
+            out = append(out, b)
+        }
+        sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+        return out
+    }
+    fleet.finish()
+    return map[string]interface{}{
+        "generatedAt": time.Now().Format(time.RFC3339),
+        "since":       since.Format(time.RFC3339),
+        "fleet":       fleet,
+        "byModel":     flatten(byModel),
+        "byGroup":     flatten(byGroup),
+    }
+}
+
+// handleReliabilityReport serves MTBF/MTTR and trip rates per drive model and group
+func handleReliabilityReport(w http.ResponseWriter, r *http.Request) {
+    driveStatsMu.RLock()
+    stats := make(map[string]DriveStats, len(driveStats))
+    for ip, st := range driveStats {
+        stats[ip] = *st
+    }
+    driveStatsMu.RUnlock()
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(buildReliabilityReport(stats, configuredDrives()))
+}
+
+// driveStatsCollector exposes the persisted totals as Prometheus counters. Const metrics
+// are used because the values are restored from disk rather than counted from zero.
+type driveStatsCollector struct{}
+
+var (
+    descStarts        = prometheus.NewDesc("vfd_starts_total", "Total drive starts since install", []string{"ip", "group", "fan_number", "drive_id"}, nil)
+    descTrips         = prometheus.NewDesc("vfd_trips_total", "Total drive trips since install", []string{"ip", "group", "fan_number", "drive_id"}, nil)
+    descUnavailable   = prometheus.NewDesc("vfd_unavailable_seconds_total", "Total time the drive was Unavailable since install", []string{"ip", "group", "fan_number", "drive_id"}, nil)
+    descEnergy        = prometheus.NewDesc("vfd_energy_kwh_total", "Total energy consumed since install (drive-reported or estimated)", []string{"ip", "group", "fan_number", "drive_id"}, nil)
+    descRun           = prometheus.NewDesc("vfd_run_seconds_total", "Total time the drive was Running since install", []string{"ip", "group", "fan_number", "drive_id"}, nil)
+    descServiceRun    = prometheus.NewDesc("vfd_service_run_hours", "Run hours since the drive's last maintenance reset", []string{"ip", "group", "fan_number", "drive_id"}, nil)
+    descServiceStarts = prometheus.NewDesc("vfd_service_starts", "Starts since the drive's last maintenance reset", []string{"ip", "group", "fan_number", "drive_id"}, nil)
+    descMaintDue      = prometheus.NewDesc("vfd_maintenance_due", "1 while the drive is past MaintenanceRunHours or MaintenanceStarts", []string{"ip", "group", "fan_number", "drive_id"}, nil)
+)
+
+func (driveStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- descStarts
+    ch <- descTrips
+    ch <- descUnavailable
+    ch <- descEnergy
+    ch <- descRun
+    ch <- descServiceRun
+    ch <- descServiceStarts
+    ch <- descMaintDue
+}
+
+func (driveStatsCollector) Collect(ch chan<- prometheus.Metric) {
+    driveStatsMu.RLock()
+    defer driveStatsMu.RUnlock()
+    for _, d := range configuredDrives() {
+        st, ok := driveStats[d.ID]
+        if !ok {
+            continue
+        }
+        labels := []string{d.IP, d.Group, fmt.Sprintf("%d", d.FanNumber), d.ID}
+        ch <- prometheus.MustNewConstMetric(descStarts, prometheus.CounterValue, float64(st.Starts), labels...)
+        ch <- prometheus.MustNewConstMetric(descTrips, prometheus.CounterValue, float64(st.Trips), labels...)
+        ch <- prometheus.MustNewConstMetric(descUnavailable, prometheus.CounterValue, st.UnavailableSeconds, labels...)
+        ch <- prometheus.MustNewConstMetric(descEnergy, prometheus.CounterValue, st.EnergyKWh, labels...)
+        ch <- prometheus.MustNewConstMetric(descRun, prometheus.CounterValue, st.RunSeconds, labels...)
+        hours, starts := maintenanceLimits(&d)
+        ch <- prometheus.MustNewConstMetric(descServiceRun, prometheus.GaugeValue, st.serviceRunHours(), labels...)
+        ch <- prometheus.MustNewConstMetric(descServiceStarts, prometheus.GaugeValue, float64(st.serviceStarts()), labels...)
+        ch <- prometheus.MustNewConstMetric(descMaintDue, prometheus.GaugeValue, boolToFloat(len(maintenanceReasons(*st, hours, starts)) > 0), labels...)
+    }
+}
+
+// =====================
+// Maintenance Counters
+// =====================
+// Run hours and starts since a drive's last service come from the same DriveStats totals:
+// a maintenance reset (POST /api/maintenance/<drive>) records the totals at that moment,
+// so counting continues from install for drives that were never reset. With
+// MaintenanceRunHours / MaintenanceStarts set (site-wide or per drive) a drive past either
+// limit is flagged maintenance-due: in /api/devices, /api/maintenance, the
+// vfd_maintenance_due metric, the log and a MaintenanceDue notification.
+
+// DriveMaintenance is a drive's service counters as reported by the APIs
+type DriveMaintenance struct {
+    ID              string     `json:"id"`
+    IP              string     `json:"ip"`
+    Group           string     `json:"group"`
+    FanNumber       int        `json:"fanNumber"`
+    RunHours        float64    `json:"runHours"` // since install
+    Starts          int64      `json:"starts"`
+    ServiceRunHours float64    `json:"serviceRunHours"` // since the last service
+    ServiceStarts   int64      `json:"serviceStarts"`
+    ServicedAt      *time.Time `json:"servicedAt,omitempty"`
+    LimitRunHours   float64    `json:"limitRunHours,omitempty"`
+    LimitStarts     int64      `json:"limitStarts,omitempty"`
+    Due             bool       `json:"due"`
+    Reasons         []string   `json:"reasons,omitempty"`
+}
+
+// maintenanceFlagged holds the drives (by ID) last seen maintenance-due; guarded by driveStatsMu
+var maintenanceFlagged = make(map[string]bool)
+
+func (st DriveStats) serviceRunHours() float64 {
+    return (st.RunSeconds - st.ServicedRunSeconds) / 3600
+}
+
+func (st DriveStats) serviceStarts() int64 {
+    return st.Starts - st.ServicedStarts
+}
+
+// maintenanceLimits returns a drive's limits: per-drive values win over the site's,
+// negative disables, 0 means none
+func maintenanceLimits(d *DriveConfig) (float64, int64) {
+    hours, starts := appConfig.MaintenanceRunHours, appConfig.MaintenanceStarts
+    if d != nil && d.MaintenanceRunHours != 0 {
+        hours = d.MaintenanceRunHours
+    }
+    if d != nil && d.MaintenanceStarts != 0 {
+        starts = d.MaintenanceStarts
+    }
+    return math.Max(hours, 0), max(starts, 0)
+}
+
+// maintenanceReasons lists the limits a drive has passed since its last service
+func maintenanceReasons(st DriveStats, hours float64, starts int64) []string {
+    var reasons []string
+    if h := st.serviceRunHours(); hours > 0 && h >= hours {
+        reasons = append(reasons, fmt.Sprintf("%.0f run hours since service (limit %.0f)", h, hours))
+    }
+    if n := st.serviceStarts(); starts > 0 && n >= starts {
+        reasons = append(reasons, fmt.Sprintf("%d starts since service (limit %d)", n, starts))
+    }
+    return reasons
+}
+
+func driveMaintenance(d DriveConfig, st DriveStats) DriveMaintenance {
+    hours, starts := maintenanceLimits(&d)
+    m := DriveMaintenance{
+        ID: d.ID, IP: d.IP, Group: d.Group, FanNumber: d.FanNumber,
+        RunHours:        math.Round(st.RunSeconds/3600*10) / 10,
+        Starts:          st.Starts,
+        ServiceRunHours: math.Round(st.serviceRunHours()*10) / 10,
+        ServiceStarts:   st.serviceStarts(),
+        LimitRunHours:   hours,
+        LimitStarts:     starts,
+        Reasons:         maintenanceReasons(st, hours, starts),
+    }
+    if !st.ServicedAt.IsZero() {
+        at := st.ServicedAt
+        m.ServicedAt = &at
+    }
+    m.Due = len(m.Reasons) > 0
+    return m
+}
+
+// checkMaintenanceLocked flags a drive that has just become due (or clears one that no
+// longer is) and returns the notification to send; the caller holds driveStatsMu
+func checkMaintenanceLocked(d *DriveConfig, st *DriveStats) *Notification {
+    if d == nil {
+        return nil
+    }
+    hours, starts := maintenanceLimits(d)
+    reasons := maintenanceReasons(*st, hours, starts)
+    due := len(reasons) > 0
+    if due == maintenanceFlagged[d.ID] {
+        return nil
+    }
+    maintenanceFlagged[d.ID] = due
+    if !due {
+        return nil
+    }
+    return &Notification{Severity: "warning", Kind: "MaintenanceDue", Group: d.Group, DriveID: d.ID, IP: d.IP,
+        Message: fmt.Sprintf("Fan %d in group %s (%s) is due for maintenance: %s", d.FanNumber, d.Group, d.IP, strings.Join(reasons, ", "))}
+}
+
+// handleMaintenance serves GET /api/maintenance (every drive's service counters) and
+// POST /api/maintenance/<id or ip> {"note": "..."} to record a service, which restarts
+// the drive's counters
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    ref := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/maintenance"), "/")
+    if r.Method == http.MethodGet && ref == "" {
+        list := []DriveMaintenance{}
+        for _, d := range configuredDrives() {
+            st, _ := driveStatsSnapshot(d.ID)
+            list = append(list, driveMaintenance(d, st))
+        }
+        json.NewEncoder(w).Encode(list)
+        return
+    }
+    if r.Method != http.MethodPost || ref == "" {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    d, ok := driveConfig(driveRefIP(ref, configuredDrives()))
+    if !ok {
+        http.Error(w, "Unknown drive: "+ref, http.StatusNotFound)
+        return
+    }
+    var req struct {
+        Note string `json:"note"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    now := time.Now()
+    driveStatsMu.Lock()
+    st, ok := driveStats[d.ID]
+    if !ok {
+        st = &DriveStats{Since: now}
+        driveStats[d.ID] = st
+    }
+    before := *st
+    st.ServicedAt, st.ServicedRunSeconds, st.ServicedStarts = now, st.RunSeconds, st.Starts
+    maintenanceFlagged[d.ID] = false
+    after := *st
+    driveStatsMu.Unlock()
+    saveDriveStats(driveStatsFilePath)
+
+    detail := fmt.Sprintf("%s serviced after %.0f run hours, %d starts", d.IP, before.serviceRunHours(), before.serviceStarts())
+    if req.Note != "" {
+        detail += ": " + req.Note
+    }
+    log.Printf("[MAINTENANCE] %s", detail)
+    resolveAlert("MaintenanceDue", d.ID)
+    recordControlEvent(ControlEvent{Timestamp: now, Action: "MaintenanceReset", Drives: []DriveEventInfo{{ID: d.ID, IP: d.IP, Success: true}}, Detail: detail})
+    json.NewEncoder(w).Encode(driveMaintenance(*d, after))
+}
+
+// =====================
+// Anomaly Baselines
+// =====================
+// With Baselines set, each drive learns what normal looks like from its own running
+// history instead of fixed thresholds: the current it draws in each speed band (BinHz wide)
+// and, for drives with a VibrationSignal, its vibration in each band. A settled running
+// poll (output within 1 Hz of the setpoint) is sampled every SampleSec into an exponentially
+// weighted mean and variance per band, so the baseline follows slow changes such as
+// seasonal load over roughly WindowHours. For its first TrainingHours a drive only learns.
+// After that every sample gets a z-score against its band, once the band has MinSamples.
+// A score beyond ZThreshold that lasts ConfirmSec flags the drive: a BaselineDeviation
+// warning that opens an alert. Deviating samples are not learned, so a developing fault
+// is never absorbed as normal; the alert resolves when the scores are back under the
+// threshold. After a legitimate change (new impeller, rebalanced fan) DELETE
+// /api/devices/<drive>/baseline starts the drive's learning over. Baselines persist in
+// baselines.json; GET /api/devices/<drive>/baseline shows the learned curve and scores.
+const baselinesFilePath = "/etc/vfd/baselines.json"
+
+// baselineMinSpread is the smallest standard deviation a band is scored with, as a
+// fraction of its mean, so a very steady drive isn't flagged over meter resolution
+const baselineMinSpread = 0.02
+
+type BaselineConfig struct {
+    TrainingHours float64  `json:"TrainingHours,omitempty"` // learn only, default 168 (a week)
+    WindowHours   float64  `json:"WindowHours,omitempty"`   // how far back the baseline reaches, default 720
+    SampleSec     int      `json:"SampleSec,omitempty"`     // default 60
+    BinHz         float64  `json:"BinHz,omitempty"`         // speed band width, default 5
+    MinSamples    int64    `json:"MinSamples,omitempty"`    // per band before it is scored, default 30
+    ZThreshold    float64  `json:"ZThreshold,omitempty"`    // default 4
+    ConfirmSec    int      `json:"ConfirmSec,omitempty"`    // default 300
+    Groups        []string `json:"Groups,omitempty"`        // empty: every group
+}
+
+// BaselineBand is the learned distribution of one signal in one speed band
+type BaselineBand struct {
+    Samples  int64   `json:"samples"`
+    Mean     float64 `json:"mean"`
+    Variance float64 `json:"variance"`
+}
+
+// DriveBaseline is one drive's learned baselines, by drive ID. Bands are keyed by
+// int(speed / BinHz).
+type DriveBaseline struct {
+    Since      time.Time             `json:"since"` // first sample; training ends TrainingHours later
+    LastSample time.Time             `json:"lastSample"`
+    BinHz      float64               `json:"binHz"`
+    Current    map[int]*BaselineBand `json:"current"`
+    Vibration  map[int]*BaselineBand `json:"vibration,omitempty"`
+}
+
+// BaselineScore is the latest comparison of one signal with its baseline
+type BaselineScore struct {
+    Hz       float64   `json:"hz"`
+    Value    float64   `json:"value"`
+    Expected float64   `json:"expected"`
+    StdDev   float64   `json:"stdDev"`
+    Z        float64   `json:"z"`
+    At       time.Time `json:"at"`
+}
+
+// baselineDeviation is a drive with a score beyond the threshold
+type baselineDeviation struct {
+    Since   time.Time
+    Flagged bool
+}
+
+var (
+    baselineMu         sync.Mutex
+    driveBaselines     = make(map[string]*DriveBaseline)           // by drive ID
+    baselineScores     = make(map[string]map[string]BaselineScore) // by drive ID, then "current"/"vibration"
+    baselineDeviations = make(map[string]*baselineDeviation)       // by drive ID
+
+    vfdBaselineZ = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "baseline_zscore",
+            Help:      "Latest deviation of the drive's current or vibration from its learned baseline, in standard deviations",
+        },
+        []string{"ip", "group", "drive_id", "signal"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(vfdBaselineZ)
+}
+
+// baselineSettings returns c with the defaults filled in
+func baselineSettings(c *BaselineConfig) BaselineConfig {
+    s := *c
+    if s.TrainingHours <= 0 {
+        s.TrainingHours = 168
+    }
+    if s.WindowHours <= 0 {
+        s.WindowHours = 720
+    }
+    if s.SampleSec <= 0 {
+        s.SampleSec = 60
+    }
+    if s.BinHz <= 0 {
+        s.BinHz = 5
+    }
+    if s.MinSamples <= 0 {
+        s.MinSamples = 30
+    }
+    if s.ZThreshold <= 0 {
+        s.ZThreshold = 4
+    }
+    if s.ConfirmSec <= 0 {
+        s.ConfirmSec = 300
+    }
+    return s
+}
+
+// learn adds a sample. Weighting is 1/n until the band holds a window's worth of samples,
+// so early samples count equally, then fixed so older samples fade out.
+func (b *BaselineBand) learn(x, windowSamples float64) {
+    b.Samples++
+    a := 1 / float64(b.Samples)
+    if windowSamples > 0 && a < 1/windowSamples {
+        a = 1 / windowSamples
+    }
+    d := x - b.Mean
+    b.Mean += a * d
+    b.Variance = (1 - a) * (b.Variance + a*d*d)
+}
+
+func (b BaselineBand) stdDev() float64 {
+    return math.Max(math.Sqrt(b.Variance), math.Abs(b.Mean)*baselineMinSpread)
+}
+
+// baselineAction is what a sample decided about one drive
+type baselineAction struct {
+    kind   string // "flag" or "clear"
+    d      *DriveConfig
+    scores map[string]BaselineScore
+}
+
+// checkBaselines samples a poll snapshot into the baselines, scores it and returns the
+// drives to flag or clear. Caller holds baselineMu.
+func checkBaselines(c *BaselineConfig, snapshot []map[string]interface{}, now time.Time) []baselineAction {
+    s := baselineSettings(c)
+    windowSamples := s.WindowHours * 3600 / float64(s.SampleSec)
+    var actions []baselineAction
+    for _, entry := range snapshot {
+        ip, _ := entry["ip"].(string)
+        d, ok := driveConfig(ip)
+        if !ok || d.ID == "" || entry["status"] != "Running" || entry["tagout"] != nil || (len(s.Groups) > 0 && !containsString(s.Groups, d.Group)) {
+            continue
+        }
+        hz, _ := entry["actualSpeed"].(float64)
+        set, _ := entry["setSpeed"].(float64)
+        current, ok := entry["current"].(float64)
+        if !ok || hz <= 0 || math.Abs(hz-math.Abs(set)) > 1 {
+            continue // ramping: current is not comparable
+        }
+        b := driveBaselines[d.ID]
+        if b != nil && b.BinHz != s.BinHz {
+            log.Printf("[BASELINE] %s: BinHz changed from %v to %v; learning again", ip, b.BinHz, s.BinHz)
+            b = nil
+        }
+        if b == nil {
+            b = &DriveBaseline{Since: now, BinHz: s.BinHz, Current: make(map[int]*BaselineBand)}
+            driveBaselines[d.ID] = b
+        } else if now.Sub(b.LastSample) < time.Duration(s.SampleSec)*time.Second {
+            continue
+        }
+        b.LastSample = now
+        band := int(hz / s.BinHz)
+        signals := map[string]float64{"current": current}
+        if d.VibrationSignal != "" {
+            if v, ok := sensorValue(d.VibrationSignal); ok {
+                signals["vibration"] = v
+            }
+        }
+        trained := now.Sub(b.Since) >= time.Duration(s.TrainingHours*float64(time.Hour))
+        scores := make(map[string]BaselineScore)
+        deviating := false
+        for signal, x := range signals {
+            bands := b.Current
+            if signal == "vibration" {
+                if b.Vibration == nil {
+                    b.Vibration = make(map[int]*BaselineBand)
+                }
+                bands = b.Vibration
+            }
+            bb := bands[band]
+            if bb == nil {
+                bb = &BaselineBand{}
+                bands[band] = bb
+            }
+            if trained && bb.Samples >= s.MinSamples {
+                sd := bb.stdDev()
+                z := 0.0
+                if sd > 0 {
+                    z = (x - bb.Mean) / sd
+                }
+                scores[signal] = BaselineScore{Hz: hz, Value: x, Expected: math.Round(bb.Mean*100) / 100, StdDev: math.Round(sd*1000) / 1000, Z: math.Round(z*100) / 100, At: now}
+                vfdBaselineZ.WithLabelValues(ip, d.Group, d.ID, signal).Set(z)
+                if math.Abs(z) > s.ZThreshold {
+                    deviating = true
+                    continue
+                }
+            }
+            bb.learn(x, windowSamples)
+        }
+        baselineScores[d.ID] = scores
+
+        dev := baselineDeviations[d.ID]
+        switch {
+        case deviating && dev == nil:
+            dev = &baselineDeviation{Since: now}
+            baselineDeviations[d.ID] = dev
+            fallthrough
+        case deviating:
+            if !dev.Flagged && now.Sub(dev.Since) >= time.Duration(s.ConfirmSec)*time.Second {
+                dev.Flagged = true
+                actions = append(actions, baselineAction{kind: "flag", d: d, scores: scores})
+            }
+        case dev != nil:
+            if dev.Flagged {
+                actions = append(actions, baselineAction{kind: "clear", d: d, scores: scores})
+            }
+            delete(baselineDeviations, d.ID)
+        }
+    }
+    return actions
+}
+
+// updateBaselines runs checkBaselines after each poll and raises or resolves the alerts
+func updateBaselines(snapshot []map[string]interface{}) {
+    c := appConfig.Baselines
+    if c == nil {
+        return
+    }
+    baselineMu.Lock()
+    actions := checkBaselines(c, snapshot, time.Now())
+    baselineMu.Unlock()
+
+    for _, a := range actions {
+        d := a.d
+        if a.kind == "clear" {
+            log.Printf("[BASELINE] %s: back within its baseline", d.IP)
+            resolveAlert("BaselineDeviation", d.ID)
+            continue
+        }
+        var parts []string
+        for _, signal := range []string{"current", "vibration"} {
+            if sc, ok := a.scores[signal]; ok && math.Abs(sc.Z) > baselineSettings(c).ZThreshold {
+                parts = append(parts, fmt.Sprintf("%s %.2f vs %.2f expected at %.0f Hz (z %.1f)", signal, sc.Value, sc.Expected, sc.Hz, sc.Z))
+            }
+        }
+        detail := strings.Join(parts, "; ")
+        log.Printf("[BASELINE] %s: deviating from its baseline: %s", d.IP, detail)
+        notify(Notification{Severity: "warning", Kind: "BaselineDeviation", Group: d.Group, DriveID: d.ID, IP: d.IP,
+            Message: fmt.Sprintf("Drive %s is behaving unlike its learned baseline: %s", d.IP, detail)})
+    }
+}
+
+// resetBaseline discards a drive's learned baselines so it trains again
+func resetBaseline(d *DriveConfig) bool {
+    baselineMu.Lock()
+    _, ok := driveBaselines[d.ID]
+    dev := baselineDeviations[d.ID]
+    delete(driveBaselines, d.ID)
+    delete(baselineScores, d.ID)
+    delete(baselineDeviations, d.ID)
+    baselineMu.Unlock()
+    vfdBaselineZ.DeletePartialMatch(prometheus.Labels{"drive_id": d.ID})
+    if dev != nil && dev.Flagged {
+        resolveAlert("BaselineDeviation", d.ID)
+    }
+    return ok
+}
+
+// baselineView is a drive's baseline for /api/devices/<drive>/baseline
+func baselineView(d *DriveConfig, now time.Time) map[string]interface{} {
+    view := map[string]interface{}{"id": d.ID, "ip": d.IP, "enabled": appConfig.Baselines != nil}
+    if appConfig.Baselines == nil {
+        return view
+    }
+    s := baselineSettings(appConfig.Baselines)
+    baselineMu.Lock()
+    defer baselineMu.Unlock()
+    b := driveBaselines[d.ID]
+    if b == nil {
+        view["state"] = "waiting" // no settled running sample yet
+        return view
+    }
+    trainingEnds := b.Since.Add(time.Duration(s.TrainingHours * float64(time.Hour)))
+    view["state"] = "scoring"
+    if now.Before(trainingEnds) {
+        view["state"] = "training"
+    }
+    view["since"] = b.Since.Format(time.RFC3339)
+    view["trainingEndsAt"] = trainingEnds.Format(time.RFC3339)
+    view["lastSample"] = b.LastSample.Format(time.RFC3339)
+    view["zThreshold"] = s.ZThreshold
+    curve := func(bands map[int]*BaselineBand) []map[string]interface{} {
+        keys := make([]int, 0, len(bands))
+        for k := range bands {
+            keys = append(keys, k)
+        }
+        sort.Ints(keys)
+        out := []map[string]interface{}{}
+        for _, k := range keys {
+            bb := bands[k]
+            out = append(out, map[string]interface{}{
+                "fromHz": float64(k) * b.BinHz, "toHz": float64(k+1) * b.BinHz,
+                "samples": bb.Samples, "mean": math.Round(bb.Mean*100) / 100, "stdDev": math.Round(bb.stdDev()*1000) / 1000,
+                "scored": bb.Samples >= s.MinSamples,
+            })
+        }
+        return out
+    }
+    view["current"] = curve(b.Current)
+    if len(b.Vibration) > 0 {
+        view["vibration"] = curve(b.Vibration)
+    }
+    if scores := baselineScores[d.ID]; len(scores) > 0 {
+        view["scores"] = scores
+    }
+    if dev := baselineDeviations[d.ID]; dev != nil {
+        view["deviatingSince"] = dev.Since.Format(time.RFC3339)
+        view["flagged"] = dev.Flagged
+    }
+    return view
+}
+
+func loadBaselines(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    loaded := make(map[string]*DriveBaseline)
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("Failed to decode baselines from %s: %v", filePath, err)
+        return
+    }
+    baselineMu.Lock()
+    driveBaselines = loaded
+    baselineMu.Unlock()
+}
+
+func saveBaselines(filePath string) {
+    baselineMu.Lock()
+    data, err := json.MarshalIndent(driveBaselines, "", "  ")
+    baselineMu.Unlock()
+    if err != nil {
+        log.Printf("Failed to encode baselines: %v", err)
+        return
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        log.Printf("Failed to write %s: %v", tmp, err)
+        return
+    }
+    if err := os.Rename(tmp, filePath); err != nil {
+        log.Printf("Failed to replace %s: %v", filePath, err)
+    }
+}
+
+// =====================
+// Tracking History
+// =====================
+// With History set, every drive's setpoint, output speed and current are sampled every
+// SampleSec (default 5) into an in-memory ring of RetainHours (default 24, at most 168).
+// GET /api/history/<drive>/tracking returns the samples in a time range as aligned series,
+// with tracking-error statistics over the running samples and, for each setpoint step of
+// at least 1 Hz, how long the drive took to settle within toleranceHz. Controls engineers
+// use it to tune ramp rates and PI gains remotely. The history does not survive a restart.
+const (
+    defaultHistorySampleSec   = 5
+    defaultHistoryRetainHours = 24
+    maxHistoryRetainHours     = 168
+    historyStepHz             = 1.0 // smallest setpoint change analysed for settling
+)
+
+type HistoryConfig struct {
+    SampleSec   int `json:"SampleSec,omitempty"`   // default 5
+    RetainHours int `json:"RetainHours,omitempty"` // default 24, max 168
+}
+
+// trackingSample is one drive's state at a sample time; float32 keeps a day of 5 s
+// samples under 400 KB per drive
+type trackingSample struct {
+    At       int64 // unix seconds
+    Setpoint float32
+    Actual   float32
+    Current  float32
+    Running  bool
+}
+
+// trackingRing is a drive's sample history, oldest overwritten first
+type trackingRing struct {
+    samples []trackingSample
+    next    int
+    full    bool
+}
+
+func (r *trackingRing) add(s trackingSample) {
+    r.samples[r.next] = s
+    r.next = (r.next + 1) % len(r.samples)
+    if r.next == 0 {
+        r.full = true
+    }
+}
+
+// between returns the samples from from to to, oldest first
+func (r *trackingRing) between(from, to int64) []trackingSample {
+    ordered := r.samples[:r.next]
+    if r.full {
+        ordered = append(append([]trackingSample{}, r.samples[r.next:]...), r.samples[:r.next]...)
+    }
+    var out []trackingSample
+    for _, s := range ordered {
+        if s.At >= from && s.At <= to {
+            out = append(out, s)
+        }
+    }
+    return out
+}
+
+var (
+    historyMu       sync.Mutex
+    trackingHistory = make(map[string]*trackingRing) // by drive IP
+    historySampled  time.Time
+)
+
+func historyLimits(c *HistoryConfig) (sample time.Duration, retain int) {
+    sec, hours := c.SampleSec, c.RetainHours
+    if sec <= 0 {
+        sec = defaultHistorySampleSec
+    }
+    if hours <= 0 {
+        hours = defaultHistoryRetainHours
+    }
+    return time.Duration(sec) * time.Second, hours * 3600 / sec
+}
+
+func validateHistory(c *HistoryConfig) error {
+    if c == nil {
+        return nil
+    }
+    if c.SampleSec < 0 || c.RetainHours < 0 || c.RetainHours > maxHistoryRetainHours {
+        return fmt.Errorf("History: SampleSec must not be negative, RetainHours at most %d", maxHistoryRetainHours)
+    }
+    return nil
+}
+
+// recordHistory samples every drive in the snapshot once SampleSec has passed
+func recordHistory(snapshot []map[string]interface{}, now time.Time) {
+    c := appConfig.History
+    if c == nil {
+        return
+    }
+    sample, retain := historyLimits(c)
+    historyMu.Lock()
+    defer historyMu.Unlock()
+    if now.Sub(historySampled) < sample {
+        return
+    }
+    historySampled = now
+    for _, entry := range snapshot {
+        ip, _ := entry["ip"].(string)
+        if ip == "" {
+            continue
+        }
+        ring := trackingHistory[ip]
+        if ring == nil || len(ring.samples) != retain {
+            ring = &trackingRing{samples: make([]trackingSample, retain)}
+            trackingHistory[ip] = ring
+        }
+        ring.add(trackingSample{
+            At:       now.Unix(),
+            Setpoint: float32(safeFloat(entry["setSpeed"])),
+            Actual:   float32(safeFloat(entry["actualSpeed"])),
+            Current:  float32(safeFloat(entry["current"])),
+            Running:  entry["status"] == "Running",
+        })
+    }
+}
+
+// TrackingStats summarizes actual-minus-setpoint over the running samples
+type TrackingStats struct {
+    Samples         int     `json:"samples"`
+    MeanErrorHz     float64 `json:"meanErrorHz"` // bias; negative = lagging below the setpoint
+    MeanAbsErrorHz  float64 `json:"meanAbsErrorHz"`
+    RMSErrorHz      float64 `json:"rmsErrorHz"`
+    P95AbsErrorHz   float64 `json:"p95AbsErrorHz"`
+    MaxAbsErrorHz   float64 `json:"maxAbsErrorHz"`
+    WithinTolerance float64 `json:"withinTolerance"` // fraction of samples within toleranceHz
+}
+
+// SetpointStep is one setpoint change and how long the drive took to follow it
+type SetpointStep struct {
+    At         time.Time `json:"at"`
+    FromHz     float64   `json:"fromHz"`
+    ToHz       float64   `json:"toHz"`
+    SettledSec *float64  `json:"settledSec"` // null: not within tolerance before the next change or the end
+}
+
+func round3(v float64) float64 {
+    return math.Round(v*1000) / 1000
+}
+
+// trackingStats computes the error statistics and setpoint steps of a sample series
+func trackingStats(samples []trackingSample, tolerance float64) (TrackingStats, []SetpointStep) {
+    var st TrackingStats
+    var abs []float64
+    var sum, sumAbs, sumSq float64
+    within := 0
+    for _, s := range samples {
+        if !s.Running {
+            continue
+        }
+        e := float64(s.Actual - s.Setpoint)
+        a := math.Abs(e)
+        abs = append(abs, a)
+        sum, sumAbs, sumSq = sum+e, sumAbs+a, sumSq+e*e
+        st.MaxAbsErrorHz = math.Max(st.MaxAbsErrorHz, a)
+        if a <= tolerance {
+            within++
+        }
+    }
+    if n := float64(len(abs)); n > 0 {
+        sort.Float64s(abs)
+        st.Samples = len(abs)
+        st.MeanErrorHz = round3(sum / n)
+        st.MeanAbsErrorHz = round3(sumAbs / n)
+        st.RMSErrorHz = round3(math.Sqrt(sumSq / n))
+        st.P95AbsErrorHz = round3(abs[int(math.Ceil(0.95*n))-1])
+        st.MaxAbsErrorHz = round3(st.MaxAbsErrorHz)
+        st.WithinTolerance = round3(float64(within) / n)
+    }
+
+    steps := []SetpointStep{}
+    for i := 1; i < len(samples); i++ {
+        prev, cur := samples[i-1], samples[i]
+        if !cur.Running || math.Abs(float64(cur.Setpoint-prev.Setpoint)) < historyStepHz {
+            continue
+        }
+        step := SetpointStep{At: time.Unix(cur.At, 0).UTC(), FromHz: round3(float64(prev.Setpoint)), ToHz: round3(float64(cur.Setpoint))}
+        for j := i; j < len(samples) && samples[j].Setpoint == cur.Setpoint; j++ {
+            if math.Abs(float64(samples[j].Actual-cur.Setpoint)) <= tolerance {
+                settled := float64(samples[j].At - cur.At)
+                step.SettledSec = &settled
+                break
+            }
+        }
+        steps = append(steps, step)
+    }
+    return st, steps
+}
+
+// handleHistoryRoutes serves GET /api/history/<drive>/tracking?from=&to=&toleranceHz=.
+// from and to are RFC 3339; the default range is the last hour.
+func handleHistoryRoutes(w http.ResponseWriter, r *http.Request) {
+    ref, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/history/"), "/"), "/")
+    if sub != "tracking" {
+        http.NotFound(w, r)
+        return
+    }
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if appConfig.History == nil {
+        http.Error(w, "History is not configured", http.StatusNotFound)
+        return
+    }
+    ip := driveRefIP(ref, configuredDrives())
+    d, ok := driveConfig(ip)
+    if !ok {
+        http.Error(w, "Unknown drive: "+ref, http.StatusNotFound)
+        return
+    }
+    q := r.URL.Query()
+    to, from := time.Now(), time.Now().Add(-time.Hour)
+    for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+        if v := q.Get(name); v != "" {
+            parsed, err := time.Parse(time.RFC3339, v)
+            if err != nil {
+                http.Error(w, name+" must be an RFC 3339 time", http.StatusBadRequest)
+                return
+            }
+            *t = parsed
+        }
+    }
+    if !from.Before(to) {
+        http.Error(w, "from must be before to", http.StatusBadRequest)
+        return
+    }
+    tolerance := 0.5
+    if v := q.Get("toleranceHz"); v != "" {
+        f, err := strconv.ParseFloat(v, 64)
+        if err != nil || f <= 0 {
+            http.Error(w, "toleranceHz must be a positive number", http.StatusBadRequest)
+            return
+        }
+        tolerance = f
+    }
+
+    historyMu.Lock()
+    var samples []trackingSample
+    if ring := trackingHistory[ip]; ring != nil {
+        samples = ring.between(from.Unix(), to.Unix())
+    }
+    historyMu.Unlock()
+
+    n := len(samples)
+    times := make([]time.Time, n)
+    setpoint, actual, current := make([]float64, n), make([]float64, n), make([]float64, n)
+    running := make([]bool, n)
+    for i, s := range samples {
+        times[i] = time.Unix(s.At, 0).UTC()
+        setpoint[i], actual[i], current[i] = round3(float64(s.Setpoint)), round3(float64(s.Actual)), round3(float64(s.Current))
+        running[i] = s.Running
+    }
+    stats, steps := trackingStats(samples, tolerance)
+    sample, _ := historyLimits(appConfig.History)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "id":          d.ID,
+        "ip":          d.IP,
+        "from":        from.UTC(),
+        "to":          to.UTC(),
+        "sampleSec":   int(sample.Seconds()),
+        "toleranceHz": tolerance,
+        "time":        times,
+        "setpointHz":  setpoint,
+        "actualHz":    actual,
+        "currentA":    current,
+        "running":     running,
+        "stats":       stats,
+        "steps":       steps,
+    })
+}
+
+// =====================
+// Prometheus Metrics
+// =====================
+var (
+    // Define metrics with VFD namespace
+    vfdstatus = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:     "status",
+            Help:     "VFD operational status (1=running, 0=stopped)",
+        },
+        []string{"ip", "group", "fan_number", "drive_id"},
+    )
+
+    vfdspeedhz = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:     "speed_hz",
+            Help:     "Current VFD speed in Hertz",
+        },
+        []string{"ip", "group", "fan_number", "drive_id"},
+    )
+
+    vfdspeedrpm = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:     "speed_rpm",
+            Help:     "Current VFD speed in RPM",
+        },
+        []string{"ip", "group", "fan_number", "drive_id"},
+    )
+
+    vfdspeedpercent = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:     "speed_percent",
+            Help:     "Current VFD speed in Percent",
+        },
+        []string{"ip", "group", "fan_number", "drive_id"},
+    )    
+
+        vfdamperage = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:     "amperage",
+            Help:     "Current VFD amperage usage",
+        },
+        []string{"ip", "group", "fan_number", "drive_id"},
+    )
+
+        vfdcfm = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:     "cfm",
+            Help:     "Current Fan CFM",
+        },
+        []string{"ip", "group", "fan_number", "drive_id"},
+    )
+
+        vfdup = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Name: "up",
+            Help: "VFD connection status (1=connected, 0=disconnected)",
+        },
+        []string{"ip", "group", "fan_number", "drive_id"},
+    )
+
+    vfdextra = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "extra",
+            Help:      "Profile-defined extra telemetry register (see name and unit)",
+        },
+        []string{"ip", "group", "fan_number", "drive_id", "name", "unit"},
+    )
+
+    vfdlastupdated = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "last_updated_timestamp_seconds",
+            Help:      "Unix time of the drive's last poll result (online or not)",
+        },
+        []string{"ip", "group", "fan_number", "drive_id"},
+    )
+
+)
+
+func init() {
+    // Register metrics
+    prometheus.MustRegister(vfdstatus)
+    prometheus.MustRegister(vfdspeedhz)
+    prometheus.MustRegister(vfdspeedrpm)
+    prometheus.MustRegister(vfdspeedpercent)
+    prometheus.MustRegister(vfdamperage)
+    prometheus.MustRegister(vfdcfm)
+    prometheus.MustRegister(vfdup)
+    prometheus.MustRegister(vfdextra)
+    prometheus.MustRegister(vfdlastupdated)
+    prometheus.MustRegister(driveStatsCollector{})
+}
+
+// updateMetrics uses cached vfdData for Prometheus metrics
+func updateMetrics() {
+    ticker := time.NewTicker(15 * time.Second)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        collectMetrics()
+        collectSensorMetrics()
+    }
+}
+
+func collectMetrics() {
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+
+    for _, drive := range vfdData {
+        ip, _ := drive["ip"].(string)
+        group := fmt.Sprintf("%v", drive["group"])
+        fan := fmt.Sprintf("%v", drive["fanNumber"])
+        id, _ := drive["id"].(string)
+
+        labels := prometheus.Labels{
+            "ip":         ip,
+            "group":      group,
+            "fan_number": fan,
+            "drive_id":   id,
+        }
+
+        status := 0.0
+        if drive["status"] == "Running" {
+            status = 1.0
+        }
+
+        // Set "up" metric based on VFD availability
+        up := 0.0
+        driveStatus := fmt.Sprintf("%v", drive["status"])
+        if driveStatus != "Unavailable" && driveStatus != "Disabled" {
+            up = 1.0
+        }
+
+        vfdstatus.With(labels).Set(status)
+        vfdup.With(labels).Set(up)
+        vfdspeedhz.With(labels).Set(safeFloat(drive["actualSpeed"]))
+        vfdspeedrpm.With(labels).Set(float64(safeInt(drive["rpmSpeed"])))
+        vfdspeedpercent.With(labels).Set(safeFloat(drive["actualPercent"]))
+        vfdcfm.With(labels).Set(float64(safeInt(drive["actualCfm"])))
+        vfdamperage.With(labels).Set(safeFloat(drive["current"]))
+        if ts, ok := drive["lastUpdated"].(int64); ok {
+            vfdlastupdated.With(labels).Set(float64(ts))
+        }
+
+        // Extras vanish while a drive is offline; drop their series rather than report stale values
+        extra, _ := drive["extra"].(map[string]float64)
+        if len(extra) == 0 {
+            vfdextra.DeletePartialMatch(labels)
+            continue
+        }
+        var profile DriveTypeProfile
+        if d, ok := driveConfig(ip); ok {
+            profile, _ = driveProfile(d)
+        }
+        for name, v := range extra {
+            vfdextra.With(prometheus.Labels{"ip": ip, "group": group, "fan_number": fan, "drive_id": id, "name": name, "unit": profile.extraUnit(name)}).Set(v)
+        }
+    }
+}
+
+// =====================
+// Prometheus Rules
+// =====================
+
+// Timings baked into the generated rules. Metrics refresh every 15s, so a drive whose
+// poll timestamp is older than rulesStaleAfterSec has missed several cycles.
+const (
+    rulesStaleAfterSec  = 60
+    rulesUnavailableFor = "2m"
+    rulesSpeedFor       = "1m"
+)
+
+type promRule struct {
+    Record      string
+    Alert       string
+    Expr        string
+    For         string
+    Labels      map[string]string
+    Annotations map[string]string
+}
+
+type promRuleGroup struct {
+    Name  string
+    Rules []promRule
+}
+
+// buildPrometheusRules derives recording and alerting rules from the site configuration:
+// per-group aggregates, trips, staleness, each drive's speed range, and the drive-type and
+// shadow checks. Serving them keeps site Prometheus in step with config.json.
+func buildPrometheusRules(site string, drives []DriveConfig, shadow bool) []promRuleGroup {
+    labels := func(severity string) map[string]string {
+        return map[string]string{"severity": severity, "site": site}
+    }
+    recording := promRuleGroup{Name: "vfdserver_recording", Rules: []promRule{
+        {Record: "group:vfd_cfm:sum", Expr: "sum by (group) (vfd_cfm)"},
+        {Record: "group:vfd_amperage:sum", Expr: "sum by (group) (vfd_amperage)"},
+        {Record: "group:vfd_running:count", Expr: "sum by (group) (vfd_status)"},
+        {Record: "group:vfd_up:ratio", Expr: `avg by (group) (up{ip!=""})`},
+        {Record: "group:vfd_energy_kwh:rate1h", Expr: "sum by (group) (rate(vfd_energy_kwh_total[1h])) * 3600"},
+    }}
+
+    alerts := promRuleGroup{Name: "vfdserver_alerts", Rules: []promRule{
+        {
+            Alert:       "VFDTripped",
+            Expr:        "increase(vfd_trips_total[5m]) > 0",
+            Labels:      labels("critical"),
+            Annotations: map[string]string{"summary": "Drive {{ $labels.ip }} (group {{ $labels.group }}, fan {{ $labels.fan_number }}) tripped"},
+        },
+        {
+            Alert:       "VFDUnavailable",
+            Expr:        `up{ip!=""} == 0`,
+            For:         rulesUnavailableFor,
+            Labels:      labels("warning"),
+            Annotations: map[string]string{"summary": "Drive {{ $labels.ip }} is Unavailable or Disabled"},
+        },
+        {
+            Alert:       "VFDDataStale",
+            Expr:        fmt.Sprintf("time() - vfd_last_updated_timestamp_seconds > %d", rulesStaleAfterSec),
+            Labels:      labels("critical"),
+            Annotations: map[string]string{"summary": "vfdserver has not polled drive {{ $labels.ip }} for over " + strconv.Itoa(rulesStaleAfterSec) + "s"},
+        },
+    }}
+
+    // One term per drive: limits differ between drives, and exact ip matchers need no escaping
+    var above, below []string
+    for _, d := range drives {
+        lo, hi := speedRange(&d)
+        sel := fmt.Sprintf(`{ip=%q}`, d.IP)
+        if hi > 0 {
+            above = append(above, fmt.Sprintf("vfd_speed_hz%s > %g", sel, hi))
+        }
+        if lo > 0 {
+            below = append(below, fmt.Sprintf("(vfd_speed_hz%s < %g and vfd_status%s == 1)", sel, lo, sel))
+        }
+    }
+    if len(above) > 0 {
+        alerts.Rules = append(alerts.Rules, promRule{
+            Alert:       "VFDSpeedAboveLimit",
+            Expr:        strings.Join(above, " or "),
+            For:         rulesSpeedFor,
+            Labels:      labels("warning"),
+            Annotations: map[string]string{"summary": "Drive {{ $labels.ip }} is running at {{ $value }} Hz, above its HardMaxHz"},
+        })
+    }
+    if len(below) > 0 {
+        alerts.Rules = append(alerts.Rules, promRule{
+            Alert:       "VFDSpeedBelowMinimum",
+            Expr:        strings.Join(below, " or "),
+            For:         rulesSpeedFor,
+            Labels:      labels("warning"),
+            Annotations: map[string]string{"summary": "Drive {{ $labels.ip }} is running below its minimum speed"},
+        })
+    }
+
+    alerts.Rules = append(alerts.Rules, promRule{
+        Alert:       "VFDDriveTypeMismatch",
+        Expr:        "vfd_drive_type_mismatch == 1",
+        Labels:      labels("warning"),
+        Annotations: map[string]string{"summary": "Drive {{ $labels.ip }} identifies as {{ $labels.detected }}, configured as {{ $labels.configured }}"},
+    })
+    if shadow {
+        alerts.Rules = append(alerts.Rules, promRule{
+            Alert:       "VFDShadowDivergent",
+            Expr:        "vfd_shadow_divergent == 1",
+            Labels:      labels("info"),
+            Annotations: map[string]string{"summary": "Shadow reading of {{ $labels.field }} on {{ $labels.ip }} differs from the primary"},
+        })
+    }
+    return []promRuleGroup{recording, alerts}
+}
+
+// renderPrometheusRules writes groups in Prometheus rule-file YAML. Strings are
+// double-quoted; Go's escapes are valid YAML escapes.
+func renderPrometheusRules(groups []promRuleGroup) string {
+    var b strings.Builder
+    writeMap := func(key string, m map[string]string) {
+        if len(m) == 0 {
+            return
+        }
+        fmt.Fprintf(&b, "        %s:\n", key)
+        keys := make([]string, 0, len(m))
+        for k := range m {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+            fmt.Fprintf(&b, "          %s: %s\n", k, strconv.Quote(m[k]))
+        }
+    }
+    b.WriteString("groups:\n")
+    for _, g := range groups {
+        fmt.Fprintf(&b, "  - name: %s\n    rules:\n", strconv.Quote(g.Name))
+        for _, r := range g.Rules {
+            if r.Record != "" {
+                fmt.Fprintf(&b, "      - record: %s\n", strconv.Quote(r.Record))
+            } else {
+                fmt.Fprintf(&b, "      - alert: %s\n", strconv.Quote(r.Alert))
+            }
+            fmt.Fprintf(&b, "        expr: %s\n", strconv.Quote(r.Expr))
+            if r.For != "" {
+                fmt.Fprintf(&b, "        for: %s\n", r.For)
+            }
+            writeMap("labels", r.Labels)
+            writeMap("annotations", r.Annotations)
+        }
+    }
+    return b.String()
+}
+
+// handlePrometheusRules serves the generated rules file for Prometheus rule_files
+func handlePrometheusRules(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    configMu.RLock()
+    site, shadow := appConfig.SiteName, appConfig.Shadow != nil
+    configMu.RUnlock()
+
+    w.Header().Set("Content-Type", "application/yaml")
+    io.WriteString(w, renderPrometheusRules(buildPrometheusRules(site, configuredDrives(), shadow)))
+}
+
+// =====================
+// Self-Monitoring
+// =====================
+// The default Prometheus registry already exports the server's goroutines (go_goroutines),
+// heap (go_memstats_heap_alloc_bytes) and open file descriptors (process_open_fds). This
+// section adds poll-cycle timing and the Modbus session count, and the guardrails: while
+// the host is starved, non-essential work is shed (Kafka telemetry, drive-stats saves) so
+// polling and control keep their time. Drive reads are never shed; extra registers can
+// feed scaling expressions.
+type GuardrailConfig struct {
+    MaxGoroutines  int `json:"MaxGoroutines"`  // default 5000; negative = not checked
+    MaxHeapMB      int `json:"MaxHeapMB"`      // default 0 = not checked
+    MaxPollCycleMs int `json:"MaxPollCycleMs"` // slowest acceptable poll cycle incl. start lag; default 3000, negative = not checked
+}
+
+const (
+    healthSampleInterval = 5 * time.Second
+    degradeAfterSamples  = 3  // consecutive starved samples before shedding
+    recoverAfterSamples  = 12 // consecutive healthy samples (a minute) before resuming
+)
+
+// ServerHealth is the latest self-monitoring sample, reported in /api/status
+type ServerHealth struct {
+    Goroutines     int      `json:"goroutines"`
+    HeapMB         float64  `json:"heapMB"`
+    PollCycleMs    int64    `json:"pollCycleMs"` // slowest cycle since the previous sample
+    PollLagMs      int64    `json:"pollLagMs"`   // latest start behind schedule since the previous sample
+    ModbusSessions int      `json:"modbusSessions"`
+    Degraded       bool     `json:"degraded"`
+    Reasons        []string `json:"reasons,omitempty"`  // limits exceeded in this sample
+    Shedding       []string `json:"shedding,omitempty"` // work skipped while degraded
+}
+
+// shedWork names what degraded mode skips, for logs and /api/status
+var shedWork = []string{"Kafka telemetry", "drive stats saves"}
+
+var (
+    maxPollCycleNanos atomic.Int64 // since the last health sample
+    maxPollLagNanos   atomic.Int64
+    degraded          atomic.Bool
+
+    healthMu     sync.RWMutex
+    serverHealth ServerHealth
+
+    vfdPollCycle = prometheus.NewGauge(prometheus.GaugeOpts{
+        Namespace: "vfd",
+        Name:      "poll_cycle_seconds",
+        Help:      "Slowest poll cycle in the last health sample",
+    })
+    vfdPollLag = prometheus.NewGauge(prometheus.GaugeOpts{
+        Namespace: "vfd",
+        Name:      "poll_lag_seconds",
+        Help:      "Largest delay of a poll cycle start behind its tick in the last health sample",
+    })
+    vfdModbusSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+        Namespace: "vfd",
+        Name:      "modbus_sessions",
+        Help:      "Healthy Modbus TCP sessions, dedicated write sessions included",
+    })
+    vfdDegraded = prometheus.NewGauge(prometheus.GaugeOpts{
+        Namespace: "vfd",
+        Name:      "degraded",
+        Help:      "1 while guardrails are shedding non-essential work",
+    })
+)
+
+func init() {
+    prometheus.MustRegister(vfdPollCycle, vfdPollLag, vfdModbusSessions, vfdDegraded)
+}
+
+// storeMax raises v to n if n is larger
+func storeMax(v *atomic.Int64, n int64) {
+    for {
+        cur := v.Load()
+        if n <= cur || v.CompareAndSwap(cur, n) {
+            return
+        }
+    }
+}
+
+// recordPollCycle notes a ticker-driven poll cycle: how late it started and how long it ran
+func recordPollCycle(lag, took time.Duration) {
+    storeMax(&maxPollLagNanos, int64(lag))
+    storeMax(&maxPollCycleNanos, int64(took))
+}
+
+func guardrailLimits() GuardrailConfig {
+    g := GuardrailConfig{MaxGoroutines: 5000, MaxPollCycleMs: 3000}
+    if c := appConfig.Guardrails; c != nil {
+        if c.MaxGoroutines != 0 {
+            g.MaxGoroutines = c.MaxGoroutines
+        }
+        g.MaxHeapMB = c.MaxHeapMB
+        if c.MaxPollCycleMs != 0 {
+            g.MaxPollCycleMs = c.MaxPollCycleMs
+        }
+    }
+    return g
+}
+
+// starvedReasons lists the limits a sample exceeds
+func starvedReasons(h ServerHealth, limits GuardrailConfig) []string {
+    var reasons []string
+    if limits.MaxGoroutines > 0 && h.Goroutines > limits.MaxGoroutines {
+        reasons = append(reasons, fmt.Sprintf("%d goroutines (max %d)", h.Goroutines, limits.MaxGoroutines))
+    }
+    if limits.MaxHeapMB > 0 && h.HeapMB > float64(limits.MaxHeapMB) {
+        reasons = append(reasons, fmt.Sprintf("heap %.0f MB (max %d)", h.HeapMB, limits.MaxHeapMB))
+    }
+    if limits.MaxPollCycleMs > 0 && h.PollCycleMs+h.PollLagMs > int64(limits.MaxPollCycleMs) {
+        reasons = append(reasons, fmt.Sprintf("poll cycle %d ms + lag %d ms (max %d)", h.PollCycleMs, h.PollLagMs, limits.MaxPollCycleMs))
+    }
+    return reasons
+}
+
+// guardrail debounces samples into the degraded state
+type guardrail struct {
+    starved, healthy int
+    degraded         bool
+}
+
+// observe takes one sample's reasons and reports whether the state changed
+func (g *guardrail) observe(reasons []string) bool {
+    if len(reasons) > 0 {
+        g.starved, g.healthy = g.starved+1, 0
+    } else {
+        g.starved, g.healthy = 0, g.healthy+1
+    }
+    switch {
+    case !g.degraded && g.starved >= degradeAfterSamples:
+        g.degraded = true
+        return true
+    case g.degraded && g.healthy >= recoverAfterSamples:
+        g.degraded = false
+        return true
+    }
+    return false
+}
+
+// sampleHealth reads the runtime and poll counters, resetting the per-sample maxima
+func sampleHealth() ServerHealth {
+    var ms runtime.MemStats
+    runtime.ReadMemStats(&ms)
+    h := ServerHealth{
+        Goroutines:  runtime.NumGoroutine(),
+        HeapMB:      math.Round(float64(ms.HeapAlloc)/(1<<20)*10) / 10,
+        PollCycleMs: time.Duration(maxPollCycleNanos.Swap(0)).Milliseconds(),
+        PollLagMs:   time.Duration(maxPollLagNanos.Swap(0)).Milliseconds(),
+    }
+    vfdConnectionsMu.RLock()
+    for _, conn := range vfdConnections {
+        if conn.healthy.Load() {
+            h.ModbusSessions++
+        }
+        if w := conn.writer.Load(); w != nil && w.healthy.Load() {
+            h.ModbusSessions++
+        }
+    }
+    vfdConnectionsMu.RUnlock()
+    return h
+}
+
+// monitorHealth samples the server's health, exports it, and enters or leaves degraded
+// mode, logging each transition
+func monitorHealth() {
+    var g guardrail
+    ticker := time.NewTicker(healthSampleInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        h := sampleHealth()
+        h.Reasons = starvedReasons(h, guardrailLimits())
+        if g.observe(h.Reasons) {
+            degraded.Store(g.degraded)
+            if g.degraded {
+                log.Printf("[HEALTH] Degraded: %s; shedding %s until it recovers", strings.Join(h.Reasons, ", "), strings.Join(shedWork, ", "))
+                notify(Notification{Severity: "warning", Kind: "Degraded", Message: "Server degraded (" + strings.Join(h.Reasons, ", ") + "); shedding " + strings.Join(shedWork, ", ")})
+            } else {
+                log.Printf("[HEALTH] Recovered; resuming %s", strings.Join(shedWork, ", "))
+                notify(Notification{Severity: "info", Kind: "HealthRecovered", Message: "Server recovered; resuming " + strings.Join(shedWork, ", ")})
+                if !shadowMode() {
+                    saveDriveStats(driveStatsFilePath)
+                }
+            }
+        }
+        h.Degraded = g.degraded
+        if g.degraded {
+            h.Shedding = shedWork
+        }
+
+        vfdPollCycle.Set(float64(h.PollCycleMs) / 1000)
+        vfdPollLag.Set(float64(h.PollLagMs) / 1000)
+        vfdModbusSessions.Set(float64(h.ModbusSessions))
+        vfdDegraded.Set(boolToFloat(g.degraded))
+        healthMu.Lock()
+        serverHealth = h
+        healthMu.Unlock()
+    }
+}
+
+func currentHealth() ServerHealth {
+    healthMu.RLock()
+    defer healthMu.RUnlock()
+    return serverHealth
+}
+
+// =====================
+// Kafka Streaming
+// =====================
+
+// Payload schemas. JSON messages carry the schema name in a "schema" field;
+// Avro messages are encoded against the definitions below (register them in
+// the schema registry and set EventsSchemaID/TelemetrySchemaID to get the
+// Confluent wire-format header).
+const (
+    kafkaEventSchemaName     = "vfdserver.ControlEvent.v1"
+    kafkaTelemetrySchemaName = "vfdserver.Telemetry.v1"
+
+    kafkaEventAvroSchema = `{"type":"record","name":"ControlEvent","namespace":"vfdserver","fields":[
+{"name":"site","type":"string"},
+{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}},
+{"name":"action","type":"string"},
+{"name":"speed","type":"double"},
+{"name":"drives","type":{"type":"array","items":{"type":"record","name":"DriveResult","fields":[
+{"name":"ip","type":"string"},{"name":"success","type":"boolean"},{"name":"error","type":"string"}]}}}]}`
+
+    kafkaTelemetryAvroSchema = `{"type":"record","name":"Telemetry","namespace":"vfdserver","fields":[
+{"name":"site","type":"string"},
+{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}},
+{"name":"ip","type":"string"},
+{"name":"group","type":"string"},
+{"name":"fanNumber","type":"int"},
+{"name":"status","type":"string"},
+{"name":"setSpeed","type":"double"},
+{"name":"actualSpeed","type":"double"},
+{"name":"actualPercent","type":"double"},
+{"name":"rpmSpeed","type":"int"},
+{"name":"actualCfm","type":"int"},
+{"name":"current","type":"double"},
+{"name":"clockwise","type":"boolean"}]}`
+)
+
+var kafkaWriter *kafka.Writer // nil when Kafka streaming is not configured
+
+func initKafka() {
+    kc := appConfig.Kafka
+    if kc == nil || len(kc.Brokers) == 0 {
+        return
+    }
+    if kc.Format == "" {
+        kc.Format = "json"
+    }
+    if kc.Format != "json" && kc.Format != "avro" {
+        log.Fatalf("Kafka: unsupported Format %q (want json or avro)", kc.Format)
+    }
+    kafkaWriter = &kafka.Writer{
+        Addr:         kafka.TCP(kc.Brokers...),
+        Balancer:     &kafka.Hash{}, // keyed by drive IP so each drive stays ordered within a partition
+        Async:        true,          // never block polling or control paths on the broker
+        BatchTimeout: 100 * time.Millisecond,
+        Completion: func(messages []kafka.Message, err error) {
+            if err != nil {
+                log.Printf("[KAFKA] Failed to deliver %d messages: %v", len(messages), err)
+            }
+        },
+    }
+    log.Printf("[KAFKA] Streaming to %v (events=%q, telemetry=%q, format=%s)", kc.Brokers, kc.EventsTopic, kc.TelemetryTopic, kc.Format)
+}
+
+// Minimal Avro binary encoding (spec 1.11) for the fixed schemas above
+func avroLong(buf *bytes.Buffer, v int64) {
+    var tmp [binary.MaxVarintLen64]byte
+    n := binary.PutVarint(tmp[:], v) // zig-zag varint, same as Avro
+    buf.Write(tmp[:n])
+}
+
+func avroString(buf *bytes.Buffer, v string) {
+    avroLong(buf, int64(len(v)))
+    buf.WriteString(v)
+}
+
+func avroDouble(buf *bytes.Buffer, v float64) {
+    var tmp [8]byte
+    binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+    buf.Write(tmp[:])
+}
+
+func avroBool(buf *bytes.Buffer, v bool) {
+    if v {
+        buf.WriteByte(1)
+    } else {
+        buf.WriteByte(0)
+    }
+}
+
+// avroFrame prepends the Confluent wire-format header when a schema ID is configured
+func avroFrame(schemaID int, body []byte) []byte {
+    if schemaID <= 0 {
+        return body
+    }
+    out := make([]byte, 5, 5+len(body))
+    binary.BigEndian.PutUint32(out[1:], uint32(schemaID))
+    return append(out, body...)
+}
+
+func encodeControlEventAvro(site string, event ControlEvent) []byte {
+    var buf bytes.Buffer
+    avroString(&buf, site)
+    avroLong(&buf, event.Timestamp.UnixMilli())
+    avroString(&buf, event.Action)
+    avroDouble(&buf, event.Speed)
+    if len(event.Drives) > 0 {
+        avroLong(&buf, int64(len(event.Drives)))
+        for _, d := range event.Drives {
+            avroString(&buf, d.IP)
+            avroBool(&buf, d.Success)
+            avroString(&buf, d.Error)
+        }
+    }
+    avroLong(&buf, 0) // end of array blocks
+    return buf.Bytes()
+}
+
+func encodeTelemetryAvro(site string, ts time.Time, entry map[string]interface{}) []byte {
+    var buf bytes.Buffer
+    avroString(&buf, site)
+    avroLong(&buf, ts.UnixMilli())
+    avroString(&buf, fmt.Sprintf("%v", entry["ip"]))
+    avroString(&buf, fmt.Sprintf("%v", entry["group"]))
+    avroLong(&buf, int64(safeInt(entry["fanNumber"])))
+    avroString(&buf, fmt.Sprintf("%v", entry["status"]))
+    avroDouble(&buf, safeFloat(entry["setSpeed"]))
+    avroDouble(&buf, safeFloat(entry["actualSpeed"]))
+    avroDouble(&buf, safeFloat(entry["actualPercent"]))
+    avroLong(&buf, int64(safeInt(entry["rpmSpeed"])))
+    avroLong(&buf, int64(safeInt(entry["actualCfm"])))
+    avroDouble(&buf, safeFloat(entry["current"]))
+    avroBool(&buf, safeInt(entry["clockwise"]) != 0)
+    return buf.Bytes()
+}
+
+func publishControlEventKafka(event ControlEvent) {
+    if kafkaWriter == nil || appConfig.Kafka.EventsTopic == "" {
+        return
+    }
+    kc := appConfig.Kafka
+    var value []byte
+    if kc.Format == "avro" {
+        value = avroFrame(kc.EventsSchemaID, encodeControlEventAvro(appConfig.SiteName, event))
+    } else {
+        var err error
+        value, err = json.Marshal(map[string]interface{}{
+            "schema":    kafkaEventSchemaName,
+            "site":      appConfig.SiteName,
+            "timestamp": event.Timestamp.Format(time.RFC3339Nano),
+            "action":    event.Action,
+            "speed":     event.Speed,
+            "drives":    event.Drives,
+        })
+        if err != nil {
+            log.Printf("[KAFKA] Failed to encode control event: %v", err)
+            return
+        }
+    }
+    err := kafkaWriter.WriteMessages(context.Background(), kafka.Message{
+        Topic: kc.EventsTopic,
+        Key:   []byte(appConfig.SiteName),
+        Value: value,
+    })
+    if err != nil {
+        log.Printf("[KAFKA] Failed to queue control event: %v", err)
+    }
+}
+
+// publishTelemetryKafka sends one message per drive for a completed poll cycle
+func publishTelemetryKafka(snapshot []map[string]interface{}) {
+    if kafkaWriter == nil || appConfig.Kafka.TelemetryTopic == "" || degraded.Load() {
+        return
+    }
+    kc := appConfig.Kafka
+    now := time.Now()
+    messages := make([]kafka.Message, 0, len(snapshot))
+    for _, entry := range snapshot {
+        ip, _ := entry["ip"].(string)
+        var value []byte
+        if kc.Format == "avro" {
+            value = avroFrame(kc.TelemetrySchemaID, encodeTelemetryAvro(appConfig.SiteName, now, entry))
+        } else {
+            payload := make(map[string]interface{}, len(entry)+3)
+            for k, v := range entry {
+                payload[k] = v
+            }
+            payload["schema"] = kafkaTelemetrySchemaName
+            payload["site"] = appConfig.SiteName
+            payload["timestamp"] = now.Format(time.RFC3339Nano)
+            var err error
+            value, err = json.Marshal(payload)
+            if err != nil {
+                log.Printf("[KAFKA] Failed to encode telemetry for %s: %v", ip, err)
+                continue
+            }
+        }
+        messages = append(messages, kafka.Message{Topic: kc.TelemetryTopic, Key: []byte(ip), Value: value})
+    }
+    if err := kafkaWriter.WriteMessages(context.Background(), messages...); err != nil {
+        log.Printf("[KAFKA] Failed to queue telemetry: %v", err)
+    }
+}
+
+// =====================
+// KNX Integration
+// =====================
+
+// KNXnet/IP service types used by the tunnelling client
+const (
+    knxConnectRequest     = 0x0205
+    knxConnectResponse    = 0x0206
+    knxConnStateRequest   = 0x0207
+    knxConnStateResponse  = 0x0208
+    knxDisconnectRequest  = 0x0209
+    knxDisconnectResponse = 0x020A
+    knxTunnelRequest      = 0x0420
+    knxTunnelAck          = 0x0421
+
+    cemiLDataReq = 0x11
+    cemiLDataInd = 0x29
+)
+
+// knxFanGAs is the resolved (numeric) group-address set for one drive
+type knxFanGAs struct {
+    ip                                              string
+    sw, swStatus, speed, speedStatus, faultStatus uint16
+}
+
+var (
+    knxFans      []knxFanGAs           // built once at startup
+    knxByGA      map[uint16]knxFanGAs  // bus-writable GA -> fan
+    knxTunnelMu  sync.Mutex
+    knxActive    *knxTunnel            // nil while disconnected
+    knxPublishCh = make(chan []map[string]interface{}, 1)
+)
+
+// parseGroupAddress parses "main/middle/sub" (5/3/8 bits) into its 16-bit form
+func parseGroupAddress(s string) (uint16, error) {
+    var a, b, c int
+    if n, err := fmt.Sscanf(s, "%d/%d/%d", &a, &b, &c); err != nil || n != 3 {
+        return 0, fmt.Errorf("invalid KNX group address %q", s)
+    }
+    if a < 0 || a > 31 || b < 0 || b > 7 || c < 0 || c > 255 {
+        return 0, fmt.Errorf("KNX group address %q out of range", s)
+    }
+    return uint16(a<<11 | b<<8 | c), nil
+}
+
+// buildKNXMapping resolves the group-address set for every configured drive
+func buildKNXMapping(kc *KNXConfig, vfds []DriveConfig) ([]knxFanGAs, error) {
+    fans := make([]knxFanGAs, 0, len(vfds))
+    seen := make(map[uint16]string)
+    for _, d := range vfds {
+        addrs := KNXFanAddresses{
+            Switch:       fmt.Sprintf("%d/0/%d", kc.MainGroup, d.FanNumber),
+            SwitchStatus: fmt.Sprintf("%d/1/%d", kc.MainGroup, d.FanNumber),
+            Speed:        fmt.Sprintf("%d/2/%d", kc.MainGroup, d.FanNumber),
+            SpeedStatus:  fmt.Sprintf("%d/3/%d", kc.MainGroup, d.FanNumber),
+            FaultStatus:  fmt.Sprintf("%d/4/%d", kc.MainGroup, d.FanNumber),
+        }
+        if o, ok := kc.Fans[d.IP]; ok {
+            if o.Switch != "" { addrs.Switch = o.Switch }
+            if o.SwitchStatus != "" { addrs.SwitchStatus = o.SwitchStatus }
+            if o.Speed != "" { addrs.Speed = o.Speed }
+            if o.SpeedStatus != "" { addrs.SpeedStatus = o.SpeedStatus }
+            if o.FaultStatus != "" { addrs.FaultStatus = o.FaultStatus }
+        }
+        fan := knxFanGAs{ip: d.IP}
+        for _, f := range []struct {
+            dst *uint16
+            s   string
+        }{
+            {&fan.sw, addrs.Switch}, {&fan.swStatus, addrs.SwitchStatus}, {&fan.speed, addrs.Speed},
+            {&fan.speedStatus, addrs.SpeedStatus}, {&fan.faultStatus, addrs.FaultStatus},
+        } {
+            ga, err := parseGroupAddress(f.s)
+            if err != nil {
+                return nil, fmt.Errorf("drive %s: %w", d.IP, err)
+            }
+            if other, dup := seen[ga]; dup {
+                return nil, fmt.Errorf("drive %s: KNX group address %s already used by %s", d.IP, f.s, other)
+            }
+            seen[ga] = d.IP
+            *f.dst = ga
+        }
+        fans = append(fans, fan)
+    }
+    return fans, nil
+}
+
+// knxFrame builds a KNXnet/IP frame: 6-byte header followed by body
+func knxFrame(service uint16, body []byte) []byte {
+    out := make([]byte, 6, 6+len(body))
+    out[0], out[1] = 0x06, 0x10
+    binary.BigEndian.PutUint16(out[2:], service)
+    binary.BigEndian.PutUint16(out[4:], uint16(6+len(body)))
+    return append(out, body...)
+}
+
+// knxHPAI is a "route back" (NAT) endpoint: the gateway replies to the packet source
+var knxHPAI = []byte{0x08, 0x01, 0, 0, 0, 0, 0, 0}
+
+// cemiGroupWrite builds an L_Data.req GroupValueWrite. Values up to 6 bits with
+// small=true are packed into the APCI byte (DPT 1.x); otherwise appended (DPT 5.x).
+func cemiGroupWrite(ga uint16, value byte, small bool) []byte {
+    frame := []byte{cemiLDataReq, 0x00, 0xBC, 0xE0, 0x00, 0x00, byte(ga >> 8), byte(ga)}
+    if small {
+        return append(frame, 0x01, 0x00, 0x80|(value&0x3F))
+    }
+    return append(frame, 0x02, 0x00, 0x80, value)
+}
+
+// parseCEMIGroupWrite extracts destination GA and payload from an L_Data.ind GroupValueWrite
+func parseCEMIGroupWrite(cemi []byte) (uint16, []byte, bool) {
+    if len(cemi) < 2 || cemi[0] != cemiLDataInd {
+        return 0, nil, false
+    }
+    i := 2 + int(cemi[1]) // skip additional info
+    if len(cemi) < i+9 || cemi[i+1]&0x80 == 0 { // need ctrl1, ctrl2, src, dst, len, TPCI, APCI; ctrl2 bit7 = group address
+        return 0, nil, false
+    }
+    ga := binary.BigEndian.Uint16(cemi[i+4:])
+    npduLen := int(cemi[i+6])
+    apdu := cemi[i+7:]
+    if len(apdu) < 2 || len(apdu) < npduLen+1 {
+        return 0, nil, false
+    }
+    apci := (uint16(apdu[0])&0x03)<<8 | uint16(apdu[1])
+    if apci&0x3C0 != 0x080 { // GroupValueWrite
+        return 0, nil, false
+    }
+    if npduLen == 1 {
+        return ga, []byte{apdu[1] & 0x3F}, true
+    }
+    return ga, apdu[2 : npduLen+1], true
+}
+
+type knxTunnel struct {
+    conn    *net.UDPConn
+    channel byte
+    seq     byte
+    sendMu  sync.Mutex
+    acks    chan byte
+    alive   chan struct{}
+}
+
+func dialKNXTunnel(gateway string) (*knxTunnel, error) {
+    if !strings.Contains(gateway, ":") {
+        gateway += ":3671"
+    }
+    addr, err := net.ResolveUDPAddr("udp4", gateway)
+    if err != nil {
+        return nil, err
+    }
+    conn, err := net.DialUDP("udp4", nil, addr)
+    if err != nil {
+        return nil, err
+    }
+    req := append(append(append([]byte{}, knxHPAI...), knxHPAI...), 0x04, 0x04, 0x02, 0x00) // CRI: tunnel, link layer
+    if _, err := conn.Write(knxFrame(knxConnectRequest, req)); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    buf := make([]byte, 512)
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    n, err := conn.Read(buf)
+    conn.SetReadDeadline(time.Time{})
+    if err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("no connect response: %w", err)
+    }
+    if n < 8 || binary.BigEndian.Uint16(buf[2:]) != knxConnectResponse {
+        conn.Close()
+        return nil, fmt.Errorf("unexpected connect response")
+    }
+    if buf[7] != 0 {
+        conn.Close()
+        return nil, fmt.Errorf("gateway refused tunnel (status 0x%02x)", buf[7])
+    }
+    return &knxTunnel{conn: conn, channel: buf[6], acks: make(chan byte, 4), alive: make(chan struct{}, 1)}, nil
+}
+
+// send writes a cEMI frame and waits for the gateway's tunnelling ack (one retry per spec)
+func (t *knxTunnel) send(cemi []byte) error {
+    t.sendMu.Lock()
+    defer t.sendMu.Unlock()
+    body := append([]byte{0x04, t.channel, t.seq, 0x00}, cemi...)
+    for attempt := 0; attempt < 2; attempt++ {
+        if _, err := t.conn.Write(knxFrame(knxTunnelRequest, body)); err != nil {
+            return err
+        }
+        timeout := time.After(time.Second)
+    wait:
+        for {
+            select {
+            case seq := <-t.acks:
+                if seq == t.seq {
+                    t.seq++
+                    return nil
+                }
+            case <-timeout:
+                break wait
+            }
+        }
+    }
+    return fmt.Errorf("no tunnelling ack for seq %d", t.seq)
+}
+
+func (t *knxTunnel) close() {
+    t.conn.Write(knxFrame(knxDisconnectRequest, append([]byte{t.channel, 0x00}, knxHPAI...)))
+    t.conn.Close()
+}
+
+// serve reads gateway traffic until the tunnel fails
+func (t *knxTunnel) serve() error {
+    go func() {
+        // Heartbeat: the gateway drops tunnels idle for 120s
+        ticker := time.NewTicker(60 * time.Second)
+        defer ticker.Stop()
+        for range ticker.C {
+            if _, err := t.conn.Write(knxFrame(knxConnStateRequest, append([]byte{t.channel, 0x00}, knxHPAI...))); err != nil {
+                return
+            }
+            select {
+            case <-t.alive:
+            case <-time.After(10 * time.Second):
+                log.Printf("[KNX] Heartbeat timed out, reconnecting")
+                t.conn.Close()
+                return
+            }
+        }
+    }()
+
+    buf := make([]byte, 512)
+    for {
+        n, err := t.conn.Read(buf)
+        if err != nil {
+            return err
+        }
+        if n < 6 {
+            continue
+        }
+        body := buf[6:n]
+        switch binary.BigEndian.Uint16(buf[2:]) {
+        case knxTunnelAck:
+            if len(body) >= 3 {
+                select {
+                case t.acks <- body[2]:
+                default:
+                }
+            }
+        case knxTunnelRequest:
+            if len(body) < 4 {
+                continue
+            }
+            t.conn.Write(knxFrame(knxTunnelAck, []byte{0x04, t.channel, body[2], 0x00}))
+            if ga, data, ok := parseCEMIGroupWrite(body[4:]); ok {
+                go handleKNXWrite(ga, append([]byte{}, data...))
+            }
+        case knxConnStateResponse:
+            select {
+            case t.alive <- struct{}{}:
+            default:
+            }
+        case knxDisconnectRequest:
+            t.conn.Write(knxFrame(knxDisconnectResponse, []byte{t.channel, 0x00}))
+            return fmt.Errorf("gateway closed the tunnel")
+        }
+    }
+}
+
+// handleKNXWrite turns a bus write to a fan's Switch or Speed address into a control action
+func handleKNXWrite(ga uint16, data []byte) {
+    fan, ok := knxByGA[ga]
+    if !ok || len(data) == 0 {
+        return
+    }
+    var action string
+    var speed float64
+    switch ga {
+    case fan.sw:
+        action = "Stop"
+        if data[0]&0x01 == 1 {
+            action = "Start"
+        }
+    case fan.speed:
+        // DPT 5.001: 0-255 = 0-100%, with 100% = 60 Hz as in actualPercent
+        action = "SetSpeed"
+        speed = math.Round(float64(data[0])/255*100*0.6*10) / 10
+    default:
+        return
+    }
+    log.Printf("[KNX] Group write %d/%d/%d -> %s %s %.1f", ga>>11, (ga>>8)&0x07, ga&0xFF, fan.ip, action, speed)
+    if !checkPolicies(knxRequester, action, []string{fan.ip}, "KNX").Allowed {
+        return
+    }
+    event := executeControl(action, speed, []string{fan.ip}, false)
+    event.Action = "KNX" + action
+    recordControlEvent(event)
+    go pollAllDrives()
+}
+
+// publishStatusKNX hands a snapshot to the publisher without ever blocking polling
+func publishStatusKNX(snapshot []map[string]interface{}) {
+    if knxFans == nil {
+        return
+    }
+    select {
+    case knxPublishCh <- snapshot:
+    default: // publisher still busy with the previous cycle
+    }
+}
+
+// knxPublisher writes status group addresses whose value changed since last publish
+func knxPublisher() {
+    var published *knxTunnel
+    var last map[uint16]int // last value published per status GA on the current tunnel
+    for snapshot := range knxPublishCh {
+        knxTunnelMu.Lock()
+        t := knxActive
+        knxTunnelMu.Unlock()
+        if t == nil {
+            continue
+        }
+        if t != published {
+            // New tunnel: republish everything so the bus starts from a known state
+            published = t
+            last = make(map[uint16]int)
+        }
+        byIP := make(map[string]map[string]interface{}, len(snapshot))
+        for _, entry := range snapshot {
+            if ip, ok := entry["ip"].(string); ok {
+                byIP[ip] = entry
+            }
+        }
+        for _, fan := range knxFans {
+            entry, ok := byIP[fan.ip]
+            if !ok {
+                continue
+            }
+            status, _ := entry["status"].(string)
+            pct := int(math.Round(math.Min(math.Max(safeFloat(entry["actualPercent"]), 0), 100) * 255 / 100))
+            for _, w := range []struct {
+                ga    uint16
+                value int
+                small bool
+            }{
+                {fan.swStatus, int(boolToFloat(status == "Running")), true},
+                {fan.speedStatus, pct, false},
+                {fan.faultStatus, int(boolToFloat(status == "Tripped")), true},
+            } {
+                if prev, ok := last[w.ga]; ok && prev == w.value {
+                    continue
+                }
+                if err := t.send(cemiGroupWrite(w.ga, byte(w.value), w.small)); err != nil {
+                    log.Printf("[KNX] Publish to %s failed: %v", fan.ip, err)
+                    break
+                }
+                last[w.ga] = w.value
+            }
+        }
+    }
+}
+
+// runKNX keeps a tunnel to the gateway open, reconnecting after failures
+func runKNX() {
+    for {
+        t, err := dialKNXTunnel(appConfig.KNX.Gateway)
+        if err != nil {
+            log.Printf("[KNX] Connect to %s failed: %v. Retrying in 30 seconds.", appConfig.KNX.Gateway, err)
+            time.Sleep(30 * time.Second)
+            continue
+        }
+        log.Printf("[KNX] Tunnel open to %s (channel %d)", appConfig.KNX.Gateway, t.channel)
+        knxTunnelMu.Lock()
+        knxActive = t
+        knxTunnelMu.Unlock()
+
+        err = t.serve()
+
+        knxTunnelMu.Lock()
+        knxActive = nil
+        knxTunnelMu.Unlock()
+        t.close()
+        log.Printf("[KNX] Tunnel lost: %v. Reconnecting in 5 seconds.", err)
+        time.Sleep(5 * time.Second)
+    }
+}
+
+func initKNX() {
+    if appConfig.KNX == nil || appConfig.KNX.Gateway == "" {
+        return
+    }
+    fans, err := buildKNXMapping(appConfig.KNX, configuredDrives())
+    if err != nil {
+        log.Fatalf("KNX: %v", err)
+    }
+    knxByGA = make(map[uint16]knxFanGAs, 2*len(fans))
+    for _, f := range fans {
+        knxByGA[f.sw] = f
+        knxByGA[f.speed] = f
+    }
+    knxFans = fans
+    go knxPublisher()
+    go runKNX()
+}
+
+// =====================
+// NATS Integration
+// =====================
+
+var (
+    natsConn       *nats.Conn          // nil when NATS is not configured
+    natsJS         jetstream.JetStream // nil unless EventsStream is set
+    natsPrefix     string
+    natsLastStatus = make(map[string][]byte) // last published status per IP; only touched from onPollComplete (serialized by pollMu)
+)
+
+// natsToken makes a value safe to use as a single subject token
+func natsToken(s string) string {
+    return strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_").Replace(s)
+}
+
+func initNATS() {
+    nc := appConfig.NATS
+    if nc == nil || nc.URL == "" {
+        return
+    }
+    natsPrefix = nc.SubjectPrefix
+    if natsPrefix == "" {
+        natsPrefix = "vfd." + natsToken(appConfig.SiteName)
+    }
+    opts := []nats.Option{
+        nats.Name("vfdserver " + appConfig.SiteName),
+        nats.MaxReconnects(-1), // never give up; the server outlives broker maintenance
+        nats.ReconnectWait(5 * time.Second),
+        nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+            log.Printf("[NATS] Disconnected: %v", err)
+        }),
+        nats.ReconnectHandler(func(c *nats.Conn) {
+            log.Printf("[NATS] Reconnected to %s", c.ConnectedUrl())
+        }),
+    }
+    if nc.CredsFile != "" {
+        opts = append(opts, nats.UserCredentials(nc.CredsFile))
+    }
+    conn, err := nats.Connect(nc.URL, opts...)
+    if err != nil {
+        // Not fatal: control and polling must work without the bus
+        log.Printf("[NATS] Connect to %s failed: %v; NATS integration disabled", nc.URL, err)
+        return
+    }
+
+    if nc.EventsStream != "" {
+        js, err := jetstream.New(conn)
+        if err == nil {
+            ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+            _, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+                Name:     nc.EventsStream,
+                Subjects: []string{natsPrefix + ".events"},
+                Storage:  jetstream.FileStorage,
+            })
+            cancel()
+        }
+        if err != nil {
+            log.Printf("[NATS] JetStream stream %s unavailable: %v; publishing events without persistence", nc.EventsStream, err)
+        } else {
+            natsJS = js
+        }
+    }
+
+    if _, err := conn.Subscribe(natsPrefix+".control", handleNATSControl); err != nil {
+        log.Printf("[NATS] Subscribe to %s.control failed: %v", natsPrefix, err)
+    }
+    if _, err := conn.Subscribe(natsPrefix+".devices", handleNATSDevices); err != nil {
+        log.Printf("[NATS] Subscribe to %s.devices failed: %v", natsPrefix, err)
+    }
+    natsConn = conn
+    log.Printf("[NATS] Connected to %s, subject prefix %s", conn.ConnectedUrl(), natsPrefix)
+}
+
+func handleNATSControl(msg *nats.Msg) {
+    var req struct {
+        Drives      []string `json:"drives"`
+        Action      string   `json:"action"`
+        Speed       float64  `json:"speed"`
+        Acknowledge bool     `json:"acknowledge"`
+    }
+    reply := func(v interface{}) {
+        if msg.Reply == "" {
+            return
+        }
+        data, _ := json.Marshal(v)
+        msg.Respond(data)
+    }
+    if err := json.Unmarshal(msg.Data, &req); err != nil {
+        reply(map[string]interface{}{"success": false, "error": "Failed to parse request body: " + err.Error()})
+        return
+    }
+    if !isValidControlAction(req.Action) {
+        reply(map[string]interface{}{"success": false, "error": "Invalid action"})
+        return
+    }
+    log.Printf("[NATS] Control action: Action=%s, Speed=%.2f, Drives=%v", req.Action, req.Speed, req.Drives)
+    ips, refused := checkControl(req.Action, req.Speed, req.Drives, req.Acknowledge)
+    if refused != nil {
+        resp := map[string]interface{}{"success": false, "error": refused.msg}
+        for k, v := range refused.detail {
+            resp[k] = v
+        }
+        reply(resp)
+        return
+    }
+    if dec := checkPolicies(natsRequester, req.Action, ips, "NATS"); !dec.Allowed {
+        reply(map[string]interface{}{"success": false, "error": "Refused by authorization policy", "who": natsRequester, "reason": dec.Reason, "policy": dec.Policy})
+        return
+    }
+    event := runControl(natsRequester, req.Action, req.Speed, ips, req.Acknowledge, false)
+    recordControlEvent(event)
+    go pollAllDrives()
+    reply(event)
+}
+
+func handleNATSDevices(msg *nats.Msg) {
+    vfdDataMutex.RLock()
+    data, err := json.Marshal(vfdData)
+    vfdDataMutex.RUnlock()
+    if err != nil {
+        return
+    }
+    msg.Respond(data)
+}
+
+// publishStatusNATS publishes each drive whose status changed since the last cycle
+func publishStatusNATS(snapshot []map[string]interface{}) {
+    if natsConn == nil {
+        return
+    }
+    for _, entry := range snapshot {
+        ip, _ := entry["ip"].(string)
+        // Compare without the timestamp so unchanged drives stay quiet
+        cmp := make(map[string]interface{}, len(entry))
+        for k, v := range entry {
+            if k != "lastUpdated" {
+                cmp[k] = v
+            }
+        }
+        key, err := json.Marshal(cmp)
+        if err != nil || bytes.Equal(key, natsLastStatus[ip]) {
+            continue
+        }
+        natsLastStatus[ip] = key
+        data, _ := json.Marshal(entry)
+        if err := natsConn.Publish(natsPrefix+".status."+natsToken(ip), data); err != nil {
+            log.Printf("[NATS] Status publish for %s failed: %v", ip, err)
+        }
+    }
+}
+
+func publishControlEventNATS(event ControlEvent) {
+    if natsConn == nil {
+        return
+    }
+    data, err := json.Marshal(event)
+    if err != nil {
+        return
+    }
+    subject := natsPrefix + ".events"
+    if natsJS != nil {
+        // Async publish: the ack is awaited off the control path
+        if _, err := natsJS.PublishAsync(subject, data); err != nil {
+            log.Printf("[NATS] JetStream event publish failed: %v", err)
+        }
+        return
+    }
+    if err := natsConn.Publish(subject, data); err != nil {
+        log.Printf("[NATS] Event publish failed: %v", err)
+    }
+}
+
+// =====================
+// Notifications
+// =====================
+// Notifications tell people about drive trips, drives going offline and coming back,
+// failed control actions and the server shedding work. Each configured channel is a
+// NotificationChannel built by its type's constructor in notificationChannelTypes
+// (webhook, slack, email, twilio, mqtt). A new integration that takes an HTTP POST,
+// e.g. a Teams workflow, is a webhook channel with a Template rather than new code.
+// Templates are Go text/template over a Notification. Routes pick channels by severity,
+// group and kind; without routes every notification goes to every channel. Delivery runs
+// off the poll and control paths and is dropped (and logged) if the queue backs up.
+const notificationQueueSize = 100
+
+const (
+    defaultNotificationTemplate = `[{{.Site}}] {{.Severity}}: {{.Message}}`
+    defaultNotificationSubject  = `[{{.Site}}] {{.Kind}}{{if .IP}} {{.IP}}{{end}}`
+)
+
+type NotificationConfig struct {
+    Channels          []NotificationChannelConfig `json:"Channels"`
+    Routes            []NotificationRoute         `json:"Routes,omitempty"`
+    RenotifyMinutes   int                         `json:"RenotifyMinutes,omitempty"`   // re-send unacknowledged alerts, default 60, negative disables
+    AckTimeoutMinutes int                         `json:"AckTimeoutMinutes,omitempty"` // acknowledged alerts reopen after this, default 240
+}
+
+// NotificationChannelConfig configures one channel. Which fields apply depends on Type:
+// webhook and slack use URL (webhook also Headers); email uses SMTPAddr, From, To and
+// optionally Username/Password; twilio uses Username (account SID), Password (auth token),
+// From and To; mqtt uses Broker, Topic and optionally Username/Password.
+type NotificationChannelConfig struct {
+    Name     string            `json:"Name"`
+    Type     string            `json:"Type"`
+    URL      string            `json:"URL,omitempty"`
+    Headers  map[string]string `json:"Headers,omitempty"`
+    SMTPAddr string            `json:"SMTPAddr,omitempty"` // "host:port"
+    Broker   string            `json:"Broker,omitempty"`   // "host:port", default port 1883
+    Topic    string            `json:"Topic,omitempty"`    // default "vfd/notifications"
+    From     string            `json:"From,omitempty"`
+    To       []string          `json:"To,omitempty"`
+    Username string            `json:"Username,omitempty"`
+    Password string            `json:"Password,omitempty"`
+    Template string            `json:"Template,omitempty"` // message body; webhook default is the Notification as JSON
+    Subject  string            `json:"Subject,omitempty"`  // email subject template
+}
+
+// NotificationRoute sends matching notifications to Channels. Empty Groups or Kinds match
+// any; site-wide notifications have no group and only match routes without Groups.
+type NotificationRoute struct {
+    MinSeverity string   `json:"MinSeverity,omitempty"` // info (default), warning or critical
+    Groups      []string `json:"Groups,omitempty"`
+    Kinds       []string `json:"Kinds,omitempty"`
+    Channels    []string `json:"Channels"`
+}
+
+// Notification is what templates and the default webhook body see
+type Notification struct {
+    Time     time.Time `json:"time"`
+    Site     string    `json:"site"`
+    Severity string    `json:"severity"` // info, warning or critical
+    Kind     string    `json:"kind"`     // DriveTripped, DriveUnavailable, DriveRecovered, TripLockout, ControlFailed, MaintenanceDue, Degraded, HealthRecovered, QuietHoursOverride, SetpointDrift, CurrentLimit, BaselineDeviation, EmergencyStop, Purge, DamperFault, DemandResponse, Test
+    Group    string    `json:"group,omitempty"`
+    DriveID  string    `json:"driveId,omitempty"`
+    IP       string    `json:"ip,omitempty"`
+    AlertID  string    `json:"alertId,omitempty"` // set for kinds that open alerts
+    Message  string    `json:"message"`
+}
+
+// notificationMessage is a notification rendered for one channel
+type notificationMessage struct {
+    Subject string
+    Body    string
+}
+
+// NotificationChannel delivers rendered notifications
+type NotificationChannel interface {
+    Send(ctx context.Context, n Notification, m notificationMessage) error
+}
+
+var notificationChannelTypes = map[string]func(NotificationChannelConfig) (NotificationChannel, error){
+    "webhook": newWebhookChannel,
+    "slack":   newSlackChannel,
+    "email":   newEmailChannel,
+    "twilio":  newTwilioChannel,
+    "mqtt":    newMQTTChannel,
+}
+
+var notificationSeverities = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+// notifier is a configured channel with its parsed templates
+type notifier struct {
+    cfg     NotificationChannelConfig
+    channel NotificationChannel
+    body    *template.Template // nil: webhook sends the Notification as JSON
+    subject *template.Template
+}
+
+// NotificationDelivery is a channel's last delivery, reported by /api/notifications
+type NotificationDelivery struct {
+    Time  time.Time `json:"time"`
+    Kind  string    `json:"kind"`
+    Error string    `json:"error,omitempty"`
+}
+
+var (
+    notifiers          map[string]*notifier // built once at startup
+    notificationRoutes []NotificationRoute
+    notificationQueue  = make(chan Notification, notificationQueueSize)
+    notificationsMu    sync.Mutex // protects notificationLast and notifyLastStatus
+    notificationLast   = make(map[string]NotificationDelivery)
+    notifyLastStatus   = make(map[string]string) // drive ID -> status at the last poll
+
+    vfdNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Namespace: "vfd",
+        Name:      "notifications_total",
+        Help:      "Notifications delivered per channel and result (sent, failed)",
+    }, []string{"channel", "result"})
+)
+
+func init() {
+    prometheus.MustRegister(vfdNotifications)
+}
+
+var notificationTemplateFuncs = template.FuncMap{
+    // json quotes a value for templates that build JSON bodies, e.g. {"text": {{json .Message}}}
+    "json": func(v interface{}) (string, error) {
+        b, err := json.Marshal(v)
+        return string(b), err
+    },
+}
+
+// buildNotifiers checks a Notifications config and builds its channels
+func buildNotifiers(nc *NotificationConfig) (map[string]*notifier, error) {
+    out := make(map[string]*notifier)
+    if nc == nil {
+        return out, nil
+    }
+    for _, c := range nc.Channels {
+        if c.Name == "" || out[c.Name] != nil {
+            return nil, fmt.Errorf("Notifications: channel names must be unique and non-empty (%q)", c.Name)
+        }
+        newChannel, ok := notificationChannelTypes[c.Type]
+        if !ok {
+            return nil, fmt.Errorf("Notifications: channel %s: unknown Type %q", c.Name, c.Type)
+        }
+        ch, err := newChannel(c)
+        if err != nil {
+            return nil, fmt.Errorf("Notifications: channel %s: %v", c.Name, err)
+        }
+        n := &notifier{cfg: c, channel: ch}
+        body := c.Template
+        if body == "" && c.Type != "webhook" {
+            body = defaultNotificationTemplate
+        }
+        if body != "" {
+            if n.body, err = template.New(c.Name).Funcs(notificationTemplateFuncs).Option("missingkey=error").Parse(body); err != nil {
+                return nil, fmt.Errorf("Notifications: channel %s Template: %v", c.Name, err)
+            }
+        }
+        subject := c.Subject
+        if subject == "" {
+            subject = defaultNotificationSubject
+        }
+        if n.subject, err = template.New(c.Name + " subject").Funcs(notificationTemplateFuncs).Parse(subject); err != nil {
+            return nil, fmt.Errorf("Notifications: channel %s Subject: %v", c.Name, err)
+        }
+        out[c.Name] = n
+    }
+    for i, r := range nc.Routes {
+        if _, ok := notificationSeverities[r.MinSeverity]; !ok && r.MinSeverity != "" {
+            return nil, fmt.Errorf("Notifications: Routes[%d]: unknown MinSeverity %q", i, r.MinSeverity)
+        }
+        if len(r.Channels) == 0 {
+            return nil, fmt.Errorf("Notifications: Routes[%d] has no Channels", i)
+        }
+        for _, name := range r.Channels {
+            if out[name] == nil {
+                return nil, fmt.Errorf("Notifications: Routes[%d]: unknown channel %q", i, name)
+            }
+        }
+    }
+    return out, nil
+}
+
+func initNotifications() error {
+    built, err := buildNotifiers(appConfig.Notifications)
+    if err != nil {
+        return err
+    }
+    if len(built) == 0 {
+        return nil
+    }
+    notifiers = built
+    notificationRoutes = appConfig.Notifications.Routes
+    go runNotifications()
+    log.Printf("[NOTIFY] %d notification channels", len(built))
+    return nil
+}
+
+// notificationTargets lists the channels a notification is routed to, in order
+func notificationTargets(routes []NotificationRoute, channels []string, n Notification) []string {
+    if len(routes) == 0 {
+        return channels
+    }
+    var out []string
+    seen := make(map[string]bool)
+    for _, r := range routes {
+        if notificationSeverities[n.Severity] < notificationSeverities[r.MinSeverity] {
+            continue
+        }
+        if len(r.Groups) > 0 && !containsString(r.Groups, n.Group) {
+            continue
+        }
+        if len(r.Kinds) > 0 && !containsString(r.Kinds, n.Kind) {
+            continue
+        }
+        for _, name := range r.Channels {
+            if !seen[name] {
+                seen[name] = true
+                out = append(out, name)
+            }
+        }
+    }
+    return out
+}
+
+func containsString(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// notify opens or updates the notification's alert and queues it for delivery; it never blocks
+func notify(n Notification) {
+    n.Time = time.Now()
+    n.Site = appConfig.SiteName
+    if !trackAlert(&n) {
+        return
+    }
+    queueNotification(n)
+}
+
+func queueNotification(n Notification) {
+    if len(notifiers) == 0 {
+        return
+    }
+    select {
+    case notificationQueue <- n:
+    default:
+        log.Printf("[NOTIFY] Queue full, dropped %s: %s", n.Kind, n.Message)
+    }
+}
+
+func runNotifications() {
+    names := make([]string, 0, len(notifiers))
+    for name := range notifiers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for n := range notificationQueue {
+        for _, name := range notificationTargets(notificationRoutes, names, n) {
+            deliverNotification(notifiers[name], n)
+        }
+    }
+}
+
+// renderNotification applies a channel's templates
+func renderNotification(nt *notifier, n Notification) (notificationMessage, error) {
+    var m notificationMessage
+    var buf bytes.Buffer
+    if err := nt.subject.Execute(&buf, n); err != nil {
+        return m, err
+    }
+    m.Subject = buf.String()
+    if nt.body == nil {
+        b, err := json.Marshal(n)
+        m.Body = string(b)
+        return m, err
+    }
+    buf.Reset()
+    if err := nt.body.Execute(&buf, n); err != nil {
+        return m, err
+    }
+    m.Body = buf.String()
+    return m, nil
+}
+
+func deliverNotification(nt *notifier, n Notification) {
+    m, err := renderNotification(nt, n)
+    if err == nil {
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        err = nt.channel.Send(ctx, n, m)
+        cancel()
+    }
+    d := NotificationDelivery{Time: time.Now(), Kind: n.Kind}
+    result := "sent"
+    if err != nil {
+        d.Error, result = err.Error(), "failed"
+        log.Printf("[NOTIFY] %s: %s not delivered: %v", nt.cfg.Name, n.Kind, err)
+    }
+    vfdNotifications.WithLabelValues(nt.cfg.Name, result).Inc()
+    notificationsMu.Lock()
+    notificationLast[nt.cfg.Name] = d
+    notificationsMu.Unlock()
+}
+
+// driveStatusNotification describes a poll-to-poll status change worth telling someone about
+func driveStatusNotification(prev, status string) (kind, severity string, ok bool) {
+    switch {
+    case prev == "" || prev == status:
+        return "", "", false
+    case status == "Tripped":
+        return "DriveTripped", "critical", true
+    case status == "Unavailable" && prev != "Disabled":
+        return "DriveUnavailable", "warning", true
+    case (prev == "Tripped" || prev == "Unavailable") && (status == "Running" || status == "Stopped"):
+        return "DriveRecovered", "info", true
+    }
+    return "", "", false
+}
+
+// notifyStatusChanges compares a poll snapshot with the previous one
+func notifyStatusChanges(snapshot []map[string]interface{}) {
+    if len(notifiers) == 0 && !alertsEnabled {
+        return
+    }
+    var out []Notification
+    notificationsMu.Lock()
+    for _, entry := range snapshot {
+        id, _ := entry["id"].(string)
+        status, _ := entry["status"].(string)
+        prev := notifyLastStatus[id]
+        notifyLastStatus[id] = status
+        kind, severity, ok := driveStatusNotification(prev, status)
+        if !ok {
+            continue
+        }
+        ip, _ := entry["ip"].(string)
+        n := Notification{Severity: severity, Kind: kind, Group: fmt.Sprintf("%v", entry["group"]), DriveID: id, IP: ip,
+            Message: fmt.Sprintf("Fan %v in group %v (%s) is %s, was %s", entry["fanNumber"], entry["group"], ip, status, prev)}
+        if text, _ := entry["faultText"].(string); status == "Tripped" && text != "" {
+            n.Message += ": " + text
+        }
+        out = append(out, n)
+    }
+    notificationsMu.Unlock()
+    for _, n := range out {
+        notify(n)
+    }
+}
+
+// notifyControlEvent reports the drives a control action failed on
+func notifyControlEvent(event ControlEvent) {
+    if len(notifiers) == 0 {
+        return
+    }
+    for _, d := range event.Drives {
+        if d.Success {
+            continue
+        }
+        var group string
+        if c, ok := driveConfig(d.IP); ok {
+            group = c.Group
+        }
+        notify(Notification{Severity: "warning", Kind: "ControlFailed", Group: group, DriveID: d.ID, IP: d.IP,
+            Message: fmt.Sprintf("%s failed on %s: %s", event.Action, d.IP, d.Error)})
+    }
+}
+
+// handleNotifications serves GET /api/notifications (channels with their last delivery)
+// and POST /api/notifications/test {"channel": name} (empty: every channel, unrouted)
+func handleNotifications(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    test := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/notifications"), "/") == "test"
+    switch {
+    case r.Method == http.MethodGet && !test:
+        type channelStatus struct {
+            Name string                `json:"name"`
+            Type string                `json:"type"`
+            Last *NotificationDelivery `json:"lastDelivery,omitempty"`
+        }
+        list := []channelStatus{}
+        notificationsMu.Lock()
+        for name, nt := range notifiers {
+            cs := channelStatus{Name: name, Type: nt.cfg.Type}
+            if d, ok := notificationLast[name]; ok {
+                cs.Last = &d
+            }
+            list = append(list, cs)
+        }
+        notificationsMu.Unlock()
+        sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+        json.NewEncoder(w).Encode(map[string]interface{}{"channels": list, "routes": notificationRoutes})
+        return
+    case r.Method != http.MethodPost || !test:
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    var req struct {
+        Channel string `json:"channel"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if req.Channel != "" && notifiers[req.Channel] == nil {
+        http.Error(w, "Unknown channel: "+req.Channel, http.StatusNotFound)
+        return
+    }
+    n := Notification{Time: time.Now(), Site: appConfig.SiteName, Severity: "info", Kind: "Test", Message: "Test notification from vfdserver " + Version}
+    results := make(map[string]string)
+    for name, nt := range notifiers {
+        if req.Channel != "" && name != req.Channel {
+            continue
+        }
+        deliverNotification(nt, n)
+        notificationsMu.Lock()
+        results[name] = "sent"
+        if d := notificationLast[name]; d.Error != "" {
+            results[name] = d.Error
+        }
+        notificationsMu.Unlock()
+    }
+    json.NewEncoder(w).Encode(results)
+}
+
+// --- Channel types ---
+
+type webhookChannel struct {
+    url     string
+    headers map[string]string
+}
+
+func newWebhookChannel(c NotificationChannelConfig) (NotificationChannel, error) {
+    if c.URL == "" {
+        return nil, fmt.Errorf("webhook needs a URL")
+    }
+    return &webhookChannel{url: c.URL, headers: c.Headers}, nil
+}
+
+func (c *webhookChannel) Send(ctx context.Context, n Notification, m notificationMessage) error {
+    return postNotification(ctx, c.url, "application/json", strings.NewReader(m.Body), c.headers, "", "")
+}
+
+type slackChannel struct{ url string }
+
+func newSlackChannel(c NotificationChannelConfig) (NotificationChannel, error) {
+    if c.URL == "" {
+        return nil, fmt.Errorf("slack needs the incoming webhook URL")
+    }
+    return &slackChannel{url: c.URL}, nil
+}
+
+func (c *slackChannel) Send(ctx context.Context, n Notification, m notificationMessage) error {
+    body, _ := json.Marshal(map[string]string{"text": m.Body})
+    return postNotification(ctx, c.url, "application/json", bytes.NewReader(body), nil, "", "")
+}
+
+type emailChannel struct{ cfg NotificationChannelConfig }
+
+func newEmailChannel(c NotificationChannelConfig) (NotificationChannel, error) {
+    if c.SMTPAddr == "" || c.From == "" || len(c.To) == 0 {
+        return nil, fmt.Errorf("email needs SMTPAddr, From and To")
+    }
+    if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+        return nil, fmt.Errorf("SMTPAddr: %v", err)
+    }
+    return &emailChannel{cfg: c}, nil
+}
+
+func (c *emailChannel) Send(ctx context.Context, n Notification, m notificationMessage) error {
+    var auth smtp.Auth
+    if c.cfg.Username != "" {
+        host, _, _ := net.SplitHostPort(c.cfg.SMTPAddr)
+        auth = smtp.PlainAuth("", c.cfg.Username, c.cfg.Password, host)
+    }
+    msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+        c.cfg.From, strings.Join(c.cfg.To, ", "), strings.ReplaceAll(m.Subject, "\n", " "), n.Time.Format(time.RFC1123Z), m.Body)
+    return smtp.SendMail(c.cfg.SMTPAddr, auth, c.cfg.From, c.cfg.To, []byte(msg))
+}
+
+// twilioAPIBase is the Twilio REST API root (replaced in tests)
+var twilioAPIBase = "https://api.twilio.com/2010-04-01"
+
+type twilioChannel struct{ cfg NotificationChannelConfig }
+
+func newTwilioChannel(c NotificationChannelConfig) (NotificationChannel, error) {
+    if c.Username == "" || c.Password == "" || c.From == "" || len(c.To) == 0 {
+        return nil, fmt.Errorf("twilio needs Username (account SID), Password (auth token), From and To")
+    }
+    return &twilioChannel{cfg: c}, nil
+}
+
+// Send texts every recipient; it reports the first failure after trying them all
+func (c *twilioChannel) Send(ctx context.Context, n Notification, m notificationMessage) error {
+    endpoint := twilioAPIBase + "/Accounts/" + url.PathEscape(c.cfg.Username) + "/Messages.json"
+    var first error
+    for _, to := range c.cfg.To {
+        form := url.Values{"From": {c.cfg.From}, "To": {to}, "Body": {m.Body}}
+        err := postNotification(ctx, endpoint, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), nil, c.cfg.Username, c.cfg.Password)
+        if err != nil && first == nil {
+            first = fmt.Errorf("%s: %v", to, err)
+        }
+    }
+    return first
+}
+
+// postNotification POSTs a body and expects a 2xx response
+func postNotification(ctx context.Context, endpoint, contentType string, body io.Reader, headers map[string]string, user, password string) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", contentType)
+    for k, v := range headers {
+        req.Header.Set(k, v)
+    }
+    if user != "" {
+        req.SetBasicAuth(user, password)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        detail, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+        return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+    }
+    return nil
+}
+
+// mqttChannel publishes each notification at QoS 0 over a short-lived MQTT 3.1.1
+// session; notifications are rare enough that a standing connection isn't worth keeping
+type mqttChannel struct {
+    broker, topic, clientID, user, password string
+}
+
+func newMQTTChannel(c NotificationChannelConfig) (NotificationChannel, error) {
+    if c.Broker == "" {
+        return nil, fmt.Errorf("mqtt needs a Broker")
+    }
+    broker := c.Broker
+    if _, _, err := net.SplitHostPort(broker); err != nil {
+        broker = net.JoinHostPort(broker, "1883")
+    }
+    topic := c.Topic
+    if topic == "" {
+        topic = "vfd/notifications"
+    }
+    return &mqttChannel{broker: broker, topic: topic, clientID: "vfdserver-" + c.Name, user: c.Username, password: c.Password}, nil
+}
+
+// mqttPacket frames an MQTT control packet: type/flags byte, variable-length remaining
+// length, then the body
+func mqttPacket(header byte, body []byte) []byte {
+    out := []byte{header}
+    n := len(body)
+    for {
+        b := byte(n % 128)
+        n /= 128
+        if n > 0 {
+            b |= 0x80
+        }
+        out = append(out, b)
+        if n == 0 {
+            break
+        }
+    }
+    return append(out, body...)
+}
+
+// mqttString encodes a length-prefixed UTF-8 string
+func mqttString(s string) []byte {
+    return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func (c *mqttChannel) Send(ctx context.Context, n Notification, m notificationMessage) error {
+    var d net.Dialer
+    conn, err := d.DialContext(ctx, "tcp", c.broker)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+
+    flags := byte(0x02) // clean session
+    payload := mqttString(c.clientID)
+    if c.user != "" {
+        flags |= 0x80
+        payload = append(payload, mqttString(c.user)...)
+        if c.password != "" {
+            flags |= 0x40
+            payload = append(payload, mqttString(c.password)...)
+        }
+    }
+    connect := append(append(mqttString("MQTT"), 4, flags, 0, 60), payload...) // level 4 = 3.1.1, 60 s keepalive
+    if _, err := conn.Write(mqttPacket(0x10, connect)); err != nil {
+        return err
+    }
+    ack := make([]byte, 4)
+    if _, err := io.ReadFull(conn, ack); err != nil {
+        return fmt.Errorf("CONNACK: %v", err)
+    }
+    if ack[0] != 0x20 || ack[3] != 0 {
+        return fmt.Errorf("broker refused the connection (return code %d)", ack[3])
+    }
+    publish := append(mqttString(c.topic), m.Body...)
+    if _, err := conn.Write(mqttPacket(0x30, publish)); err != nil {
+        return err
+    }
+    _, err = conn.Write([]byte{0xE0, 0x00}) // DISCONNECT
+    return err
+}
+
+// =====================
+// Alerts
+// =====================
+// An alert is a notified condition that stays true until something clears it: a tripped
+// or unavailable drive, an auto-reset lockout, a drive due for maintenance, a degraded
+// server. notify opens one alert per condition (kind and drive) and sends it again every
+// RenotifyMinutes until the condition clears or someone acknowledges it through
+// POST /api/alerts/<id>/ack. An acknowledgment pauses re-notification until its deadline
+// (AckTimeoutMinutes); if the condition is still there then, the alert reopens and is
+// sent again. Alerts are saved to alerts.json so acknowledgments survive a restart.
+const (
+    alertsFilePath       = "/etc/vfd/alerts.json"
+    alertHistorySize     = 200
+    defaultRenotifyMin   = 60
+    defaultAckTimeoutMin = 240
+)
+
+// alertKinds are the notification kinds that open alerts
+var alertKinds = map[string]bool{"DriveTripped": true, "DriveUnavailable": true, "TripLockout": true, "MaintenanceDue": true, "Degraded": true, "SetpointDrift": true, "CurrentLimit": true, "BaselineDeviation": true, "EmergencyStop": true, "Purge": true, "DamperFault": true}
+
+type Alert struct {
+    ID           string     `json:"id"`
+    Kind         string     `json:"kind"`
+    Severity     string     `json:"severity"`
+    Group        string     `json:"group,omitempty"`
+    DriveID      string     `json:"driveId,omitempty"`
+    IP           string     `json:"ip,omitempty"`
+    Message      string     `json:"message"`
+    OpenedAt     time.Time  `json:"openedAt"`
+    LastNotified time.Time  `json:"lastNotified"`
+    Notified     int        `json:"notified"` // times sent, including re-notifications
+    Reopened     int        `json:"reopened,omitempty"`
+    Ack          *AlertAck  `json:"ack,omitempty"`
+    ResolvedAt   *time.Time `json:"resolvedAt,omitempty"`
+}
+
+type AlertAck struct {
+    User    string    `json:"user"`
+    Comment string    `json:"comment,omitempty"`
+    At      time.Time `json:"at"`
+    Until   time.Time `json:"until"` // reopens after this if still active
+}
+
+type alertsFile struct {
+    Seq     int      `json:"seq"`
+    Active  []*Alert `json:"active"`
+    History []*Alert `json:"history,omitempty"`
+}
+
+var (
+    alertsEnabled bool // set by initAlerts; off in shadow mode
+    alertsMu      sync.Mutex
+    alertSeq      int
+    activeAlerts  = make(map[string]*Alert) // alertKey -> alert
+    alertHistory  []*Alert                  // resolved, oldest first
+    alertsDirty   bool
+
+    vfdAlertsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Namespace: "vfd",
+        Name:      "alerts_active",
+        Help:      "Active alerts by state (open, acknowledged)",
+    }, []string{"state"})
+)
+
+func init() {
+    prometheus.MustRegister(vfdAlertsActive)
+}
+
+func alertKey(kind, driveID string) string {
+    return kind + "/" + driveID
+}
+
+func alertIntervals() (renotify, ackTimeout time.Duration) {
+    r, a := defaultRenotifyMin, defaultAckTimeoutMin
+    if c := appConfig.Notifications; c != nil {
+        if c.RenotifyMinutes != 0 {
+            r = c.RenotifyMinutes
+        }
+        if c.AckTimeoutMinutes > 0 {
+            a = c.AckTimeoutMinutes
+        }
+    }
+    return time.Duration(r) * time.Minute, time.Duration(a) * time.Minute
+}
+
+func initAlerts() {
+    loadAlerts(alertsFilePath)
+    alertsEnabled = true
+    go runAlerts()
+}
+
+// trackAlert opens or updates the alert for a notification, tagging the notification with
+// its alert ID, and resolves the Degraded alert on HealthRecovered. It returns false when
+// the notification should not be sent because its alert is acknowledged.
+func trackAlert(n *Notification) bool {
+    if !alertsEnabled {
+        return true
+    }
+    if n.Kind == "HealthRecovered" {
+        resolveAlert("Degraded", "")
+        return true
+    }
+    if !alertKinds[n.Kind] {
+        return true
+    }
+    alertsMu.Lock()
+    defer alertsMu.Unlock()
+    alertsDirty = true
+    key := alertKey(n.Kind, n.DriveID)
+    if a := activeAlerts[key]; a != nil {
+        n.AlertID = a.ID
+        a.Message, a.Severity = n.Message, n.Severity
+        if a.Ack != nil {
+            return false
+        }
+        a.LastNotified = n.Time
+        a.Notified++
+        return true
+    }
+    alertSeq++
+    a := &Alert{ID: strconv.Itoa(alertSeq), Kind: n.Kind, Severity: n.Severity, Group: n.Group, DriveID: n.DriveID, IP: n.IP,
+        Message: n.Message, OpenedAt: n.Time, LastNotified: n.Time, Notified: 1}
+    activeAlerts[key] = a
+    n.AlertID = a.ID
+    return true
+}
+
+// resolveAlert closes the alert for a condition that has cleared
+func resolveAlert(kind, driveID string) {
+    if !alertsEnabled {
+        return
+    }
+    alertsMu.Lock()
+    defer alertsMu.Unlock()
+    key := alertKey(kind, driveID)
+    a := activeAlerts[key]
+    if a == nil {
+        return
+    }
+    now := time.Now()
+    a.ResolvedAt = &now
+    delete(activeAlerts, key)
+    alertHistory = append(alertHistory, a)
+    if len(alertHistory) > alertHistorySize {
+        alertHistory = alertHistory[len(alertHistory)-alertHistorySize:]
+    }
+    alertsDirty = true
+    log.Printf("[ALERT] %s %s resolved", a.ID, key)
+}
+
+// resolveDriveAlerts closes trip and unavailable alerts for drives whose status has moved
+// on, including drives since removed from the config
+func resolveDriveAlerts(snapshot []map[string]interface{}) {
+    if !alertsEnabled {
+        return
+    }
+    status := make(map[string]string)
+    for _, entry := range snapshot {
+        id, _ := entry["id"].(string)
+        status[id], _ = entry["status"].(string)
+    }
+    var cleared []*Alert
+    alertsMu.Lock()
+    for _, a := range activeAlerts {
+        s, ok := status[a.DriveID]
+        if (a.Kind == "DriveTripped" && (!ok || s != "Tripped")) || (a.Kind == "DriveUnavailable" && (!ok || s != "Unavailable")) {
+            cleared = append(cleared, a)
+        }
+    }
+    alertsMu.Unlock()
+    for _, a := range cleared {
+        resolveAlert(a.Kind, a.DriveID)
+    }
+}
+
+// dueAlerts returns copies of the alerts to send again: unacknowledged ones past the
+// re-notification interval, and acknowledged ones past their deadline, which reopen
+func dueAlerts(now time.Time, renotify time.Duration) []Notification {
+    alertsMu.Lock()
+    defer alertsMu.Unlock()
+    var out []Notification
+    for _, a := range activeAlerts {
+        prefix := "Still active"
+        if a.Ack != nil {
+            if now.Before(a.Ack.Until) {
+                continue
+            }
+            prefix = fmt.Sprintf("Reopened (acknowledged by %s at %s)", a.Ack.User, a.Ack.At.Format(time.RFC3339))
+            log.Printf("[ALERT] %s %s: acknowledgment by %s expired, reopening", a.ID, a.Kind, a.Ack.User)
+            a.Ack = nil
+            a.Reopened++
+        } else if renotify <= 0 || now.Sub(a.LastNotified) < renotify {
+            continue
+        }
+        a.LastNotified = now
+        a.Notified++
+        alertsDirty = true
+        out = append(out, Notification{Time: now, Site: appConfig.SiteName, Severity: a.Severity, Kind: a.Kind, Group: a.Group,
+            DriveID: a.DriveID, IP: a.IP, AlertID: a.ID, Message: prefix + ": " + a.Message})
+    }
+    return out
+}
+
+// acknowledgeAlert records an acknowledgment; it fails for unknown or resolved alerts
+func acknowledgeAlert(id, user, comment string, until time.Time) (Alert, bool) {
+    alertsMu.Lock()
+    defer alertsMu.Unlock()
+    for _, a := range activeAlerts {
+        if a.ID == id {
+            a.Ack = &AlertAck{User: user, Comment: comment, At: time.Now(), Until: until}
+            alertsDirty = true
+            return *a, true
+        }
+    }
+    return Alert{}, false
+}
+
+// runAlerts re-sends due alerts and saves changes every 30 seconds
+func runAlerts() {
+    ticker := time.NewTicker(30 * time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        renotify, _ := alertIntervals()
+        for _, n := range dueAlerts(time.Now(), renotify) {
+            queueNotification(n)
+        }
+        alertsMu.Lock()
+        dirty := alertsDirty
+        alertsDirty = false
+        open, acked := 0, 0
+        for _, a := range activeAlerts {
+            if a.Ack != nil {
+                acked++
+            } else {
+                open++
+            }
+        }
+        alertsMu.Unlock()
+        vfdAlertsActive.WithLabelValues("open").Set(float64(open))
+        vfdAlertsActive.WithLabelValues("acknowledged").Set(float64(acked))
+        if dirty {
+            if err := saveAlerts(alertsFilePath); err != nil {
+                log.Printf("[ALERT] Failed to save %s: %v", alertsFilePath, err)
+            }
+        }
+    }
+}
+
+func loadAlerts(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    var f alertsFile
+    if err := json.Unmarshal(data, &f); err != nil {
+        log.Printf("[ALERT] %s: %v", filePath, err)
+        return
+    }
+    alertsMu.Lock()
+    defer alertsMu.Unlock()
+    alertSeq, alertHistory = f.Seq, f.History
+    for _, a := range f.Active {
+        activeAlerts[alertKey(a.Kind, a.DriveID)] = a
+    }
+}
+
+func saveAlerts(filePath string) error {
+    alertsMu.Lock()
+    f := alertsFile{Seq: alertSeq, Active: sortedAlerts(), History: alertHistory}
+    data, err := json.MarshalIndent(f, "", "    ")
+    alertsMu.Unlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// sortedAlerts lists active alerts oldest first; callers hold alertsMu
+func sortedAlerts() []*Alert {
+    list := make([]*Alert, 0, len(activeAlerts))
+    for _, a := range activeAlerts {
+        list = append(list, a)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].OpenedAt.Before(list[j].OpenedAt) })
+    return list
+}
+
+// handleAlerts serves GET /api/alerts (active alerts; ?resolved=1 adds recently resolved
+// ones) and POST /api/alerts/<id>/ack {"user", "comment", "minutes"}
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/alerts"), "/")
+    if r.Method == http.MethodGet && rest == "" {
+        alertsMu.Lock()
+        resp := map[string]interface{}{"active": sortedAlerts()}
+        if r.URL.Query().Get("resolved") == "1" {
+            resolved := make([]*Alert, len(alertHistory))
+            for i, a := range alertHistory {
+                resolved[len(alertHistory)-1-i] = a
+            }
+            resp["resolved"] = resolved
+        }
+        data, err := json.Marshal(resp)
+        alertsMu.Unlock()
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Write(data)
+        return
+    }
+    id, action, _ := strings.Cut(rest, "/")
+    if r.Method != http.MethodPost || id == "" || action != "ack" {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    var req struct {
+        User    string `json:"user"`
+        Comment string `json:"comment"`
+        Minutes int    `json:"minutes"` // default AckTimeoutMinutes
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if strings.TrimSpace(req.User) == "" {
+        http.Error(w, "user is required", http.StatusBadRequest)
+        return
+    }
+    _, timeout := alertIntervals()
+    if req.Minutes > 0 {
+        timeout = time.Duration(req.Minutes) * time.Minute
+    }
+    a, ok := acknowledgeAlert(id, req.User, req.Comment, time.Now().Add(timeout))
+    if !ok {
+        http.Error(w, "No active alert "+id, http.StatusNotFound)
+        return
+    }
+    detail := fmt.Sprintf("Alert %s (%s) acknowledged by %s until %s", a.ID, a.Kind, req.User, a.Ack.Until.Format(time.RFC3339))
+    if req.Comment != "" {
+        detail += ": " + req.Comment
+    }
+    log.Printf("[ALERT] %s", detail)
+    drives := []DriveEventInfo{}
+    if a.DriveID != "" {
+        drives = append(drives, DriveEventInfo{ID: a.DriveID, IP: a.IP, Success: true})
+    }
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "AlertAck", Drives: drives, Detail: detail})
+    json.NewEncoder(w).Encode(a)
+}
+
+// =====================
+// Group Dependency Ordering
+// =====================
+
+// groupLevels is each dependent group's depth in GroupDependencies (0 = no prerequisites).
+// Built once at startup; groups not mentioned are level 0.
+var groupLevels map[string]int
+
+// buildGroupLevels assigns each group the length of its longest prerequisite chain so
+// transitive constraints hold even when an intermediate group isn't in the request.
+func buildGroupLevels(deps map[string][]string) (map[string]int, error) {
+    levels := make(map[string]int)
+    visiting := make(map[string]bool)
+    var visit func(g string, path []string) (int, error)
+    visit = func(g string, path []string) (int, error) {
+        if l, ok := levels[g]; ok {
+            return l, nil
+        }
+        if visiting[g] {
+            return 0, fmt.Errorf("GroupDependencies cycle: %s", strings.Join(append(path, g), " -> "))
+        }
+        visiting[g] = true
+        level := 0
+        for _, pre := range deps[g] {
+            l, err := visit(pre, append(path, g))
+            if err != nil {
+                return 0, err
+            }
+            level = max(level, l+1)
+        }
+        visiting[g] = false
+        levels[g] = level
+        return level, nil
+    }
+    for g := range deps {
+        if _, err := visit(g, nil); err != nil {
+            return nil, err
+        }
+    }
+    return levels, nil
+}
+
+// controlStages splits a request into ordered stages of drive IPs: prerequisite groups first
+// for actions that start drives, dependents first for stops. Other actions are one stage.
+func controlStages(action string, ips []string) [][]string {
+    configMu.RLock()
+    defer configMu.RUnlock()
+    if len(groupLevels) == 0 {
+        return [][]string{ips}
+    }
+    reverse := false
+    switch action {
+    case "Start", "SetSpeed", "Fanhold", "Reverse":
+    case "Stop", "Freespin":
+        reverse = true
+    default:
+        return [][]string{ips}
+    }
+    byLevel := make(map[int][]string)
+    for _, ip := range ips {
+        level := 0
+        if d, ok := ipToDrive[ip]; ok {
+            level = groupLevels[d.Group]
+        }
+        byLevel[level] = append(byLevel[level], ip)
+    }
+    levels := make([]int, 0, len(byLevel))
+    for l := range byLevel {
+        levels = append(levels, l)
+    }
+    sort.Ints(levels)
+    if reverse {
+        sort.Sort(sort.Reverse(sort.IntSlice(levels)))
+    }
+    stages := make([][]string, 0, len(levels))
+    for _, l := range levels {
+        stages = append(stages, byLevel[l])
+    }
+    return stages
+}
+
+// stageReached reports whether every drive in the stage has reached the state the action
+// leads to: Running after a start, anything but Running after a stop.
+func stageReached(action string, statuses map[string]string, ips []string) bool {
+    wantRunning := action != "Stop" && action != "Freespin"
+    for _, ip := range ips {
+        if (statuses[ip] == "Running") != wantRunning {
+            return false
+        }
+    }
+    return true
+}
+
+// executeStaged runs each stage and waits for it to be verified from polled data before
+// starting the next. If a stage fails or doesn't verify in time, the remaining drives are
+// not commanded — the safe outcome for both directions (supply never starts without
+// exhaust; exhaust never stops while supply is still running).
+func executeStaged(action string, speed float64, stages [][]string, ack bool) ControlEvent {
+    event := ControlEvent{Timestamp: time.Now(), Action: action, Speed: speed, Drives: make([]DriveEventInfo, 0)}
+    op := beginOperation("staged", action, speed, ack, stages)
+    defer finishOperation(op)
+    timeout := 30 * time.Second
+    if appConfig.GroupStageTimeoutSec > 0 {
+        timeout = time.Duration(appConfig.GroupStageTimeoutSec) * time.Second
+    }
+    blocked := ""
+    for i, stage := range stages {
+        if blocked != "" {
+            for _, ip := range stage {
+                event.Drives = append(event.Drives, DriveEventInfo{IP: ip, Success: false, Error: blocked})
+            }
+            continue
+        }
+        log.Printf("[STAGED] %s stage %d/%d: %v", action, i+1, len(stages), stage)
+        result := executeControlStage(action, speed, stage, ack)
+        event.Drives = append(event.Drives, result.Drives...)
+        if i == len(stages)-1 {
+            break
+        }
+        var commanded []string
+        for _, d := range result.Drives {
+            if !d.Success {
+                blocked = fmt.Sprintf("not commanded: stage %d drive %s failed (%s)", i+1, d.IP, d.Error)
+                break
+            }
+            if !d.Superseded {
+                commanded = append(commanded, d.IP)
+            }
+        }
+        if blocked != "" {
+            log.Printf("[STAGED] %s aborted: %s", action, blocked)
+            continue
+        }
+        if !waitForStage(action, commanded, timeout) {
+            blocked = fmt.Sprintf("not commanded: stage %d did not verify within %s", i+1, timeout)
+            log.Printf("[STAGED] %s aborted: %s", action, blocked)
+            continue
+        }
+        advanceOperation(op, i+1)
+    }
+    return event
+}
+
+func waitForStage(action string, ips []string, timeout time.Duration) bool {
+    deadline := time.Now().Add(timeout)
+    for {
+        pollAllDrives()
+        statuses := make(map[string]string, len(ips))
+        vfdDataMutex.RLock()
+        for _, entry := range vfdData {
+            ip, _ := entry["ip"].(string)
+            statuses[ip], _ = entry["status"].(string)
+        }
+        vfdDataMutex.RUnlock()
+        if stageReached(action, statuses, ips) {
+            return true
+        }
+        if time.Now().After(deadline) {
+            return false
+        }
+        time.Sleep(500 * time.Millisecond)
+    }
+}
+
+// =====================
+// Staggered Starts
+// =====================
+// Starting a whole group at once draws every motor's inrush current together and can trip
+// the upstream breaker. With StartStaggerMs, drives that are not already running start one
+// after another within their group; groups go in parallel and running drives are commanded
+// at once. Curtailment resume is staggered the same way.
+
+// startStagger returns a group's delay between starts
+func startStagger(group string) time.Duration {
+    ms, ok := appConfig.GroupStartStaggerMs[group]
+    if !ok {
+        ms = appConfig.StartStaggerMs
+    }
+    return time.Duration(max(ms, 0)) * time.Millisecond
+}
+
+// driveRunning reports whether a drive's last polled status is Running
+func driveRunning(ip string) bool {
+    vfdDataMutex.RLock()
+    defer vfdDataMutex.RUnlock()
+    for _, entry := range vfdData {
+        if entry["ip"] == ip {
+            return entry["status"] == "Running"
+        }
+    }
+    return false
+}
+
+// staggerSchedule gives each drive its start offset and groups the drives into slots that
+// start together, in time order. Drives keep their request order within a group.
+func staggerSchedule(ips []string, running func(string) bool) (map[string]time.Duration, []time.Duration, [][]string) {
+    offsets := make(map[string]time.Duration, len(ips))
+    started := make(map[string]int) // group -> drives given a slot so far
+    for _, ip := range ips {
+        d, ok := driveConfig(ip)
+        if !ok || running(ip) {
+            offsets[ip] = 0
+            continue
+        }
+        offsets[ip] = time.Duration(started[d.Group]) * startStagger(d.Group)
+        started[d.Group]++
+    }
+    var times []time.Duration
+    seen := make(map[time.Duration]bool)
+    for _, ip := range ips {
+        if !seen[offsets[ip]] {
+            seen[offsets[ip]] = true
+            times = append(times, offsets[ip])
+        }
+    }
+    sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+    slots := make([][]string, len(times))
+    for i, at := range times {
+        for _, ip := range ips {
+            if offsets[ip] == at {
+                slots[i] = append(slots[i], ip)
+            }
+        }
+    }
+    return offsets, times, slots
+}
+
+// executeStaggered runs the slots at their offsets. It is journalled like staged execution,
+// so drives not yet started when the server restarts are recorded as not commanded.
+func executeStaggered(action string, speed float64, offsets map[string]time.Duration, times []time.Duration, slots [][]string, ack bool) ControlEvent {
+    event := ControlEvent{Timestamp: time.Now(), Action: action, Speed: speed, Drives: make([]DriveEventInfo, 0)}
+    op := beginOperation("staggered", action, speed, ack, slots)
+    defer finishOperation(op)
+    log.Printf("[STAGGER] %s: %d drives in %d slots over %s", action, len(offsets), len(slots), times[len(times)-1])
+    begin := time.Now()
+    for i, slot := range slots {
+        time.Sleep(time.Until(begin.Add(times[i])))
+        result := executeConcurrently(action, speed, slot, ack)
+        event.Drives = append(event.Drives, result.Drives...)
+        advanceOperation(op, i+1)
+    }
+    return event
+}
+
+// =====================
+// Lead-Lag Rotation
+// =====================
+// A group with more fans than it needs can rest some of them in turn, so run hours even
+// out across the wall. Each Rotation entry keeps Standby fans of its group stopped (or at
+// StandbySpeed). Every IntervalHours the standby fans come back at the group's duty speed
+// and the duty fans with the most run hours (DriveStats.RunSeconds) take their place. The
+// returning fans are started before any fan is stood down, so airflow never drops. A group
+// with no duty fan running is not rotated, and fans that are Tripped or Unavailable are
+// left out. POST /api/rotation/<group> rotates now (optionally to a chosen standby set),
+// or holds and resumes automatic rotation. Standby sets, holds and the rotation history
+// are kept in rotation.json by drive ID.
+const rotationFilePath = "/etc/vfd/rotation.json"
+
+const rotationHistoryLimit = 100
+
+type RotationConfig struct {
+    Group         string  `json:"Group"`
+    IntervalHours float64 `json:"IntervalHours"`          // default 24
+    Standby       int     `json:"Standby"`                // fans resting at a time, default 1; at least one fan stays on duty
+    StandbySpeed  float64 `json:"StandbySpeed,omitempty"` // Hz for resting fans; 0 stops them
+}
+
+// RotationRun records one rotation (or a manual one that could not be made)
+type RotationRun struct {
+    Time      time.Time `json:"time"`
+    Group     string    `json:"group"`
+    Trigger   string    `json:"trigger"`  // "interval" or "manual"
+    Standby   []string  `json:"standby"`  // drive IDs resting after the rotation
+    Returned  []string  `json:"returned"` // drive IDs brought back to duty
+    DutySpeed float64   `json:"dutySpeed,omitempty"`
+    Result    string    `json:"result"`
+}
+
+type rotationGroupState struct {
+    Standby     []string  `json:"standby"` // drive IDs currently resting
+    LastRotated time.Time `json:"lastRotated"`
+    Held        bool      `json:"held,omitempty"`
+}
+
+// rotationFile is the rotation.json layout
+type rotationFile struct {
+    Groups  map[string]*rotationGroupState `json:"groups"`
+    History []RotationRun                  `json:"history"`
+}
+
+// RotationStatus is a group's rotation as reported by /api/rotation
+type RotationStatus struct {
+    RotationConfig
+    StandbyDrives []string           `json:"standbyDrives"` // drive IDs
+    LastRotated   *time.Time         `json:"lastRotated,omitempty"`
+    NextRotation  *time.Time         `json:"nextRotation,omitempty"`
+    Held          bool               `json:"held"`
+    RunHours      map[string]float64 `json:"runHours"` // by drive ID
+    History       []RotationRun      `json:"history"`
+}
+
+var (
+    rotationMu      sync.Mutex // protects rotationState and rotationHistory
+    rotationState   = make(map[string]*rotationGroupState)
+    rotationHistory []RotationRun
+    rotationRunMu   sync.Mutex // one rotation at a time
+)
+
+func rotationInterval(c RotationConfig) time.Duration {
+    if c.IntervalHours <= 0 {
+        return 24 * time.Hour
+    }
+    return time.Duration(c.IntervalHours * float64(time.Hour))
+}
+
+func rotationStandbyCount(c RotationConfig) int {
+    if c.Standby <= 0 {
+        return 1
+    }
+    return c.Standby
+}
+
+// validateRotation checks the Rotation entries against the configured drives
+func validateRotation(list []RotationConfig, drives []DriveConfig) error {
+    members := make(map[string]int)
+    for _, d := range drives {
+        members[d.Group]++
+    }
+    seen := make(map[string]bool)
+    for _, c := range list {
+        switch {
+        case seen[c.Group]:
+            return fmt.Errorf("Rotation: group %q is listed twice", c.Group)
+        case members[c.Group] == 0:
+            return fmt.Errorf("Rotation: group %q has no drives", c.Group)
+        case rotationStandbyCount(c) >= members[c.Group]:
+            return fmt.Errorf("Rotation: group %q has %d drives, too few to rest %d", c.Group, members[c.Group], rotationStandbyCount(c))
+        case c.IntervalHours < 0 || c.StandbySpeed < 0:
+            return fmt.Errorf("Rotation: group %q: IntervalHours and StandbySpeed cannot be negative", c.Group)
+        }
+        seen[c.Group] = true
+        for _, d := range drives {
+            if d.Group != c.Group || c.StandbySpeed == 0 {
+                continue
+            }
+            if _, err := checkSpeedLimits(&d, c.StandbySpeed, false); err != nil {
+                return fmt.Errorf("Rotation: group %q StandbySpeed on %s: %v", c.Group, d.IP, err)
+            }
+        }
+    }
+    return nil
+}
+
+func rotationConfigFor(group string) (RotationConfig, bool) {
+    configMu.RLock()
+    defer configMu.RUnlock()
+    for _, c := range appConfig.Rotation {
+        if c.Group == group {
+            return c, true
+        }
+    }
+    return RotationConfig{}, false
+}
+
+// RotationMember is a group drive as rotation sees it
+type RotationMember struct {
+    ID       string
+    IP       string
+    Status   string
+    SetSpeed float64
+    RunHours float64
+}
+
+// planRotation picks the fans to rest next: the given ones (a manual rotation), else the
+// n available fans that are not resting now, most run hours first, so every fan takes its
+// turn. It returns the new standby set, the resting fans that return to duty, and the duty
+// speed: the highest setpoint among the running duty fans.
+func planRotation(members []RotationMember, standby []string, n int, chosen []string) ([]string, []string, float64, error) {
+    resting := make(map[string]bool, len(standby))
+    for _, id := range standby {
+        resting[id] = true
+    }
+    var duty float64
+    var candidates, available []RotationMember
+    for _, m := range members {
+        if m.Status == "Running" && !resting[m.ID] && m.SetSpeed > duty {
+            duty = m.SetSpeed
+        }
+        if m.Status != "Running" && m.Status != "Stopped" {
+            continue
+        }
+        available = append(available, m)
+        if !resting[m.ID] {
+            candidates = append(candidates, m)
+        }
+    }
+    if duty <= 0 {
+        return nil, nil, 0, fmt.Errorf("no duty fan is running")
+    }
+    if n > len(available)-1 {
+        n = len(available) - 1
+    }
+    if n <= 0 {
+        return nil, nil, 0, fmt.Errorf("%d fans available, too few to rotate", len(available))
+    }
+    next := make([]string, 0, n)
+    picked := make(map[string]bool, n)
+    if chosen != nil {
+        isAvailable := make(map[string]bool, len(available))
+        for _, m := range available {
+            isAvailable[m.ID] = true
+        }
+        for _, id := range chosen {
+            if !isAvailable[id] {
+                return nil, nil, 0, fmt.Errorf("drive %s is not an available fan of the group", id)
+            }
+            if !picked[id] {
+                next = append(next, id)
+                picked[id] = true
+            }
+        }
+        if len(next) == 0 || len(next) >= len(available) {
+            return nil, nil, 0, fmt.Errorf("rest between 1 and %d of the %d available fans", len(available)-1, len(available))
+        }
+        n = len(next)
+    }
+    sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].RunHours > candidates[j].RunHours })
+    for _, m := range candidates {
+        if len(next) == n {
+            break
+        }
+        next = append(next, m.ID)
+        picked[m.ID] = true
+    }
+    // Not enough fans on duty to rest n new ones: the longest-running resting fans stay down
+    if len(next) < n {
+        rest := append([]RotationMember(nil), available...)
+        sort.SliceStable(rest, func(i, j int) bool { return rest[i].RunHours > rest[j].RunHours })
+        for _, m := range rest {
+            if len(next) < n && resting[m.ID] && !picked[m.ID] {
+                next = append(next, m.ID)
+                picked[m.ID] = true
+            }
+        }
+    }
+    var returning []string
+    for _, m := range available {
+        if resting[m.ID] && !picked[m.ID] {
+            returning = append(returning, m.ID)
+        }
+    }
+    return next, returning, duty, nil
+}
+
+// rotationMembers gathers a group's drives with their live state and run hours
+func rotationMembers(group string) []RotationMember {
+    var members []RotationMember
+    for _, d := range configuredDrives() {
+        if d.Group != group {
+            continue
+        }
+        m := RotationMember{ID: d.ID, IP: d.IP, Status: "Unavailable"}
+        if st, ok := driveStatsSnapshot(d.ID); ok {
+            m.RunHours = st.RunSeconds / 3600
+        }
+        members = append(members, m)
+    }
+    vfdDataMutex.RLock()
+    for _, entry := range vfdData {
+        for i := range members {
+            if entry["ip"] == members[i].IP {
+                members[i].Status, _ = entry["status"].(string)
+                members[i].SetSpeed = safeFloat(entry["setSpeed"])
+            }
+        }
+    }
+    vfdDataMutex.RUnlock()
+    return members
+}
+
+// rotateGroup rotates one group: resting fans return at the duty speed, then the new
+// standby set is stood down. Nothing is stood down if a returning fan fails to start.
+func rotateGroup(c RotationConfig, trigger string, chosen []string) (RotationRun, error) {
+    rotationRunMu.Lock()
+    defer rotationRunMu.Unlock()
+    run := RotationRun{Time: time.Now(), Group: c.Group, Trigger: trigger}
+    rotationMu.Lock()
+    var current []string
+    if st := rotationState[c.Group]; st != nil {
+        current = append(current, st.Standby...)
+    }
+    rotationMu.Unlock()
+
+    members := rotationMembers(c.Group)
+    var err error
+    run.Standby, run.Returned, run.DutySpeed, err = planRotation(members, current, rotationStandbyCount(c), chosen)
+    if err != nil {
+        return run, err
+    }
+    ipOf := make(map[string]string, len(members))
+    var memberIPs []string
+    for _, m := range members {
+        ipOf[m.ID] = m.IP
+        memberIPs = append(memberIPs, m.IP)
+    }
+    if _, held := arbitrate(sourceAutomation, memberIPs); len(held) > 0 {
+        return run, fmt.Errorf("drive %s is %s", held[0].IP, strings.TrimPrefix(held[0].Error, "held: "))
+    }
+    ips := func(ids []string) []string {
+        out := make([]string, len(ids))
+        for i, id := range ids {
+            out[i] = ipOf[id]
+        }
+        return out
+    }
+    failures := func(e ControlEvent) int {
+        n := 0
+        for _, d := range e.Drives {
+            if !d.Success {
+                n++
+            }
+        }
+        return n
+    }
+
+    event := ControlEvent{Timestamp: run.Time, Action: "Rotation", Speed: run.DutySpeed, Drives: []DriveEventInfo{}}
+    run.Result = "ok"
+    if len(run.Returned) > 0 {
+        // The duty speed is already in effect on the group, so it counts as acknowledged
+        up := executeControl("SetSpeed", run.DutySpeed, ips(run.Returned), true)
+        event.Drives = append(event.Drives, up.Drives...)
+        if n := failures(up); n > 0 {
+            run.Result = fmt.Sprintf("%d of %d returning fans failed; none stood down", n, len(run.Returned))
+            run.Standby = current
+        }
+    }
+    if run.Result == "ok" {
+        var down ControlEvent
+        if c.StandbySpeed > 0 {
+            down = executeControl("SetSpeed", c.StandbySpeed, ips(run.Standby), false)
+        } else {
+            down = executeControl("Stop", 0, ips(run.Standby), false)
+        }
+        event.Drives = append(event.Drives, down.Drives...)
+        if n := failures(down); n > 0 {
+            run.Result = fmt.Sprintf("%d of %d fans failed to stand down", n, len(run.Standby))
+        }
+    }
+
+    rotationMu.Lock()
+    st := rotationState[c.Group]
+    if st == nil {
+        st = &rotationGroupState{}
+        rotationState[c.Group] = st
+    }
+    st.Standby = run.Standby
+    st.LastRotated = run.Time
+    rotationHistory = append(rotationHistory, run)
+    if len(rotationHistory) > rotationHistoryLimit {
+        rotationHistory = rotationHistory[len(rotationHistory)-rotationHistoryLimit:]
+    }
+    rotationMu.Unlock()
+    if err := saveRotation(rotationFilePath); err != nil {
+        log.Printf("[ROTATION] Failed to save %s: %v", rotationFilePath, err)
+    }
+
+    event.Detail = fmt.Sprintf("group %s (%s): resting %s, returned %s at %.1f Hz: %s", c.Group, trigger, strings.Join(ips(run.Standby), ","), strings.Join(ips(run.Returned), ","), run.DutySpeed, run.Result)
+    log.Printf("[ROTATION] %s", event.Detail)
+    recordControlEvent(event)
+    go pollAllDrives()
+    return run, nil
+}
+
+// rotationDue reports whether a group's automatic rotation is due
+func rotationDue(c RotationConfig, now time.Time) bool {
+    rotationMu.Lock()
+    defer rotationMu.Unlock()
+    st := rotationState[c.Group]
+    return st == nil || (!st.Held && now.Sub(st.LastRotated) >= rotationInterval(c))
+}
+
+// runRotation checks every minute for groups due a rotation. A group that cannot be
+// rotated (e.g. it is stopped) is retried every minute; the reason is logged when it changes.
+func runRotation() {
+    skipped := make(map[string]string)
+    for range time.Tick(time.Minute) {
+        configMu.RLock()
+        list := append([]RotationConfig(nil), appConfig.Rotation...)
+        configMu.RUnlock()
+        for _, c := range list {
+            if !rotationDue(c, time.Now()) {
+                continue
+            }
+            _, err := rotateGroup(c, "interval", nil)
+            if err != nil && skipped[c.Group] != err.Error() {
+                log.Printf("[ROTATION] Group %s due but not rotated: %v", c.Group, err)
+            }
+            skipped[c.Group] = ""
+            if err != nil {
+                skipped[c.Group] = err.Error()
+            }
+        }
+    }
+}
+
+// rotationStatus reports the configured groups' rotation, with their history newest first
+func rotationStatus() []RotationStatus {
+    configMu.RLock()
+    list := append([]RotationConfig(nil), appConfig.Rotation...)
+    configMu.RUnlock()
+    out := make([]RotationStatus, 0, len(list))
+    for _, c := range list {
+        s := RotationStatus{RotationConfig: c, StandbyDrives: []string{}, RunHours: make(map[string]float64), History: []RotationRun{}}
+        for _, m := range rotationMembers(c.Group) {
+            s.RunHours[m.ID] = math.Round(m.RunHours*10) / 10
+        }
+        rotationMu.Lock()
+        if st := rotationState[c.Group]; st != nil {
+            s.StandbyDrives = append(s.StandbyDrives, st.Standby...)
+            s.Held = st.Held
+            if last := st.LastRotated; !last.IsZero() {
+                s.LastRotated = &last
+                if !st.Held {
+                    next := last.Add(rotationInterval(c))
+                    s.NextRotation = &next
+                }
+            }
+        }
+        for i := len(rotationHistory) - 1; i >= 0; i-- {
+            if rotationHistory[i].Group == c.Group {
+                s.History = append(s.History, rotationHistory[i])
+            }
+        }
+        rotationMu.Unlock()
+        out = append(out, s)
+    }
+    return out
+}
+
+func loadRotation(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    var f rotationFile
+    if err := json.Unmarshal(data, &f); err != nil {
+        log.Printf("[ROTATION] %s: %v", filePath, err)
+        return
+    }
+    rotationMu.Lock()
+    defer rotationMu.Unlock()
+    if f.Groups != nil {
+        rotationState = f.Groups
+    }
+    rotationHistory = f.History
+}
+
+func saveRotation(filePath string) error {
+    rotationMu.Lock()
+    data, err := json.MarshalIndent(rotationFile{Groups: rotationState, History: rotationHistory}, "", "    ")
+    rotationMu.Unlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// handleRotation serves GET /api/rotation[/<group>] and POST /api/rotation/<group> with
+// {"action": "rotate"} (optionally "standby": [drive IDs or IPs] to rest exactly those),
+// {"action": "hold"} or {"action": "resume"}
+func handleRotation(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    group := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rotation"), "/")
+    if r.Method == http.MethodGet {
+        list := rotationStatus()
+        if group == "" {
+            json.NewEncoder(w).Encode(list)
+            return
+        }
+        for _, s := range list {
+            if s.Group == group {
+                json.NewEncoder(w).Encode(s)
+                return
+            }
+        }
+        http.Error(w, "No rotation configured for group "+group, http.StatusNotFound)
+        return
+    }
+    if r.Method != http.MethodPost || group == "" {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    c, ok := rotationConfigFor(group)
+    if !ok {
+        http.Error(w, "No rotation configured for group "+group, http.StatusNotFound)
+        return
+    }
+    var ips []string
+    for _, d := range getDrivesForGroups([]string{group}) {
+        ips = append(ips, d.IP)
+    }
+    if !authorize(w, r, "Rotate", ips) {
+        return
+    }
+    var req struct {
+        Action  string   `json:"action"`
+        Standby []string `json:"standby"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    switch req.Action {
+    case "rotate":
+        var chosen []string
+        if len(req.Standby) > 0 {
+            for _, ip := range resolveDriveRefs(req.Standby) {
+                chosen = append(chosen, driveIDFor(ip))
+            }
+        }
+        run, err := rotateGroup(c, "manual", chosen)
+        if err != nil {
+            http.Error(w, "Cannot rotate group "+group+": "+err.Error(), http.StatusConflict)
+            return
+        }
+        json.NewEncoder(w).Encode(run)
+        return
+    case "hold", "resume":
+        rotationMu.Lock()
+        st := rotationState[group]
+        if st == nil {
+            // Never rotated: holding keeps the first rotation from happening
+            st = &rotationGroupState{Standby: []string{}}
+            rotationState[group] = st
+        }
+        st.Held = req.Action == "hold"
+        rotationMu.Unlock()
+        state := "resumed"
+        if st.Held {
+            state = "held"
+        }
+        if err := saveRotation(rotationFilePath); err != nil {
+            http.Error(w, "Failed to save rotation state: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        detail := fmt.Sprintf("group %s: automatic rotation %s", group, state)
+        log.Printf("[ROTATION] %s", detail)
+        recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "Rotation", Drives: []DriveEventInfo{}, Detail: detail})
+    default:
+        http.Error(w, `Invalid action, expected "rotate", "hold" or "resume"`, http.StatusBadRequest)
+        return
+    }
+    for _, s := range rotationStatus() {
+        if s.Group == group {
+            json.NewEncoder(w).Encode(s)
+            return
+        }
+    }
+}
+
+// =====================
+// Scheduler
+// =====================
+// Schedules run control actions at set times, e.g. SetSpeed 45 Hz on group B at 22:00 on
+// weekdays. Entries come from config.json Schedules (reloadable) and from /api/schedules
+// (persisted in schedules.json together with enable/disable overrides and last runs).
+// Times are cron expressions in local time; a run missed while the server was down is
+// not made up.
+const schedulesFilePath = "/etc/vfd/schedules.json"
+
+type Schedule struct {
+    ID          string   `json:"id"`
+    Cron        string   `json:"cron"`   // "minute hour day-of-month month day-of-week", e.g. "0 22 * * 1-5"
+    Action      string   `json:"action"` // an /api/control action
+    Speed       float64  `json:"speed,omitempty"`
+    Groups      []string `json:"groups,omitempty"` // with Drives empty too: every drive
+    Drives      []string `json:"drives,omitempty"`
+    Acknowledge bool     `json:"acknowledge,omitempty"` // permit exceeding soft speed limits
+    Disabled    bool     `json:"disabled,omitempty"`
+    Description string   `json:"description,omitempty"`
+}
+
+// ScheduleRun is the outcome of a schedule's last run
+type ScheduleRun struct {
+    Time   time.Time `json:"time"`
+    Result string    `json:"result"`
+}
+
+// ScheduleStatus is a schedule as reported by /api/schedules
+type ScheduleStatus struct {
+    Schedule
+    Source  string       `json:"source"` // "config" or "api"
+    Enabled bool         `json:"enabled"`
+    NextRun *time.Time   `json:"nextRun,omitempty"`
+    LastRun *ScheduleRun `json:"lastRun,omitempty"`
+    Error   string       `json:"error,omitempty"` // config entry that failed validation and never runs
+}
+
+// scheduleFile is the schedules.json layout
+type scheduleFile struct {
+    Schedules []Schedule             `json:"schedules"`         // created through /api/schedules
+    Enabled   map[string]bool        `json:"enabled,omitempty"` // overrides by ID, config entries included
+    LastRuns  map[string]ScheduleRun `json:"lastRuns,omitempty"`
+}
+
+var (
+    schedulesMu        sync.Mutex
+    configSchedules    []Schedule
+    configScheduleErrs = make(map[string]string)
+    apiSchedules       []Schedule
+    scheduleEnabled    = make(map[string]bool)
+    scheduleRuns       = make(map[string]ScheduleRun)
+)
+
+// cronSpec holds the values each field of a cron expression matches, as bitmasks
+type cronSpec struct {
+    minute, hour, dom, month, dow uint64
+    domAny, dowAny                bool
+}
+
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCron parses a five-field cron expression. Fields take *, values, ranges (1-5),
+// steps (*/15, 0-30/10) and comma lists; day-of-week 0 and 7 are both Sunday.
+func parseCron(expr string) (cronSpec, error) {
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return cronSpec{}, fmt.Errorf("cron %q: want 5 fields (minute hour day-of-month month day-of-week)", expr)
+    }
+    var sets [5]uint64
+    for i, f := range fields {
+        set, err := parseCronField(f, cronFieldRanges[i][0], cronFieldRanges[i][1])
+        if err != nil {
+            return cronSpec{}, fmt.Errorf("cron %q: %w", expr, err)
+        }
+        sets[i] = set
+    }
+    if sets[4]&(1<<7) != 0 {
+        sets[4] |= 1
+    }
+    return cronSpec{
+        minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+        domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*"),
+    }, nil
+}
+
+func parseCronField(field string, lo, hi int) (uint64, error) {
+    var set uint64
+    for _, part := range strings.Split(field, ",") {
+        rng, step := part, 1
+        if before, after, ok := strings.Cut(part, "/"); ok {
+            n, err := strconv.Atoi(after)
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("bad step in %q", part)
+            }
+            rng, step = before, n
+        }
+        from, to := lo, hi
+        if rng != "*" {
+            a, b, isRange := strings.Cut(rng, "-")
+            var err error
+            if from, err = strconv.Atoi(a); err != nil {
+                return 0, fmt.Errorf("bad value %q", part)
+            }
+            to = from
+            if isRange {
+                if to, err = strconv.Atoi(b); err != nil {
+                    return 0, fmt.Errorf("bad value %q", part)
+                }
+            } else if step > 1 {
+                to = hi // "5/15": from 5 every 15
+            }
+            if from < lo || to > hi || from > to {
+                return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+            }
+        }
+        for v := from; v <= to; v += step {
+            set |= 1 << v
+        }
+    }
+    return set, nil
+}
+
+// dayMatches applies cron's rule for the two day fields: when both are restricted, a day
+// matching either one runs
+func (c cronSpec) dayMatches(t time.Time) bool {
+    if c.month&(1<<int(t.Month())) == 0 {
+        return false
+    }
+    dom := c.dom&(1<<t.Day()) != 0
+    dow := c.dow&(1<<int(t.Weekday())) != 0
+    if !c.domAny && !c.dowAny {
+        return dom || dow
+    }
+    return dom && dow
+}
+
+func (c cronSpec) matches(t time.Time) bool {
+    return c.minute&(1<<t.Minute()) != 0 && c.hour&(1<<t.Hour()) != 0 && c.dayMatches(t)
+}
+
+// next returns the first matching minute after t, searching five years ahead so that
+// Feb 29 is found
+func (c cronSpec) next(t time.Time) (time.Time, bool) {
+    t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location()).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        if !c.dayMatches(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if c.matches(t) {
+            return t, true
+        }
+        t = t.Add(time.Minute)
+    }
+    return time.Time{}, false
+}
+
+// validateSchedule checks a schedule against the configured drives, including the speed
+// limits a SetSpeed would meet when it runs
+func validateSchedule(s Schedule, drives []DriveConfig) error {
+    if s.ID == "" || strings.ContainsAny(s.ID, "/ ") {
+        return fmt.Errorf("id must be non-empty, without spaces or slashes")
+    }
+    if _, err := parseCron(s.Cron); err != nil {
+        return err
+    }
+    if !isValidControlAction(s.Action) {
+        return fmt.Errorf("invalid action %q", s.Action)
+    }
+    if s.Action == "SetSpeed" && s.Speed <= 0 {
+        return fmt.Errorf("SetSpeed needs a speed")
+    }
+    byIP := make(map[string]*DriveConfig, len(drives))
+    groups := make(map[string]bool)
+    for i := range drives {
+        byIP[drives[i].IP] = &drives[i]
+        groups[drives[i].Group] = true
+    }
+    for _, g := range s.Groups {
+        if !groups[g] {
+            return fmt.Errorf("group %q has no drives", g)
+        }
+    }
+    for _, ref := range s.Drives {
+        if byIP[driveRefIP(ref, drives)] == nil {
+            return fmt.Errorf("drive %s is not configured", ref)
+        }
+    }
+    if s.Action == "SetSpeed" {
+        for _, ip := range scheduleTargets(s, drives) {
+            speed, _ := clampSpeed(byIP[ip], s.Speed)
+            if _, err := checkSpeedLimits(byIP[ip], speed, s.Acknowledge); err != nil {
+                return fmt.Errorf("%s: %v", ip, err)
+            }
+        }
+    }
+    return nil
+}
+
+// scheduleTargets resolves a schedule's drives: the listed drives plus every drive in the
+// listed groups, or all drives when neither is given
+func scheduleTargets(s Schedule, drives []DriveConfig) []string {
+    want := make(map[string]bool)
+    for _, ref := range s.Drives {
+        want[driveRefIP(ref, drives)] = true
+    }
+    for _, g := range s.Groups {
+        for _, d := range drives {
+            if d.Group == g {
+                want[d.IP] = true
+            }
+        }
+    }
+    var ips []string
+    for _, d := range drives {
+        if want[d.IP] || (len(s.Drives) == 0 && len(s.Groups) == 0) {
+            ips = append(ips, d.IP)
+        }
+    }
+    return ips
+}
+
+// setConfigSchedules replaces the config.json schedules. Invalid entries are kept for
+// /api/schedules to report but never run.
+func setConfigSchedules(list []Schedule, drives []DriveConfig) {
+    list = append([]Schedule(nil), list...)
+    errs := make(map[string]string)
+    seen := make(map[string]bool)
+    for i, s := range list {
+        if s.ID == "" {
+            list[i].ID = fmt.Sprintf("config-%d", i+1)
+            s.ID = list[i].ID
+        }
+        err := validateSchedule(s, drives)
+        if err == nil && seen[s.ID] {
+            err = fmt.Errorf("duplicate id")
+        }
+        seen[s.ID] = true
+        if err != nil {
+            errs[s.ID] = err.Error()
+            log.Printf("[SCHEDULE] config.json schedule %s: %v; it will not run", s.ID, err)
+        }
+    }
+    schedulesMu.Lock()
+    defer schedulesMu.Unlock()
+    configSchedules = list
+    configScheduleErrs = errs
+}
+
+// scheduleEnabledLocked applies a runtime override over the entry's own Disabled
+func scheduleEnabledLocked(s Schedule) bool {
+    if v, ok := scheduleEnabled[s.ID]; ok {
+        return v
+    }
+    return !s.Disabled
+}
+
+// findScheduleLocked returns a schedule by ID and whether it came from config.json
+func findScheduleLocked(id string) (Schedule, bool, bool) {
+    for _, s := range configSchedules {
+        if s.ID == id {
+            return s, true, true
+        }
+    }
+    for _, s := range apiSchedules {
+        if s.ID == id {
+            return s, false, true
+        }
+    }
+    return Schedule{}, false, false
+}
+
+// dueSchedules returns the enabled, valid schedules that match minute t
+func dueSchedules(t time.Time) []Schedule {
+    schedulesMu.Lock()
+    defer schedulesMu.Unlock()
+    var due []Schedule
+    for _, s := range append(append([]Schedule{}, configSchedules...), apiSchedules...) {
+        if configScheduleErrs[s.ID] != "" || !scheduleEnabledLocked(s) {
+            continue
+        }
+        if spec, err := parseCron(s.Cron); err == nil && spec.matches(t) {
+            due = append(due, s)
+        }
+    }
+    return due
+}
+
+// runSchedule executes one schedule and records the event and its last run
+func runSchedule(s Schedule, t time.Time) {
+    ips, held := arbitrate(sourceSchedule, scheduleTargets(s, configuredDrives()))
+    log.Printf("[SCHEDULE] %s: %s %.2f on %d drives", s.ID, s.Action, s.Speed, len(ips))
+    event := executeControl(s.Action, s.Speed, ips, s.Acknowledge)
+    event.Action = "Scheduled" + s.Action
+    event.Detail = "schedule " + s.ID
+    failed := 0
+    for _, d := range event.Drives {
+        if !d.Success {
+            failed++
+        }
+    }
+    event.Drives = append(event.Drives, held...)
+    recordControlEvent(event)
+
+    var problems []string
+    if failed > 0 {
+        problems = append(problems, fmt.Sprintf("%d of %d drives failed", failed, len(event.Drives)))
+    }
+    if len(held) > 0 {
+        problems = append(problems, fmt.Sprintf("%d held by a higher-priority source", len(held)))
+    }
+    result := "ok"
+    if len(problems) > 0 {
+        result = strings.Join(problems, "; ")
+        log.Printf("[SCHEDULE] %s: %s", s.ID, result)
+    }
+    schedulesMu.Lock()
+    scheduleRuns[s.ID] = ScheduleRun{Time: t, Result: result}
+    schedulesMu.Unlock()
+    if err := saveSchedules(schedulesFilePath); err != nil {
+        log.Printf("[SCHEDULE] Failed to save %s: %v", schedulesFilePath, err)
+    }
+    go pollAllDrives()
+}
+
+// runScheduler wakes at the start of every minute and runs the schedules due then
+func runScheduler() {
+    for {
+        now := time.Now()
+        minute := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, now.Location()).Add(time.Minute)
+        time.Sleep(minute.Sub(now))
+        for _, s := range dueSchedules(minute) {
+            go runSchedule(s, minute)
+        }
+    }
+}
+
+// listSchedules reports every schedule, config entries first
+func listSchedules(now time.Time) []ScheduleStatus {
+    schedulesMu.Lock()
+    defer schedulesMu.Unlock()
+    out := make([]ScheduleStatus, 0, len(configSchedules)+len(apiSchedules))
+    add := func(s Schedule, source string) {
+        st := ScheduleStatus{Schedule: s, Source: source, Enabled: scheduleEnabledLocked(s), Error: configScheduleErrs[s.ID]}
+        if source == "api" {
+            st.Error = ""
+        }
+        if run, ok := scheduleRuns[s.ID]; ok {
+            st.LastRun = &run
+        }
+        if spec, err := parseCron(s.Cron); err == nil && st.Enabled && st.Error == "" {
+            if next, ok := spec.next(now); ok {
+                st.NextRun = &next
+            }
+        }
+        out = append(out, st)
+    }
+    for _, s := range configSchedules {
+        add(s, "config")
+    }
+    for _, s := range apiSchedules {
+        add(s, "api")
+    }
+    return out
+}
+
+func loadSchedules(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    var f scheduleFile
+    if err := json.Unmarshal(data, &f); err != nil {
+        log.Printf("[SCHEDULE] %s: %v", filePath, err)
+        return
+    }
+    schedulesMu.Lock()
+    defer schedulesMu.Unlock()
+    apiSchedules = f.Schedules
+    if f.Enabled != nil {
+        scheduleEnabled = f.Enabled
+    }
+    if f.LastRuns != nil {
+        scheduleRuns = f.LastRuns
+    }
+}
+
+func saveSchedules(filePath string) error {
+    schedulesMu.Lock()
+    data, err := json.MarshalIndent(scheduleFile{Schedules: apiSchedules, Enabled: scheduleEnabled, LastRuns: scheduleRuns}, "", "    ")
+    schedulesMu.Unlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// handleSchedules serves GET/POST /api/schedules (list, create) and PUT {"enabled": bool} /
+// DELETE on /api/schedules/<id>. Only schedules created through the API can be deleted.
+func handleSchedules(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/schedules"), "/")
+    if r.Method == http.MethodGet && id == "" {
+        json.NewEncoder(w).Encode(listSchedules(time.Now()))
+        return
+    }
+    if (id == "" && r.Method != http.MethodPost) || (id != "" && r.Method != http.MethodPut && r.Method != http.MethodDelete) {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+
+    var detail string
+    switch r.Method {
+    case http.MethodPost:
+        var s Schedule
+        dec := json.NewDecoder(r.Body)
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&s); err != nil {
+            http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        if err := validateSchedule(s, configuredDrives()); err != nil {
+            http.Error(w, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        // The scheduler runs it later without a requester, so the policies apply now
+        if !authorize(w, r, s.Action, scheduleTargets(s, configuredDrives())) {
+            return
+        }
+        schedulesMu.Lock()
+        if _, _, exists := findScheduleLocked(s.ID); exists {
+            schedulesMu.Unlock()
+            http.Error(w, "Schedule already exists: "+s.ID, http.StatusConflict)
+            return
+        }
+        apiSchedules = append(apiSchedules, s)
+        schedulesMu.Unlock()
+        id, detail = s.ID, fmt.Sprintf("%s created: %s %s", s.ID, s.Cron, s.Action)
+
+    case http.MethodPut:
+        var req struct {
+            Enabled *bool `json:"enabled"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+            http.Error(w, `Request body must be {"enabled": true|false}`, http.StatusBadRequest)
+            return
+        }
+        schedulesMu.Lock()
+        s, _, ok := findScheduleLocked(id)
+        schedulesMu.Unlock()
+        if !ok {
+            http.Error(w, "Unknown schedule: "+id, http.StatusNotFound)
+            return
+        }
+        if *req.Enabled && !authorize(w, r, s.Action, scheduleTargets(s, configuredDrives())) {
+            return
+        }
+        schedulesMu.Lock()
+        if _, _, ok := findScheduleLocked(id); !ok {
+            schedulesMu.Unlock()
+            http.Error(w, "Unknown schedule: "+id, http.StatusNotFound)
+            return
+        }
+        scheduleEnabled[id] = *req.Enabled
+        schedulesMu.Unlock()
+        detail = fmt.Sprintf("%s enabled=%v", id, *req.Enabled)
+
+    case http.MethodDelete:
+        schedulesMu.Lock()
+        _, fromConfig, ok := findScheduleLocked(id)
+        if !ok || fromConfig {
+            schedulesMu.Unlock()
+            if fromConfig {
+                http.Error(w, "Schedule "+id+" is defined in config.json; disable it instead", http.StatusConflict)
+            } else {
+                http.Error(w, "Unknown schedule: "+id, http.StatusNotFound)
+            }
+            return
+        }
+        for i, s := range apiSchedules {
+            if s.ID == id {
+                apiSchedules = append(apiSchedules[:i:i], apiSchedules[i+1:]...)
+                break
+            }
+        }
+        delete(scheduleEnabled, id)
+        delete(scheduleRuns, id)
+        schedulesMu.Unlock()
+        detail = id + " deleted"
+    }
+
+    if err := saveSchedules(schedulesFilePath); err != nil {
+        http.Error(w, "Failed to save schedules: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    log.Printf("[SCHEDULE] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "Schedule", Drives: []DriveEventInfo{}, Detail: detail})
+    for _, st := range listSchedules(time.Now()) {
+        if st.ID == id {
+            json.NewEncoder(w).Encode(st)
+            return
+        }
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{"deleted": id})
+}
+
+// =====================
+// Speed Presets
+// =====================
+// A preset is a named recipe of speeds, by group and optionally by drive ("Night quiet",
+// "Full cooling", "Economizer"). Presets are managed through /api/presets, persisted in
+// presets.json, and applied with the ApplyPreset control action. Applying one runs a SetSpeed
+// per distinct speed, fastest first, and a Stop for speed 0 last, so airflow
+// comes up before anything is stopped. The usual limits, quiet hours and airflow
+// reservations apply to each part. Drives the preset doesn't cover are left alone.
+const presetsFilePath = "/etc/vfd/presets.json"
+
+type SpeedPreset struct {
+    Name        string             `json:"name"`
+    Description string             `json:"description,omitempty"`
+    Groups      map[string]float64 `json:"groups,omitempty"` // group -> Hz; 0 stops the group
+    Drives      map[string]float64 `json:"drives,omitempty"` // drive ID or IP -> Hz; wins over its group
+    UpdatedAt   time.Time          `json:"updatedAt"`
+}
+
+var (
+    presetsMu sync.Mutex
+    presets   = make(map[string]SpeedPreset)
+)
+
+// presetTargets resolves a preset to a speed per drive IP
+func presetTargets(p SpeedPreset, drives []DriveConfig) map[string]float64 {
+    targets := make(map[string]float64)
+    known := make(map[string]bool, len(drives))
+    for _, d := range drives {
+        known[d.IP] = true
+        if hz, ok := p.Groups[d.Group]; ok {
+            targets[d.IP] = hz
+        }
+    }
+    for ref, hz := range p.Drives {
+        if ip := driveRefIP(ref, drives); known[ip] {
+            targets[ip] = hz
+        }
+    }
+    return targets
+}
+
+func validatePreset(p SpeedPreset, drives []DriveConfig) error {
+    if p.Name == "" || strings.ContainsAny(p.Name, "/") {
+        return fmt.Errorf("name must be non-empty and cannot contain '/'")
+    }
+    if len(p.Groups) == 0 && len(p.Drives) == 0 {
+        return fmt.Errorf("preset %q sets no groups or drives", p.Name)
+    }
+    groups := make(map[string]bool)
+    for _, d := range drives {
+        groups[d.Group] = true
+    }
+    for g := range p.Groups {
+        if !groups[g] {
+            return fmt.Errorf("group %q has no drives", g)
+        }
+    }
+    byIP := make(map[string]*DriveConfig, len(drives))
+    for i := range drives {
+        byIP[drives[i].IP] = &drives[i]
+    }
+    for ref := range p.Drives {
+        if byIP[driveRefIP(ref, drives)] == nil {
+            return fmt.Errorf("unknown drive %q", ref)
+        }
+    }
+    for ip, hz := range presetTargets(p, drives) {
+        if hz < 0 {
+            return fmt.Errorf("%s: speed cannot be negative", ip)
+        }
+        if hz == 0 {
+            continue
+        }
+        speed, _ := clampSpeed(byIP[ip], hz)
+        // Soft limits are confirmed when the preset is applied
+        if _, err := checkSpeedLimits(byIP[ip], speed, true); err != nil {
+            return fmt.Errorf("%s: %v", ip, err)
+        }
+    }
+    return nil
+}
+
+// presetSteps orders a preset's targets into control steps: SetSpeed per distinct speed,
+// fastest first, then Stop for the drives set to 0
+func presetSteps(targets map[string]float64) []presetStep {
+    bySpeed := make(map[float64][]string)
+    for ip, hz := range targets {
+        bySpeed[hz] = append(bySpeed[hz], ip)
+    }
+    var steps []presetStep
+    for hz, ips := range bySpeed {
+        sort.Strings(ips)
+        action := "SetSpeed"
+        if hz == 0 {
+            action = "Stop"
+        }
+        steps = append(steps, presetStep{Action: action, Speed: hz, IPs: ips})
+    }
+    sort.Slice(steps, func(i, j int) bool { return steps[i].Speed > steps[j].Speed })
+    return steps
+}
+
+type presetStep struct {
+    Action string
+    Speed  float64
+    IPs    []string
+}
+
+// applyPreset runs a preset's steps and returns the combined event (not yet recorded)
+func applyPreset(p SpeedPreset, ack bool) ControlEvent {
+    event := ControlEvent{Timestamp: time.Now(), Action: "ApplyPreset", Drives: make([]DriveEventInfo, 0), Detail: "preset " + p.Name}
+    for _, step := range presetSteps(presetTargets(p, configuredDrives())) {
+        result := executeControl(step.Action, step.Speed, step.IPs, ack)
+        for _, info := range result.Drives {
+            if step.Action == "SetSpeed" {
+                info.Warning = joinWarnings(fmt.Sprintf("%.1f Hz", step.Speed), info.Warning)
+            } else {
+                info.Warning = joinWarnings("stopped", info.Warning)
+            }
+            event.Drives = append(event.Drives, info)
+        }
+        if result.Detail != "" {
+            event.Detail += "; " + result.Detail
+        }
+    }
+    return event
+}
+
+func presetByName(name string) (SpeedPreset, bool) {
+    presetsMu.Lock()
+    defer presetsMu.Unlock()
+    p, ok := presets[name]
+    return p, ok
+}
+
+func loadPresets(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    loaded := make(map[string]SpeedPreset)
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("[PRESET] %s: %v", filePath, err)
+        return
+    }
+    presetsMu.Lock()
+    presets = loaded
+    presetsMu.Unlock()
+}
+
+func savePresets(filePath string) error {
+    presetsMu.Lock()
+    data, err := json.MarshalIndent(presets, "", "    ")
+    presetsMu.Unlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// handlePresets serves GET /api/presets[/<name>], PUT /api/presets/<name> to create or
+// replace a preset and DELETE /api/presets/<name>. Presets are applied through
+// /api/control with {"action": "ApplyPreset", "preset": name}.
+func handlePresets(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/presets"), "/")
+    if r.Method == http.MethodGet {
+        if name != "" {
+            p, ok := presetByName(name)
+            if !ok {
+                http.Error(w, "Unknown preset: "+name, http.StatusNotFound)
+                return
+            }
+            json.NewEncoder(w).Encode(p)
+            return
+        }
+        list := []SpeedPreset{}
+        presetsMu.Lock()
+        for _, p := range presets {
+            list = append(list, p)
+        }
+        presetsMu.Unlock()
+        sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+        json.NewEncoder(w).Encode(list)
+        return
+    }
+    if name == "" || (r.Method != http.MethodPut && r.Method != http.MethodDelete) {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+
+    var detail string
+    var p SpeedPreset
+    if r.Method == http.MethodDelete {
+        presetsMu.Lock()
+        _, ok := presets[name]
+        delete(presets, name)
+        presetsMu.Unlock()
+        if !ok {
+            http.Error(w, "Unknown preset: "+name, http.StatusNotFound)
+            return
+        }
+        detail = name + " deleted"
+    } else {
+        dec := json.NewDecoder(r.Body)
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&p); err != nil {
+            http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        p.Name, p.UpdatedAt = name, time.Now()
+        if err := validatePreset(p, configuredDrives()); err != nil {
+            http.Error(w, "Invalid preset: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        presetsMu.Lock()
+        _, replaced := presets[name]
+        presets[name] = p
+        presetsMu.Unlock()
+        detail = name + " created"
+        if replaced {
+            detail = name + " replaced"
+        }
+    }
+
+    if err := savePresets(presetsFilePath); err != nil {
+        http.Error(w, "Failed to save presets: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    log.Printf("[PRESET] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "Preset", Drives: []DriveEventInfo{}, Detail: detail})
+    if r.Method == http.MethodDelete {
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    json.NewEncoder(w).Encode(p)
+}
+
+// =====================
+// Offline Command Queue
+// =====================
+
+// QueuedCommand is a control action held for an Unavailable drive and executed when
+// its connection comes back. Only the latest command per drive is kept: replaying a
+// stale sequence of commands onto a drive that just returned is never what's wanted.
+type QueuedCommand struct {
+    ID          string    `json:"id"`
+    IP          string    `json:"ip"`
+    Action      string    `json:"action"`
+    Speed       float64   `json:"speed"`
+    Acknowledge bool      `json:"acknowledge,omitempty"` // soft speed limit override carried from the original request
+    QueuedAt    time.Time `json:"queuedAt"`
+    ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+const (
+    commandQueueFilePath = "/etc/vfd/command_queue.json"
+    commandQueueMaxTTL   = 24 * time.Hour
+)
+
+var (
+    commandQueue   = make(map[string]QueuedCommand) // ip -> pending command
+    commandQueueMu sync.Mutex
+)
+
+// enqueueCommand stores cmd, returning the command it replaced (if any)
+func enqueueCommand(cmd QueuedCommand) (QueuedCommand, bool) {
+    commandQueueMu.Lock()
+    defer commandQueueMu.Unlock()
+    prev, replaced := commandQueue[cmd.IP]
+    commandQueue[cmd.IP] = cmd
+    return prev, replaced
+}
+
+// pruneCommandQueue drops expired commands and returns them
+func pruneCommandQueue(now time.Time) []QueuedCommand {
+    commandQueueMu.Lock()
+    defer commandQueueMu.Unlock()
+    var expired []QueuedCommand
+    for ip, cmd := range commandQueue {
+        if now.After(cmd.ExpiresAt) {
+            expired = append(expired, cmd)
+            delete(commandQueue, ip)
+        }
+    }
+    return expired
+}
+
+// takeQueuedCommand removes and returns the drive's pending command unless it has expired
+func takeQueuedCommand(ip string, now time.Time) (QueuedCommand, bool) {
+    commandQueueMu.Lock()
+    defer commandQueueMu.Unlock()
+    cmd, ok := commandQueue[ip]
+    if !ok {
+        return cmd, false
+    }
+    delete(commandQueue, ip)
+    if now.After(cmd.ExpiresAt) {
+        log.Printf("[QUEUE] %s for %s expired at %s, not executed", cmd.Action, ip, cmd.ExpiresAt.Format(time.RFC3339))
+        return cmd, false
+    }
+    return cmd, true
+}
+
+// cancelQueuedCommands removes commands matching any of the IDs or drive IPs
+func cancelQueuedCommands(ids, ips []string) []QueuedCommand {
+    match := make(map[string]bool, len(ids)+len(ips))
+    for _, v := range append(ids, ips...) {
+        match[v] = true
+    }
+    commandQueueMu.Lock()
+    defer commandQueueMu.Unlock()
+    var cancelled []QueuedCommand
+    for ip, cmd := range commandQueue {
+        if match[cmd.ID] || match[ip] {
+            cancelled = append(cancelled, cmd)
+            delete(commandQueue, ip)
+        }
+    }
+    return cancelled
+}
+
+// queueOfflineDrives queues the action for drives currently Unavailable and returns
+// the drives to execute immediately plus event entries for the queued ones.
+func queueOfflineDrives(action string, speed float64, ack bool, ips []string, ttl time.Duration, now time.Time) ([]string, []DriveEventInfo) {
+    offline := make(map[string]bool)
+    vfdDataMutex.RLock()
+    for _, entry := range vfdData {
+        if entry["status"] == "Unavailable" {
+            offline[entry["ip"].(string)] = true
+        }
+    }
+    vfdDataMutex.RUnlock()
+
+    online := make([]string, 0, len(ips))
+    var queued []DriveEventInfo
+    for _, ip := range ips {
+        // A tagged-out drive is refused now rather than queued
+        if !offline[ip] || tagoutError(ip) != nil {
+            online = append(online, ip)
+            continue
+        }
+        cmd := QueuedCommand{
+            ID:          fmt.Sprintf("%x", now.UnixNano()) + "-" + ip,
+            IP:          ip,
+            Action:      action,
+            Speed:       speed,
+            Acknowledge: ack,
+            QueuedAt:    now,
+            ExpiresAt:   now.Add(ttl),
+        }
+        if prev, replaced := enqueueCommand(cmd); replaced {
+            log.Printf("[QUEUE] %s for %s replaces queued %s", action, ip, prev.Action)
+        } else {
+            log.Printf("[QUEUE] %s queued for %s until %s", action, ip, cmd.ExpiresAt.Format(time.RFC3339))
+        }
+        queued = append(queued, DriveEventInfo{IP: ip, Success: true, Queued: true})
+    }
+    if len(queued) > 0 {
+        saveCommandQueue(commandQueueFilePath)
+    }
+    return online, queued
+}
+
+// runQueuedCommand executes a drive's pending command once it has reconnected and
+// been polled (control is refused while vfdData still shows it Unavailable). If the
+// drive drops again first, the command stays queued for the next reconnect.
+func runQueuedCommand(ip string) {
+    if shadowMode() {
+        return
+    }
+    commandQueueMu.Lock()
+    _, pending := commandQueue[ip]
+    commandQueueMu.Unlock()
+    if !pending {
+        return
+    }
+    deadline := time.Now().Add(15 * time.Second)
+    for {
+        vfdDataMutex.RLock()
+        var status string
+        for _, entry := range vfdData {
+            if entry["ip"] == ip {
+                status, _ = entry["status"].(string)
+                break
+            }
+        }
+        vfdDataMutex.RUnlock()
+        if isPolledStatus(status) {
+            break
+        }
+        if time.Now().After(deadline) {
+            log.Printf("[QUEUE] %s reconnected but was not polled successfully; keeping its queued command", ip)
+            return
+        }
+        time.Sleep(500 * time.Millisecond)
+    }
+
+    cmd, ok := takeQueuedCommand(ip, time.Now())
+    saveCommandQueue(commandQueueFilePath)
+    if !ok {
+        return
+    }
+    log.Printf("[QUEUE] Executing queued %s (%.2f) on %s, queued at %s", cmd.Action, cmd.Speed, ip, cmd.QueuedAt.Format(time.RFC3339))
+    event := executeControl(cmd.Action, cmd.Speed, []string{ip}, cmd.Acknowledge)
+    event.Action = "Queued" + cmd.Action
+    recordControlEvent(event)
+    go pollAllDrives()
+}
+
+func loadCommandQueue(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    loaded := make(map[string]QueuedCommand)
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("Failed to decode command queue from %s: %v", filePath, err)
+        return
+    }
+    commandQueueMu.Lock()
+    commandQueue = loaded
+    commandQueueMu.Unlock()
+    for _, cmd := range pruneCommandQueue(time.Now()) {
+        log.Printf("[QUEUE] %s for %s expired while the server was down", cmd.Action, cmd.IP)
+    }
+}
+
+func saveCommandQueue(filePath string) {
+    commandQueueMu.Lock()
+    data, err := json.MarshalIndent(commandQueue, "", "  ")
+    commandQueueMu.Unlock()
+    if err != nil {
+        log.Printf("Failed to encode command queue: %v", err)
+        return
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        log.Printf("Failed to write %s: %v", tmp, err)
+        return
+    }
+    if err := os.Rename(tmp, filePath); err != nil {
+        log.Printf("Failed to replace %s: %v", filePath, err)
+    }
+}
+
+// handleCommandQueue lists pending commands (GET) or cancels them (POST {"action": "cancel", "ids": [...], "drives": [...]})
+func handleCommandQueue(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    if expired := pruneCommandQueue(time.Now()); len(expired) > 0 {
+        for _, cmd := range expired {
+            log.Printf("[QUEUE] %s for %s expired, not executed", cmd.Action, cmd.IP)
+        }
+        saveCommandQueue(commandQueueFilePath)
+    }
+
+    if r.Method == http.MethodGet {
+        commandQueueMu.Lock()
+        list := make([]QueuedCommand, 0, len(commandQueue))
+        for _, cmd := range commandQueue {
+            list = append(list, cmd)
+        }
+        commandQueueMu.Unlock()
+        sort.Slice(list, func(i, j int) bool { return list[i].QueuedAt.Before(list[j].QueuedAt) })
+        json.NewEncoder(w).Encode(list)
+        return
+    }
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req struct {
+        Action string   `json:"action"`
+        IDs    []string `json:"ids"`
+        Drives []string `json:"drives"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if req.Action != "cancel" || len(req.IDs)+len(req.Drives) == 0 {
+        http.Error(w, "Invalid request, expected action 'cancel' with ids and/or drives", http.StatusBadRequest)
+        return
+    }
+    cancelled := cancelQueuedCommands(req.IDs, resolveDriveRefs(req.Drives))
+    saveCommandQueue(commandQueueFilePath)
+    if len(cancelled) > 0 {
+        event := ControlEvent{Timestamp: time.Now(), Action: "QueueCancel"}
+        for _, cmd := range cancelled {
+            log.Printf("[QUEUE] Cancelled queued %s for %s", cmd.Action, cmd.IP)
+            event.Drives = append(event.Drives, DriveEventInfo{IP: cmd.IP, Success: true})
+        }
+        recordControlEvent(event)
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{"cancelled": cancelled})
+}
+
+// =====================
+// Operation Recovery
+// =====================
+
+// Operation is a multi-step control action in progress (staged group execution, a
+// staggered start, a speed ramp or the pending stop of a jog or soak test). It is journalled to operationsFilePath as each step completes, so a
+// restart part-way through can be resumed or finalized on startup instead of leaving
+// fans half-commanded with no record.
+type Operation struct {
+    ID          string     `json:"id"`
+    Kind        string     `json:"kind"` // "staged", "staggered" (StartStaggerMs), "ramp" (MaxRampHzPerSec), "jog" or "soak" (the pending stop)
+    Action      string     `json:"action"`
+    Speed       float64    `json:"speed"`
+    Acknowledge bool       `json:"acknowledge,omitempty"`
+    Stages      [][]string `json:"stages"`
+    Completed   int        `json:"completed"` // stages executed and verified
+    StartedAt   time.Time  `json:"startedAt"`
+    UpdatedAt   time.Time  `json:"updatedAt"`
+}
+
+const (
+    operationsFilePath = "/etc/vfd/operations.json"
+    // Interrupted stops younger than this are resumed; anything older is only finalized
+    operationResumeWindow = 15 * time.Minute
+)
+
+var (
+    operationsMu sync.Mutex
+    operations   = make(map[string]*Operation)
+)
+
+func beginOperation(kind, action string, speed float64, ack bool, stages [][]string) *Operation {
+    now := time.Now()
+    op := &Operation{
+        ID:          fmt.Sprintf("%x", now.UnixNano()),
+        Kind:        kind,
+        Action:      action,
+        Speed:       speed,
+        Acknowledge: ack,
+        Stages:      stages,
+        StartedAt:   now,
+        UpdatedAt:   now,
+    }
+    operationsMu.Lock()
+    operations[op.ID] = op
+    operationsMu.Unlock()
+    saveOperations(operationsFilePath)
+    return op
+}
+
+func advanceOperation(op *Operation, completed int) {
+    operationsMu.Lock()
+    op.Completed = completed
+    op.UpdatedAt = time.Now()
+    operationsMu.Unlock()
+    saveOperations(operationsFilePath)
+}
+
+func finishOperation(op *Operation) {
+    operationsMu.Lock()
+    delete(operations, op.ID)
+    operationsMu.Unlock()
+    saveOperations(operationsFilePath)
+}
+
+// recoveryPlan decides what to do with an operation interrupted by a restart. Finishing
+// a recent stop is the safe direction, so it resumes; starts and speed changes are never
+// replayed unattended after an unknown gap, only finalized with a record of what was missed.
+func recoveryPlan(op Operation, now time.Time) (resume bool, reason string) {
+    if op.Completed >= len(op.Stages) {
+        return false, "all stages had completed"
+    }
+    if op.Kind == "ramp" {
+        return false, fmt.Sprintf("server restarted while ramping to %.1f Hz; the drive may be left at an intermediate speed", op.Speed)
+    }
+    if op.Action != "Stop" && op.Action != "Freespin" {
+        return false, fmt.Sprintf("server restarted during stage %d; %s is not resumed automatically", op.Completed+1, op.Action)
+    }
+    if age := now.Sub(op.UpdatedAt); age > operationResumeWindow {
+        return false, fmt.Sprintf("server restarted during stage %d; interrupted %s ago, too old to resume", op.Completed+1, age.Round(time.Second))
+    }
+    return true, ""
+}
+
+// recoverOperations resumes or finalizes operations left in the journal by the previous
+// run, once the initial connection phase is over, and records each outcome as a control
+// event (so it also reaches Kafka/NATS subscribers).
+func recoverOperations(interrupted []Operation) {
+    for {
+        statusMutex.RLock()
+        done := systemStatus.InitialConnectionsDone
+        statusMutex.RUnlock()
+        if done {
+            break
+        }
+        time.Sleep(time.Second)
+    }
+    for _, op := range interrupted {
+        remaining := op.Stages[min(op.Completed, len(op.Stages)):]
+        resume, reason := recoveryPlan(op, time.Now())
+        if resume {
+            log.Printf("[RECOVERY] Resuming %s from stage %d/%d (started %s)", op.Action, op.Completed+1, len(op.Stages), op.StartedAt.Format(time.RFC3339))
+            var event ControlEvent
+            if len(remaining) == 1 {
+                event = executeControlStage(op.Action, op.Speed, remaining[0], op.Acknowledge)
+            } else {
+                event = executeStaged(op.Action, op.Speed, remaining, op.Acknowledge)
+            }
+            event.Action = "Recovered" + op.Action
+            recordControlEvent(event)
+            continue
+        }
+        log.Printf("[RECOVERY] Finalizing interrupted %s (started %s): %s", op.Action, op.StartedAt.Format(time.RFC3339), reason)
+        event := ControlEvent{Timestamp: time.Now(), Action: "Interrupted" + op.Action, Speed: op.Speed, Drives: make([]DriveEventInfo, 0)}
+        for _, stage := range remaining {
+            for _, ip := range stage {
+                event.Drives = append(event.Drives, DriveEventInfo{IP: ip, Success: false, Error: "not commanded: " + reason})
+            }
+        }
+        recordControlEvent(event)
+    }
+    go pollAllDrives()
+}
+
+// loadOperations returns the operations the previous run left unfinished and clears the journal
+func loadOperations(filePath string) []Operation {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return nil
+    }
+    loaded := make(map[string]Operation)
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("Failed to decode operations journal from %s: %v", filePath, err)
+        return nil
+    }
+    interrupted := make([]Operation, 0, len(loaded))
+    for _, op := range loaded {
+        interrupted = append(interrupted, op)
+    }
+    sort.Slice(interrupted, func(i, j int) bool { return interrupted[i].StartedAt.Before(interrupted[j].StartedAt) })
+    saveOperations(filePath)
+    return interrupted
+}
+
+func saveOperations(filePath string) {
+    operationsMu.Lock()
+    data, err := json.MarshalIndent(operations, "", "  ")
+    operationsMu.Unlock()
+    if err != nil {
+        log.Printf("Failed to encode operations journal: %v", err)
+        return
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        log.Printf("Failed to write %s: %v", tmp, err)
+        return
+    }
+    if err := os.Rename(tmp, filePath); err != nil {
+        log.Printf("Failed to replace %s: %v", filePath, err)
+    }
+}
+
+// =====================
+// Shadow Mode
+// =====================
+
+// Fields compared against the primary, with their tolerance (0 = exact match)
+var shadowFields = []string{"status", "actualSpeed", "setSpeed", "current", "power"}
+
+// ShadowFieldState tracks agreement between this instance and the primary for one drive field.
+// A field is Divergent once it has mismatched ConfirmCount comparisons in a row, which
+// filters out differences caused by the two instances sampling a ramping drive at different times.
+type ShadowFieldState struct {
+    Compared     int64       `json:"compared"`
+    Mismatches   int64       `json:"mismatches"`
+    Divergent    bool        `json:"divergent"`
+    Shadow       interface{} `json:"shadow,omitempty"`  // values at the last mismatch
+    Primary      interface{} `json:"primary,omitempty"`
+    LastMismatch *time.Time  `json:"lastMismatch,omitempty"`
+    consecutive  int
+}
+
+var (
+    shadowMu          sync.Mutex
+    shadowState       = make(map[string]map[string]*ShadowFieldState) // ip -> field -> state
+    shadowLastCompare time.Time
+    shadowLastError   string
+    shadowComparing   atomic.Bool
+    shadowHTTPClient  = &http.Client{Timeout: 3 * time.Second}
+
+    vfdShadowDivergent = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "shadow_divergent",
+            Help:      "Shadow mode: 1 when a decoded field persistently differs from the primary instance",
+        },
+        []string{"ip", "field"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(vfdShadowDivergent)
+}
+
+func shadowMode() bool {
+    return appConfig.Shadow != nil
+}
+
+// shadowPollInterval is the poll period: 1s normally, reduced in shadow mode to
+// keep the extra load on the drives' comms cards low.
+func shadowPollInterval() time.Duration {
+    if !shadowMode() {
+        return time.Second
+    }
+    if appConfig.Shadow.PollIntervalMs > 0 {
+        return time.Duration(appConfig.Shadow.PollIntervalMs) * time.Millisecond
+    }
+    return 5 * time.Second
+}
+
+func shadowValuesMatch(field string, a, b interface{}, sc ShadowConfig) bool {
+    if field == "status" {
+        return fmt.Sprint(a) == fmt.Sprint(b)
+    }
+    tol := 0.5
+    switch field {
+    case "actualSpeed", "setSpeed":
+        if sc.FreqToleranceHz > 0 {
+            tol = sc.FreqToleranceHz
+        }
+    case "current":
+        if sc.CurrentToleranceA > 0 {
+            tol = sc.CurrentToleranceA
+        }
+    case "power":
+        if sc.PowerToleranceKW > 0 {
+            tol = sc.PowerToleranceKW
+        }
+    }
+    return math.Abs(safeFloat(a)-safeFloat(b)) <= tol
+}
+
+// compareShadowSnapshot diffs this instance's snapshot against the primary's /api/devices
+// output. Drives that either side could not read are skipped — connectivity is not what
+// shadow mode validates. Returns the drive fields that became divergent in this pass.
+func compareShadowSnapshot(local, primary []map[string]interface{}, sc ShadowConfig, now time.Time) []string {
+    confirm := sc.ConfirmCount
+    if confirm <= 0 {
+        confirm = 3
+    }
+    byIP := make(map[string]map[string]interface{}, len(primary))
+    for _, p := range primary {
+        if ip, ok := p["ip"].(string); ok {
+            byIP[ip] = p
+        }
+    }
+
+    shadowMu.Lock()
+    defer shadowMu.Unlock()
+    var diverged []string
+    for _, l := range local {
+        ip, _ := l["ip"].(string)
+        p, ok := byIP[ip]
+        if !ok || !isPolledStatus(fmt.Sprint(l["status"])) || !isPolledStatus(fmt.Sprint(p["status"])) {
+            continue
+        }
+        fields := shadowState[ip]
+        if fields == nil {
+            fields = make(map[string]*ShadowFieldState)
+            shadowState[ip] = fields
+        }
+        for _, f := range shadowFields {
+            lv, lok := l[f]
+            pv, pok := p[f]
+            if !lok || !pok {
+                continue
+            }
+            st := fields[f]
+            if st == nil {
+                st = &ShadowFieldState{}
+                fields[f] = st
+            }
+            st.Compared++
+            if shadowValuesMatch(f, lv, pv, sc) {
+                st.consecutive = 0
+                st.Divergent = false
+                continue
+            }
+            st.Mismatches++
+            st.consecutive++
+            st.Shadow, st.Primary = lv, pv
+            t := now
+            st.LastMismatch = &t
+            if st.consecutive >= confirm && !st.Divergent {
+                st.Divergent = true
+                diverged = append(diverged, ip+" "+f)
+            }
+        }
+    }
+    return diverged
+}
+
+func fetchPrimaryDevices(baseURL string) ([]map[string]interface{}, error) {
+    return fetchDevices(shadowHTTPClient, baseURL)
+}
+
+// fetchDevices reads another instance's /api/devices
+func fetchDevices(client *http.Client, baseURL string) ([]map[string]interface{}, error) {
+    resp, err := client.Get(strings.TrimRight(baseURL, "/") + "/api/devices")
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s returned %s", baseURL, resp.Status)
+    }
+    var devices []map[string]interface{}
+    if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+        return nil, err
+    }
+    return devices, nil
+}
+
+// compareWithPrimary runs after each poll in shadow mode. It runs in the background
+// so a slow primary never stretches the poll cycle; overlapping passes are skipped.
+func compareWithPrimary(snapshot []map[string]interface{}) {
+    if !shadowMode() || !shadowComparing.CompareAndSwap(false, true) {
+        return
+    }
+    sc := *appConfig.Shadow
+    go func() {
+        defer shadowComparing.Store(false)
+        primary, err := fetchPrimaryDevices(sc.PrimaryURL)
+        now := time.Now()
+        if err != nil {
+            shadowMu.Lock()
+            if shadowLastError != err.Error() {
+                log.Printf("[SHADOW] Failed to fetch primary devices: %v", err)
+            }
+            shadowLastError = err.Error()
+            shadowMu.Unlock()
+            return
+        }
+        for _, d := range compareShadowSnapshot(snapshot, primary, sc, now) {
+            log.Printf("[SHADOW] Divergence: %s", d)
+        }
+        shadowMu.Lock()
+        shadowLastCompare = now
+        shadowLastError = ""
+        for ip, fields := range shadowState {
+            for f, st := range fields {
+                vfdShadowDivergent.WithLabelValues(ip, f).Set(boolToFloat(st.Divergent))
+            }
+        }
+        shadowMu.Unlock()
+    }()
+}
+
+func handleShadow(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    if !shadowMode() {
+        json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+        return
+    }
+    shadowMu.Lock()
+    defer shadowMu.Unlock()
+    divergent := 0
+    drives := make(map[string]map[string]*ShadowFieldState, len(shadowState))
+    for ip, fields := range shadowState {
+        drives[ip] = fields
+        for _, st := range fields {
+            if st.Divergent {
+                divergent++
+            }
+        }
+    }
+    resp := map[string]interface{}{
+        "enabled":         true,
+        "primary":         appConfig.Shadow.PrimaryURL,
+        "pollInterval":    shadowPollInterval().String(),
+        "divergentFields": divergent,
+        "drives":          drives,
+    }
+    if !shadowLastCompare.IsZero() {
+        resp["lastCompare"] = shadowLastCompare.Format(time.RFC3339)
+    }
+    if shadowLastError != "" {
+        resp["lastError"] = shadowLastError
+    }
+    json.NewEncoder(w).Encode(resp)
+}
+
+// =====================
+// Polling Shards
+// =====================
+// For very large fleets several instances share the polling. Sharding lists every instance
+// (shard) with the groups and drives it owns; drives no shard claims belong to the
+// FrontEnd. All shards use the same config.json apart from Self. Each shard connects to
+// and polls only the drives it owns, so a drive has one poller.
+//
+// The front-end is the instance to use. Every poll it merges the other shards' drives (as
+// last fetched from their /api/devices) into its own data, so its API, websocket, metrics
+// and integrations cover the whole fleet. It forwards actions on another shard's drives to
+// POST /api/shards/control on that shard, and it alone runs schedules, rotation and the
+// other fleet-wide automation. The other shards only poll, re-assert setpoints and
+// auto-reset their own drives.
+//
+// Every shard fetches the others' /api/devices each HeartbeatSec. A shard not heard from
+// for TakeoverSec is down, and its drives pass to the next shard in the list that is up,
+// which connects to and polls them until the failed shard answers again.
+
+// ShardingConfig splits polling across instances
+type ShardingConfig struct {
+    Self         string        `json:"Self"`     // this instance's shard name
+    FrontEnd     string        `json:"FrontEnd"` // the shard serving the unified API
+    Shards       []ShardConfig `json:"Shards"`
+    HeartbeatSec int           `json:"HeartbeatSec"` // default 2
+    TakeoverSec  int           `json:"TakeoverSec"`  // default 30
+}
+
+// ShardConfig is one instance and the drives it owns
+type ShardConfig struct {
+    Name   string   `json:"Name"`
+    URL    string   `json:"URL"`              // e.g. "http://10.33.10.54:8080"
+    Groups []string `json:"Groups,omitempty"`
+    Drives []string `json:"Drives,omitempty"` // drive IDs or IPs; these win over Groups
+}
+
+// ShardStatus is this instance's view of a shard
+type ShardStatus struct {
+    Name      string     `json:"name"`
+    URL       string     `json:"url"`
+    Up        bool       `json:"up"`
+    LastSeen  *time.Time `json:"lastSeen,omitempty"`
+    LastError string     `json:"lastError,omitempty"`
+    Assigned  int        `json:"assigned"` // drives assigned to it in config
+    Polling   int        `json:"polling"`  // drives it polls now, takeovers included
+}
+
+// Live fields a front-end takes from the shard polling a drive
+var shardLiveFields = []string{"setSpeed", "actualSpeed", "actualPercent", "rpmSpeed", "actualCfm", "current",
+    "status", "clockwise", "direction", "directionMismatch", "faultCode", "faultText", "power", "energyMeter", "extra", "lastUpdated"}
+
+var (
+    shardsMu        sync.Mutex
+    shardLastSeen   = make(map[string]time.Time)
+    shardErrors     = make(map[string]string)
+    shardWasUp      = make(map[string]bool)
+    shardDevices    = make(map[string]map[string]interface{}) // by drive IP, as reported by the shard polling it
+    shardHTTPClient = &http.Client{Timeout: 2 * time.Second}
+
+    vfdShardUp = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "vfd",
+            Name:      "shard_up",
+            Help:      "Sharding: 1 while a shard answers its heartbeat",
+        },
+        []string{"shard"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(vfdShardUp)
+}
+
+func shardingLimits(c *ShardingConfig) (heartbeat, takeover time.Duration) {
+    heartbeat, takeover = time.Duration(c.HeartbeatSec)*time.Second, time.Duration(c.TakeoverSec)*time.Second
+    if heartbeat <= 0 {
+        heartbeat = 2 * time.Second
+    }
+    if takeover <= 0 {
+        takeover = 30 * time.Second
+    }
+    return heartbeat, takeover
+}
+
+func validateSharding(c *ShardingConfig, drives []DriveConfig) error {
+    if c == nil {
+        return nil
+    }
+    names := make(map[string]bool)
+    known := make(map[string]bool)
+    for _, d := range drives {
+        known[d.IP] = true
+    }
+    driveShard := make(map[string]string)
+    groupShard := make(map[string]string)
+    for _, s := range c.Shards {
+        if s.Name == "" || s.URL == "" {
+            return fmt.Errorf("Sharding: every shard needs a Name and a URL")
+        }
+        if names[s.Name] {
+            return fmt.Errorf("Sharding: shard %q is listed twice", s.Name)
+        }
+        names[s.Name] = true
+        for _, ref := range s.Drives {
+            ip := driveRefIP(ref, drives)
+            if !known[ip] {
+                return fmt.Errorf("Sharding: shard %s: unknown drive %q", s.Name, ref)
+            }
+            if other, ok := driveShard[ip]; ok {
+                return fmt.Errorf("Sharding: drive %s is in shards %s and %s", ref, other, s.Name)
+            }
+            driveShard[ip] = s.Name
+        }
+        for _, g := range s.Groups {
+            if other, ok := groupShard[g]; ok {
+                return fmt.Errorf("Sharding: group %s is in shards %s and %s", g, other, s.Name)
+            }
+            groupShard[g] = s.Name
+        }
+    }
+    if !names[c.Self] {
+        return fmt.Errorf("Sharding: Self %q is not one of the Shards", c.Self)
+    }
+    if !names[c.FrontEnd] {
+        return fmt.Errorf("Sharding: FrontEnd %q is not one of the Shards", c.FrontEnd)
+    }
+    return nil
+}
+
+// shardAssigned returns the index of the shard a drive is assigned to in config
+func shardAssigned(c *ShardingConfig, d DriveConfig) int {
+    for i, s := range c.Shards {
+        if containsString(s.Drives, d.ID) || containsString(s.Drives, d.IP) {
+            return i
+        }
+    }
+    for i, s := range c.Shards {
+        if containsString(s.Groups, d.Group) {
+            return i
+        }
+    }
+    for i, s := range c.Shards {
+        if s.Name == c.FrontEnd {
+            return i
+        }
+    }
+    return 0
+}
+
+// shardOwner returns the shard that polls a drive: its assigned shard, or while that is
+// down the next shard in the list that is up
+func shardOwner(c *ShardingConfig, d DriveConfig, up func(string) bool) string {
+    i := shardAssigned(c, d)
+    for n := 0; n < len(c.Shards); n++ {
+        if s := c.Shards[(i+n)%len(c.Shards)]; up(s.Name) {
+            return s.Name
+        }
+    }
+    return c.Shards[i].Name
+}
+
+// shardUpLocked reports whether a shard has answered within TakeoverSec; this instance is
+// always up. Shards get TakeoverSec from startup to answer. The caller holds shardsMu.
+func shardUpLocked(c *ShardingConfig, name string, now time.Time) bool {
+    seen, ok := shardLastSeen[name]
+    if name == c.Self || !ok {
+        return true
+    }
+    _, takeover := shardingLimits(c)
+    return now.Sub(seen) < takeover
+}
+
+// driveOwner returns the shard polling a drive now, "" without Sharding
+func driveOwner(ip string) string {
+    c := appConfig.Sharding
+    d, ok := driveConfig(ip)
+    if c == nil || !ok {
+        return ""
+    }
+    now := time.Now()
+    shardsMu.Lock()
+    defer shardsMu.Unlock()
+    return shardOwner(c, *d, func(name string) bool { return shardUpLocked(c, name, now) })
+}
+
+// ownsDrive reports whether this instance polls and commands a drive
+func ownsDrive(ip string) bool {
+    owner := driveOwner(ip)
+    return owner == "" || owner == appConfig.Sharding.Self
+}
+
+// isFrontEnd reports whether this instance runs the fleet-wide automation: always,
+// unless it is a shard other than the FrontEnd
+func isFrontEnd() bool {
+    c := appConfig.Sharding
+    return c == nil || c.Self == c.FrontEnd
+}
+
+func shardByName(c *ShardingConfig, name string) (ShardConfig, bool) {
+    for _, s := range c.Shards {
+        if s.Name == name {
+            return s, true
+        }
+    }
+    return ShardConfig{}, false
+}
+
+// applyShardEntry fills in a drive another shard polls: from that shard's last report on
+// the front-end, otherwise it is shown as "Remote"
+func applyShardEntry(entry map[string]interface{}, ip, owner string) {
+    entry["shard"] = owner
+    if !isFrontEnd() {
+        markDriveOffline(entry, "Remote")
+        return
+    }
+    shardsMu.Lock()
+    remote, ok := shardDevices[ip]
+    up := ok && shardUpLocked(appConfig.Sharding, fmt.Sprint(remote["shard"]), time.Now())
+    shardsMu.Unlock()
+    if !up {
+        markDriveOffline(entry, "Unavailable")
+        return
+    }
+    for _, f := range shardLiveFields {
+        if v, ok := remote[f]; ok {
+            entry[f] = v
+        } else {
+            delete(entry, f)
+        }
+    }
+    entry["shard"] = remote["shard"]
+}
+
+// shardEntry keeps the live fields of a drive from a shard's /api/devices, with JSON
+// numbers turned back into the types pollDrive uses
+func shardEntry(device map[string]interface{}) map[string]interface{} {
+    entry := map[string]interface{}{"shard": device["shard"]}
+    for _, f := range shardLiveFields {
+        v, ok := device[f]
+        if !ok {
+            continue
+        }
+        switch f {
+        case "rpmSpeed", "actualCfm", "clockwise", "faultCode":
+            v = int(safeFloat(v))
+        case "lastUpdated":
+            v = int64(safeFloat(v))
+        }
+        entry[f] = v
+    }
+    return entry
+}
+
+// runShards checks the other shards every HeartbeatSec, keeps the front-end's copy of
+// their drives, and connects to drives this instance has taken over
+func runShards() {
+    c := appConfig.Sharding
+    if c == nil {
+        return
+    }
+    heartbeat, _ := shardingLimits(c)
+    start := time.Now()
+    shardsMu.Lock()
+    for _, s := range c.Shards {
+        shardLastSeen[s.Name], shardWasUp[s.Name] = start, true
+    }
+    shardsMu.Unlock()
+    for {
+        time.Sleep(heartbeat)
+        var wg sync.WaitGroup
+        for _, s := range c.Shards {
+            if s.Name == c.Self {
+                continue
+            }
+            wg.Add(1)
+            go func(s ShardConfig) {
+                defer wg.Done()
+                devices, err := fetchDevices(shardHTTPClient, s.URL)
+                recordShardHeartbeat(c, s.Name, devices, err, time.Now())
+            }(s)
+        }
+        wg.Wait()
+        for _, d := range configuredDrives() {
+            if cfg, ok := driveConfig(d.IP); ok && ownsDrive(d.IP) && !isDriveDisabled(d.IP) {
+                ensureDriveManager(cfg)
+            }
+        }
+    }
+}
+
+// recordShardHeartbeat stores a shard's answer and logs it going down or coming back
+func recordShardHeartbeat(c *ShardingConfig, name string, devices []map[string]interface{}, err error, now time.Time) {
+    shardsMu.Lock()
+    if err != nil {
+        shardErrors[name] = err.Error()
+    } else {
+        shardLastSeen[name] = now
+        delete(shardErrors, name)
+        for ip, entry := range shardDevices {
+            if entry["shard"] == name {
+                delete(shardDevices, ip)
+            }
+        }
+        for _, device := range devices {
+            ip, _ := device["ip"].(string)
+            if ip != "" && device["shard"] == name {
+                shardDevices[ip] = shardEntry(device)
+            }
+        }
+    }
+    up := shardUpLocked(c, name, now)
+    changed := up != shardWasUp[name]
+    shardWasUp[name] = up
+    lastErr, silent := shardErrors[name], now.Sub(shardLastSeen[name])
+    shardsMu.Unlock()
+
+    vfdShardUp.WithLabelValues(name).Set(boolToFloat(up))
+    if !changed {
+        return
+    }
+    action, detail := "ShardUp", fmt.Sprintf("shard %s is answering again; its drives go back to it", name)
+    if !up {
+        action, detail = "ShardDown", fmt.Sprintf("shard %s has not answered for %s (%s); its drives pass to the next shard", name, silent.Round(time.Second), lastErr)
+    }
+    log.Printf("[SHARD] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: now, Action: action, Drives: []DriveEventInfo{}, Detail: detail})
+}
+
+// splitByShard separates the drives this instance commands from those polled by other
+// shards, by shard name
+func splitByShard(ips []string) ([]string, map[string][]string) {
+    local := make([]string, 0, len(ips))
+    remote := make(map[string][]string)
+    for _, ip := range ips {
+        if owner := driveOwner(ip); owner != "" && owner != appConfig.Sharding.Self {
+            remote[owner] = append(remote[owner], ip)
+            continue
+        }
+        local = append(local, ip)
+    }
+    return local, remote
+}
+
+// forwardShardControl runs an action on drives polled by another shard. Only the front-end
+// forwards; a shard asked about a drive it doesn't poll refuses.
+func forwardShardControl(name, action string, speed float64, ips []string, ack bool) []DriveEventInfo {
+    fail := func(msg string) []DriveEventInfo {
+        infos := make([]DriveEventInfo, 0, len(ips))
+        for _, ip := range ips {
+            infos = append(infos, DriveEventInfo{ID: driveIDFor(ip), IP: ip, Error: msg})
+        }
+        log.Printf("[SHARD] %s %v: %s", action, ips, msg)
+        return infos
+    }
+    s, ok := shardByName(appConfig.Sharding, name)
+    if !isFrontEnd() || !ok {
+        return fail(fmt.Sprintf("drive is polled by shard %s; send commands to the front-end", name))
+    }
+    body, _ := json.Marshal(map[string]interface{}{"action": action, "speed": speed, "drives": ips, "acknowledge": ack})
+    client := &http.Client{Timeout: 30 * time.Second} // staged starts and ramps run before the shard answers
+    resp, err := client.Post(strings.TrimRight(s.URL, "/")+"/api/shards/control", "application/json", bytes.NewReader(body))
+    if err != nil {
+        return fail(fmt.Sprintf("shard %s: %v", name, err))
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return fail(fmt.Sprintf("shard %s: %s: %s", name, resp.Status, strings.TrimSpace(string(msg))))
+    }
+    var event ControlEvent
+    if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+        return fail(fmt.Sprintf("shard %s: %v", name, err))
+    }
+    return event.Drives
+}
+
+// handleShards serves GET /api/shards (this instance's view of every shard) and
+// POST /api/shards/control, which the front-end uses to command drives this shard polls
+func handleShards(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    c := appConfig.Sharding
+    sub := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/shards"), "/")
+    if r.Method == http.MethodGet && sub == "" {
+        if c == nil {
+            json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+            return
+        }
+        drives := configuredDrives()
+        now := time.Now()
+        shardsMu.Lock()
+        up := func(name string) bool { return shardUpLocked(c, name, now) }
+        list := make([]ShardStatus, 0, len(c.Shards))
+        for _, s := range c.Shards {
+            st := ShardStatus{Name: s.Name, URL: s.URL, Up: up(s.Name), LastError: shardErrors[s.Name]}
+            if seen, ok := shardLastSeen[s.Name]; ok && s.Name != c.Self {
+                st.LastSeen = &seen
+            }
+            for _, d := range drives {
+                if c.Shards[shardAssigned(c, d)].Name == s.Name {
+                    st.Assigned++
+                }
+                if shardOwner(c, d, up) == s.Name {
+                    st.Polling++
+                }
+            }
+            list = append(list, st)
+        }
+        shardsMu.Unlock()
+        json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "self": c.Self, "frontEnd": c.FrontEnd, "shards": list})
+        return
+    }
+    if r.Method != http.MethodPost || sub != "control" {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    if c == nil {
+        http.Error(w, "Sharding is not configured", http.StatusNotFound)
+        return
+    }
+    var req struct {
+        Action      string   `json:"action"`
+        Speed       float64  `json:"speed"`
+        Drives      []string `json:"drives"`
+        Acknowledge bool     `json:"acknowledge"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    switch req.Action {
+    case "EmergencyStop":
+        estopMu.Lock()
+        latched := estopLatch != nil
+        estopMu.Unlock()
+        if !latched {
+            setEStopLatch(&EStopLatch{User: "front-end", At: time.Now()})
+        }
+        event := ControlEvent{Timestamp: time.Now(), Action: "EmergencyStop", Drives: stopAllDrives(resolveDriveRefs(req.Drives)), Detail: "forwarded by the front-end"}
+        recordControlEvent(event)
+        json.NewEncoder(w).Encode(event)
+        go pollAllDrives()
+        return
+    case "EmergencyStopClear":
+        setEStopLatch(nil)
+        log.Printf("[ESTOP] Emergency stop cleared by the front-end")
+        json.NewEncoder(w).Encode(ControlEvent{Timestamp: time.Now(), Action: req.Action, Drives: []DriveEventInfo{}})
+        return
+    }
+    if !isValidControlAction(req.Action) {
+        http.Error(w, "Invalid action", http.StatusBadRequest)
+        return
+    }
+    // The front-end has checked limits and reservations; executeControl still stages starts
+    event := executeControl(req.Action, req.Speed, resolveDriveRefs(req.Drives), req.Acknowledge)
+    event.Detail = "forwarded by the front-end"
+    recordControlEvent(event)
+    json.NewEncoder(w).Encode(event)
+    go pollAllDrives()
+}
+
+// =====================
+// Chaos Injection (UnsafeChaos only)
+// =====================
+
+// ChaosRule injects latency and/or dropped responses into every Modbus request to one
+// drive until it expires. Dropped requests are never sent: reads behave like a
+// timed-out response and writes are not applied.
+type ChaosRule struct {
+    LatencyMs   int       `json:"latencyMs"`
+    JitterMs    int       `json:"jitterMs"`
+    DropPercent float64   `json:"dropPercent"`
+    Until       time.Time `json:"until"`
+}
+
+const chaosMaxDuration = time.Hour
+
+var (
+    chaosRules = make(map[string]ChaosRule) // ip -> active rule
+    chaosMu    sync.Mutex
+)
+
+// chaosRuleFor returns the drive's active rule, removing it once expired
+func chaosRuleFor(ip string, now time.Time) (ChaosRule, bool) {
+    chaosMu.Lock()
+    defer chaosMu.Unlock()
+    rule, ok := chaosRules[ip]
+    if !ok {
+        return rule, false
+    }
+    if now.After(rule.Until) {
+        delete(chaosRules, ip)
+        log.Printf("[CHAOS] Injection on %s expired", ip)
+        return rule, false
+    }
+    return rule, true
+}
+
+// chaosClient wraps a drive's Modbus client when UnsafeChaos is set
+type chaosClient struct {
+    modbus.Client
+    ip string
+}
+
+func (c chaosClient) inject(ctx context.Context) error {
+    rule, ok := chaosRuleFor(c.ip, time.Now())
+    if !ok {
+        return nil
+    }
+    delay := time.Duration(rule.LatencyMs) * time.Millisecond
+    if rule.JitterMs > 0 {
+        delay += time.Duration(rand.Intn(rule.JitterMs+1)) * time.Millisecond
+    }
+    dropped := rule.DropPercent > 0 && rand.Float64()*100 < rule.DropPercent
+    if dropped {
+        // Stall like an unanswered request: until the caller gives up, or the handler timeout
+        delay = 2 * time.Second
+    }
+    select {
+    case <-time.After(delay):
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+    if dropped {
+        return fmt.Errorf("chaos: injected dropped response")
+    }
+    return nil
+}
+
+func (c chaosClient) ReadHoldingRegisters(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    if err := c.inject(ctx); err != nil {
+        return nil, err
+    }
+    return c.Client.ReadHoldingRegisters(ctx, address, quantity)
+}
+
+func (c chaosClient) ReadInputRegisters(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    if err := c.inject(ctx); err != nil {
+        return nil, err
+    }
+    return c.Client.ReadInputRegisters(ctx, address, quantity)
+}
+
+func (c chaosClient) WriteSingleRegister(ctx context.Context, address, value uint16) ([]byte, error) {
+    if err := c.inject(ctx); err != nil {
+        return nil, err
+    }
+    return c.Client.WriteSingleRegister(ctx, address, value)
+}
+
+func (c chaosClient) ReadCoils(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    if err := c.inject(ctx); err != nil {
+        return nil, err
+    }
+    return c.Client.ReadCoils(ctx, address, quantity)
+}
+
+func (c chaosClient) ReadDiscreteInputs(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    if err := c.inject(ctx); err != nil {
+        return nil, err
+    }
+    return c.Client.ReadDiscreteInputs(ctx, address, quantity)
+}
+
+func (c chaosClient) WriteSingleCoil(ctx context.Context, address, value uint16) ([]byte, error) {
+    if err := c.inject(ctx); err != nil {
+        return nil, err
+    }
+    return c.Client.WriteSingleCoil(ctx, address, value)
+}
+
+func (c chaosClient) WriteMultipleRegisters(ctx context.Context, address, quantity uint16, value []byte) ([]byte, error) {
+    if err := c.inject(ctx); err != nil {
+        return nil, err
+    }
+    return c.Client.WriteMultipleRegisters(ctx, address, quantity, value)
+}
+
+// handleChaos lists (GET), adds or clears (POST) injections. Only registered with UnsafeChaos.
+func handleChaos(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    if r.Method == http.MethodGet {
+        now := time.Now()
+        active := make(map[string]ChaosRule)
+        chaosMu.Lock()
+        for ip, rule := range chaosRules {
+            if now.Before(rule.Until) {
+                active[ip] = rule
+            }
+        }
+        chaosMu.Unlock()
+        json.NewEncoder(w).Encode(active)
+        return
+    }
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req struct {
+        Action      string   `json:"action"` // "inject" or "clear"
+        Drives      []string `json:"drives"` // "clear" with no drives clears everything
+        LatencyMs   int      `json:"latencyMs"`
+        JitterMs    int      `json:"jitterMs"`
+        DropPercent float64  `json:"dropPercent"`
+        DurationSec int      `json:"durationSec"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    for _, ip := range req.Drives {
+        if _, ok := driveConfig(ip); !ok {
+            http.Error(w, "Unknown drive: "+ip, http.StatusBadRequest)
+            return
+        }
+    }
+
+    event := ControlEvent{Timestamp: time.Now(), Drives: make([]DriveEventInfo, 0, len(req.Drives))}
+    switch req.Action {
+    case "inject":
+        duration := time.Duration(req.DurationSec) * time.Second
+        if len(req.Drives) == 0 || duration <= 0 || duration > chaosMaxDuration {
+            http.Error(w, "inject requires drives and durationSec between 1 and 3600", http.StatusBadRequest)
+            return
+        }
+        if req.LatencyMs < 0 || req.JitterMs < 0 || req.DropPercent < 0 || req.DropPercent > 100 {
+            http.Error(w, "latencyMs/jitterMs must be >= 0 and dropPercent 0-100", http.StatusBadRequest)
+            return
+        }
+        rule := ChaosRule{LatencyMs: req.LatencyMs, JitterMs: req.JitterMs, DropPercent: req.DropPercent, Until: time.Now().Add(duration)}
+        chaosMu.Lock()
+        for _, ip := range req.Drives {
+            chaosRules[ip] = rule
+            event.Drives = append(event.Drives, DriveEventInfo{IP: ip, Success: true})
+        }
+        chaosMu.Unlock()
+        log.Printf("[CHAOS] Injecting latency %dms (+%dms jitter), %.0f%% drops on %v for %s", req.LatencyMs, req.JitterMs, req.DropPercent, req.Drives, duration)
+        event.Action = "ChaosInject"
+    case "clear":
+        chaosMu.Lock()
+        if len(req.Drives) == 0 {
+            for ip := range chaosRules {
+                req.Drives = append(req.Drives, ip)
+            }
+        }
+        for _, ip := range req.Drives {
+            delete(chaosRules, ip)
+            event.Drives = append(event.Drives, DriveEventInfo{IP: ip, Success: true})
+        }
+        chaosMu.Unlock()
+        log.Printf("[CHAOS] Cleared injection on %v", req.Drives)
+        event.Action = "ChaosClear"
+    default:
+        http.Error(w, "Invalid action, must be 'inject' or 'clear'", http.StatusBadRequest)
+        return
+    }
+    recordControlEvent(event)
+    json.NewEncoder(w).Encode(event)
+}
+
+// =====================
+// Site Provisioning
+// =====================
+
+// SiteDescriptor is the compact form of a site consumed by "vfdserver generate".
+// Rows x FansPerRow drives are laid out from IPBase; RowDefs, when given, replace
+// Rows/FansPerRow and let individual rows override the fan count, IP base or model.
+type SiteDescriptor struct {
+    SiteName     string  `json:"SiteName"`
+    BindIP       string  `json:"BindIP"`
+    BindPort     string  `json:"BindPort"`
+    GroupLabel   string  `json:"GroupLabel"`
+    Rows         int     `json:"Rows"`
+    FansPerRow   int     `json:"FansPerRow"`
+    IPBase       string  `json:"IPBase"`       // first drive's address
+    RowIPStride  int     `json:"RowIPStride"`  // address offset between rows; 0 = contiguous
+    DriveType    string  `json:"DriveType"`
+    Port         int     `json:"Port"`         // default 502
+    Unit         int     `json:"Unit"`         // default 1
+    DefaultSpeed int     `json:"DefaultSpeed"`
+    FanDesc      string  `json:"FanDesc"`
+    RpmHz        float64 `json:"RpmHz"`
+    CfmRpm       float64 `json:"CfmRpm"`
+
+    RowDefs []SiteRowDescriptor `json:"RowDefs"`
+}
+
+// SiteRowDescriptor overrides the site defaults for one row (group)
+type SiteRowDescriptor struct {
+    Group     string `json:"Group"`     // default: row number
+    Fans      int    `json:"Fans"`      // default: FansPerRow
+    IPBase    string `json:"IPBase"`    // default: continues from the previous row
+    DriveType string `json:"DriveType"`
+    FanDesc   string `json:"FanDesc"`
+}
+
+func ipv4ToUint(s string) (uint32, error) {
+    ip := net.ParseIP(s).To4()
+    if ip == nil {
+        return 0, fmt.Errorf("invalid IPv4 address %q", s)
+    }
+    return binary.BigEndian.Uint32(ip), nil
+}
+
+func uintToIPv4(v uint32) string {
+    b := make(net.IP, 4)
+    binary.BigEndian.PutUint32(b, v)
+    return b.String()
+}
+
+// generateSiteConfig expands a descriptor into a full AppConfig. Fan numbers run
+// sequentially across the whole site; groups default to the row number.
+func generateSiteConfig(desc SiteDescriptor) (AppConfig, error) {
+    cfg := AppConfig{
+        SiteName:   desc.SiteName,
+        BindIP:     desc.BindIP,
+        BindPort:   desc.BindPort,
+        GroupLabel: desc.GroupLabel,
+    }
+    rows := desc.RowDefs
+    if len(rows) == 0 {
+        if desc.Rows <= 0 || desc.FansPerRow <= 0 {
+            return cfg, fmt.Errorf("descriptor needs Rows and FansPerRow (or RowDefs)")
+        }
+        rows = make([]SiteRowDescriptor, desc.Rows)
+    }
+    port, unit := desc.Port, desc.Unit
+    if port == 0 {
+        port = 502
+    }
+    if unit == 0 {
+        unit = 1
+    }
+
+    var next uint32
+    if desc.IPBase != "" {
+        v, err := ipv4ToUint(desc.IPBase)
+        if err != nil {
+            return cfg, fmt.Errorf("IPBase: %w", err)
+        }
+        next = v
+    }
+    seen := make(map[string]string)
+    fanNumber := 0
+    for r, row := range rows {
+        group := row.Group
+        if group == "" {
+            group = fmt.Sprintf("%d", r+1)
+        }
+        fans := row.Fans
+        if fans == 0 {
+            fans = desc.FansPerRow
+        }
+        if fans <= 0 {
+            return cfg, fmt.Errorf("row %s: no fan count", group)
+        }
+        driveType := row.DriveType
+        if driveType == "" {
+            driveType = desc.DriveType
+        }
+        if driveType == "" {
+            return cfg, fmt.Errorf("row %s: no DriveType", group)
+        }
+        fanDesc := row.FanDesc
+        if fanDesc == "" {
+            fanDesc = desc.FanDesc
+        }
+
+        rowStart := next
+        if row.IPBase != "" {
+            v, err := ipv4ToUint(row.IPBase)
+            if err != nil {
+                return cfg, fmt.Errorf("row %s IPBase: %w", group, err)
+            }
+            rowStart = v
+        } else if rowStart == 0 {
+            return cfg, fmt.Errorf("row %s: no IPBase", group)
+        }
+
+        for f := 0; f < fans; f++ {
+            addr := rowStart + uint32(f)
+            if addr < rowStart || addr&0xFF == 0xFF || addr&0xFF == 0 {
+                return cfg, fmt.Errorf("row %s fan %d: address range from %s runs into a .0/.255 address", group, f+1, uintToIPv4(rowStart))
+            }
+            ip := uintToIPv4(addr)
+            if prev, dup := seen[ip]; dup {
+                return cfg, fmt.Errorf("duplicate IP %s (rows %s and %s)", ip, prev, group)
+            }
+            seen[ip] = group
+            fanNumber++
+            cfg.VFDs = append(cfg.VFDs, DriveConfig{
+                IP:           ip,
+                Port:         port,
+                Unit:         unit,
+                DefaultSpeed: desc.DefaultSpeed,
+                Group:        group,
+                FanNumber:    fanNumber,
+                FanDesc:      fanDesc,
+                RpmToHz:      desc.RpmHz,
+                CfmRpm:       desc.CfmRpm,
+                DriveType:    driveType,
+            })
+        }
+        if desc.RowIPStride > 0 {
+            next = rowStart + uint32(desc.RowIPStride)
+        } else {
+            next = rowStart + uint32(fans)
+        }
+    }
+    return cfg, nil
+}
+
+// runGenerate implements "vfdserver generate <descriptor.json> [output.json]".
+// Drive types are checked against /etc/vfd/drive_profiles.json when it is readable.
+func runGenerate(args []string) int {
+    if len(args) < 1 || len(args) > 2 {
+        fmt.Fprintln(os.Stderr, "usage: vfdserver generate <descriptor.json> [output.json]")
+        return 2
+    }
+    data, err := os.ReadFile(args[0])
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    var desc SiteDescriptor
+    if err := json.Unmarshal(data, &desc); err != nil {
+        fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+        return 1
+    }
+    cfg, err := generateSiteConfig(desc)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+
+    driveTypeProfiles = make(map[string]DriveTypeProfile)
+    if err := loadDriveTypeProfiles(driveProfilesFilePath); err != nil {
+        fmt.Fprintf(os.Stderr, "warning: drive types not checked: %v\n", err)
+    } else {
+        for _, d := range cfg.VFDs {
+            if _, ok := driveTypeProfiles[d.DriveType]; !ok {
+                fmt.Fprintf(os.Stderr, "unknown DriveType %q (group %s)\n", d.DriveType, d.Group)
+                return 1
+            }
+        }
+    }
+
+    out, err := json.MarshalIndent(cfg, "", "  ")
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    out = append(out, '\n')
+    if len(args) == 2 {
+        if err := os.WriteFile(args[1], out, 0644); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        fmt.Fprintf(os.Stderr, "wrote %d drives in %d groups to %s\n", len(cfg.VFDs), countGroups(cfg.VFDs), args[1])
+        return 0
+    }
+    os.Stdout.Write(out)
+    return 0
+}
+
+func countGroups(vfds []DriveConfig) int {
+    groups := make(map[string]bool)
+    for _, d := range vfds {
+        groups[d.Group] = true
+    }
+    return len(groups)
+}
+
+// =====================
+// Configuration Lint
+// =====================
+
+// Physics cross-checks run at load time (as warnings) and by "vfdserver lint". They
+// catch unit mix-ups: RpmHz entered as total RPM, CfmRpm entered as total CFM, a
+// SetFreqCalc in 0.1 Hz paired with an OutFreqCalc in 0.01 Hz, and so on.
+const (
+    lintMaxMotorRpm = 3600 * 1.05 // 2-pole motor at 60 Hz plus slip margin
+    lintMinFanRpm   = 100
+    lintMinCfmPerHP = 500
+    lintMaxCfmPerHP = 40000
+    lintDescTolerance = 0.15 // FanDesc RPM/CFM vs computed
+)
+
+var (
+    fanDescRpmRe = regexp.MustCompile(`(?i)(\d+(?:\.\d+)?)\s*rpm`)
+    fanDescCfmRe = regexp.MustCompile(`(?i)(\d+(?:\.\d+)?)\s*(k?)\s*cfm`)
+    fanDescQtyRe = regexp.MustCompile(`(?i)^\s*(\d+)\s*x\b`)
+)
+
+// parseFanDesc extracts the fan count, RPM and CFM from descriptions like
+// "1x 1800RPM 29.5kCFM"; missing values are 0 (count defaults to 1)
+func parseFanDesc(desc string) (count int, rpm, cfm float64) {
+    count = 1
+    if m := fanDescQtyRe.FindStringSubmatch(desc); m != nil {
+        count, _ = strconv.Atoi(m[1])
+    }
+    if m := fanDescRpmRe.FindStringSubmatch(desc); m != nil {
+        rpm, _ = strconv.ParseFloat(m[1], 64)
+    }
+    if m := fanDescCfmRe.FindStringSubmatch(desc); m != nil {
+        cfm, _ = strconv.ParseFloat(m[1], 64)
+        if m[2] != "" {
+            cfm *= 1000
+        }
+    }
+    return count, rpm, cfm
+}
+
+// withinTolerance reports whether got is within lintDescTolerance of want
+func withinTolerance(got, want float64) bool {
+    return math.Abs(got-want) <= want*lintDescTolerance
+}
+
+// lintMaxHz is the top of a drive's speed range for the checks (HardMaxHz, else 60 Hz = 100%)
+func lintMaxHz(d DriveConfig) float64 {
+    if d.HardMaxHz > 0 {
+        return d.HardMaxHz
+    }
+    return 60
+}
+
+// lintConfig cross-checks every drive and the profiles in use, returning one message per problem
+func lintConfig(cfg AppConfig, profiles map[string]DriveTypeProfile) []string {
+    var problems []string
+    usedMaxHz := make(map[string]float64) // profile -> highest max Hz of the drives using it
+    for _, d := range cfg.VFDs {
+        if _, ok := profiles[d.DriveType]; ok {
+            usedMaxHz[d.DriveType] = math.Max(usedMaxHz[d.DriveType], lintMaxHz(d))
+        } else if d.DriveType != "" || !cfg.DetectDriveType { // DetectDriveType fills in an empty one
+            problems = append(problems, fmt.Sprintf("%s: unknown DriveType %q", d.IP, d.DriveType))
+        }
+        problems = append(problems, lintDrive(d)...)
+    }
+    names := make([]string, 0, len(usedMaxHz))
+    for name := range usedMaxHz {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        problems = append(problems, lintProfile(name, profiles[name], usedMaxHz[name])...)
+    }
+    // Overridden drives are checked as run, against their own max Hz
+    for _, d := range cfg.VFDs {
+        base, ok := profiles[d.DriveType]
+        if !ok || len(d.ProfileOverrides) == 0 {
+            continue
+        }
+        p, err := applyProfileOverrides(base, d.ProfileOverrides)
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("%s: ProfileOverrides: %v", d.IP, err))
+            continue
+        }
+        problems = append(problems, lintProfile(d.IP+" ("+d.DriveType+" with ProfileOverrides)", p, lintMaxHz(d))...)
+    }
+    return problems
+}
+
+func lintDrive(d DriveConfig) []string {
+    var problems []string
+    add := func(format string, args ...interface{}) {
+        problems = append(problems, d.IP+": "+fmt.Sprintf(format, args...))
+    }
+    maxHz := lintMaxHz(d)
+    rpm := d.RpmToHz * maxHz
+    cfm := rpm * d.CfmRpm
+    switch {
+    case d.RpmToHz <= 0:
+        add("RpmHz is %v; RPM and CFM will always read 0", d.RpmToHz)
+    case rpm > lintMaxMotorRpm:
+        add("RpmHz %v gives %.0f RPM at %v Hz, above any induction motor (RpmHz is RPM per Hz, not total RPM)", d.RpmToHz, rpm, maxHz)
+    case rpm < lintMinFanRpm:
+        add("RpmHz %v gives only %.0f RPM at %v Hz", d.RpmToHz, rpm, maxHz)
+    }
+    if d.CfmRpm <= 0 {
+        add("CfmRpm is %v; CFM will always read 0", d.CfmRpm)
+    } else if d.MotorHP > 0 && rpm > 0 {
+        if perHP := cfm / d.MotorHP; perHP < lintMinCfmPerHP || perHP > lintMaxCfmPerHP {
+            add("%.0f CFM at %v Hz is %.0f CFM/HP for a %v HP motor (expected %d-%d; is CfmRpm per RPM?)", cfm, maxHz, perHP, d.MotorHP, lintMinCfmPerHP, lintMaxCfmPerHP)
+        }
+    }
+
+    // The description is usually copied from the fan schedule; it should agree at 60 Hz
+    count, descRpm, descCfm := parseFanDesc(d.FanDesc)
+    if descRpm > 0 && d.RpmToHz > 0 && !withinTolerance(d.RpmToHz*60, descRpm) {
+        add("RpmHz %v gives %.0f RPM at 60 Hz but FanDesc %q says %.0f RPM", d.RpmToHz, d.RpmToHz*60, d.FanDesc, descRpm)
+    }
+    if descCfm > 0 && d.RpmToHz > 0 && d.CfmRpm > 0 {
+        at60 := d.RpmToHz * 60 * d.CfmRpm
+        if !withinTolerance(at60, descCfm) && !withinTolerance(at60, descCfm*float64(count)) {
+            add("CfmRpm %v gives %.0f CFM at 60 Hz but FanDesc %q says %.0f CFM", d.CfmRpm, at60, d.FanDesc, descCfm)
+        }
+    }
+    if d.SoftMaxHz > 0 && d.HardMaxHz > 0 && d.SoftMaxHz > d.HardMaxHz {
+        add("SoftMaxHz %v is above HardMaxHz %v", d.SoftMaxHz, d.HardMaxHz)
+    }
+    if d.MinHz > 0 && d.HardMaxHz > 0 && d.MinHz > d.HardMaxHz {
+        add("MinHz %v is above HardMaxHz %v; every SetSpeed will be refused", d.MinHz, d.HardMaxHz)
+    }
+    if d.MaxCurrentA < 0 {
+        add("MaxCurrentA is %v; the current governor ignores it", d.MaxCurrentA)
+    }
+    if d.VibrationSignal != "" && !strings.HasSuffix(d.VibrationSignal, ".vibration") {
+        add("VibrationSignal %q is not a \"<sensor>.vibration\" signal", d.VibrationSignal)
+    }
+    return problems
+}
+
+// lintProfile checks that setpoints written through SetFreqCalc read back as the same
+// frequency and fit their registers at the top of the speed range
+func lintProfile(name string, p DriveTypeProfile, maxHz float64) []string {
+    var problems []string
+    add := func(format string, args ...interface{}) {
+        problems = append(problems, name+": "+fmt.Sprintf(format, args...))
+    }
+    if len(p.Setpoint) == 0 {
+        return nil
+    }
+    if len(p.Setpoint) > 1 && p.SpeedPresetMultiplier == 0 {
+        add("SpeedPresetMultiplier is 0, so every SetSpeed writes 0 to preset register %d", p.Setpoint[1])
+    }
+
+    readCalc := p.OutFreqCalc
+    if p.SetpointReadCalc != "" {
+        readCalc = p.SetpointReadCalc
+    }
+    // A read-back that depends on other live registers can't be checked offline
+    used := make(map[string]bool)
+    if c := parseFreqCalc(readCalc); c.root != nil {
+        calcVariables(c.root, used)
+    }
+    for v := range used {
+        if _, ok := p.Constants[v]; v != "raw" && !ok {
+            return problems
+        }
+    }
+
+    maxRaw := 65535.0
+    if p.SignedSetpoint {
+        maxRaw = 32767
+    }
+    if p.isDoubleWord("Setpoint") {
+        maxRaw = math.MaxInt32
+    }
+    for _, hz := range []float64{maxHz / 2, maxHz} {
+        raw := math.Trunc(applyCalc(p.SetFreqCalc, hz, p.Constants)) // writeSetpoint truncates
+        back := applyCalc(readCalc, raw, p.Constants)
+        if math.Abs(back-hz) > 0.1 {
+            add("%v Hz is written as %v by SetFreqCalc %q but reads back as %v Hz through %q", hz, raw, p.SetFreqCalc, back, readCalc)
+            break
+        }
+        if raw > maxRaw || raw < 0 {
+            add("%v Hz is written as %v, outside the setpoint register range", hz, raw)
+        }
+        if len(p.Setpoint) > 1 && raw*float64(p.SpeedPresetMultiplier) > maxRaw {
+            add("%v Hz is written to preset register %d as %v (SpeedPresetMultiplier %d), outside the register range", hz, p.Setpoint[1], raw*float64(p.SpeedPresetMultiplier), p.SpeedPresetMultiplier)
+        }
+    }
+    return problems
+}
+
+// runLint implements "vfdserver lint [config.json] [drive_profiles.json]"
+func runLint(args []string) int {
+    if len(args) > 2 {
+        fmt.Fprintln(os.Stderr, "usage: vfdserver lint [config.json] [drive_profiles.json]")
+        return 2
+    }
+    configPath, profilesPath := "/etc/vfd/config.json", driveProfilesFilePath
+    if len(args) > 0 {
+        configPath = args[0]
+    }
+    if len(args) > 1 {
+        profilesPath = args[1]
+    }
+    data, err := os.ReadFile(configPath)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    var cfg AppConfig
+    if err := json.Unmarshal(data, &cfg); err != nil {
+        fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+        return 1
+    }
+    driveTypeProfiles = make(map[string]DriveTypeProfile)
+    if err := loadDriveTypeProfiles(profilesPath); err != nil {
+        fmt.Fprintf(os.Stderr, "%s: %v\n", profilesPath, err)
+        return 1
+    }
+    problems := lintConfig(cfg, driveTypeProfiles)
+    for _, p := range problems {
+        fmt.Println(p)
+    }
+    if len(problems) > 0 {
+        fmt.Fprintf(os.Stderr, "%d problem(s) in %d drives\n", len(problems), len(cfg.VFDs))
+        return 1
+    }
+    fmt.Fprintf(os.Stderr, "%d drives OK\n", len(cfg.VFDs))
+    return 0
+}
+
+// =====================
+// Site Drift Report
+// =====================
+// "vfdserver drift <url>..." compares the server version and drive profiles of several sites
+// through their /api/app-config and /api/profiles, so profile fixes can be rolled out to every
+// installation. Sites are queried directly; there is no central registry.
+
+// SiteSnapshot is what the drift report knows about one site
+type SiteSnapshot struct {
+    Name     string
+    Version  string
+    Profiles map[string]map[string]json.RawMessage // profile -> field -> value
+}
+
+// fetchSiteSnapshot reads a site's version and profiles from its API
+func fetchSiteSnapshot(client *http.Client, baseURL string) (SiteSnapshot, error) {
+    snap := SiteSnapshot{Name: baseURL}
+    baseURL = strings.TrimSuffix(baseURL, "/")
+    get := func(path string, v interface{}) error {
+        resp, err := client.Get(baseURL + path)
+        if err != nil {
+            return err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            return fmt.Errorf("%s%s: %s", baseURL, path, resp.Status)
+        }
+        return json.NewDecoder(resp.Body).Decode(v)
+    }
+    var info struct {
+        SiteName string `json:"siteName"`
+        Version  string `json:"version"`
+    }
+    if err := get("/api/app-config", &info); err != nil {
+        return snap, err
+    }
+    if info.SiteName != "" {
+        snap.Name = info.SiteName
+    }
+    snap.Version = info.Version
+    if snap.Version == "" {
+        snap.Version = "unknown"
+    }
+    return snap, get("/api/profiles", &snap.Profiles)
+}
+
+// isZeroJSON reports whether a value is JSON's zero for its type, which newer versions
+// serialize for fields older ones don't have
+func isZeroJSON(v json.RawMessage) bool {
+    switch string(bytes.TrimSpace(v)) {
+    case "", "null", "0", `""`, "false", "[]", "{}":
+        return true
+    }
+    return false
+}
+
+// profileFieldValue is a field's value for comparison; absent and zero are the same
+func profileFieldValue(p map[string]json.RawMessage, field string) string {
+    v, ok := p[field]
+    if !ok || isZeroJSON(v) {
+        return ""
+    }
+    var buf bytes.Buffer
+    if err := json.Compact(&buf, v); err != nil {
+        return string(v)
+    }
+    return buf.String()
+}
+
+// buildDriftReport lists every difference between the sites, one line each
+func buildDriftReport(sites []SiteSnapshot) []string {
+    var report []string
+    groupSites := func(value func(SiteSnapshot) (string, bool)) map[string][]string {
+        groups := make(map[string][]string)
+        for _, s := range sites {
+            if v, ok := value(s); ok {
+                groups[v] = append(groups[v], s.Name)
+            }
+        }
+        return groups
+    }
+    describe := func(groups map[string][]string) string {
+        values := make([]string, 0, len(groups))
+        for v := range groups {
+            values = append(values, v)
+        }
+        sort.Strings(values)
+        parts := make([]string, len(values))
+        for i, v := range values {
+            shown := v
+            if shown == "" {
+                shown = "(unset)"
+            }
+            parts[i] = fmt.Sprintf("%s on %s", shown, strings.Join(groups[v], ", "))
+        }
+        return strings.Join(parts, "; ")
+    }
+
+    if versions := groupSites(func(s SiteSnapshot) (string, bool) { return s.Version, true }); len(versions) > 1 {
+        report = append(report, "version: "+describe(versions))
+    }
+
+    names := make(map[string]bool)
+    for _, s := range sites {
+        for name := range s.Profiles {
+            names[name] = true
+        }
+    }
+    sorted := make([]string, 0, len(names))
+    for name := range names {
+        sorted = append(sorted, name)
+    }
+    sort.Strings(sorted)
+    for _, name := range sorted {
+        var missing []string
+        fields := make(map[string]bool)
+        for _, s := range sites {
+            p, ok := s.Profiles[name]
+            if !ok {
+                missing = append(missing, s.Name)
+            }
+            for f := range p {
+                fields[f] = true
+            }
+        }
+        if len(missing) > 0 {
+            report = append(report, fmt.Sprintf("profile %s: missing on %s", name, strings.Join(missing, ", ")))
+        }
+        fieldNames := make([]string, 0, len(fields))
+        for f := range fields {
+            fieldNames = append(fieldNames, f)
+        }
+        sort.Strings(fieldNames)
+        for _, f := range fieldNames {
+            values := groupSites(func(s SiteSnapshot) (string, bool) {
+                p, ok := s.Profiles[name]
+                if !ok {
+                    return "", false
+                }
+                return profileFieldValue(p, f), true
+            })
+            if len(values) > 1 {
+                report = append(report, fmt.Sprintf("profile %s %s: %s", name, f, describe(values)))
+            }
+        }
+    }
+    return report
+}
+
+// runDrift implements "vfdserver drift <site URL> <site URL>...".
+// It exits 1 when the sites differ or one can't be reached.
+func runDrift(args []string) int {
+    if len(args) < 2 {
+        fmt.Fprintln(os.Stderr, "usage: vfdserver drift <site URL> <site URL>...")
+        return 2
+    }
+    client := &http.Client{Timeout: 10 * time.Second}
+    var sites []SiteSnapshot
+    failed := false
+    for _, url := range args {
+        snap, err := fetchSiteSnapshot(client, url)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s: %v\n", url, err)
+            failed = true
+            continue
+        }
+        sites = append(sites, snap)
+    }
+    report := buildDriftReport(sites)
+    for _, line := range report {
+        fmt.Println(line)
+    }
+    switch {
+    case len(report) > 0:
+        fmt.Fprintf(os.Stderr, "%d difference(s) across %d sites\n", len(report), len(sites))
+    case !failed:
+        fmt.Fprintf(os.Stderr, "%d sites consistent\n", len(sites))
+    }
+    if failed || len(report) > 0 {
+        return 1
+    }
+    return 0
+}
+
+// =====================
+// Control CLI
+// =====================
+// `vfdserver ctl` acts on a running server through api/client, for operators on a jump
+// host when the dashboard is down. The server is -server or VFDSERVER_URL (default
+// http://localhost), the token -token or VFDSERVER_TOKEN (one of the server's APITokens).
+const ctlUsage = `usage: vfdserver ctl [-server URL] [-token TOKEN] <command> [args]
+
+commands:
+  list                             drives with status, speeds and current
+  status                           server readiness and the curtailments in effect
+  curtailment [id]                 the curtailments in effect, with each drive's saved state
+  start <drive>...                 start drives (IDs or IPs)
+  stop <drive>...                  stop drives
+  setspeed [-ack] <hz> <drive>...  set speed; -ack overrides soft speed limits
+  curtail [group]...               curtail groups, all drives if none
+  resume [id]                      resume a curtailment; the id is needed when several are in effect
+  disable <drive>...               stop polling drives
+  enable <drive>...                poll drives again`
+
+func runCtl(args []string, stdout, stderr io.Writer) int {
+    fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+    fs.SetOutput(stderr)
+    fs.Usage = func() { fmt.Fprintln(stderr, ctlUsage) }
+    server := fs.String("server", envOr("VFDSERVER_URL", "http://localhost"), "server URL")
+    token := fs.String("token", os.Getenv("VFDSERVER_TOKEN"), "API token")
+    if err := fs.Parse(args); err != nil {
+        return 2
+    }
+    usage := func() int {
+        fs.Usage()
+        return 2
+    }
+    if fs.NArg() == 0 {
+        return usage()
+    }
+    cmd, rest := fs.Arg(0), fs.Args()[1:]
+    c := apiclient.New(*server, "vfdserver-ctl", Version)
+    c.Token = *token
+    ctx := context.Background()
+
+    var err error
+    switch cmd {
+    case "list", "status":
+        if len(rest) > 0 {
+            return usage()
+        }
+        if cmd == "list" {
+            err = ctlList(ctx, c, stdout)
+        } else {
+            err = ctlStatus(ctx, c, stdout)
+        }
+    case "curtailment", "resume":
+        if len(rest) > 1 {
+            return usage()
+        }
+        id := ""
+        if len(rest) == 1 {
+            id = rest[0]
+        }
+        if cmd == "curtailment" {
+            err = ctlCurtailment(ctx, c, id, stdout)
+        } else {
+            err = ctlCurtail(ctx, c, []string{id}, false, stdout)
+        }
+    case "curtail":
+        err = ctlCurtail(ctx, c, rest, true, stdout)
+    case "start", "stop":
+        if len(rest) == 0 {
+            return usage()
+        }
+        action := apiclient.ActionStart
+        if cmd == "stop" {
+            action = apiclient.ActionStop
+        }
+        return ctlControl(ctx, c, apiclient.ControlRequest{Drives: rest, Action: action}, stdout, stderr)
+    case "setspeed":
+        sfs := flag.NewFlagSet("setspeed", flag.ContinueOnError)
+        sfs.SetOutput(stderr)
+        ack := sfs.Bool("ack", false, "override soft speed limits")
+        if err := sfs.Parse(rest); err != nil || sfs.NArg() < 2 {
+            return usage()
+        }
+        hz, err := strconv.ParseFloat(sfs.Arg(0), 64)
+        if err != nil || hz < 0 {
+            fmt.Fprintf(stderr, "invalid speed %q\n", sfs.Arg(0))
+            return 2
+        }
+        return ctlControl(ctx, c, apiclient.ControlRequest{Drives: sfs.Args()[1:], Action: apiclient.ActionSetSpeed, Speed: hz, Acknowledge: *ack}, stdout, stderr)
+    case "disable", "enable":
+        if len(rest) == 0 {
+            return usage()
+        }
+        if err = c.SetConnected(ctx, cmd == "enable", rest...); err == nil {
+            fmt.Fprintf(stdout, "%sd %d drive(s)\n", cmd, len(rest))
+        }
+    default:
+        fmt.Fprintf(stderr, "unknown command %q\n", cmd)
+        return usage()
+    }
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 1
+    }
+    return 0
+}
+
+// envOr returns the environment variable, or def when it is unset or empty
+func envOr(name, def string) string {
+    if v := os.Getenv(name); v != "" {
+        return v
+    }
+    return def
+}
+
+func ctlList(ctx context.Context, c *apiclient.Client, out io.Writer) error {
+    drives, err := c.Devices(ctx)
+    if err != nil {
+        return err
+    }
+    tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "ID\tIP\tGROUP\tFAN\tSTATUS\tSET HZ\tACTUAL HZ\tAMPS\tNOTES")
+    for _, d := range drives {
+        var notes []string
+        if d.FaultText != "" {
+            notes = append(notes, d.FaultText)
+        }
+        if d.Tagout != nil {
+            notes = append(notes, fmt.Sprintf("tagged out by %s: %s", d.Tagout.User, d.Tagout.Reason))
+        }
+        if d.Hand != nil {
+            notes = append(notes, "in hand ("+d.Hand.User+")")
+        }
+        if d.Shard != "" {
+            notes = append(notes, "shard "+d.Shard)
+        }
+        fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%.1f\t%.1f\t%.1f\t%s\n", d.ID, d.IP, d.Group, d.FanNumber, d.Status, d.SetSpeed, d.ActualSpeed, d.Current, strings.Join(notes, "; "))
+    }
+    return tw.Flush()
+}
+
+// ctlCurtail curtails groups (all drives if none), or resumes the session args[0]
+func ctlCurtail(ctx context.Context, c *apiclient.Client, args []string, curtail bool, out io.Writer) error {
+    var res apiclient.CurtailResult
+    var err error
+    if curtail {
+        res, err = c.Curtail(ctx, args...)
+    } else {
+        res, err = c.ResumeSession(ctx, args[0])
+    }
+    if err != nil {
+        return err
+    }
+    fmt.Fprintln(out, res.Message)
+    if len(res.CriticalDrives) > 0 {
+        fmt.Fprintf(out, "left alone, critical: %s\n", strings.Join(res.CriticalDrives, ", "))
+    }
+    if len(res.ReservedDrives) > 0 {
+        fmt.Fprintf(out, "left running for airflow reservations: %s\n", strings.Join(res.ReservedDrives, ", "))
+    }
+    if len(res.HandDrives) > 0 {
+        fmt.Fprintf(out, "left alone, in hand: %s\n", strings.Join(res.HandDrives, ", "))
+    }
+    if len(res.OtherSessions) > 0 {
+        fmt.Fprintf(out, "left to other curtailments: %s\n", strings.Join(res.OtherSessions, ", "))
+    }
+    return nil
+}
+
+func ctlStatus(ctx context.Context, c *apiclient.Client, out io.Writer) error {
+    st, err := c.Status(ctx)
+    if err != nil {
+        return err
+    }
+    state := "ready"
+    if !st.Ready {
+        state = "loading"
+    }
+    fmt.Fprintf(out, "%s: %d/%d drives connected, last update %s\n", state, st.ConnectedVFDs, st.TotalVFDs, st.LastUpdateTime.Local().Format("2006-01-02 15:04:05"))
+    if len(st.ExcludedVFDs) > 0 {
+        fmt.Fprintf(out, "excluded by config issues: %s\n", strings.Join(st.ExcludedVFDs, ", "))
+    }
+    sessions, err := c.Curtailments(ctx)
+    if err != nil {
+        return err
+    }
+    if len(sessions) == 0 {
+        fmt.Fprintln(out, "no curtailment in effect")
+        return nil
+    }
+    for _, curtailed := range sessions {
+        groups := "all drives"
+        if len(curtailed.Groups) > 0 {
+            groups = "groups " + strings.Join(curtailed.Groups, ", ")
+        }
+        fmt.Fprintf(out, "curtailed (%s) since %s: %s (%d drives)\n", curtailed.ID, curtailed.Timestamp.Local().Format("2006-01-02 15:04:05"), groups, len(curtailed.Drives))
+    }
+    return nil
+}
+
+// ctlCurtailment prints the curtailments in effect, or just session id, and what each
+// drive goes back to on resume
+func ctlCurtailment(ctx context.Context, c *apiclient.Client, id string, out io.Writer) error {
+    sessions, err := c.Curtailments(ctx)
+    if err != nil {
+        return err
+    }
+    shown := 0
+    for _, st := range sessions {
+        if id != "" && st.ID != id {
+            continue
+        }
+        if shown > 0 {
+            fmt.Fprintln(out)
+        }
+        shown++
+        if err := ctlCurtailmentSession(st, out); err != nil {
+            return err
+        }
+    }
+    switch {
+    case shown == 0 && id != "":
+        return fmt.Errorf("no curtailment %s in effect", id)
+    case shown == 0:
+        fmt.Fprintln(out, "no curtailment in effect")
+    }
+    return nil
+}
+
+func ctlCurtailmentSession(st apiclient.CurtailmentState, out io.Writer) error {
+    groups := "all drives"
+    if len(st.Groups) > 0 {
+        groups = strings.Join(st.Groups, ", ")
+    }
+    fmt.Fprintf(out, "id:      %s\n", st.ID)
+    if st.User != "" {
+        fmt.Fprintf(out, "by:      %s\n", st.User)
+    }
+    fmt.Fprintf(out, "since:   %s\ngroups:  %s\n", st.Timestamp.Local().Format("2006-01-02 15:04:05"), groups)
+    switch {
+    case st.Shed != nil:
+        fmt.Fprintf(out, "target:  shed %.1f kW, estimated %.1f kW", st.Shed.TargetKW, st.Shed.EstimatedKW)
+        if st.Shed.MeasuredKW != nil {
+            fmt.Fprintf(out, ", measured %.1f kW", *st.Shed.MeasuredKW)
+        }
+        fmt.Fprintln(out)
+    case st.Target != nil && st.Target.Percent > 0:
+        fmt.Fprintf(out, "target:  running drives at %g%% of their speed\n", st.Target.Percent)
+    case st.Target != nil:
+        fmt.Fprintf(out, "target:  running drives at %.1f Hz\n", st.Target.Hz)
+    }
+    if r := st.Rotation; r != nil {
+        fmt.Fprintf(out, "rolling: %d of %d groups every %d min, next turn %s\n", r.Count, len(r.Groups), r.EveryMin, r.NextAt.Local().Format("15:04:05"))
+    }
+    if st.ResumeAt != nil {
+        fmt.Fprintf(out, "resumes: %s\n", st.ResumeAt.Local().Format("2006-01-02 15:04:05"))
+    }
+    tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "IP\tGROUP\tWAS\tSETPOINT\tNOW")
+    for _, d := range st.Drives {
+        now := "stopped"
+        if d.ReducedHz > 0 {
+            now = fmt.Sprintf("%.1f Hz", d.ReducedHz)
+        }
+        fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%s\n", d.IP, d.Group, d.Status, d.SetSpeed, now)
+    }
+    return tw.Flush()
+}
+
+// ctlControl sends a control action and prints each drive's outcome from the event it
+// logged. It returns 1 when the request is refused or any drive failed.
+func ctlControl(ctx context.Context, c *apiclient.Client, req apiclient.ControlRequest, stdout, stderr io.Writer) int {
+    if err := c.Control(ctx, req); err != nil {
+        fmt.Fprintln(stderr, err)
+        return 1
+    }
+    events, err := c.ControlEvents(ctx, req.Drives[0])
+    if err != nil || len(events) == 0 || events[len(events)-1].Action != req.Action {
+        fmt.Fprintf(stdout, "%s sent; see /api/control-events for the outcome\n", req.Action)
+        return 0
+    }
+    code := 0
+    for _, d := range events[len(events)-1].Drives {
+        result := "ok"
+        switch {
+        case d.Queued:
+            result = "queued until it reconnects"
+        case d.Superseded:
+            result = "superseded by a newer request"
+        case !d.Success:
+            result, code = "FAILED: "+d.Error, 1
+        }
+        if d.Warning != "" {
+            result += " (" + d.Warning + ")"
+        }
+        fmt.Fprintf(stdout, "%s %s: %s\n", req.Action, d.IP, result)
+    }
+    return code
+}
+
+// =====================
+// Drive IDs
+// =====================
+// Every drive has a stable ID that keys its history (drive stats, control events) and
+// labels its metrics, so renumbering the OT subnet keeps it. An "ID" in config.json wins.
+// Otherwise an ID is generated on first sight and kept in drive_ids.json with the drive's
+// IP and fan slot; a drive whose IP changed keeps its generated ID if it is still in the
+// same slot. APIs accept an ID wherever they take a drive IP. Live connection state stays
+// keyed by IP, since that is what it describes.
+const driveIDsFilePath = "/etc/vfd/drive_ids.json"
+
+// DriveIDAssignment records a generated ID
+type DriveIDAssignment struct {
+    ID   string `json:"id"`
+    IP   string `json:"ip"`
+    Slot string `json:"slot"` // "<Group>/<FanNumber>"
+}
+
+var (
+    driveIDsMu         sync.Mutex
+    driveIDAssignments []DriveIDAssignment
+)
+
+func driveSlot(d DriveConfig) string {
+    return fmt.Sprintf("%s/%d", d.Group, d.FanNumber)
+}
+
+// newDriveID returns a random (version 4) UUID
+func newDriveID() string {
+    var b [16]byte
+    crand.Read(b[:])
+    b[6] = b[6]&0x0f | 0x40
+    b[8] = b[8]&0x3f | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// assignDriveIDs sets the ID of every drive without a config ID: the assignment for its
+// IP, else one for its slot whose IP is no longer configured, else a new one. It returns
+// the updated assignments and a note per new, moved or superseded ID.
+func assignDriveIDs(drives []DriveConfig, assigned []DriveIDAssignment, newID func() string) ([]DriveIDAssignment, []string) {
+    configured := make(map[string]bool, len(drives))
+    for _, d := range drives {
+        configured[d.IP] = true
+    }
+    out := append([]DriveIDAssignment(nil), assigned...)
+    var notes []string
+    for i := range drives {
+        d := &drives[i]
+        idx := -1
+        for j, a := range out {
+            if a.IP == d.IP {
+                idx = j
+                break
+            }
+        }
+        if d.ID != "" {
+            if idx >= 0 && out[idx].ID != d.ID {
+                notes = append(notes, fmt.Sprintf("drive %s: config ID %s replaces generated ID %s; set \"ID\": %q instead to keep its history", d.IP, d.ID, out[idx].ID, out[idx].ID))
+            }
+            continue
+        }
+        if idx < 0 {
+            for j, a := range out {
+                if a.Slot == driveSlot(*d) && !configured[a.IP] {
+                    idx = j
+                    notes = append(notes, fmt.Sprintf("drive %s keeps ID %s from %s (same slot %s)", d.IP, a.ID, a.IP, a.Slot))
+                    break
+                }
+            }
+        }
+        if idx < 0 {
+            out = append(out, DriveIDAssignment{ID: newID()})
+            idx = len(out) - 1
+            notes = append(notes, fmt.Sprintf("drive %s assigned ID %s", d.IP, out[idx].ID))
+        }
+        out[idx].IP, out[idx].Slot = d.IP, driveSlot(*d)
+        d.ID = out[idx].ID
+    }
+    return out, notes
+}
+
+// applyDriveIDs fills in the IDs of a config's drives (before it is published) and
+// persists any new assignment
+func applyDriveIDs(drives []DriveConfig) {
+    driveIDsMu.Lock()
+    assigned, notes := assignDriveIDs(drives, driveIDAssignments, newDriveID)
+    changed := !reflect.DeepEqual(assigned, driveIDAssignments)
+    driveIDAssignments = assigned
+    driveIDsMu.Unlock()
+    for _, note := range notes {
+        log.Printf("[DRIVE ID] %s", note)
+    }
+    if changed && !shadowMode() {
+        if err := saveDriveIDs(driveIDsFilePath); err != nil {
+            log.Printf("[DRIVE ID] Failed to save %s: %v", driveIDsFilePath, err)
+        }
+    }
+}
+
+func loadDriveIDs(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    var loaded []DriveIDAssignment
+    if err := json.Unmarshal(data, &loaded); err != nil {
+        log.Printf("[DRIVE ID] %s: %v", filePath, err)
+        return
+    }
+    driveIDsMu.Lock()
+    driveIDAssignments = loaded
+    driveIDsMu.Unlock()
+}
+
+func saveDriveIDs(filePath string) error {
+    driveIDsMu.Lock()
+    data, err := json.MarshalIndent(driveIDAssignments, "", "    ")
+    driveIDsMu.Unlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// retireDriveID drops a generated ID so a drive replacing it (even at the same IP or slot)
+// is assigned a new one
+func retireDriveID(id string) {
+    driveIDsMu.Lock()
+    kept := driveIDAssignments[:0:0]
+    for _, a := range driveIDAssignments {
+        if a.ID != id {
+            kept = append(kept, a)
+        }
+    }
+    driveIDAssignments = kept
+    driveIDsMu.Unlock()
+    if !shadowMode() {
+        if err := saveDriveIDs(driveIDsFilePath); err != nil {
+            log.Printf("[DRIVE ID] Failed to save %s: %v", driveIDsFilePath, err)
+        }
+    }
+}
+
+// driveRefIP resolves a drive reference (ID or IP) against drives; anything that is not
+// an ID is returned as given
+func driveRefIP(ref string, drives []DriveConfig) string {
+    for _, d := range drives {
+        if d.ID == ref {
+            return d.IP
+        }
+    }
+    return ref
+}
+
+// resolveDriveRefs maps request drive references to IPs against the running config
+func resolveDriveRefs(refs []string) []string {
+    drives := configuredDrives()
+    out := make([]string, len(refs))
+    for i, ref := range refs {
+        out[i] = driveRefIP(ref, drives)
+    }
+    return out
+}
+
+// driveIDFor returns the ID of the drive configured at ip, or "" if there is none
+func driveIDFor(ip string) string {
+    if d, ok := driveConfig(ip); ok {
+        return d.ID
+    }
+    return ""
+}
+
+func eventTouchesDrive(event ControlEvent, id string) bool {
+    for _, d := range event.Drives {
+        if d.ID == id {
+            return true
+        }
+    }
+    return false
+}
+
+// fillEventDriveIDs sets the ID of event entries that only carry an IP
+func fillEventDriveIDs(event *ControlEvent) {
+    for i := range event.Drives {
+        if event.Drives[i].ID == "" {
+            event.Drives[i].ID = driveIDFor(event.Drives[i].IP)
+        }
+    }
+}
+
+// migrateIPKeyedStats moves totals saved under a configured drive's IP (before drive IDs)
+// to its ID
+func migrateIPKeyedStats(stats map[string]*DriveStats, drives []DriveConfig) int {
+    moved := 0
+    for _, d := range drives {
+        st, ok := stats[d.IP]
+        if !ok || d.ID == "" || d.ID == d.IP {
+            continue
+        }
+        if _, taken := stats[d.ID]; !taken {
+            stats[d.ID] = st
+            moved++
+        }
+        delete(stats, d.IP)
+    }
+    return moved
+}
+
+// =====================
+// Config Validation
+// =====================
+// validateConfig finds the mistakes that otherwise surface only at poll or control time:
+// duplicate IPs, unknown DriveTypes, profiles missing required registers, zero RpmHz and two
+// drives in one fan slot. Startup and reload refuse a config with any of them, unless
+// StartDegraded is set, in which case the affected drives are left out.
+
+// requiredProfileFields must be present in every profile; 0 is a valid address, so a
+// missing key can't be told apart from the decoded struct
+var requiredProfileFields = []string{"Setpoint", "Control", "StartValue", "StopValue", "OutputFrequency", "OutputCurrent"}
+
+// ConfigIssue is one validation problem and the drives it affects
+type ConfigIssue struct {
+    Drives  []string `json:"drives"`
+    Problem string   `json:"problem"`
+    Fix     string   `json:"fix"`
+    entries []int    // indexes into VFDs to leave out when degraded
+}
+
+func (i ConfigIssue) String() string {
+    return fmt.Sprintf("%s: %s. Fix: %s", strings.Join(i.Drives, ", "), i.Problem, i.Fix)
+}
+
+// readMissingProfileFields lists the required fields each profile in the file leaves out
+func readMissingProfileFields(path string) (map[string][]string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var raw map[string]map[string]json.RawMessage
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    missing := make(map[string][]string)
+    for name, fields := range raw {
+        for _, f := range requiredProfileFields {
+            if _, ok := fields[f]; !ok {
+                missing[name] = append(missing[name], f)
+            }
+        }
+        _, hasStatus := fields["Status"]
+        _, hasCoils := fields["StatusCoils"]
+        if !hasStatus && !hasCoils {
+            missing[name] = append(missing[name], "Status")
+        }
+    }
+    return missing, nil
+}
+
+func validateConfig(cfg AppConfig, profiles map[string]DriveTypeProfile, missing map[string][]string) []ConfigIssue {
+    var issues []ConfigIssue
+    byIP := make(map[string]int)
+    byID := make(map[string]int)
+    bySlot := make(map[string]int)
+    byProfile := make(map[string][]int)
+    for i, d := range cfg.VFDs {
+        if d.ID != "" {
+            if first, ok := byID[d.ID]; ok {
+                issues = append(issues, ConfigIssue{Drives: []string{d.IP}, entries: []int{i},
+                    Problem: fmt.Sprintf("VFDs[%d] repeats the ID of VFDs[%d]", i, first),
+                    Fix:     "give each drive its own ID, or remove it to have one generated"})
+            } else {
+                byID[d.ID] = i
+            }
+            if strings.ContainsAny(d.ID, "/ \t") {
+                issues = append(issues, ConfigIssue{Drives: []string{d.IP}, entries: []int{i},
+                    Problem: fmt.Sprintf("ID %q contains a slash or whitespace", d.ID),
+                    Fix:     "use letters, digits, '-', '_' or '.' (IDs appear in API paths)"})
+            }
+        }
+        if first, ok := byIP[d.IP]; ok {
+            issues = append(issues, ConfigIssue{Drives: []string{d.IP}, entries: []int{i},
+                Problem: fmt.Sprintf("VFDs[%d] repeats the IP of VFDs[%d]", i, first),
+                Fix:     "remove the duplicate entry or correct its IP"})
+        } else {
+            byIP[d.IP] = i
+        }
+        slot := fmt.Sprintf("%s/%d", d.Group, d.FanNumber)
+        if first, ok := bySlot[slot]; ok && cfg.VFDs[first].IP != d.IP {
+            issues = append(issues, ConfigIssue{Drives: []string{d.IP}, entries: []int{i},
+                Problem: fmt.Sprintf("FanNumber %d in group %q is already %s", d.FanNumber, d.Group, cfg.VFDs[first].IP),
+                Fix:     "give each drive in a group its own FanNumber"})
+        } else if !ok {
+            bySlot[slot] = i
+        }
+        if d.RpmToHz <= 0 {
+            issues = append(issues, ConfigIssue{Drives: []string{d.IP}, entries: []int{i},
+                Problem: fmt.Sprintf("RpmHz is %v", d.RpmToHz),
+                Fix:     "set RpmHz to the motor's RPM per Hz (nameplate RPM / 60, e.g. 29.17 for 1750 RPM)"})
+        }
+        switch _, ok := profiles[d.DriveType]; {
+        case ok:
+            byProfile[d.DriveType] = append(byProfile[d.DriveType], i)
+        case d.DriveType == "" && cfg.DetectDriveType:
+            // filled in on first connect
+        default:
+            issues = append(issues, ConfigIssue{Drives: []string{d.IP}, entries: []int{i},
+                Problem: fmt.Sprintf("unknown DriveType %q", d.DriveType),
+                Fix:     "use one of " + strings.Join(sortedProfileNames(profiles), ", ") + ", or add a profile to drive_profiles.json"})
+        }
+    }
+
+    // Profiles are checked where drives use them (any profile may be picked by detection)
+    names := sortedProfileNames(profiles)
+    for _, name := range names {
+        entries := byProfile[name]
+        if len(entries) == 0 && !cfg.DetectDriveType {
+            continue
+        }
+        var problems []string
+        if fields := missing[name]; len(fields) > 0 {
+            problems = append(problems, "missing required "+strings.Join(fields, ", "))
+        }
+        problems = append(problems, validateProfile(profiles[name])...)
+        if len(problems) == 0 {
+            continue
+        }
+        drives := []string{}
+        for _, i := range entries {
+            drives = append(drives, cfg.VFDs[i].IP)
+        }
+        issues = append(issues, ConfigIssue{Drives: drives, entries: entries,
+            Problem: fmt.Sprintf("profile %s: %s", name, strings.Join(problems, "; ")),
+            Fix:     "correct the profile in drive_profiles.json (or with PUT /api/profiles/" + name + ")"})
+    }
+    return issues
+}
+
+func sortedProfileNames(profiles map[string]DriveTypeProfile) []string {
+    names := make([]string, 0, len(profiles))
+    for name := range profiles {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// excludeInvalidDrives returns the config without the drive entries the issues affect
+func excludeInvalidDrives(cfg AppConfig, issues []ConfigIssue) (AppConfig, []string) {
+    drop := make(map[int]bool)
+    for _, issue := range issues {
+        for _, i := range issue.entries {
+            drop[i] = true
+        }
+    }
+    var excluded []string
+    vfds := make([]DriveConfig, 0, len(cfg.VFDs))
+    for i, d := range cfg.VFDs {
+        if drop[i] {
+            excluded = append(excluded, d.IP)
+        } else {
+            vfds = append(vfds, d)
+        }
+    }
+    cfg.VFDs = vfds
+    return cfg, excluded
+}
+
+// checkConfig validates cfg for startup or reload: it logs every issue and either rejects
+// the config or, with StartDegraded, returns it without the affected drives
+func checkConfig(cfg AppConfig, profiles map[string]DriveTypeProfile, missing map[string][]string) (AppConfig, []ConfigIssue, []string, error) {
+    issues := validateConfig(cfg, profiles, missing)
+    for _, issue := range issues {
+        log.Printf("[CONFIG] %s", issue)
+    }
+    if len(issues) == 0 {
+        return cfg, nil, nil, nil
+    }
+    if !cfg.StartDegraded {
+        return cfg, issues, nil, fmt.Errorf("%d configuration problem(s) listed above; fix them, or set StartDegraded to run without the affected drives", len(issues))
+    }
+    cfg, excluded := excludeInvalidDrives(cfg, issues)
+    log.Printf("[CONFIG] StartDegraded: running without %s", strings.Join(excluded, ", "))
+    return cfg, issues, excluded, nil
+}
+
+// validateFeatures checks the optional feature blocks of a config; any error is fatal at
+// startup
+func validateFeatures(cfg AppConfig) error {
+    if err := validateSensors(cfg.Sensors); err != nil {
+        return err
+    }
+    for _, s := range cfg.Sensors {
+        for name, out := range s.Outputs {
+            if err := validateOutputFollow(out.Follow, cfg.VFDs); err != nil {
+                return fmt.Errorf("sensor %q: output %q: %v", s.Name, name, err)
+            }
+        }
+    }
+    if err := validateExternalSources(externalSources(cfg), cfg.Sensors); err != nil {
+        return err
+    }
+    if err := validateDCIM(cfg.DCIM, cfg.VFDs); err != nil {
+        return err
+    }
+    if err := validateSharding(cfg.Sharding, cfg.VFDs); err != nil {
+        return err
+    }
+    if err := validateConfigSync(cfg.ConfigSync); err != nil {
+        return err
+    }
+    if err := validateRotation(cfg.Rotation, cfg.VFDs); err != nil {
+        return err
+    }
+    if err := validateQuietHours(cfg.QuietHours, cfg.VFDs); err != nil {
+        return err
+    }
+    if err := validateSoakSteps(cfg.SoakSteps); err != nil {
+        return fmt.Errorf("SoakSteps: %v", err)
+    }
+    if err := validatePurge(cfg.Purge, cfg); err != nil {
+        return err
+    }
+    if err := validateDampers(cfg); err != nil {
+        return err
+    }
+    if err := validateHistory(cfg.History); err != nil {
+        return err
+    }
+    if err := validatePolicies(cfg.Policies, cfg.VFDs); err != nil {
+        return err
+    }
+    if err := validateDemandResponse(cfg.DemandResponse, cfg.VFDs); err != nil {
+        return err
+    }
+    if c := cfg.Mirror; c != nil {
+        if c.CacheSec < 0 || c.RatePerMin < 0 {
+            return fmt.Errorf("Mirror: CacheSec and RatePerMin must not be negative")
+        }
+        if c.BindPort != "" && (c.BindPort == cfg.BindPort || c.BindPort == cfg.ReadOnlyBindPort) {
+            return fmt.Errorf("Mirror: BindPort %s is already used by another listener", c.BindPort)
+        }
+    }
+    if c := cfg.SetpointWatchdog; c != nil && c.Mode != "" && c.Mode != "flag" && c.Mode != "reassert" {
+        return fmt.Errorf("SetpointWatchdog: Mode must be \"flag\" or \"reassert\", not %q", c.Mode)
+    }
+    // A deadband as wide as the watchdog's tolerance would skip its re-asserts
+    limit := maxSetpointDeadbandHz
+    if c := cfg.SetpointWatchdog; c != nil {
+        tolerance, _, _ := setpointWatchdogLimits(c)
+        limit = math.Min(limit, tolerance)
+    }
+    if cfg.SetpointDeadbandHz >= limit {
+        return fmt.Errorf("SetpointDeadbandHz must be below %.2f Hz", limit)
+    }
+    for _, d := range cfg.VFDs {
+        if d.SetpointDeadbandHz >= limit {
+            return fmt.Errorf("drive %s: SetpointDeadbandHz must be below %.2f Hz", d.IP, limit)
+        }
+    }
+    return nil
+}
+
+// setConfigIssues publishes the running config's validation result in /api/status
+func setConfigIssues(issues []ConfigIssue, excluded []string) {
+    statusMutex.Lock()
+    systemStatus.ConfigIssues = issues
+    systemStatus.ExcludedVFDs = excluded
+    statusMutex.Unlock()
+}
+
+// =====================
+// Configuration Reload
+// =====================
+// SIGHUP re-reads config.json and drive_profiles.json without dropping Modbus sessions.
+// Profiles, the drive list and GroupDependencies apply live: new drives get a connection
+// manager, removed drives are torn down and drives whose Port, Unit or DriveType changed
+// reconnect. Other settings only apply at startup and are reported. A reload that fails
+// to parse or validate changes nothing.
+const configFilePath = "/etc/vfd/config.json"
+
+// reloadableConfigFields are the AppConfig fields a reload applies to the running server
+var reloadableConfigFields = map[string]bool{"VFDs": true, "GroupDependencies": true, "FeatureFlags": true, "Schedules": true, "Rotation": true, "QuietHours": true}
+
+var reloadMu sync.Mutex // serializes reloads
+
+// ConfigReload summarizes what a reload changed, by drive IP
+type ConfigReload struct {
+    Added           []string
+    Removed         []string
+    Changed         []string // any setting differs
+    Reconnect       []string // the Changed drives that need a new Modbus session
+    RestartRequired []string // AppConfig fields that differ but only apply at startup
+}
+
+func (rl ConfigReload) String() string {
+    s := fmt.Sprintf("%d added, %d removed, %d changed (%d reconnecting)", len(rl.Added), len(rl.Removed), len(rl.Changed), len(rl.Reconnect))
+    if len(rl.RestartRequired) > 0 {
+        s += "; restart required for " + strings.Join(rl.RestartRequired, ", ")
+    }
+    return s
+}
+
+func readAppConfig(path string) (AppConfig, error) {
+    var cfg AppConfig
+    file, err := os.Open(path)
+    if err != nil {
+        return cfg, err
+    }
+    defer file.Close()
+    if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+        return cfg, fmt.Errorf("%s: %w", path, err)
+    }
+    return cfg, nil
+}
+
+// diffDrives compares two drive lists by IP
+func diffDrives(old, new []DriveConfig) ConfigReload {
+    var rl ConfigReload
+    before := make(map[string]DriveConfig, len(old))
+    for _, d := range old {
+        before[d.IP] = d
+    }
+    for _, d := range new {
+        prev, ok := before[d.IP]
+        delete(before, d.IP)
+        switch {
+        case !ok:
+            rl.Added = append(rl.Added, d.IP)
+        case !reflect.DeepEqual(prev, d):
+            rl.Changed = append(rl.Changed, d.IP)
+            if driveConnectionChanged(prev, d) {
+                rl.Reconnect = append(rl.Reconnect, d.IP)
+            }
+        }
+    }
+    for _, d := range old {
+        if _, ok := before[d.IP]; ok {
+            rl.Removed = append(rl.Removed, d.IP)
+        }
+    }
+    return rl
+}
+
+// restartRequiredFields lists the settings outside reloadableConfigFields that differ
+func restartRequiredFields(old, new AppConfig) []string {
+    var fields []string
+    ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+    for i := 0; i < ov.NumField(); i++ {
+        name := ov.Type().Field(i).Name
+        if reloadableConfigFields[name] {
+            continue
+        }
+        if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+            fields = append(fields, name)
+        }
+    }
+    return fields
+}
+
+// reconcileVfdData rebuilds the live data for a new drive list, in its order. Existing
+// drives keep their live values with refreshed config fields; new drives start as "Waiting".
+func reconcileVfdData(current []map[string]interface{}, drives []DriveConfig, now time.Time) []map[string]interface{} {
+    byIP := make(map[string]map[string]interface{}, len(current))
+    for _, entry := range current {
+        ip, _ := entry["ip"].(string)
+        byIP[ip] = entry
+    }
+    out := make([]map[string]interface{}, 0, len(drives))
+    for _, d := range drives {
+        fresh := newVfdEntry(d, now)
+        if prev, ok := byIP[d.IP]; ok {
+            entry := make(map[string]interface{}, len(prev))
+            for k, v := range prev {
+                entry[k] = v
+            }
+            for _, k := range []string{"id", "group", "fanNumber", "fanDesc", "rpmToHz", "cfmRpm"} {
+                entry[k] = fresh[k]
+            }
+            fresh = entry
+        }
+        out = append(out, fresh)
+    }
+    return out
+}
+
+// reloadConfig re-reads both files and applies the reloadable parts to the running server
+func reloadConfig(configPath, profilesPath string) (ConfigReload, error) {
+    reloadMu.Lock()
+    defer reloadMu.Unlock()
+
+    var rl ConfigReload
+    cfg, err := readAppConfig(configPath)
+    if err != nil {
+        return rl, err
+    }
+    missing, err := readMissingProfileFields(profilesPath)
+    if err != nil {
+        return rl, err
+    }
+    levels, err := buildGroupLevels(cfg.GroupDependencies)
+    if err != nil {
+        return rl, err
+    }
+
+    // Profiles are read under profilesMu so a concurrent /api/profiles write can't be lost
+    profilesMu.Lock()
+    profiles, err := readDriveTypeProfiles(profilesPath)
+    var overridden map[string]DriveTypeProfile
+    var issues []ConfigIssue
+    var excluded []string
+    if err == nil {
+        cfg, issues, excluded, err = checkConfig(cfg, profiles, missing)
+    }
+    if err == nil {
+        overridden, err = overrideProfiles(cfg.VFDs, profiles)
+    }
+    if err != nil {
+        profilesMu.Unlock()
+        return rl, err
+    }
+    driveTypeProfiles = profiles
+    freqCalcCache = make(map[string]freqCalc)
+    buildFreqCalcCache()
+    cacheOverrideCalcs(overridden)
+    profilesMu.Unlock()
+    for _, problem := range lintConfig(cfg, profiles) {
+        log.Printf("[LINT] %s", problem)
+    }
+    if err := validateRotation(cfg.Rotation, cfg.VFDs); err != nil {
+        return rl, err
+    }
+    if err := validateQuietHours(cfg.QuietHours, cfg.VFDs); err != nil {
+        return rl, err
+    }
+    applyDriveIDs(cfg.VFDs)
+
+    configMu.RLock()
+    old := appConfig
+    configMu.RUnlock()
+    rl = diffDrives(old.VFDs, cfg.VFDs)
+    rl.RestartRequired = restartRequiredFields(old, cfg)
+
+    byIP := make(map[string]*DriveConfig, len(cfg.VFDs))
+    for i := range cfg.VFDs {
+        byIP[cfg.VFDs[i].IP] = &cfg.VFDs[i]
+    }
+    // Hold off polling so the drive list and the live data change together
+    pollMu.Lock()
+    configMu.Lock()
+    appConfig.VFDs = cfg.VFDs
+    appConfig.GroupDependencies = cfg.GroupDependencies
+    appConfig.Schedules = cfg.Schedules
+    appConfig.Rotation = cfg.Rotation
+    appConfig.QuietHours = cfg.QuietHours
+    ipToDrive = byIP
+    groupLevels = levels
+    configMu.Unlock()
+    setConfigFlags(cfg.FeatureFlags)
+    setConfigSchedules(cfg.Schedules, cfg.VFDs)
+    setConfigIssues(issues, excluded)
+    vfdDataMutex.Lock()
+    vfdData = reconcileVfdData(vfdData, cfg.VFDs, time.Now())
+    vfdDataMutex.Unlock()
+    pollMu.Unlock()
+
+    // Series are relabelled on the next collection; write limits are rebuilt from the new config
+    for _, ip := range append(append([]string{}, rl.Removed...), rl.Changed...) {
+        for _, vec := range []*prometheus.GaugeVec{vfdstatus, vfdup, vfdspeedhz, vfdspeedrpm, vfdspeedpercent, vfdcfm, vfdamperage, vfdlastupdated, vfdextra} {
+            vec.DeletePartialMatch(prometheus.Labels{"ip": ip})
+        }
+        writeLimitersMu.Lock()
+        delete(writeLimiters, ip)
+        writeLimitersMu.Unlock()
+    }
+    cancelQueuedCommands(nil, rl.Removed)
+    rawReadingsMu.Lock()
+    detectionsMu.Lock()
+    for _, ip := range rl.Removed {
+        delete(rawReadings, ip)
+        delete(detections, ip)
+        vfdDriveTypeMismatch.DeletePartialMatch(prometheus.Labels{"ip": ip})
+    }
+    detectionsMu.Unlock()
+    rawReadingsMu.Unlock()
+    // Removed and reconnecting drives' managers notice within one health check and retire
+    for _, ip := range rl.Added {
+        ensureDriveManager(byIP[ip])
+    }
+    return rl, nil
+}
+
+// handleReloadSignal reloads on every SIGHUP until the process exits
+func handleReloadSignal(hup <-chan os.Signal) {
+    for range hup {
+        rl, err := reloadConfig(configFilePath, driveProfilesFilePath)
+        if err != nil {
+            log.Printf("[RELOAD] Rejected, running configuration unchanged: %v", err)
+            continue
+        }
+        log.Printf("[RELOAD] Applied: %s", rl)
+        if len(rl.Added)+len(rl.Removed)+len(rl.Changed) > 0 {
+            recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "ConfigReload", Drives: []DriveEventInfo{}, Detail: rl.String()})
+        }
+    }
+}
+
+// =====================
+// Config Sync
+// =====================
+// With ConfigSync the server pulls config.json (and optionally drive_profiles.json) from a
+// source of truth every IntervalSec: a branch of a Git repository, read with the git
+// command into a bare cache, or an HTTP config service. A fetched revision that differs
+// from the files on disk is validated like a startup config and held as pending, with a
+// field-by-field diff, in GET /api/config-sync. AutoApply applies a valid revision at once;
+// otherwise it waits for POST /api/config-sync/approve. Applying writes the files (keeping
+// .bak copies) and reloads them as SIGHUP would; a reload that fails puts the old files
+// back. Review and revert happen in the source: reverting a commit brings it back here.
+
+// ConfigSyncConfig sets the source a server takes its configuration from
+type ConfigSyncConfig struct {
+    GitRepo         string            `json:"GitRepo,omitempty"`         // clone URL, e.g. "https://git.example.com/ops/vfd-sites.git"
+    GitBranch       string            `json:"GitBranch,omitempty"`       // default "main"
+    GitPath         string            `json:"GitPath,omitempty"`         // config.json in the repo, default "config.json"
+    GitProfilesPath string            `json:"GitProfilesPath,omitempty"` // drive_profiles.json in the repo; empty = not synced
+    URL             string            `json:"URL,omitempty"`             // or an HTTP service returning config.json
+    ProfilesURL     string            `json:"ProfilesURL,omitempty"`     // and drive_profiles.json
+    Headers         map[string]string `json:"Headers,omitempty"`
+    IntervalSec     int               `json:"IntervalSec,omitempty"` // default 300, minimum 30
+    AutoApply       bool              `json:"AutoApply,omitempty"`   // apply valid revisions without approval
+}
+
+// ConfigRevision is a fetched configuration that differs from the running one
+type ConfigRevision struct {
+    Revision  string    `json:"revision"`          // commit, or the service's ETag or a content hash
+    Summary   string    `json:"summary,omitempty"` // commit author and subject
+    FetchedAt time.Time `json:"fetchedAt"`
+    Diff      []string  `json:"diff"`
+    Problems  []string  `json:"problems,omitempty"` // validation failures; it can't be applied
+    Warnings  []string  `json:"warnings,omitempty"` // lint findings
+    config    []byte
+    profiles  []byte // nil when profiles are not synced
+}
+
+// ConfigSyncStatus is the state of config sync shown by /api/config-sync
+type ConfigSyncStatus struct {
+    Source    string          `json:"source"`
+    AutoApply bool            `json:"autoApply"`
+    LastCheck *time.Time      `json:"lastCheck,omitempty"`
+    LastError string          `json:"lastError,omitempty"`
+    InSync    bool            `json:"inSync"`
+    Revision  string          `json:"revision,omitempty"` // the source revision the files on disk match
+    Pending   *ConfigRevision `json:"pending,omitempty"`
+}
+
+const configSyncGitDir = "/etc/vfd/config-sync.git"
+
+var (
+    configSyncMu     sync.Mutex // serializes checks and applies
+    configSyncState  ConfigSyncStatus
+    configSyncClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+func validateConfigSync(c *ConfigSyncConfig) error {
+    if c == nil {
+        return nil
+    }
+    if (c.GitRepo == "") == (c.URL == "") {
+        return fmt.Errorf("ConfigSync: set exactly one of GitRepo and URL")
+    }
+    if c.IntervalSec != 0 && c.IntervalSec < 30 {
+        return fmt.Errorf("ConfigSync: IntervalSec must be at least 30")
+    }
+    if c.GitRepo != "" {
+        if _, err := exec.LookPath("git"); err != nil {
+            return fmt.Errorf("ConfigSync: GitRepo needs the git command: %v", err)
+        }
+    }
+    return nil
+}
+
+func configSyncSource(c *ConfigSyncConfig) string {
+    if c.GitRepo != "" {
+        branch, path := c.GitBranch, c.GitPath
+        if branch == "" {
+            branch = "main"
+        }
+        if path == "" {
+            path = "config.json"
+        }
+        return fmt.Sprintf("%s %s:%s", c.GitRepo, branch, path)
+    }
+    return c.URL
+}
+
+// fetchGitConfig fetches the branch tip into the bare cache and reads the files from it
+func fetchGitConfig(c *ConfigSyncConfig, gitDir string) (rev ConfigRevision, err error) {
+    branch, path := c.GitBranch, c.GitPath
+    if branch == "" {
+        branch = "main"
+    }
+    if path == "" {
+        path = "config.json"
+    }
+    git := func(args ...string) ([]byte, error) {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+        defer cancel()
+        var stderr bytes.Buffer
+        cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir", gitDir}, args...)...)
+        cmd.Stderr = &stderr
+        out, err := cmd.Output()
+        if err != nil {
+            return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+        }
+        return out, nil
+    }
+    if _, err := os.Stat(gitDir); err != nil {
+        if _, err := git("init", "--bare", "--quiet"); err != nil {
+            return rev, err
+        }
+    }
+    if _, err := git("fetch", "--quiet", "--depth", "1", c.GitRepo, branch); err != nil {
+        return rev, err
+    }
+    out, err := git("log", "-1", "--format=%H%n%an: %s", "FETCH_HEAD")
+    if err != nil {
+        return rev, err
+    }
+    head := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)
+    rev.Revision = head[0]
+    if len(head) > 1 {
+        rev.Summary = head[1]
+    }
+    if rev.config, err = git("show", "FETCH_HEAD:"+path); err != nil {
+        return rev, err
+    }
+    if c.GitProfilesPath != "" {
+        if rev.profiles, err = git("show", "FETCH_HEAD:"+c.GitProfilesPath); err != nil {
+            return rev, err
+        }
+    }
+    return rev, nil
+}
+
+// fetchHTTPConfig reads the files from the config service
+func fetchHTTPConfig(c *ConfigSyncConfig) (rev ConfigRevision, err error) {
+    get := func(url string) ([]byte, string, error) {
+        req, err := http.NewRequest(http.MethodGet, url, nil)
+        if err != nil {
+            return nil, "", err
+        }
+        for k, v := range c.Headers {
+            req.Header.Set(k, v)
+        }
+        resp, err := configSyncClient.Do(req)
+        if err != nil {
+            return nil, "", err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            return nil, "", fmt.Errorf("%s returned %s", url, resp.Status)
+        }
+        data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+        return data, strings.Trim(resp.Header.Get("ETag"), `"`), err
+    }
+    var etag string
+    if rev.config, etag, err = get(c.URL); err != nil {
+        return rev, err
+    }
+    if c.ProfilesURL != "" {
+        if rev.profiles, _, err = get(c.ProfilesURL); err != nil {
+            return rev, err
+        }
+    }
+    rev.Revision = etag
+    if etag == "" || c.ProfilesURL != "" {
+        sum := sha256.Sum256(append(append([]byte{}, rev.config...), rev.profiles...))
+        rev.Revision = hex.EncodeToString(sum[:6])
+    }
+    return rev, nil
+}
+
+// validateConfigFiles checks a config and profiles the way startup does, returning the
+// problems that would stop the server and the lint warnings
+func validateConfigFiles(configPath, profilesPath string) (problems, warnings []string) {
+    cfg, err := readAppConfig(configPath)
+    if err != nil {
+        return []string{err.Error()}, nil
+    }
+    profiles, err := readDriveTypeProfiles(profilesPath)
+    if err != nil {
+        return []string{fmt.Sprintf("%s: %v", profilesPath, err)}, nil
+    }
+    missing, err := readMissingProfileFields(profilesPath)
+    if err != nil {
+        return []string{fmt.Sprintf("%s: %v", profilesPath, err)}, nil
+    }
+    for _, issue := range validateConfig(cfg, profiles, missing) {
+        problems = append(problems, issue.String())
+    }
+    if _, err := overrideProfiles(cfg.VFDs, profiles); err != nil {
+        problems = append(problems, err.Error())
+    }
+    if _, err := buildGroupLevels(cfg.GroupDependencies); err != nil {
+        problems = append(problems, err.Error())
+    }
+    if err := validateFeatures(cfg); err != nil {
+        problems = append(problems, err.Error())
+    }
+    return problems, lintConfig(cfg, profiles)
+}
+
+// jsonDiff lists the differences between two JSON documents, one line per changed value:
+// "+ path: new", "- path: old" or "~ path: old -> new". Array elements with an IP or Name
+// are matched by it, so reordering drives is not a change.
+func jsonDiff(path string, a, b interface{}, out *[]string) {
+    show := func(v interface{}) string {
+        data, _ := json.Marshal(v)
+        return string(data)
+    }
+    join := func(key string) string {
+        if path == "" {
+            return key
+        }
+        return path + "." + key
+    }
+    switch av := a.(type) {
+    case map[string]interface{}:
+        bv, ok := b.(map[string]interface{})
+        if !ok {
+            break
+        }
+        keys := make(map[string]bool)
+        for k := range av {
+            keys[k] = true
+        }
+        for k := range bv {
+            keys[k] = true
+        }
+        sorted := make([]string, 0, len(keys))
+        for k := range keys {
+            sorted = append(sorted, k)
+        }
+        sort.Strings(sorted)
+        for _, k := range sorted {
+            old, inA := av[k]
+            new, inB := bv[k]
+            switch {
+            case !inA:
+                *out = append(*out, fmt.Sprintf("+ %s: %s", join(k), show(new)))
+            case !inB:
+                *out = append(*out, fmt.Sprintf("- %s: %s", join(k), show(old)))
+            default:
+                jsonDiff(join(k), old, new, out)
+            }
+        }
+        return
+    case []interface{}:
+        bv, ok := b.([]interface{})
+        if !ok {
+            break
+        }
+        key := func(i int, v interface{}) string {
+            if m, ok := v.(map[string]interface{}); ok {
+                for _, k := range []string{"IP", "Name", "ID"} {
+                    if s, ok := m[k].(string); ok && s != "" {
+                        return s
+                    }
+                }
+            }
+            return strconv.Itoa(i)
+        }
+        byKey := make(map[string]interface{}, len(bv))
+        var order []string
+        for i, v := range bv {
+            byKey[key(i, v)] = v
+            order = append(order, key(i, v))
+        }
+        seen := make(map[string]bool)
+        for i, v := range av {
+            k := key(i, v)
+            seen[k] = true
+            if new, ok := byKey[k]; ok {
+                jsonDiff(path+"["+k+"]", v, new, out)
+            } else {
+                *out = append(*out, fmt.Sprintf("- %s[%s]: %s", path, k, show(v)))
+            }
+        }
+        for _, k := range order {
+            if !seen[k] {
+                *out = append(*out, fmt.Sprintf("+ %s[%s]: %s", path, k, show(byKey[k])))
+            }
+        }
+        return
+    }
+    if !reflect.DeepEqual(a, b) {
+        *out = append(*out, fmt.Sprintf("~ %s: %s -> %s", path, show(a), show(b)))
+    }
+}
+
+// diffConfigFiles diffs the current contents of a file against a new version
+func diffConfigFiles(name string, current, next []byte) []string {
+    var a, b interface{}
+    if err := json.Unmarshal(next, &b); err != nil {
+        return []string{fmt.Sprintf("%s: %v", name, err)}
+    }
+    json.Unmarshal(current, &a)
+    var out []string
+    jsonDiff(name, a, b, &out)
+    return out
+}
+
+// checkConfigSync fetches the source and compares it with the files at configPath and
+// profilesPath. A new revision becomes pending, and is applied if AutoApply is set and it
+// is valid.
+func checkConfigSync(c *ConfigSyncConfig, configPath, profilesPath string) error {
+    var rev ConfigRevision
+    var err error
+    if c.GitRepo != "" {
+        rev, err = fetchGitConfig(c, configSyncGitDir)
+    } else {
+        rev, err = fetchHTTPConfig(c)
+    }
+    now := time.Now()
+    configSyncMu.Lock()
+    defer configSyncMu.Unlock()
+    configSyncState.Source, configSyncState.AutoApply, configSyncState.LastCheck = configSyncSource(c), c.AutoApply, &now
+    if err != nil {
+        if configSyncState.LastError != err.Error() {
+            log.Printf("[CONFIG-SYNC] %v", err)
+        }
+        configSyncState.LastError = err.Error()
+        return err
+    }
+    configSyncState.LastError = ""
+
+    currentConfig, _ := os.ReadFile(configPath)
+    currentProfiles, _ := os.ReadFile(profilesPath)
+    if bytes.Equal(rev.config, currentConfig) && (rev.profiles == nil || bytes.Equal(rev.profiles, currentProfiles)) {
+        configSyncState.InSync, configSyncState.Revision, configSyncState.Pending = true, rev.Revision, nil
+        return nil
+    }
+    configSyncState.InSync = false
+    if p := configSyncState.Pending; p != nil && p.Revision == rev.Revision {
+        return nil
+    }
+
+    rev.FetchedAt = now
+    rev.Diff = diffConfigFiles("config", currentConfig, rev.config)
+    if rev.profiles != nil {
+        rev.Diff = append(rev.Diff, diffConfigFiles("profiles", currentProfiles, rev.profiles)...)
+    }
+    dir, err := os.MkdirTemp("", "vfd-config-sync")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(dir)
+    candConfig, candProfiles := filepath.Join(dir, "config.json"), filepath.Join(dir, "drive_profiles.json")
+    profiles := rev.profiles
+    if profiles == nil {
+        profiles = currentProfiles
+    }
+    if err := os.WriteFile(candConfig, rev.config, 0644); err != nil {
+        return err
+    }
+    if err := os.WriteFile(candProfiles, profiles, 0644); err != nil {
+        return err
+    }
+    rev.Problems, rev.Warnings = validateConfigFiles(candConfig, candProfiles)
+    configSyncState.Pending = &rev
+
+    detail := fmt.Sprintf("revision %s from %s: %d change(s)", rev.Revision, configSyncState.Source, len(rev.Diff))
+    if len(rev.Problems) > 0 {
+        detail += fmt.Sprintf(", %d problem(s); not applied", len(rev.Problems))
+    }
+    log.Printf("[CONFIG-SYNC] Pending %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: now, Action: "ConfigSyncPending", Drives: []DriveEventInfo{}, Detail: detail})
+    if c.AutoApply && len(rev.Problems) == 0 {
+        if _, err := applyConfigRevisionLocked(configPath, profilesPath, "auto-apply"); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// applyConfigRevisionLocked writes the pending revision and reloads it; the caller holds
+// configSyncMu. If the reload is rejected the previous files are put back.
+func applyConfigRevisionLocked(configPath, profilesPath, user string) (ConfigReload, error) {
+    rev := configSyncState.Pending
+    if rev == nil {
+        return ConfigReload{}, fmt.Errorf("no pending revision")
+    }
+    if len(rev.Problems) > 0 {
+        return ConfigReload{}, fmt.Errorf("revision %s has %d problem(s)", rev.Revision, len(rev.Problems))
+    }
+    type file struct {
+        path     string
+        next     []byte
+        previous []byte
+    }
+    files := []file{{path: configPath, next: rev.config}}
+    if rev.profiles != nil {
+        files = append(files, file{path: profilesPath, next: rev.profiles})
+    }
+    write := func(path string, data []byte) error {
+        tmp := path + ".tmp"
+        if err := os.WriteFile(tmp, data, 0644); err != nil {
+            return err
+        }
+        return os.Rename(tmp, path)
+    }
+    restore := func() {
+        for _, f := range files {
+            if f.previous != nil {
+                write(f.path, f.previous)
+            }
+        }
+    }
+    for i := range files {
+        current, err := os.ReadFile(files[i].path)
+        if err != nil {
+            return ConfigReload{}, err
+        }
+        if err := os.WriteFile(files[i].path+".bak", current, 0644); err != nil {
+            return ConfigReload{}, err
+        }
+        files[i].previous = current
+    }
+    for _, f := range files {
+        if err := write(f.path, f.next); err != nil {
+            restore()
+            return ConfigReload{}, err
+        }
+    }
+    rl, err := reloadConfig(configPath, profilesPath)
+    if err != nil {
+        restore()
+        log.Printf("[CONFIG-SYNC] Revision %s rejected on reload, previous files restored: %v", rev.Revision, err)
+        return rl, fmt.Errorf("reload rejected, previous files restored: %w", err)
+    }
+    detail := fmt.Sprintf("revision %s applied by %s: %s", rev.Revision, user, rl)
+    if rev.Summary != "" {
+        detail += " (" + rev.Summary + ")"
+    }
+    log.Printf("[CONFIG-SYNC] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "ConfigSync", Drives: []DriveEventInfo{}, Detail: detail})
+    configSyncState.InSync, configSyncState.Revision, configSyncState.Pending = true, rev.Revision, nil
+    return rl, nil
+}
 
-            if driveStatus == "Unavailable" || driveStatus == "NotReady" {
-                driveInfo.Success = false
-                driveInfo.Error = fmt.Sprintf("%s", driveStatus)
-                log.Printf("[CONTROL BLOCKED] IP: %s, Action: %s, State: %s", ip, controlData.Action, driveStatus)
-            } else {
-                switch controlData.Action {
-                case "Start":
-                    if driveStatus == "Tripped" {
-                        err = fanUnTrip(ip)
-                        if err == nil {
-                            err = fanStart(ip)
-                        }
-                    } else {
-                        err = fanStart(ip)
-                    }
-                case "Stop":
-                    err = fanStop(ip)
-                case "Fanhold":
-                    err = fanHold(ip)
-                case "Freespin":
-                    err = fanStop(ip)
-                case "SetSpeed":
-                    if driveStatus == "Tripped" {
-                        err = fanUnTrip(ip)
-                        if err == nil {
-                            err = fanStart(ip)
-                        }
-                    } else {
-                        err = fanStart(ip)
-                    }
-                    if err == nil {
-                        err = setFanSpeed(ip, controlData.Speed)
-                    }
-                }
-                if err != nil {
-                    driveInfo.Success = false
-                    driveInfo.Error = err.Error()
-                    log.Printf("[MODBUS ERROR] IP: %s, Action: %s, Error: %s", ip, controlData.Action, err.Error())
-                }
+// runConfigSync checks the source every IntervalSec
+func runConfigSync() {
+    c := appConfig.ConfigSync
+    if c == nil || shadowMode() {
+        return
+    }
+    interval := time.Duration(c.IntervalSec) * time.Second
+    if interval <= 0 {
+        interval = 5 * time.Minute
+    }
+    for {
+        checkConfigSync(c, configFilePath, driveProfilesFilePath)
+        time.Sleep(interval)
+    }
+}
+
+// handleConfigSync serves GET /api/config-sync (source, last check and any pending
+// revision with its diff), POST /api/config-sync/check to fetch now and POST
+// /api/config-sync/approve {"user": "...", "revision": "..."} to apply the pending revision
+func handleConfigSync(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    c := appConfig.ConfigSync
+    sub := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/config-sync"), "/")
+    if r.Method == http.MethodGet && sub == "" {
+        if c == nil {
+            json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+            return
+        }
+        configSyncMu.Lock()
+        state := configSyncState
+        configSyncMu.Unlock()
+        json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "status": state})
+        return
+    }
+    if r.Method != http.MethodPost || (sub != "check" && sub != "approve") {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    if c == nil {
+        http.Error(w, "ConfigSync is not configured", http.StatusNotFound)
+        return
+    }
+    if sub == "check" {
+        if err := checkConfigSync(c, configFilePath, driveProfilesFilePath); err != nil {
+            http.Error(w, "Config sync failed: "+err.Error(), http.StatusBadGateway)
+            return
+        }
+        configSyncMu.Lock()
+        state := configSyncState
+        configSyncMu.Unlock()
+        json.NewEncoder(w).Encode(state)
+        return
+    }
+
+    // Approving can replace anything in the config, the policies included
+    if !authorize(w, r, "ConfigSync", nil) {
+        return
+    }
+    var req struct {
+        User     string `json:"user"`
+        Revision string `json:"revision"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.User == "" || req.Revision == "" {
+        http.Error(w, `Request body must be {"user": "...", "revision": "..."}`, http.StatusBadRequest)
+        return
+    }
+    configSyncMu.Lock()
+    defer configSyncMu.Unlock()
+    if p := configSyncState.Pending; p == nil || p.Revision != req.Revision {
+        http.Error(w, "Revision "+req.Revision+" is not the pending revision", http.StatusConflict)
+        return
+    }
+    rl, err := applyConfigRevisionLocked(configFilePath, driveProfilesFilePath, req.User)
+    if err != nil {
+        http.Error(w, "Not applied: "+err.Error(), http.StatusConflict)
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{"revision": req.Revision, "applied": rl.String(), "restartRequired": rl.RestartRequired})
+}
+
+// =====================
+// Drive Swap
+// =====================
+// /api/drive-swap replaces a failed drive in its fan slot: commissioning checks against the
+// replacement, the old drive's record and stats archived in retired_drives.json, its
+// config.json entry rewritten in place (keeping Group, FanNumber and the fan data) and the
+// change applied by a reload, so nothing else restarts. dryRun runs only the checks.
+const retiredDrivesFilePath = "/etc/vfd/retired_drives.json"
+
+var swapMu sync.Mutex // one swap at a time
+
+type DriveSwapRequest struct {
+    OldIP     string `json:"oldIP"`
+    IP        string `json:"ip"`        // replacement address; default oldIP
+    Port      int    `json:"port"`      // default: the old drive's
+    Unit      int    `json:"unit"`      // default: the old drive's
+    DriveType string `json:"driveType"` // default: the old drive's
+    DryRun    bool   `json:"dryRun"`
+    Force     bool   `json:"force"` // swap even if a check failed
+}
+
+// SwapCheck is one commissioning check on the replacement drive
+type SwapCheck struct {
+    Name   string `json:"name"`
+    OK     bool   `json:"ok"`
+    Detail string `json:"detail,omitempty"`
+}
+
+// RetiredDrive archives a replaced drive under its fan slot
+type RetiredDrive struct {
+    RetiredAt  time.Time         `json:"retiredAt"`
+    Slot       string            `json:"slot"` // "<Group>/<FanNumber>"
+    Config     DriveConfig       `json:"config"`
+    Stats      *DriveStats       `json:"stats,omitempty"`
+    Detection  *DriveDetection   `json:"detection,omitempty"`
+    ReplacedBy string            `json:"replacedBy"`
+    Identity   map[string]string `json:"replacementIdentity,omitempty"`
+}
+
+// replacementConfig is the old drive's config with the replacement's connection settings.
+// ProfileOverrides belonged to the old unit and are dropped.
+func replacementConfig(old DriveConfig, req DriveSwapRequest) DriveConfig {
+    d := old
+    d.ID = "" // new hardware gets its own ID
+    d.ProfileOverrides = nil
+    if req.IP != "" {
+        d.IP = req.IP
+    }
+    if req.Port != 0 {
+        d.Port = req.Port
+    }
+    if req.Unit != 0 {
+        d.Unit = req.Unit
+    }
+    if req.DriveType != "" {
+        d.DriveType = req.DriveType
+    }
+    return d
+}
+
+// commissionChecks verifies a connected replacement: identity, the profile's registers, and
+// that it is not tripped. It returns the identity it read (nil if the drive has none).
+func commissionChecks(ctx context.Context, client modbus.Client, d DriveConfig, profile DriveTypeProfile) ([]SwapCheck, map[string]string) {
+    var checks []SwapCheck
+    identity := readDeviceIdentity(ctx, client)
+    switch {
+    case profile.Identify == nil:
+        checks = append(checks, SwapCheck{Name: "identity", OK: true, Detail: fmt.Sprintf("profile has no Identify; drive reports %v", identity)})
+    case identity == nil && profile.Identify.Register == nil:
+        checks = append(checks, SwapCheck{Name: "identity", OK: true, Detail: "drive does not report device identification"})
+    default:
+        regs := readIdentityRegisters(ctx, client, map[string]DriveTypeProfile{d.DriveType: profile})
+        ok := profile.identifies(identity, regs)
+        detail := fmt.Sprintf("drive reports %v", identity)
+        if !ok {
+            detail = fmt.Sprintf("drive reports %v, which does not match %s", identity, d.DriveType)
+        }
+        checks = append(checks, SwapCheck{Name: "identity", OK: ok, Detail: detail})
+    }
+
+    useInput := profile.RegisterType == "input"
+    var status int
+    statusBits := profile.StatusBits
+    var err error
+    if len(profile.StatusCoils) > 0 {
+        status, statusBits, err = readStatusCoils(ctx, client, profile)
+    } else {
+        var raw float64
+        raw, err = readProfileRegister(ctx, client, profile, "Status", profile.Status, useInput, false)
+        status = int(raw)
+    }
+    reads := []string{}
+    if err == nil {
+        reads = append(reads, fmt.Sprintf("Status=%d", status))
+        for _, f := range []struct {
+            field string
+            reg   int
+        }{{"OutputFrequency", profile.OutputFrequency}, {"OutputCurrent", profile.OutputCurrent}, {"Setpoint", profile.Setpoint[0]}} {
+            var v float64
+            v, err = readProfileRegister(ctx, client, profile, f.field, f.reg, useInput, false)
+            if err != nil {
+                err = fmt.Errorf("%s: %w", f.field, err)
+                break
             }
-            mu.Lock()
-            event.Drives = append(event.Drives, driveInfo)
-            mu.Unlock()
-        }(ip)
+            reads = append(reads, fmt.Sprintf("%s=%v", f.field, v))
+        }
     }
-    wg.Wait()
+    if err != nil {
+        return append(checks, SwapCheck{Name: "registers", OK: false, Detail: err.Error()}), identity
+    }
+    checks = append(checks, SwapCheck{Name: "registers", OK: true, Detail: strings.Join(reads, ", ")})
 
-    // Log the event with retention and persist
-    recordControlEvent(event)
+    tripped := false
+    if bit, ok := statusBits["Tripped"]; ok {
+        tripped = (status^profile.invertMaskFor(statusBits))&(1<<bit) != 0
+    }
+    if profile.FaultCode > 0 {
+        if raw, err := readProfileRegister(ctx, client, profile, "FaultCode", profile.FaultCode, useInput, false); err == nil {
+            code := int(raw)
+            if profile.FaultCodeMask > 0 {
+                code &= profile.FaultCodeMask
+            }
+            tripped = tripped || code != 0
+        }
+    }
+    if tripped {
+        checks = append(checks, SwapCheck{Name: "not tripped", OK: false, Detail: "replacement is tripped; clear the fault first"})
+    } else {
+        checks = append(checks, SwapCheck{Name: "not tripped", OK: true})
+    }
+    return checks, identity
+}
 
-    w.Write([]byte("Control action processed successfully"))
-    go pollAllDrives()
+// rewriteDriveConfig replaces one drive's entry in config.json, leaving every other key and
+// drive as written. The previous file is kept as .bak.
+func rewriteDriveConfig(filePath, oldIP string, d DriveConfig) error {
+    current, err := os.ReadFile(filePath)
+    if err != nil {
+        return err
+    }
+    var doc map[string]json.RawMessage
+    if err := json.Unmarshal(current, &doc); err != nil {
+        return fmt.Errorf("%s: %w", filePath, err)
+    }
+    var vfds []map[string]json.RawMessage
+    if err := json.Unmarshal(doc["VFDs"], &vfds); err != nil {
+        return fmt.Errorf("%s VFDs: %w", filePath, err)
+    }
+    found := false
+    for _, entry := range vfds {
+        var ip string
+        json.Unmarshal(entry["IP"], &ip)
+        if ip != oldIP {
+            continue
+        }
+        found = true
+        delete(entry, "ProfileOverrides")
+        delete(entry, "ID") // the replacement is new hardware with its own history
+        for key, v := range map[string]interface{}{"IP": d.IP, "Port": d.Port, "Unit": d.Unit, "DriveType": d.DriveType} {
+            entry[key], _ = json.Marshal(v)
+        }
+    }
+    if !found {
+        return fmt.Errorf("drive %s is not in %s", oldIP, filePath)
+    }
+    if doc["VFDs"], err = json.Marshal(vfds); err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(doc, "", "    ")
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(filePath+".bak", current, 0644); err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
 }
 
-func handleCurtail(w http.ResponseWriter, r *http.Request) {
+// archiveRetiredDrive appends a record to the retired drives archive
+func archiveRetiredDrive(filePath string, rec RetiredDrive) error {
+    var archive []RetiredDrive
+    if data, err := os.ReadFile(filePath); err == nil {
+        if err := json.Unmarshal(data, &archive); err != nil {
+            return fmt.Errorf("%s: %w", filePath, err)
+        }
+    }
+    archive = append(archive, rec)
+    data, err := json.MarshalIndent(archive, "", "    ")
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// handleDriveSwap serves POST /api/drive-swap
+func handleDriveSwap(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
     if r.Method != http.MethodPost {
         http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
         return
     }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    var req DriveSwapRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    swapMu.Lock()
+    defer swapMu.Unlock()
 
-    var curtailData struct {
-        Action string   `json:"action"` // "curtail" or "resume"
-        Groups []string `json:"groups"` // Empty means all drives
+    old, ok := driveConfig(req.OldIP)
+    if !ok {
+        http.Error(w, "Unknown drive: "+req.OldIP, http.StatusNotFound)
+        return
     }
-    err := json.NewDecoder(r.Body).Decode(&curtailData)
+    if !authorize(w, r, "DriveSwap", []string{old.IP}) {
+        return
+    }
+    repl := replacementConfig(*old, req)
+    if other, ok := driveConfig(repl.IP); ok && other.IP != old.IP {
+        http.Error(w, fmt.Sprintf("%s is already fan %d in group %s", repl.IP, other.FanNumber, other.Group), http.StatusConflict)
+        return
+    }
+    profile, ok := profileFor(repl.DriveType)
+    if !ok {
+        http.Error(w, "Unknown DriveType: "+repl.DriveType, http.StatusBadRequest)
+        return
+    }
+
+    checks := []SwapCheck{}
+    var identity map[string]string
+    conn, err := connectVFD(repl.IP, repl.Port, byte(repl.Unit), uint16(profile.wireAddr("ProbeRegister", profile.ProbeRegister)))
     if err != nil {
-        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+        checks = append(checks, SwapCheck{Name: "connect", OK: false, Detail: err.Error()})
+    } else {
+        checks = append(checks, SwapCheck{Name: "connect", OK: true, Detail: fmt.Sprintf("%s:%d unit %d", repl.IP, repl.Port, repl.Unit)})
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        var more []SwapCheck
+        more, identity = commissionChecks(ctx, conn.client, repl, profile)
+        cancel()
+        conn.handler.Close()
+        checks = append(checks, more...)
+    }
+    passed := true
+    for _, c := range checks {
+        passed = passed && c.OK
+    }
+    resp := map[string]interface{}{"oldIP": old.IP, "replacement": repl, "checks": checks, "passed": passed, "swapped": false}
+    if req.DryRun || (!passed && !req.Force) {
+        if !req.DryRun {
+            w.WriteHeader(http.StatusConflict)
+            resp["error"] = "commissioning checks failed (set force to swap anyway)"
+        }
+        json.NewEncoder(w).Encode(resp)
+        return
+    }
+
+    rec := RetiredDrive{RetiredAt: time.Now(), Slot: fmt.Sprintf("%s/%d", old.Group, old.FanNumber), Config: *old, ReplacedBy: repl.IP, Identity: identity}
+    if st, ok := driveStatsSnapshot(old.ID); ok {
+        rec.Stats = &st
+    }
+    if det, ok := driveDetection(old.IP); ok {
+        rec.Detection = &det
+    }
+    if err := archiveRetiredDrive(retiredDrivesFilePath, rec); err != nil {
+        http.Error(w, "Failed to archive the old drive: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if err := rewriteDriveConfig(configFilePath, old.IP, repl); err != nil {
+        http.Error(w, "Failed to update config: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    // The replacement starts its own history, even at the same address
+    driveStatsMu.Lock()
+    delete(driveStats, old.ID)
+    driveStatsMu.Unlock()
+    retireDriveID(old.ID)
+    detectionsMu.Lock()
+    delete(detections, old.IP)
+    detectionsMu.Unlock()
+    rl, err := reloadConfig(configFilePath, driveProfilesFilePath)
+    if err != nil {
+        http.Error(w, "config.json updated but the reload failed: "+err.Error(), http.StatusInternalServerError)
         return
     }
+    if old.IP == repl.IP && !driveConnectionChanged(*old, repl) {
+        // Same settings: drop the session to the old unit so the manager reconnects to the new one
+        vfdConnectionsMu.RLock()
+        if c, ok := vfdConnections[old.IP]; ok {
+            c.mu.Lock()
+            c.handler.Close()
+            c.mu.Unlock()
+        }
+        vfdConnectionsMu.RUnlock()
+    }
+    detail := fmt.Sprintf("%s -> %s (group %s fan %d)", old.IP, repl.IP, old.Group, old.FanNumber)
+    log.Printf("[SWAP] %s, force=%v: %s", detail, req.Force, rl)
+    recordControlEvent(ControlEvent{
+        Timestamp: time.Now(),
+        Action:    "DriveSwap",
+        Drives:    []DriveEventInfo{{ID: old.ID, IP: old.IP, Success: true}, {IP: repl.IP, Success: passed}},
+        Detail:    detail,
+    })
+    resp["swapped"] = true
+    json.NewEncoder(w).Encode(resp)
+}
+
+// =====================
+// Drive Profile API
+// =====================
+
+// Names a profile can give to DoubleWord, FieldWordOrder, FieldRegisterType and FieldAddressBase
+var profileRegisterFields = []string{"Setpoint", "Control", "Status", "EnabledStatus", "OutputFrequency", "OutputCurrent", "OutputPower", "FaultCode", "EnergyCounter", "UnTripRegister", "EnterRegister", "ProbeRegister", "StartCoil", "StopCoil", "UnTripCoil", "StatusCoils"}
+
+// parseProfileJSON decodes a profile strictly (unknown fields are rejected, which
+// catches misspelled keys) and validates it
+func parseProfileJSON(data []byte) (DriveTypeProfile, []string) {
+    var p DriveTypeProfile
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&p); err != nil {
+        return p, []string{err.Error()}
+    }
+    return p, validateProfile(p)
+}
+
+// validateProfile checks a profile's structure: required registers, enumerated values,
+// field names, bit numbers and expressions
+func validateProfile(p DriveTypeProfile) []string {
+    var problems []string
+    add := func(format string, args ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, args...))
+    }
+    oneOf := func(field, v string, allowed ...string) {
+        if v == "" {
+            return
+        }
+        for _, a := range allowed {
+            if v == a {
+                return
+            }
+        }
+        add("%s: %q is not one of %s", field, v, strings.Join(allowed, ", "))
+    }
+
+    if len(p.Setpoint) == 0 || len(p.Setpoint) > 2 {
+        add("Setpoint: expected 1 or 2 registers, got %d", len(p.Setpoint))
+    }
+    if _, ok := p.StatusBits["Enabled"]; !ok && p.EnabledStatus == 0 && len(p.StatusCoils) == 0 {
+        add("StatusBits: an \"Enabled\" bit, EnabledStatus or StatusCoils is required")
+    }
+    if id := p.Identify; id != nil {
+        if id.VendorName == "" && id.ProductCode == "" && id.ModelName == "" && id.Register == nil {
+            add("Identify: needs VendorName, ProductCode, ModelName or Register")
+        }
+        if id.Register != nil && len(id.Values) == 0 {
+            add("Identify: Register %d has no Values to match", *id.Register)
+        }
+    }
+    oneOf("RegisterType", p.RegisterType, "holding", "input")
+    oneOf("WordOrder", p.WordOrder, "big", "little")
+    oneOf("CoilStatusType", p.CoilStatusType, "coil", "discrete")
+
+    known := make(map[string]bool)
+    for _, f := range profileRegisterFields {
+        known[f] = true
+    }
+    extraNames := make(map[string]bool)
+    for i, er := range p.ExtraRegisters {
+        switch {
+        case er.Name == "" || !isCalcNameChar(er.Name[0], true) || strings.IndexFunc(er.Name, func(c rune) bool { return c > 127 || !isCalcNameChar(byte(c), false) }) >= 0:
+            add("ExtraRegisters[%d]: Name %q must be a letter followed by letters, digits or _", i, er.Name)
+        case extraNames[er.Name] || known[er.Name]:
+            add("ExtraRegisters[%d]: duplicate name %q", i, er.Name)
+        }
+        for _, f := range calcFieldVars {
+            if er.Name == f {
+                add("ExtraRegisters[%d]: name %q is reserved for expressions", i, er.Name)
+            }
+        }
+        oneOf(fmt.Sprintf("ExtraRegisters[%d].Type", i), er.Type, "holding", "input")
+        extraNames[er.Name] = true
+    }
+    isField := func(name string) bool { return known[name] || extraNames[name] }
+    for _, f := range p.DoubleWord {
+        if !isField(f) {
+            add("DoubleWord: unknown field %q", f)
+        }
+    }
+    for f, v := range p.FieldWordOrder {
+        if !isField(f) {
+            add("FieldWordOrder: unknown field %q", f)
+        }
+        oneOf("FieldWordOrder."+f, v, "big", "little")
+    }
+    for f, v := range p.FieldRegisterType {
+        if !isField(f) {
+            add("FieldRegisterType: unknown field %q", f)
+        }
+        oneOf("FieldRegisterType."+f, v, "holding", "input")
+    }
+    for f := range p.FieldAddressBase {
+        if !isField(f) {
+            add("FieldAddressBase: unknown field %q", f)
+        }
+    }
+
+    maxBit := 15
+    if p.isDoubleWord("Status") || len(p.StatusCoils) > 0 {
+        maxBit = 31
+    }
+    for name, bit := range p.StatusBits {
+        if bit < 0 || bit > maxBit {
+            add("StatusBits.%s: bit %d is outside 0-%d", name, bit, maxBit)
+        }
+    }
+    for _, name := range p.InvertedStatusBits {
+        _, inBits := p.StatusBits[name]
+        _, inCoils := p.StatusCoils[name]
+        if !inBits && !inCoils {
+            add("InvertedStatusBits: %q is not in StatusBits or StatusCoils", name)
+        }
+    }
 
-    // Validate action
-    if curtailData.Action != "curtail" && curtailData.Action != "resume" {
-        http.Error(w, "Invalid action, must be 'curtail' or 'resume'", http.StatusBadRequest)
-        return
+    for field, expr := range p.profileExprs() {
+        for _, problem := range p.calcProblems(field, parseFreqCalc(expr)) {
+            add("%s %q: %s", field, expr, problem)
+        }
     }
+    sort.Strings(problems)
+    return problems
+}
 
-    log.Printf("[CURTAIL] Received %s request for groups: %v", curtailData.Action, curtailData.Groups)
+// drivesUsingProfile lists the configured drives of a drive type
+func drivesUsingProfile(name string) []string {
+    var ips []string
+    for _, d := range configuredDrives() {
+        if d.DriveType == name {
+            ips = append(ips, d.IP)
+        }
+    }
+    return ips
+}
 
-    var response map[string]interface{}
+// storeProfile writes one profile (nil = delete) to the profiles file and applies it to the
+// running server; drives pick it up on their next poll or command. The profile is stored
+// as submitted, so other profiles keep their authored layout apart from key order.
+func storeProfile(filePath, name string, p *DriveTypeProfile, raw []byte) error {
+    profilesMu.Lock()
+    defer profilesMu.Unlock()
 
-    if curtailData.Action == "curtail" {
-        err = curtailDrives(curtailData.Groups)
-        if err != nil {
-            log.Printf("[CURTAIL] Error: %v", err)
-            http.Error(w, err.Error(), http.StatusInternalServerError)
-            return
+    current, err := os.ReadFile(filePath)
+    if err != nil {
+        return err
+    }
+    all := make(map[string]json.RawMessage)
+    if err := json.Unmarshal(current, &all); err != nil {
+        return fmt.Errorf("%s: %w", filePath, err)
+    }
+    if p == nil {
+        delete(all, name)
+    } else {
+        var compact bytes.Buffer
+        if err := json.Compact(&compact, raw); err != nil {
+            return err
         }
+        all[name] = compact.Bytes()
+    }
+    data, err := json.MarshalIndent(all, "", "    ")
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(filePath+".bak", current, 0644); err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, filePath); err != nil {
+        return err
+    }
 
-        drives := getDrivesForGroups(curtailData.Groups)
-        response = map[string]interface{}{
-            "success":    true,
-            "message":    fmt.Sprintf("Curtailment applied to %d drives", len(drives)),
-            "driveCount": len(drives),
-            "groups":     curtailData.Groups,
-            "timestamp":  time.Now().Format(time.RFC3339),
-        }
+    if p == nil {
+        delete(driveTypeProfiles, name)
+    } else {
+        driveTypeProfiles[name] = *p
+        cacheProfileCalcs(*p)
+    }
+    return nil
+}
 
-        // Log control event
-        event := ControlEvent{
-            Timestamp: time.Now(),
-            Action:    "Curtail",
-            Speed:     0,
-            Drives:    make([]DriveEventInfo, 0),
+// handleProfiles serves GET /api/profiles (all profiles) and /api/profiles/<name>:
+// GET, POST (create), PUT (replace) and DELETE (refused while drives use it)
+func handleProfiles(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/profiles"), "/")
+    if name == "" {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+            return
         }
-        for _, drive := range drives {
-            event.Drives = append(event.Drives, DriveEventInfo{
-                IP:      drive.IP,
-                Success: true,
-            })
+        profilesMu.RLock()
+        all := make(map[string]DriveTypeProfile, len(driveTypeProfiles))
+        for n, p := range driveTypeProfiles {
+            all[n] = p
         }
-        recordControlEvent(event)
+        profilesMu.RUnlock()
+        json.NewEncoder(w).Encode(all)
+        return
+    }
 
-    } else { // resume
-        // Load state BEFORE resuming (resume clears the file)
-        state, err := loadCurtailmentState()
-        if err != nil {
-            log.Printf("[RESUME] Error loading state: %v", err)
-            http.Error(w, err.Error(), http.StatusInternalServerError)
+    existing, exists := profileFor(name)
+    if r.Method == http.MethodGet {
+        if !exists {
+            http.Error(w, "Unknown profile: "+name, http.StatusNotFound)
             return
         }
+        json.NewEncoder(w).Encode(existing)
+        return
+    }
+    if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    users := drivesUsingProfile(name)
+    if !authorize(w, r, "Profiles", users) {
+        return
+    }
 
-        driveCount := len(state.Drives)
-        groups := state.Groups
-
-        // Now resume the drives
-        err = resumeDrives()
-        if err != nil {
-            log.Printf("[RESUME] Error: %v", err)
-            http.Error(w, err.Error(), http.StatusInternalServerError)
+    if r.Method == http.MethodDelete {
+        if !exists {
+            http.Error(w, "Unknown profile: "+name, http.StatusNotFound)
             return
         }
-
-        response = map[string]interface{}{
-            "success":    true,
-            "message":    fmt.Sprintf("Resumed %d drives from curtailment", driveCount),
-            "driveCount": driveCount,
-            "groups":     groups,
-            "timestamp":  time.Now().Format(time.RFC3339),
-        }
-
-        // Log control event
-        event := ControlEvent{
-            Timestamp: time.Now(),
-            Action:    "Resume",
-            Speed:     0,
-            Drives:    make([]DriveEventInfo, 0),
+        if len(users) > 0 {
+            w.WriteHeader(http.StatusConflict)
+            json.NewEncoder(w).Encode(map[string]interface{}{"error": "profile is in use", "drives": users})
+            return
         }
-        for _, drive := range state.Drives {
-            event.Drives = append(event.Drives, DriveEventInfo{
-                IP:      drive.IP,
-                Success: true,
-            })
+        if err := storeProfile(driveProfilesFilePath, name, nil, nil); err != nil {
+            http.Error(w, "Failed to save profiles: "+err.Error(), http.StatusInternalServerError)
+            return
         }
-        recordControlEvent(event)
+        log.Printf("[PROFILE] Deleted %s", name)
+        recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "ProfileDelete", Drives: []DriveEventInfo{}, Detail: name})
+        json.NewEncoder(w).Encode(map[string]interface{}{"deleted": name})
+        return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(response)
-    go pollAllDrives()
-}
-
-func handleAppConfig(w http.ResponseWriter, r *http.Request) {
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "siteName":   appConfig.SiteName,
-        "groupLabel": appConfig.GroupLabel,
-        "bindIP": appConfig.BindIP,
-        "bindPort": appConfig.BindPort,
-        "noFanHold": appConfig.NoFanHold,
-    })
-}
-
-// HTTP handler to toggle a drive's enabled/disabled state by IP
-func handleVFDConnect(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+    if r.Method == http.MethodPost && exists {
+        http.Error(w, "Profile already exists: "+name+" (use PUT to replace it)", http.StatusConflict)
         return
     }
-    var req struct {
-        IP     string   `json:"ip"`
-        IPs    []string `json:"ips"`
-        Action string   `json:"action"` // "connect", "disconnect", or empty for toggle
+    if r.Method == http.MethodPut && !exists {
+        http.Error(w, "Unknown profile: "+name+" (use POST to create it)", http.StatusNotFound)
+        return
     }
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Failed to parse request body: "+err.Error(), http.StatusBadRequest)
+    body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+    if err != nil {
+        http.Error(w, "Failed to read request body: "+err.Error(), http.StatusBadRequest)
         return
     }
-    // Determine list of IPs to operate on (bulk or single)
-    targets := make([]string, 0)
-    if len(req.IPs) > 0 {
-        targets = append(targets, req.IPs...)
-    } else if req.IP != "" {
-        targets = append(targets, req.IP)
-    } else {
-        http.Error(w, "Missing 'ip' or 'ips' in request", http.StatusBadRequest)
+    profile, problems := parseProfileJSON(body)
+    if len(problems) > 0 {
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid profile", "problems": problems})
+        return
+    }
+    if err := storeProfile(driveProfilesFilePath, name, &profile, body); err != nil {
+        http.Error(w, "Failed to save profiles: "+err.Error(), http.StatusInternalServerError)
         return
     }
 
-    // Normalize action for logging and behavior
-    normalized := strings.ToLower(strings.TrimSpace(req.Action))
-    var logAction string
-    switch normalized {
-    case "connect":
-        logAction = "ConnectVFD"
-    case "disconnect":
-        logAction = "DisconnectVFD"
-    default:
-        logAction = "ToggleVFD"
+    action := "ProfileCreate"
+    status := http.StatusCreated
+    if exists {
+        action, status = "ProfileUpdate", http.StatusOK
+    }
+    log.Printf("[PROFILE] %s %s (in use by %d drives)", action, name, len(users))
+    event := ControlEvent{Timestamp: time.Now(), Action: action, Drives: make([]DriveEventInfo, 0, len(users)), Detail: name}
+    for _, ip := range users {
+        event.Drives = append(event.Drives, DriveEventInfo{IP: ip, Success: true})
     }
+    recordControlEvent(event)
 
-    // Execute
-    drives := make([]DriveEventInfo, 0, len(targets))
-    for _, ip := range targets {
-        // Apply requested state or toggle
-        var disable bool
-        switch normalized {
-        case "connect":
-            disable = false
-        case "disconnect":
-            disable = true
-        default: // toggle
-            disable = !isDriveDisabled(ip)
-        }
-        setDriveDisabled(ip, disable)
-        if !disable {
-            // Restart the connection manager for this drive (no-op if still running)
-            if d, ok := ipToDrive[ip]; ok {
-                ensureDriveManager(d)
-            }
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "name":     name,
+        "profile":  profile,
+        "drives":   users,
+        "warnings": lintProfile(name, profile, 60),
+    })
+}
+
+// =====================
+// Feature Flags
+// =====================
+// Feature flags let one binary roll out behavior changes site by site. Each flag is declared
+// in featureFlagDefs with its default; a site's config.json FeatureFlags and then runtime
+// overrides from /api/admin/flags (persisted in feature_flags.json) take precedence. Code
+// checks featureEnabled(name); clients read the enabled set from /api/app-config.
+const featureFlagsFilePath = "/etc/vfd/feature_flags.json"
+
+type FeatureFlagDef struct {
+    Name        string
+    Description string
+    Default     bool
+}
+
+// featureFlagDefs lists the flags this version understands
+var featureFlagDefs = []FeatureFlagDef{
+    {Name: "devices-raw-view", Description: "/api/devices?raw=1 returns raw register values and scaling expressions", Default: true},
+}
+
+// FeatureFlag is a flag's state as reported by /api/admin/flags
+type FeatureFlag struct {
+    Name        string `json:"name"`
+    Description string `json:"description,omitempty"`
+    Default     bool   `json:"default"`
+    Config      *bool  `json:"config,omitempty"`   // config.json FeatureFlags
+    Override    *bool  `json:"override,omitempty"` // set through /api/admin/flags
+    Enabled     bool   `json:"enabled"`
+    Known       bool   `json:"known"` // false: named in config or overrides but not understood by this version
+}
+
+var (
+    featureFlagsMu sync.RWMutex
+    configFlags    = make(map[string]bool)
+    flagOverrides  = make(map[string]bool)
+)
+
+func featureFlagDef(name string) (FeatureFlagDef, bool) {
+    for _, def := range featureFlagDefs {
+        if def.Name == name {
+            return def, true
         }
-        drives = append(drives, DriveEventInfo{IP: ip, Success: true})
     }
+    return FeatureFlagDef{}, false
+}
 
-    // Persist disabled drives and schedule poll once
-    saveDisabledDrives()
-    go pollAllDrives()
+// featureEnabled reports whether a flag is on: override, else config, else default.
+// Unknown flags are off.
+func featureEnabled(name string) bool {
+    def, known := featureFlagDef(name)
+    if !known {
+        return false
+    }
+    featureFlagsMu.RLock()
+    defer featureFlagsMu.RUnlock()
+    if v, ok := flagOverrides[name]; ok {
+        return v
+    }
+    if v, ok := configFlags[name]; ok {
+        return v
+    }
+    return def.Default
+}
 
-    // Log a single aggregated event
-    recordControlEvent(ControlEvent{
-        Timestamp: time.Now(),
-        Action:    logAction,
-        Drives:    drives,
-    })
+func setConfigFlags(flags map[string]bool) {
+    for name := range flags {
+        if _, ok := featureFlagDef(name); !ok {
+            log.Printf("[FLAGS] config.json FeatureFlags: %q is not a flag in this version, ignored", name)
+        }
+    }
+    featureFlagsMu.Lock()
+    defer featureFlagsMu.Unlock()
+    configFlags = make(map[string]bool, len(flags))
+    for name, v := range flags {
+        configFlags[name] = v
+    }
+}
 
-    // Response
-    if len(targets) == 1 {
-        if logAction == "ConnectVFD" { w.Write([]byte("Drive enabled")) } else if logAction == "DisconnectVFD" { w.Write([]byte("Drive disabled")) } else { w.Write([]byte("Drive toggled")) }
-    } else {
-        w.Write([]byte(fmt.Sprintf("Bulk %s applied to %d drives", logAction, len(targets))))
+// featureFlags reports every known flag plus any unknown ones named in config or overrides
+func featureFlags() []FeatureFlag {
+    featureFlagsMu.RLock()
+    defer featureFlagsMu.RUnlock()
+    names := make(map[string]bool)
+    for name := range configFlags {
+        names[name] = true
+    }
+    for name := range flagOverrides {
+        names[name] = true
+    }
+    for _, def := range featureFlagDefs {
+        names[def.Name] = true
+    }
+    out := make([]FeatureFlag, 0, len(names))
+    for name := range names {
+        def, known := featureFlagDef(name)
+        f := FeatureFlag{Name: name, Description: def.Description, Default: def.Default, Known: known, Enabled: def.Default}
+        if v, ok := configFlags[name]; ok {
+            f.Config = &v
+            f.Enabled = v
+        }
+        if v, ok := flagOverrides[name]; ok {
+            f.Override = &v
+            f.Enabled = v
+        }
+        f.Enabled = f.Enabled && known
+        out = append(out, f)
     }
+    sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+    return out
 }
 
-// =====================
-// System Status API
-// =====================
-func handleSystemStatus(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    
-    statusMutex.RLock()
-    vfdConnectionsMu.RLock()
-    vfdDataMutex.RLock()
-    
-    // Calculate current system status
-    totalVFDs := len(appConfig.VFDs)
-    connectedVFDs := 0
-    healthyVFDs := 0
-    
-    for _, vfd := range appConfig.VFDs {
-        if conn, exists := vfdConnections[vfd.IP]; exists {
-            if conn.healthy.Load() {
-                connectedVFDs++
-                healthyVFDs++
-            }
+// enabledFeatureFlags lists the names of the flags that are on, for clients
+func enabledFeatureFlags() []string {
+    names := []string{}
+    for _, f := range featureFlags() {
+        if f.Enabled {
+            names = append(names, f.Name)
         }
     }
-    
-    // Update system status
-    status := systemStatus
-    status.TotalVFDs = totalVFDs
-    status.ConnectedVFDs = connectedVFDs
-    status.HealthyVFDs = healthyVFDs
-    
-	// Consider system ready if initial connections are done and we have some VFD data
-	status.Ready = status.InitialConnectionsDone && len(vfdData) > 0
-	status.Loading = !status.Ready
-	
-	// Calculate data collection age properly
-	if !status.LastUpdateTime.IsZero() {
-		status.DataCollectionAge = time.Since(status.LastUpdateTime)
-	} else {
-		status.DataCollectionAge = 0
-	}
-	
-	vfdDataMutex.RUnlock()
-	vfdConnectionsMu.RUnlock()
-	statusMutex.RUnlock()
-	
-	json.NewEncoder(w).Encode(status)
+    return names
+}
+
+func loadFeatureFlags(filePath string) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return
+    }
+    featureFlagsMu.Lock()
+    defer featureFlagsMu.Unlock()
+    if err := json.Unmarshal(data, &flagOverrides); err != nil {
+        log.Printf("[FLAGS] %s: %v", filePath, err)
+    }
 }
 
-// =====================
-// Devices API
-// =====================
-func handleDevices(w http.ResponseWriter, r *http.Request) {
+func saveFeatureFlags(filePath string) error {
+    featureFlagsMu.RLock()
+    data, err := json.MarshalIndent(flagOverrides, "", "    ")
+    featureFlagsMu.RUnlock()
+    if err != nil {
+        return err
+    }
+    tmp := filePath + ".tmp"
+    if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filePath)
+}
+
+// setFlagOverride sets (enabled != nil) or clears a runtime override and persists the overrides
+func setFlagOverride(filePath, name string, enabled *bool) error {
+    featureFlagsMu.Lock()
+    if enabled != nil {
+        flagOverrides[name] = *enabled
+    } else {
+        delete(flagOverrides, name)
+    }
+    featureFlagsMu.Unlock()
+    return saveFeatureFlags(filePath)
+}
+
+// handleFeatureFlags serves GET /api/admin/flags, and PUT {"enabled": bool} / DELETE (back
+// to the config or default) on /api/admin/flags/<name>
+func handleFeatureFlags(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
-    vfdDataMutex.RLock()
-    defer vfdDataMutex.RUnlock()
-    // vfdData is []map[string]interface{} with live data
-    // appConfig.VFDs is []DriveConfig with static config
-    // Merge config and live data by IP
-    drives := make([]map[string]interface{}, 0, len(vfdData))
-    for _, live := range vfdData {
-        drive := make(map[string]interface{})
-        ip, _ := live["ip"].(string)
-        if config, ok := ipToDrive[ip]; ok {
-            drive["DriveType"] = config.DriveType
+    name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/flags"), "/")
+    if name == "" {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+            return
         }
-        // Add live data
-        for k, v := range live {
-            drive[k] = v
+        json.NewEncoder(w).Encode(featureFlags())
+        return
+    }
+    if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    if _, ok := featureFlagDef(name); !ok {
+        http.Error(w, "Unknown feature flag: "+name, http.StatusNotFound)
+        return
+    }
+    if shadowMode() {
+        http.Error(w, "Shadow mode: this instance is read-only", http.StatusForbidden)
+        return
+    }
+    var enabled *bool
+    detail := name + " cleared"
+    if r.Method == http.MethodPut {
+        var req struct {
+            Enabled *bool `json:"enabled"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+            http.Error(w, `Request body must be {"enabled": true|false}`, http.StatusBadRequest)
+            return
+        }
+        enabled = req.Enabled
+        detail = fmt.Sprintf("%s=%v", name, *enabled)
+    }
+    if err := setFlagOverride(featureFlagsFilePath, name, enabled); err != nil {
+        http.Error(w, "Failed to save feature flags: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    log.Printf("[FLAGS] %s", detail)
+    recordControlEvent(ControlEvent{Timestamp: time.Now(), Action: "FeatureFlag", Drives: []DriveEventInfo{}, Detail: detail})
+    for _, f := range featureFlags() {
+        if f.Name == name {
+            json.NewEncoder(w).Encode(f)
         }
-        drives = append(drives, drive)
     }
-    json.NewEncoder(w).Encode(drives)
 }
 
 // =====================
-// Prometheus Metrics
+// WebSocket Clients
 // =====================
+
+// wsClient is one live /ws connection. Clients name themselves with ?client=<name>&version=<v>
+// (or X-VFD-Client / X-VFD-Client-Version headers) so that a display stuck in a reconnect
+// loop or falling behind can be picked out of the metrics.
+type wsClient struct {
+    id          int64
+    name        string
+    version     string
+    remoteAddr  string
+    connectedAt time.Time
+    messages    atomic.Int64
+    lastLag     atomic.Int64 // ns taken by the most recent write
+    maxLag      atomic.Int64
+    user        string              // operator presence; guarded by wsClientsMu
+    verified    bool
+    banners     chan PresenceBanner // nil unless connected with ?banners=1
+}
+
+// WSClientInfo is the /api/ws-clients view of a live connection
+type WSClientInfo struct {
+    ID           int64     `json:"id"`
+    Client       string    `json:"client"`
+    Version      string    `json:"version"`
+    RemoteAddr   string    `json:"remoteAddr"`
+    ConnectedAt  time.Time `json:"connectedAt"`
+    DurationSec  float64   `json:"durationSec"`
+    MessagesSent int64     `json:"messagesSent"`
+    LagMs        float64   `json:"lagMs"`
+    MaxLagMs     float64   `json:"maxLagMs"`
+}
+
+// WSClientHistory summarises all connections made under one client name since startup
+type WSClientHistory struct {
+    Connections     int64      `json:"connections"`
+    Active          int        `json:"active"`
+    LastConnect     time.Time  `json:"lastConnect"`
+    LastDisconnect  *time.Time `json:"lastDisconnect,omitempty"`
+    LastDurationSec float64    `json:"lastDurationSec,omitempty"`
+}
+
+const wsClientNameMax = 64
+
 var (
-    // Define metrics with VFD namespace
-    vfdstatus = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Namespace: "vfd",
-            Name:     "status",
-            Help:     "VFD operational status (1=running, 0=stopped)",
-        },
-        []string{"ip", "group", "fan_number"},
-    )
+    wsClientsMu   sync.Mutex
+    wsClients     = make(map[int64]*wsClient)
+    wsHistory     = make(map[string]*WSClientHistory) // client name -> history
+    wsNextID      int64
 
-    vfdspeedhz = prometheus.NewGaugeVec(
+    vfdWSClients = prometheus.NewGaugeVec(
         prometheus.GaugeOpts{
             Namespace: "vfd",
-            Name:     "speed_hz",
-            Help:     "Current VFD speed in Hertz",
+            Name:      "ws_clients",
+            Help:      "Open WebSocket connections per client",
         },
-        []string{"ip", "group", "fan_number"},
+        []string{"client", "version"},
     )
-
-    vfdspeedrpm = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
+    vfdWSConnections = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
             Namespace: "vfd",
-            Name:     "speed_rpm",
-            Help:     "Current VFD speed in RPM",
+            Name:      "ws_connections_total",
+            Help:      "WebSocket connections accepted per client",
         },
-        []string{"ip", "group", "fan_number"},
+        []string{"client", "version"},
     )
-
-    vfdspeedpercent = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
+    vfdWSMessages = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
             Namespace: "vfd",
-            Name:     "speed_percent",
-            Help:     "Current VFD speed in Percent",
+            Name:      "ws_messages_sent_total",
+            Help:      "WebSocket updates sent per client",
         },
-        []string{"ip", "group", "fan_number"},
-    )    
-
-        vfdamperage = prometheus.NewGaugeVec(
+        []string{"client", "version"},
+    )
+    vfdWSLag = prometheus.NewGaugeVec(
         prometheus.GaugeOpts{
             Namespace: "vfd",
-            Name:     "amperage",
-            Help:     "Current VFD amperage usage",
+            Name:      "ws_send_lag_seconds",
+            Help:      "Time the last update took to reach the client's socket (grows for slow or stalled clients)",
         },
-        []string{"ip", "group", "fan_number"},
+        []string{"client", "version"},
     )
-
-        vfdcfm = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
+    vfdWSDuration = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
             Namespace: "vfd",
-            Name:     "cfm",
-            Help:     "Current Fan CFM",
+            Name:      "ws_connection_duration_seconds",
+            Help:      "Lifetime of closed WebSocket connections per client",
+            Buckets:   []float64{5, 15, 60, 300, 900, 3600, 14400, 86400},
         },
-        []string{"ip", "group", "fan_number"},
+        []string{"client", "version"},
     )
+)
 
-        vfdup = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "up",
-            Help: "VFD connection status (1=connected, 0=disconnected)",
-        },
-        []string{"ip", "group", "fan_number"},
-    )
+func init() {
+    prometheus.MustRegister(vfdWSClients, vfdWSConnections, vfdWSMessages, vfdWSLag, vfdWSDuration)
+}
+
+// wsClientIdentity reads the client name and version from the query string or headers.
+// Names are limited to letters, digits, '.', '_' and '-' to keep metric labels sane.
+func wsClientIdentity(r *http.Request, allowAnonymous bool) (string, string, error) {
+    name := strings.TrimSpace(r.URL.Query().Get("client"))
+    if name == "" {
+        name = strings.TrimSpace(r.Header.Get("X-VFD-Client"))
+    }
+    version := strings.TrimSpace(r.URL.Query().Get("version"))
+    if version == "" {
+        version = strings.TrimSpace(r.Header.Get("X-VFD-Client-Version"))
+    }
+    if name == "" {
+        if !allowAnonymous {
+            return "", "", fmt.Errorf("client identification required: connect with ?client=<name>&version=<version>")
+        }
+        name = "anonymous"
+    }
+    for _, v := range []string{name, version} {
+        if len(v) > wsClientNameMax {
+            return "", "", fmt.Errorf("client name/version longer than %d characters", wsClientNameMax)
+        }
+        for _, c := range v {
+            if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+                return "", "", fmt.Errorf("invalid character %q in client name/version", c)
+            }
+        }
+    }
+    return name, version, nil
+}
+
+func registerWSClient(name, version, remoteAddr string) *wsClient {
+    wsClientsMu.Lock()
+    defer wsClientsMu.Unlock()
+    wsNextID++
+    c := &wsClient{id: wsNextID, name: name, version: version, remoteAddr: remoteAddr, connectedAt: time.Now()}
+    wsClients[c.id] = c
+    h := wsHistory[name]
+    if h == nil {
+        h = &WSClientHistory{}
+        wsHistory[name] = h
+    }
+    h.Connections++
+    h.Active++
+    h.LastConnect = c.connectedAt
+    vfdWSClients.WithLabelValues(name, version).Inc()
+    vfdWSConnections.WithLabelValues(name, version).Inc()
+    return c
+}
+
+func unregisterWSClient(c *wsClient) {
+    now := time.Now()
+    duration := now.Sub(c.connectedAt).Seconds()
+    wsClientsMu.Lock()
+    delete(wsClients, c.id)
+    if h := wsHistory[c.name]; h != nil {
+        h.Active--
+        h.LastDisconnect = &now
+        h.LastDurationSec = duration
+    }
+    wsClientsMu.Unlock()
+    vfdWSClients.WithLabelValues(c.name, c.version).Dec()
+    vfdWSDuration.WithLabelValues(c.name, c.version).Observe(duration)
+    log.Printf("WebSocket client %s %s (%s) disconnected after %.0fs, %d messages", c.name, c.version, c.remoteAddr, duration, c.messages.Load())
+}
+
+// send writes one update and records how long the write blocked
+func (c *wsClient) send(conn *websocket.Conn, data interface{}) error {
+    start := time.Now()
+    if err := conn.WriteJSON(data); err != nil {
+        return err
+    }
+    lag := time.Since(start)
+    c.messages.Add(1)
+    c.lastLag.Store(int64(lag))
+    if int64(lag) > c.maxLag.Load() {
+        c.maxLag.Store(int64(lag))
+    }
+    vfdWSMessages.WithLabelValues(c.name, c.version).Inc()
+    vfdWSLag.WithLabelValues(c.name, c.version).Set(lag.Seconds())
+    return nil
+}
+
+// handleWSClients lists open WebSocket connections and per-client connection history
+func handleWSClients(w http.ResponseWriter, r *http.Request) {
+    now := time.Now()
+    wsClientsMu.Lock()
+    active := make([]WSClientInfo, 0, len(wsClients))
+    for _, c := range wsClients {
+        active = append(active, WSClientInfo{
+            ID:           c.id,
+            Client:       c.name,
+            Version:      c.version,
+            RemoteAddr:   c.remoteAddr,
+            ConnectedAt:  c.connectedAt,
+            DurationSec:  now.Sub(c.connectedAt).Seconds(),
+            MessagesSent: c.messages.Load(),
+            LagMs:        float64(c.lastLag.Load()) / 1e6,
+            MaxLagMs:     float64(c.maxLag.Load()) / 1e6,
+        })
+    }
+    history := make(map[string]WSClientHistory, len(wsHistory))
+    for name, h := range wsHistory {
+        history[name] = *h
+    }
+    wsClientsMu.Unlock()
+    sort.Slice(active, func(i, j int) bool { return active[i].ID < active[j].ID })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "active":  active,
+        "clients": history,
+    })
+}
+
+// =====================
+// Operator Presence
+// =====================
+// Dashboards say who is looking at them by connecting to /ws as a user: with an API token
+// the token's name is used (verified), otherwise ?user=<name> or X-VFD-User (as given).
+// GET /api/presence lists the operators with dashboards open and the bulk actions in
+// progress. Connections made with ?banners=1 also receive banner messages, {"type":
+// "banner", ...} between the regular updates, when another operator starts or finishes a
+// control action on more than one drive or a curtailment, so two people don't work against
+// each other without knowing.
+const presenceBannerQueue = 8
+
+// PresenceBanner announces another operator's bulk action
+type PresenceBanner struct {
+    Type     string    `json:"type"` // always "banner"
+    ID       int64     `json:"id"`
+    Phase    string    `json:"phase"` // "started" or "finished"
+    Operator string    `json:"operator"`
+    Action   string    `json:"action"`
+    Groups   []string  `json:"groups"`
+    Drives   int       `json:"drives"`
+    Message  string    `json:"message"`
+    At       time.Time `json:"at"`
+}
+
+// OperatorPresence is one user with dashboards open
+type OperatorPresence struct {
+    User        string    `json:"user"`
+    Verified    bool      `json:"verified"` // identified by an API token
+    Connections int       `json:"connections"`
+    Clients     []string  `json:"clients"`
+    RemoteAddrs []string  `json:"remoteAddrs"`
+    Since       time.Time `json:"since"`
+}
 
+var (
+    presenceMu     sync.Mutex
+    activeBanners  = make(map[int64]PresenceBanner) // bulk actions in progress
+    bannerSeq      int64
 )
 
-func init() {
-    // Register metrics
-    prometheus.MustRegister(vfdstatus)
-    prometheus.MustRegister(vfdspeedhz)
-    prometheus.MustRegister(vfdspeedrpm)
-    prometheus.MustRegister(vfdspeedpercent)
-    prometheus.MustRegister(vfdamperage)
-    prometheus.MustRegister(vfdcfm)
-    prometheus.MustRegister(vfdup)
+// wsUser is who a /ws connection is for, "" if it didn't say
+func wsUser(r *http.Request) (string, bool, error) {
+    if who := requester(r); who != anonymousRequester {
+        return who, true, nil
+    }
+    user := strings.TrimSpace(r.URL.Query().Get("user"))
+    if user == "" {
+        user = strings.TrimSpace(r.Header.Get("X-VFD-User"))
+    }
+    if len(user) > wsClientNameMax {
+        return "", false, fmt.Errorf("user longer than %d characters", wsClientNameMax)
+    }
+    for _, c := range user {
+        if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-' || c == '@') {
+            return "", false, fmt.Errorf("invalid character %q in user", c)
+        }
+    }
+    return user, false, nil
 }
 
-// updateMetrics uses cached vfdData for Prometheus metrics
-func updateMetrics() {
-    ticker := time.NewTicker(15 * time.Second)
-    defer ticker.Stop()
+// joinPresence records the connection's user, and with banners gives it a banner queue
+func joinPresence(c *wsClient, user string, verified, banners bool) {
+    wsClientsMu.Lock()
+    defer wsClientsMu.Unlock()
+    c.user, c.verified = user, verified
+    if banners {
+        c.banners = make(chan PresenceBanner, presenceBannerQueue)
+    }
+}
 
-    for range ticker.C {
-        collectMetrics()
+// operatorName is who a request acts for: the user it names, its token, or its address
+func operatorName(r *http.Request, user string) string {
+    if user != "" {
+        return user
+    }
+    if who := requester(r); who != anonymousRequester {
+        return who
     }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
 }
 
-func collectMetrics() {
-    vfdDataMutex.RLock()
-    defer vfdDataMutex.RUnlock()
+// announce tells the other operators that operator is starting action on ips, and returns
+// the function to call with the outcome when it is done
+func announce(operator, action string, ips []string) func(outcome string) {
+    groups := []string{}
+    for _, ip := range ips {
+        if d, ok := driveConfig(ip); ok && !containsString(groups, d.Group) {
+            groups = append(groups, d.Group)
+        }
+    }
+    sort.Strings(groups)
+    presenceMu.Lock()
+    bannerSeq++
+    b := PresenceBanner{Type: "banner", ID: bannerSeq, Phase: "started", Operator: operator, Action: action, Groups: groups, Drives: len(ips), At: time.Now()}
+    b.Message = fmt.Sprintf("%s is executing %s on %s (%d drives)", operator, action, groupList(groups), len(ips))
+    activeBanners[b.ID] = b
+    presenceMu.Unlock()
+    broadcastBanner(b)
+    return func(outcome string) {
+        presenceMu.Lock()
+        delete(activeBanners, b.ID)
+        presenceMu.Unlock()
+        done := b
+        done.Phase, done.At = "finished", time.Now()
+        done.Message = fmt.Sprintf("%s finished %s on %s: %s", operator, action, groupList(groups), outcome)
+        broadcastBanner(done)
+    }
+}
 
-    for _, drive := range vfdData {
-        ip, _ := drive["ip"].(string)
-        group := fmt.Sprintf("%v", drive["group"])
-        fan := fmt.Sprintf("%v", drive["fanNumber"])
+func groupList(groups []string) string {
+    switch len(groups) {
+    case 0:
+        return "no configured drives"
+    case 1:
+        return "group " + groups[0]
+    }
+    return "groups " + strings.Join(groups, ", ")
+}
 
-        labels := prometheus.Labels{
-            "ip":         ip,
-            "group":      group,
-            "fan_number": fan,
+// broadcastBanner queues a banner for every connection that asked for banners, except
+// the operator's own. A connection whose queue is full misses it.
+func broadcastBanner(b PresenceBanner) {
+    wsClientsMu.Lock()
+    defer wsClientsMu.Unlock()
+    for _, c := range wsClients {
+        if c.banners == nil || c.user == b.Operator {
+            continue
         }
+        select {
+        case c.banners <- b:
+        default:
+        }
+    }
+}
 
-        status := 0.0
-        if drive["status"] == "Running" {
-            status = 1.0
+// eventOutcome summarises a control event for a finished banner
+func eventOutcome(event ControlEvent) string {
+    ok := 0
+    for _, d := range event.Drives {
+        if d.Success {
+            ok++
         }
+    }
+    return fmt.Sprintf("%d of %d drives succeeded", ok, len(event.Drives))
+}
 
-        // Set "up" metric based on VFD availability
-        up := 0.0
-        driveStatus := fmt.Sprintf("%v", drive["status"])
-        if driveStatus != "Unavailable" && driveStatus != "Disabled" {
-            up = 1.0
+// presence lists the operators with dashboards open, by user
+func presence() []OperatorPresence {
+    wsClientsMu.Lock()
+    byUser := make(map[string]*OperatorPresence)
+    for _, c := range wsClients {
+        if c.user == "" {
+            continue
+        }
+        p := byUser[c.user]
+        if p == nil {
+            p = &OperatorPresence{User: c.user, Since: c.connectedAt, Clients: []string{}, RemoteAddrs: []string{}}
+            byUser[c.user] = p
+        }
+        p.Verified = p.Verified || c.verified
+        p.Connections++
+        if !containsString(p.Clients, c.name) {
+            p.Clients = append(p.Clients, c.name)
         }
+        if host, _, err := net.SplitHostPort(c.remoteAddr); err == nil && !containsString(p.RemoteAddrs, host) {
+            p.RemoteAddrs = append(p.RemoteAddrs, host)
+        }
+        if c.connectedAt.Before(p.Since) {
+            p.Since = c.connectedAt
+        }
+    }
+    wsClientsMu.Unlock()
+    out := make([]OperatorPresence, 0, len(byUser))
+    for _, p := range byUser {
+        out = append(out, *p)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+    return out
+}
 
-        vfdstatus.With(labels).Set(status)
-        vfdup.With(labels).Set(up)
-        vfdspeedhz.With(labels).Set(safeFloat(drive["actualSpeed"]))
-        vfdspeedrpm.With(labels).Set(float64(safeInt(drive["rpmSpeed"])))
-        vfdspeedpercent.With(labels).Set(safeFloat(drive["actualPercent"]))
-        vfdcfm.With(labels).Set(float64(safeInt(drive["actualCfm"])))
-        vfdamperage.With(labels).Set(safeFloat(drive["current"]))
+// handlePresence serves GET /api/presence
+func handlePresence(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
     }
+    presenceMu.Lock()
+    activity := make([]PresenceBanner, 0, len(activeBanners))
+    for _, b := range activeBanners {
+        activity = append(activity, b)
+    }
+    presenceMu.Unlock()
+    sort.Slice(activity, func(i, j int) bool { return activity[i].ID < activity[j].ID })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"operators": presence(), "activity": activity})
 }
 
 // =====================
@@ -1659,6 +21719,19 @@ func collectMetrics() {
 func main() {
         var err error
 
+        if len(os.Args) > 1 && os.Args[1] == "generate" {
+                os.Exit(runGenerate(os.Args[2:]))
+        }
+        if len(os.Args) > 1 && os.Args[1] == "lint" {
+                os.Exit(runLint(os.Args[2:]))
+        }
+        if len(os.Args) > 1 && os.Args[1] == "drift" {
+                os.Exit(runDrift(os.Args[2:]))
+        }
+        if len(os.Args) > 1 && os.Args[1] == "ctl" {
+                os.Exit(runCtl(os.Args[2:], os.Stdout, os.Stderr))
+        }
+
         // Initialize system status
         statusMutex.Lock()
         systemStatus = SystemStatus{
@@ -1670,44 +21743,133 @@ func main() {
 
         // Load drive type profiles
         driveTypeProfiles = make(map[string]DriveTypeProfile)
-        if err := loadDriveTypeProfiles("/etc/vfd/drive_profiles.json"); err != nil {
+        if err := loadDriveTypeProfiles(driveProfilesFilePath); err != nil {
             log.Fatalf("Failed to load drive type profiles: %v", err)
         }
         buildFreqCalcCache()
 
         loadDisabledDrives()
+        loadTagouts(tagoutsFilePath)
+        loadHand(handFilePath)
         
-        file, err := os.Open("/etc/vfd/config.json")
+        appConfig, err = readAppConfig(configFilePath)
         if err != nil {
                 log.Fatal(err)
         }
-        defer file.Close()
-        decoder := json.NewDecoder(file)
-        if err := decoder.Decode(&appConfig); err != nil {
+        missingFields, err := readMissingProfileFields(driveProfilesFilePath)
+        if err != nil {
                 log.Fatal(err)
         }
+        var configIssues []ConfigIssue
+        var excludedDrives []string
+        appConfig, configIssues, excludedDrives, err = checkConfig(appConfig, driveTypeProfiles, missingFields)
+        if err != nil {
+                log.Fatal(err)
+        }
+        setConfigIssues(configIssues, excludedDrives)
+        loadDriveIDs(driveIDsFilePath)
+        applyDriveIDs(appConfig.VFDs)
 
         ipToDrive = make(map[string]*DriveConfig, len(appConfig.VFDs))
         for i := range appConfig.VFDs {
                 ipToDrive[appConfig.VFDs[i].IP] = &appConfig.VFDs[i]
         }
+        overridden, err := overrideProfiles(appConfig.VFDs, driveTypeProfiles)
+        if err != nil {
+                log.Fatal(err)
+        }
+        cacheOverrideCalcs(overridden)
+        setConfigFlags(appConfig.FeatureFlags)
+        loadFeatureFlags(featureFlagsFilePath)
+        setConfigSchedules(appConfig.Schedules, appConfig.VFDs)
+        loadSchedules(schedulesFilePath)
+        for _, problem := range lintConfig(appConfig, driveTypeProfiles) {
+                log.Printf("[LINT] %s", problem)
+        }
+        if err := validateFeatures(appConfig); err != nil {
+                log.Fatal(err)
+        }
+        groupLevels, err = buildGroupLevels(appConfig.GroupDependencies)
+        if err != nil {
+                log.Fatal(err)
+        }
+        for g := range groupLevels {
+                if len(getDrivesForGroups([]string{g})) == 0 {
+                        log.Printf("Warning: GroupDependencies references group %q, which has no drives", g)
+                }
+        }
 
         initializeVfdData()
+        initializeSensorData()
+        go runExternalSources(externalSources(appConfig))
+        if shadowMode() {
+                log.Printf("[SHADOW] Shadow mode: read-only, polling every %s, comparing against %s", shadowPollInterval(), appConfig.Shadow.PrimaryURL)
+        } else if !isFrontEnd() {
+                log.Printf("[SHARD] Shard %s: polling its own drives for front-end %s", appConfig.Sharding.Self, appConfig.Sharding.FrontEnd)
+                // Auto-reset lockouts and setpoint drift on its drives are reported from here
+                if err := initNotifications(); err != nil {
+                        log.Fatal(err)
+                }
+        } else {
+                initKafka()
+                initKNX()
+                initNATS()
+                if err := initNotifications(); err != nil {
+                        log.Fatal(err)
+                }
+                initAlerts()
+        }
 
         vfdConnections = make(map[string]*VFDConnection)
         // Load persisted control events from previous runs
         loadControlEvents(controlEventsFilePath)
+        loadDriveStats(driveStatsFilePath)
+        loadBaselines(baselinesFilePath)
+        loadEStop(estopFilePath)
+        loadPurge(purgeFilePath)
+        loadCommandQueue(commandQueueFilePath)
+        loadCurtailHistory(curtailHistoryFilePath)
+        if !shadowMode() {
+                go persistDriveStats()
+                if isFrontEnd() {
+                        go runScheduler()
+                        go runCurtailmentTimers()
+                        loadDemandResponse(drFilePath)
+                        go runDemandResponse()
+                }
+                loadRotation(rotationFilePath)
+                loadAutoReset(autoResetFilePath)
+                loadAirflowReservations(airflowReservationsFilePath)
+                loadPresets(presetsFilePath)
+                loadSoakCertificates(soakCertificatesFilePath)
+                go runConfigSync()
+                if isFrontEnd() {
+                        go runRotation()
+                        go runQuietHours()
+                        go runDCIM()
+                }
+                if interrupted := loadOperations(operationsFilePath); len(interrupted) > 0 {
+                        go recoverOperations(interrupted)
+                }
+        }
         for i := range appConfig.VFDs {
             ensureDriveManager(&appConfig.VFDs[i])
         }
+        go runShards()
+        go monitorHealth()
+        hup := make(chan os.Signal, 1)
+        signal.Notify(hup, syscall.SIGHUP)
+        go handleReloadSignal(hup)
 
         // Start polling VFDs every second in the background
         go func() {
-            ticker := time.NewTicker(1 * time.Second)
+            ticker := time.NewTicker(shadowPollInterval())
             defer ticker.Stop()
 
-            for range ticker.C {
+            for tick := range ticker.C {
+                start := time.Now()
                 pollAllDrives()
+                recordPollCycle(start.Sub(tick), time.Since(start))
                 
                 // Update data timestamp
                 statusMutex.Lock()
@@ -1727,20 +21889,131 @@ func main() {
         
         go updateMetrics()
 
-        http.HandleFunc("/", handleLivePage)
-        http.HandleFunc("/ws", handleWebSocket)
-        http.HandleFunc("/api/control", handleControl)
-        http.HandleFunc("/api/control-events", handleControlEvents)
-        http.HandleFunc("/api/curtail", handleCurtail)
-        http.HandleFunc("/api/app-config", handleAppConfig)
-        http.HandleFunc("/api/vfdconnect", handleVFDConnect)
-        http.HandleFunc("/api/devices", handleDevices)
-        http.HandleFunc("/api/status", handleSystemStatus)
-        http.Handle("/metrics", promhttp.Handler())
+        allowNets, err = parseAllowLists(appConfig.AllowLists)
+        if err != nil {
+                log.Fatal(err)
+        }
+        if err := checkAPITokens(appConfig.APITokens); err != nil {
+                log.Fatal(err)
+        }
+        apiTokens = appConfig.APITokens
+        if appConfig.EStopToken != "" && len(appConfig.EStopToken) < 16 {
+                log.Fatal("EStopToken must be at least 16 characters")
+        }
+
+        mux := http.NewServeMux()
+        handleFunc(mux, "/", handleLivePage)
+        handleFunc(mux, "/ws", handleWebSocket)
+        handleFunc(mux, "/api/control", handleControl)
+        handleFunc(mux, "/api/control-events", handleControlEvents)
+        handleFunc(mux, "/api/estop", handleEStop)
+        handleFunc(mux, "/api/purge", handlePurge)
+        handleFunc(mux, "/api/curtail", handleCurtail)
+        mux.Handle("/api/curtail/", withAllowList("/api/curtail", http.HandlerFunc(handleCurtail)))
+        mux.Handle("/api/curtail/history", withAllowList("/api/curtail", http.HandlerFunc(handleCurtailHistory)))
+        handleFunc(mux, "/api/dr", handleDemandResponse)
+        mux.Handle("/api/dr/", withAllowList("/api/dr", http.HandlerFunc(handleDemandResponse)))
+        handleFunc(mux, "/api/app-config", handleAppConfig)
+        handleFunc(mux, "/api/vfdconnect", handleVFDConnect)
+        handleFunc(mux, "/api/devices", handleDevices)
+        mux.Handle("/api/devices/", withAllowList("/api/devices", http.HandlerFunc(handleDeviceRoutes)))
+        mux.Handle("/api/history/", withAllowList("/api/history", http.HandlerFunc(handleHistoryRoutes)))
+        handleFunc(mux, "/api/status", handleSystemStatus)
+        handleFunc(mux, "/api/reports/reliability", handleReliabilityReport)
+        handleFunc(mux, "/api/command-queue", handleCommandQueue)
+        handleFunc(mux, "/api/shadow", handleShadow)
+        handleFunc(mux, "/api/shards", handleShards)
+        mux.Handle("/api/shards/", withAllowList("/api/shards", http.HandlerFunc(handleShards)))
+        handleFunc(mux, "/api/config-sync", handleConfigSync)
+        mux.Handle("/api/config-sync/", withAllowList("/api/config-sync", http.HandlerFunc(handleConfigSync)))
+        handleFunc(mux, "/api/ws-clients", handleWSClients)
+        handleFunc(mux, "/api/presence", handlePresence)
+        handleFunc(mux, "/api/profiles", handleProfiles)
+        mux.Handle("/api/profiles/", withAllowList("/api/profiles", http.HandlerFunc(handleProfiles)))
+        handleFunc(mux, "/api/admin/flags", handleFeatureFlags)
+        handleFunc(mux, "/api/admin/policies", handlePolicies)
+        mux.Handle("/api/admin/policies/", withAllowList("/api/admin/policies", http.HandlerFunc(handlePolicies)))
+        handleFunc(mux, "/api/drive-swap", handleDriveSwap)
+        handleFunc(mux, "/api/schedules", handleSchedules)
+        handleFunc(mux, "/api/sensors", handleSensors)
+        mux.Handle("/api/sensors/", withAllowList("/api/sensors", http.HandlerFunc(handleSensorRoutes)))
+        handleFunc(mux, "/api/external-sources", handleExternalSources)
+        handleFunc(mux, "/api/dcim", handleDCIM)
+        mux.Handle("/api/dcim/", withAllowList("/api/dcim", http.HandlerFunc(handleDCIM)))
+        handleFunc(mux, "/api/rotation", handleRotation)
+        handleFunc(mux, "/api/notifications", handleNotifications)
+        handleFunc(mux, "/api/maintenance", handleMaintenance)
+        handleFunc(mux, "/api/tagouts", handleTagouts)
+        handleFunc(mux, "/api/hand", handleHand)
+        handleFunc(mux, "/api/auto-reset", handleAutoReset)
+        handleFunc(mux, "/api/alerts", handleAlerts)
+        handleFunc(mux, "/api/airflow-reservations", handleAirflowReservations)
+        handleFunc(mux, "/api/quiet-hours", handleQuietHours)
+        handleFunc(mux, "/api/setpoint-watchdog", handleSetpointWatchdog)
+        handleFunc(mux, "/api/cfm-targets", handleCfmTargets)
+        handleFunc(mux, "/api/presets", handlePresets)
+        mux.Handle("/api/presets/", withAllowList("/api/presets", http.HandlerFunc(handlePresets)))
+        handleFunc(mux, "/api/soak", handleSoak)
+        mux.Handle("/api/soak/", withAllowList("/api/soak", http.HandlerFunc(handleSoak)))
+        mux.Handle("/api/quiet-hours/", withAllowList("/api/quiet-hours", http.HandlerFunc(handleQuietHours)))
+        mux.Handle("/api/airflow-reservations/", withAllowList("/api/airflow-reservations", http.HandlerFunc(handleAirflowReservations)))
+        mux.Handle("/api/alerts/", withAllowList("/api/alerts", http.HandlerFunc(handleAlerts)))
+        mux.Handle("/api/auto-reset/", withAllowList("/api/auto-reset", http.HandlerFunc(handleAutoReset)))
+        mux.Handle("/api/maintenance/", withAllowList("/api/maintenance", http.HandlerFunc(handleMaintenance)))
+        mux.Handle("/api/tagouts/", withAllowList("/api/tagouts", http.HandlerFunc(handleTagouts)))
+        mux.Handle("/api/hand/", withAllowList("/api/hand", http.HandlerFunc(handleHand)))
+        mux.Handle("/api/notifications/", withAllowList("/api/notifications", http.HandlerFunc(handleNotifications)))
+        mux.Handle("/api/rotation/", withAllowList("/api/rotation", http.HandlerFunc(handleRotation)))
+        mux.Handle("/api/schedules/", withAllowList("/api/schedules", http.HandlerFunc(handleSchedules)))
+        mux.Handle("/api/admin/flags/", withAllowList("/api/admin/flags", http.HandlerFunc(handleFeatureFlags)))
+        if appConfig.UnsafeChaos {
+                log.Println("[CHAOS] UnsafeChaos is enabled: /api/chaos can inject latency and dropped responses into drive connections")
+                handleFunc(mux, "/api/chaos", handleChaos)
+        }
+        handleFunc(mux, "/metrics", promhttp.Handler().ServeHTTP)
+        handleFunc(mux, "/api/prometheus/rules", handlePrometheusRules)
+        handleFunc(mux, "/api/mirror", handleMirror)
+
+        // Read-only listener for the dashboard VLAN: no control routes are registered on it
+        if appConfig.ReadOnlyBindPort != "" {
+            roMux := http.NewServeMux()
+            handleFunc(roMux, "/ws", handleWebSocket)
+            handleFunc(roMux, "/api/devices", handleDevices)
+            roMux.Handle("/api/devices/", withAllowList("/api/devices", readOnly(http.HandlerFunc(handleDeviceRoutes))))
+            handleFunc(roMux, "/metrics", promhttp.Handler().ServeHTTP)
+            handleFunc(roMux, "/api/prometheus/rules", handlePrometheusRules)
+            handleFunc(roMux, "/api/sensors", handleSensors)
+            handleFunc(roMux, "/api/presence", handlePresence)
+            roServer := &http.Server{
+                Addr:              appConfig.ReadOnlyBindIP + ":" + appConfig.ReadOnlyBindPort,
+                Handler:           roMux,
+                ReadHeaderTimeout: 10 * time.Second,
+            }
+            log.Printf("Read-only listener started on http://%s:%s", appConfig.ReadOnlyBindIP, appConfig.ReadOnlyBindPort)
+            go func() {
+                log.Fatal(roServer.ListenAndServe())
+            }()
+        }
+
+        // Mirror listener for third-party pollers: the mirror and nothing else
+        if mc := appConfig.Mirror; mc != nil && mc.BindPort != "" {
+            mirrorMux := http.NewServeMux()
+            handleFunc(mirrorMux, "/api/mirror", handleMirror)
+            mirrorServer := &http.Server{
+                Addr:              mc.BindIP + ":" + mc.BindPort,
+                Handler:           mirrorMux,
+                ReadHeaderTimeout: 10 * time.Second,
+            }
+            log.Printf("Mirror listener started on http://%s:%s", mc.BindIP, mc.BindPort)
+            go func() {
+                log.Fatal(mirrorServer.ListenAndServe())
+            }()
+        }
 
         log.Printf("VFD Control Server v%s by Louis Valois - for %s Site\nWeb server started on http://%s:%s", Version, appConfig.SiteName, appConfig.BindIP, appConfig.BindPort)
         server := &http.Server{
             Addr:              appConfig.BindIP + ":" + appConfig.BindPort,
+            Handler:           mux,
             ReadHeaderTimeout: 10 * time.Second, // drop half-open connections; WebSockets unaffected (hijacked)
         }
         log.Fatal(server.ListenAndServe())
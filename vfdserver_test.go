@@ -1,7 +1,29 @@
 package main
 
 import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+    "sync/atomic"
     "testing"
+    "time"
+
+    "github.com/grid-x/modbus"
+
+    "vfdserver/api/client"
 )
 
 // Expressions used by the real drive profiles, with exact expected conversions.
@@ -62,6 +84,10 @@ func TestStatusToString(t *testing.T) {
         {"P2 tripped wins over inhibited", 1<<1 | 1<<3, optidriveP2Bits, 0, "Tripped"},
         {"E3 running", 1 << 0, optidriveE3Bits, 0, "Running"},
 
+        // No Tripped bit (fault reported via FaultCode instead, e.g. Delta)
+        {"Delta operating", 1<<0 | 1<<1, map[string]int{"Enabled": 1}, 0, "Running"},
+        {"Delta decelerating", 1 << 0, map[string]int{"Enabled": 1}, 0, "Stopped"},
+
         // GS44020 special path (EnabledStatus register value > 0)
         {"GS4 enabled", 1 << 0, map[string]int{"Inhibited": 3}, 1, "Running"},
         {"GS4 inhibited", 1 << 3, map[string]int{"Inhibited": 3}, 1, "NotReady"},
@@ -145,3 +171,4610 @@ func TestMarkDriveOffline(t *testing.T) {
         t.Error("static fields must not be touched")
     }
 }
+
+func TestSourceAllowed(t *testing.T) {
+    nets, err := parseAllowLists(map[string][]string{
+        "/api/control": {"10.33.10.0/24", "192.168.1.5"},
+        "*":            {"10.0.0.0/8"},
+    })
+    if err != nil {
+        t.Fatalf("parseAllowLists: %v", err)
+    }
+
+    cases := []struct {
+        path, remote string
+        want         bool
+    }{
+        {"/api/control", "10.33.10.7:51234", true},
+        {"/api/control", "192.168.1.5:40000", true},
+        {"/api/control", "192.168.1.6:40000", false},
+        {"/api/control", "10.33.11.7:51234", false},
+        {"/api/devices", "10.99.0.1:1234", true},  // falls back to "*"
+        {"/api/devices", "172.16.0.1:1234", false},
+        {"/api/devices", "garbage", false},
+    }
+    for _, c := range cases {
+        if got := sourceAllowed(nets, c.path, c.remote); got != c.want {
+            t.Errorf("sourceAllowed(%q, %q) = %v, want %v", c.path, c.remote, got, c.want)
+        }
+    }
+
+    if !sourceAllowed(nil, "/api/control", "172.16.0.1:1234") {
+        t.Error("no allow-lists configured should allow everything")
+    }
+    if _, err := parseAllowLists(map[string][]string{"/": {"not-an-ip"}}); err == nil {
+        t.Error("invalid entry should fail to parse")
+    }
+}
+
+func TestAvroEncoding(t *testing.T) {
+    var buf bytes.Buffer
+    avroLong(&buf, 1)
+    avroLong(&buf, -1)
+    avroLong(&buf, 64)
+    avroString(&buf, "ab")
+    avroBool(&buf, true)
+    want := []byte{0x02, 0x01, 0x80, 0x01, 0x04, 'a', 'b', 0x01}
+    if !bytes.Equal(buf.Bytes(), want) {
+        t.Errorf("avro primitives = % x, want % x", buf.Bytes(), want)
+    }
+
+    framed := avroFrame(42, []byte{0xAA})
+    if !bytes.Equal(framed, []byte{0x00, 0x00, 0x00, 0x00, 0x2A, 0xAA}) {
+        t.Errorf("avroFrame(42) = % x", framed)
+    }
+    if got := avroFrame(0, []byte{0xAA}); !bytes.Equal(got, []byte{0xAA}) {
+        t.Errorf("avroFrame(0) should not add a header, got % x", got)
+    }
+
+    // Empty drive list still terminates the array
+    event := ControlEvent{Timestamp: time.UnixMilli(0), Action: "Stop"}
+    enc := encodeControlEventAvro("S", event)
+    if enc[len(enc)-1] != 0x00 {
+        t.Errorf("control event must end with array terminator, got % x", enc)
+    }
+}
+
+func TestKNXGroupAddressAndCEMI(t *testing.T) {
+    ga, err := parseGroupAddress("1/2/3")
+    if err != nil || ga != 1<<11|2<<8|3 {
+        t.Fatalf("parseGroupAddress(1/2/3) = %#x, %v", ga, err)
+    }
+    for _, bad := range []string{"32/0/0", "1/8/0", "1/0/256", "1/2", "x"} {
+        if _, err := parseGroupAddress(bad); err == nil {
+            t.Errorf("parseGroupAddress(%q) should fail", bad)
+        }
+    }
+
+    // A request frame re-labelled as an indication must parse back to the same write
+    for _, c := range []struct {
+        value byte
+        small bool
+    }{{1, true}, {0, true}, {200, false}} {
+        frame := cemiGroupWrite(ga, c.value, c.small)
+        frame[0] = cemiLDataInd
+        gotGA, data, ok := parseCEMIGroupWrite(frame)
+        if !ok || gotGA != ga || len(data) != 1 || data[0] != c.value {
+            t.Errorf("round trip value=%d small=%v: ga=%#x data=%v ok=%v", c.value, c.small, gotGA, data, ok)
+        }
+    }
+
+    fans, err := buildKNXMapping(&KNXConfig{MainGroup: 4}, []DriveConfig{{IP: "10.0.0.1", FanNumber: 7}})
+    if err != nil || fans[0].speed != 4<<11|2<<8|7 {
+        t.Errorf("default mapping speed GA = %#x, %v", fans[0].speed, err)
+    }
+    if _, err := buildKNXMapping(&KNXConfig{}, []DriveConfig{{IP: "a", FanNumber: 1}, {IP: "b", FanNumber: 1}}); err == nil {
+        t.Error("duplicate fan numbers should produce conflicting group addresses")
+    }
+}
+
+func TestDecodeRegister32(t *testing.T) {
+    // ACS580 01.06 output frequency 50.00 Hz in 32-bit mode (FbEq32 100 = 1 Hz)
+    if got := decodeRegister32([]byte{0x00, 0x00, 0x13, 0x88}, true, false); got != 5000 {
+        t.Errorf("positive = %v, want 5000", got)
+    }
+    if got := decodeRegister32([]byte{0xFF, 0xFF, 0xEC, 0x78}, true, false); got != -5000 {
+        t.Errorf("signed negative = %v, want -5000", got)
+    }
+    if got := decodeRegister32([]byte{0x00, 0x01, 0x00, 0x00}, false, false); got != 65536 {
+        t.Errorf("high word = %v, want 65536", got)
+    }
+
+    // Low word first (e.g. Modicon-style word swap)
+    if got := decodeRegister32([]byte{0x13, 0x88, 0x00, 0x01}, false, true); got != 70536 {
+        t.Errorf("low word first = %v, want 70536", got)
+    }
+    if got := decodeRegister32([]byte{0xEC, 0x78, 0xFF, 0xFF}, true, true); got != -5000 {
+        t.Errorf("low word first signed = %v, want -5000", got)
+    }
+    for _, little := range []bool{false, true} {
+        v := int32(-123456)
+        if got := decodeRegister32(encodeRegister32(uint32(v), little), true, little); got != float64(v) {
+            t.Errorf("round trip (little=%v) = %v, want %d", little, got, v)
+        }
+    }
+
+    p := DriveTypeProfile{DoubleWord: []string{"OutputFrequency"}}
+    if !p.isDoubleWord("OutputFrequency") || p.isDoubleWord("OutputCurrent") {
+        t.Error("isDoubleWord should only match declared fields")
+    }
+    p = DriveTypeProfile{WordOrder: "little", FieldWordOrder: map[string]string{"Setpoint": "big"}}
+    if !p.lowWordFirst("OutputFrequency") || p.lowWordFirst("Setpoint") {
+        t.Error("FieldWordOrder should override the profile WordOrder")
+    }
+}
+
+func TestCoalesceSetSpeed(t *testing.T) {
+    orig := appConfig
+    defer func() { appConfig = orig }()
+    appConfig = AppConfig{SetSpeedCoalesceMs: 30}
+
+    first := make(chan bool)
+    go func() { first <- coalesceSetSpeed("10.0.0.1") }()
+    time.Sleep(10 * time.Millisecond)
+    other := make(chan bool)
+    go func() { other <- coalesceSetSpeed("10.0.0.2") }() // different drive never supersedes
+    if coalesceSetSpeed("10.0.0.1") {
+        t.Error("latest request must not be superseded")
+    }
+    if !<-first {
+        t.Error("earlier request within the window should be superseded")
+    }
+    if <-other {
+        t.Error("request to another drive should not be superseded")
+    }
+
+    // Off unless configured: no hold at all
+    for _, ms := range []int{0, -1} {
+        appConfig.SetSpeedCoalesceMs = ms
+        start := time.Now()
+        if coalesceSetSpeed("10.0.0.1") || time.Since(start) > 5*time.Millisecond {
+            t.Errorf("SetSpeedCoalesceMs %d: superseded or held for %v", ms, time.Since(start))
+        }
+    }
+}
+
+func TestStatusInvertMask(t *testing.T) {
+    danfoss := DriveTypeProfile{
+        StatusBits:         map[string]int{"Enabled": 11, "Tripped": 3, "Inhibited": 9},
+        InvertedStatusBits: []string{"Inhibited", "Missing"},
+    }
+    mask := danfoss.statusInvertMask()
+    if mask != 1<<9 {
+        t.Fatalf("statusInvertMask = %#x, want %#x", mask, 1<<9)
+    }
+    cases := []struct {
+        raw  int
+        want string
+    }{
+        {1<<11 | 1<<9, "Running"},  // running under bus control
+        {1 << 9, "Stopped"},        // bus control, not running
+        {1 << 11, "NotReady"},      // local (keypad) control
+        {1<<3 | 1<<9, "Tripped"},
+    }
+    for _, c := range cases {
+        if got := statusToString(c.raw^mask, danfoss.StatusBits, 0); got != c.want {
+            t.Errorf("Danfoss status %#x = %q, want %q", c.raw, got, c.want)
+        }
+    }
+}
+
+// Sequences accept both the legacy bare-integer form and step objects.
+func TestControlStepUnmarshal(t *testing.T) {
+    var p DriveTypeProfile
+    err := json.Unmarshal([]byte(`{
+        "Control": 99,
+        "StartSequence": [1142, {"Value": 1151, "Register": 5, "WaitBit": 0, "DelayMs": 250}]
+    }`), &p)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(p.StartSequence) != 2 {
+        t.Fatalf("got %d steps, want 2", len(p.StartSequence))
+    }
+    first, second := p.StartSequence[0], p.StartSequence[1]
+    if first.Value != 1142 || first.Register != nil || first.WaitBit != nil {
+        t.Errorf("bare step = %+v", first)
+    }
+    if second.Value != 1151 || second.Register == nil || *second.Register != 5 ||
+        second.WaitBit == nil || *second.WaitBit != 0 || second.DelayMs != 250 {
+        t.Errorf("object step = %+v", second)
+    }
+    if err := json.Unmarshal([]byte(`["x"]`), &p.StartSequence); err == nil {
+        t.Error("expected error for non-numeric step")
+    }
+}
+
+// The shipped profile file must parse, and DriveCom drives must walk the full
+// shutdown → switch on → enable operation sequence.
+func TestShippedProfiles(t *testing.T) {
+    if err := loadDriveTypeProfiles("drive_profiles.json"); err != nil {
+        t.Fatal(err)
+    }
+    for _, name := range []string{"AltivarATV320", "AltivarATV630"} {
+        p, ok := driveTypeProfiles[name]
+        if !ok {
+            t.Fatalf("profile %s missing", name)
+        }
+        var values []int
+        for _, step := range p.StartSequence {
+            values = append(values, step.Value)
+            if step.WaitBit == nil {
+                t.Errorf("%s: start step %d has no WaitBit", name, step.Value)
+            }
+        }
+        if len(values) != 3 || values[0] != 0x06 || values[1] != 0x07 || values[2] != 0x0F {
+            t.Errorf("%s: StartSequence = %v, want [6 7 15]", name, values)
+        }
+    }
+
+    // Eaton DG1: speed reference is a percentage (0-10000) of the 0-60 Hz span
+    dg1 := driveTypeProfiles["EatonDG1"]
+    if got := applyFreqCalc(45, dg1.SetFreqCalc); got != 7500 {
+        t.Errorf("EatonDG1 45 Hz reference = %v, want 7500", got)
+    }
+
+    // Delta fault codes decode; unlisted codes still say which code tripped the drive
+    ms300 := driveTypeProfiles["DeltaMS300"]
+    if got := ms300.faultText(15); got != "OrP: Input phase loss" {
+        t.Errorf("DeltaMS300 fault 15 = %q", got)
+    }
+    if got := ms300.faultText(99); got != "Fault 99" {
+        t.Errorf("DeltaMS300 fault 99 = %q", got)
+    }
+    if got := ms300.faultText(0); got != "" {
+        t.Errorf("no fault = %q, want empty", got)
+    }
+}
+
+func TestWriteLimiterReserve(t *testing.T) {
+    now := time.Unix(1000, 0)
+    l := &writeLimiter{cooldown: time.Second, budget: 3, maxWait: 1500 * time.Millisecond}
+
+    if wait, err := l.reserve(now); err != nil || wait != 0 {
+        t.Fatalf("first write: wait=%v err=%v", wait, err)
+    }
+    if wait, err := l.reserve(now); err != nil || wait != time.Second {
+        t.Fatalf("second write should queue 1s behind the first: wait=%v err=%v", wait, err)
+    }
+    if _, err := l.reserve(now); err == nil {
+        t.Fatal("third write would queue 2s > maxWait and should be rejected")
+    }
+
+    later := now.Add(10 * time.Second)
+    if _, err := l.reserve(later); err != nil {
+        t.Fatalf("third write after cooldown: %v", err)
+    }
+    if _, err := l.reserve(later.Add(5 * time.Second)); err == nil {
+        t.Fatal("fourth write within the minute should exceed the budget of 3")
+    }
+    if _, err := l.reserve(now.Add(61 * time.Second)); err != nil {
+        t.Fatalf("budget should free up after a minute: %v", err)
+    }
+}
+
+func TestStopExemptFromWriteLimit(t *testing.T) {
+    savedConfig, savedIPs, savedProfiles, savedConns := appConfig, ipToDrive, driveTypeProfiles, vfdConnections
+    writeLimitersMu.Lock()
+    savedLimiters := writeLimiters
+    writeLimiters = make(map[string]*writeLimiter)
+    writeLimitersMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive, driveTypeProfiles, vfdConnections = savedConfig, savedIPs, savedProfiles, savedConns
+        writeLimitersMu.Lock()
+        writeLimiters = savedLimiters
+        writeLimitersMu.Unlock()
+    }()
+    profile := DriveTypeProfile{Control: 5, StartValue: 1, StopValue: 0, Setpoint: []int{1}, SetFreqCalc: "* 10"}
+    driveTypeProfiles = map[string]DriveTypeProfile{"Plain": profile}
+    appConfig = AppConfig{VFDs: []DriveConfig{{ID: "f1", IP: "10.0.0.1", DriveType: "Plain", WriteCooldownMs: 60000, WriteBudgetPerMin: 1}}}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0]}
+    drive := &fakeWrites{}
+    conn := &VFDConnection{ip: "10.0.0.1", client: drive}
+    conn.healthy.Store(true)
+    vfdConnections = map[string]*VFDConnection{"10.0.0.1": conn}
+
+    // The SetSpeed uses up the budget and starts a minute-long cooldown
+    if err := writeSpeedReference(conn, profile, 40); err != nil {
+        t.Fatalf("set speed: %v", err)
+    }
+    start := time.Now()
+    for _, action := range []string{"Stop", "Freespin"} { // executeConcurrently sends both through fanStop
+        if err := fanStop("10.0.0.1"); err != nil {
+            t.Fatalf("%s with the budget used up: %v", action, err)
+        }
+    }
+    if time.Since(start) > time.Second {
+        t.Errorf("stops waited %s for the cooldown", time.Since(start))
+    }
+    if got := fmt.Sprint(drive.writes); got != "[1=400 5=0 5=0]" {
+        t.Errorf("writes = %s", got)
+    }
+    // Other writes are still limited
+    if err := writeSpeedReference(conn, profile, 30); err == nil {
+        t.Error("SetSpeed after the stops should still be rejected")
+    }
+
+    // A SetSpeed queued for the cooldown holds conn.mu; a Stop wakes it and goes first
+    appConfig.VFDs[0].WriteCooldownMs, appConfig.VFDs[0].WriteBudgetPerMin = 2000, -1
+    writeLimitersMu.Lock()
+    writeLimiters = make(map[string]*writeLimiter)
+    writeLimitersMu.Unlock()
+    drive.writes = nil
+    if err := writeSpeedStep("10.0.0.1", 35); err != nil {
+        t.Fatalf("set speed: %v", err)
+    }
+    queued := make(chan error, 1)
+    go func() { queued <- writeSpeedStep("10.0.0.1", 30) }()
+    time.Sleep(50 * time.Millisecond)
+    start = time.Now()
+    if err := fanStop("10.0.0.1"); err != nil {
+        t.Fatalf("stop behind a queued SetSpeed: %v", err)
+    }
+    if time.Since(start) > 500*time.Millisecond {
+        t.Errorf("stop waited %s behind the queued SetSpeed", time.Since(start))
+    }
+    if err := <-queued; !errors.Is(err, errWriteStopped) {
+        t.Errorf("queued SetSpeed: %v", err)
+    }
+    if got := fmt.Sprint(drive.writes); got != "[1=350 5=0]" {
+        t.Errorf("writes = %s", got)
+    }
+}
+
+func TestAccumulateDriveStats(t *testing.T) {
+    var st DriveStats
+    steps := []struct {
+        prev, status string
+        powerKW      float64
+        elapsed      time.Duration
+    }{
+        {"", "Running", 10, time.Second},               // first observation after startup: not a start
+        {"Running", "Running", 10, time.Hour},          // 10 kWh
+        {"Running", "Tripped", 0, time.Second},         // trip
+        {"Tripped", "Tripped", 0, time.Second},         // still tripped, not a new trip
+        {"Tripped", "Running", 5, time.Second},         // reset + start
+        {"Running", "Stopped", 0, time.Second},
+        {"Stopped", "Running", 5, 0},                   // start
+        {"Running", "Unavailable", 0, 2 * time.Minute}, // 2 minutes unavailable
+        {"Unavailable", "Tripped", 0, time.Second},     // came back tripped: unknown when, not counted
+    }
+    for _, s := range steps {
+        accumulateDriveStats(&st, s.prev, s.status, s.powerKW, s.elapsed)
+    }
+    if st.Starts != 2 {
+        t.Errorf("Starts = %d, want 2", st.Starts)
+    }
+    if st.Trips != 1 {
+        t.Errorf("Trips = %d, want 1", st.Trips)
+    }
+    if st.UnavailableSeconds != 120 {
+        t.Errorf("UnavailableSeconds = %v, want 120", st.UnavailableSeconds)
+    }
+    if math.Abs(st.EnergyKWh-10.0042) > 0.001 {
+        t.Errorf("EnergyKWh = %v, want ~10.004", st.EnergyKWh)
+    }
+}
+
+func TestMeterEnergy(t *testing.T) {
+    last := 65000.0
+    for _, c := range []struct {
+        last          *float64
+        reading, want float64
+    }{
+        {nil, 120, 0},         // first reading is the baseline
+        {&last, 65010, 10},    // normal increase
+        {&last, 20, 556},      // wrapped at 65536
+        {&last, 40000, 40000}, // dropped without wrapping: reset, counted from zero
+    } {
+        if got := meterEnergyDelta(c.last, c.reading, 65536); got != c.want {
+            t.Errorf("meterEnergyDelta(%v) = %v, want %v", c.reading, got, c.want)
+        }
+    }
+    if r := energyRolloverKWh(DriveTypeProfile{EnergyCalc: "/ 10", DoubleWord: []string{"EnergyCounter"}}); r != 429496729.6 {
+        t.Errorf("32-bit rollover = %v", r)
+    }
+
+    savedCfg, savedIPs, savedProfiles := appConfig, ipToDrive, driveTypeProfiles
+    driveStatsMu.Lock()
+    savedStats, savedLast, savedTime := driveStats, statsLastStatus, statsLastTime
+    driveStats, statsLastStatus, statsLastTime = make(map[string]*DriveStats), make(map[string]string), time.Time{}
+    driveStatsMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive, driveTypeProfiles = savedCfg, savedIPs, savedProfiles
+        driveStatsMu.Lock()
+        driveStats, statsLastStatus, statsLastTime = savedStats, savedLast, savedTime
+        driveStatsMu.Unlock()
+    }()
+    driveTypeProfiles = map[string]DriveTypeProfile{"Metered": {EnergyCounter: 44}, "Plain": {}}
+    m := DriveConfig{ID: "m", IP: "10.0.0.1", DriveType: "Metered"}
+    e := DriveConfig{ID: "e", IP: "10.0.0.2", DriveType: "Plain"}
+    ipToDrive = map[string]*DriveConfig{m.IP: &m, e.IP: &e}
+    poll := func(meter interface{}) []map[string]interface{} {
+        metered := map[string]interface{}{"ip": m.IP, "id": "m", "status": "Running", "current": 50.0}
+        if meter != nil {
+            metered["energyMeter"] = meter
+        }
+        return []map[string]interface{}{metered, {"ip": e.IP, "id": "e", "status": "Running", "current": 50.0}}
+    }
+    now := time.Now()
+    updateDriveStats(poll(1000.0), now)
+    for i := 1; i <= 5; i++ {
+        updateDriveStats(poll(nil), now.Add(time.Duration(i)*time.Second)) // between counter reads
+    }
+    updateDriveStats(poll(1002.5), now.Add(6*time.Second))
+
+    driveStatsMu.Lock()
+    defer driveStatsMu.Unlock()
+    if st := driveStats["m"]; st.EnergyKWh != 2.5 || st.EnergySource != "meter" {
+        t.Errorf("metered drive: %v kWh from %q, want 2.5 from the counter", st.EnergyKWh, st.EnergySource)
+    }
+    if st := driveStats["e"]; st.EnergyKWh <= 0 || st.EnergySource != "estimate" {
+        t.Errorf("unmetered drive: %v kWh from %q", st.EnergyKWh, st.EnergySource)
+    }
+}
+
+func TestBuildReliabilityReport(t *testing.T) {
+    drives := []DriveConfig{
+        {ID: "a", IP: "10.0.0.1", Group: "1", DriveType: "OptidriveP2"},
+        {ID: "b", IP: "10.0.0.2", Group: "1", DriveType: "CFW500"},
+        {ID: "c", IP: "10.0.0.3", Group: "2", DriveType: "CFW500"},
+    }
+    stats := map[string]DriveStats{
+        "a": {RunSeconds: 1000 * 3600, Trips: 2, TrippedSeconds: 1200, Recoveries: 2},
+        "b": {RunSeconds: 500 * 3600},
+        "c": {RunSeconds: 500 * 3600, Trips: 1},
+    }
+    report := buildReliabilityReport(stats, drives)
+
+    fleet := report["fleet"].(*ReliabilityBucket)
+    if fleet.Drives != 3 || fleet.Trips != 3 || fleet.RunHours != 2000 {
+        t.Fatalf("fleet = %+v", fleet)
+    }
+    if *fleet.TripsPer1000RunHours != 1.5 || *fleet.MTBFHours != 666.67 || *fleet.MTTRMinutes != 10 {
+        t.Errorf("fleet rates = %v/%v/%v", *fleet.TripsPer1000RunHours, *fleet.MTBFHours, *fleet.MTTRMinutes)
+    }
+
+    byModel := report["byModel"].([]*ReliabilityBucket)
+    if len(byModel) != 2 || byModel[0].Key != "CFW500" || byModel[0].Drives != 2 {
+        t.Fatalf("byModel = %+v", byModel)
+    }
+    if byModel[0].MTTRMinutes != nil {
+        t.Error("MTTR should be null without recoveries")
+    }
+    if *byModel[0].MTBFHours != 1000 {
+        t.Errorf("CFW500 MTBF = %v, want 1000", *byModel[0].MTBFHours)
+    }
+}
+
+func TestGenerateSiteConfig(t *testing.T) {
+    cfg, err := generateSiteConfig(SiteDescriptor{
+        SiteName: "T1", Rows: 3, FansPerRow: 4, IPBase: "10.0.1.11", RowIPStride: 20,
+        DriveType: "OptidriveE3", RpmHz: 30,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(cfg.VFDs) != 12 {
+        t.Fatalf("got %d drives, want 12", len(cfg.VFDs))
+    }
+    last := cfg.VFDs[11]
+    if last.IP != "10.0.1.54" || last.Group != "3" || last.FanNumber != 12 || last.Port != 502 || last.Unit != 1 {
+        t.Errorf("last drive = %+v", last)
+    }
+
+    // Per-row overrides, contiguous addressing continuing from the previous row
+    cfg, err = generateSiteConfig(SiteDescriptor{
+        IPBase: "10.0.1.250", FansPerRow: 2, DriveType: "OptidriveP2",
+        RowDefs: []SiteRowDescriptor{{Group: "A"}, {Group: "B", Fans: 1, DriveType: "CFW500"}},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := cfg.VFDs[2]; got.IP != "10.0.1.252" || got.Group != "B" || got.DriveType != "CFW500" {
+        t.Errorf("override row drive = %+v", got)
+    }
+
+    bad := []SiteDescriptor{
+        {IPBase: "10.0.1.1", Rows: 2, FansPerRow: 5, RowIPStride: 3, DriveType: "X"},  // rows overlap
+        {IPBase: "10.0.1.250", Rows: 1, FansPerRow: 10, DriveType: "X"},               // runs into .255
+        {IPBase: "10.0.1.1", Rows: 1, FansPerRow: 2},                                  // no drive type
+        {IPBase: "10.0.1", Rows: 1, FansPerRow: 2, DriveType: "X"},                    // bad base
+    }
+    for i, d := range bad {
+        if _, err := generateSiteConfig(d); err == nil {
+            t.Errorf("case %d: expected error", i)
+        }
+    }
+}
+
+func TestCompareShadowSnapshot(t *testing.T) {
+    shadowState = make(map[string]map[string]*ShadowFieldState)
+    sc := ShadowConfig{FreqToleranceHz: 0.5, ConfirmCount: 2}
+    now := time.Unix(1000, 0)
+    primary := []map[string]interface{}{
+        {"ip": "10.0.0.1", "status": "Running", "actualSpeed": 45.0, "current": 10.0},
+        {"ip": "10.0.0.2", "status": "Unavailable", "actualSpeed": 0.0},
+    }
+    local := []map[string]interface{}{
+        {"ip": "10.0.0.1", "status": "Running", "actualSpeed": 45.3, "current": 12.0},
+        {"ip": "10.0.0.2", "status": "Stopped", "actualSpeed": 0.0},
+    }
+
+    if d := compareShadowSnapshot(local, primary, sc, now); len(d) != 0 {
+        t.Fatalf("first mismatch should not confirm divergence: %v", d)
+    }
+    d := compareShadowSnapshot(local, primary, sc, now)
+    if len(d) != 1 || d[0] != "10.0.0.1 current" {
+        t.Fatalf("divergence = %v, want [10.0.0.1 current]", d)
+    }
+    speed := shadowState["10.0.0.1"]["actualSpeed"]
+    if speed.Compared != 2 || speed.Mismatches != 0 {
+        t.Errorf("actualSpeed within tolerance: %+v", speed)
+    }
+    if _, ok := shadowState["10.0.0.2"]; ok {
+        t.Error("drive unreadable on the primary should be skipped")
+    }
+
+    local[0]["current"] = 10.2
+    compareShadowSnapshot(local, primary, sc, now)
+    if shadowState["10.0.0.1"]["current"].Divergent {
+        t.Error("divergence should clear once values agree")
+    }
+}
+
+func TestChaosInject(t *testing.T) {
+    c := chaosClient{ip: "10.0.0.9"}
+    now := time.Now()
+
+    if err := c.inject(context.Background()); err != nil {
+        t.Fatalf("no rule: %v", err)
+    }
+
+    chaosMu.Lock()
+    chaosRules[c.ip] = ChaosRule{LatencyMs: 30, Until: now.Add(time.Minute)}
+    chaosMu.Unlock()
+    start := time.Now()
+    if err := c.inject(context.Background()); err != nil {
+        t.Fatalf("latency rule: %v", err)
+    }
+    if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+        t.Errorf("latency not applied: %v", elapsed)
+    }
+
+    chaosMu.Lock()
+    chaosRules[c.ip] = ChaosRule{DropPercent: 100, Until: now.Add(time.Minute)}
+    chaosMu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    if err := c.inject(ctx); err == nil {
+        t.Error("expected dropped request to fail")
+    }
+
+    // Expired rules are removed and no longer injected
+    chaosMu.Lock()
+    chaosRules[c.ip] = ChaosRule{DropPercent: 100, Until: now.Add(-time.Second)}
+    chaosMu.Unlock()
+    if err := c.inject(context.Background()); err != nil {
+        t.Errorf("expired rule still injected: %v", err)
+    }
+    if _, ok := chaosRules[c.ip]; ok {
+        t.Error("expired rule not removed")
+    }
+}
+
+func TestCommandQueue(t *testing.T) {
+    commandQueue = make(map[string]QueuedCommand)
+    now := time.Unix(5000, 0)
+
+    enqueueCommand(QueuedCommand{ID: "a", IP: "10.0.0.1", Action: "Start", QueuedAt: now, ExpiresAt: now.Add(time.Hour)})
+    prev, replaced := enqueueCommand(QueuedCommand{ID: "b", IP: "10.0.0.1", Action: "SetSpeed", Speed: 40, QueuedAt: now, ExpiresAt: now.Add(time.Hour)})
+    if !replaced || prev.ID != "a" {
+        t.Fatalf("expected SetSpeed to replace Start, got replaced=%v prev=%+v", replaced, prev)
+    }
+    enqueueCommand(QueuedCommand{ID: "c", IP: "10.0.0.2", Action: "Stop", QueuedAt: now, ExpiresAt: now.Add(time.Minute)})
+    enqueueCommand(QueuedCommand{ID: "d", IP: "10.0.0.3", Action: "Stop", QueuedAt: now, ExpiresAt: now.Add(time.Hour)})
+
+    // Latest command per drive is executed once
+    cmd, ok := takeQueuedCommand("10.0.0.1", now.Add(time.Minute))
+    if !ok || cmd.Action != "SetSpeed" || cmd.Speed != 40 {
+        t.Fatalf("take = %+v, %v", cmd, ok)
+    }
+    if _, ok := takeQueuedCommand("10.0.0.1", now.Add(time.Minute)); ok {
+        t.Error("command executed twice")
+    }
+
+    // Expired commands are dropped, not executed
+    if _, ok := takeQueuedCommand("10.0.0.2", now.Add(2*time.Minute)); ok {
+        t.Error("expired command returned")
+    }
+
+    if got := cancelQueuedCommands(nil, []string{"10.0.0.3"}); len(got) != 1 || got[0].ID != "d" {
+        t.Errorf("cancel = %+v", got)
+    }
+    if len(commandQueue) != 0 {
+        t.Errorf("queue not empty: %+v", commandQueue)
+    }
+
+    enqueueCommand(QueuedCommand{ID: "e", IP: "10.0.0.4", Action: "Stop", ExpiresAt: now})
+    if expired := pruneCommandQueue(now.Add(time.Second)); len(expired) != 1 {
+        t.Errorf("prune = %+v", expired)
+    }
+}
+
+func TestGroupDependencyStages(t *testing.T) {
+    if _, err := buildGroupLevels(map[string][]string{"A": {"B"}, "B": {"A"}}); err == nil {
+        t.Fatal("expected cycle error")
+    }
+    levels, err := buildGroupLevels(map[string][]string{"Supply": {"Exhaust"}, "Makeup": {"Supply"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if levels["Exhaust"] != 0 || levels["Supply"] != 1 || levels["Makeup"] != 2 {
+        t.Fatalf("levels = %v", levels)
+    }
+
+    savedLevels, savedIPs := groupLevels, ipToDrive
+    defer func() { groupLevels, ipToDrive = savedLevels, savedIPs }()
+    groupLevels = levels
+    ipToDrive = map[string]*DriveConfig{
+        "10.0.0.1": {IP: "10.0.0.1", Group: "Supply"},
+        "10.0.0.2": {IP: "10.0.0.2", Group: "Exhaust"},
+        "10.0.0.3": {IP: "10.0.0.3", Group: "Makeup"},
+        "10.0.0.4": {IP: "10.0.0.4", Group: "Exhaust"},
+    }
+    ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+
+    start := controlStages("Start", ips)
+    if len(start) != 3 || len(start[0]) != 2 || start[1][0] != "10.0.0.1" || start[2][0] != "10.0.0.3" {
+        t.Errorf("start stages = %v", start)
+    }
+    stop := controlStages("Stop", ips)
+    if len(stop) != 3 || stop[0][0] != "10.0.0.3" || len(stop[2]) != 2 {
+        t.Errorf("stop stages = %v", stop)
+    }
+    // Transitive: Makeup still waits for Exhaust when Supply isn't part of the request
+    if got := controlStages("Start", []string{"10.0.0.3", "10.0.0.2"}); len(got) != 2 || got[0][0] != "10.0.0.2" {
+        t.Errorf("transitive stages = %v", got)
+    }
+    if got := controlStages("UnknownAction", ips); len(got) != 1 {
+        t.Errorf("unordered action split into %d stages", len(got))
+    }
+
+    statuses := map[string]string{"10.0.0.2": "Running", "10.0.0.4": "Stopped"}
+    if stageReached("Start", statuses, []string{"10.0.0.2", "10.0.0.4"}) {
+        t.Error("start stage verified with a stopped drive")
+    }
+    if !stageReached("Stop", statuses, []string{"10.0.0.4"}) {
+        t.Error("stop stage not verified")
+    }
+}
+
+func TestCheckSpeedLimits(t *testing.T) {
+    d := &DriveConfig{SoftMaxHz: 50, HardMaxHz: 58}
+    if w, err := checkSpeedLimits(d, 45, false); w != "" || err != nil {
+        t.Errorf("within limits: %q, %v", w, err)
+    }
+    if _, err := checkSpeedLimits(d, 52, false); err == nil {
+        t.Error("soft limit exceeded without acknowledge should fail")
+    }
+    if w, err := checkSpeedLimits(d, 52, true); err != nil || w == "" {
+        t.Errorf("acknowledged soft override: %q, %v", w, err)
+    }
+    if _, err := checkSpeedLimits(d, 59, true); err == nil {
+        t.Error("hard limit must not be exceeded even when acknowledged")
+    }
+    if w, err := checkSpeedLimits(&DriveConfig{}, 60, false); w != "" || err != nil {
+        t.Errorf("no limits configured: %q, %v", w, err)
+    }
+
+    // The minimum comes from the drive, else its profile, and is absolute
+    savedConfig, savedProfiles := appConfig, driveTypeProfiles
+    defer func() { appConfig, driveTypeProfiles = savedConfig, savedProfiles }()
+    driveTypeProfiles = map[string]DriveTypeProfile{"Slow": {MinHz: 30}}
+    profiled := &DriveConfig{DriveType: "Slow", HardMaxHz: 58}
+    if _, err := checkSpeedLimits(profiled, 25, true); err == nil {
+        t.Error("profile MinHz not enforced")
+    }
+    if _, err := checkSpeedLimits(&DriveConfig{DriveType: "Slow", MinHz: 20}, 25, false); err != nil {
+        t.Errorf("drive MinHz should override the profile's: %v", err)
+    }
+    if !speedOutOfRange(profiled, 25) || !speedOutOfRange(profiled, 59) || speedOutOfRange(profiled, 52) {
+        t.Error("speedOutOfRange")
+    }
+    if speed, w := clampSpeed(profiled, 25); speed != 25 || w != "" {
+        t.Errorf("clamped without ClampSpeedLimits: %v %q", speed, w)
+    }
+    appConfig.ClampSpeedLimits = true
+    for in, want := range map[float64]float64{25: 30, 59: 58, 45: 45} {
+        if speed, w := clampSpeed(profiled, in); speed != want || (w == "") != (in == want) {
+            t.Errorf("clampSpeed(%v) = %v, %q; want %v", in, speed, w, want)
+        }
+    }
+}
+
+// fakeCoils serves FC01/FC02 reads from a coil map, recording which function was used
+type fakeCoils struct {
+    modbus.Client
+    coils map[uint16]bool
+    fc    byte
+}
+
+func (f *fakeCoils) read(fc byte, address uint16) ([]byte, error) {
+    f.fc = fc
+    if f.coils[address] {
+        return []byte{1}, nil
+    }
+    return []byte{0}, nil
+}
+
+func (f *fakeCoils) ReadCoils(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    return f.read(1, address)
+}
+
+func (f *fakeCoils) ReadDiscreteInputs(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    return f.read(2, address)
+}
+
+func TestReadStatusCoils(t *testing.T) {
+    profile := DriveTypeProfile{
+        StatusCoils:        map[string]int{"Enabled": 10, "Tripped": 11, "Inhibited": 12},
+        InvertedStatusBits: []string{"Inhibited"}, // coil 12 is "ready"
+    }
+    cases := []struct {
+        coils map[uint16]bool
+        want  string
+    }{
+        {map[uint16]bool{10: true, 12: true}, "Running"},
+        {map[uint16]bool{12: true}, "Stopped"},
+        {map[uint16]bool{11: true}, "Tripped"},
+        {map[uint16]bool{10: true}, "NotReady"},
+    }
+    for _, c := range cases {
+        client := &fakeCoils{coils: c.coils}
+        status, bits, err := readStatusCoils(context.Background(), client, profile)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := statusToString(status^profile.invertMaskFor(bits), bits, 0); got != c.want {
+            t.Errorf("coils %v = %q, want %q", c.coils, got, c.want)
+        }
+        if client.fc != 1 {
+            t.Errorf("status coils read with FC%02d, want FC01", client.fc)
+        }
+    }
+
+    profile.CoilStatusType = "discrete"
+    client := &fakeCoils{}
+    if _, _, err := readStatusCoils(context.Background(), client, profile); err != nil || client.fc != 2 {
+        t.Errorf("discrete inputs: fc=%d err=%v", client.fc, err)
+    }
+}
+
+// fakeRegisters serves single-register reads from a value map (missing = exception),
+// recording the function and address of the last read
+type fakeRegisters struct {
+    modbus.Client
+    values   map[uint16]uint16 // nil = every address reads 0
+    identity map[byte][]byte   // FC 0x2B objects; nil = not supported
+    fc       byte
+    addr     uint16
+}
+
+func (f *fakeRegisters) ReadDeviceIdentification(ctx context.Context, code modbus.ReadDeviceIDCode) (map[byte][]byte, error) {
+    if f.identity == nil {
+        return nil, fmt.Errorf("illegal function")
+    }
+    return f.identity, nil
+}
+
+func (f *fakeRegisters) read(fc byte, address, quantity uint16) ([]byte, error) {
+    f.fc, f.addr = fc, address
+    res := make([]byte, 2*quantity)
+    if f.values != nil {
+        v, ok := f.values[address]
+        if !ok {
+            return nil, fmt.Errorf("illegal data address %d", address)
+        }
+        binary.BigEndian.PutUint16(res, v)
+    }
+    return res, nil
+}
+
+func (f *fakeRegisters) ReadHoldingRegisters(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    return f.read(3, address, quantity)
+}
+
+func (f *fakeRegisters) ReadInputRegisters(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    return f.read(4, address, quantity)
+}
+
+func TestProfileRegisterAddressing(t *testing.T) {
+    profile := DriveTypeProfile{
+        RegisterType:      "input",
+        AddressBase:       30001,
+        FieldRegisterType: map[string]string{"Setpoint": "holding"},
+        FieldAddressBase:  map[string]int{"Setpoint": 40001, "Status": 1},
+    }
+    cases := []struct {
+        field    string
+        reg      int
+        wantFC   byte
+        wantAddr uint16
+    }{
+        {"OutputFrequency", 30004, 4, 3},
+        {"Setpoint", 40002, 3, 1},
+        {"Status", 1, 4, 0},
+    }
+    for _, c := range cases {
+        client := &fakeRegisters{}
+        if _, err := readProfileRegister(context.Background(), client, profile, c.field, c.reg, true, false); err != nil {
+            t.Fatal(err)
+        }
+        if client.fc != c.wantFC || client.addr != c.wantAddr {
+            t.Errorf("%s: got FC%02d addr %d, want FC%02d addr %d", c.field, client.fc, client.addr, c.wantFC, c.wantAddr)
+        }
+    }
+    if got := (DriveTypeProfile{}).wireAddr("Control", 8192); got != 8192 {
+        t.Errorf("default base: got %d, want 8192", got)
+    }
+}
+
+func TestWSClientIdentity(t *testing.T) {
+    cases := []struct {
+        url       string
+        header    string
+        anonymous bool
+        wantName  string
+        wantErr   bool
+    }{
+        {"/ws?client=wall-display-3&version=1.4.2", "", false, "wall-display-3", false},
+        {"/ws", "scada-bridge", false, "scada-bridge", false},
+        {"/ws", "", false, "", true},
+        {"/ws", "", true, "anonymous", false},
+        {"/ws?client=bad%20name", "", false, "", true},
+    }
+    for _, c := range cases {
+        r := httptest.NewRequest("GET", c.url, nil)
+        if c.header != "" {
+            r.Header.Set("X-VFD-Client", c.header)
+        }
+        name, _, err := wsClientIdentity(r, c.anonymous)
+        if (err != nil) != c.wantErr || name != c.wantName {
+            t.Errorf("%s (header %q): got %q, %v", c.url, c.header, name, err)
+        }
+    }
+
+    c1 := registerWSClient("test-display", "1.0", "10.0.0.9:5000")
+    unregisterWSClient(c1)
+    c2 := registerWSClient("test-display", "1.0", "10.0.0.9:5001")
+    defer unregisterWSClient(c2)
+    wsClientsMu.Lock()
+    h := *wsHistory["test-display"]
+    wsClientsMu.Unlock()
+    if h.Connections != 2 || h.Active != 1 || h.LastDisconnect == nil {
+        t.Errorf("history: %+v", h)
+    }
+}
+
+func TestPresence(t *testing.T) {
+    r := httptest.NewRequest("GET", "/ws?user=alice", nil)
+    if user, verified, err := wsUser(r); user != "alice" || verified || err != nil {
+        t.Errorf("query user: %q %v %v", user, verified, err)
+    }
+    r = r.WithContext(context.WithValue(r.Context(), requesterKey{}, "ops-console"))
+    if user, verified, _ := wsUser(r); user != "ops-console" || !verified {
+        t.Errorf("token user: %q %v", user, verified)
+    }
+    if _, _, err := wsUser(httptest.NewRequest("GET", "/ws?user=a%20b", nil)); err == nil {
+        t.Error("accepted a user with a space")
+    }
+
+    savedIPs := ipToDrive
+    defer func() { ipToDrive = savedIPs }()
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": {IP: "10.0.0.1", Group: "B"}, "10.0.0.2": {IP: "10.0.0.2", Group: "B"}}
+    alice := registerWSClient("test-dash", "1.0", "10.0.0.9:5000")
+    defer unregisterWSClient(alice)
+    joinPresence(alice, "alice", false, true)
+    bob := registerWSClient("test-dash", "1.0", "10.0.0.8:5000")
+    defer unregisterWSClient(bob)
+    joinPresence(bob, "bob", true, true)
+    quiet := registerWSClient("test-dash", "1.0", "10.0.0.7:5000")
+    defer unregisterWSClient(quiet)
+    joinPresence(quiet, "carol", false, false)
+
+    finished := announce("bob", "Stop", []string{"10.0.0.1", "10.0.0.2"})
+    select {
+    case b := <-alice.banners:
+        if b.Phase != "started" || b.Message != "bob is executing Stop on group B (2 drives)" {
+            t.Errorf("started banner: %+v", b)
+        }
+    default:
+        t.Error("no banner for alice")
+    }
+    if len(bob.banners) != 0 {
+        t.Error("bob was told about his own action")
+    }
+    rec := httptest.NewRecorder()
+    handlePresence(rec, httptest.NewRequest("GET", "/api/presence", nil))
+    var resp struct {
+        Operators []OperatorPresence
+        Activity  []PresenceBanner
+    }
+    json.NewDecoder(rec.Body).Decode(&resp)
+    var users []string
+    for _, p := range resp.Operators {
+        if p.Clients[0] == "test-dash" {
+            users = append(users, fmt.Sprintf("%s/%v", p.User, p.Verified))
+        }
+    }
+    if fmt.Sprint(users) != "[alice/false bob/true carol/false]" || len(resp.Activity) != 1 || resp.Activity[0].Operator != "bob" {
+        t.Errorf("presence: %v %+v", users, resp.Activity)
+    }
+
+    finished("2 of 2 drives succeeded")
+    if b := <-alice.banners; b.Phase != "finished" || !strings.HasSuffix(b.Message, ": 2 of 2 drives succeeded") {
+        t.Errorf("finished banner: %+v", b)
+    }
+    presenceMu.Lock()
+    defer presenceMu.Unlock()
+    if len(activeBanners) != 0 {
+        t.Errorf("activity left over: %+v", activeBanners)
+    }
+}
+
+func TestDemandResponse(t *testing.T) {
+    drives := []DriveConfig{{IP: "10.0.0.1", Group: "A"}, {IP: "10.0.0.2", Group: "B"}}
+    for _, bad := range []DemandResponseConfig{
+        {},
+        {Tiers: []DRTier{{Name: "t1"}}},
+        {Tiers: []DRTier{{Groups: []string{"Z"}}}},
+        {Tiers: []DRTier{{Groups: []string{"A"}, TargetHz: 30, Percent: 50}}},
+        {Tiers: []DRTier{{Groups: []string{"A"}}}, MeterSignal: "meter"},
+    } {
+        if validateDemandResponse(&bad, drives) == nil {
+            t.Errorf("accepted %+v", bad)
+        }
+    }
+    c := &DemandResponseConfig{Tiers: []DRTier{{Name: "trim", Groups: []string{"A"}, Percent: 70}, {Name: "shed", Groups: []string{"A", "B"}}}}
+    if err := validateDemandResponse(c, drives); err != nil {
+        t.Fatal(err)
+    }
+
+    savedConfig, savedIPs := appConfig, ipToDrive
+    vfdDataMutex.Lock()
+    savedData := vfdData
+    vfdData = []map[string]interface{}{{"ip": "10.0.0.1", "power": 50.0}, {"ip": "10.0.0.2", "power": 30.0}}
+    vfdDataMutex.Unlock()
+    drMu.Lock()
+    savedActive, savedReports := drActive, drReports
+    drMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive = savedConfig, savedIPs
+        vfdDataMutex.Lock()
+        vfdData = savedData
+        vfdDataMutex.Unlock()
+        drMu.Lock()
+        drActive, drReports = savedActive, savedReports
+        drMu.Unlock()
+    }()
+    appConfig = AppConfig{VFDs: drives, DemandResponse: c}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0], "10.0.0.2": &appConfig.VFDs[1]}
+    if kw, source, ok := sitePower(c); kw != 80 || source != "drives" || !ok {
+        t.Errorf("site power: %v %s %v", kw, source, ok)
+    }
+
+    // 100 kW at the start, 30 kW to shed within 10 minutes; the first tier is in
+    start := time.Now()
+    ev := &DREvent{ID: "ev1", ReceivedAt: start, Deadline: start.Add(10 * time.Minute), BaselineKW: 100, RequiredKW: 30, Result: "pending",
+        Tiers: []DRTierRecord{{Tier: 1, Name: "trim", AppliedAt: start}}}
+    drMu.Lock()
+    drActive, drReports = ev, nil
+    drMu.Unlock()
+    checkDemandResponse(c, start.Add(30*time.Second)) // 20 kW shed, still settling
+    if len(ev.Tiers) != 1 || ev.Result != "pending" || len(ev.Samples) != 1 || ev.Samples[0].ReductionKW != 20 {
+        t.Fatalf("settling: %+v", ev)
+    }
+    checkDemandResponse(c, start.Add(61*time.Second))
+    if len(ev.Tiers) != 2 || ev.Tiers[1].Name != "shed" || !strings.HasPrefix(ev.Tiers[1].Reason, "20.0 of 30.0 kW shed 1m1s after the last tier") {
+        t.Fatalf("escalation: %+v", ev.Tiers)
+    }
+    vfdDataMutex.Lock()
+    vfdData[1]["power"] = 10.0
+    vfdDataMutex.Unlock()
+    checkDemandResponse(c, start.Add(90*time.Second))
+    if ev.Result != "compliant" || ev.MetAt == nil || *ev.ShedSec != 90 {
+        t.Errorf("met: %+v", ev)
+    }
+    report, _ := endDemandResponse("ended by test", start.Add(time.Hour))
+    if report == nil || report.Result != "compliant" || drInProgress() {
+        t.Errorf("end: %+v", report)
+    }
+
+    // Nothing left to escalate to, and the deadline passes short of the target
+    vfdDataMutex.Lock()
+    vfdData[1]["power"] = 40.0
+    vfdDataMutex.Unlock()
+    ev2 := &DREvent{ID: "ev2", ReceivedAt: start, Deadline: start.Add(time.Minute), BaselineKW: 100, RequiredKW: 30, Result: "pending",
+        Tiers: []DRTierRecord{{Tier: 1, AppliedAt: start}, {Tier: 2, AppliedAt: start}}}
+    drMu.Lock()
+    drActive = ev2
+    drMu.Unlock()
+    checkDemandResponse(c, start.Add(2*time.Minute))
+    if ev2.Result != "missed" || len(ev2.Tiers) != 2 {
+        t.Errorf("missed: %+v", ev2)
+    }
+    endDemandResponse("ended by test", start.Add(time.Hour))
+
+    rec := httptest.NewRecorder()
+    handleDemandResponse(rec, httptest.NewRequest(http.MethodGet, "/api/dr/reports", nil))
+    var reports []DREvent
+    json.NewDecoder(rec.Body).Decode(&reports)
+    if len(reports) != 2 || reports[0].ID != "ev2" || reports[1].Samples != nil {
+        t.Errorf("reports: %+v", reports)
+    }
+    rec = httptest.NewRecorder()
+    handleDemandResponse(rec, httptest.NewRequest(http.MethodGet, "/api/dr/reports/ev1", nil))
+    var full DREvent
+    json.NewDecoder(rec.Body).Decode(&full)
+    if full.ID != "ev1" || len(full.Samples) != 3 {
+        t.Errorf("report: %+v", full)
+    }
+    rec = httptest.NewRecorder()
+    handleDemandResponse(rec, httptest.NewRequest(http.MethodPost, "/api/dr", strings.NewReader(`{"action": "start", "reductionKW": 10, "reductionPercent": 5}`)))
+    if rec.Code != http.StatusBadRequest {
+        t.Errorf("kW and percent: %d", rec.Code)
+    }
+    for _, id := range []string{"history", "a/b"} {
+        rec = httptest.NewRecorder()
+        handleDemandResponse(rec, httptest.NewRequest(http.MethodPost, "/api/dr", strings.NewReader(`{"action": "start", "id": "`+id+`", "reductionKW": 10}`)))
+        if rec.Code != http.StatusBadRequest {
+            t.Errorf("id %s: %d", id, rec.Code)
+        }
+    }
+}
+
+func TestScalingExpressions(t *testing.T) {
+    vars := map[string]float64{"maxHz": 60, "outputCurrent": 150}
+    cases := []struct {
+        expr string
+        raw  float64
+        want float64
+    }{
+        {"(raw - 16384) / 16384 * maxHz", 24576, 30},
+        {"raw * 60 / 16384", 8192, 30},
+        {"2 + raw * 3", 4, 14},
+        {"-(raw - 10) / 2", 4, 3},
+        {"max(raw, 0) / 10", -50, 0},
+        {"abs(raw) * 1e-1", -500, 50},
+        {"round(raw / 3)", 10, 3},
+        {"outputCurrent / 10 * raw", 2, 30},
+        {"/ 60 * 8192", 30, 4096},
+        {"raw / 0", 7, 7},           // division by zero falls back to raw
+        {"raw * unknownVar", 7, 7},  // so does an unknown variable
+        {"(raw * 2", 7, 7},          // and a compile error
+    }
+    for _, c := range cases {
+        if got := applyCalc(c.expr, c.raw, vars); math.Abs(got-c.want) > 1e-9 {
+            t.Errorf("applyCalc(%q, %v) = %v, want %v", c.expr, c.raw, got, c.want)
+        }
+    }
+
+    for _, bad := range []string{"(raw * 2", "raw +", "sqrt(raw)", "min(raw)", "raw $ 2"} {
+        if parseFreqCalc(bad).err == nil {
+            t.Errorf("parseFreqCalc(%q): expected compile error", bad)
+        }
+    }
+
+    profile := DriveTypeProfile{Constants: map[string]float64{"maxHz": 50}}
+    if p := profile.calcProblems("OutFreqCalc", parseFreqCalc("raw / 16384 * maxHz + outputCurrent")); len(p) != 0 {
+        t.Errorf("unexpected problems: %v", p)
+    }
+    if p := profile.calcProblems("SetFreqCalc", parseFreqCalc("raw * outputCurrent / maxRpm")); len(p) != 2 {
+        t.Errorf("SetFreqCalc problems = %v, want outputCurrent and maxRpm flagged", p)
+    }
+}
+
+func TestExtraRegisters(t *testing.T) {
+    profile := DriveTypeProfile{
+        ExtraRegisters: []ExtraRegister{
+            {Name: "dcBusVoltage", Register: 30, Type: "input", Unit: "V"},
+            {Name: "heatsinkTemp", Register: 31, Signed: true, Calc: "/ 10", Unit: "C"},
+            {Name: "torque", Register: 99, Calc: "raw * 100 / ratedTorque", Unit: "%"},
+        },
+        Constants: map[string]float64{"ratedTorque": 200},
+    }
+    client := &fakeRegisters{values: map[uint16]uint16{30: 565, 31: 0xFFCE}} // -50 -> -5.0 C
+    raw := readExtraRegisters(context.Background(), client, profile, false, "10.0.0.1")
+    if _, ok := raw["torque"]; ok || len(raw) != 2 {
+        t.Fatalf("raw = %v, want dcBusVoltage and heatsinkTemp only (torque read fails)", raw)
+    }
+    raw["torque"] = 50
+    got := scaleExtraRegisters(profile, raw, profile.calcVars(raw))
+    want := map[string]float64{"dcBusVoltage": 565, "heatsinkTemp": -5, "torque": 25}
+    for name, v := range want {
+        if got[name] != v {
+            t.Errorf("%s = %v, want %v", name, got[name], v)
+        }
+    }
+    if p := profile.calcProblems("OutCurrentCalc", parseFreqCalc("raw * torque")); len(p) != 0 {
+        t.Errorf("extra register names should be valid variables: %v", p)
+    }
+    if u := profile.extraUnit("heatsinkTemp"); u != "C" {
+        t.Errorf("extraUnit = %q", u)
+    }
+}
+
+func TestOperationRecovery(t *testing.T) {
+    now := time.Now()
+    stages := [][]string{{"10.0.0.1"}, {"10.0.0.2"}}
+    cases := []struct {
+        op     Operation
+        resume bool
+    }{
+        {Operation{Action: "Stop", Stages: stages, Completed: 1, UpdatedAt: now.Add(-time.Minute)}, true},
+        {Operation{Action: "Stop", Stages: stages, Completed: 1, UpdatedAt: now.Add(-time.Hour)}, false},
+        {Operation{Action: "Start", Stages: stages, Completed: 1, UpdatedAt: now.Add(-time.Minute)}, false},
+        {Operation{Action: "Freespin", Stages: stages, Completed: 2, UpdatedAt: now}, false},
+        {Operation{Kind: "ramp", Action: "Stop", Stages: stages[:1], UpdatedAt: now}, false},
+    }
+    for _, c := range cases {
+        if resume, reason := recoveryPlan(c.op, now); resume != c.resume || (!resume && reason == "") {
+            t.Errorf("%s completed %d: resume = %v (%q), want %v", c.op.Action, c.op.Completed, resume, reason, c.resume)
+        }
+    }
+
+    // The journal survives a "restart" and is cleared once loaded
+    path := t.TempDir() + "/operations.json"
+    operations = map[string]*Operation{"1": {ID: "1", Kind: "staged", Action: "Stop", Stages: stages, Completed: 1, StartedAt: now, UpdatedAt: now}}
+    saveOperations(path)
+    operations = make(map[string]*Operation)
+    loaded := loadOperations(path)
+    if len(loaded) != 1 || loaded[0].Completed != 1 || len(loaded[0].Stages) != 2 {
+        t.Fatalf("loaded = %+v", loaded)
+    }
+    if again := loadOperations(path); len(again) != 0 {
+        t.Errorf("journal not cleared after load: %+v", again)
+    }
+}
+
+func TestLintConfig(t *testing.T) {
+    profiles := map[string]DriveTypeProfile{
+        "Good":     {Setpoint: []int{1}, SetFreqCalc: "* 10", OutFreqCalc: "/ 10"},
+        "Mixed":    {Setpoint: []int{1}, SetFreqCalc: "* 10", OutFreqCalc: "/ 100"},
+        "Preset":   {Setpoint: []int{1, 207}, SetFreqCalc: "* 10", OutFreqCalc: "/ 10"},
+        "Overflow": {Setpoint: []int{1}, SetFreqCalc: "* 2000", OutFreqCalc: "/ 2000"},
+    }
+    good := DriveConfig{IP: "10.0.0.1", DriveType: "Good", FanDesc: "3x 650RPM 25kCFM", RpmToHz: 10.8333, CfmRpm: 115.3846, MotorHP: 5}
+    cases := []struct {
+        name  string
+        drive DriveConfig
+        want  []string // substrings, one per expected problem
+    }{
+        {"consistent", good, nil},
+        {"unknown profile", DriveConfig{IP: "10.0.0.2", DriveType: "Nope", RpmToHz: 30, CfmRpm: 16}, []string{"unknown DriveType"}},
+        {"total RPM entered as RpmHz", DriveConfig{IP: "10.0.0.3", DriveType: "Good", RpmToHz: 1800, CfmRpm: 16}, []string{"above any induction motor"}},
+        {"description disagrees", DriveConfig{IP: "10.0.0.4", DriveType: "Good", FanDesc: "1x 1800RPM 29.5kCFM", RpmToHz: 30, CfmRpm: 1.6}, []string{"FanDesc"}},
+        {"CFM per HP", DriveConfig{IP: "10.0.0.5", DriveType: "Good", RpmToHz: 30, CfmRpm: 16.39, MotorHP: 0.1}, []string{"CFM/HP"}},
+        {"calc unit mix-up", DriveConfig{IP: "10.0.0.6", DriveType: "Mixed", RpmToHz: 30, CfmRpm: 16}, []string{"reads back as"}},
+        {"missing preset multiplier", DriveConfig{IP: "10.0.0.7", DriveType: "Preset", RpmToHz: 30, CfmRpm: 16}, []string{"SpeedPresetMultiplier is 0"}},
+        {"register overflow", DriveConfig{IP: "10.0.0.8", DriveType: "Overflow", RpmToHz: 30, CfmRpm: 16}, []string{"outside the setpoint register range"}},
+    }
+    for _, c := range cases {
+        got := lintConfig(AppConfig{VFDs: []DriveConfig{c.drive}}, profiles)
+        if len(got) != len(c.want) {
+            t.Errorf("%s: got %d problems %q, want %d", c.name, len(got), got, len(c.want))
+            continue
+        }
+        for i, w := range c.want {
+            if !strings.Contains(got[i], w) {
+                t.Errorf("%s: problem %q does not mention %q", c.name, got[i], w)
+            }
+        }
+    }
+
+    if n, rpm, cfm := parseFanDesc("2x 1140 rpm 18.2kCFM"); n != 2 || rpm != 1140 || cfm != 18200 {
+        t.Errorf("parseFanDesc = %d, %v, %v", n, rpm, cfm)
+    }
+}
+
+func TestProfileValidation(t *testing.T) {
+    good := `{"Setpoint": [1], "Control": 0, "StartValue": 1, "OutputFrequency": 7, "OutputCurrent": 8, "Status": 6,
+        "StatusBits": {"Enabled": 0, "Tripped": 1}, "SetFreqCalc": "* 10", "OutFreqCalc": "/ 10"}`
+    if _, problems := parseProfileJSON([]byte(good)); len(problems) != 0 {
+        t.Errorf("valid profile rejected: %v", problems)
+    }
+    bad := []struct {
+        json string
+        want string
+    }{
+        {`{"Setpiont": [1]}`, "unknown field"},
+        {`{"Setpoint": [], "StatusBits": {"Enabled": 0}}`, "Setpoint"},
+        {`{"Setpoint": [1]}`, "Enabled"},
+        {`{"Setpoint": [1], "StatusBits": {"Enabled": 16}}`, "outside 0-15"},
+        {`{"Setpoint": [1], "StatusBits": {"Enabled": 0}, "RegisterType": "coils"}`, "RegisterType"},
+        {`{"Setpoint": [1], "StatusBits": {"Enabled": 0}, "DoubleWord": ["OutputFreq"]}`, "DoubleWord"},
+        {`{"Setpoint": [1], "StatusBits": {"Enabled": 0}, "OutFreqCalc": "(raw / 10"}`, "OutFreqCalc"},
+        {`{"Setpoint": [1], "StatusBits": {"Enabled": 0}, "ExtraRegisters": [{"Name": "dc bus"}]}`, "ExtraRegisters[0]"},
+    }
+    for _, c := range bad {
+        _, problems := parseProfileJSON([]byte(c.json))
+        if len(problems) == 0 || !strings.Contains(strings.Join(problems, "; "), c.want) {
+            t.Errorf("%s: problems %v, want one mentioning %q", c.json, problems, c.want)
+        }
+    }
+
+    // Every shipped profile passes the same validation the API applies
+    data, err := os.ReadFile("drive_profiles.json")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var shipped map[string]json.RawMessage
+    if err := json.Unmarshal(data, &shipped); err != nil {
+        t.Fatal(err)
+    }
+    for name, raw := range shipped {
+        if _, problems := parseProfileJSON(raw); len(problems) != 0 {
+            t.Errorf("shipped profile %s: %v", name, problems)
+        }
+    }
+}
+
+func TestStoreProfile(t *testing.T) {
+    path := t.TempDir() + "/drive_profiles.json"
+    if err := os.WriteFile(path, []byte(`{"Existing": {"Setpoint": [1], "StatusBits": {"Enabled": 0}}}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    driveTypeProfiles = make(map[string]DriveTypeProfile)
+    raw := []byte(`{"Setpoint": [8193], "StatusBits": {"Enabled": 1}, "OutFreqCalc": "raw / 100"}`)
+    p, _ := parseProfileJSON(raw)
+    if err := storeProfile(path, "NewDrive", &p, raw); err != nil {
+        t.Fatal(err)
+    }
+    if got, ok := profileFor("NewDrive"); !ok || got.Setpoint[0] != 8193 {
+        t.Errorf("profile not applied: %+v", got)
+    }
+    if _, ok := freqCalcCache["raw / 100"]; !ok {
+        t.Error("new expression not compiled into the cache")
+    }
+    if err := storeProfile(path, "Existing", nil, nil); err != nil {
+        t.Fatal(err)
+    }
+
+    driveTypeProfiles = make(map[string]DriveTypeProfile)
+    if err := loadDriveTypeProfiles(path); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := driveTypeProfiles["Existing"]; ok || len(driveTypeProfiles) != 1 {
+        t.Errorf("file after create+delete: %v", driveTypeProfiles)
+    }
+    if _, err := os.Stat(path + ".bak"); err != nil {
+        t.Errorf("no backup written: %v", err)
+    }
+}
+
+func TestConfigReload(t *testing.T) {
+    old := []DriveConfig{
+        {IP: "10.0.0.1", Port: 502, Unit: 1, DriveType: "A", Group: "1"},
+        {IP: "10.0.0.2", Port: 502, Unit: 1, DriveType: "A", Group: "1"},
+        {IP: "10.0.0.3", Port: 502, Unit: 1, DriveType: "A", Group: "1"},
+    }
+    updated := []DriveConfig{
+        {IP: "10.0.0.1", Port: 502, Unit: 1, DriveType: "A", Group: "1"},
+        {IP: "10.0.0.2", Port: 502, Unit: 1, DriveType: "A", Group: "2"},
+        {IP: "10.0.0.3", Port: 503, Unit: 1, DriveType: "A", Group: "1"},
+        {IP: "10.0.0.4", Port: 502, Unit: 1, DriveType: "A", Group: "1"},
+    }
+    rl := diffDrives(old, updated)
+    if fmt.Sprint(rl.Added, rl.Removed, rl.Changed, rl.Reconnect) != "[10.0.0.4] [] [10.0.0.2 10.0.0.3] [10.0.0.3]" {
+        t.Errorf("diff: %+v", rl)
+    }
+    rl = diffDrives(updated, old[:1])
+    if fmt.Sprint(rl.Removed) != "[10.0.0.2 10.0.0.3 10.0.0.4]" {
+        t.Errorf("removed: %v", rl.Removed)
+    }
+
+    got := restartRequiredFields(AppConfig{BindPort: "8080", VFDs: old}, AppConfig{BindPort: "9090", VFDs: updated, GroupDependencies: map[string][]string{"2": {"1"}}})
+    if fmt.Sprint(got) != "[BindPort]" {
+        t.Errorf("restart required: %v", got)
+    }
+
+    current := []map[string]interface{}{newVfdEntry(old[0], time.Unix(0, 0)), newVfdEntry(old[1], time.Unix(0, 0))}
+    current[1]["status"] = "Running"
+    data := reconcileVfdData(current, updated[1:], time.Unix(0, 0))
+    if len(data) != 3 || data[0]["status"] != "Running" || data[0]["group"] != "2" || data[2]["status"] != "Waiting" {
+        t.Errorf("reconciled: %v", data)
+    }
+    if current[1]["group"] != "1" {
+        t.Error("reconcile modified the published snapshot")
+    }
+
+    // A rejected reload leaves the running configuration alone
+    savedConfig, savedIPs, savedData, savedProfiles := appConfig, ipToDrive, vfdData, driveTypeProfiles
+    defer func() { appConfig, ipToDrive, vfdData, driveTypeProfiles = savedConfig, savedIPs, savedData, savedProfiles }()
+    dir := t.TempDir()
+    profiles := dir + "/drive_profiles.json"
+    config := dir + "/config.json"
+    os.WriteFile(profiles, []byte(`{"A": {"Setpoint": [1], "Control": 0, "StartValue": 1, "StopValue": 0, "Status": 5, "OutputFrequency": 6, "OutputCurrent": 7, "StatusBits": {"Enabled": 0}}}`), 0644)
+    os.WriteFile(config, []byte(`{"VFDs": [{"IP": "10.0.0.1", "DriveType": "A"}, {"IP": "10.0.0.1", "DriveType": "A"}]}`), 0644)
+    appConfig = AppConfig{VFDs: old}
+    ipToDrive = map[string]*DriveConfig{}
+    vfdData = nil
+    if _, err := reloadConfig(config, profiles); err == nil || len(configuredDrives()) != 3 {
+        t.Errorf("duplicate IP accepted: %v", err)
+    }
+
+    os.WriteFile(config, []byte(`{"VFDs": [{"ID": "fan-1", "IP": "10.0.0.1", "Port": 502, "Unit": 1, "DriveType": "A", "Group": "1", "RpmHz": 29}]}`), 0644)
+    rl, err := reloadConfig(config, profiles)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fmt.Sprint(rl.Removed) != "[10.0.0.2 10.0.0.3]" || len(rl.Added) != 0 {
+        t.Errorf("reload: %+v", rl)
+    }
+    if _, ok := driveConfig("10.0.0.2"); ok || len(vfdData) != 1 {
+        t.Errorf("removed drive still configured: %v", vfdData)
+    }
+    if _, ok := profileFor("A"); !ok {
+        t.Error("profiles not reloaded")
+    }
+}
+
+func TestRegisterMap(t *testing.T) {
+    p := DriveTypeProfile{
+        RegisterType:    "input",
+        Setpoint:        []int{40002, 40010},
+        Control:         40001,
+        StartValue:      1,
+        StopValue:       0,
+        Status:          30001,
+        StatusBits:      map[string]int{"Enabled": 0},
+        OutputFrequency: 30002,
+        OutputCurrent:   30003,
+        OutFreqCalc:     "/ 100",
+        SetFreqCalc:     "* 100",
+        AddressBase:     30001,
+        FieldAddressBase: map[string]int{"Setpoint": 40001, "Control": 40001},
+        FieldRegisterType: map[string]string{"Setpoint": "holding"},
+        DoubleWord:      []string{"Setpoint"},
+        SpeedPresetMultiplier: 1,
+    }
+    entries := registerMap(p, map[string]float64{"status": 1, "outputFrequency": 4500})
+    find := func(field, access string) RegisterMapEntry {
+        for _, e := range entries {
+            if e.Field == field && e.Access == access {
+                return e
+            }
+        }
+        t.Fatalf("no %s %s entry in %+v", access, field, entries)
+        return RegisterMapEntry{}
+    }
+    if e := find("OutputFrequency", "read"); e.FunctionCode != 4 || e.WireAddress != 1 || e.Raw == nil || *e.Value != 45 {
+        t.Errorf("OutputFrequency: %+v", e)
+    }
+    if e := find("Setpoint", "read"); e.FunctionCode != 3 || e.WireAddress != 1 || e.Words != 2 || e.Raw != nil {
+        t.Errorf("Setpoint read: %+v", e)
+    }
+    if e := find("Setpoint", "write"); e.FunctionCode != 16 || e.Scaling != "* 100" {
+        t.Errorf("Setpoint write: %+v", e)
+    }
+    if e := find("SetpointPreset", "write"); e.WireAddress != 9 {
+        t.Errorf("SetpointPreset: %+v", e)
+    }
+    if e := find("Control", "write"); e.FunctionCode != 6 || e.WireAddress != 0 || e.Values["StartValue"] != 1 {
+        t.Errorf("Control: %+v", e)
+    }
+
+    savedIPs, savedProfiles := ipToDrive, driveTypeProfiles
+    defer func() { ipToDrive, driveTypeProfiles = savedIPs, savedProfiles }()
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": {IP: "10.0.0.1", DriveType: "Test"}}
+    driveTypeProfiles = map[string]DriveTypeProfile{"Test": p}
+    for path, want := range map[string]int{
+        "/api/devices/10.0.0.1/registermap": http.StatusOK,
+        "/api/devices/10.0.0.9/registermap": http.StatusNotFound,
+        "/api/devices/10.0.0.1/other":       http.StatusNotFound,
+    } {
+        rec := httptest.NewRecorder()
+        handleDeviceRoutes(rec, httptest.NewRequest(http.MethodGet, path, nil))
+        if rec.Code != want {
+            t.Errorf("%s: %d, want %d", path, rec.Code, want)
+        }
+    }
+}
+
+func TestProfileOverrides(t *testing.T) {
+    base := DriveTypeProfile{
+        Setpoint:    []int{1},
+        Status:      5,
+        StatusBits:  map[string]int{"Enabled": 0, "Tripped": 1},
+        OutFreqCalc: "/ 10",
+    }
+    p, err := applyProfileOverrides(base, json.RawMessage(`{"Setpoint": [8193], "StatusBits": {"Enabled": 3}}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if p.Setpoint[0] != 8193 || p.Status != 5 || p.OutFreqCalc != "/ 10" {
+        t.Errorf("override applied wrongly: %+v", p)
+    }
+    if _, ok := p.StatusBits["Tripped"]; ok || p.StatusBits["Enabled"] != 3 {
+        t.Errorf("StatusBits should be replaced, not merged: %v", p.StatusBits)
+    }
+    if base.StatusBits["Enabled"] != 0 || base.Setpoint[0] != 1 {
+        t.Errorf("base profile modified: %+v", base)
+    }
+    for _, bad := range []string{`{"setpoint": [2]}`, `{"MaxHz": 60}`, `{"Setpoint": "one"}`, `[1]`} {
+        if _, err := applyProfileOverrides(base, json.RawMessage(bad)); err == nil {
+            t.Errorf("%s: accepted", bad)
+        }
+    }
+
+    profiles := map[string]DriveTypeProfile{"Base": base}
+    drives := []DriveConfig{
+        {IP: "10.0.0.1", DriveType: "Base"},
+        {IP: "10.0.0.2", DriveType: "Base", ProfileOverrides: json.RawMessage(`{"OutFreqCalc": "/ 100"}`)},
+    }
+    got, err := overrideProfiles(drives, profiles)
+    if err != nil || len(got) != 1 || got["10.0.0.2"].OutFreqCalc != "/ 100" {
+        t.Errorf("overrideProfiles = %v, %v", got, err)
+    }
+    drives[1].ProfileOverrides = json.RawMessage(`{"Setpoint": []}`)
+    if _, err := overrideProfiles(drives, profiles); err == nil {
+        t.Error("override leaving no Setpoint accepted")
+    }
+
+    savedIPs, savedProfiles := ipToDrive, driveTypeProfiles
+    defer func() { ipToDrive, driveTypeProfiles = savedIPs, savedProfiles }()
+    driveTypeProfiles = profiles
+    d := &DriveConfig{IP: "10.0.0.3", DriveType: "Base", ProfileOverrides: json.RawMessage(`{"Status": 9}`)}
+    ipToDrive = map[string]*DriveConfig{d.IP: d}
+    if p, ok := driveProfile(d); !ok || p.Status != 9 {
+        t.Errorf("driveProfile = %+v, %v", p, ok)
+    }
+}
+
+func TestDevicesRawView(t *testing.T) {
+    savedIPs, savedProfiles, savedData := ipToDrive, driveTypeProfiles, vfdData
+    defer func() { ipToDrive, driveTypeProfiles, vfdData = savedIPs, savedProfiles, savedData }()
+    d := DriveConfig{IP: "10.0.0.1", DriveType: "Test"}
+    ipToDrive = map[string]*DriveConfig{d.IP: &d}
+    driveTypeProfiles = map[string]DriveTypeProfile{"Test": {Setpoint: []int{1}, OutFreqCalc: "* 10"}}
+    vfdData = []map[string]interface{}{newVfdEntry(d, time.Unix(0, 0))}
+    recordRawReading(d.IP, map[string]float64{"outputFrequency": 500}, time.Unix(0, 0))
+
+    get := func(url string) []map[string]interface{} {
+        rec := httptest.NewRecorder()
+        handleDevices(rec, httptest.NewRequest(http.MethodGet, url, nil))
+        var out []map[string]interface{}
+        if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || len(out) != 1 {
+            t.Fatalf("%s: %v %s", url, err, rec.Body.String())
+        }
+        return out
+    }
+    if _, ok := get("/api/devices")[0]["raw"]; ok {
+        t.Error("raw view included without ?raw")
+    }
+    raw, _ := get("/api/devices?raw=1")[0]["raw"].(map[string]interface{})
+    values, _ := raw["values"].(map[string]interface{})
+    scaling, _ := raw["scaling"].(map[string]interface{})
+    if values["outputFrequency"] != 500.0 || scaling["outputFrequency"] != "* 10" || scaling["outputCurrent"] != "/ 10" {
+        t.Errorf("raw view: %v", raw)
+    }
+}
+
+func TestDriveTypeDetection(t *testing.T) {
+    reg := 100
+    profiles := map[string]DriveTypeProfile{
+        "WegDrive":   {Identify: &DriveIdentity{VendorName: "weg"}},
+        "AbbSmall":   {Identify: &DriveIdentity{VendorName: "ABB", ModelName: "ACS380"}},
+        "AbbLarge":   {Identify: &DriveIdentity{VendorName: "ABB", ModelName: "ACS580"}},
+        "CodedDrive": {Identify: &DriveIdentity{Register: &reg, Values: []int{7, 8}}, AddressBase: 1},
+        "Anonymous":  {},
+    }
+    client := &fakeRegisters{
+        values:   map[uint16]uint16{99: 8},
+        identity: map[byte][]byte{0x00: []byte("ABB Oy "), 0x04: []byte("ACS580-01")},
+    }
+    identity := readDeviceIdentity(context.Background(), client)
+    regs := readIdentityRegisters(context.Background(), client, profiles)
+    if identity["VendorName"] != "ABB Oy" || regs[99] != 8 {
+        t.Fatalf("identity %v, registers %v", identity, regs)
+    }
+    matches := matchDriveProfiles(identity, regs, profiles)
+    if fmt.Sprint(matches) != "[AbbLarge CodedDrive]" {
+        t.Errorf("matches = %v", matches)
+    }
+    if got := matchDriveProfiles(nil, nil, profiles); len(got) != 0 {
+        t.Errorf("no identity matched %v", got)
+    }
+
+    for _, c := range []struct {
+        configured string
+        matches    []string
+        fill       string
+        mismatch   bool
+    }{
+        {"AbbLarge", []string{"AbbLarge"}, "", false},
+        {"WegDrive", []string{"AbbLarge"}, "", true},
+        {"WegDrive", nil, "", false},
+        {"", []string{"AbbLarge"}, "AbbLarge", false},
+        {"", []string{"AbbLarge", "AbbSmall"}, "", false},
+    } {
+        fill, mismatch := judgeDetection(c.configured, c.matches)
+        if fill != c.fill || mismatch != c.mismatch {
+            t.Errorf("judgeDetection(%q, %v) = %q, %v", c.configured, c.matches, fill, mismatch)
+        }
+    }
+
+    // An unconfigured drive is filled in once; the next connect does not re-detect
+    savedConfig, savedIPs, savedProfiles := appConfig, ipToDrive, driveTypeProfiles
+    defer func() { appConfig, ipToDrive, driveTypeProfiles = savedConfig, savedIPs, savedProfiles }()
+    driveTypeProfiles = map[string]DriveTypeProfile{"WegDrive": profiles["WegDrive"]}
+    appConfig = AppConfig{VFDs: []DriveConfig{{IP: "10.0.0.5"}}}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.5": &appConfig.VFDs[0]}
+    conn := &VFDConnection{client: &fakeRegisters{identity: map[byte][]byte{0x00: []byte("WEG")}}}
+    orig := &appConfig.VFDs[0]
+    if !detectDriveType(conn, orig) {
+        t.Fatal("DriveType not filled in")
+    }
+    d, _ := driveConfig("10.0.0.5")
+    if d.DriveType != "WegDrive" || orig.DriveType != "" {
+        t.Errorf("detected drive = %+v", d)
+    }
+    if detectDriveType(conn, d) {
+        t.Error("detected twice")
+    }
+    if det, _ := driveDetection("10.0.0.5"); !det.AutoFilled || det.Configured != "WegDrive" {
+        t.Errorf("detection = %+v", det)
+    }
+}
+
+func TestFeatureFlags(t *testing.T) {
+    savedDefs, savedConfig, savedOverrides := featureFlagDefs, configFlags, flagOverrides
+    defer func() { featureFlagDefs, configFlags, flagOverrides = savedDefs, savedConfig, savedOverrides }()
+    featureFlagDefs = []FeatureFlagDef{{Name: "on-by-default", Default: true}, {Name: "off-by-default"}}
+    flagOverrides = make(map[string]bool)
+    setConfigFlags(map[string]bool{"on-by-default": false, "from-the-future": true})
+
+    if featureEnabled("on-by-default") || featureEnabled("off-by-default") || featureEnabled("from-the-future") {
+        t.Error("config flags not applied")
+    }
+    path := t.TempDir() + "/feature_flags.json"
+    on := true
+    if err := setFlagOverride(path, "on-by-default", &on); err != nil {
+        t.Fatal(err)
+    }
+    if !featureEnabled("on-by-default") {
+        t.Error("override does not win over config")
+    }
+    flags := featureFlags()
+    if len(flags) != 3 || flags[0].Name != "from-the-future" || flags[0].Known || flags[0].Enabled {
+        t.Errorf("flags = %+v", flags)
+    }
+
+    flagOverrides = make(map[string]bool)
+    loadFeatureFlags(path)
+    if !flagOverrides["on-by-default"] {
+        t.Errorf("overrides not persisted: %v", flagOverrides)
+    }
+    if err := setFlagOverride(path, "on-by-default", nil); err != nil || featureEnabled("on-by-default") {
+        t.Errorf("clearing the override should fall back to config: %v", err)
+    }
+
+    rec := httptest.NewRecorder()
+    handleFeatureFlags(rec, httptest.NewRequest(http.MethodPut, "/api/admin/flags/from-the-future", strings.NewReader(`{"enabled": true}`)))
+    if rec.Code != http.StatusNotFound {
+        t.Errorf("unknown flag: %d", rec.Code)
+    }
+}
+
+func TestDriveSwap(t *testing.T) {
+    old := DriveConfig{IP: "10.0.0.5", Port: 502, Unit: 1, DriveType: "WegDrive", Group: "North", FanNumber: 3, ProfileOverrides: json.RawMessage(`{"OutputCurrent": 9}`)}
+    repl := replacementConfig(old, DriveSwapRequest{OldIP: "10.0.0.5", IP: "10.0.0.9"})
+    if repl.IP != "10.0.0.9" || repl.Port != 502 || repl.DriveType != "WegDrive" || repl.Group != "North" || repl.FanNumber != 3 || repl.ProfileOverrides != nil {
+        t.Errorf("replacement = %+v", repl)
+    }
+
+    profile := DriveTypeProfile{
+        Status: 1, Setpoint: []int{2}, OutputFrequency: 3, OutputCurrent: 4,
+        StatusBits: map[string]int{"Tripped": 3},
+        Identify:   &DriveIdentity{VendorName: "WEG"},
+    }
+    client := &fakeRegisters{
+        values:   map[uint16]uint16{1: 0, 2: 300, 3: 298, 4: 12},
+        identity: map[byte][]byte{0x00: []byte("WEG")},
+    }
+    checks, identity := commissionChecks(context.Background(), client, repl, profile)
+    for _, c := range checks {
+        if !c.OK {
+            t.Errorf("check %s failed: %s", c.Name, c.Detail)
+        }
+    }
+    if len(checks) != 3 || identity["VendorName"] != "WEG" {
+        t.Errorf("checks = %+v, identity %v", checks, identity)
+    }
+
+    // A tripped replacement of another make fails identity and the trip check
+    client.values[1] = 1 << 3
+    client.identity = map[byte][]byte{0x00: []byte("ABB")}
+    checks, _ = commissionChecks(context.Background(), client, repl, profile)
+    if checks[0].OK || !checks[1].OK || checks[2].OK {
+        t.Errorf("checks = %+v", checks)
+    }
+    delete(client.values, 4)
+    if checks, _ = commissionChecks(context.Background(), client, repl, profile); len(checks) != 2 || checks[1].OK {
+        t.Errorf("unreadable register: %+v", checks)
+    }
+
+    // The drive's entry is rewritten in place; other keys and drives survive
+    dir := t.TempDir()
+    configPath := dir + "/config.json"
+    os.WriteFile(configPath, []byte(`{"Port": 8080, "VFDs": [
+        {"IP": "10.0.0.4", "Group": "North", "FanNumber": 2, "DriveType": "WegDrive"},
+        {"IP": "10.0.0.5", "Group": "North", "FanNumber": 3, "DriveType": "WegDrive", "CfmRpm": 9.5, "ProfileOverrides": {"OutputCurrent": 9}}
+    ]}`), 0644)
+    if err := rewriteDriveConfig(configPath, "10.0.0.5", repl); err != nil {
+        t.Fatal(err)
+    }
+    if err := rewriteDriveConfig(configPath, "10.0.0.5", repl); err == nil {
+        t.Error("rewrote a drive that is no longer configured")
+    }
+    data, _ := os.ReadFile(configPath)
+    var doc struct {
+        Port int
+        VFDs []map[string]interface{}
+    }
+    if err := json.Unmarshal(data, &doc); err != nil {
+        t.Fatal(err)
+    }
+    swapped := doc.VFDs[1]
+    if doc.Port != 8080 || doc.VFDs[0]["IP"] != "10.0.0.4" || swapped["IP"] != "10.0.0.9" || swapped["CfmRpm"] != 9.5 || swapped["ProfileOverrides"] != nil {
+        t.Errorf("config after swap: %s", data)
+    }
+    if _, err := os.Stat(configPath + ".bak"); err != nil {
+        t.Error("no backup written")
+    }
+
+    archivePath := dir + "/retired_drives.json"
+    for i := 0; i < 2; i++ {
+        if err := archiveRetiredDrive(archivePath, RetiredDrive{Slot: "North/3", Config: old, ReplacedBy: repl.IP}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    var archive []RetiredDrive
+    data, _ = os.ReadFile(archivePath)
+    if err := json.Unmarshal(data, &archive); err != nil || len(archive) != 2 || archive[0].Config.IP != "10.0.0.5" {
+        t.Errorf("archive = %s (%v)", data, err)
+    }
+}
+
+func TestConfigValidation(t *testing.T) {
+    // The shipped example config and profiles are clean
+    shipped, err := readAppConfig("config.json")
+    if err != nil {
+        t.Fatal(err)
+    }
+    profiles, err := readDriveTypeProfiles("drive_profiles.json")
+    if err != nil {
+        t.Fatal(err)
+    }
+    missing, err := readMissingProfileFields("drive_profiles.json")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if issues := validateConfig(shipped, profiles, missing); len(issues) != 0 {
+        t.Errorf("shipped config: %v", issues)
+    }
+
+    dir := t.TempDir()
+    os.WriteFile(dir+"/drive_profiles.json", []byte(`{"Partial": {"Setpoint": [1], "StatusCoils": {"Enabled": 1}}}`), 0644)
+    if missing, _ := readMissingProfileFields(dir + "/drive_profiles.json"); fmt.Sprint(missing["Partial"]) != "[Control StartValue StopValue OutputFrequency OutputCurrent]" {
+        t.Errorf("missing = %v", missing)
+    }
+
+    profiles = map[string]DriveTypeProfile{
+        "Good":    profiles["OptidriveE3"],
+        "Partial": {Setpoint: []int{1}, StatusBits: map[string]int{"Enabled": 0}},
+    }
+    missing = map[string][]string{"Partial": {"OutputCurrent"}}
+    cfg := AppConfig{VFDs: []DriveConfig{
+        {IP: "10.0.0.1", Group: "A", FanNumber: 1, RpmToHz: 29, DriveType: "Good"},
+        {IP: "10.0.0.1", Group: "A", FanNumber: 1, RpmToHz: 29, DriveType: "Good"}, // duplicate entry
+        {IP: "10.0.0.2", Group: "A", FanNumber: 1, RpmToHz: 29, DriveType: "Good"}, // same slot
+        {IP: "10.0.0.3", Group: "B", FanNumber: 1, RpmToHz: 0, DriveType: "Good"},
+        {IP: "10.0.0.4", Group: "B", FanNumber: 2, RpmToHz: 29, DriveType: "Optidrive"},
+        {IP: "10.0.0.5", Group: "B", FanNumber: 3, RpmToHz: 29, DriveType: "Partial"},
+        {IP: "10.0.0.6", Group: "B", FanNumber: 4, RpmToHz: 29, DriveType: "Good"},
+    }}
+    issues := validateConfig(cfg, profiles, missing)
+    var problems []string
+    for _, issue := range issues {
+        problems = append(problems, issue.String())
+    }
+    for i, want := range []string{
+        "10.0.0.1: VFDs[1] repeats the IP of VFDs[0]",
+        `10.0.0.2: FanNumber 1 in group "A" is already 10.0.0.1`,
+        "10.0.0.3: RpmHz is 0",
+        `10.0.0.4: unknown DriveType "Optidrive". Fix: use one of Good, Partial`,
+        "10.0.0.5: profile Partial: missing required OutputCurrent",
+    } {
+        if i >= len(problems) || !strings.HasPrefix(problems[i], want) {
+            t.Errorf("issues = %q, want %q at %d", problems, want, i)
+        }
+    }
+    if len(issues) != 5 {
+        t.Errorf("%d issues: %q", len(issues), problems)
+    }
+
+    // Refused by default; StartDegraded keeps the first entry of the duplicate and the clean drives
+    if _, _, _, err := checkConfig(cfg, profiles, missing); err == nil {
+        t.Error("invalid config accepted")
+    }
+    cfg.StartDegraded = true
+    degraded, _, excluded, err := checkConfig(cfg, profiles, missing)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var kept []string
+    for _, d := range degraded.VFDs {
+        kept = append(kept, d.IP)
+    }
+    if fmt.Sprint(kept) != "[10.0.0.1 10.0.0.6]" || fmt.Sprint(excluded) != "[10.0.0.1 10.0.0.2 10.0.0.3 10.0.0.4 10.0.0.5]" {
+        t.Errorf("kept %v, excluded %v", kept, excluded)
+    }
+}
+
+func TestDriftReport(t *testing.T) {
+    site := func(name, version, profiles string) *httptest.Server {
+        return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            switch r.URL.Path {
+            case "/api/app-config":
+                fmt.Fprintf(w, `{"siteName": %q, "version": %q}`, name, version)
+            case "/api/profiles":
+                fmt.Fprint(w, profiles)
+            default:
+                http.NotFound(w, r)
+            }
+        }))
+    }
+    a := site("A", "3.8.1", `{"OptidriveE3": {"OutFreqCalc": "/ 10", "Status": 5}, "CFW500": {"Status": 680}}`)
+    b := site("B", "3.8.1", `{"OptidriveE3": {"OutFreqCalc": "/ 10", "Status": 5, "FaultCodeMask": 0}, "CFW500": {"Status": 680}}`)
+    c := site("", "", `{"OptidriveE3": {"OutFreqCalc": "/ 100", "Status": 5}}`)
+    defer a.Close()
+    defer b.Close()
+    defer c.Close()
+
+    client := &http.Client{Timeout: time.Second}
+    var sites []SiteSnapshot
+    for _, s := range []*httptest.Server{a, b} {
+        snap, err := fetchSiteSnapshot(client, s.URL+"/")
+        if err != nil {
+            t.Fatal(err)
+        }
+        sites = append(sites, snap)
+    }
+    // A field one version serializes as zero and another omits is not drift
+    if report := buildDriftReport(sites); len(report) != 0 {
+        t.Errorf("consistent sites: %q", report)
+    }
+
+    snap, err := fetchSiteSnapshot(client, c.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sites = append(sites, snap)
+    want := []string{
+        "version: 3.8.1 on A, B; unknown on " + c.URL,
+        "profile CFW500: missing on " + c.URL,
+        `profile OptidriveE3 OutFreqCalc: "/ 10" on A, B; "/ 100" on ` + c.URL,
+    }
+    if report := buildDriftReport(sites); fmt.Sprint(report) != fmt.Sprint(want) {
+        t.Errorf("report:\n%s\nwant:\n%s", strings.Join(report, "\n"), strings.Join(want, "\n"))
+    }
+
+    if _, err := fetchSiteSnapshot(client, a.URL+"/nowhere"); err == nil {
+        t.Error("bad URL accepted")
+    }
+}
+
+func TestSpeedRamp(t *testing.T) {
+    for _, c := range []struct {
+        from, to, rate float64
+        steps          string
+        interval       time.Duration
+    }{
+        {20, 25, 2, "[21 22 23 24 25]", 500 * time.Millisecond},
+        {20, 30, 10, "[25 30]", 500 * time.Millisecond},
+        {60, 58.5, 0.5, "[59 58.5]", 2 * time.Second},
+        {0, 2.5, 1, "[1 2 2.5]", time.Second},
+        {30, 30, 2, "[30]", 500 * time.Millisecond},
+    } {
+        steps, interval := rampSteps(c.from, c.to, c.rate)
+        if fmt.Sprint(steps) != c.steps || interval != c.interval {
+            t.Errorf("rampSteps(%v, %v, %v) = %v every %s, want %s every %s", c.from, c.to, c.rate, steps, interval, c.steps, c.interval)
+        }
+    }
+
+    savedConfig, savedData := appConfig, vfdData
+    defer func() { appConfig, vfdData = savedConfig, savedData }()
+    appConfig.MaxRampHzPerSec = 2
+    if rampRate(&DriveConfig{}) != 2 || rampRate(&DriveConfig{MaxRampHzPerSec: 5}) != 5 || rampRate(&DriveConfig{MaxRampHzPerSec: -1}) != 0 {
+        t.Error("rampRate does not apply the per-drive setting over the site default")
+    }
+
+    // A ramp starts from a running drive's setpoint; a newer one takes over from its last step
+    vfdData = []map[string]interface{}{{"ip": "10.0.0.1", "status": "Running", "setSpeed": 30.0}, {"ip": "10.0.0.2", "status": "Stopped", "setSpeed": 30.0}}
+    first, from := beginRamp("10.0.0.1")
+    if from != 30 {
+        t.Errorf("ramp from %v, want 30", from)
+    }
+    first.setpoint = 34
+    second, from := beginRamp("10.0.0.1")
+    if from != 34 || first.stop != "superseded" {
+        t.Errorf("second ramp from %v, first stop %q", from, first.stop)
+    }
+    endRamp("10.0.0.1", first) // the superseded ramp must not remove its successor
+    cancelRamp("10.0.0.1", "Stop")
+    if second.stop != "Stop" || len(ramps) != 0 {
+        t.Errorf("cancel: stop %q, ramps %v", second.stop, ramps)
+    }
+    if r, from := beginRamp("10.0.0.2"); from != 0 {
+        t.Errorf("stopped drive ramps from %v", from)
+    } else {
+        endRamp("10.0.0.2", r)
+    }
+}
+
+func TestWriteConnection(t *testing.T) {
+    shared := &VFDConnection{ip: "10.0.0.1"}
+    shared.healthy.Store(true)
+    if shared.commandConn() != shared {
+        t.Error("no write session: commands must use the shared connection")
+    }
+    writer := &VFDConnection{ip: "10.0.0.1"}
+    writer.healthy.Store(true)
+    shared.writer.Store(writer)
+    if shared.commandConn() != writer {
+        t.Error("healthy write session not used")
+    }
+
+    savedConns := vfdConnections
+    defer func() { vfdConnections = savedConns }()
+    other := &VFDConnection{ip: "10.0.0.2"}
+    other.healthy.Store(true)
+    vfdConnections = map[string]*VFDConnection{"10.0.0.1": shared, "10.0.0.2": other}
+    if states := writeConnectionStates(); states["10.0.0.1"] != "dedicated" || states["10.0.0.2"] != "shared" {
+        t.Errorf("states = %v", states)
+    }
+    writer.healthy.Store(false)
+    if shared.commandConn() != shared || writeConnectionStates()["10.0.0.1"] != "shared" {
+        t.Error("unhealthy write session still used")
+    }
+
+    savedConfig := appConfig
+    defer func() { appConfig = savedConfig }()
+    appConfig.DedicatedWriteConnection = true
+    if !wantWriteConnection(&DriveConfig{}) || wantWriteConnection(&DriveConfig{SharedConnection: true}) {
+        t.Error("SharedConnection does not opt a drive out")
+    }
+}
+
+func TestStaggerSchedule(t *testing.T) {
+    savedConfig, savedIPs := appConfig, ipToDrive
+    defer func() { appConfig, ipToDrive = savedConfig, savedIPs }()
+    appConfig = AppConfig{
+        StartStaggerMs:      2000,
+        GroupStartStaggerMs: map[string]int{"B": 500, "C": 0},
+        VFDs: []DriveConfig{
+            {IP: "a1", Group: "A"}, {IP: "a2", Group: "A"}, {IP: "a3", Group: "A"},
+            {IP: "b1", Group: "B"}, {IP: "b2", Group: "B"},
+            {IP: "c1", Group: "C"}, {IP: "c2", Group: "C"},
+        },
+    }
+    ipToDrive = make(map[string]*DriveConfig)
+    for i := range appConfig.VFDs {
+        ipToDrive[appConfig.VFDs[i].IP] = &appConfig.VFDs[i]
+    }
+
+    // a2 is already running, so it neither waits nor delays a3
+    running := func(ip string) bool { return ip == "a2" }
+    offsets, times, slots := staggerSchedule([]string{"a1", "a2", "a3", "b1", "b2", "c1", "c2"}, running)
+    if offsets["a3"] != 2*time.Second || offsets["b2"] != 500*time.Millisecond || offsets["c2"] != 0 || offsets["a2"] != 0 {
+        t.Errorf("offsets = %v", offsets)
+    }
+    if fmt.Sprint(times, slots) != "[0s 500ms 2s] [[a1 a2 b1 c1 c2] [b2] [a3]]" {
+        t.Errorf("schedule = %v %v", times, slots)
+    }
+
+    appConfig.StartStaggerMs = 0
+    appConfig.GroupStartStaggerMs = nil
+    if _, _, slots := staggerSchedule([]string{"a1", "a3", "b1"}, running); len(slots) != 1 {
+        t.Errorf("no stagger configured, got %v", slots)
+    }
+}
+
+// fakeWrites records single-register writes as "address=value"
+type fakeWrites struct {
+    modbus.Client
+    mu     sync.Mutex
+    writes []string
+}
+
+func (f *fakeWrites) WriteSingleRegister(ctx context.Context, address, value uint16) ([]byte, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.writes = append(f.writes, fmt.Sprintf("%d=%d", address, value))
+    return nil, nil
+}
+
+func TestSynchronizedSetSpeed(t *testing.T) {
+    savedConfig, savedIPs, savedProfiles, savedConns, savedData := appConfig, ipToDrive, driveTypeProfiles, vfdConnections, vfdData
+    defer func() {
+        appConfig, ipToDrive, driveTypeProfiles, vfdConnections, vfdData = savedConfig, savedIPs, savedProfiles, savedConns, savedData
+    }()
+    driveTypeProfiles = map[string]DriveTypeProfile{
+        "Plain": {Setpoint: []int{1}, SetFreqCalc: "* 10"},
+        "Yask":  {Setpoint: []int{2}, SetFreqCalc: "* 100", EnterRegister: 9, EnterValue: 0, EnterAfter: []string{"Setpoint"}},
+    }
+    appConfig = AppConfig{VFDs: []DriveConfig{{IP: "10.0.0.1", DriveType: "Plain"}, {IP: "10.0.0.2", DriveType: "Yask", HardMaxHz: 50}}}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0], "10.0.0.2": &appConfig.VFDs[1]}
+    vfdData = []map[string]interface{}{{"ip": "10.0.0.1", "status": "Running"}, {"ip": "10.0.0.2", "status": "Running"}}
+    clients := map[string]*fakeWrites{"10.0.0.1": {}, "10.0.0.2": {}}
+    vfdConnections = make(map[string]*VFDConnection)
+    for ip, c := range clients {
+        conn := &VFDConnection{ip: ip, client: c}
+        conn.healthy.Store(true)
+        vfdConnections[ip] = conn
+    }
+
+    event, skew := executeSynchronized(45, []string{"10.0.0.1", "10.0.0.2"}, false)
+    if len(event.Drives) != 2 || !event.Drives[0].Success || !event.Drives[1].Success {
+        t.Fatalf("event = %+v", event)
+    }
+    if skew < 0 || skew > time.Second || !strings.HasPrefix(event.Detail, "synchronized, skew ") {
+        t.Errorf("skew %s, detail %q", skew, event.Detail)
+    }
+    // The ENTER drive had its setpoint staged ahead; the release wrote only ENTER
+    if fmt.Sprint(clients["10.0.0.1"].writes) != "[1=450]" || fmt.Sprint(clients["10.0.0.2"].writes) != "[2=4500 9=0]" {
+        t.Errorf("writes: %v %v", clients["10.0.0.1"].writes, clients["10.0.0.2"].writes)
+    }
+
+    // A drive over its hard limit fails alone
+    event, _ = executeSynchronized(55, []string{"10.0.0.1", "10.0.0.2"}, true)
+    if !event.Drives[0].Success || event.Drives[1].Success {
+        t.Errorf("hard limit: %+v", event.Drives)
+    }
+}
+
+func TestPrometheusRules(t *testing.T) {
+    drives := []DriveConfig{
+        {IP: "10.0.0.1", Group: "1", FanNumber: 1, MinHz: 15, HardMaxHz: 60},
+        {IP: "10.0.0.2", Group: "1", FanNumber: 2, MinHz: 20},
+        {IP: "10.0.0.3", Group: "2", FanNumber: 1},
+    }
+    find := func(groups []promRuleGroup, alert string) (promRule, bool) {
+        for _, g := range groups {
+            for _, r := range g.Rules {
+                if r.Alert == alert {
+                    return r, true
+                }
+            }
+        }
+        return promRule{}, false
+    }
+
+    groups := buildPrometheusRules("Site", drives, false)
+    above, ok := find(groups, "VFDSpeedAboveLimit")
+    if !ok || above.Expr != `vfd_speed_hz{ip="10.0.0.1"} > 60` {
+        t.Errorf("above limit: %+v", above)
+    }
+    below, ok := find(groups, "VFDSpeedBelowMinimum")
+    want := `(vfd_speed_hz{ip="10.0.0.1"} < 15 and vfd_status{ip="10.0.0.1"} == 1) or (vfd_speed_hz{ip="10.0.0.2"} < 20 and vfd_status{ip="10.0.0.2"} == 1)`
+    if !ok || below.Expr != want {
+        t.Errorf("below minimum: %s", below.Expr)
+    }
+    if r, ok := find(groups, "VFDTripped"); !ok || r.Labels["site"] != "Site" {
+        t.Errorf("trip alert: %+v", r)
+    }
+    if _, ok := find(groups, "VFDShadowDivergent"); ok {
+        t.Error("shadow alert without shadow mode")
+    }
+
+    // Drives without limits need no speed alerts; shadow mode adds its own
+    groups = buildPrometheusRules("Site", drives[2:], true)
+    if _, ok := find(groups, "VFDSpeedAboveLimit"); ok {
+        t.Error("speed alert without limits")
+    }
+    if _, ok := find(groups, "VFDShadowDivergent"); !ok {
+        t.Error("missing shadow alert")
+    }
+
+    out := renderPrometheusRules([]promRuleGroup{{Name: "g", Rules: []promRule{
+        {Record: "group:vfd_cfm:sum", Expr: "sum by (group) (vfd_cfm)"},
+        {Alert: "A", Expr: `up{ip!=""} == 0`, For: "2m", Labels: map[string]string{"site": "S", "severity": "warning"}},
+    }}})
+    wantYAML := `groups:
+  - name: "g"
+    rules:
+      - record: "group:vfd_cfm:sum"
+        expr: "sum by (group) (vfd_cfm)"
+      - alert: "A"
+        expr: "up{ip!=\"\"} == 0"
+        for: 2m
+        labels:
+          severity: "warning"
+          site: "S"
+`
+    if out != wantYAML {
+        t.Errorf("rendered:\n%s\nwant:\n%s", out, wantYAML)
+    }
+}
+
+func TestSchedules(t *testing.T) {
+    spec, err := parseCron("0 22 * * 1-5")
+    if err != nil {
+        t.Fatal(err)
+    }
+    friday := time.Date(2026, 10, 16, 22, 0, 0, 0, time.Local)
+    if !spec.matches(friday) || spec.matches(friday.Add(time.Minute)) || spec.matches(friday.AddDate(0, 0, 1)) {
+        t.Error("weekday 22:00 matching")
+    }
+    if next, ok := spec.next(friday); !ok || !next.Equal(time.Date(2026, 10, 19, 22, 0, 0, 0, time.Local)) {
+        t.Errorf("next after Friday: %v", next)
+    }
+    // Both day fields restricted: either matches, as in cron
+    spec, _ = parseCron("*/15 6 1 * 0")
+    for day, want := range map[int]bool{1: true, 18: true, 16: false} {
+        if got := spec.matches(time.Date(2026, 10, day, 6, 30, 0, 0, time.Local)); got != want {
+            t.Errorf("Oct %d: got %v", day, got)
+        }
+    }
+    if next, ok := mustCron(t, "0 0 29 2 *").next(friday); !ok || next.Year() != 2028 {
+        t.Errorf("Feb 29: %v %v", next, ok)
+    }
+    for _, bad := range []string{"0 22 * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+        if _, err := parseCron(bad); err == nil {
+            t.Errorf("%q accepted", bad)
+        }
+    }
+
+    drives := []DriveConfig{
+        {IP: "10.0.0.1", Group: "A", MinHz: 10, SoftMaxHz: 50, HardMaxHz: 60},
+        {IP: "10.0.0.2", Group: "B", MinHz: 10},
+        {IP: "10.0.0.3", Group: "B", MinHz: 10},
+    }
+    if got := scheduleTargets(Schedule{Groups: []string{"B"}}, drives); fmt.Sprint(got) != "[10.0.0.2 10.0.0.3]" {
+        t.Errorf("group targets: %v", got)
+    }
+    if got := scheduleTargets(Schedule{}, drives); len(got) != 3 {
+        t.Errorf("all targets: %v", got)
+    }
+    good := Schedule{ID: "night", Cron: "0 22 * * 1-5", Action: "SetSpeed", Speed: 45, Groups: []string{"B"}}
+    if err := validateSchedule(good, drives); err != nil {
+        t.Errorf("valid schedule: %v", err)
+    }
+    for name, s := range map[string]Schedule{
+        "id":         {ID: "a/b", Cron: good.Cron, Action: "Stop"},
+        "action":     {ID: "x", Cron: good.Cron, Action: "Spin"},
+        "no speed":   {ID: "x", Cron: good.Cron, Action: "SetSpeed"},
+        "group":      {ID: "x", Cron: good.Cron, Action: "Stop", Groups: []string{"C"}},
+        "drive":      {ID: "x", Cron: good.Cron, Action: "Stop", Drives: []string{"10.0.0.9"}},
+        "soft limit": {ID: "x", Cron: good.Cron, Action: "SetSpeed", Speed: 55},
+    } {
+        if err := validateSchedule(s, drives); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+
+    schedulesMu.Lock()
+    savedAPI, savedEnabled := apiSchedules, scheduleEnabled
+    apiSchedules = []Schedule{{ID: "morning", Cron: "0 6 * * *", Action: "SetSpeed", Speed: 60, Drives: []string{"10.0.0.1"}}}
+    scheduleEnabled = map[string]bool{"morning": false}
+    schedulesMu.Unlock()
+    defer func() {
+        schedulesMu.Lock()
+        apiSchedules, scheduleEnabled = savedAPI, savedEnabled
+        schedulesMu.Unlock()
+        setConfigSchedules(nil, nil)
+    }()
+    setConfigSchedules([]Schedule{good, {Cron: "0 22 * * *", Action: "Stop", Groups: []string{"C"}}}, drives)
+
+    if due := dueSchedules(friday); len(due) != 1 || due[0].ID != "night" {
+        t.Errorf("due at 22:00: %+v", due)
+    }
+    if due := dueSchedules(time.Date(2026, 10, 16, 6, 0, 0, 0, time.Local)); len(due) != 0 {
+        t.Errorf("disabled schedule due: %+v", due)
+    }
+    list := listSchedules(friday)
+    if len(list) != 3 || list[1].ID != "config-2" || list[1].Error == "" || list[1].NextRun != nil {
+        t.Fatalf("list: %+v", list)
+    }
+    if list[2].Source != "api" || list[2].Enabled || list[0].NextRun == nil {
+        t.Errorf("list: %+v", list)
+    }
+}
+
+func mustCron(t *testing.T, expr string) cronSpec {
+    spec, err := parseCron(expr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return spec
+}
+
+func TestGuardrails(t *testing.T) {
+    limits := GuardrailConfig{MaxGoroutines: 100, MaxHeapMB: 50, MaxPollCycleMs: 3000}
+    if r := starvedReasons(ServerHealth{Goroutines: 90, HeapMB: 40, PollCycleMs: 1200, PollLagMs: 900}, limits); len(r) != 0 {
+        t.Errorf("healthy sample: %v", r)
+    }
+    r := starvedReasons(ServerHealth{Goroutines: 101, HeapMB: 60, PollCycleMs: 2500, PollLagMs: 900}, limits)
+    if len(r) != 3 {
+        t.Errorf("starved sample: %v", r)
+    }
+    if r := starvedReasons(ServerHealth{Goroutines: 1e6, PollCycleMs: 1e6}, GuardrailConfig{MaxGoroutines: -1, MaxPollCycleMs: -1}); len(r) != 0 {
+        t.Errorf("disabled limits: %v", r)
+    }
+
+    // A single bad sample is not enough, and recovery needs a sustained run of good ones
+    var g guardrail
+    starved := []string{"slow"}
+    for i, reasons := range [][]string{starved, nil, starved, starved} {
+        if g.observe(reasons) || g.degraded {
+            t.Fatalf("degraded after sample %d", i)
+        }
+    }
+    if !g.observe(starved) || !g.degraded {
+        t.Fatal("not degraded after three starved samples")
+    }
+    for i := 1; i < recoverAfterSamples; i++ {
+        if g.observe(nil) {
+            t.Fatalf("recovered after %d samples", i)
+        }
+    }
+    if !g.observe(nil) || g.degraded {
+        t.Error("not recovered")
+    }
+
+    var v atomic.Int64
+    for _, n := range []int64{5, 3, 9, 7} {
+        storeMax(&v, n)
+    }
+    if v.Load() != 9 {
+        t.Errorf("storeMax: %d", v.Load())
+    }
+}
+
+func TestSensors(t *testing.T) {
+    good := SensorConfig{Name: "wall-a", IP: "10.0.1.1", Group: "A", RegisterType: "input", Temperature: 1, Humidity: 2}
+    if err := validateSensors([]SensorConfig{good, {Name: "duct", IP: "10.0.1.2", Humidity: 5, HumidityCalc: "/ 100"}}); err != nil {
+        t.Errorf("valid sensors: %v", err)
+    }
+    for name, bad := range map[string][]SensorConfig{
+        "duplicate":     {good, good},
+        "dotted name":   {{Name: "a.b", IP: "10.0.1.1", Temperature: 1}},
+        "no registers":  {{Name: "x", IP: "10.0.1.1"}},
+        "register type": {{Name: "x", IP: "10.0.1.1", Temperature: 1, RegisterType: "coil"}},
+        "calc":          {{Name: "x", IP: "10.0.1.1", Temperature: 1, TempCalc: "/ ("}},
+    } {
+        if err := validateSensors(bad); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+
+    broken := SensorConfig{Name: "wall-b", IP: "10.0.1.3", Temperature: 7}
+    fakes := map[string]*fakeRegisters{
+        "wall-a": {values: map[uint16]uint16{1: 0xFF38, 2: 455}}, // -20.0 °C, 45.5 %RH
+        "wall-b": {values: map[uint16]uint16{}},
+    }
+    savedSensors, savedData := appConfig.Sensors, sensorData
+    appConfig.Sensors = []SensorConfig{good, broken}
+    sensorConnsMu.Lock()
+    for name, f := range fakes {
+        conn := &VFDConnection{client: f}
+        conn.healthy.Store(true)
+        sensorConns[name] = conn
+    }
+    sensorConnsMu.Unlock()
+    defer func() {
+        appConfig.Sensors = savedSensors
+        vfdDataMutex.Lock()
+        sensorData = savedData
+        vfdDataMutex.Unlock()
+        sensorConnsMu.Lock()
+        delete(sensorConns, "wall-a")
+        delete(sensorConns, "wall-b")
+        sensorConnsMu.Unlock()
+    }()
+
+    entries := pollSensors(nil, make(chan struct{}, 2))
+    if entries[0]["status"] != "Online" || entries[0]["temperature"] != -20.0 || entries[0]["humidity"] != 45.5 {
+        t.Errorf("wall-a: %v", entries[0])
+    }
+    if fakes["wall-a"].fc != 4 {
+        t.Errorf("read with function %d, want input registers", fakes["wall-a"].fc)
+    }
+    if entries[1]["status"] != "Unavailable" || entries[1]["temperature"] != nil {
+        t.Errorf("wall-b: %v", entries[1])
+    }
+
+    vfdDataMutex.Lock()
+    sensorData = entries
+    vfdDataMutex.Unlock()
+    if v, ok := sensorValue("wall-a.humidity"); !ok || v != 45.5 {
+        t.Errorf("wall-a.humidity = %v, %v", v, ok)
+    }
+    for _, signal := range []string{"wall-b.temperature", "wall-a.pressure", "wall-c.temperature", "wall-a"} {
+        if _, ok := sensorValue(signal); ok {
+            t.Errorf("%s: got a value", signal)
+        }
+    }
+    entries[0]["lastUpdated"] = time.Now().Add(-time.Minute).Unix()
+    if _, ok := sensorValue("wall-a.temperature"); ok {
+        t.Error("stale reading returned")
+    }
+}
+
+// fakeIO is an I/O module with discrete inputs and coils
+type fakeIO struct {
+    modbus.Client
+    mu     sync.Mutex
+    inputs map[uint16]bool
+    coils  map[uint16]bool
+    writes []string
+}
+
+func (f *fakeIO) ReadDiscreteInputs(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    return []byte{byte(boolToFloat(f.inputs[address]))}, nil
+}
+
+func (f *fakeIO) ReadCoils(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    return []byte{byte(boolToFloat(f.coil(address)))}, nil
+}
+
+func (f *fakeIO) coil(address uint16) bool {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.coils[address]
+}
+
+func (f *fakeIO) WriteSingleCoil(ctx context.Context, address, value uint16) ([]byte, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.coils[address] = value == 0xFF00
+    f.writes = append(f.writes, fmt.Sprintf("%d=%t", address, f.coils[address]))
+    return nil, nil
+}
+
+func TestSensorOutputs(t *testing.T) {
+    io := SensorConfig{Name: "panel", IP: "10.0.1.9", Inputs: map[string]int{"alarm": 0}, Outputs: map[string]SensorOutput{
+        "beacon": {Coil: 0, Follow: "Purge"},
+        "damper": {Coil: 1, Follow: "Running:ahu"},
+        "horn":   {Coil: 2},
+    }}
+    vfds := []DriveConfig{{ID: "f1", IP: "10.0.0.1", Group: "ahu"}}
+    if err := validateSensors([]SensorConfig{io}); err != nil {
+        t.Errorf("valid I/O module: %v", err)
+    }
+    if err := validateSensors([]SensorConfig{{Name: "x", IP: "10.0.1.1", Inputs: map[string]int{"a": 0}, Outputs: map[string]SensorOutput{"a": {}}}}); err == nil {
+        t.Error("output named like an input accepted")
+    }
+    for _, follow := range []string{"Purge", "Alert:DriveTripped", "Running:ahu", "panel.alarm", ""} {
+        if err := validateOutputFollow(follow, vfds); err != nil {
+            t.Errorf("%q: %v", follow, err)
+        }
+    }
+    for _, follow := range []string{"Always", "Alert:Nope", "Running:attic"} {
+        if err := validateOutputFollow(follow, vfds); err == nil {
+            t.Errorf("%q accepted", follow)
+        }
+    }
+
+    savedConfig, savedIPs, savedData, savedSensors := appConfig, ipToDrive, vfdData, sensorData
+    fake := &fakeIO{inputs: map[uint16]bool{0: true}, coils: map[uint16]bool{1: true}}
+    sensorConnsMu.Lock()
+    conn := &VFDConnection{client: fake}
+    conn.healthy.Store(true)
+    sensorConns["panel"] = conn
+    sensorConnsMu.Unlock()
+    eventsMutex.Lock()
+    savedEvents := controlEvents
+    eventsMutex.Unlock()
+    defer func() {
+        appConfig, ipToDrive = savedConfig, savedIPs
+        vfdDataMutex.Lock()
+        vfdData, sensorData = savedData, savedSensors
+        vfdDataMutex.Unlock()
+        sensorConnsMu.Lock()
+        delete(sensorConns, "panel")
+        sensorConnsMu.Unlock()
+        eventsMutex.Lock()
+        controlEvents = savedEvents
+        eventsMutex.Unlock()
+        purgeMu.Lock()
+        purgeState = nil
+        purgeMu.Unlock()
+    }()
+    appConfig = AppConfig{VFDs: vfds, Sensors: []SensorConfig{io}}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0]}
+
+    // Inputs and outputs are read as signals
+    entries := pollSensors(nil, make(chan struct{}, 1))
+    vfdDataMutex.Lock()
+    sensorData = entries
+    vfdDataMutex.Unlock()
+    for signal, want := range map[string]float64{"panel.alarm": 1, "panel.beacon": 0, "panel.damper": 1, "panel.horn": 0} {
+        if v, ok := sensorValue(signal); !ok || v != want {
+            t.Errorf("%s = %v, %v; want %v", signal, v, ok, want)
+        }
+    }
+
+    // Followed outputs are written only when they differ from what they follow
+    purgeMu.Lock()
+    purgeState = &PurgeState{Since: time.Now(), Source: "api"}
+    purgeMu.Unlock()
+    driveSensorOutputs([]map[string]interface{}{{"ip": "10.0.0.1", "status": "Stopped"}})
+    if fmt.Sprint(fake.writes) != "[0=true 1=false]" && fmt.Sprint(fake.writes) != "[1=false 0=true]" {
+        t.Errorf("follow writes: %v", fake.writes)
+    }
+    fake.writes = nil
+    driveSensorOutputs([]map[string]interface{}{{"ip": "10.0.0.1", "status": "Stopped"}})
+    if len(fake.writes) != 0 {
+        t.Errorf("rewritten without a change: %v", fake.writes)
+    }
+
+    // Only outputs without a Follow are set through the API
+    call := func(path, body string) int {
+        rec := httptest.NewRecorder()
+        handleSensorRoutes(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+        return rec.Code
+    }
+    if code := call("/api/sensors/panel/beacon", `{"on": false, "user": "ops"}`); code != http.StatusConflict {
+        t.Errorf("followed output: %d", code)
+    }
+    if code := call("/api/sensors/panel/siren", `{"on": true, "user": "ops"}`); code != http.StatusNotFound {
+        t.Errorf("unknown output: %d", code)
+    }
+    if code := call("/api/sensors/panel/horn", `{"on": true}`); code != http.StatusBadRequest {
+        t.Errorf("no user: %d", code)
+    }
+    if code := call("/api/sensors/panel/horn", `{"on": true, "user": "ops"}`); code != http.StatusOK || !fake.coils[2] {
+        t.Errorf("set horn: %d, coil %v", code, fake.coils[2])
+    }
+    if v, _ := sensorValue("panel.horn"); v != 1 {
+        t.Errorf("live entry not updated: %v", v)
+    }
+}
+
+func TestDampers(t *testing.T) {
+    coil := 4
+    bad := []DriveConfig{
+        {IP: "10.0.0.1", Damper: &DamperConfig{}},
+        {IP: "10.0.0.1", Damper: &DamperConfig{Output: "panel.damper", DriveCoil: &coil}},
+        {IP: "10.0.0.1", Damper: &DamperConfig{Output: "panel.beacon"}},
+        {IP: "10.0.0.1", Damper: &DamperConfig{Output: "panel.nope"}},
+    }
+    io := SensorConfig{Name: "panel", IP: "10.0.1.9", Inputs: map[string]int{"open": 0}, Outputs: map[string]SensorOutput{
+        "damper": {Coil: 1},
+        "beacon": {Coil: 0, Follow: "Purge"},
+    }}
+    for _, d := range bad {
+        if err := validateDampers(AppConfig{VFDs: []DriveConfig{d}, Sensors: []SensorConfig{io}}); err == nil {
+            t.Errorf("%+v accepted", *d.Damper)
+        }
+    }
+
+    savedConfig, savedIPs, savedProfiles, savedConns, savedInterval := appConfig, ipToDrive, driveTypeProfiles, vfdConnections, damperPollInterval
+    vfdDataMutex.Lock()
+    savedSensors := sensorData
+    vfdDataMutex.Unlock()
+    fake := &fakeIO{inputs: map[uint16]bool{}, coils: map[uint16]bool{}}
+    sensorConnsMu.Lock()
+    ioConn := &VFDConnection{client: fake}
+    ioConn.healthy.Store(true)
+    sensorConns["panel"] = ioConn
+    sensorConnsMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive, driveTypeProfiles, vfdConnections, damperPollInterval = savedConfig, savedIPs, savedProfiles, savedConns, savedInterval
+        vfdDataMutex.Lock()
+        sensorData = savedSensors
+        vfdDataMutex.Unlock()
+        sensorConnsMu.Lock()
+        delete(sensorConns, "panel")
+        sensorConnsMu.Unlock()
+    }()
+    damperPollInterval = 10 * time.Millisecond
+    driveTypeProfiles = map[string]DriveTypeProfile{"Plain": {Control: 5, StartValue: 1, StopValue: 0}}
+    appConfig = AppConfig{
+        VFDs:    []DriveConfig{{ID: "f1", IP: "10.0.0.1", DriveType: "Plain", Damper: &DamperConfig{Output: "panel.damper", EndSwitch: "panel.open", OpenSec: 1}}},
+        Sensors: []SensorConfig{io},
+    }
+    if err := validateDampers(appConfig); err != nil {
+        t.Fatalf("valid damper: %v", err)
+    }
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0]}
+    drive := &fakeWrites{}
+    conn := &VFDConnection{ip: "10.0.0.1", client: drive}
+    conn.healthy.Store(true)
+    vfdConnections = map[string]*VFDConnection{"10.0.0.1": conn}
+    setEndSwitch := func(open bool) {
+        vfdDataMutex.Lock()
+        sensorData = []map[string]interface{}{{"name": "panel", "status": "Online", "lastUpdated": time.Now().Unix(), "open": boolToFloat(open), "damper": boolToFloat(fake.coil(1))}}
+        vfdDataMutex.Unlock()
+    }
+
+    // No end-switch feedback: the start fails after OpenSec with the damper commanded open
+    setEndSwitch(false)
+    if err := fanStart("10.0.0.1"); err == nil || len(drive.writes) != 0 || !fake.coil(1) {
+        t.Errorf("start against a closed damper: %v, writes %v, damper %v", err, drive.writes, fake.coil(1))
+    }
+
+    // Feedback: the fan starts
+    setEndSwitch(true)
+    if err := fanStart("10.0.0.1"); err != nil || fmt.Sprint(drive.writes) != "[5=1]" {
+        t.Errorf("start: %v %v", err, drive.writes)
+    }
+
+    // A stop closes the damper, and run commands are refused until it is opened again
+    setEndSwitch(false)
+    if err := fanStop("10.0.0.1"); err != nil {
+        t.Fatalf("stop: %v", err)
+    }
+    if err := damperError("10.0.0.1"); err == nil {
+        t.Error("run allowed after the stop")
+    }
+    for deadline := time.Now().Add(time.Second); fake.coil(1) && time.Now().Before(deadline); {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if fake.coil(1) {
+        t.Error("damper not closed after the stop")
+    }
+}
+
+func TestTrackingHistory(t *testing.T) {
+    ring := &trackingRing{samples: make([]trackingSample, 3)}
+    for i := int64(1); i <= 5; i++ {
+        ring.add(trackingSample{At: i})
+    }
+    if got := ring.between(0, 10); len(got) != 3 || got[0].At != 3 || got[2].At != 5 {
+        t.Errorf("ring after wrapping: %+v", got)
+    }
+    if got := ring.between(4, 4); len(got) != 1 || got[0].At != 4 {
+        t.Errorf("range: %+v", got)
+    }
+
+    // A step from 30 to 40 Hz that settles after 10 s, with the drive 0.2 Hz low otherwise
+    var samples []trackingSample
+    for i, actual := range []float32{29.8, 29.8, 33, 37, 39.8, 39.8} {
+        sp := float32(30)
+        if i >= 2 {
+            sp = 40
+        }
+        samples = append(samples, trackingSample{At: int64(100 + 5*i), Setpoint: sp, Actual: actual, Running: true})
+    }
+    samples = append(samples, trackingSample{At: 130, Setpoint: 0, Actual: 0})
+    stats, steps := trackingStats(samples, 0.5)
+    if stats.Samples != 6 || stats.MaxAbsErrorHz != 7 || stats.MeanErrorHz != -1.8 || stats.WithinTolerance != 0.667 {
+        t.Errorf("stats: %+v", stats)
+    }
+    if len(steps) != 1 || steps[0].FromHz != 30 || steps[0].ToHz != 40 || steps[0].SettledSec == nil || *steps[0].SettledSec != 10 {
+        t.Errorf("steps: %+v", steps)
+    }
+
+    savedConfig, savedIPs := appConfig, ipToDrive
+    historyMu.Lock()
+    savedHistory, savedSampled := trackingHistory, historySampled
+    trackingHistory, historySampled = make(map[string]*trackingRing), time.Time{}
+    historyMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive = savedConfig, savedIPs
+        historyMu.Lock()
+        trackingHistory, historySampled = savedHistory, savedSampled
+        historyMu.Unlock()
+    }()
+    appConfig = AppConfig{History: &HistoryConfig{SampleSec: 5, RetainHours: 1}, VFDs: []DriveConfig{{ID: "f1", IP: "10.0.0.1"}}}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0]}
+    now := time.Now()
+    entry := map[string]interface{}{"ip": "10.0.0.1", "status": "Running", "setSpeed": 40.0, "actualSpeed": 39.5, "current": 12.5}
+    recordHistory([]map[string]interface{}{entry}, now)
+    recordHistory([]map[string]interface{}{entry}, now.Add(time.Second)) // within SampleSec
+    rec := httptest.NewRecorder()
+    handleHistoryRoutes(rec, httptest.NewRequest(http.MethodGet, "/api/history/f1/tracking", nil))
+    var resp struct {
+        ActualHz []float64
+        CurrentA []float64
+        Stats    TrackingStats
+    }
+    json.NewDecoder(rec.Body).Decode(&resp)
+    if rec.Code != http.StatusOK || fmt.Sprint(resp.ActualHz) != "[39.5]" || fmt.Sprint(resp.CurrentA) != "[12.5]" || resp.Stats.MeanErrorHz != -0.5 {
+        t.Errorf("tracking: %d %+v", rec.Code, resp)
+    }
+    rec = httptest.NewRecorder()
+    handleHistoryRoutes(rec, httptest.NewRequest(http.MethodGet, "/api/history/f1/tracking?from=yesterday", nil))
+    if rec.Code != http.StatusBadRequest {
+        t.Errorf("bad from: %d", rec.Code)
+    }
+}
+
+func TestMirror(t *testing.T) {
+    savedConfig := appConfig
+    vfdDataMutex.Lock()
+    savedData, savedSensors := vfdData, sensorData
+    vfdData = []map[string]interface{}{{"id": "f1", "ip": "10.0.0.1", "group": "A", "status": "Running", "actualSpeed": 40.0}}
+    sensorData = nil
+    vfdDataMutex.Unlock()
+    mirrorMu.Lock()
+    savedClients := mirrorClients
+    mirrorClients, mirrorBody = make(map[string]*mirrorBucket), nil
+    mirrorMu.Unlock()
+    defer func() {
+        appConfig = savedConfig
+        vfdDataMutex.Lock()
+        vfdData, sensorData = savedData, savedSensors
+        vfdDataMutex.Unlock()
+        mirrorMu.Lock()
+        mirrorClients, mirrorBody = savedClients, nil
+        mirrorMu.Unlock()
+    }()
+    appConfig = AppConfig{SiteName: "test", Mirror: &MirrorConfig{CacheSec: 60, RatePerMin: 30}}
+
+    get := func(client, etag string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodGet, "/api/mirror", nil)
+        req.RemoteAddr = client + ":40000"
+        if etag != "" {
+            req.Header.Set("If-None-Match", etag)
+        }
+        rec := httptest.NewRecorder()
+        handleMirror(rec, req)
+        return rec
+    }
+    rec := get("192.0.2.1", "")
+    var doc struct {
+        Site   string
+        Drives []map[string]interface{}
+    }
+    json.NewDecoder(rec.Body).Decode(&doc)
+    if rec.Code != http.StatusOK || doc.Site != "test" || len(doc.Drives) != 1 || doc.Drives[0]["actualSpeed"] != 40.0 {
+        t.Fatalf("mirror: %d %+v", rec.Code, doc)
+    }
+    if _, leaked := doc.Drives[0]["ip"]; leaked {
+        t.Error("drive IP published")
+    }
+    etag := rec.Header().Get("ETag")
+    if etag == "" || !strings.HasPrefix(rec.Header().Get("Cache-Control"), "public, max-age=") {
+        t.Errorf("headers: %v", rec.Header())
+    }
+
+    // Cached: a later reading isn't published until CacheSec passes
+    vfdDataMutex.Lock()
+    vfdData[0]["actualSpeed"] = 20.0
+    vfdDataMutex.Unlock()
+    if rec := get("192.0.2.1", etag); rec.Code != http.StatusNotModified {
+        t.Errorf("conditional request: %d", rec.Code)
+    }
+
+    // A burst of 3 (a tenth of 30/min), then 429; other clients are unaffected
+    if rec := get("192.0.2.1", ""); rec.Code != http.StatusOK {
+        t.Errorf("third request: %d", rec.Code)
+    }
+    rec = get("192.0.2.1", "")
+    if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+        t.Errorf("over the limit: %d %v", rec.Code, rec.Header())
+    }
+    if rec := get("192.0.2.2", ""); rec.Code != http.StatusOK {
+        t.Errorf("other client: %d", rec.Code)
+    }
+
+    req := httptest.NewRequest(http.MethodPost, "/api/mirror", nil)
+    rec = httptest.NewRecorder()
+    handleMirror(rec, req)
+    if rec.Code != http.StatusMethodNotAllowed {
+        t.Errorf("POST: %d", rec.Code)
+    }
+}
+
+func TestPolicies(t *testing.T) {
+    contractor := AuthPolicy{Name: "contractors", Who: []string{"contractor-*"}, Actions: []string{"SetSpeed"}, Groups: []string{"TEST"}, Start: "09:00", End: "17:00", MaxDrives: 3}
+    noNight := AuthPolicy{Name: "no-night-stops", Effect: "deny", Who: []string{"*"}, Actions: []string{"Stop"}, Groups: []string{"A"}, Start: "22:00", End: "06:00"}
+    drives := []DriveConfig{{IP: "10.0.0.1", Group: "TEST"}, {IP: "10.0.0.2", Group: "A"}}
+    if err := validatePolicies([]AuthPolicy{contractor, noNight}, drives); err != nil {
+        t.Fatal(err)
+    }
+    for _, bad := range []AuthPolicy{
+        {Name: "x", Who: []string{"["}},
+        {Name: "x", Who: []string{"*"}, Actions: []string{"Explode"}},
+        {Name: "x", Who: []string{"*"}, Start: "09:00"},
+        {Name: "x", Who: []string{"*"}, Effect: "deny", MaxDrives: 2},
+        {Name: "x", Who: []string{"*"}, Groups: []string{"Z"}},
+    } {
+        if validatePolicies([]AuthPolicy{bad}, drives) == nil {
+            t.Errorf("accepted %+v", bad)
+        }
+    }
+
+    day := time.Date(2026, 10, 16, 10, 0, 0, 0, time.Local)
+    night := time.Date(2026, 10, 16, 23, 0, 0, 0, time.Local)
+    list := []AuthPolicy{contractor, noNight}
+    req := func(who, action string, n int, groups []string, at time.Time) PolicyRequest {
+        return PolicyRequest{Who: who, Action: action, Drives: make([]string, n), Groups: groups, At: at}
+    }
+    cases := []struct {
+        req     PolicyRequest
+        allowed bool
+        policy  string
+    }{
+        {req("contractor-acme", "SetSpeed", 2, []string{"TEST"}, day), true, "contractors"},
+        {req("contractor-acme", "SetSpeed", 4, []string{"TEST"}, day), false, ""},
+        {req("contractor-acme", "Stop", 1, []string{"TEST"}, day), false, ""},
+        {req("contractor-acme", "SetSpeed", 1, []string{"TEST", "A"}, day), false, ""},
+        {req("contractor-acme", "SetSpeed", 1, []string{"TEST"}, night), false, ""},
+        {req("ops", "Stop", 5, []string{"B"}, night), true, ""},
+        {req("ops", "Stop", 1, []string{"A", "B"}, night), false, "no-night-stops"},
+        {req("anonymous", "Stop", 1, []string{"A"}, day), true, ""},
+    }
+    for _, c := range cases {
+        dec := evaluatePolicies(list, c.req)
+        if dec.Allowed != c.allowed || dec.Policy != c.policy && !(c.allowed && c.policy == "") {
+            t.Errorf("%+v: %+v", c.req, dec)
+        }
+    }
+    if dec := evaluatePolicies(list, req("ops", "Start", 1, []string{"B"}, day)); !dec.Allowed || dec.Reason != "no allow policy applies to ops" {
+        t.Errorf("unrestricted requester: %+v", dec)
+    }
+
+    // Enforced on /api/control for the token's name
+    savedConfig, savedIPs := appConfig, ipToDrive
+    defer func() { appConfig, ipToDrive = savedConfig, savedIPs }()
+    appConfig = AppConfig{VFDs: drives, Policies: list}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0], "10.0.0.2": &appConfig.VFDs[1]}
+    body := `{"action": "Stop", "drives": ["10.0.0.1"]}`
+    r := httptest.NewRequest(http.MethodPost, "/api/control", strings.NewReader(body))
+    r = r.WithContext(context.WithValue(r.Context(), requesterKey{}, "contractor-acme"))
+    rec := httptest.NewRecorder()
+    handleControl(rec, r)
+    if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "not one of [SetSpeed]") {
+        t.Errorf("control: %d %s", rec.Code, rec.Body.String())
+    }
+
+    // The test endpoint tries a candidate set without deploying it
+    body = `{"who": "contractor-acme", "action": "Stop", "drives": ["10.0.0.1"], "policies": [{"Name": "all", "Who": ["contractor-*"]}]}`
+    rec = httptest.NewRecorder()
+    handlePolicies(rec, httptest.NewRequest(http.MethodPost, "/api/admin/policies/test", strings.NewReader(body)))
+    var resp struct {
+        Request  PolicyRequest
+        Decision PolicyDecision
+    }
+    json.NewDecoder(rec.Body).Decode(&resp)
+    if rec.Code != http.StatusOK || !resp.Decision.Allowed || resp.Decision.Policy != "all" || fmt.Sprint(resp.Request.Groups) != "[TEST]" {
+        t.Errorf("test endpoint: %d %+v", rec.Code, resp)
+    }
+    rec = httptest.NewRecorder()
+    handlePolicies(rec, httptest.NewRequest(http.MethodPost, "/api/admin/policies/test", strings.NewReader(`{"action": "Stop", "groups": ["A"], "at": "`+day.Format(time.RFC3339)+`"}`)))
+    json.NewDecoder(rec.Body).Decode(&resp)
+    if rec.Code != http.StatusOK || resp.Request.Who != "anonymous" || !resp.Decision.Allowed {
+        t.Errorf("anonymous test: %d %+v", rec.Code, resp)
+    }
+    // Schedules run later without a requester, so a restricted token can't use one to get
+    // around its policy: creating or enabling a schedule is checked against its action
+    savedConfigSch, savedAPISch, savedEnabled := configSchedules, apiSchedules, scheduleEnabled
+    defer func() { configSchedules, apiSchedules, scheduleEnabled = savedConfigSch, savedAPISch, savedEnabled }()
+    configSchedules, apiSchedules, scheduleEnabled = []Schedule{{ID: "night-stop", Cron: "0 22 * * *", Action: "Stop", Groups: []string{"TEST"}, Disabled: true}}, nil, map[string]bool{}
+    asContractor := func(method, path, body string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(method, path, strings.NewReader(body))
+        r = r.WithContext(context.WithValue(r.Context(), requesterKey{}, "contractor-acme"))
+        rec := httptest.NewRecorder()
+        switch {
+        case strings.HasPrefix(path, "/api/schedules"):
+            handleSchedules(rec, r)
+        case path == "/api/purge":
+            handlePurge(rec, r)
+        case strings.HasPrefix(path, "/api/config-sync"):
+            handleConfigSync(rec, r)
+        default:
+            handleHand(rec, r)
+        }
+        return rec
+    }
+    rec = asContractor(http.MethodPost, "/api/schedules", `{"id": "sneaky", "cron": "0 3 * * *", "action": "Stop", "groups": ["TEST"]}`)
+    if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "not one of [SetSpeed]") || len(apiSchedules) != 0 {
+        t.Errorf("schedule create: %d %s %v", rec.Code, rec.Body.String(), apiSchedules)
+    }
+    rec = asContractor(http.MethodPut, "/api/schedules/night-stop", `{"enabled": true}`)
+    if _, enabled := scheduleEnabled["night-stop"]; rec.Code != http.StatusForbidden || enabled {
+        t.Errorf("schedule enable: %d %s", rec.Code, rec.Body.String())
+    }
+    if rec = asContractor(http.MethodPost, "/api/hand/10.0.0.1", `{"user": "acme"}`); rec.Code != http.StatusForbidden {
+        t.Errorf("hand: %d %s", rec.Code, rec.Body.String())
+    }
+    // Site-wide and admin routes too: a purge, and approving a config that could replace
+    // the policies themselves
+    appConfig.Purge = &PurgeConfig{Groups: map[string]PurgeAction{"TEST": {}}}
+    appConfig.ConfigSync = &ConfigSyncConfig{URL: "http://config.example"}
+    purgeMu.Lock()
+    savedPurge := purgeState
+    purgeMu.Unlock()
+    rec = asContractor(http.MethodPost, "/api/purge", `{"user": "acme"}`)
+    purgeMu.Lock()
+    started := purgeState != savedPurge
+    purgeMu.Unlock()
+    if rec.Code != http.StatusForbidden || started || !strings.Contains(rec.Body.String(), "action Purge") {
+        t.Errorf("purge: %d %s", rec.Code, rec.Body.String())
+    }
+    rec = asContractor(http.MethodPost, "/api/config-sync/approve", `{"user": "acme", "revision": "abc"}`)
+    if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "action ConfigSync") {
+        t.Errorf("config-sync approve: %d %s", rec.Code, rec.Body.String())
+    }
+    appConfig.Purge, appConfig.ConfigSync = nil, nil
+
+    // Bus control is checked as "nats" and "knx"
+    appConfig.Policies = append(appConfig.Policies, AuthPolicy{Name: "bus", Who: []string{natsRequester}, Actions: []string{"SetSpeed"}})
+    if dec := checkPolicies(natsRequester, "Stop", []string{"10.0.0.1"}, "NATS"); dec.Allowed {
+        t.Errorf("nats Stop: %+v", dec)
+    }
+    if dec := checkPolicies(knxRequester, "Stop", []string{"10.0.0.1"}, "KNX"); !dec.Allowed {
+        t.Errorf("knx Stop: %+v", dec)
+    }
+    if checkAPITokens([]APIToken{{Name: natsRequester, Token: "0123456789abcdef"}}) == nil {
+        t.Error("token named nats accepted")
+    }
+}
+
+func TestDriveIDs(t *testing.T) {
+    n := 0
+    newID := func() string { n++; return fmt.Sprintf("gen-%d", n) }
+    drives := []DriveConfig{
+        {IP: "10.0.0.1", Group: "A", FanNumber: 1},
+        {IP: "10.0.0.2", Group: "A", FanNumber: 2},
+    }
+    assigned, _ := assignDriveIDs(drives, nil, newID)
+    if drives[0].ID != "gen-1" || drives[1].ID != "gen-2" || len(assigned) != 2 {
+        t.Fatalf("first assignment: %+v %+v", drives, assigned)
+    }
+
+    // Renumbered subnet: same slots, new IPs keep their IDs; a config ID wins but is noted
+    renumbered := []DriveConfig{
+        {IP: "10.1.0.1", Group: "A", FanNumber: 1},
+        {IP: "10.1.0.2", Group: "A", FanNumber: 2},
+        {IP: "10.0.0.9", Group: "B", FanNumber: 1},
+    }
+    assigned, notes := assignDriveIDs(renumbered, assigned, newID)
+    if renumbered[0].ID != "gen-1" || renumbered[1].ID != "gen-2" || renumbered[2].ID != "gen-3" || len(assigned) != 3 {
+        t.Errorf("renumbered: %+v", renumbered)
+    }
+    again := []DriveConfig{{ID: "fan-a1", IP: "10.1.0.1", Group: "A", FanNumber: 1}, {IP: "10.1.0.2", Group: "A", FanNumber: 2}}
+    _, notes = assignDriveIDs(again, assigned, newID)
+    if again[0].ID != "fan-a1" || again[1].ID != "gen-2" || len(notes) != 1 || !strings.Contains(notes[0], "gen-1") {
+        t.Errorf("config ID: %+v %v", again, notes)
+    }
+
+    stats := map[string]*DriveStats{"10.1.0.1": {Starts: 3}, "10.0.0.7": {Starts: 1}}
+    if moved := migrateIPKeyedStats(stats, renumbered); moved != 1 || stats["gen-1"].Starts != 3 || stats["10.1.0.1"] != nil || stats["10.0.0.7"] == nil {
+        t.Errorf("migrated %d: %v", moved, stats)
+    }
+
+    if driveRefIP("gen-2", renumbered) != "10.1.0.2" || driveRefIP("10.1.0.2", renumbered) != "10.1.0.2" {
+        t.Error("drive refs not resolved")
+    }
+    event := ControlEvent{Drives: []DriveEventInfo{{ID: "gen-3", IP: "10.0.0.9"}}}
+    if !eventTouchesDrive(event, "gen-3") || eventTouchesDrive(event, "gen-1") {
+        t.Error("event drive filter")
+    }
+}
+
+func TestRotationPlan(t *testing.T) {
+    members := []RotationMember{
+        {ID: "f1", Status: "Running", SetSpeed: 45, RunHours: 900},
+        {ID: "f2", Status: "Running", SetSpeed: 45, RunHours: 1200},
+        {ID: "f3", Status: "Stopped", RunHours: 1500}, // resting
+        {ID: "f4", Status: "Running", SetSpeed: 40, RunHours: 1000},
+        {ID: "f5", Status: "Tripped", RunHours: 10},
+    }
+    standby, returned, duty, err := planRotation(members, []string{"f3"}, 1, nil)
+    if err != nil || fmt.Sprint(standby, returned, duty) != "[f2] [f3] 45" {
+        t.Errorf("rotation: %v %v %v %v", standby, returned, duty, err)
+    }
+    // Resting more fans than are available leaves one on duty: the resting fan returns
+    standby, returned, _, err = planRotation(members, []string{"f3"}, 9, nil)
+    if err != nil || fmt.Sprint(standby, returned) != "[f2 f4 f1] [f3]" {
+        t.Errorf("capped: %v %v %v", standby, returned, err)
+    }
+    standby, returned, _, err = planRotation(members, []string{"f3"}, 1, []string{"f1", "f3"})
+    if err != nil || fmt.Sprint(standby, returned) != "[f1 f3] []" {
+        t.Errorf("manual: %v %v %v", standby, returned, err)
+    }
+    if _, _, _, err := planRotation(members, nil, 1, []string{"f5"}); err == nil {
+        t.Error("tripped fan accepted for standby")
+    }
+    stopped := []RotationMember{{ID: "f1", Status: "Stopped"}, {ID: "f2", Status: "Stopped"}}
+    if _, _, _, err := planRotation(stopped, nil, 1, nil); err == nil {
+        t.Error("stopped group rotated")
+    }
+
+    drives := []DriveConfig{{IP: "10.0.0.1", Group: "A"}, {IP: "10.0.0.2", Group: "A"}, {IP: "10.0.0.3", Group: "B"}}
+    if err := validateRotation([]RotationConfig{{Group: "A", IntervalHours: 12}}, drives); err != nil {
+        t.Errorf("valid rotation: %v", err)
+    }
+    for name, bad := range map[string][]RotationConfig{
+        "unknown group": {{Group: "C"}},
+        "too few":       {{Group: "B"}},
+        "duplicate":     {{Group: "A"}, {Group: "A"}},
+        "all resting":   {{Group: "A", Standby: 2}},
+    } {
+        if err := validateRotation(bad, drives); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+}
+
+func TestNotifications(t *testing.T) {
+    var posts []string
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        user, _, _ := r.BasicAuth()
+        posts = append(posts, r.URL.Path+" "+user+" "+string(body))
+        if strings.Contains(string(body), "fail") {
+            http.Error(w, "nope", http.StatusBadRequest)
+        }
+    }))
+    defer srv.Close()
+    savedBase := twilioAPIBase
+    twilioAPIBase = srv.URL
+    defer func() { twilioAPIBase = savedBase }()
+
+    cfg := &NotificationConfig{
+        Channels: []NotificationChannelConfig{
+            {Name: "teams", Type: "webhook", URL: srv.URL + "/teams", Template: `{"text": {{json .Message}}}`},
+            {Name: "ops", Type: "slack", URL: srv.URL + "/slack"},
+            {Name: "sms", Type: "twilio", Username: "AC1", Password: "tok", From: "+1555", To: []string{"+1666"}},
+        },
+        Routes: []NotificationRoute{
+            {MinSeverity: "critical", Channels: []string{"sms"}},
+            {Groups: []string{"A"}, Channels: []string{"teams", "ops"}},
+        },
+    }
+    built, err := buildNotifiers(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, bad := range map[string]NotificationConfig{
+        "unknown type":     {Channels: []NotificationChannelConfig{{Name: "x", Type: "pager"}}},
+        "missing URL":      {Channels: []NotificationChannelConfig{{Name: "x", Type: "webhook"}}},
+        "template":         {Channels: []NotificationChannelConfig{{Name: "x", Type: "slack", URL: "u", Template: "{{.Nope"}}},
+        "unknown channel":  {Channels: cfg.Channels, Routes: []NotificationRoute{{Channels: []string{"y"}}}},
+        "unknown severity": {Channels: cfg.Channels, Routes: []NotificationRoute{{MinSeverity: "loud", Channels: []string{"ops"}}}},
+    } {
+        if _, err := buildNotifiers(&bad); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+
+    names := []string{"ops", "sms", "teams"}
+    trip := Notification{Site: "S1", Severity: "critical", Kind: "DriveTripped", Group: "A", IP: "10.0.0.1", Message: `Fan 1 "A" tripped`}
+    if got := notificationTargets(cfg.Routes, names, trip); fmt.Sprint(got) != "[sms teams ops]" {
+        t.Errorf("trip routed to %v", got)
+    }
+    if got := notificationTargets(cfg.Routes, names, Notification{Severity: "warning", Kind: "Degraded"}); len(got) != 0 {
+        t.Errorf("site-wide warning routed to %v", got)
+    }
+    if got := notificationTargets(nil, names, trip); len(got) != 3 {
+        t.Errorf("unrouted: %v", got)
+    }
+
+    for _, name := range []string{"teams", "ops", "sms"} {
+        deliverNotification(built[name], trip)
+    }
+    want := []string{
+        `/teams  {"text": "Fan 1 \"A\" tripped"}`,
+        `/slack  {"text":"[S1] critical: Fan 1 \"A\" tripped"}`,
+        `/Accounts/AC1/Messages.json AC1 Body=%5BS1%5D+critical%3A+Fan+1+%22A%22+tripped&From=%2B1555&To=%2B1666`,
+    }
+    if fmt.Sprint(posts) != fmt.Sprint(want) {
+        t.Errorf("posts:\n%v\nwant:\n%v", strings.Join(posts, "\n"), strings.Join(want, "\n"))
+    }
+    deliverNotification(built["ops"], Notification{Severity: "info", Message: "fail"})
+    if d := notificationLast["ops"]; !strings.Contains(d.Error, "400") {
+        t.Errorf("failed delivery recorded as %+v", d)
+    }
+
+    for _, c := range []struct{ prev, status, kind string }{
+        {"", "Tripped", ""}, {"Running", "Tripped", "DriveTripped"}, {"Running", "Unavailable", "DriveUnavailable"},
+        {"Disabled", "Unavailable", ""}, {"Unavailable", "Stopped", "DriveRecovered"}, {"Running", "Stopped", ""},
+    } {
+        if kind, _, _ := driveStatusNotification(c.prev, c.status); kind != c.kind {
+            t.Errorf("%s -> %s: %q, want %q", c.prev, c.status, kind, c.kind)
+        }
+    }
+
+    // MQTT: a broker that accepts the session and captures the PUBLISH
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    published := make(chan []byte, 1)
+    go func() {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        buf := make([]byte, 512)
+        conn.Read(buf) // CONNECT
+        conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+        data, _ := io.ReadAll(conn)
+        published <- data
+    }()
+    ch, err := newMQTTChannel(NotificationChannelConfig{Name: "bus", Broker: ln.Addr().String(), Topic: "site/alerts"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+    defer cancel()
+    if err := ch.Send(ctx, trip, notificationMessage{Body: "hi"}); err != nil {
+        t.Fatal(err)
+    }
+    if got := <-published; !bytes.Equal(got, append(mqttPacket(0x30, append(mqttString("site/alerts"), "hi"...)), 0xE0, 0x00)) {
+        t.Errorf("MQTT publish = % x", got)
+    }
+}
+
+func TestMaintenanceCounters(t *testing.T) {
+    saved := appConfig
+    defer func() { appConfig = saved }()
+    appConfig.MaintenanceRunHours, appConfig.MaintenanceStarts = 1000, 0
+
+    d := DriveConfig{ID: "fan-1", IP: "10.0.0.1", Group: "A", FanNumber: 1, MaintenanceStarts: 50}
+    st := DriveStats{RunSeconds: 1500 * 3600, Starts: 60, ServicedRunSeconds: 600 * 3600, ServicedStarts: 20}
+    m := driveMaintenance(d, st)
+    if m.ServiceRunHours != 900 || m.ServiceStarts != 40 || m.Due || m.LimitRunHours != 1000 || m.LimitStarts != 50 {
+        t.Errorf("not due: %+v", m)
+    }
+
+    st.Starts = 75
+    driveStatsMu.Lock()
+    defer driveStatsMu.Unlock()
+    delete(maintenanceFlagged, d.ID)
+    n := checkMaintenanceLocked(&d, &st)
+    if n == nil || n.Kind != "MaintenanceDue" || !strings.Contains(n.Message, "55 starts since service (limit 50)") {
+        t.Fatalf("due notice: %+v", n)
+    }
+    if checkMaintenanceLocked(&d, &st) != nil {
+        t.Error("notified twice")
+    }
+
+    // Per-drive negative disables the site limit; a reset restarts the counters
+    d.MaintenanceRunHours, d.MaintenanceStarts = -1, -1
+    if m := driveMaintenance(d, DriveStats{RunSeconds: 5000 * 3600}); m.Due || m.LimitRunHours != 0 {
+        t.Errorf("disabled limits: %+v", m)
+    }
+    if r := maintenanceReasons(DriveStats{RunSeconds: 2000 * 3600, ServicedRunSeconds: 2000 * 3600}, 1000, 0); len(r) != 0 {
+        t.Errorf("after reset: %v", r)
+    }
+}
+
+func TestAutoResetPolicy(t *testing.T) {
+    c := &AutoResetConfig{Groups: []string{"A"}, ExcludeFaultCodes: []int{12}}
+    if max, delay := autoResetLimits(c); max != 3 || delay != 30*time.Second {
+        t.Errorf("defaults: %d %v", max, delay)
+    }
+    if !autoResetAppliesTo(c, "A", 4) || autoResetAppliesTo(c, "B", 4) || autoResetAppliesTo(c, "A", 12) {
+        t.Error("group/fault filter")
+    }
+
+    now := time.Now()
+    s := &AutoResetState{Attempts: []time.Time{now.Add(-90 * time.Minute), now.Add(-50 * time.Minute), now.Add(-time.Minute)}}
+    s.pruneAttempts(now)
+    if len(s.Attempts) != 2 {
+        t.Errorf("pruned attempts: %v", s.Attempts)
+    }
+}
+
+func TestAlertLifecycle(t *testing.T) {
+    savedEnabled, savedActive, savedHistory, savedSeq := alertsEnabled, activeAlerts, alertHistory, alertSeq
+    defer func() { alertsEnabled, activeAlerts, alertHistory, alertSeq = savedEnabled, savedActive, savedHistory, savedSeq }()
+    alertsEnabled, activeAlerts, alertHistory, alertSeq = true, make(map[string]*Alert), nil, 0
+
+    now := time.Now()
+    n := Notification{Time: now, Severity: "critical", Kind: "DriveTripped", Group: "A", DriveID: "fan-1", IP: "10.0.0.1", Message: "tripped"}
+    if !trackAlert(&n) || n.AlertID != "1" {
+        t.Fatalf("open: %+v", n)
+    }
+    other := Notification{Time: now, Kind: "DriveRecovered", DriveID: "fan-1"}
+    if !trackAlert(&other) || other.AlertID != "" || len(activeAlerts) != 1 {
+        t.Errorf("non-alert kind: %+v", other)
+    }
+
+    // Unacknowledged: re-sent once the interval passes
+    if due := dueAlerts(now.Add(30*time.Minute), time.Hour); len(due) != 0 {
+        t.Errorf("early renotify: %+v", due)
+    }
+    due := dueAlerts(now.Add(61*time.Minute), time.Hour)
+    if len(due) != 1 || due[0].AlertID != "1" || !strings.HasPrefix(due[0].Message, "Still active") {
+        t.Fatalf("renotify: %+v", due)
+    }
+
+    // Acknowledged: repeats are suppressed until the deadline, then it reopens
+    if _, ok := acknowledgeAlert("1", "pat", "on it", now.Add(4*time.Hour)); !ok {
+        t.Fatal("ack failed")
+    }
+    again := n
+    if trackAlert(&again) {
+        t.Error("acknowledged alert was re-sent")
+    }
+    if due := dueAlerts(now.Add(3*time.Hour), time.Hour); len(due) != 0 {
+        t.Errorf("renotified while acknowledged: %+v", due)
+    }
+    due = dueAlerts(now.Add(5*time.Hour), time.Hour)
+    if len(due) != 1 || !strings.HasPrefix(due[0].Message, "Reopened (acknowledged by pat") || activeAlerts[alertKey("DriveTripped", "fan-1")].Reopened != 1 {
+        t.Fatalf("reopen: %+v", due)
+    }
+
+    // The drive recovering resolves it; unknown IDs can't be acknowledged
+    resolveDriveAlerts([]map[string]interface{}{{"id": "fan-1", "status": "Running"}})
+    if len(activeAlerts) != 0 || len(alertHistory) != 1 || alertHistory[0].ResolvedAt == nil {
+        t.Errorf("resolve: %v %v", activeAlerts, alertHistory)
+    }
+    if _, ok := acknowledgeAlert("1", "pat", "", now); ok {
+        t.Error("acknowledged a resolved alert")
+    }
+}
+
+func TestAirflowReservations(t *testing.T) {
+    drives := []DriveConfig{
+        {IP: "10.0.0.1", Group: "A", RpmToHz: 30, CfmRpm: 10}, // 300 CFM/Hz
+        {IP: "10.0.0.2", Group: "A", RpmToHz: 30, CfmRpm: 10},
+        {IP: "10.0.0.3", Group: "A", RpmToHz: 30, CfmRpm: 10},
+        {IP: "10.0.0.4", Group: "B", RpmToHz: 30, CfmRpm: 10},
+    }
+    live := map[string]map[string]interface{}{
+        "10.0.0.1": {"status": "Running", "setSpeed": 50.0},
+        "10.0.0.2": {"status": "Running", "setSpeed": 30.0},
+        "10.0.0.3": {"status": "Stopped", "setSpeed": 40.0},
+        "10.0.0.4": {"status": "Running", "setSpeed": 60.0},
+    }
+    reservations := map[string]AirflowReservation{"A": {Group: "A", MinCfm: 20000, Source: "greenhouse"}}
+
+    before, after := plannedGroupAirflow(drives, live, "Stop", 0, []string{"10.0.0.2", "10.0.0.4"})
+    if before["A"] != 24000 || after["A"] != 15000 || after["B"] != 0 {
+        t.Fatalf("planned: %v -> %v", before, after)
+    }
+    if c := reservationConflicts(reservations, before, after); len(c) != 1 || !strings.Contains(c[0], "group A would drop to 15000 CFM, below the 20000 CFM reserved by greenhouse") {
+        t.Errorf("conflicts: %v", c)
+    }
+
+    // Raising a short group is allowed even if it stays short
+    live["10.0.0.1"]["setSpeed"] = 20.0
+    before, after = plannedGroupAirflow(drives, live, "Start", 0, []string{"10.0.0.3"})
+    if after["A"] != 27000 || len(reservationConflicts(reservations, before, after)) != 0 {
+        t.Errorf("start: %v -> %v", before, after)
+    }
+    before, after = plannedGroupAirflow(drives, live, "SetSpeed", 35, []string{"10.0.0.1"})
+    if after["A"] != 19500 || len(reservationConflicts(reservations, before, after)) != 0 {
+        t.Errorf("raise while short: %v -> %v", before, after)
+    }
+
+    // Curtailment keeps the biggest drives until the reservation is covered
+    live["10.0.0.1"]["setSpeed"] = 50.0
+    live["10.0.0.3"]["status"] = "Running"
+    keep := reservedDrives(drives, live, reservations)
+    if len(keep) != 2 || !keep["10.0.0.1"] || !keep["10.0.0.3"] {
+        t.Errorf("kept: %v", keep)
+    }
+}
+
+// /api/control and NATS share checkControl: drive IDs resolve, unknown drives and speeds
+// beyond the limits refuse the whole request
+func TestCheckControl(t *testing.T) {
+    savedConfig, savedIPs := appConfig, ipToDrive
+    defer func() { appConfig, ipToDrive = savedConfig, savedIPs }()
+    appConfig = AppConfig{VFDs: []DriveConfig{
+        {ID: "r1f1", IP: "10.0.0.1", Group: "A", MinHz: 10, SoftMaxHz: 50, HardMaxHz: 60},
+        {ID: "r1f2", IP: "10.0.0.2", Group: "A", MinHz: 10},
+    }}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0], "10.0.0.2": &appConfig.VFDs[1]}
+
+    if ips, refused := checkControl("Stop", 0, []string{"r1f1", "10.0.0.2"}, false); refused != nil || fmt.Sprint(ips) != "[10.0.0.1 10.0.0.2]" {
+        t.Errorf("Stop: %v %+v", ips, refused)
+    }
+    if _, refused := checkControl("Stop", 0, []string{"r1f1", "r9f9"}, false); refused == nil || refused.status != http.StatusNotFound || refused.msg != "Unknown drive: r9f9" {
+        t.Errorf("unknown drive: %+v", refused)
+    }
+    if _, refused := checkControl("SetSpeed", 55, []string{"r1f1", "r1f2"}, false); refused == nil || refused.status != http.StatusConflict || len(refused.detail["drives"].([]map[string]interface{})) != 1 {
+        t.Errorf("soft limit: %+v", refused)
+    }
+    if _, refused := checkControl("SetSpeed", 55, []string{"r1f1"}, true); refused != nil {
+        t.Errorf("acknowledged: %+v", refused)
+    }
+    if _, refused := checkControl("SetSpeed", 65, []string{"r1f1"}, true); refused == nil || refused.status != http.StatusBadRequest {
+        t.Errorf("hard limit: %+v", refused)
+    }
+}
+
+func TestReverseDirection(t *testing.T) {
+    coil := 5
+    if (DriveTypeProfile{}).canReverse() || !(DriveTypeProfile{ReverseValue: 2}).canReverse() || (DriveTypeProfile{ReverseCoil: &coil}).canReverse() {
+        t.Error("canReverse")
+    }
+
+    signed := DriveTypeProfile{SignedOutputFreq: true}
+    for _, c := range []struct {
+        profile   DriveTypeProfile
+        direction string
+        clockwise int
+        hz        float64
+        want      bool
+    }{
+        {signed, "forward", 1, 40, false},
+        {signed, "reverse", 0, 40, false},
+        {signed, "reverse", 1, 40, true},
+        {signed, "forward", 0, 40, true},
+        {signed, "reverse", 1, 0, false},             // stopped
+        {DriveTypeProfile{}, "reverse", 1, 40, false}, // no sign reported
+    } {
+        if got := directionMismatch(c.profile, c.direction, c.clockwise, c.hz); got != c.want {
+            t.Errorf("%s clockwise=%d %.0f Hz: mismatch %v", c.direction, c.clockwise, c.hz, got)
+        }
+    }
+
+    setCommandedDirection("10.9.9.9", "reverse")
+    if driveDirection("10.9.9.9") != "reverse" {
+        t.Error("reverse not recorded")
+    }
+    setCommandedDirection("10.9.9.9", "forward")
+    if driveDirection("10.9.9.9") != "forward" {
+        t.Error("forward not recorded")
+    }
+}
+
+func TestQuietHours(t *testing.T) {
+    drives := []DriveConfig{{IP: "10.0.0.1", Group: "A"}, {IP: "10.0.0.2", Group: "B"}}
+    list := []QuietHoursConfig{
+        {Name: "night", Groups: []string{"A"}, Start: "22:00", End: "07:00", MaxHz: 35},
+        {Name: "sunday", Start: "08:00", End: "12:00", Days: []string{"Sun"}, MaxHz: 40},
+    }
+    if err := validateQuietHours(list, drives); err != nil {
+        t.Fatalf("valid: %v", err)
+    }
+    for name, bad := range map[string]QuietHoursConfig{
+        "clock": {Start: "25:00", End: "07:00", MaxHz: 30},
+        "same":  {Start: "07:00", End: "07:00", MaxHz: 30},
+        "hz":    {Start: "22:00", End: "07:00"},
+        "group": {Groups: []string{"C"}, Start: "22:00", End: "07:00", MaxHz: 30},
+        "day":   {Start: "22:00", End: "07:00", Days: []string{"Funday"}, MaxHz: 30},
+    } {
+        if err := validateQuietHours([]QuietHoursConfig{bad}, drives); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+
+    // 2026-10-17 is a Saturday
+    at := func(day, hour, min int) time.Time { return time.Date(2026, 10, day, hour, min, 0, 0, time.Local) }
+    for _, c := range []struct {
+        now   time.Time
+        group string
+        want  float64 // 0: no cap
+    }{
+        {at(17, 21, 59), "A", 0},
+        {at(17, 22, 0), "A", 35},
+        {at(18, 6, 59), "A", 35}, // window opened the evening before
+        {at(18, 7, 0), "A", 0},
+        {at(17, 23, 0), "B", 0},
+        {at(18, 9, 0), "B", 40}, // Sunday only
+        {at(17, 9, 0), "B", 0},
+    } {
+        got, ok := quietHoursCapAt(list, c.group, c.now)
+        if (c.want == 0) == ok || (ok && got.MaxHz != c.want) {
+            t.Errorf("%s group %s: %+v %v, want %v", c.now.Format("Mon 15:04"), c.group, got, ok, c.want)
+        }
+    }
+    if c, _ := quietHoursCapAt(list, "A", at(18, 1, 0)); !c.Until.Equal(at(18, 7, 0)) || c.Rule != "night" {
+        t.Errorf("until: %+v", c)
+    }
+}
+
+func TestJogSettings(t *testing.T) {
+    saved := appConfig
+    defer func() { appConfig = saved }()
+    appConfig.JogHz, appConfig.JogSeconds = 0, 0
+    if hz, dur := jogSettings(&DriveConfig{}); hz != 10 || dur != 10*time.Second {
+        t.Errorf("defaults: %v %v", hz, dur)
+    }
+    appConfig.JogHz, appConfig.JogSeconds = 8, 600
+    if hz, dur := jogSettings(&DriveConfig{JogHz: 15}); hz != 15 || dur != 2*time.Minute {
+        t.Errorf("per drive, capped: %v %v", hz, dur)
+    }
+
+    // A restart mid-jog still stops the drive
+    op := Operation{Kind: "jog", Action: "Stop", Stages: [][]string{{"10.0.0.1"}}, UpdatedAt: time.Now().Add(-time.Minute)}
+    if resume, reason := recoveryPlan(op, time.Now()); !resume {
+        t.Errorf("jog not stopped after restart: %s", reason)
+    }
+}
+
+func TestSpeedPresets(t *testing.T) {
+    drives := []DriveConfig{
+        {ID: "a1", IP: "10.0.0.1", Group: "A"},
+        {ID: "a2", IP: "10.0.0.2", Group: "A"},
+        {ID: "b1", IP: "10.0.0.3", Group: "B", HardMaxHz: 50},
+        {ID: "c1", IP: "10.0.0.4", Group: "C"},
+    }
+    p := SpeedPreset{Name: "Night quiet", Groups: map[string]float64{"A": 30, "B": 0}, Drives: map[string]float64{"a2": 45}}
+    if err := validatePreset(p, drives); err != nil {
+        t.Fatalf("valid: %v", err)
+    }
+    targets := presetTargets(p, drives)
+    if len(targets) != 3 || targets["10.0.0.1"] != 30 || targets["10.0.0.2"] != 45 || targets["10.0.0.3"] != 0 {
+        t.Errorf("targets: %v", targets)
+    }
+    steps := presetSteps(targets)
+    if fmt.Sprint(steps) != "[{SetSpeed 45 [10.0.0.2]} {SetSpeed 30 [10.0.0.1]} {Stop 0 [10.0.0.3]}]" {
+        t.Errorf("steps: %v", steps)
+    }
+
+    for name, bad := range map[string]SpeedPreset{
+        "name":  {Name: "a/b", Groups: map[string]float64{"A": 30}},
+        "empty": {Name: "x"},
+        "group": {Name: "x", Groups: map[string]float64{"Z": 30}},
+        "drive": {Name: "x", Drives: map[string]float64{"nope": 30}},
+        "limit": {Name: "x", Groups: map[string]float64{"B": 55}},
+        "neg":   {Name: "x", Groups: map[string]float64{"A": -1}},
+    } {
+        if err := validatePreset(bad, drives); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+}
+
+func TestSoakTest(t *testing.T) {
+    if err := validateSoakSteps(defaultSoakSteps); err != nil {
+        t.Fatalf("defaults: %v", err)
+    }
+    for name, bad := range map[string]SoakStep{
+        "percent": {Percent: 0, Minutes: 10},
+        "minutes": {Percent: 50, Minutes: 600},
+        "band":    {Percent: 50, Minutes: 10, CurrentMin: 8, CurrentMax: 5},
+    } {
+        if err := validateSoakSteps([]SoakStep{bad}); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+
+    d := &DriveConfig{MinHz: 15, SoftMaxHz: 55}
+    if hz, err := soakStepHz(d, SoakStep{Percent: 50}, false); err != nil || hz != 30 {
+        t.Errorf("50%%: %v %v", hz, err)
+    }
+    if _, err := soakStepHz(d, SoakStep{Percent: 20}, false); err == nil {
+        t.Error("below MinHz accepted")
+    }
+    if _, err := soakStepHz(d, SoakStep{Percent: 100}, false); err == nil {
+        t.Error("soft limit without acknowledge accepted")
+    }
+
+    var current SoakReading
+    for _, v := range []float64{4, 6, 5} {
+        current.add(v)
+    }
+    if current.Min != 4 || current.Max != 6 || current.Avg != 5 || current.Samples != 3 {
+        t.Errorf("reading: %+v", current)
+    }
+    vibration := SoakReading{Max: 2.1, Samples: 3}
+    step := SoakStepResult{SoakStep: SoakStep{CurrentMin: 4, CurrentMax: 6, VibrationMax: 4.5}, Current: &current, Vibration: &vibration}
+    if judgeSoakStep(&step, "fan1.vibration"); step.Result != "pass" {
+        t.Errorf("in band: %s %s", step.Result, step.Reason)
+    }
+    step.CurrentMax = 5.5
+    if judgeSoakStep(&step, "fan1.vibration"); step.Result != "fail" {
+        t.Error("peak current above band passed")
+    }
+    step.CurrentMax, vibration.Max = 6, 7.1
+    if judgeSoakStep(&step, "fan1.vibration"); step.Result != "fail" {
+        t.Error("vibration above band passed")
+    }
+    if judgeSoakStep(&step, ""); step.Result != "pass" {
+        t.Errorf("vibration checked without a signal: %s", step.Reason)
+    }
+
+    if p := soakSampleProblem(map[string]interface{}{"status": "Running", "setSpeed": 30.0}, 30, true); p != "" {
+        t.Errorf("running at speed: %s", p)
+    }
+    if p := soakSampleProblem(map[string]interface{}{"status": "Running", "setSpeed": 20.0}, 30, true); p == "" {
+        t.Error("setpoint changed outside the test not detected")
+    }
+    if p := soakSampleProblem(map[string]interface{}{"status": "Stopped"}, 30, false); p != "" {
+        t.Errorf("still starting: %s", p)
+    }
+    if p := soakSampleProblem(map[string]interface{}{"status": "Tripped", "faultText": "Overcurrent"}, 30, false); p == "" {
+        t.Error("trip not detected")
+    }
+}
+
+func TestExternalSources(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if user, pass, _ := r.BasicAuth(); user != "dcim" || pass != "secret" {
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        w.Write([]byte(`{"plant": {"loadTons": 412.5, "chillers": [{"on": true}]}, "it load": "830.2"}`))
+    }))
+    defer srv.Close()
+
+    c := ExternalSourceConfig{Name: "dcim", URL: srv.URL, Username: "dcim", Password: "secret",
+        Values: map[string]string{"load": "$.plant.loadTons", "chiller1": "$.plant.chillers[0].on", "itKw": "$['it load']"}}
+    if err := validateExternalSources([]ExternalSourceConfig{c}, nil); err != nil {
+        t.Fatalf("valid: %v", err)
+    }
+    values, err := pollExternalSource(context.Background(), c)
+    if err != nil || values["load"] != 412.5 || values["chiller1"] != 1 || values["itKw"] != 830.2 {
+        t.Fatalf("poll: %v %v", values, err)
+    }
+    c.Password = "wrong"
+    if _, err := pollExternalSource(context.Background(), c); err == nil {
+        t.Error("401 accepted")
+    }
+    c.Password = "secret"
+    c.Values = map[string]string{"missing": "$.plant.tons"}
+    if _, err := pollExternalSource(context.Background(), c); err == nil {
+        t.Error("missing field accepted")
+    }
+
+    for name, bad := range map[string]ExternalSourceConfig{
+        "sensor name": {Name: "wall", URL: srv.URL, Values: map[string]string{"v": "$.a"}},
+        "scheme":      {Name: "x", URL: "ftp://host/", Values: map[string]string{"v": "$.a"}},
+        "path":        {Name: "x", URL: srv.URL, Values: map[string]string{"v": "$.a[x]"}},
+        "interval":    {Name: "x", URL: srv.URL, Values: map[string]string{"v": "$.a"}, IntervalSec: 1},
+    } {
+        if err := validateExternalSources([]ExternalSourceConfig{bad}, []SensorConfig{{Name: "wall"}}); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+
+    // Values are signals until they go stale
+    externalMu.Lock()
+    externalStatus["dcim"] = &ExternalSourceStatus{Name: "dcim", Values: map[string]float64{}, maxAge: time.Minute}
+    externalMu.Unlock()
+    defer func() {
+        externalMu.Lock()
+        delete(externalStatus, "dcim")
+        externalMu.Unlock()
+    }()
+    if _, ok := sensorValue("dcim.load"); ok {
+        t.Error("value before the first poll")
+    }
+    recordExternalPoll("dcim", map[string]float64{"load": 412.5}, nil, time.Now())
+    if v, ok := sensorValue("dcim.load"); !ok || v != 412.5 {
+        t.Errorf("signal: %v %v", v, ok)
+    }
+    recordExternalPoll("dcim", nil, fmt.Errorf("timeout"), time.Now())
+    if _, ok := sensorValue("dcim.load"); !ok {
+        t.Error("recent value dropped after one failed poll")
+    }
+    recordExternalPoll("dcim", map[string]float64{"load": 400}, nil, time.Now().Add(-2*time.Minute))
+    if _, ok := sensorValue("dcim.load"); ok {
+        t.Error("stale value returned")
+    }
+}
+
+func TestSetpointWatchdog(t *testing.T) {
+    setpointMu.Lock()
+    savedCmd, savedDrift, savedRe := commandedSpeeds, setpointDrifts, setpointReasserts
+    commandedSpeeds = map[string]commandedSetpoint{"10.0.0.1": {Hz: 45}, "10.0.0.2": {Hz: 30}}
+    setpointDrifts, setpointReasserts = map[string]*SetpointDrift{}, map[string][]time.Time{}
+    setpointMu.Unlock()
+    defer func() {
+        setpointMu.Lock()
+        commandedSpeeds, setpointDrifts, setpointReasserts = savedCmd, savedDrift, savedRe
+        setpointMu.Unlock()
+    }()
+    poll := func(hz1 float64) []map[string]interface{} {
+        return []map[string]interface{}{
+            {"id": "a1", "ip": "10.0.0.1", "group": "A", "status": "Running", "setSpeed": hz1},
+            {"id": "a2", "ip": "10.0.0.2", "group": "A", "status": "Running", "setSpeed": 30.2},
+            {"id": "a3", "ip": "10.0.0.3", "group": "A", "status": "Running", "setSpeed": 10.0}, // never written
+        }
+    }
+    kinds := func(actions []setpointAction) string {
+        var out []string
+        for _, a := range actions {
+            out = append(out, a.kind+" "+a.drift.IP)
+        }
+        return strings.Join(out, ",")
+    }
+    check := func(c *SetpointWatchdogConfig, hz1 float64, at time.Time) string {
+        setpointMu.Lock()
+        defer setpointMu.Unlock()
+        return kinds(checkSetpoints(c, poll(hz1), at))
+    }
+
+    now := time.Now()
+    flag := &SetpointWatchdogConfig{}
+    if got := check(flag, 30, now); got != "" {
+        t.Errorf("unconfirmed drift acted on: %s", got)
+    }
+    if got := check(flag, 30, now.Add(31*time.Second)); got != "flag 10.0.0.1" {
+        t.Errorf("confirmed drift: %q", got)
+    }
+    if got := check(flag, 30, now.Add(time.Minute)); got != "" {
+        t.Errorf("flagged twice: %q", got)
+    }
+    if got := check(flag, 45, now.Add(2*time.Minute)); got != "clear 10.0.0.1" {
+        t.Errorf("back at the commanded speed: %q", got)
+    }
+
+    // Re-assert up to the hourly limit, then flag
+    reassert := &SetpointWatchdogConfig{Mode: "reassert", MaxReassertsPerHour: 2}
+    at := now.Add(10 * time.Minute)
+    check(reassert, 30, at)
+    var got []string
+    for i := 1; i <= 3; i++ {
+        got = append(got, check(reassert, 30, at.Add(time.Duration(i)*31*time.Second)))
+    }
+    if strings.Join(got, ";") != "reassert 10.0.0.1;reassert 10.0.0.1;flag 10.0.0.1" {
+        t.Errorf("reassert sequence: %v", got)
+    }
+}
+
+func TestDCIMLoadFollowing(t *testing.T) {
+    drives := []DriveConfig{
+        {ID: "a1", IP: "10.0.0.1", Group: "A", RpmToHz: 30, CfmRpm: 20, MinHz: 15, SoftMaxHz: 55},
+        {ID: "a2", IP: "10.0.0.2", Group: "A", RpmToHz: 30, CfmRpm: 20},
+        {ID: "b1", IP: "10.0.0.3", Group: "B"},
+    }
+    room := DCIMRoom{Name: "hallA", Path: "$.rooms[0].kw", Group: "A", CfmPerKw: 150, MinCfm: 20000, MaxCfm: 60000}
+    c := &DCIMConfig{URL: "https://dcim.example.com/api/load", Rooms: []DCIMRoom{room}}
+    if err := validateDCIM(c, drives); err != nil {
+        t.Fatalf("valid: %v", err)
+    }
+    sources := externalSources(AppConfig{DCIM: c})
+    if len(sources) != 1 || sources[0].Name != "dcim" || sources[0].Values["hallA"] != "$.rooms[0].kw" {
+        t.Errorf("source: %+v", sources)
+    }
+    for name, bad := range map[string]DCIMRoom{
+        "no cfm":  {Name: "b", Group: "B", CfmPerKw: 100},
+        "ratio":   {Name: "a", Group: "A"},
+        "bands":   {Name: "a", Group: "A", CfmPerKw: 100, MinCfm: 5000, MaxCfm: 1000},
+        "unknown": {Name: "z", Group: "Z", CfmPerKw: 100},
+    } {
+        if err := validateDCIM(&DCIMConfig{Rooms: []DCIMRoom{bad}}, drives); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+
+    // Floor, proportional and ceiling
+    for kw, want := range map[float64]float64{50: 20000, 200: 30000, 1000: 60000} {
+        if got := dcimTargetCfm(room, kw); got != want {
+            t.Errorf("%v kW: %v CFM, want %v", kw, got, want)
+        }
+    }
+    // Two drives give 1200 CFM per Hz
+    saved := appConfig
+    defer func() { appConfig = saved }()
+    appConfig.QuietHours = nil
+    now := time.Now()
+    if hz, note := airflowSpeed("A", drives[:2], 36000, now); hz != 30 || note != "" {
+        t.Errorf("36000 CFM: %v %q", hz, note)
+    }
+    if hz, note := airflowSpeed("A", drives[:2], 90000, now); hz != 55 || note == "" {
+        t.Errorf("above the soft limit: %v %q", hz, note)
+    }
+    if hz, note := airflowSpeed("A", drives[:2], 6000, now); hz != 15 || note == "" {
+        t.Errorf("below MinHz: %v %q", hz, note)
+    }
+}
+
+// lossyGateway acknowledges every write but drops the first drop of them
+type lossyGateway struct {
+    modbus.Client
+    regs   map[uint16]uint16
+    drop   int
+    writes int
+    reads  int
+}
+
+func (g *lossyGateway) WriteSingleRegister(ctx context.Context, address, value uint16) ([]byte, error) {
+    g.writes++
+    if g.writes > g.drop {
+        g.regs[address] = value
+    }
+    return nil, nil
+}
+
+func (g *lossyGateway) ReadHoldingRegisters(ctx context.Context, address, quantity uint16) ([]byte, error) {
+    g.reads++
+    res := make([]byte, 2)
+    binary.BigEndian.PutUint16(res, g.regs[address])
+    return res, nil
+}
+
+func TestSetpointDeadband(t *testing.T) {
+    savedConfig, savedIPs, savedData := appConfig, ipToDrive, vfdData
+    setpointMu.Lock()
+    savedCommanded := commandedSpeeds
+    commandedSpeeds = make(map[string]commandedSetpoint)
+    setpointMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive, vfdData = savedConfig, savedIPs, savedData
+        setpointMu.Lock()
+        commandedSpeeds = savedCommanded
+        setpointMu.Unlock()
+    }()
+    appConfig = AppConfig{SetpointDeadbandHz: 0.2, VFDs: []DriveConfig{{IP: "10.0.0.1"}, {IP: "10.0.0.2", SetpointDeadbandHz: -1}}}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0], "10.0.0.2": &appConfig.VFDs[1]}
+    vfdData = []map[string]interface{}{
+        {"ip": "10.0.0.1", "status": "Running", "setSpeed": 40.0},
+        {"ip": "10.0.0.2", "status": "Running", "setSpeed": 40.0},
+    }
+    profile := DriveTypeProfile{Setpoint: []int{1}, SetFreqCalc: "* 10"}
+    write := func(ip string, hz float64) string {
+        f := &fakeWrites{}
+        if err := writeSpeedReference(&VFDConnection{ip: ip, client: f}, profile, hz); err != nil {
+            t.Fatalf("%s %.2f: %v", ip, hz, err)
+        }
+        return fmt.Sprint(f.writes)
+    }
+
+    if got := write("10.0.0.1", 40.1); got != "[]" {
+        t.Errorf("within the deadband: %s", got)
+    }
+    if got := write("10.0.0.1", 40.4); got != "[1=404]" {
+        t.Errorf("outside the deadband: %s", got)
+    }
+    // The poll still shows 40 Hz, but the last write was 40.4
+    if got := write("10.0.0.1", 40.1); got != "[1=401]" {
+        t.Errorf("change back before the poll: %s", got)
+    }
+    if got := write("10.0.0.2", 40.1); got != "[1=401]" {
+        t.Errorf("drive with the deadband off: %s", got)
+    }
+    vfdData[0]["status"] = "Unavailable"
+    setpointMu.Lock()
+    delete(commandedSpeeds, "10.0.0.1")
+    setpointMu.Unlock()
+    if got := write("10.0.0.1", 40.1); got != "[1=401]" {
+        t.Errorf("no current setpoint: %s", got)
+    }
+
+    cfg := AppConfig{SetpointDeadbandHz: 0.5, SetpointWatchdog: &SetpointWatchdogConfig{ToleranceHz: 0.5}}
+    if err := validateFeatures(cfg); err == nil {
+        t.Error("deadband as wide as the watchdog tolerance accepted")
+    }
+    cfg.SetpointDeadbandHz = 0.2
+    if err := validateFeatures(cfg); err != nil {
+        t.Errorf("valid deadband: %v", err)
+    }
+}
+
+func TestWriteVerify(t *testing.T) {
+    saved := appConfig
+    defer func() { appConfig = saved }()
+    appConfig.WriteVerify = &WriteVerifyConfig{Retries: 2, DelayMs: 1}
+    profile := DriveTypeProfile{}
+
+    g := &lossyGateway{regs: map[uint16]uint16{}, drop: 1}
+    if err := writeRegisterVerified(&VFDConnection{client: g}, profile, "Setpoint", 1, 450); err != nil || g.writes != 2 || g.regs[1] != 450 {
+        t.Errorf("dropped once: err=%v writes=%d", err, g.writes)
+    }
+    g = &lossyGateway{regs: map[uint16]uint16{}, drop: 10}
+    err := writeRegisterVerified(&VFDConnection{client: g}, profile, "Control", 0, 1)
+    if !errors.Is(err, errWriteNotVerified) || g.writes != 3 {
+        t.Errorf("never lands: err=%v writes=%d", err, g.writes)
+    }
+
+    // Kinds the profile excludes, and no WriteVerify, are written once without a read
+    g = &lossyGateway{regs: map[uint16]uint16{}, drop: 10}
+    profile.NoReadBack = []string{"Control"}
+    if err := writeRegisterVerified(&VFDConnection{client: g}, profile, "Control", 0, 1); err != nil || g.reads != 0 {
+        t.Errorf("NoReadBack: err=%v reads=%d", err, g.reads)
+    }
+    appConfig.WriteVerify = nil
+    if err := writeRegisterVerified(&VFDConnection{client: g}, DriveTypeProfile{}, "Setpoint", 1, 450); err != nil || g.reads != 0 {
+        t.Errorf("disabled: err=%v reads=%d", err, g.reads)
+    }
+}
+
+func TestTagout(t *testing.T) {
+    savedIPs, savedData := ipToDrive, vfdData
+    tagoutsMu.Lock()
+    savedTags := tagouts
+    tagouts = map[string]Tagout{"a1": {User: "sam", Reason: "belt change", SetAt: time.Now()}}
+    tagoutsMu.Unlock()
+    defer func() {
+        ipToDrive, vfdData = savedIPs, savedData
+        tagoutsMu.Lock()
+        tagouts = savedTags
+        tagoutsMu.Unlock()
+    }()
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": {ID: "a1", IP: "10.0.0.1"}, "10.0.0.2": {ID: "a2", IP: "10.0.0.2"}}
+    vfdData = []map[string]interface{}{{"id": "a1", "ip": "10.0.0.1", "status": "Unavailable"}}
+
+    if err := tagoutError("10.0.0.2"); err != nil {
+        t.Errorf("untagged drive refused: %v", err)
+    }
+    // Writes are refused with the tag as the reason, even on the direct write path
+    if _, _, err := getConnAndProfile("10.0.0.1"); err == nil || !strings.Contains(err.Error(), "belt change") {
+        t.Errorf("getConnAndProfile: %v", err)
+    }
+    event := executeConcurrently("Stop", 0, []string{"10.0.0.1"}, false)
+    if len(event.Drives) != 1 || event.Drives[0].Success || !strings.Contains(event.Drives[0].Error, "tagged out for maintenance") {
+        t.Errorf("Stop on a tagged drive: %+v", event.Drives)
+    }
+    // An offline tagged drive is refused rather than queued
+    if online, queued := queueOfflineDrives("Start", 0, false, []string{"10.0.0.1"}, time.Minute, time.Now()); len(online) != 1 || len(queued) != 0 {
+        t.Errorf("queued a tagged drive: online=%v queued=%v", online, queued)
+    }
+
+    // The setpoint watchdog leaves tagged drives alone
+    setpointMu.Lock()
+    savedCmd, savedDrift := commandedSpeeds, setpointDrifts
+    commandedSpeeds = map[string]commandedSetpoint{"10.0.0.1": {Hz: 45}}
+    setpointDrifts = map[string]*SetpointDrift{}
+    snapshot := []map[string]interface{}{{"id": "a1", "ip": "10.0.0.1", "status": "Running", "setSpeed": 20.0, "tagout": tagouts["a1"]}}
+    actions := checkSetpoints(&SetpointWatchdogConfig{ConfirmSec: 1}, snapshot, time.Now())
+    actions = append(actions, checkSetpoints(&SetpointWatchdogConfig{ConfirmSec: 1}, snapshot, time.Now().Add(time.Minute))...)
+    commandedSpeeds, setpointDrifts = savedCmd, savedDrift
+    setpointMu.Unlock()
+    if len(actions) != 0 {
+        t.Errorf("watchdog acted on a tagged drive: %+v", actions)
+    }
+}
+
+func TestCurtailRequest(t *testing.T) {
+    past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+    future := time.Now().Add(time.Hour).Format(time.RFC3339)
+    for name, body := range map[string]string{
+        "both":         `{"action": "curtail", "minutes": 30, "resumeAt": "` + future + `"}`,
+        "past":         `{"action": "curtail", "resumeAt": "` + past + `"}`,
+        "negative":     `{"action": "curtail", "minutes": -5}`,
+        "on a resume":  `{"action": "resume", "minutes": 30}`,
+        "hz and %":     `{"action": "curtail", "targetHz": 30, "percent": 50}`,
+        "100%":         `{"action": "curtail", "percent": 100}`,
+        "hz to resume": `{"action": "resume", "targetHz": 30}`,
+        "rotate resume": `{"action": "resume", "rotateMinutes": 15}`,
+        "count alone":   `{"action": "curtail", "groups": ["A", "B"], "rotateCount": 1}`,
+        "one group":     `{"action": "curtail", "groups": ["A"], "rotateMinutes": 15}`,
+        "all at once":   `{"action": "curtail", "groups": ["A", "B"], "rotateMinutes": 15, "rotateCount": 2}`,
+        "repeated":      `{"action": "curtail", "groups": ["A", "B", "A"], "rotateMinutes": 15}`,
+        "kw and %":      `{"action": "curtail", "shedKW": 20, "percent": 50}`,
+        "negative kw":   `{"action": "curtail", "shedKW": -20}`,
+        "kw to resume":  `{"action": "resume", "shedKW": 20}`,
+        "rolling kw":    `{"action": "curtail", "groups": ["A", "B"], "shedKW": 20, "rotateMinutes": 15}`,
+    } {
+        rec := httptest.NewRecorder()
+        handleCurtail(rec, httptest.NewRequest(http.MethodPost, "/api/curtail", strings.NewReader(body)))
+        if rec.Code != http.StatusBadRequest {
+            t.Errorf("%s: %d", name, rec.Code)
+        }
+    }
+    // No saved state, nothing to resume
+    checkCurtailmentResume(time.Now())
+    for name, c := range map[string]struct {
+        method, path, body string
+        code               int
+    }{
+        "bad id":      {http.MethodPost, "/api/curtail", `{"action": "curtail", "id": "a/b"}`, http.StatusBadRequest},
+        "resume none": {http.MethodPost, "/api/curtail", `{"action": "resume"}`, http.StatusNotFound},
+        "unknown":     {http.MethodPost, "/api/curtail", `{"action": "resume", "id": "utility"}`, http.StatusNotFound},
+        "post to id":  {http.MethodPost, "/api/curtail/utility", `{"action": "resume"}`, http.StatusMethodNotAllowed},
+        "get none":    {http.MethodGet, "/api/curtail/utility", "", http.StatusNotFound},
+        "latest none": {http.MethodGet, "/api/curtail", "", http.StatusNotFound},
+        "list":        {http.MethodGet, "/api/curtail/sessions", "", http.StatusOK},
+        "reserved id": {http.MethodPost, "/api/curtail", `{"action": "curtail", "id": "sessions"}`, http.StatusBadRequest},
+    } {
+        rec := httptest.NewRecorder()
+        handleCurtail(rec, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+        if rec.Code != c.code || (name == "list" && strings.TrimSpace(rec.Body.String()) != "[]") {
+            t.Errorf("%s: %d %s", name, rec.Code, rec.Body.String())
+        }
+    }
+
+    // Sessions: each drive belongs to one, and a resume without an ID needs a single one
+    t0 := time.Now()
+    sessions := map[string]*CurtailmentState{
+        "utility":     {ID: "utility", Timestamp: t0, Drives: []CurtailedDriveState{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}}},
+        "maintenance": {ID: "maintenance", Timestamp: t0.Add(-time.Minute), Drives: []CurtailedDriveState{{IP: "10.0.0.4"}}},
+    }
+    if by := curtailedBy(sessions); len(by) != 3 || by["10.0.0.2"] != "utility" || by["10.0.0.4"] != "maintenance" {
+        t.Errorf("curtailedBy: %v", by)
+    }
+    if list := sortedCurtailments(sessions); list[0].ID != "maintenance" || list[1].ID != "utility" {
+        t.Errorf("not oldest first: %s, %s", list[0].ID, list[1].ID)
+    }
+    if _, err := resumeTarget(sessions, ""); err == nil || !strings.Contains(err.Error(), "(maintenance, utility)") {
+        t.Errorf("resume without an id: %v", err)
+    }
+    if id, err := resumeTarget(sessions, "utility"); id != "utility" || err != nil {
+        t.Errorf("resume utility: %q %v", id, err)
+    }
+    delete(sessions, "utility")
+    if id, err := resumeTarget(sessions, ""); id != "maintenance" || err != nil {
+        t.Errorf("resume the only one: %q %v", id, err)
+    }
+
+    // Partial curtailment lowers speeds, never below MinHz and never up
+    d := &DriveConfig{MinHz: 20}
+    for _, c := range []struct {
+        target CurtailTarget
+        hz     float64
+        want   float64
+    }{
+        {CurtailTarget{Hz: 35}, 50, 35},
+        {CurtailTarget{Hz: 35}, 30, 30},
+        {CurtailTarget{Hz: 10}, 50, 20},
+        {CurtailTarget{Percent: 70}, 45, 31.5},
+        {CurtailTarget{Percent: 30}, 45, 20},
+    } {
+        if got := c.target.reducedSpeed(d, c.hz); got != c.want {
+            t.Errorf("%+v from %.1f Hz: %.2f, want %.2f", c.target, c.hz, got, c.want)
+        }
+    }
+
+    // Power target: both drives slow to the same fraction of their speed, b2 no lower than
+    // its MinHz, so a1 makes up the rest; the stopped drive is left alone
+    orig, savedIPs, savedData := appConfig, ipToDrive, vfdData
+    defer func() { appConfig, ipToDrive, vfdData = orig, savedIPs, savedData }()
+    appConfig = AppConfig{VFDs: []DriveConfig{{IP: "10.0.0.1", MinHz: 20}, {IP: "10.0.0.2", MinHz: 47}, {IP: "10.0.0.3"}}}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0], "10.0.0.2": &appConfig.VFDs[1], "10.0.0.3": &appConfig.VFDs[2]}
+    plan := func() []CurtailedDriveState {
+        return []CurtailedDriveState{
+            {IP: "10.0.0.1", SetSpeed: 50, Status: "Running", PowerKW: 10},
+            {IP: "10.0.0.2", SetSpeed: 50, Status: "Running", PowerKW: 10},
+            {IP: "10.0.0.3", SetSpeed: 40, Status: "Stopped"},
+        }
+    }
+    drives := plan()
+    if est := planShed(drives, 5); est < 5 || est > 5.5 || drives[0].ReducedHz <= 43 || drives[0].ReducedHz >= 44.5 || drives[1].ReducedHz != 47 || drives[2].ReducedHz != 0 {
+        t.Errorf("shed 5 kW: %.2f kW, %+v", est, drives)
+    }
+    // More than the drives can give at MinHz: all at their floor, reporting the shortfall
+    drives = plan()
+    if est := planShed(drives, 40); math.Abs(est-11.05) > 0.01 || drives[0].ReducedHz != 20 || drives[1].ReducedHz != 47 {
+        t.Errorf("shed 40 kW: %.2f kW, %+v", est, drives)
+    }
+    vfdData = []map[string]interface{}{
+        {"ip": "10.0.0.1", "status": "Running", "power": 1.0},
+        {"ip": "10.0.0.2", "status": "Running", "power": 7.5},
+    }
+    if got := measuredShed(&CurtailmentState{Drives: drives}); got != 11.5 {
+        t.Errorf("measured shed: %.2f", got)
+    }
+
+    // Critical drives are never captured, whether or not they are online
+    appConfig.VFDs[1].NeverCurtail = true
+    captured, skipped := captureCurtailment("utility", appConfig.VFDs, nil)
+    if len(captured) != 1 || captured[0].IP != "10.0.0.1" || fmt.Sprint(skipped.Critical) != "[10.0.0.2]" {
+        t.Errorf("captured %+v, skipped %+v", captured, skipped)
+    }
+    if infos := skipped.events(); len(infos) != 1 || infos[0].Warning != "critical; never curtailed" {
+        t.Errorf("events: %+v", infos)
+    }
+
+    // Rolling curtailment: two of three groups at a time, wrapping around
+    rot := CurtailRotation{Groups: []string{"A", "B", "C"}, Count: 2}
+    if got := fmt.Sprint(rot.active(0), rot.active(2), rot.active(1)); got != "[A B] [C A] [B C]" {
+        t.Errorf("turns: %s", got)
+    }
+    curtailed := []CurtailedDriveState{{IP: "10.0.0.1", Group: "A"}, {IP: "10.0.0.2", Group: "B"}}
+    staying, leaving := splitCurtailed(curtailed, rot.active(2))
+    if len(staying) != 1 || staying[0].Group != "A" || len(leaving) != 1 || leaving[0].Group != "B" {
+        t.Errorf("from [A B] to [C A]: staying %+v, leaving %+v", staying, leaving)
+    }
+}
+
+func TestCurtailHistory(t *testing.T) {
+    t0 := time.Date(2026, 7, 1, 14, 0, 0, 0, time.UTC)
+    turnEnd := t0.Add(30 * time.Minute)
+    state := &CurtailmentState{
+        ID: "utility", User: "dispatch", Timestamp: t0, Groups: []string{"A", "B"}, Target: &CurtailTarget{Percent: 50},
+        Rotation: &CurtailRotation{Groups: []string{"A", "B"}, Count: 1, EveryMin: 30},
+        // A's turn is over; B has been slowed to half speed since
+        Past:   []CurtailedDriveState{{IP: "10.0.0.1", Group: "A", SetSpeed: 50, Status: "Running", ReducedHz: 25, PowerKW: 16, Since: t0, Until: &turnEnd}},
+        Drives: []CurtailedDriveState{{IP: "10.0.0.2", Group: "B", SetSpeed: 40, Status: "Running", ReducedHz: 20, PowerKW: 8, Since: turnEnd}, {IP: "10.0.0.3", Group: "B", SetSpeed: 40, Status: "Stopped"}},
+    }
+    rec := curtailRecord(state, t0.Add(time.Hour))
+    // A: 16 kW × (1 − ½³) = 14 kW for half an hour; B: 7 kW for half an hour; the stopped drive sheds nothing
+    if rec.DurationSec != 3600 || rec.ShedKW != 7 || rec.EnergySavedKWh != 10.5 || !rec.Rolling || len(rec.Drives) != 3 || rec.EndedAt != nil {
+        t.Errorf("record: %+v", rec)
+    }
+    if d := rec.Drives[0]; d.ShedKW != 14 || d.EnergySavedKWh != 7 || !d.Until.Equal(turnEnd) || d.BeforeHz != 50 || d.AfterHz != 25 {
+        t.Errorf("finished turn: %+v", d)
+    }
+    if d := rec.Drives[2]; d.ShedKW != 0 || d.EnergySavedKWh != 0 {
+        t.Errorf("stopped drive: %+v", d)
+    }
+
+    // Filed records, newest first, filtered by time and group
+    ended, olderEnded := t0.Add(time.Hour), t0.AddDate(0, -1, 0).Add(time.Hour)
+    older := CurtailRecord{ID: "june", Groups: []string{"C"}, StartedAt: t0.AddDate(0, -1, 0), EndedAt: &olderEnded, EnergySavedKWh: 2}
+    rec.EndedAt = &ended
+    records := []CurtailRecord{older, rec}
+    if view := curtailHistoryView(records, time.Time{}, time.Time{}, ""); len(view) != 2 || view[0].ID != "utility" {
+        t.Errorf("all: %+v", view)
+    }
+    if view := curtailHistoryView(records, t0.AddDate(0, 0, -1), time.Time{}, ""); len(view) != 1 || view[0].ID != "utility" {
+        t.Errorf("since: %+v", view)
+    }
+    if view := curtailHistoryView(records, time.Time{}, time.Time{}, "C"); len(view) != 1 || view[0].ID != "june" {
+        t.Errorf("group: %+v", view)
+    }
+
+    curtailHistoryMu.Lock()
+    saved := curtailHistory
+    curtailHistory = records
+    path := filepath.Join(t.TempDir(), "curtail_history.json")
+    err := saveCurtailHistoryLocked(path)
+    curtailHistory = nil
+    curtailHistoryMu.Unlock()
+    defer func() {
+        curtailHistoryMu.Lock()
+        curtailHistory = saved
+        curtailHistoryMu.Unlock()
+    }()
+    loadCurtailHistory(path)
+    if _, statErr := os.Stat(path + ".tmp"); err != nil || !os.IsNotExist(statErr) || len(curtailHistory) != 2 || curtailHistory[1].ID != "utility" {
+        t.Errorf("saved history: %v %v %d records", err, statErr, len(curtailHistory))
+    }
+    rec2 := httptest.NewRecorder()
+    handleCurtailHistory(rec2, httptest.NewRequest(http.MethodGet, "/api/curtail/history?group=A", nil))
+    var body struct {
+        Count          int     `json:"count"`
+        EnergySavedKWh float64 `json:"energySavedKWh"`
+    }
+    if err := json.Unmarshal(rec2.Body.Bytes(), &body); err != nil || body.Count != 1 || body.EnergySavedKWh != 10.5 {
+        t.Errorf("history: %v %s", err, rec2.Body.String())
+    }
+    rec2 = httptest.NewRecorder()
+    handleCurtailHistory(rec2, httptest.NewRequest(http.MethodGet, "/api/curtail/history?since=yesterday", nil))
+    if rec2.Code != http.StatusBadRequest {
+        t.Errorf("bad since: %d", rec2.Code)
+    }
+}
+
+func TestSourceArbitration(t *testing.T) {
+    savedIPs := ipToDrive
+    handMu.Lock()
+    savedHand := handModes
+    handModes = map[string]HandMode{"a1": {User: "sam", Since: time.Now()}}
+    handMu.Unlock()
+    defer func() {
+        ipToDrive = savedIPs
+        handMu.Lock()
+        handModes = savedHand
+        handMu.Unlock()
+    }()
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": {ID: "a1", IP: "10.0.0.1"}, "10.0.0.2": {ID: "a2", IP: "10.0.0.2"}, "10.0.0.3": {ID: "a3", IP: "10.0.0.3"}}
+    curtailed := map[string]bool{"10.0.0.2": true}
+
+    // The operator outranks everything; a drive in hand holds off every other source
+    for _, source := range []int{sourceOperator, sourceCurtailment, sourceSchedule, sourceAutomation} {
+        if got := sourceHold(source, "10.0.0.1", curtailed); (got != "") != (source > sourceOperator) || (got != "" && !strings.Contains(got, "in hand (sam")) {
+            t.Errorf("source %d on a drive in hand: %q", source, got)
+        }
+    }
+    // Curtailment holds off schedules and automation, but not the operator
+    for _, source := range []int{sourceOperator, sourceCurtailment, sourceSchedule, sourceAutomation} {
+        if got := sourceHold(source, "10.0.0.2", curtailed); (got == "curtailed") != (source > sourceCurtailment) {
+            t.Errorf("source %d on a curtailed drive: %q", source, got)
+        }
+    }
+
+    allowed, held := arbitrate(sourceSchedule, []string{"10.0.0.1", "10.0.0.3"})
+    if len(allowed) != 1 || allowed[0] != "10.0.0.3" || len(held) != 1 || held[0].ID != "a1" || held[0].Success || !strings.HasPrefix(held[0].Error, "held: in hand") {
+        t.Errorf("arbitrate: allowed=%v held=%+v", allowed, held)
+    }
+    if allowed, held := arbitrate(sourceOperator, []string{"10.0.0.1"}); len(allowed) != 1 || len(held) != 0 {
+        t.Errorf("operator held off: allowed=%v held=%+v", allowed, held)
+    }
+
+    // Releasing to auto reports the previous claim
+    if old, was := setHand("a1", false, HandMode{}); !was || old.User != "sam" {
+        t.Errorf("release: %+v %v", old, was)
+    }
+    if got := sourceHold(sourceAutomation, "10.0.0.1", nil); got != "" {
+        t.Errorf("drive back in auto still held: %q", got)
+    }
+}
+
+func TestSharding(t *testing.T) {
+    drives := []DriveConfig{
+        {ID: "a1", IP: "10.0.0.1", Group: "A"},
+        {ID: "b1", IP: "10.0.0.2", Group: "B"},
+        {ID: "b2", IP: "10.0.0.3", Group: "B"},
+        {ID: "c1", IP: "10.0.0.4", Group: "C"},
+    }
+    c := &ShardingConfig{Self: "fe", FrontEnd: "fe", Shards: []ShardConfig{
+        {Name: "fe", URL: "http://fe", Groups: []string{"A"}},
+        {Name: "s1", URL: "http://s1", Groups: []string{"B"}, Drives: []string{"c1"}},
+        {Name: "s2", URL: "http://s2", Drives: []string{"10.0.0.3"}},
+    }}
+    if err := validateSharding(c, drives); err != nil {
+        t.Fatalf("valid config: %v", err)
+    }
+    for _, bad := range []*ShardingConfig{
+        {Self: "x", FrontEnd: "fe", Shards: c.Shards},
+        {Self: "fe", FrontEnd: "fe", Shards: []ShardConfig{{Name: "fe", URL: "http://fe", Drives: []string{"nope"}}}},
+        {Self: "fe", FrontEnd: "fe", Shards: []ShardConfig{{Name: "fe", URL: "http://fe", Groups: []string{"A"}}, {Name: "s1", URL: "http://s1", Groups: []string{"A"}}}},
+    } {
+        if validateSharding(bad, drives) == nil {
+            t.Errorf("accepted %+v", bad)
+        }
+    }
+
+    // Drives win over groups; unclaimed drives go to the front-end; a down shard's drives
+    // pass to the next shard that is up, wrapping around the list
+    owners := func(down ...string) string {
+        var out []string
+        for _, d := range drives {
+            out = append(out, shardOwner(c, d, func(name string) bool { return !containsString(down, name) }))
+        }
+        return strings.Join(out, ",")
+    }
+    if got := owners(); got != "fe,s1,s2,s1" {
+        t.Errorf("owners = %s", got)
+    }
+    if got := owners("s1"); got != "fe,s2,s2,s2" {
+        t.Errorf("s1 down: %s", got)
+    }
+    if got := owners("s2"); got != "fe,s1,fe,s1" {
+        t.Errorf("s2 down: %s", got)
+    }
+
+    // The front-end takes a shard's drives from its /api/devices and forwards their commands
+    savedConfig, savedIPs, savedData := appConfig, ipToDrive, vfdData
+    shardsMu.Lock()
+    savedSeen, savedDevices, savedUp := shardLastSeen, shardDevices, shardWasUp
+    shardLastSeen, shardDevices, shardWasUp = map[string]time.Time{}, map[string]map[string]interface{}{}, map[string]bool{"s1": true}
+    shardsMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive, vfdData = savedConfig, savedIPs, savedData
+        shardsMu.Lock()
+        shardLastSeen, shardDevices, shardWasUp = savedSeen, savedDevices, savedUp
+        shardsMu.Unlock()
+    }()
+    appConfig = AppConfig{VFDs: drives, Sharding: c}
+    ipToDrive = make(map[string]*DriveConfig)
+    for i := range appConfig.VFDs {
+        ipToDrive[appConfig.VFDs[i].IP] = &appConfig.VFDs[i]
+    }
+    recordShardHeartbeat(c, "s1", []map[string]interface{}{
+        {"ip": "10.0.0.2", "shard": "s1", "status": "Running", "actualSpeed": 42.0, "rpmSpeed": 1260.0, "lastUpdated": 1700000000.0, "stats": "dropped"},
+        {"ip": "10.0.0.3", "shard": "s2", "status": "Remote"},
+    }, nil, time.Now())
+    entry := map[string]interface{}{"ip": "10.0.0.2", "faultCode": 3}
+    applyShardEntry(entry, "10.0.0.2", "s1")
+    if entry["status"] != "Running" || entry["rpmSpeed"] != 1260 || entry["lastUpdated"] != int64(1700000000) || entry["stats"] != nil || entry["faultCode"] != nil {
+        t.Errorf("merged entry = %v", entry)
+    }
+    entry = map[string]interface{}{"ip": "10.0.0.3"}
+    applyShardEntry(entry, "10.0.0.3", "s2")
+    if entry["status"] != "Unavailable" {
+        t.Errorf("entry s1 only reported as Remote = %v", entry)
+    }
+    local, remote := splitByShard([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"})
+    if strings.Join(local, ",") != "10.0.0.1" || strings.Join(remote["s1"], ",") != "10.0.0.2,10.0.0.4" || len(remote["s2"]) != 1 {
+        t.Errorf("split: local=%v remote=%v", local, remote)
+    }
+    if _, _, err := getConnAndProfile("10.0.0.2"); err == nil || !strings.Contains(err.Error(), "polled by shard s1") {
+        t.Errorf("direct write to a shard's drive: %v", err)
+    }
+}
+
+func TestConfigSync(t *testing.T) {
+    var out []string
+    jsonDiff("config",
+        map[string]interface{}{"SiteName": "A", "VFDs": []interface{}{map[string]interface{}{"IP": "1", "Group": "1"}, map[string]interface{}{"IP": "2"}}},
+        map[string]interface{}{"VFDs": []interface{}{map[string]interface{}{"IP": "3"}, map[string]interface{}{"IP": "1", "Group": "2"}}, "BindPort": "80"},
+        &out)
+    want := []string{`+ config.BindPort: "80"`, `- config.SiteName: "A"`, `~ config.VFDs[1].Group: "1" -> "2"`, `- config.VFDs[2]: {"IP":"2"}`, `+ config.VFDs[3]: {"IP":"3"}`}
+    if strings.Join(out, "\n") != strings.Join(want, "\n") {
+        t.Errorf("diff:\n%s", strings.Join(out, "\n"))
+    }
+
+    savedConfig, savedIPs, savedData, savedProfiles := appConfig, ipToDrive, vfdData, driveTypeProfiles
+    configSyncMu.Lock()
+    savedState := configSyncState
+    configSyncState = ConfigSyncStatus{}
+    configSyncMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive, vfdData, driveTypeProfiles = savedConfig, savedIPs, savedData, savedProfiles
+        configSyncMu.Lock()
+        configSyncState = savedState
+        configSyncMu.Unlock()
+    }()
+    dir := t.TempDir()
+    profiles, config := dir+"/drive_profiles.json", dir+"/config.json"
+    os.WriteFile(profiles, []byte(`{"A": {"Setpoint": [1], "Control": 0, "StartValue": 1, "StopValue": 0, "Status": 5, "OutputFrequency": 6, "OutputCurrent": 7, "StatusBits": {"Enabled": 0}}}`), 0644)
+    current := `{"VFDs": [{"ID": "fan-1", "IP": "10.0.0.1", "Port": 502, "Unit": 1, "DriveType": "A", "Group": "1", "RpmHz": 29}]}`
+    os.WriteFile(config, []byte(current), 0644)
+    appConfig = AppConfig{VFDs: []DriveConfig{{ID: "fan-1", IP: "10.0.0.1", Port: 502, Unit: 1, DriveType: "A", Group: "1"}}}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0]}
+    vfdData = nil
+
+    served := current
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(served)) }))
+    defer srv.Close()
+    c := &ConfigSyncConfig{URL: srv.URL}
+    if err := checkConfigSync(c, config, profiles); err != nil || !configSyncState.InSync || configSyncState.Pending != nil {
+        t.Fatalf("unchanged source: err=%v state=%+v", err, configSyncState)
+    }
+
+    // An invalid revision is held with its problems and can't be applied
+    served = `{"VFDs": [{"IP": "10.0.0.1", "DriveType": "Missing"}]}`
+    checkConfigSync(c, config, profiles)
+    if p := configSyncState.Pending; p == nil || len(p.Problems) == 0 {
+        t.Fatalf("invalid revision: %+v", p)
+    }
+    configSyncMu.Lock()
+    _, err := applyConfigRevisionLocked(config, profiles, "pat")
+    configSyncMu.Unlock()
+    if err == nil {
+        t.Error("applied a revision with problems")
+    }
+
+    // A valid one waits for approval, then is written and reloaded
+    served = strings.Replace(current, `"Group": "1"`, `"Group": "2"`, 1)
+    checkConfigSync(c, config, profiles)
+    p := configSyncState.Pending
+    if p == nil || len(p.Problems) != 0 || strings.Join(p.Diff, ";") != `~ config.VFDs[10.0.0.1].Group: "1" -> "2"` {
+        t.Fatalf("valid revision: %+v", p)
+    }
+    if d, _ := driveConfig("10.0.0.1"); d.Group != "1" {
+        t.Error("applied without approval")
+    }
+    configSyncMu.Lock()
+    _, err = applyConfigRevisionLocked(config, profiles, "pat")
+    configSyncMu.Unlock()
+    if err != nil {
+        t.Fatal(err)
+    }
+    onDisk, _ := os.ReadFile(config)
+    backup, _ := os.ReadFile(config + ".bak")
+    if d, _ := driveConfig("10.0.0.1"); d.Group != "2" || string(onDisk) != served || string(backup) != current || !configSyncState.InSync {
+        t.Errorf("after approval: group=%s disk=%s", d.Group, onDisk)
+    }
+}
+
+// The published client decodes what the handlers actually send, so a renamed field
+// fails here rather than in someone's automation
+func TestAPIClient(t *testing.T) {
+    savedIPs, savedData := ipToDrive, vfdData
+    defer func() { ipToDrive, vfdData = savedIPs, savedData }()
+    d := DriveConfig{ID: "r1f3", IP: "10.0.0.1", Group: "1", FanNumber: 3, DriveType: "Test"}
+    ipToDrive = map[string]*DriveConfig{d.IP: &d}
+    entry := newVfdEntry(d, time.Unix(1700000000, 0))
+    entry["status"], entry["setSpeed"], entry["faultCode"], entry["power"] = "Running", 45.5, 0, 2.25
+    vfdData = []map[string]interface{}{entry}
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/api/devices", handleDevices)
+    mux.HandleFunc("/api/control", handleControl)
+    mux.HandleFunc("/api/curtail", handleCurtail)
+    mux.HandleFunc("/api/curtail/", handleCurtail)
+    srv := httptest.NewServer(mux)
+    defer srv.Close()
+    c := client.New(srv.URL+"/", "test", "1.0")
+
+    got, err := c.Device(context.Background(), "r1f3")
+    if err != nil || got.IP != d.IP || got.Group != "1" || got.FanNumber != 3 || got.Status != "Running" || got.SetSpeed != 45.5 ||
+        got.FaultCode == nil || *got.FaultCode != 0 || got.Power == nil || *got.Power != 2.25 || got.LastUpdated != 1700000000 {
+        t.Errorf("Device = %+v, %v", got, err)
+    }
+    if _, err := c.Device(context.Background(), "10.0.0.9"); err == nil {
+        t.Error("unknown drive found")
+    }
+    err = c.Control(context.Background(), client.ControlRequest{Drives: []string{d.IP}, Action: "Bogus"})
+    if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusBadRequest || e.Body != "Invalid action" {
+        t.Errorf("Control with a bad action: %v", err)
+    }
+    // Nothing curtailed: Curtailment keeps its single-object contract, Curtailments lists
+    if state, err := c.Curtailment(context.Background()); state != nil || err != nil {
+        t.Errorf("Curtailment = %+v, %v", state, err)
+    }
+    if sessions, err := c.Curtailments(context.Background()); len(sessions) != 0 || err != nil {
+        t.Errorf("Curtailments = %+v, %v", sessions, err)
+    }
+}
+
+func TestCtl(t *testing.T) {
+    savedIPs, savedData, savedNets, savedTokens := ipToDrive, vfdData, allowNets, apiTokens
+    defer func() { ipToDrive, vfdData, allowNets, apiTokens = savedIPs, savedData, savedNets, savedTokens }()
+    d := DriveConfig{ID: "r1f3", IP: "10.0.0.1", Group: "1", FanNumber: 3, DriveType: "Test"}
+    ipToDrive = map[string]*DriveConfig{d.IP: &d}
+    entry := newVfdEntry(d, time.Unix(0, 0))
+    entry["status"], entry["setSpeed"] = "Running", 45.0
+    vfdData = []map[string]interface{}{entry}
+    allowNets, _ = parseAllowLists(map[string][]string{"*": {"127.0.0.1"}})
+    apiTokens = []APIToken{{Name: "jump host", Token: "0123456789abcdef"}}
+    if err := checkAPITokens([]APIToken{{Name: "short", Token: "abc"}}); err == nil {
+        t.Error("short token accepted")
+    }
+
+    mux := http.NewServeMux()
+    handleFunc(mux, "/api/devices", handleDevices)
+    curtailment := `[{"id": "utility", "timestamp": "2026-10-16T14:00:00Z", "groups": ["1"], "target": {"percent": 70}, "resumeAt": "2026-10-16T16:00:00Z",
+        "drives": [{"ip": "10.0.0.1", "group": "1", "setSpeed": 45, "status": "Running", "reducedHz": 31.5}]},
+        {"id": "maintenance", "timestamp": "2026-10-16T15:00:00Z", "groups": ["D"], "drives": []}]`
+    handleFunc(mux, "/api/curtail/sessions", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(curtailment)) })
+    srv := httptest.NewServer(mux)
+    defer srv.Close()
+    ctl := func(args ...string) (int, string, string) {
+        var stdout, stderr bytes.Buffer
+        code := runCtl(append([]string{"-server", srv.URL}, args...), &stdout, &stderr)
+        return code, stdout.String(), stderr.String()
+    }
+
+    // From an allow-listed source the token is accepted; a wrong one is refused
+    if code, out, errOut := ctl("-token", "0123456789abcdef", "list"); code != 0 || !strings.Contains(out, "r1f3") || !strings.Contains(out, "Running") {
+        t.Errorf("list with token: %d %q %q", code, out, errOut)
+    }
+    if code, _, errOut := ctl("-token", "not-the-token-at-all", "list"); code != 1 || !strings.Contains(errOut, "401") {
+        t.Errorf("list with a wrong token: %d %q", code, errOut)
+    }
+    // A valid token doesn't get a source outside the allow-list in
+    r := httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+    r.RemoteAddr = "198.51.100.7:40000"
+    r.Header.Set("Authorization", "Bearer 0123456789abcdef")
+    rec := httptest.NewRecorder()
+    mux.ServeHTTP(rec, r)
+    if rec.Code != http.StatusForbidden {
+        t.Errorf("token from a denied source: %d %s", rec.Code, rec.Body.String())
+    }
+    code, out, _ := ctl("-token", "0123456789abcdef", "curtailment", "utility")
+    if code != 0 || strings.Contains(out, "maintenance") || !strings.Contains(out, "at 70% of their speed") || !strings.Contains(out, "resumes:") || !regexp.MustCompile(`10\.0\.0\.1 +1 +Running +45\.0 +31\.5 Hz`).MatchString(out) {
+        t.Errorf("curtailment: %d %q", code, out)
+    }
+    if code, out, _ := ctl("-token", "0123456789abcdef", "curtailment"); code != 0 || !strings.Contains(out, "id:      utility") || !strings.Contains(out, "id:      maintenance") {
+        t.Errorf("all curtailments: %d %q", code, out)
+    }
+    if code, _, errOut := ctl("-token", "0123456789abcdef", "curtailment", "purge"); code != 1 || !strings.Contains(errOut, "no curtailment purge") {
+        t.Errorf("unknown curtailment: %d %q", code, errOut)
+    }
+    for _, args := range [][]string{{}, {"setspeed", "fast", "r1f3"}, {"setspeed", "45"}, {"stop"}, {"reboot"}, {"curtailment", "a", "b"}} {
+        if code, _, _ := ctl(args...); code != 2 {
+            t.Errorf("ctl %v: exit %d, want 2", args, code)
+        }
+    }
+}
+
+func TestCfmTargets(t *testing.T) {
+    savedCfg, savedIPs := appConfig, ipToDrive
+    cfmMu.Lock()
+    savedTargets, savedSteady := cfmTargets, cfmSteady
+    cfmTargets, cfmSteady = make(map[string]*CfmTarget), make(map[string]steadySpeed)
+    cfmMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive = savedCfg, savedIPs
+        cfmMu.Lock()
+        cfmTargets, cfmSteady = savedTargets, savedSteady
+        cfmMu.Unlock()
+    }()
+    // 60 CFM per Hz each; the third can't convert airflow
+    drives := []DriveConfig{
+        {ID: "a1", IP: "10.0.0.1", Group: "A", RpmToHz: 10, CfmRpm: 6, MinHz: 10, SoftMaxHz: 50},
+        {ID: "a2", IP: "10.0.0.2", Group: "A", RpmToHz: 10, CfmRpm: 6, MinHz: 10, SoftMaxHz: 50},
+        {ID: "b1", IP: "10.0.0.3", Group: "B", MinHz: 10},
+    }
+    appConfig = AppConfig{VFDs: drives}
+    ipToDrive = map[string]*DriveConfig{}
+    for i := range drives {
+        ipToDrive[drives[i].IP] = &drives[i]
+    }
+    live := map[string]map[string]interface{}{"10.0.0.1": {"status": "Running"}, "10.0.0.2": {"status": "Running"}}
+    now := time.Now()
+
+    steps, targets, err := planCfm(1800, []string{"10.0.0.1"}, nil, live, now)
+    if err != nil || len(steps) != 1 || steps[0].Hz != 30 || len(targets) != 1 || targets[0].Key != "10.0.0.1" {
+        t.Errorf("per fan: %+v %+v %v", steps, targets, err)
+    }
+    steps, targets, err = planCfm(4800, nil, []string{"A"}, live, now)
+    if err != nil || len(steps) != 1 || steps[0].Hz != 40 || len(steps[0].IPs) != 2 || targets[0].Key != "group:A" {
+        t.Errorf("per group: %+v %+v %v", steps, targets, err)
+    }
+    for name, args := range map[string][2][]string{
+        "no CfmRpm":         {{"10.0.0.3"}, nil},
+        "drives and groups": {{"10.0.0.1"}, {"A"}},
+        "neither":           {nil, nil},
+        "none running":      {nil, {"B"}},
+    } {
+        if _, _, err := planCfm(1800, args[0], args[1], live, now); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+
+    // Trims wait for the speed to settle, then scale the setpoint by target/actual
+    cfmTargets["10.0.0.1"] = &CfmTarget{Key: "10.0.0.1", Drives: []string{"10.0.0.1"}, Cfm: 1800}
+    cfmTargets["10.0.0.2"] = &CfmTarget{Key: "10.0.0.2", Drives: []string{"10.0.0.2"}, Cfm: 1800}
+    snapshot := []map[string]interface{}{
+        {"ip": "10.0.0.1", "status": "Running", "setSpeed": 30.0, "actualSpeed": 28.3, "actualCfm": 1700},
+        {"ip": "10.0.0.2", "status": "Running", "setSpeed": 30.0, "actualSpeed": 29.9, "actualCfm": 1790},
+    }
+    if trims := checkCfmTargets(snapshot, now); len(trims) != 0 || cfmTargets["10.0.0.1"].Note != "settling" {
+        t.Errorf("trimmed before settling: %+v", trims)
+    }
+    trims := checkCfmTargets(snapshot, now.Add(6*time.Second))
+    if len(trims) != 1 || trims[0].IP != "10.0.0.1" || trims[0].ToHz != 31.8 || cfmTargets["10.0.0.1"].Trims != 1 {
+        t.Errorf("trims: %+v", trims)
+    }
+
+    // A drive in hand is left alone
+    handMu.Lock()
+    savedHand := handModes
+    handModes = map[string]HandMode{"a1": {User: "sam", Since: now}}
+    handMu.Unlock()
+    defer func() {
+        handMu.Lock()
+        handModes = savedHand
+        handMu.Unlock()
+    }()
+    if trims := checkCfmTargets(snapshot, now.Add(12*time.Second)); len(trims) != 0 || !strings.Contains(cfmTargets["10.0.0.1"].Note, "in hand") {
+        t.Errorf("trimmed a drive in hand: %+v %q", trims, cfmTargets["10.0.0.1"].Note)
+    }
+
+    // Another command for a drive ends its target
+    endCfmTargets([]string{"10.0.0.1"}, "SetSpeed")
+    if _, ok := cfmTargets["10.0.0.1"]; ok || cfmTargets["10.0.0.2"] == nil {
+        t.Errorf("targets after SetSpeed: %v", cfmTargets)
+    }
+}
+
+func TestCurrentGovernor(t *testing.T) {
+    savedCfg, savedIPs := appConfig, ipToDrive
+    currentMu.Lock()
+    savedOverloads := currentOverloads
+    currentOverloads = make(map[string]*currentOverload)
+    currentMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive = savedCfg, savedIPs
+        currentMu.Lock()
+        currentOverloads = savedOverloads
+        currentMu.Unlock()
+    }()
+    appConfig = AppConfig{CurrentStepHz: 3}
+    d := DriveConfig{ID: "a1", IP: "10.0.0.1", MaxCurrentA: 20, MinHz: 20}
+    ipToDrive = map[string]*DriveConfig{d.IP: &d, "10.0.0.2": {IP: "10.0.0.2"}}
+    poll := func(current, hz float64) []map[string]interface{} {
+        return []map[string]interface{}{
+            {"ip": "10.0.0.1", "status": "Running", "current": current, "setSpeed": hz},
+            {"ip": "10.0.0.2", "status": "Running", "current": 99.0, "setSpeed": 60.0}, // no limit
+        }
+    }
+    now := time.Now()
+
+    // Over the limit: a step only once it has lasted CurrentConfirmSec, then every confirm period
+    if a := checkCurrents(poll(22, 45), now); len(a) != 0 {
+        t.Errorf("stepped at once: %+v", a)
+    }
+    if a := checkCurrents(poll(22, 45), now.Add(2*time.Second)); len(a) != 0 {
+        t.Errorf("stepped before confirming: %+v", a)
+    }
+    a := checkCurrents(poll(22, 45), now.Add(5*time.Second))
+    if len(a) != 1 || a[0].kind != "step" || a[0].toHz != 42 || !a[0].first {
+        t.Fatalf("first step: %+v", a)
+    }
+    if a := checkCurrents(poll(21, 42), now.Add(7*time.Second)); len(a) != 0 {
+        t.Errorf("stepped again before confirming: %+v", a)
+    }
+    a = checkCurrents(poll(21, 42), now.Add(10*time.Second))
+    if len(a) != 1 || a[0].kind != "step" || a[0].toHz != 39 || a[0].first {
+        t.Errorf("second step: %+v", a)
+    }
+
+    // Never below the minimum speed
+    currentOverloads["10.0.0.1"] = &currentOverload{Since: now, Steps: 5}
+    a = checkCurrents(poll(21, 21), now.Add(5*time.Second))
+    if len(a) != 1 || a[0].kind != "step" || a[0].toHz != 20 {
+        t.Errorf("step to the minimum: %+v", a)
+    }
+    a = checkCurrents(poll(21, 20), now.Add(10*time.Second))
+    if len(a) != 1 || a[0].kind != "floor" || !currentOverloads["10.0.0.1"].AtFloor {
+        t.Errorf("at the minimum: %+v", a)
+    }
+
+    // Back under the limit clears it
+    if a := checkCurrents(poll(18, 20), now.Add(11*time.Second)); len(a) != 1 || a[0].kind != "clear" || len(currentOverloads) != 0 {
+        t.Errorf("clear: %+v %v", a, currentOverloads)
+    }
+}
+
+func TestBaselines(t *testing.T) {
+    savedCfg, savedIPs := appConfig, ipToDrive
+    baselineMu.Lock()
+    savedBaselines, savedScores, savedDevs := driveBaselines, baselineScores, baselineDeviations
+    driveBaselines, baselineScores, baselineDeviations = make(map[string]*DriveBaseline), make(map[string]map[string]BaselineScore), make(map[string]*baselineDeviation)
+    baselineMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive = savedCfg, savedIPs
+        baselineMu.Lock()
+        driveBaselines, baselineScores, baselineDeviations = savedBaselines, savedScores, savedDevs
+        baselineMu.Unlock()
+    }()
+    c := &BaselineConfig{TrainingHours: 1, MinSamples: 10, ConfirmSec: 120}
+    appConfig = AppConfig{Baselines: c}
+    d := DriveConfig{ID: "a1", IP: "10.0.0.1", Group: "1"}
+    ipToDrive = map[string]*DriveConfig{d.IP: &d}
+    poll := func(hz, set, current float64) []map[string]interface{} {
+        return []map[string]interface{}{{"ip": d.IP, "status": "Running", "actualSpeed": hz, "setSpeed": set, "current": current}}
+    }
+    now := time.Now()
+    step := func(current float64) []baselineAction {
+        now = now.Add(time.Minute)
+        return checkBaselines(c, poll(45, 45, current), now)
+    }
+
+    // Training: two hours of normal running, alternating 19.5/20.5 A at 45 Hz
+    for i := 0; i < 120; i++ {
+        if a := step(20 + 0.5*float64(i%2*2-1)); len(a) != 0 {
+            t.Fatalf("action while learning: %+v", a)
+        }
+    }
+    // Ramping samples and samples inside SampleSec are not learned
+    checkBaselines(c, poll(30, 45, 80), now.Add(time.Minute))
+    checkBaselines(c, poll(45, 45, 80), now.Add(time.Second))
+    band := driveBaselines["a1"].Current[9]
+    if band == nil || math.Abs(band.Mean-20) > 0.3 || len(driveBaselines["a1"].Current) != 1 {
+        t.Fatalf("learned bands = %+v", driveBaselines["a1"].Current)
+    }
+
+    // 26 A is far outside: flagged once it has lasted ConfirmSec, and not learned
+    if a := step(26); len(a) != 0 {
+        t.Fatalf("flagged before confirming: %+v", a)
+    }
+    if z := baselineScores["a1"]["current"].Z; z < 4 {
+        t.Errorf("z = %v for 26 A", z)
+    }
+    step(26)
+    a := step(26)
+    if len(a) != 1 || a[0].kind != "flag" {
+        t.Fatalf("after ConfirmSec: %+v", a)
+    }
+    if math.Abs(band.Mean-20) > 0.3 {
+        t.Errorf("deviating samples were learned: mean %v", band.Mean)
+    }
+    if a := step(20); len(a) != 1 || a[0].kind != "clear" {
+        t.Errorf("back to normal: %+v", a)
+    }
+
+    view := baselineView(&d, now)
+    if view["state"] != "scoring" || len(view["current"].([]map[string]interface{})) != 1 {
+        t.Errorf("view = %+v", view)
+    }
+    if !resetBaseline(&d) || baselineView(&d, now)["state"] != "waiting" {
+        t.Error("reset should discard the baseline")
+    }
+}
+
+func TestEmergencyStop(t *testing.T) {
+    savedConfig, savedIPs, savedProfiles, savedConns, savedData := appConfig, ipToDrive, driveTypeProfiles, vfdConnections, vfdData
+    eventsMutex.Lock()
+    savedEvents := controlEvents
+    eventsMutex.Unlock()
+    tagoutsMu.Lock()
+    savedTagouts := tagouts
+    tagouts = map[string]Tagout{"b": {User: "sam", Reason: "belt change"}}
+    tagoutsMu.Unlock()
+    defer func() {
+        appConfig, ipToDrive, driveTypeProfiles, vfdConnections, vfdData = savedConfig, savedIPs, savedProfiles, savedConns, savedData
+        eventsMutex.Lock()
+        controlEvents = savedEvents
+        eventsMutex.Unlock()
+        tagoutsMu.Lock()
+        tagouts = savedTagouts
+        tagoutsMu.Unlock()
+        estopMu.Lock()
+        estopLatch = nil
+        estopMu.Unlock()
+    }()
+    driveTypeProfiles = map[string]DriveTypeProfile{"Plain": {Control: 5, StartValue: 1, StopValue: 0}}
+    appConfig = AppConfig{EStopToken: "fire-panel-0123456789", VFDs: []DriveConfig{{ID: "a", IP: "10.0.0.1", DriveType: "Plain"}, {ID: "b", IP: "10.0.0.2", DriveType: "Plain"}}}
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0], "10.0.0.2": &appConfig.VFDs[1]}
+    vfdData = nil
+    clients := map[string]*fakeWrites{"10.0.0.1": {}, "10.0.0.2": {}}
+    vfdConnections = make(map[string]*VFDConnection)
+    for ip, c := range clients {
+        conn := &VFDConnection{ip: ip, client: c}
+        conn.healthy.Store(true)
+        vfdConnections[ip] = conn
+    }
+    call := func(method, body string) *httptest.ResponseRecorder {
+        rec := httptest.NewRecorder()
+        handleEStop(rec, httptest.NewRequest(method, "/api/estop", strings.NewReader(body)))
+        return rec
+    }
+
+    // The first call only arms
+    if rec := call(http.MethodPost, `{}`); rec.Code != http.StatusBadRequest {
+        t.Errorf("arm without user: %d", rec.Code)
+    }
+    rec := call(http.MethodPost, `{"user": "ops", "reason": "fire watch"}`)
+    var armed struct{ Confirm string }
+    json.NewDecoder(rec.Body).Decode(&armed)
+    if rec.Code != http.StatusAccepted || armed.Confirm == "" || len(clients["10.0.0.1"].writes) != 0 {
+        t.Fatalf("arm: %d %+v, writes %v", rec.Code, armed, clients["10.0.0.1"].writes)
+    }
+    if rec := call(http.MethodPost, `{"confirm": "nope"}`); rec.Code != http.StatusConflict {
+        t.Errorf("wrong confirmation: %d", rec.Code)
+    }
+
+    // Confirmed: every drive is stopped, the tagged-out one too
+    rec = call(http.MethodPost, `{"confirm": "`+armed.Confirm+`"}`)
+    var event ControlEvent
+    json.NewDecoder(rec.Body).Decode(&event)
+    if rec.Code != http.StatusOK || event.Action != "EmergencyStop" || len(event.Drives) != 2 || !event.Drives[0].Success || !event.Drives[1].Success {
+        t.Fatalf("confirm: %d %+v", rec.Code, event)
+    }
+    for ip, c := range clients {
+        if fmt.Sprint(c.writes) != "[5=0]" {
+            t.Errorf("%s writes: %v", ip, c.writes)
+        }
+    }
+    if rec := call(http.MethodPost, `{"confirm": "`+armed.Confirm+`"}`); rec.Code != http.StatusConflict {
+        t.Errorf("a confirmation token is good once: %d", rec.Code)
+    }
+
+    // Latched: no starts until cleared
+    if err := fanStart("10.0.0.1"); !errors.Is(err, errEStopLatched) {
+        t.Errorf("start while latched: %v", err)
+    }
+    if rec := call(http.MethodDelete, `{}`); rec.Code != http.StatusBadRequest {
+        t.Errorf("clear without user: %d", rec.Code)
+    }
+    if rec := call(http.MethodDelete, `{"user": "ops"}`); rec.Code != http.StatusOK {
+        t.Errorf("clear: %d", rec.Code)
+    }
+    if err := fanStart("10.0.0.1"); err != nil || fmt.Sprint(clients["10.0.0.1"].writes) != "[5=0 5=1]" {
+        t.Errorf("start after clearing: %v %v", err, clients["10.0.0.1"].writes)
+    }
+
+    // EStopToken stops in one call
+    if rec := call(http.MethodPost, `{"token": "wrong-token-0123456789"}`); rec.Code != http.StatusUnauthorized {
+        t.Errorf("wrong token: %d", rec.Code)
+    }
+    if rec := call(http.MethodPost, `{"token": "fire-panel-0123456789", "reason": "smoke detector"}`); rec.Code != http.StatusOK || estopError() == nil {
+        t.Errorf("token stop: %d, latched %v", rec.Code, estopError())
+    }
+
+    // Armed stops expire
+    token, expires := armEStop("ops", "", time.Now())
+    if _, ok := confirmEStop(token, expires.Add(time.Second)); ok {
+        t.Error("expired confirmation accepted")
+    }
+}
+
+func TestPurge(t *testing.T) {
+    savedConfig, savedIPs, savedProfiles, savedConns, savedData := appConfig, ipToDrive, driveTypeProfiles, vfdConnections, vfdData
+    vfdDataMutex.Lock()
+    savedSensors := sensorData
+    vfdDataMutex.Unlock()
+    eventsMutex.Lock()
+    savedEvents := controlEvents
+    eventsMutex.Unlock()
+    defer func() {
+        appConfig, ipToDrive, driveTypeProfiles, vfdConnections, vfdData = savedConfig, savedIPs, savedProfiles, savedConns, savedData
+        vfdDataMutex.Lock()
+        sensorData = savedSensors
+        vfdDataMutex.Unlock()
+        eventsMutex.Lock()
+        controlEvents = savedEvents
+        eventsMutex.Unlock()
+        purgeMu.Lock()
+        purgeState, purgeApplied, purgeInputLost = nil, make(map[string]time.Time), false
+        purgeMu.Unlock()
+    }()
+    driveTypeProfiles = map[string]DriveTypeProfile{"Plain": {Setpoint: []int{1}, SetFreqCalc: "* 10", Control: 5, StartValue: 1, StopValue: 0}}
+    appConfig = AppConfig{
+        VFDs: []DriveConfig{
+            {ID: "a", IP: "10.0.0.1", DriveType: "Plain", Group: "exhaust", HardMaxHz: 50},
+            {ID: "b", IP: "10.0.0.2", DriveType: "Plain", Group: "supply"},
+            {ID: "c", IP: "10.0.0.3", DriveType: "Plain", Group: "office"},
+        },
+        Purge: &PurgeConfig{Groups: map[string]PurgeAction{"exhaust": {}, "supply": {Action: "Stop"}}, InputSignal: "panel.purge"},
+    }
+    if err := validatePurge(appConfig.Purge, appConfig); err != nil {
+        t.Fatalf("valid config rejected: %v", err)
+    }
+    for _, bad := range []PurgeConfig{{}, {Groups: map[string]PurgeAction{"attic": {}}}, {Groups: map[string]PurgeAction{"exhaust": {Action: "Spin"}}}} {
+        if err := validatePurge(&bad, appConfig); err == nil {
+            t.Errorf("%+v accepted", bad)
+        }
+    }
+    ipToDrive = map[string]*DriveConfig{"10.0.0.1": &appConfig.VFDs[0], "10.0.0.2": &appConfig.VFDs[1], "10.0.0.3": &appConfig.VFDs[2]}
+    vfdData = []map[string]interface{}{
+        {"ip": "10.0.0.1", "status": "Stopped", "setSpeed": 0.0, "direction": "forward"},
+        {"ip": "10.0.0.2", "status": "Running", "setSpeed": 40.0, "direction": "forward"},
+    }
+    clients := map[string]*fakeWrites{"10.0.0.1": {}, "10.0.0.2": {}, "10.0.0.3": {}}
+    vfdConnections = make(map[string]*VFDConnection)
+    for ip, c := range clients {
+        conn := &VFDConnection{ip: ip, client: c}
+        conn.healthy.Store(true)
+        vfdConnections[ip] = conn
+    }
+    call := func(method, body string) *httptest.ResponseRecorder {
+        rec := httptest.NewRecorder()
+        handlePurge(rec, httptest.NewRequest(method, "/api/purge", strings.NewReader(body)))
+        return rec
+    }
+    reset := func() {
+        for _, c := range clients {
+            c.writes = nil
+        }
+    }
+
+    // Starting from the API: exhaust to its top speed, supply stopped, others untouched
+    if rec := call(http.MethodPost, `{}`); rec.Code != http.StatusBadRequest {
+        t.Errorf("start without user: %d", rec.Code)
+    }
+    rec := call(http.MethodPost, `{"user": "ops", "reason": "smoke on 3"}`)
+    var event ControlEvent
+    json.NewDecoder(rec.Body).Decode(&event)
+    if rec.Code != http.StatusOK || event.Action != "PurgeStart" || len(event.Drives) != 2 {
+        t.Fatalf("start: %d %+v", rec.Code, event)
+    }
+    for ip, want := range map[string]string{"10.0.0.1": "[1=500 5=1]", "10.0.0.2": "[5=0]", "10.0.0.3": "[]"} {
+        if got := fmt.Sprint(clients[ip].writes); got != want {
+            t.Errorf("%s writes %s, want %s", ip, got, want)
+        }
+    }
+    if rec := call(http.MethodPost, `{"user": "ops"}`); rec.Code != http.StatusConflict {
+        t.Errorf("second start: %d", rec.Code)
+    }
+
+    // Purge drives refuse other commands
+    reset()
+    if err := fanStart("10.0.0.2"); err == nil {
+        t.Error("start of a purge drive accepted")
+    }
+    if err := fanStart("10.0.0.3"); err != nil {
+        t.Errorf("start outside purge: %v", err)
+    }
+
+    // A drive that left its purge state is set again, but not within 30 s of the last write
+    snapshot := []map[string]interface{}{
+        {"ip": "10.0.0.1", "status": "Running", "setSpeed": 50.0, "direction": "forward"},
+        {"ip": "10.0.0.2", "status": "Running", "setSpeed": 40.0, "direction": "forward"},
+    }
+    reset()
+    watchPurge(snapshot)
+    if len(clients["10.0.0.2"].writes) != 0 {
+        t.Errorf("reasserted within the interval: %v", clients["10.0.0.2"].writes)
+    }
+    purgeMu.Lock()
+    purgeApplied["10.0.0.1"] = time.Now().Add(-time.Minute)
+    purgeApplied["10.0.0.2"] = time.Now().Add(-time.Minute)
+    purgeMu.Unlock()
+    watchPurge(snapshot)
+    if fmt.Sprint(clients["10.0.0.2"].writes) != "[5=0]" || len(clients["10.0.0.1"].writes) != 0 {
+        t.Errorf("reassert writes: %v %v", clients["10.0.0.1"].writes, clients["10.0.0.2"].writes)
+    }
+
+    // Clearing is refused while the input is on, then restores the drives
+    vfdDataMutex.Lock()
+    sensorData = []map[string]interface{}{{"name": "panel", "status": "Online", "lastUpdated": time.Now().Unix(), "purge": 1.0}}
+    vfdDataMutex.Unlock()
+    if rec := call(http.MethodDelete, `{"user": "ops"}`); rec.Code != http.StatusConflict {
+        t.Errorf("clear with the input on: %d", rec.Code)
+    }
+    vfdDataMutex.Lock()
+    sensorData[0]["purge"] = 0.0
+    vfdDataMutex.Unlock()
+    reset()
+    if rec := call(http.MethodDelete, `{"user": "ops"}`); rec.Code != http.StatusOK {
+        t.Fatalf("clear: %d %s", rec.Code, rec.Body)
+    }
+    for ip, want := range map[string]string{"10.0.0.1": "[5=0]", "10.0.0.2": "[1=400 5=1]"} {
+        if got := fmt.Sprint(clients[ip].writes); got != want {
+            t.Errorf("%s restored with %s, want %s", ip, got, want)
+        }
+    }
+    if rec := call(http.MethodDelete, `{"user": "ops"}`); rec.Code != http.StatusNotFound {
+        t.Errorf("clear when inactive: %d", rec.Code)
+    }
+
+    // The input starts purge on the next poll
+    vfdDataMutex.Lock()
+    sensorData[0]["purge"] = 1.0
+    vfdDataMutex.Unlock()
+    watchPurge(nil)
+    purgeMu.Lock()
+    state := purgeState
+    purgeMu.Unlock()
+    if state == nil || state.Source != "panel.purge" {
+        t.Errorf("input did not start purge: %+v", state)
+    }
+}